@@ -0,0 +1,140 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// AdminServer serves an HTTP API for operators to start, monitor
+// and cancel builds, without needing shell access to the machine
+// where the builder runs. All requests must carry the admin token
+// in an "Authorization: Bearer <token>" header.
+//
+//	POST   /admin/build  starts a build, unless one is already running
+//	GET    /admin/build  returns the status of the current or last build
+//	DELETE /admin/build  cancels the running build
+type adminServer struct {
+	token string
+	build func(ctx context.Context) error
+
+	mutex  sync.Mutex
+	cancel context.CancelFunc // nil if no build is running
+	done   chan struct{}      // closed when the running build has finished
+}
+
+func newAdminServer(token string, build func(ctx context.Context) error) *adminServer {
+	return &adminServer{token: token, build: build}
+}
+
+// ServeHTTP implements the http.Handler interface.
+func (a *adminServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if !a.authorized(req) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="qrank-builder"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if req.URL.Path != "/admin/build" {
+		http.NotFound(w, req)
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+		a.writeStatus(w, http.StatusOK)
+	case http.MethodPost:
+		if !a.start() {
+			http.Error(w, "a build is already running", http.StatusConflict)
+			return
+		}
+		a.writeStatus(w, http.StatusAccepted)
+	case http.MethodDelete:
+		if !a.stop() {
+			http.Error(w, "no build is running", http.StatusConflict)
+			return
+		}
+		a.writeStatus(w, http.StatusOK)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST, DELETE")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// Authorized checks the bearer token of a request in constant time,
+// so that response timing does not leak the token.
+func (a *adminServer) authorized(req *http.Request) bool {
+	token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if !ok || a.token == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) == 1
+}
+
+// Start starts a build in the background, or returns false
+// if a build is already running.
+func (a *adminServer) start() bool {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.cancel != nil {
+		return false
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	a.cancel, a.done = cancel, done
+	progress.start()
+	if logger != nil {
+		logger.Printf("build started via admin API")
+	}
+
+	go func() {
+		defer close(done)
+		err := a.build(ctx)
+		progress.finish(err)
+		if logger != nil {
+			if err != nil {
+				logger.Printf("error: build failed: %v", err)
+			} else {
+				logger.Printf("build finished")
+			}
+		}
+
+		a.mutex.Lock()
+		defer a.mutex.Unlock()
+		a.cancel()
+		a.cancel, a.done = nil, nil
+	}()
+	return true
+}
+
+// Stop cancels the running build and waits for it to wind down,
+// or returns false if no build is running.
+func (a *adminServer) stop() bool {
+	a.mutex.Lock()
+	cancel, done := a.cancel, a.done
+	a.mutex.Unlock()
+	if cancel == nil {
+		return false
+	}
+
+	if logger != nil {
+		logger.Printf("build canceled via admin API")
+	}
+	cancel()
+	<-done
+	return true
+}
+
+func (a *adminServer) writeStatus(w http.ResponseWriter, code int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(progress.Status())
+}
@@ -0,0 +1,103 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func sendAdminRequest(t *testing.T, a *adminServer, method, token string) (int, BuildStatus) {
+	t.Helper()
+	req := httptest.NewRequest(method, "/admin/build", nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	a.ServeHTTP(w, req)
+	var status BuildStatus
+	if w.Code < 300 {
+		if err := json.NewDecoder(w.Body).Decode(&status); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return w.Code, status
+}
+
+func waitForBuildState(t *testing.T, state string) BuildStatus {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if s := progress.Status(); s.State == state {
+			return s
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("build did not reach state %q, got %+v", state, progress.Status())
+	return BuildStatus{}
+}
+
+func TestAdminServer_Unauthorized(t *testing.T) {
+	a := newAdminServer("secret", func(ctx context.Context) error { return nil })
+	for _, token := range []string{"", "wrong", "secret2"} {
+		if code, _ := sendAdminRequest(t, a, "POST", token); code != http.StatusUnauthorized {
+			t.Errorf("token %q: got status %d, want %d", token, code, http.StatusUnauthorized)
+		}
+	}
+
+	// An admin server without a token must not let anyone in.
+	b := newAdminServer("", func(ctx context.Context) error { return nil })
+	if code, _ := sendAdminRequest(t, b, "GET", ""); code != http.StatusUnauthorized {
+		t.Errorf("empty token: got status %d, want %d", code, http.StatusUnauthorized)
+	}
+}
+
+func TestAdminServer_StartAndCancel(t *testing.T) {
+	running := make(chan struct{})
+	a := newAdminServer("secret", func(ctx context.Context) error {
+		progress.setStage("titles", 7)
+		progress.advance()
+		close(running)
+		<-ctx.Done()
+		return ctx.Err()
+	})
+
+	if code, status := sendAdminRequest(t, a, "POST", "secret"); code != http.StatusAccepted || status.State != "running" {
+		t.Fatalf("POST: got %d %+v", code, status)
+	}
+	<-running
+	if code, _ := sendAdminRequest(t, a, "POST", "secret"); code != http.StatusConflict {
+		t.Errorf("second POST: got status %d, want %d", code, http.StatusConflict)
+	}
+
+	code, status := sendAdminRequest(t, a, "GET", "secret")
+	if code != http.StatusOK || status.Stage != "titles" || status.Done != 1 || status.Total != 7 {
+		t.Errorf("GET: got %d %+v", code, status)
+	}
+
+	if code, status := sendAdminRequest(t, a, "DELETE", "secret"); code != http.StatusOK || status.State != "canceled" {
+		t.Errorf("DELETE: got %d %+v", code, status)
+	}
+	if code, _ := sendAdminRequest(t, a, "DELETE", "secret"); code != http.StatusConflict {
+		t.Errorf("second DELETE: got status %d, want %d", code, http.StatusConflict)
+	}
+}
+
+func TestAdminServer_Failure(t *testing.T) {
+	a := newAdminServer("secret", func(ctx context.Context) error {
+		return errors.New("disk full")
+	})
+	if code, _ := sendAdminRequest(t, a, "POST", "secret"); code != http.StatusAccepted {
+		t.Fatalf("POST: got status %d, want %d", code, http.StatusAccepted)
+	}
+	status := waitForBuildState(t, "failed")
+	if status.Error != "disk full" || status.Started == nil || status.Finished == nil {
+		t.Errorf("got %+v", status)
+	}
+}
@@ -0,0 +1,134 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// AggregateCachePrefix is the start of the storage keys of aggregates,
+// such as weekly pageviews, that get shared between builders.
+const aggregateCachePrefix = "internal/qrank-builder/cache/"
+
+// AggregateCacheKey returns the storage key of an aggregate that gets
+// built from a set of dump files, such as the "pageviews" of a week.
+// The key is derived from the names of the dumps relative to the dumps
+// directory, together with their sizes and modification times. Hosts
+// that mount the dumps at different places therefore arrive at the same
+// key, but once Wikimedia re-publishes a dump, the key changes.
+func aggregateCacheKey(stage, unit, dumps string, paths []string, ext string) string {
+	h := sha256.New()
+	for _, path := range paths {
+		name, err := filepath.Rel(dumps, path)
+		if err != nil {
+			name = path
+		}
+		name = filepath.ToSlash(name)
+		if stat, err := os.Stat(path); err == nil {
+			fmt.Fprintf(h, "%s\t%d\t%d\n", name, stat.Size(), stat.ModTime().Unix())
+		} else {
+			fmt.Fprintf(h, "%s\tmissing\n", name)
+		}
+	}
+	id := hex.EncodeToString(h.Sum(nil))[:32]
+	return fmt.Sprintf("%s%s/%s-%s%s", aggregateCachePrefix, stage, unit, id, ext)
+}
+
+// FetchCachedAggregate copies an aggregate from the shared cache to dest,
+// on the server side. The result tells whether the cache had the aggregate.
+// Not all storage implementations report missing objects in the same way,
+// so we list instead of trying to stat a possibly missing object.
+func fetchCachedAggregate(ctx context.Context, bucket, key, dest string, s3 S3) (bool, error) {
+	found := false
+	var size int64
+	opts := minio.ListObjectsOptions{Prefix: key}
+	for obj := range s3.ListObjects(ctx, bucket, opts) {
+		if obj.Err != nil {
+			return false, obj.Err
+		}
+		if obj.Key == key {
+			found, size = true, obj.Size
+		}
+	}
+	if !found {
+		return false, nil
+	}
+
+	// Aggregates are internal files, so we need not preserve their
+	// headers when copying large ones in parts.
+	dst := minio.CopyDestOptions{Bucket: bucket, Object: dest}
+	src := minio.CopySrcOptions{Bucket: bucket, Object: key}
+	var err error
+	if size > maxCopyObjectSize {
+		_, err = s3.ComposeObject(ctx, dst, src)
+	} else {
+		_, err = s3.CopyObject(ctx, dst, src)
+	}
+	if err != nil {
+		return false, err
+	}
+	if logger != nil {
+		logger.Printf("reused %s/%s from shared cache", bucket, key)
+	}
+	return true, nil
+}
+
+// CleanupSharedCache deletes aggregates from the shared cache that are
+// older than maxAge, or that do not fit into maxBytes any more. Aggregates
+// get kept from the most recently written one to the oldest, so the
+// weeks that the next build needs are the last to go. A limit of zero
+// means no limit. In dry-run mode, nothing gets deleted. The result lists
+// the keys of the deleted objects (or, in dry-run mode, of those that
+// would have been deleted).
+func cleanupSharedCache(ctx context.Context, bucket string, maxBytes int64, maxAge time.Duration, now time.Time, dryRun bool, s3 S3) ([]string, error) {
+	var objects []minio.ObjectInfo
+	opts := minio.ListObjectsOptions{Prefix: aggregateCachePrefix, Recursive: true}
+	for obj := range s3.ListObjects(ctx, bucket, opts) {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		objects = append(objects, obj)
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		a, b := objects[i], objects[j]
+		if !a.LastModified.Equal(b.LastModified) {
+			return a.LastModified.After(b.LastModified)
+		}
+		return a.Key > b.Key
+	})
+
+	var deleted []string
+	var total int64
+	for _, obj := range objects {
+		total += obj.Size
+		tooBig := maxBytes > 0 && total > maxBytes
+		tooOld := maxAge > 0 && !obj.LastModified.IsZero() && now.Sub(obj.LastModified) > maxAge
+		if !tooBig && !tooOld {
+			continue
+		}
+		if dryRun {
+			if logger != nil {
+				logger.Printf("dry run, would delete %s/%s from shared cache", bucket, obj.Key)
+			}
+		} else {
+			if err := s3.RemoveObject(ctx, bucket, obj.Key, minio.RemoveObjectOptions{}); err != nil {
+				return deleted, err
+			}
+			if logger != nil {
+				logger.Printf("deleted %s/%s from shared cache", bucket, obj.Key)
+			}
+		}
+		deleted = append(deleted, obj.Key)
+	}
+	return deleted, nil
+}
@@ -0,0 +1,175 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAggregateCacheKey(t *testing.T) {
+	// Two hosts that mount the same dumps at different places.
+	modTime := time.Date(2024, 3, 4, 5, 6, 7, 0, time.UTC)
+	var dirs [2]string
+	for i := range dirs {
+		dirs[i] = t.TempDir()
+		path := filepath.Join(dirs[i], "pageviews-20240304-user.bz2")
+		if err := os.WriteFile(path, []byte("data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	key := func(dir string) string {
+		paths := []string{filepath.Join(dir, "pageviews-20240304-user.bz2")}
+		return aggregateCacheKey("pageviews", "2024-W10", dir, paths, ".zst")
+	}
+	a, b := key(dirs[0]), key(dirs[1])
+	if a != b {
+		t.Errorf("got different keys %q and %q for the same dumps", a, b)
+	}
+	prefix := "internal/qrank-builder/cache/pageviews/2024-W10-"
+	if !strings.HasPrefix(a, prefix) || !strings.HasSuffix(a, ".zst") {
+		t.Errorf("got %q, want %q...", a, prefix)
+	}
+
+	// If a dump gets re-published, the key must change.
+	path := filepath.Join(dirs[1], "pageviews-20240304-user.bz2")
+	if err := os.WriteFile(path, []byte("fixed data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if c := key(dirs[1]); c == a {
+		t.Errorf("key should change when a dump is re-published")
+	}
+}
+
+func TestBuildPageviews_SharedCache(t *testing.T) {
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	ctx := context.Background()
+	cfg := newBuildConfig(filepath.Join("testdata", "dumps"))
+	cfg.NumWeeks = 1
+	year, week := 2023, 12
+	cacheKey := aggregateCacheKey("pageviews", "2023-W12", cfg.Dumps, weeklyPageviewsPaths(cfg.Dumps, year, week), ".zst")
+
+	// Another builder has already aggregated the week.
+	s3 := NewFakeS3()
+	s3.data[cacheKey] = []byte("cached")
+	manifest, err := loadResumeManifest(ctx, cfg.Bucket, s3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := buildPageviews(ctx, cfg, manifest, s3); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(s3.data["pageviews/pageviews-2023-W12.zst"]); got != "cached" {
+		t.Errorf("got %q, want week copied from shared cache", got)
+	}
+
+	// Without the shared cache, the week gets built from the dumps.
+	cfg.SharedCache = false
+	s3 = NewFakeS3()
+	s3.data[cacheKey] = []byte("cached")
+	manifest, err = loadResumeManifest(ctx, cfg.Bucket, s3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := buildPageviews(ctx, cfg, manifest, s3); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(s3.data["pageviews/pageviews-2023-W12.zst"]); got == "cached" {
+		t.Errorf("should not use shared cache when disabled")
+	}
+}
+
+func TestFetchCachedAggregate_Large(t *testing.T) {
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	defer func(size int64) { maxCopyObjectSize = size }(maxCopyObjectSize)
+	maxCopyObjectSize = 3
+	ctx := context.Background()
+	key := aggregateCachePrefix + "pageviews/2023-W12-aaaa.zst"
+	s3 := NewFakeS3()
+	s3.data[key] = []byte("cached")
+	found, err := fetchCachedAggregate(ctx, "qrank", key, "pageviews/pageviews-2023-W12.zst", s3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(s3.data["pageviews/pageviews-2023-W12.zst"]); !found || got != "cached" {
+		t.Errorf("got (%v, %q), want (true, \"cached\")", found, got)
+	}
+}
+
+func TestCleanupSharedCache(t *testing.T) {
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	ctx := context.Background()
+	now := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	dir := t.TempDir()
+	storage := NewLocalStorage(dir)
+	write := func(key string, size int, age time.Duration) {
+		path := filepath.Join(dir, "qrank", filepath.FromSlash(key))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, make([]byte, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+		modTime := now.Add(-age)
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	day := 24 * time.Hour
+	write("internal/qrank-builder/cache/pageviews/2023-W01-aaaa.zst", 100, 500*day)
+	write("internal/qrank-builder/cache/pageviews/2024-W10-bbbb.zst", 100, 80*day)
+	write("internal/qrank-builder/cache/pageviews/2024-W20-cccc.zst", 100, 10*day)
+	write("internal/qrank-builder/cache/pageviews/2024-W21-dddd.zst", 100, 3*day)
+	write("pageviews/pageviews-2023-W01.zst", 100, 500*day)
+
+	// In dry-run mode, nothing gets deleted.
+	got, err := cleanupSharedCache(ctx, "qrank", 250, 400*day, now, true, storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"internal/qrank-builder/cache/pageviews/2024-W10-bbbb.zst",
+		"internal/qrank-builder/cache/pageviews/2023-W01-aaaa.zst",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	got, err = cleanupSharedCache(ctx, "qrank", 250, 400*day, now, false, storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	for _, key := range want {
+		if _, err := os.Stat(filepath.Join(dir, "qrank", filepath.FromSlash(key))); !os.IsNotExist(err) {
+			t.Errorf("%s should have been deleted", key)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "qrank", "pageviews", "pageviews-2023-W01.zst")); err != nil {
+		t.Errorf("files outside the shared cache should be kept, got %v", err)
+	}
+
+	// Only the age limit.
+	got, err = cleanupSharedCache(ctx, "qrank", 0, 5*day, now, false, storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []string{"internal/qrank-builder/cache/pageviews/2024-W20-cccc.zst"}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
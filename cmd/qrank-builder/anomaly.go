@@ -0,0 +1,190 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// AnomalyThresholds tell how much a new release may differ from the
+// previous one before it gets held back as suspicious.
+type anomalyThresholds struct {
+	// Rows is the maximal relative change in the number of items,
+	// such as 0.1 for 10%.
+	Rows float64
+
+	// Pageviews is the maximal relative change in total pageviews.
+	Pageviews float64
+
+	// Distribution is the maximal total variation distance between
+	// the histograms of pageviews, between 0 (the same shape) and 1
+	// (completely disjoint).
+	Distribution float64
+}
+
+// SignalsSummary describes an item signals file in a few numbers.
+type signalsSummary struct {
+	Rows      int64
+	Pageviews int64
+
+	// Histogram[0] is the number of items without pageviews.
+	// For i > 0, Histogram[i] is the number of items whose
+	// pageviews are in the interval [10^(i-1), 10^i).
+	Histogram []int64
+}
+
+// SummarizeSignals reads a zstd-compressed item signals file.
+func summarizeSignals(r io.Reader) (signalsSummary, error) {
+	var s signalsSummary
+	decompressor, err := zstd.NewReader(r)
+	if err != nil {
+		return s, err
+	}
+	defer decompressor.Close()
+
+	scanner := bufio.NewScanner(decompressor)
+	scanner.Scan() // skip header
+	for scanner.Scan() {
+		line := scanner.Text()
+		cols := strings.SplitN(line, ",", 3)
+		if len(cols) < 2 {
+			return s, fmt.Errorf("bad item signals row %q", line)
+		}
+		views, err := strconv.ParseInt(cols[1], 10, 64)
+		if err != nil || views < 0 {
+			return s, fmt.Errorf("bad pageviews in item signals row %q", line)
+		}
+		bucket := 0
+		for v := views; v > 0; v /= 10 {
+			bucket += 1
+		}
+		for len(s.Histogram) <= bucket {
+			s.Histogram = append(s.Histogram, 0)
+		}
+		s.Histogram[bucket] += 1
+		s.Rows += 1
+		s.Pageviews += views
+	}
+	if err := scanner.Err(); err != nil {
+		return s, err
+	}
+	return s, nil
+}
+
+// DetectAnomalies compares the summary of a new release with that
+// of the previous release, and returns a description of each anomaly.
+func detectAnomalies(prev, cur signalsSummary, limits anomalyThresholds) []string {
+	var anomalies []string
+	if prev.Rows > 0 {
+		change := float64(cur.Rows-prev.Rows) / float64(prev.Rows)
+		if math.Abs(change) > limits.Rows {
+			anomalies = append(anomalies, fmt.Sprintf("number of items changed by %+.1f%%, from %d to %d", change*100, prev.Rows, cur.Rows))
+		}
+	}
+	if prev.Pageviews > 0 {
+		change := float64(cur.Pageviews-prev.Pageviews) / float64(prev.Pageviews)
+		if math.Abs(change) > limits.Pageviews {
+			anomalies = append(anomalies, fmt.Sprintf("total pageviews changed by %+.1f%%, from %d to %d", change*100, prev.Pageviews, cur.Pageviews))
+		}
+	}
+	if prev.Rows > 0 && cur.Rows > 0 {
+		var distance float64
+		for i := 0; i < max(len(prev.Histogram), len(cur.Histogram)); i++ {
+			var p, q float64
+			if i < len(prev.Histogram) {
+				p = float64(prev.Histogram[i]) / float64(prev.Rows)
+			}
+			if i < len(cur.Histogram) {
+				q = float64(cur.Histogram[i]) / float64(cur.Rows)
+			}
+			distance += math.Abs(p - q)
+		}
+		distance /= 2
+		if distance > limits.Distribution {
+			anomalies = append(anomalies, fmt.Sprintf("distribution of pageviews shifted by %.3f", distance))
+		}
+	}
+	return anomalies
+}
+
+// PreviousItemSignals returns the storage key of the most recent
+// item signals file that is older than a version, or the empty string
+// if there is none.
+func previousItemSignals(ctx context.Context, cfg *buildConfig, version time.Time, s3 S3) (string, error) {
+	stored, err := storedSizes(ctx, cfg.Bucket, cfg.PublicPrefix+"item_signals-", s3)
+	if err != nil {
+		return "", err
+	}
+	re := regexp.MustCompile(`^item_signals-(\d{8})\.csv\.zst$`)
+	var result string
+	var resultDate time.Time
+	for key := range stored {
+		match := re.FindStringSubmatch(strings.TrimPrefix(key, cfg.PublicPrefix))
+		if match == nil {
+			continue
+		}
+		date, err := time.Parse("20060102", match[1])
+		if err != nil || !date.Before(version) {
+			continue
+		}
+		if result == "" || date.After(resultDate) {
+			result, resultDate = key, date
+		}
+	}
+	return result, nil
+}
+
+// CheckAnomalies compares a newly built item signals file with the
+// previous release in storage. If they differ beyond cfg.Anomalies,
+// it returns an error, unless cfg.Force is set. This prevents
+// publishing releases that are truncated or otherwise broken, but
+// still well-formed.
+func checkAnomalies(ctx context.Context, cfg *buildConfig, path string, version time.Time, s3 S3) error {
+	prevKey, err := previousItemSignals(ctx, cfg, version, s3)
+	if err != nil || prevKey == "" {
+		return err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	cur, err := summarizeSignals(f)
+	if err != nil {
+		return err
+	}
+
+	r, err := NewS3Reader(ctx, cfg.Bucket, prevKey, s3)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	prev, err := summarizeSignals(r)
+	if err != nil {
+		return fmt.Errorf("%s: %w", prevKey, err)
+	}
+
+	anomalies := detectAnomalies(prev, cur, cfg.Anomalies)
+	if len(anomalies) == 0 {
+		return nil
+	}
+	msg := fmt.Sprintf("compared to %s, %s", prevKey, strings.Join(anomalies, "; "))
+	if cfg.Force {
+		logger.Printf("warning: publishing anyway because of -force: %s", msg)
+		return nil
+	}
+	return fmt.Errorf("release looks anomalous, not publishing without -force: %s", msg)
+}
@@ -0,0 +1,124 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSummarizeSignals(t *testing.T) {
+	s3 := NewFakeS3()
+	lines := []string{
+		"item,pageviews_52w,wikitext_bytes,claims,identifiers,sitelinks",
+		"Q1,0,1,1,1,1",
+		"Q2,7,1,1,1,1",
+		"Q3,10,1,1,1,1",
+		"Q4,1234,1,1,1,1",
+	}
+	if err := s3.WriteLines(lines, "signals.zst"); err != nil {
+		t.Fatal(err)
+	}
+	got, err := summarizeSignals(bytes.NewReader(s3.data["signals.zst"]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := signalsSummary{Rows: 4, Pageviews: 1251, Histogram: []int64{1, 1, 1, 0, 1}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestDetectAnomalies(t *testing.T) {
+	limits := anomalyThresholds{Rows: 0.1, Pageviews: 0.25, Distribution: 0.1}
+	prev := signalsSummary{Rows: 1000, Pageviews: 50000, Histogram: []int64{500, 300, 200}}
+	for _, tc := range []struct {
+		cur  signalsSummary
+		want []string
+	}{
+		{signalsSummary{Rows: 1050, Pageviews: 55000, Histogram: []int64{520, 320, 210}}, nil},
+		{
+			signalsSummary{Rows: 500, Pageviews: 25000, Histogram: []int64{250, 150, 100}},
+			[]string{
+				"number of items changed by -50.0%, from 1000 to 500",
+				"total pageviews changed by -50.0%, from 50000 to 25000",
+			},
+		},
+		{
+			signalsSummary{Rows: 1000, Pageviews: 50000, Histogram: []int64{900, 50, 50}},
+			[]string{"distribution of pageviews shifted by 0.400"},
+		},
+	} {
+		got := detectAnomalies(prev, tc.cur, limits)
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("got %q, want %q", got, tc.want)
+		}
+	}
+
+	// Without a previous release, nothing can be anomalous.
+	if got := detectAnomalies(signalsSummary{}, prev, limits); got != nil {
+		t.Errorf("got %q, want nil", got)
+	}
+}
+
+func TestPreviousItemSignals(t *testing.T) {
+	s3 := NewFakeS3()
+	for _, key := range []string{
+		"public/item_signals-20240101.csv.zst",
+		"public/item_signals-20240301.csv.zst",
+		"public/item_signals-20240501.csv.zst",
+		"public/item_signals-20240201.csv.zst.sha256",
+	} {
+		s3.data[key] = []byte("content")
+	}
+	ctx := context.Background()
+	for _, tc := range []struct{ version, want string }{
+		{"2024-05-01", "public/item_signals-20240301.csv.zst"},
+		{"2024-06-01", "public/item_signals-20240501.csv.zst"},
+		{"2024-01-01", ""},
+	} {
+		version, _ := time.Parse(time.DateOnly, tc.version)
+		got, err := previousItemSignals(ctx, newBuildConfig(""), version, s3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tc.want {
+			t.Errorf("version %s: got %q, want %q", tc.version, got, tc.want)
+		}
+	}
+}
+
+func TestCheckAnomalies(t *testing.T) {
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	cfg := newBuildConfig("")
+	ctx := context.Background()
+	header := "item,pageviews_52w,wikitext_bytes,claims,identifiers,sitelinks"
+	s3 := NewFakeS3()
+	prev := []string{header, "Q1,10,1,1,1,1", "Q2,20,1,1,1,1", "Q3,30,1,1,1,1", "Q4,40,1,1,1,1"}
+	if err := s3.WriteLines(prev, "public/item_signals-20240301.csv.zst"); err != nil {
+		t.Fatal(err)
+	}
+	version := time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC)
+
+	good := writeTestItemSignals(t, []string{header, "Q1,11,1,1,1,1", "Q2,19,1,1,1,1", "Q3,30,1,1,1,1", "Q4,41,1,1,1,1"})
+	if err := checkAnomalies(ctx, cfg, good, version, s3); err != nil {
+		t.Error(err)
+	}
+
+	truncated := writeTestItemSignals(t, []string{header, "Q1,11,1,1,1,1"})
+	err := checkAnomalies(ctx, cfg, truncated, version, s3)
+	if err == nil || !strings.Contains(err.Error(), "number of items changed by -75.0%") {
+		t.Errorf("got %v, want error about number of items", err)
+	}
+
+	cfg.Force = true
+	if err := checkAnomalies(ctx, cfg, truncated, version, s3); err != nil {
+		t.Errorf("with -force, got %v", err)
+	}
+}
@@ -0,0 +1,133 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// BackfillRelease is a historical release that is missing in storage,
+// and the date as of which its dumps get taken.
+type backfillRelease struct {
+	AsOf    time.Time
+	Version time.Time
+}
+
+// Key returns the storage key of the release, whose published files
+// have keys that start with prefix.
+func (r backfillRelease) key(prefix string) string {
+	return fmt.Sprintf("%sitem_signals-%s.csv.zst", prefix, r.Version.Format("20060102"))
+}
+
+// MissingReleases returns the historical releases that could be built
+// from the available dumps, but are missing in storage. We look at the
+// end of every month for which Wikidata has been dumped; the release
+// for a month is the one that would have been built from the dumps
+// available at that time. If two months would lead to the same release,
+// such as when dumps are missing for a while, it gets returned once.
+// The result is sorted by date, from oldest to newest.
+func missingReleases(ctx context.Context, cfg *buildConfig, s3 S3) ([]backfillRelease, error) {
+	months, err := dumpedMonths(cfg.Dumps)
+	if err != nil {
+		return nil, err
+	}
+
+	stored, err := storedSizes(ctx, cfg.Bucket, cfg.PublicPrefix+"item_signals-", s3)
+	if err != nil {
+		return nil, err
+	}
+
+	monthCfg := *cfg
+	result := make([]backfillRelease, 0, len(months))
+	seen := make(map[time.Time]bool, len(months))
+	for _, month := range months {
+		monthCfg.AsOf = month.AddDate(0, 1, -1) // last day of month
+		latest, err := LatestPageviewsDump(&monthCfg)
+		if err != nil {
+			logger.Printf("debug: cannot backfill %s: %v", month.Format("2006-01"), err)
+			continue
+		}
+		weeks := pageviewsWeeks(latest, cfg.NumWeeks)
+		pageviews := make([]string, 0, len(weeks))
+		for _, week := range weeks {
+			pageviews = append(pageviews, "pageviews/pageviews-"+week+".zst")
+		}
+		sites, err := ReadWikiSites(nil, &monthCfg)
+		if err != nil {
+			return nil, err
+		}
+
+		r := backfillRelease{AsOf: monthCfg.AsOf, Version: ItemSignalsVersion(pageviews, sites)}
+		if _, found := stored[r.key(cfg.PublicPrefix)]; found || seen[r.Version] {
+			continue
+		}
+		seen[r.Version] = true
+		result = append(result, r)
+	}
+	return result, nil
+}
+
+// DumpedMonths returns the first days of the months for which there
+// is a complete dump of Wikidata, sorted from oldest to newest.
+// Without Wikidata, no release can be built.
+func dumpedMonths(dumps string) ([]time.Time, error) {
+	entries, err := os.ReadDir(filepath.Join(dumps, "wikidatawiki"))
+	if err != nil {
+		return nil, err
+	}
+	months := make([]time.Time, 0, len(entries))
+	for _, e := range entries {
+		dumped, err := time.Parse("20060102", e.Name())
+		if err != nil || !e.IsDir() {
+			continue
+		}
+		// Only count the dump if it is complete.
+		if d, err := siteDumpAsOf(dumps, "wikidatawiki", dumped); err != nil || !d.Equal(dumped) {
+			continue
+		}
+		month := time.Date(dumped.Year(), dumped.Month(), 1, 0, 0, 0, 0, time.UTC)
+		if !slices.Contains(months, month) {
+			months = append(months, month)
+		}
+	}
+	slices.SortFunc(months, func(a, b time.Time) int { return a.Compare(b) })
+	return months, nil
+}
+
+// Backfill builds all historical releases that are missing in storage,
+// one after the other, from oldest to newest. If one of them fails,
+// backfilling stops, so the problem can be fixed before continuing;
+// since releases in storage do not get rebuilt, a later run picks up
+// where the failed one has stopped.
+func backfill(ctx context.Context, client *http.Client, cfg *buildConfig, s3 S3) error {
+	releases, err := missingReleases(ctx, cfg, s3)
+	if err != nil {
+		return err
+	}
+	if len(releases) == 0 {
+		logger.Printf("backfill: no releases missing")
+		return nil
+	}
+
+	for i, r := range releases {
+		version := r.Version.Format(time.DateOnly)
+		logger.Printf("backfill: building release %s from the dumps as of %s, %d of %d", version, r.AsOf.Format(time.DateOnly), i+1, len(releases))
+		releaseCfg := *cfg
+		releaseCfg.AsOf = r.AsOf
+		releaseCtx, span := startSpan(ctx, "backfill release", "version", version)
+		err := Build(releaseCtx, client, &releaseCfg, s3)
+		span.finish(err)
+		if err != nil {
+			return fmt.Errorf("backfilling release %s: %w", version, err)
+		}
+	}
+	logger.Printf("backfill: built %d releases", len(releases))
+	return nil
+}
@@ -0,0 +1,112 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// MakeBackfillDumps creates a dumps directory with Wikidata dumps
+// of some dates, and daily pageviews dumps from start to end.
+// The dump files are empty, since backfill planning only looks
+// at which files exist.
+func makeBackfillDumps(t *testing.T, wikidata []string, start, end time.Time) string {
+	dumps := t.TempDir()
+	touch := func(path string) {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sites, err := os.ReadFile(filepath.Join("testdata", "dumps", "metawiki", "latest", "metawiki-latest-sites.sql.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sitesPath := filepath.Join(dumps, "metawiki", "latest", "metawiki-latest-sites.sql.gz")
+	touch(sitesPath)
+	if err := os.WriteFile(sitesPath, sites, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, ymd := range wikidata {
+		for _, f := range siteDumpFiles {
+			touch(filepath.Join(dumps, "wikidatawiki", ymd, fmt.Sprintf("wikidatawiki-%s-%s", ymd, f)))
+		}
+	}
+	for day := start; !day.After(end); day = day.AddDate(0, 0, 1) {
+		touch(PageviewsPath(dumps, day))
+	}
+	return dumps
+}
+
+func TestDumpedMonths(t *testing.T) {
+	start := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	dumps := makeBackfillDumps(t, []string{"20240201", "20240301", "20240320", "20240501"}, start, start)
+
+	// An incomplete dump does not count.
+	os.Remove(filepath.Join(dumps, "wikidatawiki", "20240501", "wikidatawiki-20240501-page.sql.gz"))
+
+	months, err := dumpedMonths(dumps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]string, 0, len(months))
+	for _, m := range months {
+		got = append(got, m.Format(time.DateOnly))
+	}
+	want := "[2024-02-01 2024-03-01]"
+	if fmt.Sprint(got) != want {
+		t.Errorf("got %v, want %s", got, want)
+	}
+}
+
+func TestMissingReleases(t *testing.T) {
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	start := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	end := time.Date(2024, 4, 30, 0, 0, 0, 0, time.UTC)
+	dumps := makeBackfillDumps(t, []string{"20240201", "20240301", "20240401", "20240420"}, start, end)
+	s3 := NewFakeS3()
+	s3.data["public/item_signals-20240331.csv.zst"] = []byte("march")
+
+	cfg := newBuildConfig(dumps)
+	cfg.NumWeeks = 1
+	releases, err := missingReleases(context.Background(), cfg, s3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// February has no pageviews dumps, so it cannot be backfilled.
+	// The release of March is already stored. For April, the last
+	// full week of pageviews ends on Sunday, 2024-04-28.
+	got := fmt.Sprint(releases)
+	if len(releases) != 1 || releases[0].AsOf.Format(time.DateOnly) != "2024-04-30" || releases[0].Version.Format(time.DateOnly) != "2024-04-28" {
+		t.Errorf("got %s, want one release 2024-04-28 as of 2024-04-30", got)
+	}
+	if !cfg.AsOf.IsZero() {
+		t.Errorf("cfg.AsOf should not have been changed, got %s", cfg.AsOf)
+	}
+}
+
+func TestBackfill_NothingMissing(t *testing.T) {
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	day := time.Date(2024, 3, 31, 0, 0, 0, 0, time.UTC)
+	dumps := makeBackfillDumps(t, []string{"20240301"}, day, day)
+	s3 := NewFakeS3()
+	s3.data["public/item_signals-20240331.csv.zst"] = []byte("march")
+	cfg := newBuildConfig(dumps)
+	cfg.NumWeeks = 1
+	if err := backfill(context.Background(), nil, cfg, s3); err != nil {
+		t.Fatal(err)
+	}
+}
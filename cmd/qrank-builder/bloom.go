@@ -0,0 +1,206 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// BloomFilter is a probabilistic set of Wikidata items. Clients can use
+// it to cheaply check whether an item has a rank at all, before looking
+// it up in the (much larger) QRank file. A Bloom filter never gives false
+// negatives, but it can give false positives.
+//
+// When serialized, the filter starts with the four magic bytes "QRBF",
+// followed by the number of hash functions as big-endian uint32,
+// the number of bits as big-endian uint64, and finally the bits.
+// To test an item such as Q42, hash the number 42 (as big-endian uint64)
+// with 64-bit FNV-1a, and split the hash into a lower and upper 32-bit
+// half h1 and h2. For i in [0, numHashes), bit (h1 + i*h2) mod numBits
+// must be set; bit j is stored in byte j/8 at position j%8 (LSB first).
+type BloomFilter struct {
+	numHashes uint32
+	numBits   uint64
+	bits      []byte
+}
+
+var bloomMagic = []byte("QRBF")
+
+// NewBloomFilter creates an empty Bloom filter that is large enough
+// for `n` items at a false positive rate of `p`.
+func NewBloomFilter(n int64, p float64) *BloomFilter {
+	if n < 1 {
+		n = 1
+	}
+	m := math.Ceil(-float64(n) * math.Log(p) / (math.Ln2 * math.Ln2))
+	numBits := (uint64(m) + 7) / 8 * 8
+	k := math.Round(float64(numBits) / float64(n) * math.Ln2)
+	if k < 1 {
+		k = 1
+	}
+	return &BloomFilter{
+		numHashes: uint32(k),
+		numBits:   numBits,
+		bits:      make([]byte, numBits/8),
+	}
+}
+
+func (b *BloomFilter) hash(item int64) (uint32, uint32) {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(item))
+	h := fnv.New64a()
+	h.Write(buf[:])
+	sum := h.Sum64()
+	return uint32(sum), uint32(sum >> 32)
+}
+
+// Add inserts an item, such as 42 for Q42, into the filter.
+func (b *BloomFilter) Add(item int64) {
+	h1, h2 := b.hash(item)
+	for i := uint32(0); i < b.numHashes; i++ {
+		bit := (uint64(h1) + uint64(i)*uint64(h2)) % b.numBits
+		b.bits[bit/8] |= 1 << (bit % 8)
+	}
+}
+
+// MayContain returns false if an item is definitely not in the filter.
+func (b *BloomFilter) MayContain(item int64) bool {
+	h1, h2 := b.hash(item)
+	for i := uint32(0); i < b.numHashes; i++ {
+		bit := (uint64(h1) + uint64(i)*uint64(h2)) % b.numBits
+		if b.bits[bit/8]&(1<<(bit%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// WriteTo serializes the filter in the format described at BloomFilter.
+func (b *BloomFilter) WriteTo(w io.Writer) (int64, error) {
+	var header [16]byte
+	copy(header[0:4], bloomMagic)
+	binary.BigEndian.PutUint32(header[4:8], b.numHashes)
+	binary.BigEndian.PutUint64(header[8:16], b.numBits)
+	n, err := w.Write(header[:])
+	if err != nil {
+		return int64(n), err
+	}
+	m, err := w.Write(b.bits)
+	return int64(n + m), err
+}
+
+// ReadBloomFilter deserializes a filter that was written by WriteTo.
+func ReadBloomFilter(r io.Reader) (*BloomFilter, error) {
+	var header [16]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	if string(header[0:4]) != string(bloomMagic) {
+		return nil, fmt.Errorf("not a QRank Bloom filter")
+	}
+	b := &BloomFilter{
+		numHashes: binary.BigEndian.Uint32(header[4:8]),
+		numBits:   binary.BigEndian.Uint64(header[8:16]),
+	}
+	if b.numHashes == 0 || b.numBits == 0 || b.numBits%8 != 0 {
+		return nil, fmt.Errorf("bad Bloom filter header")
+	}
+	b.bits = make([]byte, b.numBits/8)
+	if _, err := io.ReadFull(r, b.bits); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// BuildBloomFilter writes a Bloom filter with all items in a QRank file.
+func buildBloomFilter(date time.Time, qrankPath string, outDir string) (string, error) {
+	bloomPath := filepath.Join(
+		outDir,
+		fmt.Sprintf("qrank-bloom-%04d%02d%02d.bin", date.Year(), date.Month(), date.Day()))
+	_, err := os.Stat(bloomPath)
+	if err == nil {
+		return bloomPath, nil // use pre-existing file
+	}
+	if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	// Like in buildStats(), we do two passes over the QRank file:
+	// the first pass counts the lines so we know how big the filter
+	// needs to be, the second pass fills the filter.
+	qrankFile, err := os.Open(qrankPath)
+	if err != nil {
+		return "", err
+	}
+	defer qrankFile.Close()
+
+	qrankReader, err := gzip.NewReader(qrankFile)
+	if err != nil {
+		return "", err
+	}
+	numRanks, err := countLines(qrankReader)
+	if err != nil {
+		return "", err
+	}
+	numRanks -= 1 // Don’t count CSV header.
+
+	if _, err := qrankFile.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	qrankReader, err = gzip.NewReader(qrankFile)
+	if err != nil {
+		return "", err
+	}
+
+	filter := NewBloomFilter(numRanks, 0.01)
+	scanner := bufio.NewScanner(qrankReader)
+	scanner.Scan() // Skip CSV header.
+	for scanner.Scan() {
+		line := scanner.Text()
+		comma := strings.IndexByte(line, ',')
+		if comma < 0 {
+			return "", fmt.Errorf("%s: missing comma in %q", qrankPath, line)
+		}
+		item := ParseItem(line[0:comma])
+		if item == NoItem {
+			return "", fmt.Errorf("%s: bad entity in %q", qrankPath, line)
+		}
+		filter.Add(int64(item))
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+
+	tmpBloomPath := bloomPath + ".tmp"
+	bloomFile, err := os.Create(tmpBloomPath)
+	if err != nil {
+		return "", err
+	}
+	defer bloomFile.Close()
+
+	if _, err := filter.WriteTo(bloomFile); err != nil {
+		return "", err
+	}
+	if err := bloomFile.Sync(); err != nil {
+		return "", err
+	}
+	if err := bloomFile.Close(); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmpBloomPath, bloomPath); err != nil {
+		return "", err
+	}
+
+	return bloomPath, nil
+}
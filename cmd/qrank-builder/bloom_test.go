@@ -0,0 +1,57 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBloomFilter(t *testing.T) {
+	filter := NewBloomFilter(1000, 0.01)
+	for i := int64(1); i <= 1000; i++ {
+		filter.Add(i)
+	}
+	for i := int64(1); i <= 1000; i++ {
+		if !filter.MayContain(i) {
+			t.Fatalf("false negative for Q%d", i)
+		}
+	}
+	falsePositives := 0
+	for i := int64(1001); i <= 11000; i++ {
+		if filter.MayContain(i) {
+			falsePositives += 1
+		}
+	}
+	if falsePositives > 200 {
+		t.Errorf("got %d false positives in 10000 tests, want about 100", falsePositives)
+	}
+}
+
+func TestBuildBloomFilter(t *testing.T) {
+	qrank := filepath.Join(t.TempDir(), "TestBloom-qrank.gz")
+	writeGzipFile(qrank, "Entity,QRank\nQ4,77\nQ2,42\nQ5,42\n")
+	path, err := buildBloomFilter(time.Now(), qrank, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	filter, err := ReadBloomFilter(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, item := range []int64{2, 4, 5} {
+		if !filter.MayContain(item) {
+			t.Errorf("Q%d should be in filter", item)
+		}
+	}
+}
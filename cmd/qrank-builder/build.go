@@ -5,66 +5,340 @@ package main
 
 import (
 	"context"
+	"crypto/ed25519"
 	"fmt"
 	"net/http"
 	"os"
 	"runtime"
 	"slices"
 	"sort"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/klauspost/compress/zstd"
 	"github.com/minio/minio-go/v7"
 	"golang.org/x/sync/errgroup"
 )
 
-// Build runs the entire QRank pipeline.
-func Build(client *http.Client, dumps string, numWeeks int, s3 S3) error {
-	ctx := context.Background()
+// BuildStages lists the stages of the QRank pipeline, in the order
+// in which they run.
+var buildStages = []string{
+	"pageviews",
+	"page_signals",
+	"interwiki_links",
+	"titles",
+	"page_items",
+	"item_signals",
+	"release",
+}
+
+// BuildConfig holds the settings of a build, as given on the command
+// line or in a configuration file.
+type buildConfig struct {
+	// Dumps is the path to the Wikimedia dumps.
+	Dumps string
+
+	// NumWeeks is the number of weeks of pageviews to aggregate.
+	NumWeeks int
+
+	// Stages is the set of pipeline stages to run, or nil to run all.
+	Stages map[string]bool
+
+	// Bucket is the bucket in object storage that holds our files.
+	// Published files have keys that start with PublicPrefix.
+	Bucket       string
+	PublicPrefix string
+
+	// AsOf pins builds to the dumps that were available at a date,
+	// for reproducing past releases or backfilling gaps. If zero,
+	// builds use the latest dumps.
+	AsOf time.Time
+
+	// PinnedSites pins the dumps of each site to a date, for
+	// rebuilding a release from its provenance manifest. If nil,
+	// sites use their dumps as of AsOf.
+	PinnedSites map[string]time.Time
+
+	// Canaries are checks on the pageviews of well-known items.
+	// If any fails, the release does not get published.
+	Canaries []canary
+
+	// Anomalies are the thresholds for holding back a release that
+	// differs too much from the previous one. If Force is true,
+	// such releases get published anyway.
+	Anomalies anomalyThresholds
+	Force     bool
+
+	// Sort tunes the external sorts of the pipeline.
+	Sort sortSettings
+
+	// StreamPageviews tells whether item signals get built by streaming
+	// pageviews straight from the Wikimedia dumps, rather than from
+	// weekly pageview files in storage. This avoids writing, uploading
+	// and again downloading the weekly files, which is useful for
+	// one-shot builds, but every build has to read all the dumps again.
+	StreamPageviews bool
+
+	// Bzip2Command, if not empty, is an external program for
+	// decompressing bzip2 files, such as "lbzip2".
+	Bzip2Command string
+
+	// Limits, if not nil, limit how many dump files get read, and
+	// how many goroutines decompress them, at the same time.
+	Limits *concurrencyLimits
+
+	// CacheLevel, if set, is the zstd level for compressing the
+	// intermediate files that get kept across builds. The best
+	// trade-off depends on whether a build is bound by CPU or by
+	// I/O, such as NFS on Wikimedia Toolforge. If zero, each kind
+	// of file uses its own default level.
+	CacheLevel zstd.EncoderLevel
+
+	// CacheDictionary, if not empty, is a zstd dictionary for
+	// intermediate files such as weekly pageviews, for example
+	// one trained with "zstd --train" on samples of such files.
+	// Files written with a dictionary can only be read with
+	// the same dictionary.
+	CacheDictionary []byte
+
+	// SharedCache tells whether aggregates, such as weekly pageviews,
+	// get shared with other builders and with later runs through a
+	// content-addressed cache in storage.
+	SharedCache bool
+
+	// Queue, if not nil, shares the units of work of a build between
+	// jobs that run at the same time.
+	Queue *workQueue
+
+	// LabelLanguage, if not empty, is the language of the labels
+	// in a labeled variant of the ranking, such as "en".
+	LabelLanguage string
+
+	// SplitTypes tells whether to publish separate rankings for
+	// humans, places, taxa and works.
+	SplitTypes bool
+
+	// ClassStats tells whether the stats of a release should list
+	// the top entities of a few prominent classes, such as cities.
+	ClassStats bool
+
+	// Zstd tells whether CSV files get published with zstandard
+	// compression in addition to gzip.
+	Zstd bool
+
+	// SigningKey, if not nil, signs the checksums of published files.
+	SigningKey ed25519.PrivateKey
+
+	// Mirror, if not nil, is a secondary storage endpoint to which
+	// published files get mirrored, into MirrorBucket.
+	Mirror       S3
+	MirrorBucket string
+}
 
-	pageviews, err := buildPageviews(ctx, dumps, numWeeks, s3)
+// NewBuildConfig returns the default settings for building from
+// the Wikimedia dumps at a path.
+func newBuildConfig(dumps string) *buildConfig {
+	return &buildConfig{
+		Dumps:        dumps,
+		NumWeeks:     52,
+		Bucket:       "qrank",
+		PublicPrefix: "public/",
+		Anomalies:    anomalyThresholds{Rows: 0.1, Pageviews: 0.25, Distribution: 0.1},
+		MirrorBucket: "qrank",
+		SharedCache:  true,
+	}
+}
+
+// CacheLevel returns the zstd level for writing an intermediate file,
+// which is CacheLevel if set, or else the default for that kind of file.
+func (cfg *buildConfig) cacheLevel(dflt zstd.EncoderLevel) zstd.EncoderLevel {
+	if cfg.CacheLevel != 0 {
+		return cfg.CacheLevel
+	}
+	return dflt
+}
+
+// NeedsEntitiesDump tells whether building a release involves
+// a scan of the Wikidata entities dump.
+func (cfg *buildConfig) needsEntitiesDump() bool {
+	return cfg.LabelLanguage != "" || cfg.SplitTypes || cfg.ClassStats
+}
+
+// ParseStages parses a comma-separated list of pipeline stages,
+// such as "titles,item_signals". For an empty string, the result
+// is nil, which means to run all stages.
+func parseStages(s string) (map[string]bool, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	stages := make(map[string]bool, len(buildStages))
+	for _, stage := range strings.Split(s, ",") {
+		stage = strings.TrimSpace(stage)
+		if !slices.Contains(buildStages, stage) {
+			return nil, fmt.Errorf("unknown stage %q, known stages are %s", stage, strings.Join(buildStages, ","))
+		}
+		stages[stage] = true
+	}
+	return stages, nil
+}
+
+// Build runs the QRank pipeline. If cfg.Stages is nil, all stages get
+// run; otherwise, only those in the set. Skipped stages leave their
+// outputs in storage as they are, and later stages read whatever is
+// there. While running, the pipeline reports its current stage
+// to progress.
+func Build(ctx context.Context, client *http.Client, cfg *buildConfig, s3 S3) error {
+	selected := func(stage string) bool {
+		if cfg.Stages == nil || cfg.Stages[stage] {
+			return true
+		}
+		logger.Printf("skipping stage %s", stage)
+		return false
+	}
+
+	manifest, err := loadResumeManifest(ctx, cfg.Bucket, s3)
 	if err != nil {
 		return err
 	}
 
-	sites, err := ReadWikiSites(client, dumps)
+	// Workers must not overwrite the manifest of the coordinator,
+	// which adopts the units built by workers from storage.
+	manifest.readOnly = cfg.Queue.isWorker()
+
+	var pageviews []string
+	if cfg.StreamPageviews {
+		logger.Printf("streaming pageviews from dumps, not building weekly pageview files")
+		pageviews, err = pageviewsKeys(cfg)
+	} else if selected("pageviews") {
+		progress.setStage("pageviews", 0)
+		stageCtx, span := startSpan(ctx, "pageviews")
+		pageviews, err = buildPageviews(stageCtx, cfg, manifest, s3)
+		span.finish(err)
+	} else {
+		pageviews, err = latestStoredPageviews(ctx, cfg, s3)
+	}
 	if err != nil {
 		return err
 	}
-	logger.Printf("found wikimedia dumps for %d sites", len(sites.Sites))
 
-	if err := buildSiteFiles(ctx, "page_signals", buildPageSignals, dumps, sites, s3); err != nil {
+	progress.setStage("sites", 0)
+	sites, err := ReadWikiSites(client, cfg)
+	if err != nil {
 		return err
 	}
+	logger.Printf("found wikimedia dumps for %d sites", len(sites.Sites))
 
-	if err := buildSiteFiles(ctx, "interwiki_links", buildInterwikiLinks, dumps, sites, s3); err != nil {
-		return err
+	if selected("page_signals") {
+		if err := buildSiteFiles(ctx, "page_signals", buildPageSignals, cfg, sites, manifest, s3); err != nil {
+			return err
+		}
 	}
 
-	if err := buildSiteFiles(ctx, "titles", buildTitles, dumps, sites, s3); err != nil {
-		return err
+	if selected("interwiki_links") {
+		if err := buildSiteFiles(ctx, "interwiki_links", buildInterwikiLinks, cfg, sites, manifest, s3); err != nil {
+			return err
+		}
 	}
 
-	if err := buildSiteFiles(ctx, "page_items", buildSite, dumps, sites, s3); err != nil {
-		return err
+	if selected("titles") {
+		if err := buildSiteFiles(ctx, "titles", buildTitles, cfg, sites, manifest, s3); err != nil {
+			return err
+		}
 	}
 
-	_, err = buildItemSignals(ctx, pageviews, sites, s3)
-	if err != nil {
-		return err
+	if selected("page_items") {
+		if err := buildSiteFiles(ctx, "page_items", buildSite, cfg, sites, manifest, s3); err != nil {
+			return err
+		}
+	}
+
+	var release time.Time
+	if selected("item_signals") {
+		progress.setStage("item_signals", 0)
+		stageCtx, span := startSpan(ctx, "item_signals")
+		release, err = buildItemSignals(stageCtx, cfg, pageviews, sites, s3)
+		span.finish(err)
+		if err != nil {
+			return err
+		}
+		key := provenanceKey(cfg.PublicPrefix, release)
+		stored, err := storedSizes(ctx, cfg.Bucket, key, s3)
+		if err != nil {
+			return err
+		}
+		if _, found := stored[key]; !found {
+			p, err := buildProvenance(release, cfg, pageviews, sites)
+			if err != nil {
+				return err
+			}
+			meta := releaseMetadata(release, pageviews)
+			if err := publishProvenance(ctx, p, cfg, release, meta, s3); err != nil {
+				return err
+			}
+		}
+	}
+
+	if selected("release") {
+		// If the item signals were not built in this run, we release
+		// the most recent ones in storage.
+		if release.IsZero() {
+			before := time.Date(9999, 12, 31, 0, 0, 0, 0, time.UTC)
+			if !cfg.AsOf.IsZero() {
+				before = cfg.AsOf.AddDate(0, 0, 1)
+			}
+			release, err = publishedVersion(ctx, cfg, "item_signals", ".csv.zst", before, s3)
+			if err != nil {
+				return err
+			}
+			if release.IsZero() {
+				return fmt.Errorf("no item signals in storage for building a release")
+			}
+		}
+		progress.setStage("release", 0)
+		stageCtx, span := startSpan(ctx, "release")
+		err := buildRelease(stageCtx, cfg, release, pageviews, s3)
+		span.finish(err)
+		if err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
-type SiteFileBuilder func(site *WikiSite, ctx context.Context, dumps string, s3 S3) error
+type SiteFileBuilder func(site *WikiSite, ctx context.Context, cfg *buildConfig, s3 S3) error
+
+func buildSiteFiles(ctx context.Context, filename string, builder SiteFileBuilder, cfg *buildConfig, sites *WikiSites, manifest *resumeManifest, s3 S3) (err error) {
+	ctx, span := startSpan(ctx, filename)
+	defer func() { span.finish(err) }()
 
-func buildSiteFiles(ctx context.Context, filename string, builder SiteFileBuilder, dumps string, sites *WikiSites, s3 S3) error {
-	stored, err := ListStoredFiles(ctx, filename, s3)
+	stored, err := ListStoredFiles(ctx, cfg.Bucket, filename, s3)
 	if err != nil {
 		return err
 	}
+	built := make(map[string]string, len(sites.Sites))
+	inputs := make(map[string]string, len(sites.Sites))
+	buildUnit := func(t WikiSite) func(context.Context) error {
+		return func(ctx context.Context) error {
+			taskCtx, taskSpan := startSpan(ctx, "site", "stage", filename, "site", t.Key)
+			err := builder(&t, taskCtx, cfg, s3)
+			taskSpan.finish(err)
+			if err != nil {
+				return err
+			}
+			stageReadBytes.WithLabelValues(filename).Add(float64(fileSizes(siteStageInputs(cfg.Dumps, &t, filename))))
+			return nil
+		}
+	}
+
+	// Sites that other builders are working on, if there is a work queue.
+	var pending []WikiSite
+	var pendingMutex sync.Mutex
+
 	tasks := make(chan WikiSite, len(sites.Sites))
 	group, groupCtx := errgroup.WithContext(ctx)
-	for i := 0; i < runtime.NumCPU(); i++ {
+	for i := 0; i < runtime.GOMAXPROCS(0); i++ {
 		group.Go(func() error {
 			for {
 				select {
@@ -76,20 +350,38 @@ func buildSiteFiles(ctx context.Context, filename string, builder SiteFileBuilde
 					if !more {
 						return nil
 					}
-					if err := builder(&t, ctx, dumps, s3); err != nil {
+					done, err := cfg.Queue.run(ctx, filename, t.Key, inputs[t.Key], buildUnit(t))
+					if err != nil {
+						return err
+					}
+					if !done {
+						pendingMutex.Lock()
+						pending = append(pending, t)
+						pendingMutex.Unlock()
+						continue
+					}
+					if err := manifest.complete(ctx, filename, t.Key, inputs[t.Key]); err != nil {
 						return err
 					}
+					progress.advance()
 				}
 			}
 		})
 	}
 
-	built := make(map[string]string, len(sites.Sites))
 	for _, site := range sites.Sites {
 		ymd := site.LastDumped.Format("20060102")
-		if arr, ok := stored[site.Key]; !ok || !slices.Contains(arr, ymd) {
-			tasks <- *site
+		input := siteDumpIdentity(cfg.Dumps, site)
+		isStored := slices.Contains(stored[site.Key], ymd)
+		if !manifest.canSkip(filename, site.Key, input, isStored) {
 			built[site.Key] = ymd
+			inputs[site.Key] = input
+		}
+	}
+	progress.setStage(filename, len(built))
+	for _, site := range sites.Sites {
+		if _, ok := built[site.Key]; ok {
+			tasks <- *site
 		}
 	}
 	close(tasks)
@@ -98,15 +390,31 @@ func buildSiteFiles(ctx context.Context, filename string, builder SiteFileBuilde
 		return err
 	}
 
+	for _, t := range pending {
+		done, err := cfg.Queue.await(ctx, filename, t.Key, inputs[t.Key], buildUnit(t))
+		if err != nil {
+			return err
+		}
+		if done {
+			if err := manifest.complete(ctx, filename, t.Key, inputs[t.Key]); err != nil {
+				return err
+			}
+			progress.advance()
+		}
+	}
+
 	// Clean up old files. We only touch those wikis for which we built a new file.
 	for site, ymd := range built {
-		versions := append(stored[site], ymd)
+		versions := stored[site]
+		if !slices.Contains(versions, ymd) {
+			versions = append(versions, ymd)
+		}
 		sort.Strings(versions)
 		pos := slices.Index(versions, ymd)
 		for i := 0; i < pos-2; i += 1 {
 			path := fmt.Sprintf("%s/%s-%s-%s.zst", filename, site, versions[i], filename)
 			opts := minio.RemoveObjectOptions{}
-			if err := s3.RemoveObject(ctx, "qrank", path, opts); err != nil {
+			if err := s3.RemoveObject(ctx, cfg.Bucket, path, opts); err != nil {
 				return err
 			}
 		}
@@ -115,11 +423,11 @@ func buildSiteFiles(ctx context.Context, filename string, builder SiteFileBuilde
 	return nil
 }
 
-func buildSite(site *WikiSite, ctx context.Context, dumps string, s3 S3) error {
+func buildSite(site *WikiSite, ctx context.Context, cfg *buildConfig, s3 S3) error {
 	dest := site.S3Path("page_items") // TODO: change to "links" once implemented
 	logger.Printf("building %s", dest)
 
-	pageItems, err := buildPageItems(ctx, site, dumps)
+	pageItems, err := buildPageItems(ctx, site, cfg)
 	if err != nil {
 		return err
 	}
@@ -130,7 +438,7 @@ func buildSite(site *WikiSite, ctx context.Context, dumps string, s3 S3) error {
 	// will allow us to replace the sort by a (much faster) merge.
 
 	// TODO: Ultimately, we want the resolved links, not any intermediate files.
-	if err := PutInStorage(ctx, pageItems, s3, "qrank", dest, "application/zstd"); err != nil {
+	if err := PutInStorage(ctx, pageItems, s3, cfg.Bucket, dest, "application/zstd"); err != nil {
 		return err
 	}
 
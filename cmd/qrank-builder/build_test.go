@@ -6,6 +6,7 @@ package main
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
@@ -13,6 +14,8 @@ import (
 	"reflect"
 	"slices"
 	"sort"
+	"strings"
+	"sync/atomic"
 	"testing"
 )
 
@@ -26,7 +29,9 @@ func TestBuild(t *testing.T) {
 	dumps := filepath.Join("testdata", "dumps")
 	client := &http.Client{Transport: &FakeWikiSite{}}
 	s3 := NewFakeS3()
-	if err := Build(client, dumps /*numWeeks*/, 1, s3); err != nil {
+	cfg := newBuildConfig(dumps)
+	cfg.NumWeeks = 1
+	if err := Build(context.Background(), client, cfg, s3); err != nil {
 		t.Fatal(err)
 	}
 
@@ -51,6 +56,107 @@ func TestBuild(t *testing.T) {
 	if !slices.Equal(got, want) {
 		t.Errorf("got %v, want %v", got, want)
 	}
+
+	qrank, err := s3.ReadLines("public/qrank-20240501.csv.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"Entity,QRank", "Q662541,3"}; !slices.Equal(qrank, want) {
+		t.Errorf("got %v, want %v", qrank, want)
+	}
+
+	sitelinks, err := s3.ReadLines("public/qrank-sitelinks-20240501.txt.br")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Contains(sitelinks, "rm.wikipedia/obergesteln Q662541") {
+		t.Errorf("got sitelinks %v, want rm.wikipedia/obergesteln Q662541", sitelinks)
+	}
+
+	var stats Stats
+	if err := json.Unmarshal(s3.data["public/qrank-stats-20240501.json"], &stats); err != nil {
+		t.Fatal(err)
+	}
+	var siteViews int64
+	for _, site := range stats.Sites {
+		siteViews += site.Views
+	}
+	if len(stats.Sites) == 0 || siteViews != 3 {
+		t.Errorf("got sites %v, want 3 views in total", stats.Sites)
+	}
+
+	for _, key := range []string{
+		"public/item_signals-20240501.csv.zst",
+		"public/provenance-20240501.json",
+		"public/qrank-20240501.csv.gz",
+		"public/qrank-bloom-20240501.bin",
+		"public/qrank-index-20240501.bin",
+		"public/qrank-top-100k-20240501.csv.gz",
+		"public/qrank-top-1m-20240501.csv.gz",
+		"public/qrank-history-20240501.csv.gz",
+		"public/qrank-stats-20240501.json",
+		"public/qrank-sitelinks-20240501.txt.br",
+		"public/qrank-metadata-20240501.json",
+		"public/qrank-sha256sums-20240501.txt",
+	} {
+		if _, ok := s3.data[key]; !ok {
+			t.Errorf("%s not published", key)
+		}
+		opts := s3.opts[key]
+		if opts.CacheControl != immutableCacheControl || opts.UserMetadata["Release"] != "2024-05-01" {
+			t.Errorf("%s: got %+v", key, opts)
+		}
+		latest := latestKey(cfg.PublicPrefix, key)
+		if !bytes.Equal(s3.data[latest], s3.data[key]) {
+			t.Errorf("%s not copied to %s", key, latest)
+		}
+	}
+}
+
+func TestBuild_EntitiesDump(t *testing.T) {
+	if testing.Short() {
+		t.Skip()
+	}
+
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	dumps := t.TempDir()
+	if err := extractSelftestDumps(dumps); err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: &FakeWikiSite{}}
+	s3 := NewFakeS3()
+	cfg := newBuildConfig(addEntitiesDump(t, dumps))
+	cfg.NumWeeks = 1
+	cfg.LabelLanguage = "en"
+	cfg.Zstd = true
+	if err := Build(context.Background(), client, cfg, s3); err != nil {
+		t.Fatal(err)
+	}
+
+	labeled, err := s3.ReadLines("public/qrank-labels-en-20240501.csv.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"Entity,Label,QRank", "Q662541,,3"}; !slices.Equal(labeled, want) {
+		t.Errorf("got %v, want %v", labeled, want)
+	}
+
+	for _, key := range []string{
+		"public/qrank-20240501.csv.zst",
+		"public/qrank-labels-en-20240501.csv.zst",
+	} {
+		gz, err := s3.ReadLines(strings.TrimSuffix(key, ".zst") + ".gz")
+		if err != nil {
+			t.Fatal(err)
+		}
+		zst, err := s3.ReadLines(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(zst, gz) {
+			t.Errorf("%s: got %v, want %v", key, zst, gz)
+		}
+	}
 }
 
 func TestBuildSiteFiles(t *testing.T) {
@@ -63,26 +169,34 @@ func TestBuildSiteFiles(t *testing.T) {
 	s3.data["foobar/rmwiki-20020203-foobar.zst"] = []byte("old-2002")
 	s3.data["foobar/rmwiki-20030203-foobar.zst"] = []byte("old-2003")
 
-	dumps := filepath.Join("testdata", "dumps")
-	sites, err := ReadWikiSites(nil, dumps)
+	cfg := newBuildConfig(filepath.Join("testdata", "dumps"))
+	sites, err := ReadWikiSites(nil, cfg)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	buildFunc := func(site *WikiSite, ctx context.Context, dumps string, s3 S3) error {
+	var numBuilt atomic.Int32
+	buildFunc := func(site *WikiSite, ctx context.Context, cfg *buildConfig, s3 S3) error {
 		ymd := site.LastDumped.Format("20060102")
 		path := fmt.Sprintf("foobar/%s-%s-foobar.zst", site.Key, ymd)
 		s3.(*FakeS3).data[path] = []byte("fresh-" + ymd[:4])
+		numBuilt.Add(1)
 		return nil
 	}
 
-	if err := buildSiteFiles(ctx, "foobar", buildFunc, dumps, sites, s3); err != nil {
+	manifest, err := loadResumeManifest(ctx, cfg.Bucket, s3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := buildSiteFiles(ctx, "foobar", buildFunc, cfg, sites, manifest, s3); err != nil {
 		t.Fatal(err)
 	}
 
 	got := make([]string, 0, len(s3.data))
 	for path, value := range s3.data {
-		got = append(got, fmt.Sprintf("%s = %s", path, string(value)))
+		if path != resumeManifestKey {
+			got = append(got, fmt.Sprintf("%s = %s", path, string(value)))
+		}
 	}
 	sort.Strings(got)
 
@@ -100,4 +214,50 @@ func TestBuildSiteFiles(t *testing.T) {
 	if !reflect.DeepEqual(got, want) {
 		t.Errorf("got %q, want %q", got, want)
 	}
+	// A restarted build should not rebuild anything, unless
+	// the dumps have changed in the meantime.
+	numBuilt.Store(0)
+	manifest, err = loadResumeManifest(ctx, cfg.Bucket, s3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := buildSiteFiles(ctx, "foobar", buildFunc, cfg, sites, manifest, s3); err != nil {
+		t.Fatal(err)
+	}
+	if n := numBuilt.Load(); n != 0 {
+		t.Errorf("restarted build should not rebuild anything, built %d files", n)
+	}
+	manifest.Stages["foobar"]["rmwiki"] = "republished"
+	if err := buildSiteFiles(ctx, "foobar", buildFunc, cfg, sites, manifest, s3); err != nil {
+		t.Fatal(err)
+	}
+	if n := numBuilt.Load(); n != 1 {
+		t.Errorf("changed dump should be rebuilt, built %d files", n)
+	}
+}
+
+func TestParseStages(t *testing.T) {
+	for _, tc := range []struct {
+		input string
+		want  []string
+	}{
+		{"", nil},
+		{"item_signals", []string{"item_signals"}},
+		{"titles, item_signals", []string{"item_signals", "titles"}},
+		{"titles,rank", []string{"error"}},
+	} {
+		var got []string
+		stages, err := parseStages(tc.input)
+		if err != nil {
+			got = []string{"error"}
+		} else if stages != nil {
+			for stage := range stages {
+				got = append(got, stage)
+			}
+			slices.Sort(got)
+		}
+		if !slices.Equal(got, tc.want) {
+			t.Errorf("parseStages(%q) = %v, want %v", tc.input, got, tc.want)
+		}
+	}
 }
@@ -0,0 +1,350 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/dsnet/compress/bzip2"
+)
+
+// Bzip2SegmentSize is the approximate amount of compressed data that
+// one worker decompresses at a time. The decompressed segments are held
+// in memory until they get consumed, so this should not be too large.
+const bzip2SegmentSize = 1024 * 1024
+
+// Bzip2MaxScan is how far past the end of a segment we look for the
+// start of the next stream. The streams of multistream files are much
+// smaller than this. If we find no stream start within this distance,
+// the file is probably not multistream; instead of scanning all of it
+// in vain, we then decompress the rest of the file sequentially.
+const bzip2MaxScan = 16 * bzip2SegmentSize
+
+// ResolveBzip2Command finds the external program for decompressing
+// bzip2 files. For "auto", this is lbzip2 or pbzip2 if installed, or
+// else the empty string for decompressing in Go.
+func resolveBzip2Command(name string) (string, error) {
+	if name == "" {
+		return "", nil
+	}
+	if name != "auto" {
+		return exec.LookPath(name)
+	}
+	for _, candidate := range []string{"lbzip2", "pbzip2"} {
+		if path, err := exec.LookPath(candidate); err == nil {
+			return path, nil
+		}
+	}
+	return "", nil
+}
+
+// OpenBzip2 opens a bzip2-compressed file for reading. If bzip2Command
+// is set, such as to lbzip2 or pbzip2, we pipe the file through that
+// program. Otherwise, multistream files such as the Wikimedia pageview
+// dumps get decompressed in Go, on multiple cores, within the limits
+// for bzip2 workers. Closing the returned reader also closes the file.
+func openBzip2(path string, bzip2Command string, limits *concurrencyLimits) (io.ReadCloser, error) {
+	if bzip2Command != "" {
+		return startBzip2Command(bzip2Command, path)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	r := newParallelBzip2Reader(file, stat.Size(), bzip2SegmentSize, bzip2MaxScan, runtime.GOMAXPROCS(0), limits.bzip2Slots())
+	return &bzip2File{parallelBzip2Reader: r, file: file}, nil
+}
+
+type bzip2File struct {
+	*parallelBzip2Reader
+	file *os.File
+}
+
+func (f *bzip2File) Close() error {
+	err := f.parallelBzip2Reader.Close()
+	if fileErr := f.file.Close(); err == nil {
+		err = fileErr
+	}
+	return err
+}
+
+// Bzip2Process reads the output of an external program that
+// decompresses a bzip2 file.
+type bzip2Process struct {
+	cmd    *exec.Cmd
+	stdout io.ReadCloser
+	stderr bytes.Buffer
+	waited bool
+	err    error
+}
+
+func startBzip2Command(command string, path string) (*bzip2Process, error) {
+	p := &bzip2Process{cmd: exec.Command(command, "-d", "-c", path)}
+	p.cmd.Stderr = &p.stderr
+	stdout, err := p.cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	p.stdout = stdout
+	if err := p.cmd.Start(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *bzip2Process) Read(buf []byte) (int, error) {
+	n, err := p.stdout.Read(buf)
+	if err == io.EOF {
+		// A corrupt file can make the program exit early,
+		// so we only report EOF if it succeeded.
+		if waitErr := p.wait(); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
+
+func (p *bzip2Process) wait() error {
+	if !p.waited {
+		p.waited = true
+		if err := p.cmd.Wait(); err != nil {
+			msg := strings.TrimSpace(p.stderr.String())
+			p.err = fmt.Errorf("%s: %w: %s", strings.Join(p.cmd.Args, " "), err, msg)
+		}
+	}
+	return p.err
+}
+
+// Close stops the external program if it is still running,
+// for example because our caller stopped reading early.
+func (p *bzip2Process) Close() error {
+	if !p.waited {
+		p.cmd.Process.Kill()
+		p.wait()
+	}
+	return nil
+}
+
+// ParallelBzip2Reader decompresses a multistream bzip2 file, which is
+// a concatenation of independent bzip2 streams. We split the file into
+// segments that start at stream boundaries, and decompress several
+// segments at the same time. The output comes in the original order.
+//
+// The start of a stream is recognized by its magic bytes, which could
+// also appear by chance inside compressed data. In that case, the
+// segment before the false boundary ends in the middle of a stream
+// and fails to decompress. Because all earlier segments did decompress,
+// the failing segment is known to start at a real stream boundary,
+// so we continue by decompressing the rest of the file sequentially.
+// Genuinely corrupt files still fail, with the error of the sequential
+// decompressor. We also decompress sequentially when there is no
+// stream start within maxScan bytes after a segment, as is the case
+// for files with a single stream.
+type parallelBzip2Reader struct {
+	r        io.ReaderAt
+	size     int64
+	segments chan *bzip2Segment
+	done     chan struct{}
+	stop     sync.Once
+	cur      []byte
+	fallback *bzip2.Reader
+	err      error
+
+	// Slots, if not nil, is a semaphore that limits the number of
+	// segments getting decompressed at the same time, shared with
+	// the readers of other files.
+	slots chan struct{}
+}
+
+type bzip2Segment struct {
+	start, end int64
+	data       []byte
+	err        error // from decompressing the segment
+	splitErr   error // from finding the end of the segment
+	sequential bool  // if true, decompress the rest of the file sequentially
+	ready      chan struct{}
+}
+
+func newParallelBzip2Reader(r io.ReaderAt, size int64, segmentSize int64, maxScan int64, workers int, slots chan struct{}) *parallelBzip2Reader {
+	p := &parallelBzip2Reader{
+		r:        r,
+		size:     size,
+		segments: make(chan *bzip2Segment, max(workers, 1)),
+		done:     make(chan struct{}),
+		slots:    slots,
+	}
+	go p.split(segmentSize, maxScan)
+	return p
+}
+
+// Split cuts the file into segments and starts decompressing them.
+// At most len(p.segments) segments wait to be consumed, which bounds
+// both the memory and the number of concurrent workers. If there is
+// a semaphore for bzip2 workers, it further limits the workers.
+func (p *parallelBzip2Reader) split(segmentSize int64, maxScan int64) {
+	defer close(p.segments)
+	var start int64
+	for start < p.size {
+		seg := &bzip2Segment{start: start, ready: make(chan struct{})}
+		scanEnd := min(start+segmentSize+maxScan, p.size)
+		end, found, err := findBzip2Stream(p.r, min(start+segmentSize, p.size), scanEnd, p.size)
+		switch {
+		case err != nil:
+			seg.splitErr = err
+		case found:
+			seg.end = end
+		case scanEnd == p.size:
+			seg.end = p.size
+		default:
+			seg.sequential = true
+		}
+		if seg.splitErr != nil || seg.sequential {
+			close(seg.ready)
+		} else {
+			go seg.decompress(p.r, p.slots, p.done)
+		}
+		select {
+		case p.segments <- seg:
+		case <-p.done:
+			return
+		}
+		if seg.splitErr != nil || seg.sequential {
+			return
+		}
+		start = seg.end
+	}
+}
+
+func (s *bzip2Segment) decompress(r io.ReaderAt, slots chan struct{}, done <-chan struct{}) {
+	defer close(s.ready)
+	if slots != nil {
+		select {
+		case slots <- struct{}{}:
+			defer func() { <-slots }()
+		case <-done:
+			s.err = io.ErrClosedPipe
+			return
+		}
+	}
+	zr, err := bzip2.NewReader(io.NewSectionReader(r, s.start, s.end-s.start), &bzip2.ReaderConfig{})
+	if err != nil {
+		s.err = err
+		return
+	}
+	var buf bytes.Buffer
+	if _, err := buf.ReadFrom(zr); err != nil {
+		s.err = err
+		return
+	}
+	s.data = buf.Bytes()
+}
+
+func (p *parallelBzip2Reader) Read(buf []byte) (int, error) {
+	for {
+		if p.err != nil {
+			return 0, p.err
+		}
+		if p.fallback != nil {
+			return p.fallback.Read(buf)
+		}
+		if len(p.cur) > 0 {
+			n := copy(buf, p.cur)
+			p.cur = p.cur[n:]
+			return n, nil
+		}
+
+		seg, ok := <-p.segments
+		if !ok {
+			// An empty file is not a valid bzip2 stream; let the
+			// sequential decompressor report the error.
+			if p.size == 0 {
+				p.startFallback(0)
+				continue
+			}
+			p.err = io.EOF
+			continue
+		}
+		<-seg.ready
+		if seg.splitErr != nil {
+			p.err = seg.splitErr
+			continue
+		}
+		if seg.err != nil || seg.sequential {
+			p.startFallback(seg.start)
+			continue
+		}
+		p.cur = seg.data
+	}
+}
+
+// StartFallback stops the parallel workers and continues decompressing
+// sequentially, starting at a stream boundary.
+func (p *parallelBzip2Reader) startFallback(start int64) {
+	p.stop.Do(func() { close(p.done) })
+	p.cur = nil
+	p.fallback, p.err = bzip2.NewReader(io.NewSectionReader(p.r, start, p.size-start), &bzip2.ReaderConfig{})
+}
+
+func (p *parallelBzip2Reader) Close() error {
+	p.stop.Do(func() { close(p.done) })
+	p.cur = nil
+	if p.fallback != nil {
+		p.fallback.Close()
+	}
+	return nil
+}
+
+// FindBzip2Stream finds the first bzip2 stream that starts at or
+// after off, but before end. The stream start may extend past end,
+// but not past size. A stream starts with "BZh", a block size digit,
+// and the magic bytes of the first compressed block.
+func findBzip2Stream(r io.ReaderAt, off int64, end int64, size int64) (int64, bool, error) {
+	const magicLen = 10
+	chunk := make([]byte, 64*1024)
+	for off < end {
+		n, err := r.ReadAt(chunk[:min(int64(len(chunk)), size-off)], off)
+		if err != nil && err != io.EOF {
+			return 0, false, err
+		}
+		data := chunk[:n]
+		for i := 0; i+magicLen <= len(data) && off+int64(i) < end; {
+			pos := bytes.Index(data[i:], []byte("BZh"))
+			if pos < 0 || off+int64(i+pos) >= end {
+				break
+			}
+			if isBzip2StreamStart(data[i+pos:]) {
+				return off + int64(i+pos), true, nil
+			}
+			i += pos + 1
+		}
+		if off+int64(n) >= size || n < magicLen {
+			break
+		}
+
+		// A stream start might span the chunk boundary.
+		off += int64(n - magicLen + 1)
+	}
+	return 0, false, nil
+}
+
+func isBzip2StreamStart(b []byte) bool {
+	blockMagic := []byte{0x31, 0x41, 0x59, 0x26, 0x53, 0x59} // π
+	return len(b) >= 10 &&
+		b[0] == 'B' && b[1] == 'Z' && b[2] == 'h' &&
+		b[3] >= '1' && b[3] <= '9' &&
+		bytes.Equal(b[4:10], blockMagic)
+}
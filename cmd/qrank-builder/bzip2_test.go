@@ -0,0 +1,273 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dsnet/compress/bzip2"
+)
+
+// MultistreamBzip2 compresses each of the passed texts into a separate
+// bzip2 stream, and returns the concatenation of all streams.
+func multistreamBzip2(t *testing.T, texts ...string) []byte {
+	var buf bytes.Buffer
+	for _, text := range texts {
+		w, err := bzip2.NewWriter(&buf, &bzip2.WriterConfig{Level: 9})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(w, text); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+func TestParallelBzip2Reader(t *testing.T) {
+	var texts []string
+	for i := 0; i < 50; i++ {
+		var b strings.Builder
+		for j := 0; j < 20; j++ {
+			fmt.Fprintf(&b, "en.wikipedia Page_%d_%d %d mobile-web %d A1\n", i, j, i*100+j, j+1)
+		}
+		texts = append(texts, b.String())
+	}
+	want := strings.Join(texts, "")
+	data := multistreamBzip2(t, texts...)
+
+	for _, segmentSize := range []int64{1, 100, 1000, 1 << 20} {
+		for _, maxScan := range []int64{10, bzip2MaxScan} {
+			for _, workers := range []int{1, 3} {
+				r := newParallelBzip2Reader(bytes.NewReader(data), int64(len(data)), segmentSize, maxScan, workers, nil)
+				got, err := io.ReadAll(r)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(got) != want {
+					t.Errorf("segmentSize=%d, maxScan=%d, workers=%d: got %d bytes, want %d", segmentSize, maxScan, workers, len(got), len(want))
+				}
+				if err := r.Close(); err != nil {
+					t.Error(err)
+				}
+			}
+		}
+	}
+}
+
+func TestParallelBzip2Reader_Corrupt(t *testing.T) {
+	data := multistreamBzip2(t, "foo\n", "bar\n", "baz\n")
+	data[len(data)/2] ^= 0xff
+	r := newParallelBzip2Reader(bytes.NewReader(data), int64(len(data)), 1, bzip2MaxScan, 2, nil)
+	defer r.Close()
+	if _, err := io.ReadAll(r); err == nil {
+		t.Error("expected error for corrupt input")
+	}
+
+	r = newParallelBzip2Reader(bytes.NewReader(nil), 0, 1, bzip2MaxScan, 2, nil)
+	defer r.Close()
+	if _, err := io.ReadAll(r); err == nil {
+		t.Error("expected error for empty input")
+	}
+}
+
+// Make sure we recover when the magic bytes of a stream start appear
+// inside compressed data, rather than at a real stream boundary.
+func TestParallelBzip2Reader_FalseBoundary(t *testing.T) {
+	data := multistreamBzip2(t, "foo\n", "bar\n", "qux\n")
+	second, found, err := findBzip2Stream(bytes.NewReader(data), 1, int64(len(data)), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found {
+		t.Fatal("second stream not found")
+	}
+
+	// Split the first stream in the middle, as if its compressed data
+	// happened to contain the magic bytes.
+	r := &parallelBzip2Reader{
+		r:        bytes.NewReader(data),
+		size:     int64(len(data)),
+		segments: make(chan *bzip2Segment, 2),
+		done:     make(chan struct{}),
+	}
+	for _, s := range [][2]int64{{0, second - 3}, {second - 3, int64(len(data))}} {
+		seg := &bzip2Segment{start: s[0], end: s[1], ready: make(chan struct{})}
+		seg.decompress(r.r, nil, nil)
+		r.segments <- seg
+	}
+	close(r.segments)
+	defer r.Close()
+
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "foo\nbar\nqux\n" {
+		t.Errorf("got %q, want %q", got, "foo\nbar\nqux\n")
+	}
+}
+
+func TestFindBzip2Stream(t *testing.T) {
+	start := []byte{'B', 'Z', 'h', '9', 0x31, 0x41, 0x59, 0x26, 0x53, 0x59}
+	for _, pos := range []int{0, 7, 64*1024 - 5, 64*1024 - 10, 64 * 1024, 200000} {
+		data := make([]byte, 300000)
+		copy(data[pos:], start)
+		got, found, err := findBzip2Stream(bytes.NewReader(data), 0, int64(len(data)), int64(len(data)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !found || got != int64(pos) {
+			t.Errorf("got %d, %v; want %d, true", got, found, pos)
+		}
+
+		// A stream start may extend past the end of the scan,
+		// but must not begin there.
+		_, found, err = findBzip2Stream(bytes.NewReader(data), 0, int64(pos+1), int64(len(data)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !found {
+			t.Errorf("pos=%d, end=%d: stream start not found", pos, pos+1)
+		}
+		_, found, err = findBzip2Stream(bytes.NewReader(data), 0, int64(pos), int64(len(data)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found {
+			t.Errorf("pos=%d, end=%d: found stream start past end", pos, pos)
+		}
+	}
+
+	// A truncated magic at the end of the file is not a stream start.
+	data := append(make([]byte, 100), start[0:8]...)
+	_, found, err := findBzip2Stream(bytes.NewReader(data), 0, int64(len(data)), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found {
+		t.Error("truncated magic should not be a stream start")
+	}
+}
+
+// A file with a single large stream has no stream boundaries to split
+// at, so we should decompress it sequentially without scanning all of it.
+func TestParallelBzip2Reader_SingleStream(t *testing.T) {
+	var b strings.Builder
+	for i := 0; i < 5000; i++ {
+		fmt.Fprintf(&b, "en.wikipedia Page_%d %d mobile-web %d A1\n", i, i, i%7+1)
+	}
+	want := b.String()
+	data := multistreamBzip2(t, want)
+	r := newParallelBzip2Reader(bytes.NewReader(data), int64(len(data)), 100, 100, 3, nil)
+	defer r.Close()
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Errorf("got %d bytes, want %d", len(got), len(want))
+	}
+}
+
+func TestOpenBzip2(t *testing.T) {
+	path := filepath.Join("testdata", "dumps", "other", "pageview_complete", "2023", "2023-03", "pageviews-20230326-user.bz2")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zr, err := bzip2.NewReader(bytes.NewReader(data), &bzip2.ReaderConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := openBzip2(path, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestOpenBzip2_Command(t *testing.T) {
+	command, err := exec.LookPath("bzip2")
+	if err != nil {
+		t.Skip("no bzip2 program installed")
+	}
+	path := filepath.Join(t.TempDir(), "test.bz2")
+	if err := os.WriteFile(path, multistreamBzip2(t, "foo\n", "bar\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	r, err := openBzip2(path, command, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "foo\nbar\n" {
+		t.Errorf("got %q, want %q", got, "foo\nbar\n")
+	}
+
+	// Closing early should stop the program.
+	r, err = openBzip2(path, command, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A corrupt file should give an error, not a silent EOF.
+	corrupt := filepath.Join(t.TempDir(), "corrupt.bz2")
+	if err := os.WriteFile(corrupt, []byte("BZh9 not really bzip2"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	r, err = openBzip2(corrupt, command, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if _, err := io.ReadAll(r); err == nil {
+		t.Error("expected error for corrupt file")
+	}
+}
+
+func TestResolveBzip2Command(t *testing.T) {
+	if got, err := resolveBzip2Command(""); got != "" || err != nil {
+		t.Errorf(`got (%q, %v), want ("", nil)`, got, err)
+	}
+	if _, err := resolveBzip2Command("auto"); err != nil {
+		t.Error(err)
+	}
+	if _, err := resolveBzip2Command("no-such-bzip2-program"); err == nil {
+		t.Error("expected error for missing program")
+	}
+}
@@ -0,0 +1,147 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Canary is a sanity check on the pageviews of a well-known item,
+// such as Q64 for Berlin. If the check fails, something has most likely
+// gone wrong in aggregating the pageviews, so we do not publish.
+type canary struct {
+	Item  int64
+	Floor int64 // minimum pageviews, if Above is zero
+	Above int64 // if not zero, Item must have more pageviews than this item
+}
+
+func (c canary) String() string {
+	if c.Above != 0 {
+		return fmt.Sprintf("Q%d>Q%d", c.Item, c.Above)
+	}
+	return fmt.Sprintf("Q%d>=%d", c.Item, c.Floor)
+}
+
+// ParseCanaries parses a comma-separated list of canaries, such as
+// "Q42>=100000,Q64>=1000000,Q64>Q42". Q42>=100000 means that Q42 must
+// have at least 100000 pageviews; Q64>Q42 means that Q64 must have
+// more pageviews than Q42.
+func parseCanaries(s string) ([]canary, error) {
+	var result []canary
+	for _, spec := range strings.Split(s, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		var c canary
+		var err error
+		if item, floor, ok := strings.Cut(spec, ">="); ok {
+			if c.Item, err = parseCanaryItem(item); err == nil {
+				c.Floor, err = strconv.ParseInt(strings.TrimSpace(floor), 10, 64)
+			}
+		} else if item, above, ok := strings.Cut(spec, ">"); ok {
+			if c.Item, err = parseCanaryItem(item); err == nil {
+				c.Above, err = parseCanaryItem(above)
+			}
+		} else {
+			err = errors.New("expected Q123>=floor or Q123>Q456")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("bad canary %q: %w", spec, err)
+		}
+		result = append(result, c)
+	}
+	return result, nil
+}
+
+func parseCanaryItem(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	id, err := strconv.ParseInt(strings.TrimPrefix(s, "Q"), 10, 64)
+	if err != nil || !strings.HasPrefix(s, "Q") || id <= 0 {
+		return 0, fmt.Errorf("bad item %q", s)
+	}
+	return id, nil
+}
+
+// CheckCanaries reads a zstd-compressed item signals file and checks
+// the pageviews of the canary items. The returned error lists all
+// canaries that have failed.
+func checkCanaries(path string, canaries []canary) error {
+	if len(canaries) == 0 {
+		return nil
+	}
+
+	pageviews := make(map[int64]int64, len(canaries)*2)
+	var last int64
+	for _, c := range canaries {
+		pageviews[c.Item] = 0
+		last = max(last, c.Item)
+		if c.Above != 0 {
+			pageviews[c.Above] = 0
+			last = max(last, c.Above)
+		}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	decompressor, err := zstd.NewReader(f)
+	if err != nil {
+		return err
+	}
+	defer decompressor.Close()
+
+	// The file is sorted by item ID, so we can stop after the last canary.
+	scanner := bufio.NewScanner(decompressor)
+	scanner.Scan() // skip header
+	for scanner.Scan() {
+		line := scanner.Text()
+		item, err := signalsItem(line)
+		if err != nil {
+			return err
+		}
+		if item > last {
+			break
+		}
+		if _, ok := pageviews[item]; ok {
+			cols := strings.SplitN(line, ",", 3)
+			if len(cols) < 2 {
+				return fmt.Errorf("bad item signals row %q", line)
+			}
+			if pageviews[item], err = strconv.ParseInt(cols[1], 10, 64); err != nil {
+				return fmt.Errorf("bad pageviews in item signals row %q", line)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	var failed []string
+	for _, c := range canaries {
+		views := pageviews[c.Item]
+		if c.Above != 0 {
+			if views <= pageviews[c.Above] {
+				failed = append(failed, fmt.Sprintf("%s, but Q%d has %d pageviews and Q%d has %d", c, c.Item, views, c.Above, pageviews[c.Above]))
+			}
+		} else if views < c.Floor {
+			failed = append(failed, fmt.Sprintf("%s, but Q%d has %d pageviews", c, c.Item, views))
+		}
+	}
+	if len(failed) > 0 {
+		slices.Sort(failed)
+		return fmt.Errorf("canary check failed: %s", strings.Join(failed, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseCanaries(t *testing.T) {
+	got, err := parseCanaries("Q42>=100000, Q64>=1000000,Q64>Q42,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := fmt.Sprint(got); s != "[Q42>=100000 Q64>=1000000 Q64>Q42]" {
+		t.Errorf("got %s", s)
+	}
+
+	for _, s := range []string{"Q42", "Q42>=many", "L42>=7", "Q42>Berlin", "Q0>=1"} {
+		if _, err := parseCanaries(s); err == nil {
+			t.Errorf("parseCanaries(%q): expected error", s)
+		}
+	}
+}
+
+func writeTestItemSignals(t *testing.T, lines []string) string {
+	s3 := NewFakeS3()
+	if err := s3.WriteLines(lines, "signals.zst"); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "item_signals.csv.zst")
+	if err := os.WriteFile(path, s3.data["signals.zst"], 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestCheckCanaries(t *testing.T) {
+	path := writeTestItemSignals(t, []string{
+		"item,pageviews_52w,wikitext_bytes,claims,identifiers,sitelinks",
+		"Q5,800,1,1,1,1",
+		"Q42,500,1,1,1,1",
+		"Q64,900,1,1,1,1",
+	})
+	for _, tc := range []struct{ canaries, want string }{
+		{"", ""},
+		{"Q42>=500,Q64>=900,Q64>Q42", ""},
+		{"Q42>=501", "canary check failed: Q42>=501, but Q42 has 500 pageviews"},
+		{"Q42>Q64,Q7>=1", "canary check failed: Q42>Q64, but Q42 has 500 pageviews and Q64 has 900; Q7>=1, but Q7 has 0 pageviews"},
+	} {
+		c, err := parseCanaries(tc.canaries)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := ""
+		if err := checkCanaries(path, c); err != nil {
+			got = err.Error()
+		}
+		if got != tc.want {
+			t.Errorf("canaries %q: got %q, want %q", tc.canaries, got, tc.want)
+		}
+	}
+}
+
+func TestBuild_CanaryFails(t *testing.T) {
+	if testing.Short() {
+		t.Skip()
+	}
+
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	cfg := newBuildConfig(filepath.Join("testdata", "dumps"))
+	cfg.NumWeeks = 1
+	cfg.Canaries = []canary{{Item: 662541, Floor: 4}}
+	client := &http.Client{Transport: &FakeWikiSite{}}
+	s3 := NewFakeS3()
+	err := Build(context.Background(), client, cfg, s3)
+	if err == nil || !strings.Contains(err.Error(), "Q662541>=4, but Q662541 has 3 pageviews") {
+		t.Errorf("got %v, want canary failure", err)
+	}
+	if _, found := s3.data["public/item_signals-20240501.csv.zst"]; found {
+		t.Error("item signals should not have been published")
+	}
+}
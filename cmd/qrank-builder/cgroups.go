@@ -0,0 +1,107 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+)
+
+// CgroupLimits are the CPU and memory limits of the container in which
+// we are running, as enforced by Linux control groups. On Toolforge,
+// a job gets a fraction of a large machine; since Go sizes its thread
+// pool by the number of CPUs of the machine, and knows nothing about
+// the memory quota, we have to tell it.
+type cgroupLimits struct {
+	CPUs   float64 // zero if unlimited
+	Memory int64   // in bytes; zero if unlimited
+}
+
+// ReadCgroupLimits reads the limits of the current process from the
+// cgroup filesystem at root, which is usually /sys/fs/cgroup. We support
+// both the unified hierarchy of cgroup v2, and the cpu and memory
+// controllers of cgroup v1. Limits that cannot be read count as none.
+func readCgroupLimits(root string) cgroupLimits {
+	var limits cgroupLimits
+
+	// cgroup v2: "max 100000" or "200000 100000" in cpu.max,
+	// and "max" or a number of bytes in memory.max.
+	if fields := readCgroupFields(filepath.Join(root, "cpu.max")); len(fields) == 2 {
+		quota, err1 := strconv.ParseFloat(fields[0], 64)
+		period, err2 := strconv.ParseFloat(fields[1], 64)
+		if err1 == nil && err2 == nil && quota > 0 && period > 0 {
+			limits.CPUs = quota / period
+		}
+	} else {
+		quota := readCgroupInt(filepath.Join(root, "cpu", "cpu.cfs_quota_us"))
+		period := readCgroupInt(filepath.Join(root, "cpu", "cpu.cfs_period_us"))
+		if quota > 0 && period > 0 {
+			limits.CPUs = float64(quota) / float64(period)
+		}
+	}
+
+	if mem := readCgroupInt(filepath.Join(root, "memory.max")); mem > 0 {
+		limits.Memory = mem
+	} else if mem := readCgroupInt(filepath.Join(root, "memory", "memory.limit_in_bytes")); mem > 0 {
+		// Without a limit, cgroup v1 reports a huge number
+		// such as 9223372036854771712.
+		if mem < math.MaxInt64/2 {
+			limits.Memory = mem
+		}
+	}
+
+	return limits
+}
+
+func readCgroupFields(path string) []string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	return strings.Fields(string(data))
+}
+
+// ReadCgroupInt reads a number from a cgroup file, returning zero
+// if the file does not exist or says "max".
+func readCgroupInt(path string) int64 {
+	fields := readCgroupFields(path)
+	if len(fields) != 1 {
+		return 0
+	}
+	n, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+// ApplyCgroupLimits sets GOMAXPROCS and the soft memory limit of the
+// Go runtime from the limits of the container, unless they have been
+// set explicitly with the GOMAXPROCS and GOMEMLIMIT environment
+// variables. The memory limit leaves a tenth of the quota for memory
+// that the Go runtime does not manage, such as thread stacks and the
+// buffers of child processes. Everything in the pipeline that runs
+// one goroutine per CPU, such as external sorts and bzip2 workers,
+// goes by GOMAXPROCS.
+func applyCgroupLimits(limits cgroupLimits) {
+	if limits.CPUs > 0 && os.Getenv("GOMAXPROCS") == "" {
+		procs := min(max(int(math.Ceil(limits.CPUs)), 1), runtime.NumCPU())
+		runtime.GOMAXPROCS(procs)
+		if logger != nil {
+			logger.Printf("container has %.2f CPUs, setting GOMAXPROCS to %d", limits.CPUs, procs)
+		}
+	}
+	if limits.Memory > 0 && os.Getenv("GOMEMLIMIT") == "" {
+		limit := limits.Memory / 10 * 9
+		debug.SetMemoryLimit(limit)
+		if logger != nil {
+			logger.Printf("container has %d MiB of memory, setting GOMEMLIMIT to %d MiB", limits.Memory>>20, limit>>20)
+		}
+	}
+}
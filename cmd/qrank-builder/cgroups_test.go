@@ -0,0 +1,80 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"testing"
+)
+
+func TestReadCgroupLimits(t *testing.T) {
+	write := func(root, name, content string) {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	v2 := t.TempDir()
+	write(v2, "cpu.max", "250000 100000\n")
+	write(v2, "memory.max", "6442450944\n")
+
+	v2Unlimited := t.TempDir()
+	write(v2Unlimited, "cpu.max", "max 100000\n")
+	write(v2Unlimited, "memory.max", "max\n")
+
+	v1 := t.TempDir()
+	write(v1, "cpu/cpu.cfs_quota_us", "50000\n")
+	write(v1, "cpu/cpu.cfs_period_us", "100000\n")
+	write(v1, "memory/memory.limit_in_bytes", "2147483648\n")
+
+	v1Unlimited := t.TempDir()
+	write(v1Unlimited, "cpu/cpu.cfs_quota_us", "-1\n")
+	write(v1Unlimited, "cpu/cpu.cfs_period_us", "100000\n")
+	write(v1Unlimited, "memory/memory.limit_in_bytes", "9223372036854771712\n")
+
+	for _, tc := range []struct {
+		name string
+		root string
+		want cgroupLimits
+	}{
+		{"v2", v2, cgroupLimits{CPUs: 2.5, Memory: 6 << 30}},
+		{"v2Unlimited", v2Unlimited, cgroupLimits{}},
+		{"v1", v1, cgroupLimits{CPUs: 0.5, Memory: 2 << 30}},
+		{"v1Unlimited", v1Unlimited, cgroupLimits{}},
+		{"missing", filepath.Join(t.TempDir(), "missing"), cgroupLimits{}},
+	} {
+		if got := readCgroupLimits(tc.root); got != tc.want {
+			t.Errorf("%s: got %+v, want %+v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestApplyCgroupLimits(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(0))
+	defer debug.SetMemoryLimit(debug.SetMemoryLimit(-1))
+	t.Setenv("GOMAXPROCS", "")
+	t.Setenv("GOMEMLIMIT", "")
+
+	applyCgroupLimits(cgroupLimits{CPUs: 0.5, Memory: 10 << 20})
+	if got := runtime.GOMAXPROCS(0); got != 1 {
+		t.Errorf("got GOMAXPROCS=%d, want 1", got)
+	}
+	if got := debug.SetMemoryLimit(-1); got != 9<<20 {
+		t.Errorf("got GOMEMLIMIT=%d, want %d", got, 9<<20)
+	}
+
+	// Explicit settings in the environment take precedence.
+	t.Setenv("GOMEMLIMIT", "1GiB")
+	applyCgroupLimits(cgroupLimits{Memory: 20 << 20})
+	if got := debug.SetMemoryLimit(-1); got != 9<<20 {
+		t.Errorf("got GOMEMLIMIT=%d, want %d", got, 9<<20)
+	}
+}
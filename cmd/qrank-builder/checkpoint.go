@@ -0,0 +1,45 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"os"
+)
+
+// ExitInterrupted is the exit status of the builder after it has been
+// asked to terminate, for example when Kubernetes evicts the job with
+// SIGTERM. The value is EX_TEMPFAIL from sysexits.h, which tells the
+// caller to try again later: the next run resumes from the completed
+// intermediate files instead of starting over.
+const exitInterrupted = 75
+
+// CommitFile makes a completely written temporary file durable, and
+// then gives it its final name. The final name is what marks a file
+// as valid: since the rename happens only after all data has reached
+// the disk, a crash or eviction can never leave an incomplete file
+// under the final name, so the next run can trust every file it finds
+// and only needs to redo the missing ones.
+func commitFile(tmp *os.File, path string) error {
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// ExitIfInterrupted terminates the process with exitInterrupted
+// if the context was canceled by a termination signal.
+func exitIfInterrupted(ctx context.Context) {
+	if ctx.Err() == nil {
+		return
+	}
+	if logger != nil {
+		logger.Printf("qrank-builder interrupted, exiting with status %d; the next run resumes from completed files", exitInterrupted)
+	}
+	os.Exit(exitInterrupted)
+}
@@ -0,0 +1,124 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"os"
+	"path"
+)
+
+// Artifact is a file that gets published to object storage.
+type artifact struct {
+	dest        string // key in object storage, such as "public/qrank-20240301.csv.gz"
+	src         string // path on local disk
+	contentType string
+}
+
+// SHA256File computes the SHA-256 hash of a file, returned in hex encoding.
+func sha256File(p string) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// HashArtifacts computes the SHA-256 hash of every artifact, unless
+// it is already in hashes. The map is keyed by local file path.
+func hashArtifacts(artifacts []artifact, hashes map[string]string) error {
+	for _, a := range artifacts {
+		if _, ok := hashes[a.src]; ok {
+			continue
+		}
+		sum, err := sha256File(a.src)
+		if err != nil {
+			return err
+		}
+		hashes[a.src] = sum
+	}
+	return nil
+}
+
+// WriteChecksums writes a file in the format of the sha256sum tool,
+// listing the SHA-256 hash of every artifact. Artifacts are identified
+// by the base name of their destination key, so that clients can verify
+// their downloads with `sha256sum --check`.
+func writeChecksums(sumsPath string, artifacts []artifact, hashes map[string]string) error {
+	if err := hashArtifacts(artifacts, hashes); err != nil {
+		return err
+	}
+
+	tmpPath := sumsPath + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	for _, a := range artifacts {
+		if _, err := fmt.Fprintf(f, "%s  %s\n", hashes[a.src], path.Base(a.dest)); err != nil {
+			return err
+		}
+	}
+
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, sumsPath)
+}
+
+// LoadSigningKey reads an Ed25519 private key in PKCS #8 PEM format,
+// as generated by `openssl genpkey -algorithm ed25519`.
+func loadSigningKey(keyPath string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data found", keyPath)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	edKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an Ed25519 private key", keyPath)
+	}
+	return edKey, nil
+}
+
+// SignFile writes a detached Ed25519 signature for a file. The signature
+// gets stored next to the signed file, with an additional ".sig" extension.
+// To verify, run `openssl pkeyutl -verify -pubin -inkey public.pem -rawin
+// -in SHA256SUMS -sigfile SHA256SUMS.sig`.
+func signFile(p string, key ed25519.PrivateKey) (string, error) {
+	data, err := os.ReadFile(p)
+	if err != nil {
+		return "", err
+	}
+	sig := ed25519.Sign(key, data)
+	sigPath := p + ".sig"
+	if err := os.WriteFile(sigPath, sig, 0644); err != nil {
+		return "", err
+	}
+	return sigPath, nil
+}
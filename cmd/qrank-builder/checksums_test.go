@@ -0,0 +1,80 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteChecksums(t *testing.T) {
+	dir := t.TempDir()
+	hello := filepath.Join(dir, "hello.txt")
+	if err := os.WriteFile(hello, []byte("Hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	sums := filepath.Join(dir, "sums.txt")
+	artifacts := []artifact{{"public/hello-20240301.txt", hello, "text/plain"}}
+	hashes := make(map[string]string)
+	if err := writeChecksums(sums, artifacts, hashes); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := os.ReadFile(sums)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "185f8db32271fe25f561a6fc938b2e264306ec304eda518007d1764826381969  hello-20240301.txt\n"
+	if string(got) != want {
+		t.Errorf("got %q, want %q", string(got), want)
+	}
+
+	if len(hashes) != 1 || hashes[hello] == "" {
+		t.Errorf("hashes should contain hash of %s, got %v", hello, hashes)
+	}
+}
+
+func TestSignFile(t *testing.T) {
+	dir := t.TempDir()
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPath := filepath.Join(dir, "key.pem")
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	if err := os.WriteFile(keyPath, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := loadSigningKey(keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "SHA256SUMS")
+	if err := os.WriteFile(path, []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sigPath, err := signFile(path, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sig, err := os.ReadFile(sigPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ed25519.Verify(pub, []byte("content"), sig) {
+		t.Error("signature does not verify")
+	}
+}
@@ -0,0 +1,155 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Churn compares a QRank release to its predecessor. Sudden changes
+// in these metrics are a hint that something went wrong in the pipeline.
+type Churn struct {
+	Previous string // date of previous release, such as "2024-02-01"
+	Top      []ChurnTop
+
+	// RankCorrelation is Spearman’s rank correlation coefficient,
+	// computed over the entities that are in the top list of both
+	// releases. The size of that top list is the largest of the sizes
+	// in Top.
+	RankCorrelation float64
+}
+
+// ChurnTop tells how many entities have entered or left a top list.
+type ChurnTop struct {
+	Size    int64
+	Entered int64
+	Left    int64
+}
+
+// ChurnSizes are the sizes of the top lists that get compared by computeChurn.
+var churnSizes = []int64{10000, 100000, 1000000}
+
+// ComputeChurn compares a freshly built QRank file to the previous
+// QRank file in storage. If there is no previous file, the result is nil
+// without error.
+func computeChurn(ctx context.Context, cfg *buildConfig, date time.Time, qrankPath string, sizes []int64, s3 S3) (*Churn, error) {
+	prev, err := PublishedQRankVersion(ctx, cfg, date, s3)
+	if err != nil {
+		return nil, err
+	}
+	if prev.IsZero() {
+		return nil, nil
+	}
+
+	var maxSize int64
+	for _, size := range sizes {
+		maxSize = max(maxSize, size)
+	}
+
+	prevKey := cfg.PublicPrefix + fmt.Sprintf("qrank-%s.csv.gz", prev.Format("20060102"))
+	prevReader, err := NewS3Reader(ctx, cfg.Bucket, prevKey, s3)
+	if err != nil {
+		return nil, err
+	}
+	defer prevReader.Close()
+	prevDecompressor, err := gzip.NewReader(prevReader)
+	if err != nil {
+		return nil, err
+	}
+	oldTop, err := readTopPositions(prevDecompressor, maxSize)
+	if err != nil {
+		return nil, err
+	}
+
+	qrankFile, err := os.Open(qrankPath)
+	if err != nil {
+		return nil, err
+	}
+	defer qrankFile.Close()
+	qrankDecompressor, err := gzip.NewReader(qrankFile)
+	if err != nil {
+		return nil, err
+	}
+	newTop, err := readTopPositions(qrankDecompressor, maxSize)
+	if err != nil {
+		return nil, err
+	}
+
+	churn := &Churn{Previous: prev.Format(time.DateOnly)}
+	for _, size := range sizes {
+		ct := ChurnTop{Size: size}
+		for entity, pos := range newTop {
+			if oldPos, ok := oldTop[entity]; pos <= size && (!ok || oldPos > size) {
+				ct.Entered += 1
+			}
+		}
+		for entity, pos := range oldTop {
+			if newPos, ok := newTop[entity]; pos <= size && (!ok || newPos > size) {
+				ct.Left += 1
+			}
+		}
+		churn.Top = append(churn.Top, ct)
+	}
+	churn.RankCorrelation = rankCorrelation(oldTop, newTop)
+
+	return churn, nil
+}
+
+// ReadTopPositions reads the first n entities of a QRank file
+// and returns their position in the file, starting at 1.
+func readTopPositions(r io.Reader, n int64) (map[string]int64, error) {
+	positions := make(map[string]int64, min(n, 1<<20))
+	scanner := bufio.NewScanner(r)
+	scanner.Scan() // Skip CSV header.
+	for pos := int64(1); pos <= n && scanner.Scan(); pos++ {
+		line := scanner.Text()
+		comma := strings.IndexByte(line, ',')
+		if comma < 0 {
+			return nil, fmt.Errorf("missing comma in %q", line)
+		}
+		positions[line[:comma]] = pos
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return positions, nil
+}
+
+// RankCorrelation computes Spearman’s rank correlation coefficient
+// for the entities that appear in both maps. The positions get
+// re-ranked among these common entities before comparing.
+func rankCorrelation(a, b map[string]int64) float64 {
+	type pair struct{ a, b int64 }
+	pairs := make([]pair, 0, min(len(a), len(b)))
+	for entity, posA := range a {
+		if posB, ok := b[entity]; ok {
+			pairs = append(pairs, pair{posA, posB})
+		}
+	}
+	n := float64(len(pairs))
+	if len(pairs) < 2 {
+		return 0
+	}
+
+	// Positions are unique within each file, so there are no ties.
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i].b < pairs[j].b })
+	for i := range pairs {
+		pairs[i].b = int64(i)
+	}
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i].a < pairs[j].a })
+	var sumSq float64
+	for i, p := range pairs {
+		d := float64(int64(i) - p.b)
+		sumSq += d * d
+	}
+	return 1.0 - 6.0*sumSq/(n*(n*n-1))
+}
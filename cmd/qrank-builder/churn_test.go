@@ -0,0 +1,65 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestComputeChurn(t *testing.T) {
+	s3 := NewFakeS3()
+	prev := filepath.Join(t.TempDir(), "prev.gz")
+	writeGzipFile(prev, "Entity,QRank\nQ4,77\nQ2,42\nQ5,42\nQ1,1\n")
+	data, err := os.ReadFile(prev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s3.data["public/qrank-20240201.csv.gz"] = data
+
+	qrank := filepath.Join(t.TempDir(), "qrank.gz")
+	writeGzipFile(qrank, "Entity,QRank\nQ2,80\nQ4,42\nQ3,7\nQ1,1\n")
+	date := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	got, err := computeChurn(context.Background(), newBuildConfig(""), date, qrank, []int64{1, 3}, s3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := &Churn{
+		Previous: "2024-02-01",
+		Top: []ChurnTop{
+			{Size: 1, Entered: 1, Left: 1},
+			{Size: 3, Entered: 1, Left: 1},
+		},
+		// Q2 and Q4 are in the top 3 of both releases, but swapped.
+		RankCorrelation: -1.0,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestComputeChurn_NoPrevious(t *testing.T) {
+	qrank := filepath.Join(t.TempDir(), "qrank.gz")
+	writeGzipFile(qrank, "Entity,QRank\nQ4,80\n")
+	got, err := computeChurn(context.Background(), newBuildConfig(""), time.Now(), qrank, churnSizes, NewFakeS3())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != nil {
+		t.Errorf("got %+v, want nil", got)
+	}
+}
+
+func TestRankCorrelation(t *testing.T) {
+	a := map[string]int64{"Q1": 1, "Q2": 2, "Q3": 3, "Q4": 4}
+	b := map[string]int64{"Q1": 1, "Q2": 3, "Q3": 7, "Q4": 9, "Q5": 2}
+	if got := rankCorrelation(a, b); got != 1.0 {
+		t.Errorf("got %v, want 1.0", got)
+	}
+}
@@ -35,7 +35,7 @@ func findLatestStats(path string) (time.Time, error) {
 }
 
 func CleanupCache(path string) error {
-	re, err := regexp.Compile(`^(qrank|qviews|sitelinks|stats)-(\d{6,8})\.(br|gz|json)$`)
+	re, err := regexp.Compile(`^(classes|labels-[a-z\-]+|qrank|qrank-bloom|qrank-delta|qrank-history|qrank-index|qrank-human|qrank-labels-[a-z\-]+|qrank-metadata|qrank-place|qrank-sha256sums|qrank-taxon|qrank-top-[0-9a-z]+|qrank-work|qviews|sitelinks|siteviews|stats|types)-(\d{6,8})\.(bin|br|gz|json|txt|txt\.sig|zst)$`)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,60 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"runtime"
+)
+
+// ConcurrencyLimits keep the pipeline from reading too many dump files,
+// or decompressing too much data, at the same time. Reading is bound by
+// I/O, which goes to NFS on Wikimedia Toolforge, whereas decompressing
+// is bound by CPU; therefore, the two limits can be tuned independently.
+// The limits hold across all stages of a build. A nil *concurrencyLimits
+// imposes no limits.
+type concurrencyLimits struct {
+	files chan struct{} // nil for no limit
+	bzip2 chan struct{}
+}
+
+// NewConcurrencyLimits sets up limits for reading at most openFiles
+// dump files at the same time, and for decompressing bzip2 data in at
+// most bzip2Workers goroutines, shared by all files being read. If
+// openFiles is not positive, any number of files may be open; if
+// bzip2Workers is not positive, we use one per CPU.
+func newConcurrencyLimits(openFiles int, bzip2Workers int) *concurrencyLimits {
+	l := &concurrencyLimits{}
+	if openFiles > 0 {
+		l.files = make(chan struct{}, openFiles)
+	}
+	if bzip2Workers <= 0 {
+		bzip2Workers = runtime.GOMAXPROCS(0)
+	}
+	l.bzip2 = make(chan struct{}, bzip2Workers)
+	return l
+}
+
+// AcquireFile blocks until another file may be opened for reading.
+// When done with the file, the caller must call the returned function.
+func (l *concurrencyLimits) acquireFile(ctx context.Context) (func(), error) {
+	if l == nil || l.files == nil {
+		return func() {}, nil
+	}
+	select {
+	case l.files <- struct{}{}:
+		return func() { <-l.files }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Bzip2Slots returns the semaphore for bzip2 decompression workers,
+// or nil if there is no limit.
+func (l *concurrencyLimits) bzip2Slots() chan struct{} {
+	if l == nil {
+		return nil
+	}
+	return l.bzip2
+}
@@ -0,0 +1,96 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestConcurrencyLimits_AcquireFile(t *testing.T) {
+	ctx := context.Background()
+	limits := newConcurrencyLimits(2, 1)
+	release1, err := limits.acquireFile(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	release2, err := limits.acquireFile(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A third file has to wait until one of the others is released.
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := limits.acquireFile(canceled); err != context.Canceled {
+		t.Errorf("got %v, want context.Canceled", err)
+	}
+	release1()
+	release3, err := limits.acquireFile(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	release2()
+	release3()
+}
+
+func TestConcurrencyLimits_Nil(t *testing.T) {
+	var limits *concurrencyLimits
+	release, err := limits.acquireFile(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+	if limits.bzip2Slots() != nil {
+		t.Error("nil limits should have no bzip2 slots")
+	}
+
+	// Without -maxOpenFiles, any number of files may be open.
+	limits = newConcurrencyLimits(0, 0)
+	for i := 0; i < 100; i++ {
+		if _, err := limits.acquireFile(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if cap(limits.bzip2Slots()) < 1 {
+		t.Error("expected at least one bzip2 worker")
+	}
+}
+
+func TestOpenBzip2_Limits(t *testing.T) {
+	var texts []string
+	for i := 0; i < 20; i++ {
+		texts = append(texts, string(bytes.Repeat([]byte{byte('a' + i)}, 1000)))
+	}
+	path := filepath.Join(t.TempDir(), "test.bz2")
+	if err := os.WriteFile(path, multistreamBzip2(t, texts...), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	limits := newConcurrencyLimits(1, 1)
+	var readers []io.ReadCloser
+	for i := 0; i < 3; i++ {
+		r, err := openBzip2(path, "", limits)
+		if err != nil {
+			t.Fatal(err)
+		}
+		readers = append(readers, r)
+	}
+	for _, r := range readers {
+		got, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != 20*1000 {
+			t.Errorf("got %d bytes, want %d", len(got), 20*1000)
+		}
+		if err := r.Close(); err != nil {
+			t.Error(err)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// ConfigSetting is a setting from a configuration file, such as
+// `bucket = "qrank"`, with its value in the string form that
+// the flag package understands.
+type configSetting struct {
+	Key   string
+	Value string
+}
+
+// LoadConfig reads a configuration file and applies its settings to
+// flags. Flags that have been set on the command line take precedence
+// over the file. The keys in the file are the names of the flags.
+//
+// The file is in TOML format, such as
+//
+//	# Where to find the Wikimedia dumps.
+//	dumps = "/public/dumps/public"
+//	weeks = 52
+//	stages = ["titles", "item_signals"]
+//
+//	[storage]
+//	bucket = "qrank"
+//
+// or in YAML format if its name ends in .yaml or .yml. Arrays get
+// joined with commas. Tables only serve to group settings; their
+// names are not part of the keys.
+func loadConfig(path string, flags *flag.FlagSet) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	settings, err := parseConfig(path, file)
+	if err != nil {
+		return err
+	}
+
+	explicit := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+	for _, s := range settings {
+		f := flags.Lookup(s.Key)
+		if f == nil || s.Key == "config" {
+			msg := fmt.Sprintf("%s: unknown setting %q", path, s.Key)
+			if suggestion := suggestFlag(s.Key, flags); suggestion != "" {
+				msg += fmt.Sprintf(", did you mean %q?", suggestion)
+			}
+			return fmt.Errorf("%s", msg)
+		}
+		if explicit[s.Key] {
+			continue
+		}
+		if err := f.Value.Set(s.Value); err != nil {
+			return fmt.Errorf("%s: invalid value for %s: %w", path, s.Key, err)
+		}
+	}
+	return nil
+}
+
+// ParseConfig parses a configuration file, in YAML format if name
+// ends in .yaml or .yml, and in TOML otherwise. The settings are
+// returned in the order of their keys.
+func parseConfig(name string, r io.Reader) ([]configSetting, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc map[string]any
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &doc)
+	default:
+		_, err = toml.Decode(string(data), &doc)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+
+	var settings []configSetting
+	if err := flattenConfig(doc, "", &settings); err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	slices.SortFunc(settings, func(a, b configSetting) int {
+		return strings.Compare(a.Key, b.Key)
+	})
+	for i := 1; i < len(settings); i++ {
+		if settings[i].Key == settings[i-1].Key {
+			return nil, fmt.Errorf("%s: %s is set more than once", name, settings[i].Key)
+		}
+	}
+	return settings, nil
+}
+
+// FlattenConfig appends the settings in a decoded configuration
+// document to out. Tables get flattened, so that a setting has the same
+// key whichever table it is in; table is the path of the enclosing
+// table, such as "storage", for error messages.
+func flattenConfig(doc map[string]any, table string, out *[]configSetting) error {
+	for key, raw := range doc {
+		path := key
+		if table != "" {
+			path = table + "." + key
+		}
+		if t, ok := raw.(map[string]any); ok {
+			if err := flattenConfig(t, path, out); err != nil {
+				return err
+			}
+			continue
+		}
+		value, err := configValue(raw)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		*out = append(*out, configSetting{Key: key, Value: value})
+	}
+	return nil
+}
+
+// ConfigValue converts a decoded TOML or YAML value into the string
+// form that the flag package understands.
+func configValue(v any) (string, error) {
+	switch v := v.(type) {
+	case nil:
+		return "", fmt.Errorf("missing value")
+
+	case string:
+		return v, nil
+
+	case bool, int, int64, uint64, float64:
+		return fmt.Sprint(v), nil
+
+	case time.Time:
+		if v.Hour() == 0 && v.Minute() == 0 && v.Second() == 0 && v.Nanosecond() == 0 {
+			return v.Format(time.DateOnly), nil
+		}
+		return v.Format(time.RFC3339), nil
+
+	case []any:
+		values := make([]string, 0, len(v))
+		for _, item := range v {
+			switch item.(type) {
+			case []any, map[string]any:
+				return "", fmt.Errorf("arrays may only contain plain values")
+			}
+			value, err := configValue(item)
+			if err != nil {
+				return "", err
+			}
+			values = append(values, value)
+		}
+		return strings.Join(values, ","), nil
+
+	default:
+		return "", fmt.Errorf("unsupported value %v", v)
+	}
+}
+
+// SuggestFlag returns the name of the flag that is most similar
+// to a misspelled name, or the empty string if none is close.
+func suggestFlag(name string, flags *flag.FlagSet) string {
+	best, bestDistance := "", 3
+	flags.VisitAll(func(f *flag.Flag) {
+		if strings.EqualFold(f.Name, name) {
+			best, bestDistance = f.Name, 0
+			return
+		}
+		if d := editDistance(strings.ToLower(name), strings.ToLower(f.Name)); d < bestDistance {
+			best, bestDistance = f.Name, d
+		}
+	})
+	return best
+}
+
+// EditDistance returns the Levenshtein distance between two strings.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
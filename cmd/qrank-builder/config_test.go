@@ -0,0 +1,177 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseConfig(t *testing.T) {
+	config := `
+# Settings for qrank-builder.
+dumps = "/public/dumps/public"  # on Toolforge
+weeks = 52
+keepReleases = 1_000
+dryRun = true
+stages = [
+    "titles",
+    "item_signals",
+]
+date = 2024-03-01
+stallTimeout = "6h"
+
+[storage]
+bucket = 'qrank'
+
+[notify]
+notifyIRC = "ircs://irc.libera.chat/#qrank"
+`
+	got, err := parseConfig("test.toml", strings.NewReader(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []configSetting{
+		{"bucket", "qrank"},
+		{"date", "2024-03-01"},
+		{"dryRun", "true"},
+		{"dumps", "/public/dumps/public"},
+		{"keepReleases", "1000"},
+		{"notifyIRC", "ircs://irc.libera.chat/#qrank"},
+		{"stages", "titles,item_signals"},
+		{"stallTimeout", "6h"},
+		{"weeks", "52"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestParseConfig_YAML(t *testing.T) {
+	config := `
+# Settings for qrank-builder.
+dumps: /public/dumps/public
+weeks: 52
+dryRun: true
+stages:
+  - titles
+  - item_signals
+storage:
+  bucket: qrank
+`
+	got, err := parseConfig("test.yaml", strings.NewReader(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []configSetting{
+		{"bucket", "qrank"},
+		{"dryRun", "true"},
+		{"dumps", "/public/dumps/public"},
+		{"stages", "titles,item_signals"},
+		{"weeks", "52"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestParseConfig_Errors(t *testing.T) {
+	for _, tc := range []struct{ name, config, want string }{
+		{"test.toml", "bucket", "test.toml: toml: line 1"},
+		{"test.toml", "bucket = qrank", "test.toml: toml: line 1"},
+		{"test.toml", "bucket = \"qrank", "test.toml: toml: line 1"},
+		{"test.toml", "weeks = 52\nweeks = 26", "test.toml: toml: line 2"},
+		{"test.toml", "bucket = \"a\"\n[storage]\nbucket = \"b\"", "test.toml: bucket is set more than once"},
+		{"test.toml", "stages = [[\"titles\"]]", "test.toml: stages: arrays may only contain plain values"},
+		{"test.yaml", "weeks:", "test.yaml: weeks: missing value"},
+		{"test.yaml", "weeks: [52", "test.yaml: yaml: line 1"},
+	} {
+		_, err := parseConfig(tc.name, strings.NewReader(tc.config))
+		if err == nil || !strings.HasPrefix(err.Error(), tc.want) {
+			t.Errorf("config %q: got error %v, want %q", tc.config, err, tc.want)
+		}
+	}
+}
+
+func testConfigFlags() *flag.FlagSet {
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	flags.String("bucket", "qrank", "")
+	flags.String("dumps", "/public/dumps/public", "")
+	flags.Int("weeks", 52, "")
+	flags.Duration("stallTimeout", time.Hour, "")
+	flags.String("config", "", "")
+	return flags
+}
+
+func writeTestConfig(t *testing.T, config string) string {
+	path := filepath.Join(t.TempDir(), "qrank-builder.toml")
+	if err := os.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := writeTestConfig(t, "bucket = \"qrank-test\"\nweeks = 26\nstallTimeout = \"2h\"\n")
+	flags := testConfigFlags()
+	if err := flags.Parse([]string{"-weeks", "4"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadConfig(path, flags); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{
+		"bucket":       "qrank-test",
+		"dumps":        "/public/dumps/public",
+		"weeks":        "4", // command line takes precedence
+		"stallTimeout": "2h0m0s",
+	} {
+		if got := flags.Lookup(name).Value.String(); got != want {
+			t.Errorf("got %s=%q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestLoadConfig_Errors(t *testing.T) {
+	for _, tc := range []struct{ config, want string }{
+		{"buckett = \"qrank\"", `: unknown setting "buckett", did you mean "bucket"?`},
+		{"Weeks = 3", `: unknown setting "Weeks", did you mean "weeks"?`},
+		{"storage = \"s3\"", `: unknown setting "storage"`},
+		{"config = \"other.toml\"", `: unknown setting "config"`},
+		{"\nweeks = \"many\"", `: invalid value for weeks`},
+		{"stallTimeout = 6", `: invalid value for stallTimeout`},
+	} {
+		path := writeTestConfig(t, tc.config)
+		err := loadConfig(path, testConfigFlags())
+		if err == nil || !strings.HasPrefix(err.Error(), path+tc.want) {
+			t.Errorf("config %q: got error %v, want %q", tc.config, err, tc.want)
+		}
+	}
+
+	if err := loadConfig("does-not-exist.toml", testConfigFlags()); err == nil {
+		t.Error("expected error for missing file")
+	}
+}
+
+func TestEditDistance(t *testing.T) {
+	for _, tc := range []struct {
+		a, b string
+		want int
+	}{
+		{"", "", 0},
+		{"bucket", "bucket", 0},
+		{"bucket", "buckett", 1},
+		{"kitten", "sitting", 3},
+		{"", "abc", 3},
+	} {
+		if got := editDistance(tc.a, tc.b); got != tc.want {
+			t.Errorf("editDistance(%q, %q) = %d, want %d", tc.a, tc.b, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,264 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+
+	"github.com/lanrat/extsort"
+	"github.com/minio/minio-go/v7"
+)
+
+// QRankEntityLess sorts QRank records by increasing entity ID.
+func QRankEntityLess(a, b extsort.SortType) bool {
+	return a.(QRank).Entity < b.(QRank).Entity
+}
+
+// PublishedQRankVersion returns the date of the most recent QRank file
+// in storage that is older than `before`. If there is no such file,
+// the result is the zero time.Time without error.
+func PublishedQRankVersion(ctx context.Context, cfg *buildConfig, before time.Time, s3 S3) (time.Time, error) {
+	return publishedVersion(ctx, cfg, "qrank", ".csv.gz", before, s3)
+}
+
+// PublishedVersion returns the date of the most recent published file
+// with a given name, such as "qrank-history", that is older than `before`.
+// If there is no such file, the result is the zero time.Time without error.
+func publishedVersion(ctx context.Context, cfg *buildConfig, name string, ext string, before time.Time, s3 S3) (time.Time, error) {
+	re := regexp.MustCompile("^" + regexp.QuoteMeta(cfg.PublicPrefix+name+"-") + `(\d{8})` + regexp.QuoteMeta(ext) + "$")
+	var result time.Time
+	opts := minio.ListObjectsOptions{Prefix: cfg.PublicPrefix + name + "-"}
+	for obj := range s3.ListObjects(ctx, cfg.Bucket, opts) {
+		if obj.Err != nil {
+			return time.Time{}, obj.Err
+		}
+		if match := re.FindStringSubmatch(obj.Key); match != nil {
+			if t, err := time.Parse("20060102", match[1]); err == nil {
+				if t.Before(before) && t.After(result) {
+					result = t
+				}
+			}
+		}
+	}
+	return result, nil
+}
+
+// BuildDelta computes the difference between a freshly built QRank file
+// and the previous QRank file in storage. The output is a gzip-compressed
+// CSV file with columns `Entity`, `OldQRank` and `NewQRank`, sorted by
+// entity ID. Entities that were added in the new file have an empty
+// `OldQRank`; entities that were removed have an empty `NewQRank`.
+// Entities whose score did not change are not part of the delta.
+// If there is no previous QRank file in storage, the returned path
+// is empty.
+func buildDelta(ctx context.Context, cfg *buildConfig, date time.Time, qrankPath string, outDir string, s3 S3) (string, error) {
+	deltaPath := filepath.Join(
+		outDir,
+		fmt.Sprintf("qrank-delta-%04d%02d%02d.gz", date.Year(), date.Month(), date.Day()))
+	_, err := os.Stat(deltaPath)
+	if err == nil {
+		return deltaPath, nil // use pre-existing file
+	}
+	if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	prev, err := PublishedQRankVersion(ctx, cfg, date, s3)
+	if err != nil {
+		return "", err
+	}
+	if prev.IsZero() {
+		if logger != nil {
+			logger.Printf("no previous QRank file in storage, not building delta")
+		}
+		return "", nil
+	}
+
+	prevKey := cfg.PublicPrefix + fmt.Sprintf("qrank-%s.csv.gz", prev.Format("20060102"))
+	if logger != nil {
+		logger.Printf("building %s against %s", deltaPath, prevKey)
+	}
+	start := time.Now()
+
+	prevReader, err := NewS3Reader(ctx, cfg.Bucket, prevKey, s3)
+	if err != nil {
+		return "", err
+	}
+	defer prevReader.Close()
+	prevDecompressor, err := gzip.NewReader(prevReader)
+	if err != nil {
+		return "", err
+	}
+
+	qrankFile, err := os.Open(qrankPath)
+	if err != nil {
+		return "", err
+	}
+	defer qrankFile.Close()
+	qrankDecompressor, err := gzip.NewReader(qrankFile)
+	if err != nil {
+		return "", err
+	}
+
+	tmpDeltaPath := deltaPath + ".tmp"
+	tmpDeltaFile, err := os.Create(tmpDeltaPath)
+	if err != nil {
+		return "", err
+	}
+	defer tmpDeltaFile.Close()
+
+	deltaWriter, err := gzip.NewWriterLevel(tmpDeltaFile, 9)
+	if err != nil {
+		return "", err
+	}
+	defer deltaWriter.Close()
+
+	config := cfg.Sort.newConfig(0, 8)
+	oldChan := make(chan extsort.SortType, cfg.Sort.buffer(10000))
+	newChan := make(chan extsort.SortType, cfg.Sort.buffer(10000))
+	oldSorter, oldOut, oldErr := extsort.New(oldChan, QRankFromBytes, QRankEntityLess, config)
+	newSorter, newOut, newErr := extsort.New(newChan, QRankFromBytes, QRankEntityLess, config)
+	g, subCtx := errgroup.WithContext(ctx)
+	g.Go(func() error {
+		return readQRankCSV(prevDecompressor, oldChan, subCtx)
+	})
+	g.Go(func() error {
+		return readQRankCSV(qrankDecompressor, newChan, subCtx)
+	})
+	g.Go(func() error {
+		oldSorter.Sort(ctx) // not subCtx, as per extsort docs
+		return nil
+	})
+	g.Go(func() error {
+		newSorter.Sort(ctx) // not subCtx, as per extsort docs
+		return nil
+	})
+	g.Go(func() error {
+		return writeDelta(oldOut, newOut, deltaWriter)
+	})
+	if err := g.Wait(); err != nil {
+		return "", err
+	}
+	if err := <-oldErr; err != nil {
+		return "", err
+	}
+	if err := <-newErr; err != nil {
+		return "", err
+	}
+
+	if err := deltaWriter.Close(); err != nil {
+		return "", err
+	}
+	if err := tmpDeltaFile.Sync(); err != nil {
+		return "", err
+	}
+	if err := tmpDeltaFile.Close(); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmpDeltaPath, deltaPath); err != nil {
+		return "", err
+	}
+
+	if logger != nil {
+		logger.Printf("built %s in %.1fs", deltaPath, time.Since(start).Seconds())
+	}
+
+	return deltaPath, nil
+}
+
+// ReadQRankCSV reads a QRank file in CSV format, sending its records
+// to a channel before closing that channel.
+func readQRankCSV(r io.Reader, ch chan<- extsort.SortType, ctx context.Context) error {
+	defer close(ch)
+	scanner := bufio.NewScanner(r)
+	scanner.Scan() // Skip CSV header.
+	for scanner.Scan() {
+		line := scanner.Text()
+		cols := strings.Split(line, ",")
+		if len(cols) < 2 {
+			return fmt.Errorf("expected at least 2 columns, got %q", line)
+		}
+		entity := ParseItem(cols[0])
+		if entity == NoItem {
+			return fmt.Errorf("expected Q..., got %q", line)
+		}
+		rank, err := strconv.ParseInt(cols[1], 10, 64)
+		if err != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case ch <- QRank{Entity: int64(entity), Rank: rank}:
+		}
+	}
+	return scanner.Err()
+}
+
+// WriteDelta merges two streams of QRank records, both sorted by
+// entity ID, and writes their difference in CSV format.
+func writeDelta(old, new <-chan extsort.SortType, w io.Writer) error {
+	if _, err := w.Write([]byte("Entity,OldQRank,NewQRank\n")); err != nil {
+		return err
+	}
+
+	o, oldOK := <-old
+	n, newOK := <-new
+	for oldOK || newOK {
+		switch {
+		case oldOK && (!newOK || o.(QRank).Entity < n.(QRank).Entity):
+			if err := writeDeltaLine(w, o.(QRank).Entity, o.(QRank).Rank, -1); err != nil {
+				return err
+			}
+			o, oldOK = <-old
+
+		case newOK && (!oldOK || n.(QRank).Entity < o.(QRank).Entity):
+			if err := writeDeltaLine(w, n.(QRank).Entity, -1, n.(QRank).Rank); err != nil {
+				return err
+			}
+			n, newOK = <-new
+
+		default:
+			oldRank, newRank := o.(QRank).Rank, n.(QRank).Rank
+			if oldRank != newRank {
+				if err := writeDeltaLine(w, n.(QRank).Entity, oldRank, newRank); err != nil {
+					return err
+				}
+			}
+			o, oldOK = <-old
+			n, newOK = <-new
+		}
+	}
+	return nil
+}
+
+func writeDeltaLine(w io.Writer, entity int64, oldRank, newRank int64) error {
+	var buf bytes.Buffer
+	buf.WriteByte('Q')
+	buf.WriteString(strconv.FormatInt(entity, 10))
+	buf.WriteByte(',')
+	if oldRank >= 0 {
+		buf.WriteString(strconv.FormatInt(oldRank, 10))
+	}
+	buf.WriteByte(',')
+	if newRank >= 0 {
+		buf.WriteString(strconv.FormatInt(newRank, 10))
+	}
+	buf.WriteByte('\n')
+	_, err := w.Write(buf.Bytes())
+	return err
+}
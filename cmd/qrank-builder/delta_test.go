@@ -0,0 +1,51 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBuildDelta(t *testing.T) {
+	s3 := NewFakeS3()
+	prev := filepath.Join(t.TempDir(), "prev.gz")
+	writeGzipFile(prev, "Entity,QRank\nQ4,77\nQ2,42\nQ5,42\nQ1,1\n")
+	data, err := os.ReadFile(prev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s3.data["public/qrank-20240201.csv.gz"] = data
+	s3.data["public/qrank-20240401.csv.gz"] = data // newer than build
+
+	qrank := filepath.Join(t.TempDir(), "qrank.gz")
+	writeGzipFile(qrank, "Entity,QRank\nQ4,80\nQ2,42\nQ3,7\nQ1,1\n")
+	date := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	path, err := buildDelta(context.Background(), newBuildConfig(""), date, qrank, t.TempDir(), s3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := readGzipFile(path)
+	want := "Entity,OldQRank,NewQRank\nQ3,,7\nQ4,77,80\nQ5,42,\n"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestBuildDelta_NoPrevious(t *testing.T) {
+	s3 := NewFakeS3()
+	qrank := filepath.Join(t.TempDir(), "qrank.gz")
+	writeGzipFile(qrank, "Entity,QRank\nQ4,80\n")
+	path, err := buildDelta(context.Background(), newBuildConfig(""), time.Now(), qrank, t.TempDir(), s3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path != "" {
+		t.Errorf("got %q, want empty path", path)
+	}
+}
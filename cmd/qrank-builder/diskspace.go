@@ -0,0 +1,178 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"runtime"
+	"slices"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// TempSpaceFactor is how many times the size of its compressed input
+// a task needs in temporary disk space, for its sort runs and outputs.
+// This is a rough figure; it errs on the side of caution.
+const tempSpaceFactor = 3
+
+// DiskBudget compares the temporary disk space that a build would
+// need with what is available.
+type diskBudget struct {
+	Stage     string // stage with the highest need
+	Need      int64
+	Available int64
+	NumWeeks  int // weeks of pageviews that fit into the available space
+}
+
+func (b diskBudget) fits() bool {
+	return b.Need <= b.Available
+}
+
+// CheckDiskSpace estimates how much temporary disk space a build would
+// need, and compares it against what is available in the directory for
+// temporary files. If there is not enough space for aggregating cfg.NumWeeks
+// of pageviews, but enough for at least minWeeks, the result is the
+// largest number of weeks that fits. Otherwise, CheckDiskSpace fails,
+// so the build stops right away instead of running out of disk space
+// in the middle of sorting.
+func checkDiskSpace(ctx context.Context, client *http.Client, cfg *buildConfig, minWeeks int, s3 S3) (int, error) {
+	plan, err := planBuild(ctx, client, cfg, s3)
+	if err != nil {
+		return 0, err
+	}
+
+	latest, err := LatestPageviewsDump(cfg)
+	if err != nil {
+		return 0, err
+	}
+	window := pageviewsWeeks(latest, cfg.NumWeeks)
+
+	sizes, err := storedSizes(ctx, cfg.Bucket, "pageviews/", s3)
+	if err != nil {
+		return 0, err
+	}
+	var weekly int64
+	if len(sizes) > 0 {
+		for _, size := range sizes {
+			weekly += size
+		}
+		weekly /= int64(len(sizes))
+	}
+
+	// Most of the temporary space goes into the chunks of external sorts.
+	dir := os.TempDir()
+	if cfg.Sort.TempDir != "" {
+		dir = cfg.Sort.TempDir
+	}
+	available, err := availableSpace(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	budget := budgetDiskSpace(plan, window, weekly, minWeeks, runtime.GOMAXPROCS(0), available)
+	if !budget.fits() {
+		return 0, fmt.Errorf("not enough disk space in %s: stage %s needs about %s, but only %s is available", dir, budget.Stage, formatBytes(budget.Need), formatBytes(budget.Available))
+	}
+	if budget.NumWeeks < cfg.NumWeeks {
+		logger.Printf("warning: not enough disk space in %s for %d weeks of pageviews, aggregating only %d weeks", dir, cfg.NumWeeks, budget.NumWeeks)
+	} else {
+		logger.Printf("debug: build needs about %s of disk space in %s, %s available", formatBytes(budget.Need), dir, formatBytes(available))
+	}
+	return budget.NumWeeks, nil
+}
+
+// BudgetDiskSpace works out the temporary disk space for a build plan.
+// The window lists the weeks of pageviews that the build would aggregate,
+// most recent first, as returned by pageviewsWeeks, and weekly is the size of a weekly pageviews file.
+// Unless the full window fits into the available space, the window gets
+// shrunk to its most recent weeks, but not below minWeeks; if minWeeks
+// is not positive, the window never gets shrunk. The returned
+// budget is for the largest window that fits, or for the smallest
+// window tried if nothing fits.
+func budgetDiskSpace(plan []plannedTask, window []string, weekly int64, minWeeks int, workers int, available int64) diskBudget {
+	numWeeks := len(window)
+	smallest := numWeeks
+	if minWeeks > 0 {
+		smallest = max(min(minWeeks, numWeeks), 1)
+	}
+	var budget diskBudget
+	for n := numWeeks; n >= smallest; n-- {
+		budget = diskBudget{NumWeeks: n, Available: available}
+		budget.Stage, budget.Need = estimateTempSpace(plan, window[:n], weekly, workers)
+		if budget.fits() {
+			break
+		}
+	}
+	return budget
+}
+
+// EstimateTempSpace estimates the peak temporary disk space of a build
+// plan. Since the stages of the pipeline run one after the other, the
+// peak is the need of the most demanding stage, which also gets returned.
+func estimateTempSpace(plan []plannedTask, window []string, weekly int64, workers int) (string, int64) {
+	needs := make(map[string]int64, len(buildStages))
+	tasks := make(map[string][]int64, len(buildStages))
+	for _, task := range plan {
+		switch task.Stage {
+		case "pageviews":
+			// Weekly pageviews get built one after the other, but
+			// their outputs stay on disk until the stage is done.
+			week := strings.TrimSuffix(strings.TrimPrefix(task.Outputs[0], "pageviews/pageviews-"), ".zst")
+			if !slices.Contains(window, week) {
+				continue
+			}
+			output := task.OutputBytes
+			if output < 0 {
+				output = task.InputBytes
+			}
+			needs["pageviews"] += output
+			tasks["pageviews"] = append(tasks["pageviews"], task.InputBytes*tempSpaceFactor)
+
+		case "item_signals":
+			// Item signals get computed from the weekly pageviews files,
+			// which get downloaded before sorting.
+			pageviews := weekly * int64(len(window))
+			needs["item_signals"] = pageviews*(1+tempSpaceFactor) + max(task.OutputBytes, 0)
+
+		default:
+			output := max(task.OutputBytes, 0)
+			tasks[task.Stage] = append(tasks[task.Stage], task.InputBytes*tempSpaceFactor+output)
+		}
+	}
+
+	// For pageviews, only one task runs at a time; the per-site stages
+	// run as many tasks in parallel as there are workers.
+	for stage, sizes := range tasks {
+		sort.Slice(sizes, func(i, j int) bool { return sizes[i] > sizes[j] })
+		parallel := workers
+		if stage == "pageviews" {
+			parallel = 1
+		}
+		for i := 0; i < len(sizes) && i < parallel; i++ {
+			needs[stage] += sizes[i]
+		}
+	}
+
+	peakStage, peak := "", int64(0)
+	for _, stage := range buildStages {
+		if needs[stage] > peak {
+			peakStage, peak = stage, needs[stage]
+		}
+	}
+	return peakStage, peak
+}
+
+// AvailableSpace returns how many bytes can be written to the file
+// system of a directory by an unprivileged user.
+func availableSpace(dir string) (int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, err
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
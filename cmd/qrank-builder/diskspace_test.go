@@ -0,0 +1,106 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"path/filepath"
+	"testing"
+)
+
+func testDiskPlan() []plannedTask {
+	return []plannedTask{
+		{Stage: "pageviews", Outputs: []string{"pageviews/pageviews-2024-W17.zst"}, InputBytes: 100, OutputBytes: 50},
+		{Stage: "pageviews", Outputs: []string{"pageviews/pageviews-2024-W16.zst"}, InputBytes: 120, OutputBytes: -1},
+		{Stage: "titles", Outputs: []string{"titles/a.zst"}, InputBytes: 10, OutputBytes: 5},
+		{Stage: "titles", Outputs: []string{"titles/b.zst"}, InputBytes: 20, OutputBytes: 5},
+		{Stage: "titles", Outputs: []string{"titles/c.zst"}, InputBytes: 30, OutputBytes: -1},
+		{Stage: "item_signals", Outputs: []string{"public/item_signals-20240428.csv.zst"}, OutputBytes: 40},
+	}
+}
+
+func TestEstimateTempSpace(t *testing.T) {
+	window := []string{"2024-W17", "2024-W16"}
+	for _, tc := range []struct {
+		weekly    int64
+		workers   int
+		wantStage string
+		wantNeed  int64
+	}{
+		// pageviews: 50 + 120 outputs + 3*120 for sorting the largest week
+		{weekly: 0, workers: 1, wantStage: "pageviews", wantNeed: 530},
+		// item_signals: 2 weeks * 100 bytes * (1+3) + 40 bytes output
+		{weekly: 100, workers: 1, wantStage: "item_signals", wantNeed: 840},
+	} {
+		stage, need := estimateTempSpace(testDiskPlan(), window, tc.weekly, tc.workers)
+		if stage != tc.wantStage || need != tc.wantNeed {
+			t.Errorf("weekly=%d, workers=%d: got %s %d, want %s %d", tc.weekly, tc.workers, stage, need, tc.wantStage, tc.wantNeed)
+		}
+	}
+
+	// Weeks outside the window do not count: 50 output + 3*100 sorting.
+	stage, need := estimateTempSpace(testDiskPlan(), []string{"2024-W17"}, 0, 1)
+	if stage != "pageviews" || need != 350 {
+		t.Errorf("got %s %d, want pageviews 350", stage, need)
+	}
+
+	// With parallel workers, titles tasks add up: 90 + 65 + 35.
+	stage, need = estimateTempSpace(testDiskPlan(), nil, 0, 8)
+	if stage != "titles" || need != 190 {
+		t.Errorf("got %s %d, want titles 190", stage, need)
+	}
+}
+
+func TestBudgetDiskSpace(t *testing.T) {
+	window := []string{"2024-W17", "2024-W16", "2024-W15", "2024-W14"}
+	plan := []plannedTask{{Stage: "item_signals", OutputBytes: 0}}
+
+	// Four weeks of 100 bytes need 1600 bytes.
+	b := budgetDiskSpace(plan, window, 100, 0, 1, 2000)
+	if !b.fits() || b.NumWeeks != 4 || b.Need != 1600 {
+		t.Errorf("got %+v, want 4 weeks fitting", b)
+	}
+
+	// Without minWeeks, the window does not shrink.
+	b = budgetDiskSpace(plan, window, 100, 0, 1, 1000)
+	if b.fits() || b.NumWeeks != 4 || b.Stage != "item_signals" {
+		t.Errorf("got %+v, want 4 weeks not fitting", b)
+	}
+
+	b = budgetDiskSpace(plan, window, 100, 2, 1, 1000)
+	if !b.fits() || b.NumWeeks != 2 {
+		t.Errorf("got %+v, want 2 weeks fitting", b)
+	}
+
+	b = budgetDiskSpace(plan, window, 100, 3, 1, 1000)
+	if b.fits() || b.NumWeeks != 3 {
+		t.Errorf("got %+v, want 3 weeks not fitting", b)
+	}
+}
+
+func TestCheckDiskSpace(t *testing.T) {
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	cfg := newBuildConfig(filepath.Join("testdata", "dumps"))
+	cfg.NumWeeks = 2
+	s3 := NewFakeS3()
+	numWeeks, err := checkDiskSpace(context.Background(), nil, cfg, 0, s3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if numWeeks != 2 {
+		t.Errorf("got numWeeks=%d, want 2", numWeeks)
+	}
+}
+
+func TestAvailableSpace(t *testing.T) {
+	available, err := availableSpace(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if available <= 0 {
+		t.Errorf("got %d bytes available, want > 0", available)
+	}
+}
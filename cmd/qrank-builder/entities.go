@@ -10,9 +10,11 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
 	"runtime"
+	"slices"
 	"strings"
 	"time"
 
@@ -44,6 +46,38 @@ func findEntitiesDump(dumpsPath string) (time.Time, string, error) {
 	return date, resolved, nil
 }
 
+// EntitiesDumpAsOf returns the date and path of the most recent
+// Wikidata entities dump on or before a date. Releases use this instead
+// of findEntitiesDump, so that a rebuild reads the same dump as the
+// original build, even after Wikimedia has published newer ones.
+func entitiesDumpAsOf(dumpsPath string, date time.Time) (time.Time, string, error) {
+	dir := filepath.Join(dumpsPath, "wikidatawiki", "entities")
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return time.Time{}, "", err
+	}
+	versions := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if e.IsDir() && len(e.Name()) == 8 {
+			versions = append(versions, e.Name())
+		}
+	}
+	slices.Sort(versions)
+	slices.Reverse(versions)
+
+	for _, version := range versions {
+		dumped, err := time.Parse("20060102", version)
+		if err != nil || dumped.After(date) {
+			continue
+		}
+		path := filepath.Join(dir, version, fmt.Sprintf("wikidata-%s-all.json.bz2", version))
+		if _, err := os.Stat(path); err == nil {
+			return dumped, path, nil
+		}
+	}
+	return time.Time{}, "", fmt.Errorf("no Wikidata entities dump on or before %s: %w", date.Format(time.DateOnly), fs.ErrNotExist)
+}
+
 type WikidataSplit struct {
 	Start int64  // Position of compression block in bzip2 file.
 	Limit string // First entity coming after the current split.
@@ -58,6 +92,9 @@ func SplitWikidataDump(r io.ReaderAt, size int64, numSplits int) ([]WikidataSpli
 	for i := 0; i < numSplits; i++ {
 		off := int64(i) * size / int64(numSplits)
 		start, entity, err := findEntitySplit(r, off)
+		if err == io.EOF && len(splits) > 0 {
+			break // small dump, fewer compression blocks than splits
+		}
 		if err != nil {
 			return nil, err
 		}
@@ -86,13 +123,22 @@ func findEntitySplit(r io.ReaderAt, off int64) (int64, string, error) {
 	// last six bytes of the chunk to the beginning of the chunk
 	// buffer; this allows us to catch chunk-spanning magic sequences.
 	chunk := make([]byte, 6+32*1024) // default value is all zeroes
-	chunkLen := len(chunk)
 	for {
-		if _, err := r.ReadAt(chunk[6:chunkLen], off); err != nil {
+		// At the end of the file, ReadAt returns a short chunk
+		// along with io.EOF.
+		n, err := r.ReadAt(chunk[6:], off)
+		if n == 0 {
+			if err == nil {
+				err = io.EOF
+			}
 			return 0, "", err
 		}
+		if err != nil && err != io.EOF {
+			return 0, "", err
+		}
+		chunkLen := 6 + n
 		magic := []byte{0x31, 0x41, 0x59, 0x26, 0x53, 0x59} // π
-		pos := bytes.Index(chunk, magic)
+		pos := bytes.Index(chunk[0:chunkLen], magic)
 		if pos < 0 {
 			copy(chunk[0:6], chunk[chunkLen-6:chunkLen])
 			off += int64(chunkLen - 6)
@@ -148,17 +194,40 @@ func NewBzip2ReaderAt(r io.ReaderAt, off int64, size int64) (io.Reader, error) {
 	return bzip2.NewReader(cat, &bzip2.ReaderConfig{})
 }
 
-func processEntities(testRun bool, path string, date time.Time, outDir string, ctx context.Context) (string, error) {
+// EntityExtractor extracts a per-entity value from the JSON representation
+// of Wikidata entities, such as their English label. The extracted values
+// get stored in a file named after the extractor, sorted by entity ID,
+// with lines such as "Q42 Douglas Adams".
+type entityExtractor struct {
+	name    string // for example "labels-en"
+	extract func(data []byte) (string, bool)
+}
+
+// ProcessEntities extracts sitelinks from the Wikidata dump. In the same
+// pass, it runs the passed extractors; the returned slice contains
+// the paths to their output files, in the same order as the extractors.
+func processEntities(testRun bool, path string, date time.Time, extractors []entityExtractor, outDir string, sorting sortSettings, ctx context.Context) (string, []string, error) {
 	year, month, day := date.Year(), date.Month(), date.Day()
 	sitelinksPath := filepath.Join(
 		outDir,
 		fmt.Sprintf("sitelinks-%04d%02d%02d.br", year, month, day))
+	extractedPaths := make([]string, 0, len(extractors))
+	for _, ex := range extractors {
+		extractedPaths = append(extractedPaths, filepath.Join(
+			outDir,
+			fmt.Sprintf("%s-%04d%02d%02d.br", ex.name, year, month, day)))
+	}
 	_, err := os.Stat(sitelinksPath)
+	for _, p := range extractedPaths {
+		if err == nil {
+			_, err = os.Stat(p)
+		}
+	}
 	if err == nil {
-		return sitelinksPath, nil // use pre-existing file
+		return sitelinksPath, extractedPaths, nil // use pre-existing files
 	}
 	if !os.IsNotExist(err) {
-		return "", err
+		return "", nil, err
 	}
 
 	logger.Printf("processing entities of %04d-%02d-%d", year, month, day)
@@ -171,21 +240,44 @@ func processEntities(testRun bool, path string, date time.Time, outDir string, c
 	tmpSitelinksPath := sitelinksPath + ".tmp"
 	tmpSitelinksFile, err := os.Create(tmpSitelinksPath)
 	if err != nil {
-		return "", err
+		return "", nil, err
 	}
 	defer tmpSitelinksFile.Close()
 
 	sitelinksWriter := brotli.NewWriterLevel(tmpSitelinksFile, 6)
 	defer sitelinksWriter.Close()
 
-	ch := make(chan string, 10000)
-	config := extsort.DefaultConfig()
-	config.ChunkSize = 8 * 1024 * 1024 / 16 // 8 MiB, 16 Bytes/line avg
-	config.NumWorkers = runtime.NumCPU()
+	ch := make(chan string, sorting.buffer(10000))
+	config := sorting.newConfig(8*1024*1024/16, 16) // 8 MiB, 16 Bytes/line avg
 	sorter, outChan, errChan := extsort.Strings(ch, config)
 	g, subCtx := errgroup.WithContext(ctx)
+
+	extractedChans := make([]chan<- extsort.SortType, 0, len(extractors))
+	extractedErrChans := make([]<-chan error, 0, len(extractors))
+	extractedWriters := make([]*brotli.Writer, 0, len(extractors))
+	for _, p := range extractedPaths {
+		tmpFile, err := os.Create(p + ".tmp")
+		if err != nil {
+			return "", nil, err
+		}
+		defer tmpFile.Close()
+		writer := brotli.NewWriterLevel(tmpFile, 6)
+		defer writer.Close()
+
+		exChan := make(chan extsort.SortType, sorting.buffer(10000))
+		exConfig := sorting.newConfig(8*1024*1024/32, 32) // 8 MiB, 32 Bytes/value avg
+		exSorter, exOutChan, exErrChan := extsort.New(exChan, EntityLabelFromBytes, EntityLabelLess, exConfig)
+		g.Go(func() error {
+			exSorter.Sort(subCtx)
+			return writeLabels(exOutChan, writer, subCtx)
+		})
+		extractedChans = append(extractedChans, exChan)
+		extractedErrChans = append(extractedErrChans, exErrChan)
+		extractedWriters = append(extractedWriters, writer)
+	}
+
 	g.Go(func() error {
-		return readEntities(testRun, path, ch, subCtx)
+		return readEntities(testRun, path, extractors, ch, extractedChans, subCtx)
 	})
 	g.Go(func() error {
 		sorter.Sort(subCtx)
@@ -195,10 +287,10 @@ func processEntities(testRun bool, path string, date time.Time, outDir string, c
 		return nil
 	})
 	if err := g.Wait(); err != nil {
-		return "", err
+		return "", nil, err
 	}
 	if err := <-errChan; err != nil {
-		return "", err
+		return "", nil, err
 	}
 
 	if err := sitelinksWriter.Close(); err != nil {
@@ -211,16 +303,31 @@ func processEntities(testRun bool, path string, date time.Time, outDir string, c
 	}
 
 	if err := os.Rename(tmpSitelinksPath, sitelinksPath); err != nil {
-		return "", err
+		return "", nil, err
+	}
+
+	for i, p := range extractedPaths {
+		if err := <-extractedErrChans[i]; err != nil {
+			return "", nil, err
+		}
+		if err := extractedWriters[i].Close(); err != nil {
+			return "", nil, err
+		}
+		if err := os.Rename(p+".tmp", p); err != nil {
+			return "", nil, err
+		}
 	}
 
 	logger.Printf("built sitelinks for %04d-%02d-%02d in %.1fs",
 		year, month, day, time.Since(start).Seconds())
-	return sitelinksPath, nil
+	return sitelinksPath, extractedPaths, nil
 }
 
-func readEntities(testRun bool, path string, sitelinks chan<- string, ctx context.Context) error {
+func readEntities(testRun bool, path string, extractors []entityExtractor, sitelinks chan<- string, extracted []chan<- extsort.SortType, ctx context.Context) error {
 	defer close(sitelinks)
+	for _, ch := range extracted {
+		defer close(ch)
+	}
 
 	file, err := os.Open(path)
 	if err != nil {
@@ -236,7 +343,7 @@ func readEntities(testRun bool, path string, sitelinks chan<- string, ctx contex
 
 	// To keep CPU cores busy while tasks are blocked waiting for input,
 	// we use more worker tasks than we have CPUs.
-	numSplits := runtime.NumCPU() * 4
+	numSplits := runtime.GOMAXPROCS(0) * 4
 	if testRun {
 		numSplits = 2
 	}
@@ -260,7 +367,7 @@ func readEntities(testRun bool, path string, sitelinks chan<- string, ctx contex
 				if err != nil {
 					return err
 				}
-				if err := readWikidataSplit(reader, testRun, task.Limit, sitelinks, ctx); err != nil {
+				if err := readWikidataSplit(reader, testRun, task.Limit, extractors, sitelinks, extracted, ctx); err != nil {
 					return err
 				}
 			}
@@ -273,7 +380,7 @@ func readEntities(testRun bool, path string, sitelinks chan<- string, ctx contex
 	return nil
 }
 
-func readWikidataSplit(reader io.Reader, testRun bool, limit string, sitelinks chan<- string, ctx context.Context) error {
+func readWikidataSplit(reader io.Reader, testRun bool, limit string, extractors []entityExtractor, sitelinks chan<- string, extracted []chan<- extsort.SortType, ctx context.Context) error {
 	numLines := 0
 	scanner := bufio.NewScanner(reader)
 	maxLineSize := 8 * 1024 * 1024
@@ -306,6 +413,11 @@ func readWikidataSplit(reader io.Reader, testRun bool, limit string, sitelinks c
 			}
 			return err
 		}
+		for i, ex := range extractors {
+			if err := processExtractor(buf, ex, extracted[i], ctx); err != nil {
+				return err
+			}
+		}
 	}
 	if err := scanner.Err(); err != nil {
 		return err
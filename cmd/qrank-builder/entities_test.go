@@ -7,12 +7,15 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"errors"
 	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
 	"sort"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/dsnet/compress/bzip2"
 )
@@ -58,6 +61,45 @@ func TestFindEntitiesDump(t *testing.T) {
 	}
 }
 
+func TestEntitiesDumpAsOf(t *testing.T) {
+	dumps := t.TempDir()
+	dir := filepath.Join(dumps, "wikidatawiki", "entities")
+	for _, version := range []string{"20240226", "20240304", "20240311"} {
+		if err := os.MkdirAll(filepath.Join(dir, version), 0755); err != nil {
+			t.Fatal(err)
+		}
+		// The dump of 20240311 is still being written.
+		if version == "20240311" {
+			continue
+		}
+		path := filepath.Join(dir, version, "wikidata-"+version+"-all.json.bz2")
+		if err := os.WriteFile(path, []byte("dump"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct{ asOf, want string }{
+		{"2024-03-01", "20240226"},
+		{"2024-03-04", "20240304"},
+		{"2024-03-20", "20240304"},
+	} {
+		asOf, _ := time.Parse(time.DateOnly, tc.asOf)
+		date, path, err := entitiesDumpAsOf(dumps, asOf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wantPath := filepath.Join(dir, tc.want, "wikidata-"+tc.want+"-all.json.bz2")
+		if got := date.Format("20060102"); got != tc.want || path != wantPath {
+			t.Errorf("as of %s: got %s %q, want %s %q", tc.asOf, got, path, tc.want, wantPath)
+		}
+	}
+
+	asOf := time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)
+	if _, _, err := entitiesDumpAsOf(dumps, asOf); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("got %v, want fs.ErrNotExist", err)
+	}
+}
+
 func TestNewBzip2ReaderAt(t *testing.T) {
 	var buf bytes.Buffer
 	buf.WriteString("Junk")
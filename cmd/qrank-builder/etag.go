@@ -0,0 +1,106 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// UploadPartSize is the size of the parts for uploading large files
+// to object storage. Files up to this size get uploaded in one piece.
+const uploadPartSize = 64 * 1024 * 1024
+
+// ExpectedETag computes the ETag that S3-compatible object storage
+// assigns to a file after uploading it in parts of partSize bytes.
+// For a file that fits in a single part, this is the MD5 hash of the
+// file content. For a multipart upload, it is the MD5 hash of the
+// concatenated MD5 hashes of all parts, followed by a dash and the
+// number of parts.
+func expectedETag(p string, partSize int64) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	if stat.Size() <= partSize {
+		h := md5.New()
+		if _, err := io.Copy(h, f); err != nil {
+			return "", err
+		}
+		return hex.EncodeToString(h.Sum(nil)), nil
+	}
+
+	var sums []byte
+	numParts := 0
+	for {
+		h := md5.New()
+		n, err := io.CopyN(h, f, partSize)
+		if err != nil && err != io.EOF {
+			return "", err
+		}
+		if n == 0 {
+			break
+		}
+		sums = h.Sum(sums)
+		numParts += 1
+		if err == io.EOF {
+			break
+		}
+	}
+	sum := md5.Sum(sums)
+	return fmt.Sprintf("%s-%d", hex.EncodeToString(sum[:]), numParts), nil
+}
+
+// VerifySize checks that an object in storage has the same size
+// as the local file from which it was uploaded. Unlike verifyUpload,
+// this also works for objects that were created by server-side copy,
+// whose ETag does not depend on how the original was uploaded.
+func verifySize(ctx context.Context, bucket, dest, src string, storage S3) (minio.ObjectInfo, error) {
+	stat, err := os.Stat(src)
+	if err != nil {
+		return minio.ObjectInfo{}, err
+	}
+	obj, err := storage.StatObject(ctx, bucket, dest, minio.StatObjectOptions{})
+	if err != nil {
+		return minio.ObjectInfo{}, err
+	}
+	if obj.Size != stat.Size() {
+		return minio.ObjectInfo{}, fmt.Errorf("%s/%s has %d bytes, expected %d",
+			bucket, dest, obj.Size, stat.Size())
+	}
+	return obj, nil
+}
+
+// VerifyUpload checks that an object in storage has the same size
+// and ETag as the local file from which it was uploaded.
+func verifyUpload(ctx context.Context, bucket, dest, src string, storage S3) error {
+	obj, err := verifySize(ctx, bucket, dest, src, storage)
+	if err != nil {
+		return err
+	}
+
+	etag, err := expectedETag(src, uploadPartSize)
+	if err != nil {
+		return err
+	}
+	if obj.ETag != etag {
+		return fmt.Errorf("%s/%s has ETag %s, expected %s",
+			bucket, dest, obj.ETag, etag)
+	}
+
+	return nil
+}
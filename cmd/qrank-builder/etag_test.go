@@ -0,0 +1,35 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExpectedETag(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hello.txt")
+	if err := os.WriteFile(path, []byte("Hello, world"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		partSize int64
+		want     string
+	}{
+		{1024, "bc6e6f16b8a077ef5fbc8d59d0b931b9"},
+		{12, "bc6e6f16b8a077ef5fbc8d59d0b931b9"},
+		{5, "dd65673c567566daf7bd9e4be895b083-3"},
+		{4, "e66152dce8e501eda9952ebeab39a5f9-3"},
+	} {
+		got, err := expectedETag(path, tc.partSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tc.want {
+			t.Errorf("partSize=%d: got %q, want %q", tc.partSize, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// CollectGarbage deletes old releases from storage, so the bucket does not
+// grow without bound. A release is the set of published files that share
+// the same date stamp. We keep the newest `keep` releases, plus the first
+// release of every calendar quarter for historical research. In dry-run
+// mode, nothing gets deleted. The result lists the keys of the deleted
+// objects (or, in dry-run mode, of those that would have been deleted).
+// Published files are those in bucket whose keys start with prefix.
+func CollectGarbage(ctx context.Context, bucket string, prefix string, keep int, dryRun bool, s3 S3) ([]string, error) {
+	releases := make(map[string][]string, 100)
+	opts := minio.ListObjectsOptions{Prefix: prefix}
+	for obj := range s3.ListObjects(ctx, bucket, opts) {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		name, _ := strings.CutPrefix(obj.Key, prefix)
+		if m := publishedNameRegexp.FindStringSubmatch(name); m != nil {
+			releases[m[2]] = append(releases[m[2]], obj.Key)
+		}
+	}
+
+	dates := make([]string, 0, len(releases))
+	for ymd := range releases {
+		dates = append(dates, ymd)
+	}
+	sort.Strings(dates)
+
+	retained := make(map[string]bool, keep+len(dates)/12)
+	for i := len(dates) - 1; i >= 0 && i >= len(dates)-keep; i-- {
+		retained[dates[i]] = true
+	}
+	quarters := make(map[string]bool, len(dates)/12)
+	for _, ymd := range dates {
+		t, err := time.Parse("20060102", ymd)
+		if err != nil {
+			continue // not a date, such as 20241399; leave alone
+		}
+		q := fmt.Sprintf("%04d-Q%d", t.Year(), (int(t.Month())-1)/3+1)
+		if !quarters[q] {
+			quarters[q] = true
+			retained[ymd] = true
+		}
+	}
+
+	var deleted []string
+	for _, ymd := range dates {
+		if retained[ymd] {
+			continue
+		}
+		if _, err := time.Parse("20060102", ymd); err != nil {
+			continue
+		}
+		keys := releases[ymd]
+		sort.Strings(keys)
+		for _, key := range keys {
+			if dryRun {
+				if logger != nil {
+					logger.Printf("dry run, would delete %s/%s", bucket, key)
+				}
+			} else {
+				if err := s3.RemoveObject(ctx, bucket, key, minio.RemoveObjectOptions{}); err != nil {
+					return deleted, err
+				}
+				if logger != nil {
+					logger.Printf("deleted %s/%s", bucket, key)
+				}
+			}
+			deleted = append(deleted, key)
+		}
+	}
+
+	return deleted, nil
+}
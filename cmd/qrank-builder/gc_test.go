@@ -0,0 +1,63 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"slices"
+	"sort"
+	"testing"
+)
+
+func TestCollectGarbage(t *testing.T) {
+	for _, dryRun := range []bool{true, false} {
+		s3 := NewFakeS3()
+		for _, key := range []string{
+			"public/qrank-20240101.csv.gz",
+			"public/qrank-20240201.csv.gz",
+			"public/qrank-stats-20240201.json",
+			"public/qrank-20240301.csv.gz",
+			"public/qrank-20240401.csv.gz",
+			"public/qrank-20240501.csv.gz",
+			"public/qrank-stats-20240501.json",
+			"public/qrank-20240601.csv.gz",
+			"public/qrank-20240701.csv.gz",
+			"public/qrank-latest.csv.gz",
+			"page_signals/rmwiki-20240101-page_signals.zst",
+		} {
+			s3.data[key] = []byte("content")
+		}
+
+		got, err := CollectGarbage(context.Background(), "qrank", "public/", 2, dryRun, s3)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Keep 20240601 and 20240701 as the newest two releases,
+		// plus 20240101, 20240401 and 20240701 as first of their quarter.
+		want := []string{
+			"public/qrank-20240201.csv.gz",
+			"public/qrank-stats-20240201.json",
+			"public/qrank-20240301.csv.gz",
+			"public/qrank-20240501.csv.gz",
+			"public/qrank-stats-20240501.json",
+		}
+		if !slices.Equal(got, want) {
+			t.Errorf("dryRun=%v: got %v, want %v", dryRun, got, want)
+		}
+
+		remaining := make([]string, 0, len(s3.data))
+		for key := range s3.data {
+			remaining = append(remaining, key)
+		}
+		sort.Strings(remaining)
+		wantRemaining := 11
+		if !dryRun {
+			wantRemaining -= len(want)
+		}
+		if len(remaining) != wantRemaining {
+			t.Errorf("dryRun=%v: remaining %v", dryRun, remaining)
+		}
+	}
+}
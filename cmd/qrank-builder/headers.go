@@ -0,0 +1,95 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"runtime/debug"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// Files with a date stamp in their key never change once published,
+// so clients and CDNs may cache them for as long as they like.
+// The "latest" keys get replaced with every release.
+const immutableCacheControl = "public, max-age=31536000, immutable"
+const latestCacheControl = "public, max-age=3600"
+
+// PutOptions returns the options for uploading an artifact to storage.
+// The userMetadata gets stored with the object; S3 sends it to clients
+// in x-amz-meta-* headers.
+func putOptions(a artifact, userMetadata map[string]string) minio.PutObjectOptions {
+	opts := minio.PutObjectOptions{
+		ContentType:  a.contentType,
+		CacheControl: immutableCacheControl,
+		UserMetadata: userMetadata,
+		PartSize:     uploadPartSize,
+	}
+
+	// For gzip-compressed CSV files, the content type is "text/csv".
+	// With Content-Encoding, browsers and CDNs know how to handle them.
+	if strings.HasSuffix(a.dest, ".gz") && a.contentType != "application/gzip" {
+		opts.ContentEncoding = "gzip"
+	}
+
+	return opts
+}
+
+// LatestCopyOptions returns the options for copying an artifact
+// to its "latest" key. Other than the caching policy, the headers
+// are the same as for the dated original.
+func latestCopyOptions(a artifact, bucket, key string, userMetadata map[string]string) minio.CopyDestOptions {
+	put := putOptions(a, userMetadata)
+	return minio.CopyDestOptions{
+		Bucket:          bucket,
+		Object:          key,
+		ReplaceMetadata: true,
+		UserMetadata:    userMetadata,
+		ContentType:     put.ContentType,
+		ContentEncoding: put.ContentEncoding,
+		CacheControl:    latestCacheControl,
+	}
+}
+
+// ReleaseMetadata returns the user metadata for the published files
+// of a release, which tells clients what went into the release without
+// having to download its provenance manifest.
+func releaseMetadata(release time.Time, pageviews []string) map[string]string {
+	meta := map[string]string{
+		"Release":         release.Format(time.DateOnly),
+		"Builder-Version": builderVersion(),
+	}
+	var weeks []string
+	for _, pv := range pageviews {
+		if week := isoWeekRegexp.FindString(pv); week != "" {
+			weeks = append(weeks, week)
+		}
+	}
+	if len(weeks) > 0 {
+		slices.Sort(weeks)
+		meta["Pageviews"] = weeks[0] + "/" + weeks[len(weeks)-1]
+	}
+	return meta
+}
+
+// BuilderVersion tells which version of qrank-builder is running,
+// such as the git revision from which the binary was built.
+func builderVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	version := info.Main.Version
+	for _, s := range info.Settings {
+		if s.Key == "vcs.revision" {
+			version = s.Value
+		}
+	}
+	if version == "" {
+		return "unknown"
+	}
+	return version
+}
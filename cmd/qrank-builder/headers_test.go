@@ -0,0 +1,58 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPutOptions(t *testing.T) {
+	meta := map[string]string{"Wikidata-Dump": "2024-03-01"}
+	for _, tc := range []struct {
+		a        artifact
+		encoding string
+	}{
+		{artifact{"public/qrank-20240301.csv.gz", "qrank.gz", "text/csv"}, "gzip"},
+		{artifact{"public/qrank-20240301.csv.zst", "qrank.zst", "application/zstd"}, ""},
+		{artifact{"public/qrank-stats-20240301.json", "stats.json", "application/json"}, ""},
+	} {
+		opts := putOptions(tc.a, meta)
+		if opts.ContentEncoding != tc.encoding {
+			t.Errorf("%s: got Content-Encoding %q, want %q", tc.a.dest, opts.ContentEncoding, tc.encoding)
+		}
+		if opts.ContentType != tc.a.contentType {
+			t.Errorf("%s: got Content-Type %q, want %q", tc.a.dest, opts.ContentType, tc.a.contentType)
+		}
+		if opts.CacheControl != immutableCacheControl {
+			t.Errorf("%s: got Cache-Control %q", tc.a.dest, opts.CacheControl)
+		}
+		if opts.UserMetadata["Wikidata-Dump"] != "2024-03-01" {
+			t.Errorf("%s: got metadata %v", tc.a.dest, opts.UserMetadata)
+		}
+
+		copyOpts := latestCopyOptions(tc.a, "qrank", "public/qrank-latest.csv.gz", meta)
+		if copyOpts.CacheControl != latestCacheControl || !copyOpts.ReplaceMetadata {
+			t.Errorf("%s: got %+v", tc.a.dest, copyOpts)
+		}
+	}
+}
+
+func TestReleaseMetadata(t *testing.T) {
+	release := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	pageviews := []string{"pageviews/pageviews-2024-W08.zst", "pageviews/pageviews-2024-W06.zst"}
+	got := releaseMetadata(release, pageviews)
+	if got["Release"] != "2024-03-01" || got["Pageviews"] != "2024-W06/2024-W08" || got["Builder-Version"] == "" {
+		t.Errorf("got %v", got)
+	}
+	if _, found := releaseMetadata(release, nil)["Pageviews"]; found {
+		t.Error("without pageviews, there should be no Pageviews metadata")
+	}
+}
+
+func TestBuilderVersion(t *testing.T) {
+	if builderVersion() == "" {
+		t.Error("builderVersion() should not be empty")
+	}
+}
@@ -0,0 +1,101 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// HealthServer serves endpoints for the container infrastructure
+// and for humans who want to know how far a build has come.
+//
+//	GET /healthz   liveness; fails if a running build seems stuck
+//	GET /progress  status of the current or last build, with an estimate
+//	               of when the current stage will be done
+//
+// Unlike the admin API, these endpoints need no token: they only
+// reveal the build status, and cannot change anything.
+type healthServer struct {
+	progress     *buildProgress
+	stallTimeout time.Duration // 0 to never report a build as stuck
+	now          func() time.Time
+}
+
+func newHealthServer(p *buildProgress, stallTimeout time.Duration) *healthServer {
+	return &healthServer{progress: p, stallTimeout: stallTimeout, now: time.Now}
+}
+
+// ProgressReport is the response of the /progress endpoint.
+type progressReport struct {
+	BuildStatus
+
+	// For stages that consist of individual tasks, the percentage
+	// of finished tasks in the current stage, and the estimated time
+	// when the stage will be done. The estimate assumes that the
+	// remaining tasks take as long, on average, as the finished ones.
+	Percent float64    `json:"percent,omitempty"`
+	ETA     *time.Time `json:"eta,omitempty"`
+}
+
+// ServeHTTP implements the http.Handler interface.
+func (h *healthServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	switch req.URL.Path {
+	case "/healthz":
+		if err := h.check(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte("ok\n"))
+	case "/progress":
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(h.report())
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+// Check returns an error if a running build has not made any
+// progress for longer than the stall timeout. A restart is then
+// the best remedy, since completed work does not get lost.
+func (h *healthServer) check() error {
+	h.progress.mutex.Lock()
+	defer h.progress.mutex.Unlock()
+	if h.stallTimeout <= 0 || h.progress.status.State != "running" {
+		return nil
+	}
+	if idle := h.now().Sub(h.progress.updated); idle > h.stallTimeout {
+		return fmt.Errorf("build stuck: no progress in stage %q for %s", h.progress.status.Stage, idle.Round(time.Second))
+	}
+	return nil
+}
+
+// Report returns the current progress, with an estimate of when
+// the current stage will be done.
+func (h *healthServer) report() progressReport {
+	h.progress.mutex.Lock()
+	defer h.progress.mutex.Unlock()
+	r := progressReport{BuildStatus: h.progress.status}
+	if r.State != "running" || r.Total <= 0 {
+		return r
+	}
+	r.Percent = 100 * float64(r.Done) / float64(r.Total)
+	if r.Done > 0 {
+		elapsed := h.now().Sub(h.progress.stageStarted)
+		remaining := time.Duration(float64(elapsed) * float64(r.Total-r.Done) / float64(r.Done))
+		eta := h.now().Add(remaining).UTC().Truncate(time.Second)
+		r.ETA = &eta
+	}
+	return r
+}
@@ -0,0 +1,91 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func sendHealthRequest(h *healthServer, method, path string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+	return w
+}
+
+func TestHealthServer_Healthz(t *testing.T) {
+	p := &buildProgress{status: BuildStatus{State: "idle"}}
+	h := newHealthServer(p, time.Hour)
+	if w := sendHealthRequest(h, "GET", "/healthz"); w.Code != http.StatusOK {
+		t.Errorf("idle: got status %d, want 200", w.Code)
+	}
+
+	p.start()
+	p.setStage("titles", 10)
+	now := time.Now()
+	h.now = func() time.Time { return now.Add(30 * time.Minute) }
+	if w := sendHealthRequest(h, "GET", "/healthz"); w.Code != http.StatusOK {
+		t.Errorf("running: got status %d, want 200", w.Code)
+	}
+
+	h.now = func() time.Time { return now.Add(2 * time.Hour) }
+	if w := sendHealthRequest(h, "GET", "/healthz"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("stuck: got status %d, want 503", w.Code)
+	}
+
+	// Without stall timeout, builds are never considered stuck.
+	h.stallTimeout = 0
+	if w := sendHealthRequest(h, "GET", "/healthz"); w.Code != http.StatusOK {
+		t.Errorf("no stall timeout: got status %d, want 200", w.Code)
+	}
+
+	// Finished builds are not stuck, no matter how long ago.
+	h.stallTimeout = time.Hour
+	p.finish(nil)
+	if w := sendHealthRequest(h, "GET", "/healthz"); w.Code != http.StatusOK {
+		t.Errorf("finished: got status %d, want 200", w.Code)
+	}
+}
+
+func TestHealthServer_Progress(t *testing.T) {
+	p := &buildProgress{}
+	p.start()
+	p.setStage("titles", 4)
+	p.advance()
+	h := newHealthServer(p, time.Hour)
+	stageStarted := p.stageStarted
+	h.now = func() time.Time { return stageStarted.Add(10 * time.Minute) }
+
+	w := sendHealthRequest(h, "GET", "/progress")
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want 200", w.Code)
+	}
+	var got progressReport
+	if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if got.State != "running" || got.Stage != "titles" || got.Done != 1 || got.Total != 4 {
+		t.Errorf("got %+v", got)
+	}
+	if got.Percent != 25 {
+		t.Errorf("got percent %v, want 25", got.Percent)
+	}
+	wantETA := stageStarted.Add(40 * time.Minute).UTC().Truncate(time.Second)
+	if got.ETA == nil || !got.ETA.Equal(wantETA) {
+		t.Errorf("got ETA %v, want %v", got.ETA, wantETA)
+	}
+}
+
+func TestHealthServer_Errors(t *testing.T) {
+	h := newHealthServer(&buildProgress{}, time.Hour)
+	if w := sendHealthRequest(h, "POST", "/healthz"); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST: got status %d, want 405", w.Code)
+	}
+	if w := sendHealthRequest(h, "GET", "/admin/build"); w.Code != http.StatusNotFound {
+		t.Errorf("unknown path: got status %d, want 404", w.Code)
+	}
+}
@@ -0,0 +1,237 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lanrat/extsort"
+	"golang.org/x/sync/errgroup"
+)
+
+// HistoryReleases is the number of releases kept in the history file.
+const historyReleases = 24
+
+// HistoryRow is one line of a history file.
+type historyRow struct {
+	Entity int64
+	Scores []string // empty string if not ranked in that release
+}
+
+// BuildHistory computes the history of QRank scores across releases.
+// The output is a gzip-compressed CSV file whose first column is the
+// entity ID, followed by one column per release with the QRank score
+// in that release, or an empty value if the entity was not ranked.
+// The header line gives the release dates, such as "2024-03-01".
+// Rows are sorted by entity ID. The file is built incrementally
+// from the previous history file in storage, keeping the last
+// historyReleases releases.
+func buildHistory(ctx context.Context, cfg *buildConfig, date time.Time, qrankPath string, outDir string, s3 S3) (string, error) {
+	ymd := date.Format("20060102")
+	historyPath := filepath.Join(outDir, fmt.Sprintf("qrank-history-%s.gz", ymd))
+	_, err := os.Stat(historyPath)
+	if err == nil {
+		return historyPath, nil // use pre-existing file
+	}
+	if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	prev, err := publishedVersion(ctx, cfg, "qrank-history", ".csv.gz", date, s3)
+	if err != nil {
+		return "", err
+	}
+
+	if logger != nil {
+		logger.Printf("building %s", historyPath)
+	}
+	start := time.Now()
+
+	// Without a previous history file, we start from an empty one.
+	var prevReader io.Reader = strings.NewReader("Entity\n")
+	if !prev.IsZero() {
+		prevKey := cfg.PublicPrefix + fmt.Sprintf("qrank-history-%s.csv.gz", prev.Format("20060102"))
+		r, err := NewS3Reader(ctx, cfg.Bucket, prevKey, s3)
+		if err != nil {
+			return "", err
+		}
+		defer r.Close()
+		prevReader, err = gzip.NewReader(r)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	qrankFile, err := os.Open(qrankPath)
+	if err != nil {
+		return "", err
+	}
+	defer qrankFile.Close()
+	qrankDecompressor, err := gzip.NewReader(qrankFile)
+	if err != nil {
+		return "", err
+	}
+
+	tmpPath := historyPath + ".tmp"
+	tmpFile, err := os.Create(tmpPath)
+	if err != nil {
+		return "", err
+	}
+	defer tmpFile.Close()
+
+	writer, err := gzip.NewWriterLevel(tmpFile, 9)
+	if err != nil {
+		return "", err
+	}
+	defer writer.Close()
+
+	prevScanner := bufio.NewScanner(prevReader)
+	if !prevScanner.Scan() {
+		if err := prevScanner.Err(); err != nil {
+			return "", err
+		}
+		return "", fmt.Errorf("history file %s has no header", prev.Format(time.DateOnly))
+	}
+	prevDates := strings.Split(prevScanner.Text(), ",")[1:]
+
+	config := cfg.Sort.newConfig(0, 8)
+	newChan := make(chan extsort.SortType, cfg.Sort.buffer(10000))
+	newSorter, newOut, newErr := extsort.New(newChan, QRankFromBytes, QRankEntityLess, config)
+	oldChan := make(chan historyRow, 10000)
+	g, subCtx := errgroup.WithContext(ctx)
+	g.Go(func() error {
+		return readHistoryRows(prevScanner, len(prevDates), oldChan, subCtx)
+	})
+	g.Go(func() error {
+		return readQRankCSV(qrankDecompressor, newChan, subCtx)
+	})
+	g.Go(func() error {
+		newSorter.Sort(ctx) // not subCtx, as per extsort docs
+		return nil
+	})
+	g.Go(func() error {
+		return writeHistory(prevDates, oldChan, date.Format(time.DateOnly), newOut, writer)
+	})
+	if err := g.Wait(); err != nil {
+		return "", err
+	}
+	if err := <-newErr; err != nil {
+		return "", err
+	}
+
+	if err := writer.Close(); err != nil {
+		return "", err
+	}
+	if err := tmpFile.Sync(); err != nil {
+		return "", err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmpPath, historyPath); err != nil {
+		return "", err
+	}
+
+	if logger != nil {
+		logger.Printf("built %s in %.1fs", historyPath, time.Since(start).Seconds())
+	}
+
+	return historyPath, nil
+}
+
+// ReadHistoryRows reads the rows of a history file, sending them to
+// a channel before closing that channel. The header must already have
+// been consumed.
+func readHistoryRows(scanner *bufio.Scanner, numReleases int, ch chan<- historyRow, ctx context.Context) error {
+	defer close(ch)
+	for scanner.Scan() {
+		line := scanner.Text()
+		cols := strings.Split(line, ",")
+		if len(cols) != numReleases+1 {
+			return fmt.Errorf("expected %d columns, got %q", numReleases+1, line)
+		}
+		entity := ParseItem(cols[0])
+		if entity == NoItem {
+			return fmt.Errorf("expected Q..., got %q", line)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case ch <- historyRow{Entity: int64(entity), Scores: cols[1:]}:
+		}
+	}
+	return scanner.Err()
+}
+
+// WriteHistory merges the rows of the previous history file with the
+// records of a new QRank release, both sorted by entity ID, and writes
+// the result in CSV format. Releases beyond historyReleases are dropped,
+// and so are entities that are not ranked in any of the kept releases.
+func writeHistory(oldDates []string, old <-chan historyRow, newDate string, new <-chan extsort.SortType, w io.Writer) error {
+	dates := append(slices.Clone(oldDates), newDate)
+	drop := max(0, len(dates)-historyReleases)
+	header := "Entity," + strings.Join(dates[drop:], ",") + "\n"
+	if _, err := w.Write([]byte(header)); err != nil {
+		return err
+	}
+
+	emptyOld := make([]string, len(oldDates))
+	o, oldOK := <-old
+	n, newOK := <-new
+	for oldOK || newOK {
+		var entity int64
+		scores, score := emptyOld, ""
+		switch {
+		case oldOK && (!newOK || o.Entity < n.(QRank).Entity):
+			entity, scores = o.Entity, o.Scores
+			o, oldOK = <-old
+		case newOK && (!oldOK || n.(QRank).Entity < o.Entity):
+			entity, score = n.(QRank).Entity, strconv.FormatInt(n.(QRank).Rank, 10)
+			n, newOK = <-new
+		default:
+			entity, scores = o.Entity, o.Scores
+			score = strconv.FormatInt(n.(QRank).Rank, 10)
+			o, oldOK = <-old
+			n, newOK = <-new
+		}
+		if err := writeHistoryLine(w, entity, append(scores[drop:len(scores):len(scores)], score)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeHistoryLine(w io.Writer, entity int64, scores []string) error {
+	ranked := false
+	for _, s := range scores {
+		if s != "" {
+			ranked = true
+			break
+		}
+	}
+	if !ranked {
+		return nil
+	}
+
+	var buf strings.Builder
+	buf.WriteByte('Q')
+	buf.WriteString(strconv.FormatInt(entity, 10))
+	for _, s := range scores {
+		buf.WriteByte(',')
+		buf.WriteString(s)
+	}
+	buf.WriteByte('\n')
+	_, err := w.Write([]byte(buf.String()))
+	return err
+}
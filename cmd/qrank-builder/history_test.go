@@ -0,0 +1,89 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lanrat/extsort"
+)
+
+func TestBuildHistory(t *testing.T) {
+	s3 := NewFakeS3()
+	prev := filepath.Join(t.TempDir(), "prev.gz")
+	writeGzipFile(prev, "Entity,2024-01-01,2024-02-01\nQ1,1,2\nQ3,,5\nQ4,6,\n")
+	data, err := os.ReadFile(prev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s3.data["public/qrank-history-20240201.csv.gz"] = data
+	s3.data["public/qrank-history-20240401.csv.gz"] = data // newer than build
+
+	qrank := filepath.Join(t.TempDir(), "qrank.gz")
+	writeGzipFile(qrank, "Entity,QRank\nQ3,80\nQ2,42\nQ1,3\n")
+	date := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	path, err := buildHistory(context.Background(), newBuildConfig(""), date, qrank, t.TempDir(), s3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := readGzipFile(path)
+	want := "Entity,2024-01-01,2024-02-01,2024-03-01\n" +
+		"Q1,1,2,3\nQ2,,,42\nQ3,,5,80\nQ4,6,,\n"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestBuildHistory_NoPrevious(t *testing.T) {
+	s3 := NewFakeS3()
+	qrank := filepath.Join(t.TempDir(), "qrank.gz")
+	writeGzipFile(qrank, "Entity,QRank\nQ4,80\nQ17,3\n")
+	date := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	path, err := buildHistory(context.Background(), newBuildConfig(""), date, qrank, t.TempDir(), s3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := readGzipFile(path)
+	want := "Entity,2024-03-01\nQ4,80\nQ17,3\n"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestWriteHistory_DropsOldReleases(t *testing.T) {
+	dates := make([]string, historyReleases)
+	for i := range dates {
+		dates[i] = fmt.Sprintf("d%02d", i)
+	}
+	scores := make([]string, historyReleases)
+	scores[0] = "7" // only ranked in the oldest release
+	old := make(chan historyRow, 2)
+	old <- historyRow{Entity: 1, Scores: scores}
+	old <- historyRow{Entity: 2, Scores: append(make([]string, historyReleases-1), "9")}
+	close(old)
+	new := make(chan extsort.SortType, 1)
+	new <- QRank{Entity: 3, Rank: 5}
+	close(new)
+
+	var buf strings.Builder
+	if err := writeHistory(dates, old, "new", new, &buf); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(buf.String(), "\n")
+	if got, want := lines[0], "Entity,"+strings.Join(dates[1:], ",")+",new"; got != want {
+		t.Errorf("got header %q, want %q", got, want)
+	}
+	emptyCols := strings.Repeat(",", historyReleases-2)
+	want := []string{"Q2" + emptyCols + ",9,", "Q3" + emptyCols + ",,5", ""}
+	if got := lines[1:]; strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -11,7 +11,6 @@ import (
 	"io"
 	"os"
 	"path/filepath"
-	"runtime"
 	"slices"
 	"strconv"
 	"strings"
@@ -22,7 +21,7 @@ import (
 )
 
 // BuildInterwikiLinks builds the interwiki_links file for a WikiSite and puts it in S3 storage.
-func buildInterwikiLinks(site *WikiSite, ctx context.Context, dumps string, s3 S3) error {
+func buildInterwikiLinks(site *WikiSite, ctx context.Context, cfg *buildConfig, s3 S3) error {
 	destPath := site.S3Path("interwiki_links")
 	logger.Printf("building %s", destPath)
 
@@ -32,19 +31,17 @@ func buildInterwikiLinks(site *WikiSite, ctx context.Context, dumps string, s3 S
 	}
 	defer os.Remove(outFile.Name())
 
-	linesChan := make(chan string, 10000)
-	config := extsort.DefaultConfig()
-	config.ChunkSize = 8 * 1024 * 1024 / 64 // 8 MiB, 64 Bytes/line avg
-	config.NumWorkers = runtime.NumCPU()
+	linesChan := make(chan string, cfg.Sort.buffer(10000))
+	config := cfg.Sort.newConfig(8*1024*1024/64, 64) // 8 MiB, 64 Bytes/line avg
 	sorter, outChan, errChan := extsort.Strings(linesChan, config)
 
 	group, groupCtx := errgroup.WithContext(ctx)
 	group.Go(func() error {
 		defer close(linesChan)
-		if err := ReadPageItemsOld(groupCtx, site, "A", s3, linesChan); err != nil {
+		if err := ReadPageItemsOld(groupCtx, site, "A", cfg.Bucket, s3, linesChan); err != nil {
 			return err
 		}
-		if err := processInterwikiLinks(groupCtx, site, "B", dumps, linesChan); err != nil {
+		if err := processInterwikiLinks(groupCtx, site, "B", cfg.Dumps, linesChan); err != nil {
 			return err
 		}
 		return nil
@@ -74,13 +71,13 @@ func buildInterwikiLinks(site *WikiSite, ctx context.Context, dumps string, s3 S
 	if err := <-errChan; err != nil {
 		return err
 	}
-	sorted, err := SortLines(ctx, outFile.Name())
+	sorted, err := SortLines(ctx, outFile.Name(), cfg.Sort)
 	if err != nil {
 		return err
 	}
 	defer os.Remove(sorted)
 
-	if err := PutInStorage(ctx, sorted, s3, "qrank", destPath, "application/zstd"); err != nil {
+	if err := PutInStorage(ctx, sorted, s3, cfg.Bucket, destPath, "application/zstd"); err != nil {
 		return err
 	}
 
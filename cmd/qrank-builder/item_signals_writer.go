@@ -15,6 +15,7 @@ type ItemSignalsWriter struct {
 	signals     ItemSignals
 	out         io.WriteCloser
 	wroteHeader bool
+	rows        int64
 }
 
 func NewItemSignalsWriter(w io.WriteCloser) *ItemSignalsWriter {
@@ -83,6 +84,7 @@ func (w *ItemSignalsWriter) flush() error {
 	buf.WriteByte('\n')
 
 	w.signals.Clear()
+	w.rows += 1
 	_, err := w.out.Write(buf.Bytes())
 	return err
 }
@@ -7,12 +7,13 @@ import (
 	"bufio"
 	"context"
 	"encoding/binary"
+	"encoding/json"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
 	"regexp"
-	"runtime"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -137,22 +138,34 @@ func ItemSignalsLess(a, b extsort.SortType) bool {
 
 // BuildItemSignals builds per-item signals and puts them in storage.
 // If the signals file is already in storage, it does not get re-built.
-func buildItemSignals(ctx context.Context, pageviews []string, sites *WikiSites, s3 S3) (time.Time, error) {
-	stored, err := StoredItemSignalsVersion(ctx, s3)
+// When building from the dumps as of a past date, the signals file
+// for that date gets built unless it is in storage, even if storage
+// has a more recent version.
+func buildItemSignals(ctx context.Context, cfg *buildConfig, pageviews []string, sites *WikiSites, s3 S3) (time.Time, error) {
+	stored, err := StoredItemSignalsVersion(ctx, cfg, s3)
 	if err != nil {
 		return time.Time{}, err
 	}
 
 	newest := ItemSignalsVersion(pageviews, sites)
-	if !newest.After(stored) {
+	newestYMD := newest.Format("20060102")
+	destPath := cfg.PublicPrefix + fmt.Sprintf("item_signals-%s.csv.zst", newestYMD)
+	if !cfg.AsOf.IsZero() {
+		sizes, err := storedSizes(ctx, cfg.Bucket, destPath, s3)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if _, found := sizes[destPath]; found {
+			logger.Printf("signals for %s are already in storage", newest.Format(time.DateOnly))
+			return newest, nil
+		}
+	} else if !newest.After(stored) {
 		s := stored.Format(time.DateOnly)
 		n := newest.Format(time.DateOnly)
 		logger.Printf("signals in storage are still fresh: stored=%s, newest=%s", s, n)
 		return stored, nil
 	}
 
-	newestYMD := newest.Format("20060102")
-	destPath := fmt.Sprintf("public/item_signals-%s.csv.zst", newestYMD)
 	logger.Printf("building %s", destPath)
 	outFile, err := os.CreateTemp("", "*-item_signals.csv.zst")
 	if err != nil {
@@ -169,6 +182,56 @@ func buildItemSignals(ctx context.Context, pageviews []string, sites *WikiSites,
 	defer compressor.Close()
 	writer := NewItemSignalsWriter(compressor)
 
+	// When streaming, pageviews gets narrowed below to the weeks that
+	// are in storage, but the release metadata should still tell which
+	// weeks went into the signals.
+	weeks := pageviews
+
+	scanners := make([]LineScanner, 0, len(pageviews)+1)
+	scannerNames := make([]string, 0, len(pageviews)+1)
+	scanners = append(scanners, NewPageSignalsScanner(sites, cfg.Bucket, s3))
+	scannerNames = append(scannerNames, "page_signals")
+
+	if cfg.StreamPageviews && len(pageviews) > 0 {
+		// Weeks that earlier builds have already aggregated into
+		// weekly pageview files get read from storage, so we only
+		// stream the weeks that are not covered yet.
+		stored, err := storedPageviews(ctx, cfg.Bucket, s3)
+		if err != nil {
+			return time.Time{}, err
+		}
+		var seeded, streamed []string
+		for _, pv := range pageviews {
+			week := strings.TrimSuffix(strings.TrimPrefix(pv, "pageviews/pageviews-"), ".zst")
+			if _, found := slices.BinarySearch(stored, week); found {
+				seeded = append(seeded, pv)
+			} else {
+				streamed = append(streamed, pv)
+			}
+		}
+		pageviews = seeded
+
+		if len(streamed) > 0 {
+			// Pageviews for pages without Wikidata items can never make
+			// it into the output, so we drop them before sorting. We
+			// cannot do this for the weekly pageview files in storage,
+			// because they get re-used by later builds, when some of
+			// these pages may have been linked to items.
+			filter, err := itemPages(sites, cfg.Bucket, s3)
+			if err != nil {
+				return time.Time{}, err
+			}
+			logger.Printf("debug: BuildItemSignals(): streaming %d weeks of pageviews from dumps, keeping %d pages with items; %d weeks are in storage", len(streamed), filter.size, len(seeded))
+			stream, err := newPageviewsStream(ctx, cfg, streamed, filter)
+			if err != nil {
+				return time.Time{}, err
+			}
+			defer stream.Close()
+			scanners = append(scanners, stream)
+			scannerNames = append(scannerNames, "pageviews stream")
+		}
+	}
+
 	// Download all pageview files from S3 storage to local disk, to work
 	// around an apparent flakiness in Wikimedia's storage infrastructure.
 	// https://github.com/brawer/wikidata-qrank/issues/40
@@ -178,29 +241,28 @@ func buildItemSignals(ctx context.Context, pageviews []string, sites *WikiSites,
 	}
 	defer os.RemoveAll(tempDir)
 
-	// logger.Printf("BuildItemSignals(): download %d pageview files to %s", len(pageviews), tempDir)
+	logger.Printf("debug: BuildItemSignals(): download %d pageview files to %s", len(pageviews), tempDir)
 	localPageViews := make([]string, 0, len(pageviews))
 	for _, pv := range pageviews {
 		path := filepath.Join(tempDir, filepath.Base(pv))
 		localPageViews = append(localPageViews, path)
 		opts := minio.GetObjectOptions{}
-		if err := s3.FGetObject(ctx, "qrank", pv, path, opts); err != nil {
+		downloadCtx, span := startSpan(ctx, "download", "key", pv)
+		err := s3.FGetObject(downloadCtx, cfg.Bucket, pv, path, opts)
+		span.finish(err)
+		if err != nil {
 			return time.Time{}, err
 		}
 	}
-	// logger.Printf("BuildItemSignals(): finished downloading pageview files")
-
-	scanners := make([]LineScanner, 0, len(pageviews)+1)
-	scannerNames := make([]string, 0, len(pageviews)+1)
-	scanners = append(scanners, NewPageSignalsScanner(sites, s3))
-	scannerNames = append(scannerNames, "page_signals")
+	stageReadBytes.WithLabelValues("item_signals").Add(float64(fileSizes(localPageViews)))
+	logger.Printf("debug: BuildItemSignals(): finished downloading pageview files")
 
 	for _, pv := range localPageViews {
 		reader, err := os.Open(pv)
 		if err != nil {
 			return time.Time{}, err
 		}
-		decompressor, err := zstd.NewReader(reader)
+		decompressor, err := newCacheReader(pv, reader, cfg.CacheDictionary)
 		if err != nil {
 			return time.Time{}, err
 		}
@@ -209,26 +271,26 @@ func buildItemSignals(ctx context.Context, pageviews []string, sites *WikiSites,
 	}
 
 	// Produce a stream of ItemSignals, sorted by Wikidata item ID.
-	sigChan := make(chan extsort.SortType, 10000)
-	config := extsort.DefaultConfig()
-	config.ChunkSize = 8 * 1024 * 1024 / 64 // 8 MiB, 64 Bytes/line avg
-	config.NumWorkers = runtime.NumCPU()
+	sigChan := make(chan extsort.SortType, cfg.Sort.buffer(10000))
+	config := cfg.Sort.newConfig(8*1024*1024/64, 64) // 8 MiB, 64 Bytes/line avg
 	sorter, outChan, errChan := extsort.New(sigChan, ItemSignalsFromBytes, ItemSignalsLess, config)
 	merger := NewLineMerger(scanners, scannerNames)
-	group, groupCtx := errgroup.WithContext(ctx)
+	mergeCtx, mergeSpan := startSpan(ctx, "sort and merge")
+	group, groupCtx := errgroup.WithContext(mergeCtx)
+	siteViews := make(map[string]int64, len(sites.Sites))
 	group.Go(func() error {
-		joiner := itemSignalsJoiner{out: sigChan}
+		joiner := itemSignalsJoiner{out: sigChan, siteViews: siteViews}
 		for merger.Advance() {
 			line := merger.Line()
 			if err := joiner.Process(line); err != nil {
 				joiner.Close()
-				logger.Printf(`ItemSignalsJoiner.Process("%s") failed: %v`, line, err)
+				logger.Printf(`error: ItemSignalsJoiner.Process("%s") failed: %v`, line, err)
 				return err
 			}
 		}
 		joiner.Close()
 		if err := merger.Err(); err != nil {
-			logger.Printf("LineMerger failed: %v", err)
+			logger.Printf("error: LineMerger failed: %v", err)
 			return err
 		}
 		return nil
@@ -246,25 +308,27 @@ func buildItemSignals(ctx context.Context, pageviews []string, sites *WikiSites,
 				if !more {
 					err := writer.Close()
 					if err != nil {
-						logger.Printf("ItemSignalsWriter.Close() failed: %v", err)
+						logger.Printf("error: ItemSignalsWriter.Close() failed: %v", err)
 					}
 					return err
 				}
 				if err := writer.Write(s.(ItemSignals)); err != nil {
-					logger.Printf("ItemSignalsWriter.Write() failed: %v", err)
+					logger.Printf("error: ItemSignalsWriter.Write() failed: %v", err)
 					return err
 				}
 			}
 		}
 	})
 
-	if err := group.Wait(); err != nil {
-		logger.Printf("BuildItemSignals(): group.Wait() failed, err==%v", err)
+	err = group.Wait()
+	mergeSpan.finish(err)
+	if err != nil {
+		logger.Printf("error: BuildItemSignals(): group.Wait() failed, err==%v", err)
 		return time.Time{}, err
 	}
 
 	if err := <-errChan; err != nil {
-		logger.Printf("BuildItemSignals(): sorting failed, err=%v", err)
+		logger.Printf("error: BuildItemSignals(): sorting failed, err=%v", err)
 		return time.Time{}, err
 	}
 
@@ -276,9 +340,33 @@ func buildItemSignals(ctx context.Context, pageviews []string, sites *WikiSites,
 		}
 	}
 
-	if err := PutInStorage(ctx, outFile.Name(), s3, "qrank", destPath, "application/zstd"); err != nil {
+	if err := checkCanaries(outFile.Name(), cfg.Canaries); err != nil {
+		logger.Printf("error: not publishing %s: %v", destPath, err)
+		return time.Time{}, err
+	}
+
+	if err := checkAnomalies(ctx, cfg, outFile.Name(), newest, s3); err != nil {
+		logger.Printf("error: not publishing %s: %v", destPath, err)
+		return time.Time{}, err
+	}
+
+	if _, err := validateItemSignalsFile(outFile.Name()); err != nil {
+		logger.Printf("error: not publishing %s: %v", destPath, err)
+		return time.Time{}, err
+	}
+
+	// The per-site views are not published, but the release stage
+	// puts them into the stats. Therefore, they need to be in storage
+	// before the item signals.
+	if err := storeSiteViews(ctx, cfg, newest, siteViews, s3); err != nil {
+		return time.Time{}, err
+	}
+
+	a := artifact{destPath, outFile.Name(), "application/zstd"}
+	if err := PublishInStorage(ctx, a, releaseMetadata(newest, weeks), s3, cfg.Bucket); err != nil {
 		return time.Time{}, err
 	}
+	stageRows.WithLabelValues("item_signals").Add(float64(writer.rows))
 
 	if err := os.Remove(outFile.Name()); err != nil {
 		return time.Time{}, err
@@ -291,6 +379,10 @@ type itemSignalsJoiner struct {
 	out                                                                  chan<- extsort.SortType
 	domain                                                               string
 	page, item, pageviews, wikitextBytes, claims, identifiers, sitelinks int64
+
+	// SiteViews, if not nil, accumulates the pageviews that each site,
+	// such as "en.wikipedia", has contributed to the item signals.
+	siteViews map[string]int64
 }
 
 func (j *itemSignalsJoiner) Process(line string) error {
@@ -367,6 +459,9 @@ func (j *itemSignalsJoiner) Close() {
 }
 
 func (j *itemSignalsJoiner) flush() {
+	if j.item != 0 && j.pageviews != 0 && j.siteViews != nil {
+		j.siteViews[j.domain] += j.pageviews
+	}
 	if j.item != 0 {
 		j.out <- ItemSignals{
 			item:          j.item,
@@ -387,6 +482,34 @@ func (j *itemSignalsJoiner) flush() {
 	j.sitelinks = 0
 }
 
+// SiteViewsKey returns the storage key for the per-site views
+// that went into the item signals of a release.
+func siteViewsKey(release time.Time) string {
+	return fmt.Sprintf("item_signals/siteviews-%s.json", release.Format("20060102"))
+}
+
+// StoreSiteViews puts the per-site views of a release into storage,
+// in the format that readSiteStats reads.
+func storeSiteViews(ctx context.Context, cfg *buildConfig, release time.Time, siteViews map[string]int64, s3 S3) error {
+	data, err := json.Marshal(siteViews)
+	if err != nil {
+		return err
+	}
+	file, err := os.CreateTemp("", "*-siteviews.json")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+	if _, err := file.Write(data); err != nil {
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return PutInStorage(ctx, file.Name(), s3, cfg.Bucket, siteViewsKey(release), "application/json")
+}
+
 func ItemSignalsVersion(pageviews []string, sites *WikiSites) time.Time {
 	var date time.Time
 	re := regexp.MustCompile(`^pageviews/pageviews-(\d{4}-W\d{2}).zst$`)
@@ -413,11 +536,11 @@ func ItemSignalsVersion(pageviews []string, sites *WikiSites) time.Time {
 
 // StoredItemSignalsVersion returns the version of the signals file in storage.
 // If there is no such file, the result is the zero time.Time without error.
-func StoredItemSignalsVersion(ctx context.Context, s3 S3) (time.Time, error) {
-	re := regexp.MustCompile(`^public/item_signals-(\d{8}).csv.zst$`)
+func StoredItemSignalsVersion(ctx context.Context, cfg *buildConfig, s3 S3) (time.Time, error) {
+	re := regexp.MustCompile("^" + regexp.QuoteMeta(cfg.PublicPrefix) + `item_signals-(\d{8}).csv.zst$`)
 	var result time.Time
-	opts := minio.ListObjectsOptions{Prefix: "public/"}
-	for obj := range s3.ListObjects(ctx, "qrank", opts) {
+	opts := minio.ListObjectsOptions{Prefix: cfg.PublicPrefix}
+	for obj := range s3.ListObjects(ctx, cfg.Bucket, opts) {
 		if obj.Err != nil {
 			return time.Time{}, obj.Err
 		}
@@ -141,7 +141,7 @@ func TestBuildItemSignals(t *testing.T) {
 		Domains: map[string]*WikiSite{"rm.wikipedia.org": rmwikiSite, "www.wikidata.org": wikidatawikiSite},
 	}
 
-	date, err := buildItemSignals(ctx, pageviews, sites, s3)
+	date, err := buildItemSignals(ctx, newBuildConfig(""), pageviews, sites, s3)
 	if err != nil {
 		t.Error(err)
 	}
@@ -220,9 +220,34 @@ func TestItemSignalsVersion_OldPageviews(t *testing.T) {
 	}
 }
 
+func TestBuildItemSignals_AsOfAlreadyStored(t *testing.T) {
+	cfg := newBuildConfig("")
+	cfg.AsOf = time.Date(2011, 12, 31, 0, 0, 0, 0, time.UTC)
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	s3 := NewFakeS3()
+	s3.data["public/item_signals-20111209.csv.zst"] = []byte("stored")
+	dumped, _ := time.Parse(time.DateOnly, "2011-12-09")
+	site := &WikiSite{Key: "rmwiki", Domain: "rm.wikipedia.org", LastDumped: dumped}
+	sites := &WikiSites{
+		Sites:   map[string]*WikiSite{"rmwiki": site},
+		Domains: map[string]*WikiSite{"rm.wikipedia.org": site},
+	}
+
+	date, err := buildItemSignals(context.Background(), cfg, nil, sites, s3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := date.Format(time.DateOnly); got != "2011-12-09" {
+		t.Errorf("got %s, want 2011-12-09", got)
+	}
+	if got := string(s3.data["public/item_signals-20111209.csv.zst"]); got != "stored" {
+		t.Errorf("stored signals should not have been rebuilt, got %q", got)
+	}
+}
+
 func TestStoredItemSignalsVersion(t *testing.T) {
 	s3 := NewFakeS3()
-	got, err := StoredItemSignalsVersion(context.Background(), s3)
+	got, err := StoredItemSignalsVersion(context.Background(), newBuildConfig(""), s3)
 	if err != nil {
 		t.Error(err)
 	}
@@ -231,7 +256,7 @@ func TestStoredItemSignalsVersion(t *testing.T) {
 	}
 	s3.data["public/item_signals-20230815.csv.zst"] = []byte("foo")
 	s3.data["public/item_signals-20240131.csv.zst"] = []byte("bar")
-	got, err = StoredItemSignalsVersion(context.Background(), s3)
+	got, err = StoredItemSignalsVersion(context.Background(), newBuildConfig(""), s3)
 	if err != nil {
 		t.Error(err)
 	}
@@ -268,3 +293,26 @@ func TestItemSignalsJoiner(t *testing.T) {
 		t.Errorf("got %v, want %v", got, want)
 	}
 }
+
+func TestItemSignalsJoiner_SiteViews(t *testing.T) {
+	ch := make(chan extsort.SortType, 20)
+	siteViews := make(map[string]int64)
+	joiner := itemSignalsJoiner{out: ch, siteViews: siteViews}
+	for _, line := range []string{
+		"en.wikipedia,1,99",
+		"en.wikipedia,200,198",
+		"en.wikipedia,200,Q72,4,550,85,186",
+		"rm.wikipedia,7,5",
+		"rm.wikipedia,7,Q72",
+		"rm.wikipedia,8,Q662541",
+	} {
+		if err := joiner.Process(line); err != nil {
+			t.Error(err)
+		}
+	}
+	joiner.Close()
+	want := map[string]int64{"en.wikipedia": 198, "rm.wikipedia": 5}
+	if !reflect.DeepEqual(siteViews, want) {
+		t.Errorf("got %v, want %v", siteViews, want)
+	}
+}
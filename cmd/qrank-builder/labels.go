@@ -0,0 +1,373 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"golang.org/x/sync/errgroup"
+
+	"github.com/andybalholm/brotli"
+	"github.com/lanrat/extsort"
+)
+
+// EntityLabel is the label of a Wikidata entity in some language.
+type EntityLabel struct {
+	Entity int64
+	Label  string
+}
+
+func (el EntityLabel) ToBytes() []byte {
+	buf := make([]byte, binary.MaxVarintLen64+len(el.Label))
+	n := binary.PutVarint(buf, el.Entity)
+	n += copy(buf[n:], el.Label)
+	return buf[0:n]
+}
+
+func EntityLabelFromBytes(b []byte) extsort.SortType {
+	entity, n := binary.Varint(b)
+	return EntityLabel{Entity: entity, Label: string(b[n:])}
+}
+
+func EntityLabelLess(a, b extsort.SortType) bool {
+	return a.(EntityLabel).Entity < b.(EntityLabel).Entity
+}
+
+// LabeledQRank is a QRank record together with the entity label.
+type LabeledQRank struct {
+	Entity int64
+	Rank   int64
+	Label  string
+}
+
+func (lq LabeledQRank) ToBytes() []byte {
+	buf := make([]byte, binary.MaxVarintLen64*2+len(lq.Label))
+	n := binary.PutVarint(buf, lq.Entity)
+	n += binary.PutVarint(buf[n:], lq.Rank)
+	n += copy(buf[n:], lq.Label)
+	return buf[0:n]
+}
+
+func LabeledQRankFromBytes(b []byte) extsort.SortType {
+	entity, entitySize := binary.Varint(b)
+	rank, rankSize := binary.Varint(b[entitySize:])
+	label := string(b[entitySize+rankSize:])
+	return LabeledQRank{Entity: entity, Rank: rank, Label: label}
+}
+
+func LabeledQRankLess(a, b extsort.SortType) bool {
+	// Same sort order as QRankLess.
+	x, y := a.(LabeledQRank), b.(LabeledQRank)
+	if x.Rank != y.Rank {
+		return x.Rank > y.Rank
+	} else {
+		return x.Entity < y.Entity
+	}
+}
+
+// ProcessExtractor runs an entityExtractor on the JSON representation
+// of a Wikidata entity, sending the extracted value to a channel.
+// Like processEntity(), this works directly on the raw JSON bytes for speed.
+func processExtractor(data []byte, ex entityExtractor, out chan<- extsort.SortType, ctx context.Context) error {
+	idStart := bytes.Index(data, []byte(`,"id":"Q`))
+	if idStart < 0 {
+		return nil
+	}
+	idStart += 8
+	idLen := bytes.IndexByte(data[idStart:], '"')
+	if idLen < 1 || idLen > 25 {
+		return nil
+	}
+	entity, err := strconv.ParseInt(string(data[idStart:idStart+idLen]), 10, 64)
+	if err != nil || entity <= 0 {
+		return nil
+	}
+
+	value, ok := ex.extract(data)
+	if !ok {
+		return nil
+	}
+
+	select {
+	case out <- EntityLabel{Entity: entity, Label: value}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return nil
+}
+
+// LabelExtractor returns an entityExtractor for labels in a language.
+func labelExtractor(lang string) entityExtractor {
+	return entityExtractor{
+		name: "labels-" + lang,
+		extract: func(data []byte) (string, bool) {
+			return extractLabel(data, lang)
+		},
+	}
+}
+
+// ExtractLabel finds the label in a given language in the JSON
+// representation of a Wikidata entity.
+func extractLabel(data []byte, lang string) (string, bool) {
+	start := bytes.Index(data, []byte(`"labels":{`))
+	if start < 0 {
+		return "", false
+	}
+
+	// In Wikidata dumps, labels come before descriptions and aliases.
+	// Since these have the same structure as labels, we must not
+	// search past the start of descriptions.
+	limit := len(data)
+	if desc := bytes.Index(data[start:], []byte(`"descriptions":{`)); desc > 0 {
+		limit = start + desc
+	}
+
+	pattern := fmt.Sprintf(`"%s":{"language":"%s","value":"`, lang, lang)
+	pos := bytes.Index(data[start:limit], []byte(pattern))
+	if pos < 0 {
+		return "", false
+	}
+	valueStart := start + pos + len(pattern)
+	valueEnd := -1
+	for i := valueStart; i < limit; i++ {
+		if data[i] == '\\' {
+			i++
+		} else if data[i] == '"' {
+			valueEnd = i
+			break
+		}
+	}
+	if valueEnd < 0 {
+		return "", false
+	}
+
+	label, ok := unquote(data[valueStart-1 : valueEnd+1])
+	if !ok {
+		return "", false
+	}
+
+	// Labels go into line-oriented files, so we cannot have line breaks.
+	label = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return ' '
+		}
+		return r
+	}, label)
+	return label, true
+}
+
+// WriteLabels writes entity labels, one per line, such as
+// "Q42 Douglas Adams".
+func writeLabels(ch <-chan extsort.SortType, w io.Writer, ctx context.Context) error {
+	for {
+		select {
+		case data, ok := <-ch:
+			if !ok { // channel closed, end of input
+				return nil
+			}
+			el := data.(EntityLabel)
+			var buf bytes.Buffer
+			buf.WriteByte('Q')
+			buf.WriteString(strconv.FormatInt(el.Entity, 10))
+			buf.WriteByte(' ')
+			buf.WriteString(el.Label)
+			buf.WriteByte('\n')
+			if _, err := w.Write(buf.Bytes()); err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// BuildLabeledQRank builds a variant of the QRank file that has
+// an additional column with entity labels.
+func buildLabeledQRank(date time.Time, qrankPath string, labelsPath string, labelLang string, outDir string, sorting sortSettings, ctx context.Context) (string, error) {
+	outPath := filepath.Join(
+		outDir,
+		fmt.Sprintf("qrank-labels-%s-%04d%02d%02d.gz", labelLang, date.Year(), date.Month(), date.Day()))
+	_, err := os.Stat(outPath)
+	if err == nil {
+		return outPath, nil // use pre-existing file
+	}
+	if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	if logger != nil {
+		logger.Printf("building %s", outPath)
+	}
+	start := time.Now()
+
+	tmpPath := outPath + ".tmp"
+	tmpFile, err := os.Create(tmpPath)
+	if err != nil {
+		return "", err
+	}
+	defer tmpFile.Close()
+
+	writer, err := gzip.NewWriterLevel(tmpFile, 9)
+	if err != nil {
+		return "", err
+	}
+	defer writer.Close()
+
+	err = joinQRank(qrankPath, labelsPath, sorting, ctx, func(labeled <-chan extsort.SortType) error {
+		return writeLabeledQRank(labeled, writer)
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if err := writer.Close(); err != nil {
+		return "", err
+	}
+	if err := tmpFile.Sync(); err != nil {
+		return "", err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmpPath, outPath); err != nil {
+		return "", err
+	}
+
+	if logger != nil {
+		logger.Printf("built %s in %.1fs", outPath, time.Since(start).Seconds())
+	}
+
+	return outPath, nil
+}
+
+// JoinQRank joins a QRank file with a file of per-entity values,
+// such as the output of an entityExtractor. The joined LabeledQRank
+// records get passed to the write function in QRank order.
+func joinQRank(qrankPath string, labelsPath string, sorting sortSettings, ctx context.Context, write func(<-chan extsort.SortType) error) error {
+	qrankFile, err := os.Open(qrankPath)
+	if err != nil {
+		return err
+	}
+	defer qrankFile.Close()
+	qrankReader, err := gzip.NewReader(qrankFile)
+	if err != nil {
+		return err
+	}
+
+	labelsFile, err := os.Open(labelsPath)
+	if err != nil {
+		return err
+	}
+	defer labelsFile.Close()
+
+	// First, we sort the QRank records by entity ID, so we can join them
+	// with the labels file (which is also sorted by entity ID). Then,
+	// we sort the labeled records back into QRank order.
+	config := sorting.newConfig(0, 16)
+	qrankChan := make(chan extsort.SortType, sorting.buffer(10000))
+	labeledChan := make(chan extsort.SortType, sorting.buffer(10000))
+	bySorter, byEntity, byEntityErr := extsort.New(qrankChan, QRankFromBytes, QRankEntityLess, config)
+	labeledSorter, labeled, labeledErr := extsort.New(labeledChan, LabeledQRankFromBytes, LabeledQRankLess, config)
+	g, subCtx := errgroup.WithContext(ctx)
+	g.Go(func() error {
+		return readQRankCSV(qrankReader, qrankChan, subCtx)
+	})
+	g.Go(func() error {
+		bySorter.Sort(ctx) // not subCtx, as per extsort docs
+		return joinLabels(byEntity, brotli.NewReader(labelsFile), labeledChan, subCtx)
+	})
+	g.Go(func() error {
+		labeledSorter.Sort(ctx) // not subCtx, as per extsort docs
+		return write(labeled)
+	})
+	if err := g.Wait(); err != nil {
+		return err
+	}
+	if err := <-byEntityErr; err != nil {
+		return err
+	}
+	return <-labeledErr
+}
+
+// JoinLabels joins a stream of QRank records, sorted by entity ID,
+// with a labels file that is also sorted by entity ID. Entities without
+// a label are passed on with an empty label.
+func joinLabels(qranks <-chan extsort.SortType, labels io.Reader, out chan<- extsort.SortType, ctx context.Context) error {
+	defer close(out)
+	scanner := bufio.NewScanner(labels)
+	var labelEntity int64
+	var label string
+	advance := func() error {
+		labelEntity, label = 0, ""
+		if !scanner.Scan() {
+			return scanner.Err()
+		}
+		line := scanner.Text()
+		space := strings.IndexByte(line, ' ')
+		if space < 2 || line[0] != 'Q' {
+			return fmt.Errorf("bad label line: %q", line)
+		}
+		e, err := strconv.ParseInt(line[1:space], 10, 64)
+		if err != nil {
+			return err
+		}
+		labelEntity, label = e, line[space+1:]
+		return nil
+	}
+	if err := advance(); err != nil {
+		return err
+	}
+
+	for data := range qranks {
+		qr := data.(QRank)
+		for labelEntity != 0 && labelEntity < qr.Entity {
+			if err := advance(); err != nil {
+				return err
+			}
+		}
+		lq := LabeledQRank{Entity: qr.Entity, Rank: qr.Rank}
+		if labelEntity == qr.Entity {
+			lq.Label = label
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case out <- lq:
+		}
+	}
+	return nil
+}
+
+func writeLabeledQRank(ch <-chan extsort.SortType, w io.Writer) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"Entity", "Label", "QRank"}); err != nil {
+		return err
+	}
+	for data := range ch {
+		lq := data.(LabeledQRank)
+		rec := []string{
+			"Q" + strconv.FormatInt(lq.Entity, 10),
+			lq.Label,
+			strconv.FormatInt(lq.Rank, 10),
+		}
+		if err := cw.Write(rec); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
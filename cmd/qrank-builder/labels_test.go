@@ -0,0 +1,51 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestExtractLabel(t *testing.T) {
+	data := []byte(`{"type":"item","id":"Q42","labels":{` +
+		`"de":{"language":"de","value":"Douglas Adams"},` +
+		`"fr":{"language":"fr","value":"Douglas \"Bop\" Adams"}},` +
+		`"descriptions":{"en":{"language":"en","value":"English writer"}}}`)
+	for _, tc := range []struct{ lang, want string }{
+		{"de", "Douglas Adams"},
+		{"fr", `Douglas "Bop" Adams`},
+		{"en", ""}, // only has a description, no label
+	} {
+		got, _ := extractLabel(data, tc.lang)
+		if got != tc.want {
+			t.Errorf("got %q for %s, want %q", got, tc.lang, tc.want)
+		}
+	}
+}
+
+func TestBuildLabeledQRank(t *testing.T) {
+	dir := t.TempDir()
+	qrank := filepath.Join(dir, "qrank.gz")
+	writeGzipFile(qrank, "Entity,QRank\nQ4,77\nQ2,42\nQ5,42\nQ1,1\n")
+	labels := filepath.Join(dir, "labels.br")
+	writeBrotli(labels, "Q1 Universe\nQ3 unranked\nQ4 death, the\nQ5 human\n")
+
+	path, err := buildLabeledQRank(time.Now(), qrank, labels, "en", dir, sortSettings{}, context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := readGzipFile(path)
+	want := "Entity,Label,QRank\n" +
+		"Q4,\"death, the\",77\n" +
+		"Q2,,42\n" +
+		"Q5,human,42\n" +
+		"Q1,Universe,1\n"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
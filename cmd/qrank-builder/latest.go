@@ -0,0 +1,74 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// LatestKey returns the stable storage key for the most recent version
+// of a published file. For example, "public/qrank-20240301.csv.gz"
+// becomes "public/qrank-latest.csv.gz". If the key has no date stamp,
+// or if it is not a published file under prefix, the result is empty.
+func latestKey(prefix string, dest string) string {
+	name, ok := strings.CutPrefix(dest, prefix)
+	if !ok {
+		return ""
+	}
+	if m := publishedNameRegexp.FindStringSubmatch(name); m != nil {
+		return prefix + m[1] + "-latest." + m[3]
+	}
+	return ""
+}
+
+// PublishLatest copies freshly uploaded artifacts to their stable
+// "latest" keys, so that downstream clients do not need to list
+// the bucket for finding the newest release. Before touching any
+// "latest" key, we check that all artifacts have been completely
+// uploaded; this way, the "latest" keys never point to a partial
+// release. Copying happens on the server side, and each copy
+// atomically replaces the previous object. Artifacts that are too
+// large for a server-side copy get uploaded again from the local file.
+func publishLatest(ctx context.Context, artifacts []artifact, bucket string, prefix string, userMetadata map[string]string, storage S3) error {
+	for _, a := range artifacts {
+		if _, err := verifySize(ctx, bucket, a.dest, a.src, storage); err != nil {
+			return err
+		}
+	}
+
+	for _, a := range artifacts {
+		key := latestKey(prefix, a.dest)
+		if key == "" {
+			continue
+		}
+		if fileSizes([]string{a.src}) > maxCopyObjectSize {
+			opts := putOptions(a, userMetadata)
+			opts.CacheControl = latestCacheControl
+			if err := putVerified(ctx, a.src, storage, bucket, key, opts); err != nil {
+				return err
+			}
+			if logger != nil {
+				logger.Printf("Uploaded to object storage: %s/%s, too large for copying %s", bucket, key, a.dest)
+			}
+			continue
+		}
+		dst := latestCopyOptions(a, bucket, key, userMetadata)
+		src := minio.CopySrcOptions{Bucket: bucket, Object: a.dest}
+		if _, err := storage.CopyObject(ctx, dst, src); err != nil {
+			return err
+		}
+
+		logmsg := fmt.Sprintf("Copied in object storage: %s/%s to %s", bucket, a.dest, key)
+		fmt.Println(logmsg)
+		if logger != nil {
+			logger.Println(logmsg)
+		}
+	}
+
+	return nil
+}
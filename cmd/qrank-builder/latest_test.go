@@ -0,0 +1,83 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"testing"
+)
+
+func TestLatestKey(t *testing.T) {
+	for _, tc := range []struct{ dest, want string }{
+		{"public/qrank-20240301.csv.gz", "public/qrank-latest.csv.gz"},
+		{"public/qrank-stats-20240301.json", "public/qrank-stats-latest.json"},
+		{"public/qrank-sha256sums-20240301.txt.sig", "public/qrank-sha256sums-latest.txt.sig"},
+		{"public/qrank-labels-en-20240301.csv.zst", "public/qrank-labels-en-latest.csv.zst"},
+		{"public/qrank.csv.gz", ""},
+		{"internal/qrank-20240301.csv.gz", ""},
+	} {
+		if got := latestKey("public/", tc.dest); got != tc.want {
+			t.Errorf("got %q for %q, want %q", got, tc.dest, tc.want)
+		}
+	}
+}
+
+func TestLatestKey_CustomPrefix(t *testing.T) {
+	got := latestKey("staging/v2/", "staging/v2/qrank-20240301.csv.gz")
+	want := "staging/v2/qrank-latest.csv.gz"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got := latestKey("staging/v2/", "public/qrank-20240301.csv.gz"); got != "" {
+		t.Errorf("got %q, want empty string", got)
+	}
+}
+
+func TestPublishLatest(t *testing.T) {
+	ctx := context.Background()
+	src := filepath.Join(t.TempDir(), "qrank.gz")
+	writeGzipFile(src, "Entity,QRank\nQ42,7\n")
+	artifacts := []artifact{{"public/qrank-20240301.csv.gz", src, "text/csv"}}
+
+	s3 := NewFakeS3()
+	if err := publishLatest(ctx, artifacts, "qrank", "public/", nil, s3); err == nil {
+		t.Error("publishing latest keys before upload should fail")
+	}
+	if err := PutInStorage(ctx, src, s3, "qrank", artifacts[0].dest, "text/csv"); err != nil {
+		t.Fatal(err)
+	}
+	if err := publishLatest(ctx, artifacts, "qrank", "public/", nil, s3); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"public/qrank-20240301.csv.gz", "public/qrank-latest.csv.gz"} {
+		if _, ok := s3.data[key]; !ok {
+			t.Errorf("%s missing in storage", key)
+		}
+	}
+}
+
+func TestPublishLatest_Large(t *testing.T) {
+	defer func(size int64) { maxCopyObjectSize = size }(maxCopyObjectSize)
+	maxCopyObjectSize = 10
+	ctx := context.Background()
+	src := filepath.Join(t.TempDir(), "qrank.gz")
+	writeGzipFile(src, "Entity,QRank\nQ42,7\n")
+	artifacts := []artifact{{"public/qrank-20240301.csv.gz", src, "text/csv"}}
+
+	s3 := NewFakeS3()
+	if err := PutInStorage(ctx, src, s3, "qrank", artifacts[0].dest, "text/csv"); err != nil {
+		t.Fatal(err)
+	}
+	if err := publishLatest(ctx, artifacts, "qrank", "public/", nil, s3); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(s3.data["public/qrank-latest.csv.gz"], s3.data["public/qrank-20240301.csv.gz"]) {
+		t.Error("public/qrank-latest.csv.gz should have the same content as the release")
+	}
+	if got := s3.opts["public/qrank-latest.csv.gz"].CacheControl; got != latestCacheControl {
+		t.Errorf("got Cache-Control %q, want %q", got, latestCacheControl)
+	}
+}
@@ -0,0 +1,304 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// LeaseKey is the storage key of the lease that a builder must hold
+// while building, so that two builders never work on the same cache
+// or publish the same release at the same time.
+const leaseKey = "internal/qrank-builder/lease.json"
+
+// ErrLeaseHeld is returned when another builder holds the lease.
+var errLeaseHeld = errors.New("another builder holds the lease")
+
+// ErrLeaseLost is the cause for canceling a build whose lease
+// could not be renewed before expiring, or was taken over.
+var errLeaseLost = errors.New("lost the build lease")
+
+// ErrUnitDone is returned when claiming a unit of work that has
+// already been completed from the same input.
+var errUnitDone = errors.New("unit of work is already done")
+
+// LeaseRecord is the content of the lease object in storage. Leases
+// on units of work also record the identity of the input, and whether
+// the unit has been completed.
+type leaseRecord struct {
+	Holder   string    `json:"holder"`
+	Acquired time.Time `json:"acquired"`
+	Expires  time.Time `json:"expires"`
+	Input    string    `json:"input,omitempty"`
+	Done     bool      `json:"done,omitempty"`
+}
+
+// BuildLease is a lease on building, held in object storage. Leases
+// get acquired with conditional puts: a new lease only gets created
+// if no lease object exists yet (If-None-Match: *), and an existing
+// lease only gets renewed or taken over if it has not changed since
+// we last looked at it (If-Match with its ETag). The holder renews
+// the lease periodically; if a holder crashes, its lease expires
+// and another builder may take it over. Besides the lease on the entire
+// build, the same mechanism is used for claiming units of work from
+// a work queue.
+type buildLease struct {
+	s3       S3
+	bucket   string
+	key      string
+	input    string // for units of work, identity of their input
+	holder   string
+	ttl      time.Duration
+	now      func() time.Time
+	acquired time.Time
+	expires  time.Time
+}
+
+// AcquireLease takes the build lease in a bucket, or returns errLeaseHeld
+// if another builder holds an unexpired lease.
+func acquireLease(ctx context.Context, s3 S3, bucket string, holder string, ttl time.Duration) (*buildLease, error) {
+	l := &buildLease{s3: s3, bucket: bucket, key: leaseKey, holder: holder, ttl: ttl, now: time.Now}
+	if err := l.acquire(ctx); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *buildLease) acquire(ctx context.Context) error {
+	l.acquired = l.now()
+	opts := minio.PutObjectOptions{}
+	opts.SetMatchETagExcept("*")
+	err := l.put(ctx, opts)
+	if err == nil || !isPreconditionFailed(err) {
+		return err
+	}
+
+	// Someone else has created a lease. If it has expired,
+	// we take it over, unless a third builder is faster.
+	// A completed unit of work can be taken over right away
+	// if its input has changed since.
+	rec, etag, err := l.read(ctx)
+	if err != nil {
+		return err
+	}
+	if rec.Done && rec.Input == l.input {
+		return errUnitDone
+	}
+	if !rec.Done && l.now().Before(rec.Expires) {
+		return fmt.Errorf("%w: %s until %s", errLeaseHeld, rec.Holder, rec.Expires.Format(time.RFC3339))
+	}
+	if logger != nil {
+		logger.Printf("taking over lease of %s, which expired at %s", rec.Holder, rec.Expires.Format(time.RFC3339))
+	}
+	opts = minio.PutObjectOptions{}
+	opts.SetMatchETag(etag)
+	if err := l.put(ctx, opts); err != nil {
+		if isPreconditionFailed(err) {
+			return errLeaseHeld
+		}
+		return err
+	}
+	return nil
+}
+
+// Renew extends the lease by another ttl. If someone else has taken
+// over the lease in the meantime, Renew returns errLeaseLost.
+func (l *buildLease) renew(ctx context.Context) error {
+	rec, etag, err := l.read(ctx)
+	if err != nil {
+		return err
+	}
+	if rec.Holder != l.holder {
+		return errLeaseLost
+	}
+	opts := minio.PutObjectOptions{}
+	opts.SetMatchETag(etag)
+	if err := l.put(ctx, opts); err != nil {
+		if isPreconditionFailed(err) {
+			return errLeaseLost
+		}
+		return err
+	}
+	return nil
+}
+
+// Release gives up the lease. There is no conditional delete in S3,
+// so another builder could in theory take over an expired lease just
+// between our check and the deletion; but then, our build would
+// already have been canceled for not renewing in time.
+func (l *buildLease) release(ctx context.Context) error {
+	rec, _, err := l.read(ctx)
+	if err != nil {
+		return err
+	}
+	if rec.Holder != l.holder {
+		return errLeaseLost
+	}
+	return l.s3.RemoveObject(ctx, l.bucket, l.key, minio.RemoveObjectOptions{})
+}
+
+// Finish marks a unit of work as completed, so other builders
+// do not build it again from the same input.
+func (l *buildLease) finish(ctx context.Context) error {
+	rec, etag, err := l.read(ctx)
+	if err != nil {
+		return err
+	}
+	if rec.Holder != l.holder {
+		return errLeaseLost
+	}
+	opts := minio.PutObjectOptions{}
+	opts.SetMatchETag(etag)
+	rec = leaseRecord{Holder: l.holder, Acquired: l.acquired, Expires: l.now(), Input: l.input, Done: true}
+	if err := l.write(ctx, rec, opts); err != nil {
+		if isPreconditionFailed(err) {
+			return errLeaseLost
+		}
+		return err
+	}
+	return nil
+}
+
+// Put writes our lease record to storage with a new expiry time.
+func (l *buildLease) put(ctx context.Context, opts minio.PutObjectOptions) error {
+	expires := l.now().Add(l.ttl)
+	rec := leaseRecord{Holder: l.holder, Acquired: l.acquired, Expires: expires, Input: l.input}
+	if err := l.write(ctx, rec, opts); err != nil {
+		return err
+	}
+	l.expires = expires
+	return nil
+}
+
+// Write puts a lease record into storage.
+func (l *buildLease) write(ctx context.Context, rec leaseRecord, opts minio.PutObjectOptions) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	temp, err := os.CreateTemp("", "lease-*.json")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+	if _, err := temp.Write(data); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+
+	opts.ContentType = "application/json"
+	_, err = l.s3.FPutObject(ctx, l.bucket, l.key, temp.Name(), opts)
+	return err
+}
+
+// Read fetches the current lease record and its ETag from storage.
+func (l *buildLease) read(ctx context.Context) (leaseRecord, string, error) {
+	var rec leaseRecord
+	info, err := l.s3.StatObject(ctx, l.bucket, l.key, minio.StatObjectOptions{})
+	if err != nil {
+		return rec, "", err
+	}
+
+	// If the lease changes between StatObject and reading it,
+	// the subsequent conditional put fails, which is what we want.
+	r, err := NewS3Reader(ctx, l.bucket, l.key, l.s3)
+	if err != nil {
+		return rec, "", err
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return rec, "", err
+	}
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return rec, "", fmt.Errorf("%s: %w", l.key, err)
+	}
+	return rec, info.ETag, nil
+}
+
+// KeepAlive renews the lease in the background, three times per ttl,
+// until stop gets called. If the lease is lost, the returned context
+// gets canceled with errLeaseLost as its cause. Transient storage
+// errors get retried until the lease is about to expire.
+func (l *buildLease) keepAlive(ctx context.Context) (leaseCtx context.Context, stop func()) {
+	leaseCtx, cancel := context.WithCancelCause(ctx)
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(l.ttl / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-leaseCtx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			err := l.renew(leaseCtx)
+			if err == nil {
+				continue
+			}
+			if logger != nil {
+				logger.Printf("warning: could not renew lease: %v", err)
+			}
+			if errors.Is(err, errLeaseLost) || !l.now().Before(l.expires) {
+				cancel(errLeaseLost)
+				return
+			}
+		}
+	}()
+	return leaseCtx, func() {
+		close(done)
+		<-stopped
+		cancel(nil)
+	}
+}
+
+// WithLease runs a build function while holding the build lease
+// in a bucket.
+func withLease(ctx context.Context, s3 S3, bucket string, holder string, ttl time.Duration, build func(ctx context.Context) error) error {
+	lease, err := acquireLease(ctx, s3, bucket, holder, ttl)
+	if err != nil {
+		return err
+	}
+	if logger != nil {
+		logger.Printf("acquired build lease as %s", holder)
+	}
+
+	leaseCtx, stop := lease.keepAlive(ctx)
+	err = build(leaseCtx)
+	if cause := context.Cause(leaseCtx); errors.Is(cause, errLeaseLost) {
+		err = cause
+	}
+	stop()
+
+	if !errors.Is(err, errLeaseLost) {
+		if releaseErr := lease.release(context.WithoutCancel(ctx)); releaseErr != nil && err == nil {
+			err = releaseErr
+		}
+	}
+	return err
+}
+
+// LeaseHolder returns a name that identifies this builder process
+// in the lease, such as "tools-worker-1234:42:20240301T040000Z".
+func leaseHolder() string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s:%d:%s", host, os.Getpid(), time.Now().UTC().Format("20060102T150405Z"))
+}
@@ -0,0 +1,208 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+func readTestLease(t *testing.T, s3 *FakeS3) leaseRecord {
+	t.Helper()
+	s3.mutex.RLock()
+	data, ok := s3.data[leaseKey]
+	s3.mutex.RUnlock()
+	if !ok {
+		t.Fatal("no lease in storage")
+	}
+	var rec leaseRecord
+	if err := json.Unmarshal(data, &rec); err != nil {
+		t.Fatal(err)
+	}
+	return rec
+}
+
+func TestBuildLease(t *testing.T) {
+	ctx := context.Background()
+	s3 := NewFakeS3()
+	now := time.Date(2024, 3, 1, 4, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+
+	alice := &buildLease{s3: s3, bucket: "qrank", key: leaseKey, holder: "alice", ttl: 10 * time.Minute, now: clock}
+	if err := alice.acquire(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if rec := readTestLease(t, s3); rec.Holder != "alice" || !rec.Expires.Equal(now.Add(10*time.Minute)) {
+		t.Errorf("got %+v", rec)
+	}
+
+	// While Alice’s lease is valid, Bob cannot take it.
+	bob := &buildLease{s3: s3, bucket: "qrank", key: leaseKey, holder: "bob", ttl: 10 * time.Minute, now: clock}
+	if err := bob.acquire(ctx); !errors.Is(err, errLeaseHeld) {
+		t.Errorf("got %v, want %v", err, errLeaseHeld)
+	}
+
+	// Renewing extends Alice’s lease.
+	now = now.Add(8 * time.Minute)
+	if err := alice.renew(ctx); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(8 * time.Minute)
+	if err := bob.acquire(ctx); !errors.Is(err, errLeaseHeld) {
+		t.Errorf("got %v, want %v", err, errLeaseHeld)
+	}
+
+	// Once expired, Bob may take over, and Alice has lost her lease.
+	now = now.Add(3 * time.Minute)
+	if err := bob.acquire(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if rec := readTestLease(t, s3); rec.Holder != "bob" {
+		t.Errorf("got holder %q, want bob", rec.Holder)
+	}
+	if err := alice.renew(ctx); err != errLeaseLost {
+		t.Errorf("got %v, want %v", err, errLeaseLost)
+	}
+	if err := alice.release(ctx); err != errLeaseLost {
+		t.Errorf("got %v, want %v", err, errLeaseLost)
+	}
+
+	if err := bob.release(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s3.StatObject(ctx, "qrank", leaseKey, minio.StatObjectOptions{}); err == nil {
+		t.Error("lease still in storage after release")
+	}
+}
+
+func TestWithLease(t *testing.T) {
+	ctx := context.Background()
+	s3 := NewFakeS3()
+	// The lease gets renewed every ttl/3. The ttl is generous, so the
+	// test does not fail on a busy machine that delays the renewals.
+	err := withLease(ctx, s3, "qrank", "alice", time.Second, func(ctx context.Context) error {
+		// Take longer than the lease’s ttl, so it must get renewed.
+		time.Sleep(1200 * time.Millisecond)
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if rec := readTestLease(t, s3); rec.Holder != "alice" {
+			t.Errorf("got holder %q, want alice", rec.Holder)
+		}
+
+		// A concurrent build must not start.
+		other := withLease(ctx, s3, "qrank", "bob", time.Minute, func(ctx context.Context) error {
+			t.Error("bob should not be building")
+			return nil
+		})
+		if !errors.Is(other, errLeaseHeld) {
+			t.Errorf("got %v, want %v", other, errLeaseHeld)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s3.StatObject(ctx, "qrank", leaseKey, minio.StatObjectOptions{}); err == nil {
+		t.Error("lease still in storage after build")
+	}
+}
+
+func TestWithLease_Lost(t *testing.T) {
+	ctx := context.Background()
+	s3 := NewFakeS3()
+	err := withLease(ctx, s3, "qrank", "alice", 30*time.Millisecond, func(ctx context.Context) error {
+		// Simulate another builder that has taken over the lease.
+		data, _ := json.Marshal(leaseRecord{Holder: "bob", Expires: time.Now().Add(time.Hour)})
+		s3.mutex.Lock()
+		s3.data[leaseKey] = data
+		s3.mutex.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(5 * time.Second):
+			t.Error("build was not canceled")
+			return nil
+		}
+	})
+	if err != errLeaseLost {
+		t.Errorf("got %v, want %v", err, errLeaseLost)
+	}
+
+	// Bob’s lease must not have been removed.
+	if rec := readTestLease(t, s3); rec.Holder != "bob" {
+		t.Errorf("got holder %q, want bob", rec.Holder)
+	}
+}
+
+func TestPutPreconditionsHold(t *testing.T) {
+	for _, tc := range []struct {
+		ifMatch, ifNoneMatch, etag string
+		want                       bool
+	}{
+		{"", "", "", true},
+		{"", "", "abc", true},
+		{"", "*", "", true},
+		{"", "*", "abc", false},
+		{"", "abc", "abc", false},
+		{"", "abc", "def", true},
+		{"abc", "", "abc", true},
+		{"abc", "", "def", false},
+		{"abc", "", "", false},
+		{"*", "", "abc", true},
+		{"*", "", "", false},
+	} {
+		opts := minio.PutObjectOptions{}
+		if tc.ifMatch != "" {
+			opts.SetMatchETag(tc.ifMatch)
+		}
+		if tc.ifNoneMatch != "" {
+			opts.SetMatchETagExcept(tc.ifNoneMatch)
+		}
+		if got := putPreconditionsHold(opts, tc.etag); got != tc.want {
+			t.Errorf("If-Match=%q If-None-Match=%q etag=%q: got %v, want %v",
+				tc.ifMatch, tc.ifNoneMatch, tc.etag, got, tc.want)
+		}
+	}
+}
+
+func TestLocalStorage_ConditionalPut(t *testing.T) {
+	ctx := context.Background()
+	s := NewLocalStorage(t.TempDir())
+	src := filepath.Join(t.TempDir(), "lease.json")
+	if err := os.WriteFile(src, []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	create := minio.PutObjectOptions{}
+	create.SetMatchETagExcept("*")
+	if _, err := s.FPutObject(ctx, "qrank", "lease.json", src, create); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.FPutObject(ctx, "qrank", "lease.json", src, create); !isPreconditionFailed(err) {
+		t.Errorf("got %v, want PreconditionFailed", err)
+	}
+
+	info, err := s.StatObject(ctx, "qrank", "lease.json", minio.StatObjectOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	update := minio.PutObjectOptions{}
+	update.SetMatchETag(info.ETag)
+	if _, err := s.FPutObject(ctx, "qrank", "lease.json", src, update); err != nil {
+		t.Fatal(err)
+	}
+	update.SetMatchETag("0123456789abcdef")
+	if _, err := s.FPutObject(ctx, "qrank", "lease.json", src, update); !isPreconditionFailed(err) {
+		t.Errorf("got %v, want PreconditionFailed", err)
+	}
+}
@@ -5,14 +5,23 @@ package main
 
 import (
 	"bytes"
-	"container/heap"
 	"fmt"
 	"strings"
 )
 
 // Merges the lines of a multiple io.Readers whose content is in sorted order.
+//
+// The merge uses a loser tree, also known as a tournament tree.
+// Each inner node remembers the loser of the match between its two
+// subtrees, and the overall winner is the input with the smallest
+// current line. When the winner advances to its next line, only the
+// matches along the path from its leaf to the root get replayed.
+// Each line therefore costs about log2(k) comparisons for k inputs,
+// which is about half of what a binary heap needs. This matters when
+// merging many weekly pageview files with billions of lines.
 type LineMerger struct {
-	heap   lineMergerHeap
+	inputs []*mergee
+	tree   []int // tree[0] is the winner, tree[1:] the losers of inner nodes
 	err    error
 	inited bool
 }
@@ -36,46 +45,79 @@ func NewLineMerger(r []LineScanner, names []string) *LineMerger {
 	}
 
 	m := &LineMerger{}
-	m.heap = make(lineMergerHeap, 0, len(r))
+	m.inputs = make([]*mergee, len(r))
 	for i, rr := range r {
-		item := &mergee{scanner: rr, name: names[i]}
-		if item.scanner.Scan() {
-			m.heap = append(m.heap, item)
-		}
+		m.inputs[i] = &mergee{scanner: rr, name: names[i], done: true}
+	}
+	for _, item := range m.inputs {
+		item.done = !item.scanner.Scan()
 		if err := item.scanner.Err(); err != nil {
-			logger.Printf(`LineMerger: scanner "%s" failed to scan first line, err=%v`, item.name, err)
+			logger.Printf(`error: LineMerger: scanner "%s" failed to scan first line, err=%v`, item.name, err)
 			m.err = err
-			return m
+			break
 		}
 	}
+
+	m.tree = make([]int, max(len(m.inputs), 1))
+	if len(m.inputs) > 1 {
+		m.tree[0] = m.build(1)
+	}
 	return m
 }
 
+// Build plays the matches in the subtree at node, and returns the
+// index of the winning input. Inner nodes are numbered from 1 to k-1,
+// the leaves from k to 2k-1, and the children of node n are 2n and 2n+1.
+func (m *LineMerger) build(node int) int {
+	k := len(m.inputs)
+	if node >= k {
+		return node - k
+	}
+	winner, loser := m.build(2*node), m.build(2*node+1)
+	if m.less(loser, winner) {
+		winner, loser = loser, winner
+	}
+	m.tree[node] = loser
+	return winner
+}
+
+// Replay advances the winner to its next line, and replays the matches
+// on the path from its leaf to the root.
+func (m *LineMerger) replay() {
+	k := len(m.inputs)
+	winner := m.tree[0]
+	for node := (winner + k) / 2; node >= 1; node /= 2 {
+		if m.less(m.tree[node], winner) {
+			m.tree[node], winner = winner, m.tree[node]
+		}
+	}
+	m.tree[0] = winner
+}
+
 func (m *LineMerger) Advance() bool {
 	if m.err != nil {
 		return false
 	}
-	if len(m.heap) == 0 {
+	if len(m.inputs) == 0 {
 		return false
 	}
 	if !m.inited {
-		heap.Init(&m.heap)
 		m.inited = true
-		return true
+		return !m.inputs[m.tree[0]].done
 	}
-	item := m.heap[0]
 
-	if item.scanner.Scan() {
-		heap.Fix(&m.heap, 0)
-	} else {
-		heap.Remove(&m.heap, 0)
+	item := m.inputs[m.tree[0]]
+	if item.done {
+		return false
 	}
+	item.done = !item.scanner.Scan()
+	m.replay()
 
 	if err := item.scanner.Err(); err != nil {
 		m.err = err
 		return false
 	}
-	return len(m.heap) > 0
+	return !m.inputs[m.tree[0]].done
 }
 
 func (m *LineMerger) Err() error {
@@ -83,34 +125,38 @@ func (m *LineMerger) Err() error {
 }
 
 func (m *LineMerger) Line() string {
-	n := len(m.heap)
-	if n > 0 {
-		return m.heap[0].scanner.Text()
-	} else {
-		return ""
+	if len(m.inputs) > 0 {
+		if item := m.inputs[m.tree[0]]; !item.done {
+			return item.scanner.Text()
+		}
 	}
+	return ""
 }
 
 func (m *LineMerger) Name() string {
-	n := len(m.heap)
-	if n > 0 {
-		return m.heap[0].name
-	} else {
-		return ""
+	if len(m.inputs) > 0 {
+		if item := m.inputs[m.tree[0]]; !item.done {
+			return item.name
+		}
 	}
+	return ""
 }
 
 type mergee struct {
 	scanner LineScanner
 	name    string
+	done    bool // true when the scanner has reached the end of its input
 }
 
-type lineMergerHeap []*mergee
-
-func (h lineMergerHeap) Len() int { return len(h) }
+// Less reports whether input i has a smaller current line than input j.
+// Inputs that have reached their end are larger than all others.
+func (m *LineMerger) less(i, j int) bool {
+	a, b := m.inputs[i], m.inputs[j]
+	if a.done || b.done {
+		return !a.done && b.done
+	}
 
-func (h lineMergerHeap) Less(i, j int) bool {
-	if c := bytes.Compare(h[i].scanner.Bytes(), h[j].scanner.Bytes()); c < 0 {
+	if c := bytes.Compare(a.scanner.Bytes(), b.scanner.Bytes()); c < 0 {
 		return true
 	} else if c > 0 {
 		return false
@@ -118,31 +164,14 @@ func (h lineMergerHeap) Less(i, j int) bool {
 
 	// Make the processing order deterministic by imposing a total order.
 	// https://github.com/brawer/wikidata-qrank/issues/40#issuecomment-2118675361
-	if c := strings.Compare(h[i].name, h[j].name); c < 0 {
+	if c := strings.Compare(a.name, b.name); c < 0 {
 		return true
 	} else if c > 0 {
 		return false
 	}
 
 	// This should never happen in production.
-	msg := fmt.Sprintf("LineMergerHeap.Less() called on equivalent items; i=%d, h[i]=%v, j=%d, h[j]=%v", i, h[i], j, h[j])
+	msg := fmt.Sprintf("LineMerger.less() called on equivalent items; i=%d, inputs[i]=%v, j=%d, inputs[j]=%v", i, a, j, b)
 	logger.Println(msg)
 	panic(msg)
 }
-
-func (h lineMergerHeap) Swap(i, j int) {
-	h[i], h[j] = h[j], h[i]
-}
-
-func (h *lineMergerHeap) Push(x interface{}) {
-	*h = append(*h, x.(*mergee))
-}
-
-func (h *lineMergerHeap) Pop() interface{} {
-	old := *h
-	n := len(old)
-	item := old[n-1]
-	old[n-1] = nil // avoid memory leak
-	*h = old[0 : n-1]
-	return item
-}
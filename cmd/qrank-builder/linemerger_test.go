@@ -9,6 +9,8 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"math/rand"
+	"slices"
 	"strings"
 	"testing"
 )
@@ -81,3 +83,69 @@ func TestLineMerger(t *testing.T) {
 		}
 	}
 }
+
+// Merge random inputs, and check the result against sorting
+// the concatenation of all inputs.
+func TestLineMerger_Random(t *testing.T) {
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	rng := rand.New(rand.NewSource(23))
+	for k := 0; k <= 17; k++ {
+		var want []string
+		scanners := make([]LineScanner, 0, k)
+		names := make([]string, 0, k)
+		for i := 0; i < k; i++ {
+			lines := make([]string, rng.Intn(50))
+			for j := range lines {
+				lines[j] = fmt.Sprintf("%03d", rng.Intn(200))
+			}
+			slices.Sort(lines)
+			name := fmt.Sprintf("input-%02d", i)
+			for _, line := range lines {
+				want = append(want, line+" "+name)
+			}
+			text := strings.Join(lines, "\n")
+			scanners = append(scanners, bufio.NewScanner(strings.NewReader(text)))
+			names = append(names, name)
+		}
+		slices.Sort(want)
+
+		merger := NewLineMerger(scanners, names)
+		got := make([]string, 0, len(want))
+		for merger.Advance() {
+			got = append(got, merger.Line()+" "+merger.Name())
+		}
+		if err := merger.Err(); err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(got, want) {
+			t.Errorf("k=%d: got %v, want %v", k, got, want)
+		}
+	}
+}
+
+func BenchmarkLineMerger(b *testing.B) {
+	const k, n = 52, 2000
+	inputs := make([]string, k)
+	for i := range inputs {
+		lines := make([]string, n)
+		for j := range lines {
+			lines[j] = fmt.Sprintf("en.wikipedia,%08d,%d", j*k+i, i)
+		}
+		inputs[i] = strings.Join(lines, "\n")
+	}
+	names := make([]string, k)
+	for i := range names {
+		names[i] = fmt.Sprintf("pageviews-%02d", i)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		scanners := make([]LineScanner, k)
+		for j, input := range inputs {
+			scanners[j] = bufio.NewScanner(strings.NewReader(input))
+		}
+		merger := NewLineMerger(scanners, names)
+		for merger.Advance() {
+		}
+	}
+}
@@ -11,7 +11,6 @@ import (
 	"io"
 	"os"
 	"path/filepath"
-	"runtime"
 	"slices"
 	"strings"
 
@@ -25,7 +24,7 @@ import (
 // like "799\t<property>\tTalk:Zürich" to the output channel, indicating
 // that page 799 links to page "Talk:Zürich". Property is an arbitrary string
 // that will be emitted as the second column in the output, useful for joining.
-func joinLinkTargets(ctx context.Context, site *WikiSite, property string, dumps string, out chan<- string) error {
+func joinLinkTargets(ctx context.Context, site *WikiSite, property string, cfg *buildConfig, out chan<- string) error {
 	temp, err := os.CreateTemp("", "linktargets-*")
 	if err != nil {
 		return err
@@ -33,18 +32,16 @@ func joinLinkTargets(ctx context.Context, site *WikiSite, property string, dumps
 	defer temp.Close()
 	defer os.Remove(temp.Name())
 
-	linesChan := make(chan string, 10000)
-	config := extsort.DefaultConfig()
-	config.ChunkSize = 8 * 1024 * 1024 / 64 // 8 MiB, 64 Bytes/line avg
-	config.NumWorkers = runtime.NumCPU()
+	linesChan := make(chan string, cfg.Sort.buffer(10000))
+	config := cfg.Sort.newConfig(8*1024*1024/64, 64) // 8 MiB, 64 Bytes/line avg
 	sorter, outChan, errChan := extsort.Strings(linesChan, config)
 	group, groupCtx := errgroup.WithContext(ctx)
 	group.Go(func() error {
 		defer close(linesChan)
-		if err := readLinkTargets(groupCtx, site, "A", dumps, linesChan); err != nil {
+		if err := readLinkTargets(groupCtx, site, "A", cfg.Dumps, linesChan); err != nil {
 			return err
 		}
-		if err := readLinkTargetsFromPageLinks(groupCtx, site, "B", dumps, linesChan); err != nil {
+		if err := readLinkTargetsFromPageLinks(groupCtx, site, "B", cfg.Dumps, linesChan); err != nil {
 			return err
 		}
 		return nil
@@ -74,7 +71,7 @@ func joinLinkTargets(ctx context.Context, site *WikiSite, property string, dumps
 		return err
 	}
 
-	sorted, err := SortLines(ctx, temp.Name())
+	sorted, err := SortLines(ctx, temp.Name(), cfg.Sort)
 	if err != nil {
 		return err
 	}
@@ -25,7 +25,7 @@ func TestJoinLinkTargets(t *testing.T) {
 	ctx := context.Background()
 	client := &http.Client{Transport: &FakeWikiSite{}}
 	dumps := filepath.Join("testdata", "dumps")
-	sites, err := ReadWikiSites(client, dumps)
+	sites, err := ReadWikiSites(client, newBuildConfig(dumps))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -36,7 +36,7 @@ func TestJoinLinkTargets(t *testing.T) {
 	group, _ := errgroup.WithContext(context.Background())
 	group.Go(func() error {
 		defer close(ch)
-		return joinLinkTargets(ctx, site, "Prop", dumps, ch)
+		return joinLinkTargets(ctx, site, "Prop", newBuildConfig(dumps), ch)
 	})
 	if err := group.Wait(); err != nil {
 		t.Fatal(err)
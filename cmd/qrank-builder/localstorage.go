@@ -0,0 +1,308 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// LocalStorage implements the S3 interface on top of a local directory,
+// so the builder can run without access to object storage. Buckets are
+// subdirectories of the root directory; object keys such as
+// "public/qrank-20240301.csv.gz" are file paths within the bucket.
+type LocalStorage struct {
+	root string
+
+	// Serializes conditional puts. Since this only works within
+	// one process, LocalStorage cannot coordinate concurrent builders
+	// in separate processes the way real object storage does.
+	mutex sync.Mutex
+
+	// ETags of files that we have already hashed, keyed by path.
+	etagsMutex sync.Mutex
+	etags      map[string]cachedETag
+}
+
+type cachedETag struct {
+	stat os.FileInfo
+	etag string
+}
+
+// NewLocalStorage returns a LocalStorage that keeps its buckets in root.
+func NewLocalStorage(root string) *LocalStorage {
+	return &LocalStorage{root: root}
+}
+
+func (s *LocalStorage) path(bucketName, objectName string) (string, error) {
+	if bucketName == "" || strings.ContainsAny(bucketName, `/\`) {
+		return "", fmt.Errorf("bad bucket name %q", bucketName)
+	}
+	if !fs.ValidPath(objectName) || objectName == "." {
+		return "", fmt.Errorf("bad object name %q", objectName)
+	}
+	return filepath.Join(s.root, bucketName, filepath.FromSlash(objectName)), nil
+}
+
+func (s *LocalStorage) BucketExists(ctx context.Context, bucketName string) (bool, error) {
+	stat, err := os.Stat(filepath.Join(s.root, bucketName))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return stat.IsDir(), nil
+}
+
+func (s *LocalStorage) ListObjects(ctx context.Context, bucketName string, opts minio.ListObjectsOptions) <-chan minio.ObjectInfo {
+	ch := make(chan minio.ObjectInfo, 100)
+	go func() {
+		defer close(ch)
+		dir := filepath.Join(s.root, bucketName)
+		var keys []string
+		err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() || strings.HasSuffix(p, ".tmp") {
+				return nil
+			}
+			rel, err := filepath.Rel(dir, p)
+			if err != nil {
+				return err
+			}
+			key := filepath.ToSlash(rel)
+			if !strings.HasPrefix(key, opts.Prefix) {
+				return nil
+			}
+
+			// Like S3, we roll up keys into common prefixes
+			// unless the caller has asked for a recursive listing.
+			if !opts.Recursive {
+				if slash := strings.IndexByte(key[len(opts.Prefix):], '/'); slash >= 0 {
+					key = key[:len(opts.Prefix)+slash+1]
+					if n := len(keys); n > 0 && keys[n-1] == key {
+						return nil
+					}
+				}
+			}
+			keys = append(keys, key)
+			return nil
+		})
+		if err != nil {
+			ch <- minio.ObjectInfo{Err: err}
+			return
+		}
+
+		sort.Strings(keys)
+		for _, key := range keys {
+			info := minio.ObjectInfo{Key: key}
+			if !strings.HasSuffix(key, "/") {
+				if stat, err := os.Stat(filepath.Join(dir, filepath.FromSlash(key))); err == nil {
+					info.Size = stat.Size()
+					info.LastModified = stat.ModTime()
+				}
+			}
+			select {
+			case ch <- info:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch
+}
+
+func (s *LocalStorage) StatObject(ctx context.Context, bucketName, objectName string, opts minio.StatObjectOptions) (minio.ObjectInfo, error) {
+	p, err := s.path(bucketName, objectName)
+	if err != nil {
+		return minio.ObjectInfo{}, err
+	}
+	stat, err := os.Stat(p)
+	if err != nil {
+		return minio.ObjectInfo{}, err
+	}
+
+	etag, err := s.etag(p, stat)
+	if err != nil {
+		return minio.ObjectInfo{}, err
+	}
+
+	return minio.ObjectInfo{
+		Key:          objectName,
+		Size:         stat.Size(),
+		LastModified: stat.ModTime(),
+		ETag:         etag,
+	}, nil
+}
+
+// ETag computes the ETag of a file like S3 does, so that uploads can
+// get verified. Hashing takes long for large files, and conditional puts
+// stat their object every time, so we remember the ETag until the file
+// changes. Since we replace files by renaming, a replaced file counts
+// as changed even if its size and modification time stay the same.
+func (s *LocalStorage) etag(p string, stat os.FileInfo) (string, error) {
+	s.etagsMutex.Lock()
+	cached, ok := s.etags[p]
+	s.etagsMutex.Unlock()
+	if ok && os.SameFile(cached.stat, stat) && cached.stat.Size() == stat.Size() && cached.stat.ModTime().Equal(stat.ModTime()) {
+		return cached.etag, nil
+	}
+
+	etag, err := expectedETag(p, uploadPartSize)
+	if err != nil {
+		return "", err
+	}
+
+	s.etagsMutex.Lock()
+	defer s.etagsMutex.Unlock()
+	if s.etags == nil {
+		s.etags = make(map[string]cachedETag, 100)
+	}
+	s.etags[p] = cachedETag{stat: stat, etag: etag}
+	return etag, nil
+}
+
+func (s *LocalStorage) CopyObject(ctx context.Context, dst minio.CopyDestOptions, src minio.CopySrcOptions) (minio.UploadInfo, error) {
+	srcPath, err := s.path(src.Bucket, src.Object)
+	if err != nil {
+		return minio.UploadInfo{}, err
+	}
+	dstPath, err := s.path(dst.Bucket, dst.Object)
+	if err != nil {
+		return minio.UploadInfo{}, err
+	}
+	size, err := copyLocalFile(srcPath, dstPath)
+	if err != nil {
+		return minio.UploadInfo{}, err
+	}
+	return minio.UploadInfo{Bucket: dst.Bucket, Key: dst.Object, Size: size}, nil
+}
+
+// ComposeObject concatenates the source objects into the destination.
+// Unlike S3, local storage has no size limit for CopyObject, but the
+// builder calls this for copying large objects.
+func (s *LocalStorage) ComposeObject(ctx context.Context, dst minio.CopyDestOptions, srcs ...minio.CopySrcOptions) (minio.UploadInfo, error) {
+	dstPath, err := s.path(dst.Bucket, dst.Object)
+	if err != nil {
+		return minio.UploadInfo{}, err
+	}
+	readers := make([]io.Reader, 0, len(srcs))
+	for _, src := range srcs {
+		srcPath, err := s.path(src.Bucket, src.Object)
+		if err != nil {
+			return minio.UploadInfo{}, err
+		}
+		f, err := os.Open(srcPath)
+		if err != nil {
+			return minio.UploadInfo{}, err
+		}
+		defer f.Close()
+		readers = append(readers, f)
+	}
+	size, err := writeLocalFile(io.MultiReader(readers...), dstPath)
+	if err != nil {
+		return minio.UploadInfo{}, err
+	}
+	return minio.UploadInfo{Bucket: dst.Bucket, Key: dst.Object, Size: size}, nil
+}
+
+func (s *LocalStorage) RemoveObject(ctx context.Context, bucketName string, objectName string, opts minio.RemoveObjectOptions) error {
+	p, err := s.path(bucketName, objectName)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *LocalStorage) FGetObject(ctx context.Context, bucketName, objectName, filePath string, opts minio.GetObjectOptions) error {
+	p, err := s.path(bucketName, objectName)
+	if err != nil {
+		return err
+	}
+	_, err = copyLocalFile(p, filePath)
+	return err
+}
+
+func (s *LocalStorage) FPutObject(ctx context.Context, bucketName, objectName, filePath string, opts minio.PutObjectOptions) (minio.UploadInfo, error) {
+	p, err := s.path(bucketName, objectName)
+	if err != nil {
+		return minio.UploadInfo{}, err
+	}
+	if h := opts.Header(); h.Get("If-Match") != "" || h.Get("If-None-Match") != "" {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		var etag string
+		if info, err := s.StatObject(ctx, bucketName, objectName, minio.StatObjectOptions{}); err == nil {
+			etag = info.ETag
+		} else if !os.IsNotExist(err) {
+			return minio.UploadInfo{}, err
+		}
+		if !putPreconditionsHold(opts, etag) {
+			return minio.UploadInfo{}, preconditionFailed(objectName)
+		}
+	}
+	size, err := copyLocalFile(filePath, p)
+	if err != nil {
+		return minio.UploadInfo{}, err
+	}
+	return minio.UploadInfo{Bucket: bucketName, Key: objectName, Size: size}, nil
+}
+
+// CopyLocalFile copies a file, creating the parent directories of the
+// destination if needed. Readers never see a partially written file,
+// since we write to a temporary file and then rename it atomically.
+func copyLocalFile(src, dst string) (int64, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+	return writeLocalFile(in, dst)
+}
+
+// WriteLocalFile writes the content of a reader into a file, in the
+// same way as copyLocalFile.
+func writeLocalFile(in io.Reader, dst string) (int64, error) {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return 0, err
+	}
+	tmp := dst + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return 0, err
+	}
+	defer out.Close()
+
+	n, err := io.Copy(out, in)
+	if err != nil {
+		os.Remove(tmp)
+		return 0, err
+	}
+	if err := out.Sync(); err != nil {
+		os.Remove(tmp)
+		return 0, err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tmp)
+		return 0, err
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
@@ -0,0 +1,127 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/minio/minio-go/v7"
+)
+
+func TestLocalStorage(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	s := NewLocalStorage(root)
+
+	if exists, err := s.BucketExists(ctx, "qrank"); exists || err != nil {
+		t.Fatalf("got (%v, %v), want (false, nil)", exists, err)
+	}
+	if err := os.Mkdir(filepath.Join(root, "qrank"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if exists, err := s.BucketExists(ctx, "qrank"); !exists || err != nil {
+		t.Fatalf("got (%v, %v), want (true, nil)", exists, err)
+	}
+
+	src := filepath.Join(t.TempDir(), "hello.txt")
+	if err := os.WriteFile(src, []byte("Hello, world"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"public/a-1.txt", "public/b-2.txt", "public/sub/c.txt", "other.txt"} {
+		if _, err := s.FPutObject(ctx, "qrank", key, src, minio.PutObjectOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	info, err := s.StatObject(ctx, "qrank", "public/a-1.txt", minio.StatObjectOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size != 12 || info.ETag != "bc6e6f16b8a077ef5fbc8d59d0b931b9" {
+		t.Errorf("got size=%d etag=%q", info.Size, info.ETag)
+	}
+
+	// Replacing an object must change its ETag, even if the new content
+	// has the same size and the modification time stays the same.
+	src2 := filepath.Join(t.TempDir(), "hello2.txt")
+	if err := os.WriteFile(src2, []byte("Hello, World"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.FPutObject(ctx, "qrank", "other.txt", src2, minio.PutObjectOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	otherPath := filepath.Join(root, "qrank", "other.txt")
+	if err := os.Chtimes(otherPath, info.LastModified, info.LastModified); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.StatObject(ctx, "qrank", "other.txt", minio.StatObjectOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.FPutObject(ctx, "qrank", "other.txt", src, minio.PutObjectOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(otherPath, info.LastModified, info.LastModified); err != nil {
+		t.Fatal(err)
+	}
+	other, err := s.StatObject(ctx, "qrank", "other.txt", minio.StatObjectOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.ETag != info.ETag {
+		t.Errorf("got etag %q for replaced object, want %q", other.ETag, info.ETag)
+	}
+
+	dst := minio.CopyDestOptions{Bucket: "qrank", Object: "public/a-latest.txt"}
+	csrc := minio.CopySrcOptions{Bucket: "qrank", Object: "public/a-1.txt"}
+	if _, err := s.CopyObject(ctx, dst, csrc); err != nil {
+		t.Fatal(err)
+	}
+	cdst := minio.CopyDestOptions{Bucket: "qrank", Object: "composed.txt"}
+	if _, err := s.ComposeObject(ctx, cdst, csrc, csrc); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(root, "qrank", "composed.txt")); string(data) != "Hello, worldHello, world" {
+		t.Errorf("got %q, want composed object", data)
+	}
+	if err := s.RemoveObject(ctx, "qrank", "public/b-2.txt", minio.RemoveObjectOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	list := func(opts minio.ListObjectsOptions) []string {
+		var keys []string
+		for obj := range s.ListObjects(ctx, "qrank", opts) {
+			if obj.Err != nil {
+				t.Fatal(obj.Err)
+			}
+			keys = append(keys, obj.Key)
+		}
+		return keys
+	}
+	got := list(minio.ListObjectsOptions{Prefix: "public/"})
+	want := []string{"public/a-1.txt", "public/a-latest.txt", "public/sub/"}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	got = list(minio.ListObjectsOptions{Prefix: "public/", Recursive: true})
+	want = []string{"public/a-1.txt", "public/a-latest.txt", "public/sub/c.txt"}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	path := filepath.Join(t.TempDir(), "downloaded.txt")
+	if err := s.FGetObject(ctx, "qrank", "public/a-latest.txt", path, minio.GetObjectOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "Hello, world" {
+		t.Errorf("got %q, want %q", data, "Hello, world")
+	}
+
+	if _, err := s.StatObject(ctx, "qrank", "../escape", minio.StatObjectOptions{}); err == nil {
+		t.Error("expected error for key outside bucket")
+	}
+}
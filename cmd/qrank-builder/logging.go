@@ -0,0 +1,84 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/syslog"
+	"slices"
+	"strings"
+)
+
+// LogLevels are the levels of log messages, from least to most severe.
+// A message gets its level from a prefix such as "error: ", as in
+// logger.Printf("error: %v", err). Messages without such a prefix
+// are at level "info".
+var logLevels = []string{"debug", "info", "warning", "error"}
+
+// ParseLogLevel parses a level name, as given to the -logLevel flag.
+func parseLogLevel(s string) (int, error) {
+	level := slices.Index(logLevels, strings.ToLower(s))
+	if level < 0 {
+		return 0, fmt.Errorf("unknown log level %q, known levels are %s", s, strings.Join(logLevels, ","))
+	}
+	return level, nil
+}
+
+// MessageLevel returns the level of a log line, as formatted by our
+// logger. The header of a line, such as "2024/03/01 04:00:00 main.go:12: ",
+// is the only part of the line that contains ": " without being
+// the message itself, so the message starts after its first occurrence.
+func messageLevel(line string) (level int, msg string) {
+	if pos := strings.Index(line, ": "); pos >= 0 {
+		msg = line[pos+2:]
+	} else {
+		msg = line
+	}
+	for i, name := range logLevels {
+		if strings.HasPrefix(msg, name+": ") {
+			return i, msg
+		}
+	}
+	return slices.Index(logLevels, "info"), msg
+}
+
+// LevelWriter passes log lines on to its outputs, dropping those whose
+// level is below a minimum. Lines also get sent to syslog, if enabled,
+// with a priority that matches their level.
+type levelWriter struct {
+	min    int
+	out    io.Writer
+	syslog *syslog.Writer
+}
+
+// Write implements the io.Writer interface. A log.Logger calls Write
+// exactly once for every line.
+func (w *levelWriter) Write(p []byte) (int, error) {
+	level, msg := messageLevel(string(p))
+	if level < w.min {
+		return len(p), nil
+	}
+	if _, err := w.out.Write(p); err != nil {
+		return 0, err
+	}
+	if w.syslog != nil {
+		msg = strings.TrimSuffix(msg, "\n")
+		var err error
+		switch logLevels[level] {
+		case "debug":
+			err = w.syslog.Debug(msg)
+		case "warning":
+			err = w.syslog.Warning(msg)
+		case "error":
+			err = w.syslog.Err(msg)
+		default:
+			err = w.syslog.Info(msg)
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
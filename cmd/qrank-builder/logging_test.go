@@ -0,0 +1,68 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"log"
+	"testing"
+)
+
+func TestParseLogLevel(t *testing.T) {
+	for _, tc := range []struct {
+		input string
+		want  int
+	}{
+		{"debug", 0},
+		{"info", 1},
+		{"WARNING", 2},
+		{"error", 3},
+		{"verbose", -1},
+	} {
+		got, err := parseLogLevel(tc.input)
+		if err != nil {
+			got = -1
+		}
+		if got != tc.want {
+			t.Errorf("parseLogLevel(%q) = %d, want %d", tc.input, got, tc.want)
+		}
+	}
+}
+
+func TestMessageLevel(t *testing.T) {
+	for _, tc := range []struct {
+		line  string
+		level string
+		msg   string
+	}{
+		{"2024/03/01 04:00:00 main.go:12: error: boom\n", "error", "error: boom\n"},
+		{"2024/03/01 04:00:00 main.go:12: building titles\n", "info", "building titles\n"},
+		{"main.go:12: debug: x: y\n", "debug", "debug: x: y\n"},
+		{"main.go:12: status: error: not a prefix\n", "info", "status: error: not a prefix\n"},
+	} {
+		level, msg := messageLevel(tc.line)
+		if logLevels[level] != tc.level || msg != tc.msg {
+			t.Errorf("messageLevel(%q) = %s, %q; want %s, %q", tc.line, logLevels[level], msg, tc.level, tc.msg)
+		}
+	}
+}
+
+func TestLevelWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w := &levelWriter{min: 2, out: &buf}
+	l := log.New(w, "", log.Ldate|log.Ltime|log.LUTC|log.Lshortfile)
+	l.Printf("debug: hidden")
+	l.Printf("hidden too")
+	l.Printf("warning: shown")
+	l.Printf("error: %s", "shown too")
+	got := buf.String()
+	for _, want := range []string{"warning: shown\n", "error: shown too\n"} {
+		if !bytes.Contains(buf.Bytes(), []byte(want)) {
+			t.Errorf("missing %q in %q", want, got)
+		}
+	}
+	if bytes.Contains(buf.Bytes(), []byte("hidden")) {
+		t.Errorf("messages below minimum level should be dropped, got %q", got)
+	}
+}
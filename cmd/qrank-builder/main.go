@@ -8,12 +8,18 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"log/syslog"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strings"
+	"syscall"
 	"time"
 
+	"github.com/klauspost/compress/zstd"
 	"github.com/minio/minio-go/v7"
 	"github.com/minio/minio-go/v7/pkg/credentials"
 )
@@ -21,13 +27,106 @@ import (
 var logger *log.Logger
 
 func main() {
-	ctx := context.Background()
+	// Kubernetes sends SIGTERM when evicting a job, and gives it
+	// a grace period for cleaning up before killing it. We cancel
+	// the build, which removes incomplete temporary files and
+	// releases the build lease, and then exit with a distinct status.
+	ctx, stopSignals := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stopSignals()
+
+	if len(os.Args) > 1 && os.Args[1] == "presign" {
+		if err := presignMain(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
-	var dumps = flag.String("dumps", "/public/dumps/public", "path to Wikimedia dumps")
-	var testRun = flag.Bool("testRun", false, "if true, we process only a small fraction of the data; used for testing")
+	if len(os.Args) > 1 && os.Args[1] == "validate" {
+		if err := validateMain(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "selftest" {
+		if err := selftestMain(ctx, os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	cfg := newBuildConfig("/public/dumps/public")
+	flag.StringVar(&cfg.Dumps, "dumps", cfg.Dumps, "path to Wikimedia dumps")
+	flag.StringVar(&cfg.LabelLanguage, "labelLanguage", "", "if set, also publish a variant of the ranking with entity labels in this language, such as \"en\"")
+	flag.BoolVar(&cfg.SplitTypes, "splitTypes", false, "if true, also publish separate ranking files for humans, places, taxa and works")
+	flag.BoolVar(&cfg.ClassStats, "classStats", false, "if true, list the top entities of a few prominent classes in the stats of a release")
+	flag.BoolVar(&cfg.Zstd, "zstd", false, "if true, CSV files get published with zstandard compression in addition to gzip")
 	storagekey := flag.String("", "", "path to key with storage access credentials")
+	storageDir := flag.String("storageDir", "", "if set, outputs are stored in this local directory instead of S3-compatible object storage")
+	signingKeyPath := flag.String("signingKey", "", "path to Ed25519 private key in PEM format for signing published checksums; if empty, checksums are not signed")
+	keepReleases := flag.Int("keepReleases", 0, "if positive, delete all but this many releases from storage, plus the first release of each quarter")
+	gcDryRun := flag.Bool("gcDryRun", false, "if true, only log which old releases and cached aggregates would get deleted from storage")
+	flag.StringVar(&cfg.Bucket, "bucket", cfg.Bucket, "name of the bucket in object storage")
+	mirrorKey := flag.String("mirrorKey", "", "path to key with access credentials for a secondary storage endpoint; if set, published files get mirrored there")
+	flag.StringVar(&cfg.MirrorBucket, "mirrorBucket", cfg.MirrorBucket, "name of the bucket on the secondary storage endpoint")
+	flag.StringVar(&cfg.PublicPrefix, "publicPrefix", cfg.PublicPrefix, "prefix for the storage keys of published files")
+	adminAddr := flag.String("admin", "", "if set, serve the admin API on this address, such as \":8000\", and only build when triggered through the API; the token is taken from env var QRANK_ADMIN_TOKEN")
+	schedule := flag.String("schedule", "", "if set, keep running and check for new dumps at the times of this cron expression, such as \"@hourly\" or \"17 */4 * * *\" in UTC; a build starts whenever new dumps have appeared")
+	stagesFlag := flag.String("stages", "", "comma-separated list of pipeline stages to run, such as \"item_signals\"; by default, all stages run; stages are "+strings.Join(buildStages, ","))
+	dateFlag := flag.String("date", "", "if set, build from the dumps as of this date, such as \"2024-03-01\", instead of the latest dumps; for reproducing past releases")
+	backfillFlag := flag.Bool("backfill", false, "if true, build all historical releases, one per month, for which dumps are available but the release is missing in storage")
+	flag.IntVar(&cfg.NumWeeks, "weeks", cfg.NumWeeks, "number of weeks of pageviews to aggregate")
+	diskCheck := flag.Bool("diskCheck", true, "if true, estimate the temporary disk space before building, and fail right away if there is not enough")
+	minWeeks := flag.Int("minWeeks", 0, "if positive and there is not enough temporary disk space for -weeks of pageviews, aggregate fewer weeks, but at least this many")
+	canariesFlag := flag.String("canaries", "", "comma-separated checks on the pageviews of well-known items, such as \"Q64>=1000000,Q64>Q42\"; if any fails, the release does not get published")
+	flag.BoolVar(&cfg.Force, "force", false, "if true, publish releases even if they differ from the previous release beyond the thresholds for anomalies")
+	flag.Float64Var(&cfg.Anomalies.Rows, "maxRowsChange", cfg.Anomalies.Rows, "maximal relative change in the number of items, compared to the previous release, before publishing needs -force")
+	flag.Float64Var(&cfg.Anomalies.Pageviews, "maxViewsChange", cfg.Anomalies.Pageviews, "maximal relative change in total pageviews, compared to the previous release, before publishing needs -force")
+	flag.Float64Var(&cfg.Anomalies.Distribution, "maxDistributionShift", cfg.Anomalies.Distribution, "maximal total variation distance between the histograms of pageviews of the previous and the new release, before publishing needs -force")
+	flag.IntVar(&cfg.Sort.ChunkMiB, "sortChunkMiB", 0, "if positive, external sorts keep chunks of about this many MiB in memory before spilling them to disk; by default, each sort uses its own chunk size, mostly 8 MiB")
+	flag.IntVar(&cfg.Sort.Workers, "sortWorkers", 0, "if positive, number of goroutines for sorting chunks in external sorts; by default, one per CPU")
+	flag.IntVar(&cfg.Sort.MergeWorkers, "sortMergeWorkers", 0, "if positive, number of goroutines for merging chunks in external sorts")
+	flag.IntVar(&cfg.Sort.Buffer, "sortBuffer", 0, "if positive, size of the channels that pass records to and from external sorts")
+	cgroupFlag := flag.Bool("cgroupLimits", true, "if true, set GOMAXPROCS and GOMEMLIMIT from the CPU and memory limits of the container, unless these environment variables are set; the number of sort and bzip2 workers follows GOMAXPROCS")
+	memoryQuota := flag.Int("memoryQuotaMiB", 0, "if positive, memory quota of the job in MiB, such as the memory limit of a Toolforge job; when resident memory gets close to it, or to GOMEMLIMIT, external sorts use smaller chunks and fewer workers")
+	flag.StringVar(&cfg.Sort.TempDir, "sortTempDir", "", "if set, external sorts spill their chunks into this directory, such as a local SSD, instead of the directory for temporary files")
+	flag.BoolVar(&cfg.StreamPageviews, "streamPageviews", false, "if true, stream pageviews from the dumps straight into building item signals, without building weekly pageview files in storage; weeks that earlier builds have put into storage get read from there; saves disk space and I/O for one-shot builds")
+	flag.BoolVar(&cfg.SharedCache, "sharedCache", cfg.SharedCache, "if true, keep aggregates such as weekly pageviews in a content-addressed cache in storage, so other builders and later runs reuse them instead of reading the same dumps again")
+	cacheMaxGiB := flag.Int("cacheMaxGiB", 0, "if positive, after every build, delete the oldest aggregates from the shared cache in storage until it holds at most this many GiB")
+	cacheMaxAgeDays := flag.Int("cacheMaxAgeDays", 400, "if positive, after every build, delete aggregates from the shared cache in storage that were written more than this many days ago")
+	zstdDictPath := flag.String("zstdDict", "", "if set, path to a zstd dictionary for compressing intermediate files, such as weekly pageviews; files written with a dictionary can only be read with the same dictionary, so changing it rebuilds them")
+	cacheLevelFlag := flag.String("cacheLevel", "", "if set, zstd compression level for intermediate files that get kept across builds, such as weekly pageviews; one of fastest,default,better,best; lower levels save CPU, higher levels save I/O")
+	maxOpenFiles := flag.Int("maxOpenFiles", 0, "if positive, maximal number of dump files that get read at the same time; lower this if reading from NFS is the bottleneck")
+	bzip2Workers := flag.Int("bzip2Workers", 0, "if positive, number of goroutines for decompressing bzip2 dumps, shared by all files that get read at the same time; by default, one per CPU")
+	bzip2Flag := flag.String("bzip2Command", "", "if set, decompress bzip2 files by piping them through this program, such as \"lbzip2\" or \"pbzip2\", instead of decompressing in Go; \"auto\" picks lbzip2 or pbzip2 if installed")
+	verifyFlag := flag.String("verify", "", "if set, rebuild the release of this date, such as \"2024-05-01\", from the inputs in its provenance manifest, and report any differences to the published release")
+	dryRun := flag.Bool("dryRun", false, "if true, only print what would be read, built and uploaded, with size estimates, without building anything")
+	logLevelFlag := flag.String("logLevel", "info", "minimum level of logged messages; one of "+strings.Join(logLevels, ","))
+	logConsole := flag.String("logConsole", "", "if set to \"stderr\" or \"stdout\", also write logs there, for example to see them with \"toolforge jobs logs\"")
+	logSyslog := flag.Bool("syslog", false, "if true, also send logs to the local syslog daemon")
+	pushgateway := flag.String("pushgateway", "", "if set, push build metrics to the Prometheus Pushgateway at this URL, such as \"http://pushgateway:9091\", after every build")
+	metricsTextfile := flag.String("metricsTextfile", "", "if set, write build metrics after every build to this file, for the textfile collector of Prometheus node_exporter; the name must end in .prom")
+	otlpFlag := flag.String("otlpEndpoint", "", "if set, export traces to this OpenTelemetry collector, such as \"http://localhost:4318/v1/traces\"; defaults to env var OTEL_EXPORTER_OTLP_TRACES_ENDPOINT or OTEL_EXPORTER_OTLP_ENDPOINT")
+	pprofAddr := flag.String("pprof", "", "if set, serve runtime profiles for \"go tool pprof\" on this address, such as \"localhost:6060\"")
+	healthAddr := flag.String("health", "", "if set, serve /healthz and /progress on this address, such as \":8080\"")
+	stallTimeout := flag.Duration("stallTimeout", 6*time.Hour, "if a running build makes no progress for this long, /healthz reports it as stuck so it gets restarted; 0 to disable")
+	notifyWebhook := flag.String("notifyWebhook", "", "if set, post a JSON summary of every finished or failed build to this URL, such as an incoming webhook for Slack, Mattermost or Zulip")
+	notifyEmail := flag.String("notifyEmail", "", "if set, send a summary of every finished or failed build to these comma-separated e-mail addresses")
+	notifyFrom := flag.String("notifyFrom", "qrank-builder@localhost", "sender address for notification e-mails")
+	smtpAddr := flag.String("smtp", "localhost:25", "address of the mail server for sending notification e-mails")
+	notifyIRC := flag.String("notifyIRC", "", "if set, post a one-line summary of every finished or failed build to this IRC channel, such as \"ircs://qrank-builder@irc.libera.chat/#wikidata-qrank\"")
+	workQueueFlag := flag.Bool("workQueue", false, "if true, share the work of building with workers started with -worker, through a work queue in storage; this builder waits for the workers, and then finishes the build")
+	workerFlag := flag.Bool("worker", false, "if true, only help a builder that runs with -workQueue: claim weeks of pageviews and wiki sites from the work queue in storage, build them, and exit when no unclaimed work is left")
+	leaseTTL := flag.Duration("leaseTTL", 10*time.Minute, "how long the build lease in object storage stays valid without renewal; the lease keeps concurrent builders from interfering, and gets renewed while building; 0 to build without a lease")
+	configPath := flag.String("config", "", "if set, read settings from this TOML or YAML file, such as qrank-builder.toml or qrank-builder.yaml; its keys are the names of flags, and flags on the command line take precedence")
 	flag.Parse()
 
+	if *configPath != "" {
+		if err := loadConfig(*configPath, flag.CommandLine); err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	// https://wikitech.wikimedia.org/wiki/Help:Toolforge/Build_Service#Using_NFS_shared_storage
 	if toolDir := os.Getenv("TOOL_DATA_DIR"); toolDir != "" {
 		if err := os.Chdir(toolDir); err != nil {
@@ -44,162 +143,396 @@ func main() {
 		log.Fatal(err)
 	}
 	defer logfile.Close()
-	logger = log.New(logfile, "", log.Ldate|log.Ltime|log.LUTC|log.Lshortfile)
-	logger.Printf("qrank-builder starting up")
-
-	storage, err := NewStorageClient(*storagekey)
+	logLevel, err := parseLogLevel(*logLevelFlag)
 	if err != nil {
-		logger.Fatal(err)
+		log.Fatal(err)
 	}
-
-	bucketExists, err := storage.BucketExists(ctx, "qrank")
-	if err != nil {
-		logger.Fatal(err)
+	logOut := &levelWriter{min: logLevel, out: logfile}
+	switch *logConsole {
+	case "":
+	case "stderr":
+		logOut.out = io.MultiWriter(logfile, os.Stderr)
+	case "stdout":
+		logOut.out = io.MultiWriter(logfile, os.Stdout)
+	default:
+		log.Fatalf("-logConsole must be \"stderr\" or \"stdout\", got %q", *logConsole)
 	}
-	if !bucketExists {
-		logger.Fatal("storage bucket \"qrank\" does not exist")
+	if *logSyslog {
+		logOut.syslog, err = syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, "qrank-builder")
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer logOut.syslog.Close()
 	}
-
-	if err := computeQRank(*dumps, *testRun, storage); err != nil {
-		logger.Printf("ComputeQRank failed: %v", err)
-		log.Fatal(err)
-		return
+	logger = log.New(logOut, "", log.Ldate|log.Ltime|log.LUTC|log.Lshortfile)
+	logger.Printf("qrank-builder starting up")
+	if *cgroupFlag {
+		applyCgroupLimits(readCgroupLimits("/sys/fs/cgroup"))
 	}
 
-	logger.Printf("qrank-builder exiting")
-}
+	if *healthAddr != "" {
+		health := newHealthServer(progress, *stallTimeout)
+		go func() {
+			logger.Printf("serving /healthz and /progress on %s", *healthAddr)
+			if err := http.ListenAndServe(*healthAddr, health); err != nil {
+				logger.Fatal("error: ", err)
+			}
+		}()
+	}
 
-// NewStorageClient sets up a client for accessing S3-compatible object storage.
-func NewStorageClient(keypath string) (*minio.Client, error) {
-	var config struct{ Endpoint, Key, Secret string }
+	if *pprofAddr != "" {
+		servePprof(*pprofAddr)
+	}
 
-	if keypath == "" {
-		config.Endpoint = os.Getenv("S3_ENDPOINT")
-		config.Key = os.Getenv("S3_KEY")
-		config.Secret = os.Getenv("S3_SECRET")
-	} else {
-		data, err := os.ReadFile(keypath)
+	cfg.Stages, err = parseStages(*stagesFlag)
+	if err != nil {
+		logger.Fatal("error: ", err)
+	}
+	cfg.Canaries, err = parseCanaries(*canariesFlag)
+	if err != nil {
+		logger.Fatal("error: ", err)
+	}
+	if cfg.Sort.TempDir != "" {
+		if info, err := os.Stat(cfg.Sort.TempDir); err != nil || !info.IsDir() {
+			logger.Fatalf("error: -sortTempDir %q is not a directory", cfg.Sort.TempDir)
+		}
+	}
+	if *zstdDictPath != "" {
+		cfg.CacheDictionary, err = os.ReadFile(*zstdDictPath)
 		if err != nil {
-			return nil, err
+			logger.Fatal("error: ", err)
 		}
-		if err := json.Unmarshal(data, &config); err != nil {
-			return nil, err
+		if _, err := zstd.InspectDictionary(cfg.CacheDictionary); err != nil {
+			logger.Fatalf("error: -zstdDict %s: %v", *zstdDictPath, err)
 		}
 	}
+	if *cacheLevelFlag != "" {
+		ok, level := zstd.EncoderLevelFromString(*cacheLevelFlag)
+		if !ok {
+			logger.Fatalf("error: -cacheLevel must be one of fastest,default,better,best; got %q", *cacheLevelFlag)
+		}
+		cfg.CacheLevel = level
+	}
+	cfg.Limits = newConcurrencyLimits(*maxOpenFiles, *bzip2Workers)
+	cacheMaxBytes := int64(*cacheMaxGiB) << 30
+	cacheMaxAge := time.Duration(*cacheMaxAgeDays) * 24 * time.Hour
+	if *memoryQuota < 0 {
+		logger.Fatalf("error: -memoryQuotaMiB must not be negative, got %d", *memoryQuota)
+	}
+	cfg.Sort.Memory = newMemoryMonitor(int64(*memoryQuota) << 20)
+	if cfg.Sort.Memory != nil {
+		logger.Printf("monitoring memory against a limit of %d MiB", cfg.Sort.Memory.limit>>20)
+		go cfg.Sort.Memory.run(context.Background(), time.Second)
+	}
 
-	client, err := minio.New(config.Endpoint, &minio.Options{
-		Creds:  credentials.NewStaticV4(config.Key, config.Secret, ""),
-		Secure: true,
-	})
+	cfg.Bzip2Command, err = resolveBzip2Command(*bzip2Flag)
 	if err != nil {
-		return nil, err
+		logger.Fatal("error: -bzip2Command: ", err)
+	}
+	if cfg.Bzip2Command != "" {
+		logger.Printf("decompressing bzip2 files with %s", cfg.Bzip2Command)
+	}
+	if cfg.NumWeeks < 1 {
+		logger.Fatalf("error: -weeks must be positive, got %d", cfg.NumWeeks)
+	}
+	if *dateFlag != "" {
+		cfg.AsOf, err = time.Parse(time.DateOnly, *dateFlag)
+		if err != nil {
+			logger.Fatalf("error: -date must be in the form YYYY-MM-DD, got %q", *dateFlag)
+		}
+		if *schedule != "" {
+			logger.Fatal("error: -date cannot be combined with -schedule")
+		}
+		logger.Printf("building from the dumps as of %s", *dateFlag)
+	}
+	if *backfillFlag {
+		if *dateFlag != "" || *schedule != "" {
+			logger.Fatal("error: -backfill cannot be combined with -date or -schedule")
+		}
+		if *keepReleases > 0 {
+			logger.Fatal("error: -backfill cannot be combined with -keepReleases, which would delete the backfilled releases")
+		}
 	}
 
-	client.SetAppInfo("QRankBuilder", "0.1")
-	return client, nil
-}
+	if *workQueueFlag || *workerFlag {
+		if *workQueueFlag && *workerFlag {
+			logger.Fatal("error: -workQueue cannot be combined with -worker")
+		}
+		if *leaseTTL <= 0 {
+			logger.Fatal("error: -workQueue and -worker need a positive -leaseTTL")
+		}
+		if cfg.StreamPageviews {
+			logger.Fatal("error: -workQueue and -worker cannot be combined with -streamPageviews")
+		}
+		if *workerFlag && (*backfillFlag || *keepReleases > 0) {
+			logger.Fatal("error: -worker cannot be combined with -backfill or -keepReleases")
+		}
+	}
+	if *workerFlag {
+		cfg.Stages = workerStages(cfg.Stages)
+	}
 
-func computeQRank(dumpsPath string, testRun bool, storage *minio.Client) error {
-	return Build(&http.Client{}, dumpsPath /*numWeeks*/, 52, storage)
+	var verifyDate time.Time
+	if *verifyFlag != "" {
+		verifyDate, err = time.Parse(time.DateOnly, *verifyFlag)
+		if err != nil {
+			logger.Fatalf("error: -verify must be in the form YYYY-MM-DD, got %q", *verifyFlag)
+		}
+		if *dateFlag != "" || *schedule != "" || *backfillFlag {
+			logger.Fatal("error: -verify cannot be combined with -date, -schedule or -backfill")
+		}
+	}
 
-	// TODO: Old code starts here, remove after new implementation is done.
+	if *signingKeyPath != "" {
+		cfg.SigningKey, err = loadSigningKey(*signingKeyPath)
+		if err != nil {
+			logger.Fatal("error: ", err)
+		}
+	}
 
-	ctx := context.Background()
-	outDir := "cache"
-	if testRun {
-		outDir = "cache-testrun"
+	var storage S3
+	if *storageDir != "" {
+		storage = NewLocalStorage(*storageDir)
+	} else {
+		client, err := NewStorageClient(*storagekey)
+		if err != nil {
+			logger.Fatal("error: ", err)
+		}
+		storage = client
 	}
 
-	if err := os.MkdirAll(outDir, 0755); err != nil {
-		return err
+	bucketExists, err := storage.BucketExists(ctx, cfg.Bucket)
+	if err != nil {
+		logger.Fatal("error: ", err)
+	}
+	if !bucketExists {
+		logger.Fatalf("error: storage bucket %q does not exist", cfg.Bucket)
 	}
 
-	if err := CleanupCache(outDir); err != nil {
-		return err
+	if *workQueueFlag || *workerFlag {
+		cfg.Queue = &workQueue{
+			s3:     storage,
+			bucket: cfg.Bucket,
+			holder: leaseHolder(),
+			ttl:    *leaseTTL,
+			poll:   time.Minute,
+			worker: *workerFlag,
+		}
 	}
 
-	edate, epath, err := findEntitiesDump(dumpsPath)
-	if err != nil {
-		return err
+	if *dryRun {
+		plan, err := planBuild(ctx, &http.Client{}, cfg, storage)
+		if err != nil {
+			logger.Fatal("error: ", err)
+		}
+		if err := writePlan(os.Stdout, plan); err != nil {
+			logger.Fatal("error: ", err)
+		}
+		return
 	}
 
-	pageviews, err := processPageviews(testRun, dumpsPath, edate, outDir, ctx)
-	if err != nil {
-		return err
+	if *verifyFlag != "" {
+		result, err := verifyRelease(ctx, &http.Client{}, cfg, verifyDate, storage)
+		if err != nil {
+			logger.Fatal("error: ", err)
+		}
+		if err := writeVerifyResult(os.Stdout, result); err != nil {
+			logger.Fatal("error: ", err)
+		}
+		if !result.deterministic() {
+			os.Exit(1)
+		}
+		return
 	}
 
-	sitelinks, err := processEntities(testRun, epath, edate, outDir, ctx)
-	if err != nil {
-		return err
+	if *mirrorKey != "" {
+		client, err := NewStorageClient(*mirrorKey)
+		if err != nil {
+			logger.Fatal("error: ", err)
+		}
+		cfg.Mirror = client
 	}
 
-	qviews, err := buildQViews(testRun, edate, sitelinks, pageviews, outDir, ctx)
-	if err != nil {
-		return err
+	build := func(ctx context.Context) error {
+		// Each build gets its own copy of the settings, so that
+		// shrinking the window for one build does not affect the next.
+		cfg := *cfg
+		if *diskCheck {
+			var err error
+			cfg.NumWeeks, err = checkDiskSpace(ctx, &http.Client{}, &cfg, *minWeeks, storage)
+			if err != nil {
+				logger.Printf("error: disk space check failed: %v", err)
+				return err
+			}
+		}
+		if *backfillFlag {
+			if err := backfill(ctx, &http.Client{}, &cfg, storage); err != nil {
+				logger.Printf("error: backfill failed: %v", err)
+				return err
+			}
+			return nil
+		}
+		if err := Build(ctx, &http.Client{}, &cfg, storage); err != nil {
+			logger.Printf("error: Build failed: %v", err)
+			return err
+		}
+		if *keepReleases > 0 {
+			if _, err := CollectGarbage(ctx, cfg.Bucket, cfg.PublicPrefix, *keepReleases, *gcDryRun, storage); err != nil {
+				logger.Printf("error: CollectGarbage failed: %v", err)
+				return err
+			}
+		}
+		if (cacheMaxBytes > 0 || cacheMaxAge > 0) && !*workerFlag {
+			if _, err := cleanupSharedCache(ctx, cfg.Bucket, cacheMaxBytes, cacheMaxAge, time.Now(), *gcDryRun, storage); err != nil {
+				logger.Printf("error: cleanupSharedCache failed: %v", err)
+				return err
+			}
+		}
+		return nil
+	}
+	run := build
+
+	// Workers do not take the build lease, which is held by
+	// the builder that coordinates them.
+	if *leaseTTL > 0 && !*workerFlag {
+		holder := leaseHolder()
+		run = func(ctx context.Context) error {
+			err := withLease(ctx, storage, cfg.Bucket, holder, *leaseTTL, build)
+			if err != nil {
+				logger.Printf("error: build with lease failed: %v", err)
+			}
+			return err
+		}
 	}
 
-	qrank, err := buildQRank(edate, qviews, outDir, ctx)
-	if err != nil {
-		return err
+	if *pushgateway != "" || *metricsTextfile != "" {
+		build := run
+		run = func(ctx context.Context) error {
+			started := time.Now()
+			err := build(ctx)
+			recordRun(started, time.Now(), err)
+			if err := exportMetrics(*pushgateway, *metricsTextfile); err != nil {
+				logger.Printf("warning: could not export metrics: %v", err)
+			}
+			return err
+		}
 	}
 
-	stats, err := buildStats(edate, qrank, 50, 1000, outDir)
-	if err != nil {
-		return err
+	if endpoint := otlpEndpoint(*otlpFlag); endpoint != "" {
+		traces = newTracer(endpoint)
+		build := run
+		run = func(ctx context.Context) error {
+			ctx, span := startSpan(ctx, "build")
+			err := build(ctx)
+			span.finish(err)
+			if err := traces.flush(context.Background()); err != nil {
+				logger.Printf("warning: could not export traces: %v", err)
+			}
+			return err
+		}
 	}
 
-	if storage != nil {
-		if err := upload(edate, qrank, stats, storage); err != nil {
+	notify := &notifier{
+		webhook: *notifyWebhook,
+		smtp:    *smtpAddr,
+		from:    *notifyFrom,
+		irc:     *notifyIRC,
+		client:  &http.Client{Timeout: 30 * time.Second},
+	}
+	if *notifyEmail != "" {
+		notify.email = strings.Split(*notifyEmail, ",")
+	}
+	if notify.enabled() {
+		build := run
+		run = func(ctx context.Context) error {
+			started := time.Now()
+			read, rows := stageCounters("qrank_builder_read_bytes_total"), stageCounters("qrank_builder_rows_total")
+			err := build(ctx)
+			summary := summarizeBuild(started, time.Now(), err, read, rows)
+
+			// Also notify about builds that got interrupted by SIGTERM.
+			notifyCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 2*time.Minute)
+			defer cancel()
+			if err := notify.notify(notifyCtx, summary); err != nil {
+				logger.Printf("warning: could not send notifications: %v", err)
+			}
 			return err
 		}
 	}
 
-	return nil
-}
+	if *schedule != "" {
+		if *adminAddr != "" {
+			logger.Fatal("error: -schedule cannot be combined with -admin")
+		}
+		sched, err := parseCronSchedule(*schedule)
+		if err != nil {
+			logger.Fatal("error: ", err)
+		}
+		logger.Printf("running on schedule %q", *schedule)
+		s := newScheduler(sched, "qrank-builder-schedule.json", cfg.Dumps, run)
+		err = s.Run(ctx)
+		exitIfInterrupted(ctx)
+		logger.Fatal("error: ", err)
+	}
 
-// Upload puts the final output files into an S3-compatible object storage.
-func upload(date time.Time, qrank, stats string, storage *minio.Client) error {
-	ymd := date.Format("20060102")
-	qrankDest := fmt.Sprintf("public/qrank-%s.csv.gz", ymd)
-	if err := uploadFile(qrankDest, qrank, "text/csv", storage); err != nil {
-		return err
+	if *adminAddr != "" {
+		token := os.Getenv("QRANK_ADMIN_TOKEN")
+		if token == "" {
+			logger.Fatal("error: -admin needs env var QRANK_ADMIN_TOKEN")
+		}
+		admin := newAdminServer(token, run)
+		server := &http.Server{Addr: *adminAddr, Handler: admin}
+		go func() {
+			<-ctx.Done()
+			admin.stop()
+			server.Shutdown(context.Background())
+		}()
+		logger.Printf("serving admin API on %s", *adminAddr)
+		err := server.ListenAndServe()
+		exitIfInterrupted(ctx)
+		log.Fatal(err)
 	}
 
-	statsDest := fmt.Sprintf("public/qrank-stats-%s.json", ymd)
-	if err := uploadFile(statsDest, stats, "application/json", storage); err != nil {
-		return err
+	progress.start()
+	err = run(ctx)
+	progress.finish(err)
+	exitIfInterrupted(ctx)
+	if err != nil {
+		log.Fatal(err)
+		return
 	}
 
-	return nil
+	logger.Printf("qrank-builder exiting")
 }
 
-// UploadFile puts one single file into an S3-compatible object storage.
-func uploadFile(dest, src, contentType string, storage *minio.Client) error {
-	ctx := context.Background()
-	bucket := "qrank"
+// NewStorageClient sets up a client for accessing S3-compatible object storage.
+// Besides Amazon S3, Ceph and MinIO, this also works for Google Cloud
+// Storage through its XML API at storage.googleapis.com, using HMAC keys.
+func NewStorageClient(keypath string) (*minio.Client, error) {
+	var config struct{ Endpoint, Key, Secret string }
 
-	// Check if the output file already exists in storage.
-	_, err := storage.StatObject(ctx, bucket, dest, minio.StatObjectOptions{})
-	if err == nil {
-		logmsg := fmt.Sprintf("Already in object storage: %s/%s", bucket, dest)
-		fmt.Println(logmsg)
-		if logger != nil {
-			logger.Println(logmsg)
+	if keypath == "" {
+		config.Endpoint = os.Getenv("S3_ENDPOINT")
+		config.Key = os.Getenv("S3_KEY")
+		config.Secret = os.Getenv("S3_SECRET")
+	} else {
+		data, err := os.ReadFile(keypath)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, &config); err != nil {
+			return nil, err
 		}
-		return nil
 	}
 
-	opts := minio.PutObjectOptions{ContentType: contentType}
-	_, err = storage.FPutObject(ctx, bucket, dest, src, opts)
+	client, err := minio.New(config.Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(config.Key, config.Secret, ""),
+		Secure: true,
+	})
 	if err != nil {
-		return err
-	}
-
-	logmsg := fmt.Sprintf("Uploaded to object storage: %s/%s", bucket, dest)
-	fmt.Println(logmsg)
-	if logger != nil {
-		logger.Println(logmsg)
+		return nil, err
 	}
 
-	return nil
+	client.SetAppInfo("QRankBuilder", "0.1")
+	return client, nil
 }
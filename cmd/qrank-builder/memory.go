@@ -0,0 +1,132 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"math"
+	"os"
+	"runtime/debug"
+	"runtime/metrics"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// MemoryMonitor watches the resident memory of the process, and tells
+// the external sorts to use smaller chunks and fewer workers when it
+// gets close to the memory quota. On Toolforge, a job that exceeds its
+// quota gets killed without warning, typically hours into a build while
+// sorting the last stages. Sorts that are already running keep their
+// settings, but every new sort gets configured for the memory that is
+// left at the time it starts.
+type memoryMonitor struct {
+	limit int64                 // in bytes
+	rss   func() (int64, error) // resident memory, in bytes
+	level atomic.Int32          // see memoryHigh and memoryCritical
+	peak  atomic.Int64          // highest resident memory seen, in bytes
+}
+
+// Memory pressure levels, as fractions of the memory limit.
+const (
+	memoryHigh     = 0.7
+	memoryCritical = 0.85
+)
+
+// NewMemoryMonitor returns a monitor for a memory quota in bytes.
+// If GOMEMLIMIT is set to something lower, that is used instead. If
+// neither is known, the result is nil, and no monitoring takes place.
+func newMemoryMonitor(quota int64) *memoryMonitor {
+	limit := quota
+	if soft := debug.SetMemoryLimit(-1); soft != math.MaxInt64 && (limit <= 0 || soft < limit) {
+		limit = soft
+	}
+	if limit <= 0 {
+		return nil
+	}
+	return &memoryMonitor{limit: limit, rss: residentMemory}
+}
+
+// Run samples the resident memory until the context is done.
+func (m *memoryMonitor) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		m.sample()
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Sample measures the resident memory, and updates the pressure level.
+// When the level rises, we log a warning and return freed memory to the
+// operating system, which is what the quota is enforced against.
+func (m *memoryMonitor) sample() {
+	rss, err := m.rss()
+	if err != nil {
+		return
+	}
+	if rss > m.peak.Load() {
+		m.peak.Store(rss)
+		memoryPeak.Set(float64(rss))
+	}
+
+	var level int32
+	switch ratio := float64(rss) / float64(m.limit); {
+	case ratio >= memoryCritical:
+		level = 2
+	case ratio >= memoryHigh:
+		level = 1
+	}
+	if old := m.level.Swap(level); level > old {
+		if logger != nil {
+			logger.Printf("warning: resident memory is %d MiB, %.0f%% of the limit of %d MiB; shrinking external sorts",
+				rss>>20, 100*float64(rss)/float64(m.limit), m.limit>>20)
+		}
+		debug.FreeOSMemory()
+	}
+}
+
+// Adjust scales down the chunk size and the number of workers of an
+// external sort according to the current memory pressure.
+func (m *memoryMonitor) adjust(chunkSize, workers int) (int, int) {
+	if m == nil {
+		return chunkSize, workers
+	}
+	switch m.level.Load() {
+	case 1:
+		return max(chunkSize/2, 2), max(workers/2, 1)
+	case 2:
+		return max(chunkSize/4, 2), 1
+	}
+	return chunkSize, workers
+}
+
+// ResidentMemory returns the resident set size of the current process.
+// On Linux, this is what memory quotas get enforced against. Elsewhere,
+// we approximate it by the memory that the Go runtime has mapped and
+// not yet returned to the operating system.
+func residentMemory() (int64, error) {
+	if data, err := os.ReadFile("/proc/self/statm"); err == nil {
+		fields := bytes.Fields(data)
+		if len(fields) >= 2 {
+			pages, err := strconv.ParseInt(string(fields[1]), 10, 64)
+			if err != nil {
+				return 0, err
+			}
+			return pages * int64(os.Getpagesize()), nil
+		}
+	}
+
+	samples := []metrics.Sample{
+		{Name: "/memory/classes/total:bytes"},
+		{Name: "/memory/classes/heap/released:bytes"},
+	}
+	metrics.Read(samples)
+	return int64(samples[0].Value.Uint64() - samples[1].Value.Uint64()), nil
+}
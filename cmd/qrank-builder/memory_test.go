@@ -0,0 +1,75 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"log"
+	"runtime/debug"
+	"testing"
+)
+
+func TestMemoryMonitor(t *testing.T) {
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	var rss int64
+	m := &memoryMonitor{limit: 1000, rss: func() (int64, error) { return rss, nil }}
+	for _, tc := range []struct {
+		rss                int64
+		chunkSize, workers int
+	}{
+		{100, 1000, 8},
+		{700, 500, 4},
+		{900, 250, 1},
+		{750, 500, 4},
+		{200, 1000, 8},
+	} {
+		rss = tc.rss
+		m.sample()
+		chunkSize, workers := m.adjust(1000, 8)
+		if chunkSize != tc.chunkSize || workers != tc.workers {
+			t.Errorf("rss=%d: got (%d, %d), want (%d, %d)",
+				tc.rss, chunkSize, workers, tc.chunkSize, tc.workers)
+		}
+	}
+	if got := m.peak.Load(); got != 900 {
+		t.Errorf("got peak %d, want 900", got)
+	}
+}
+
+func TestMemoryMonitor_Nil(t *testing.T) {
+	var m *memoryMonitor
+	if chunkSize, workers := m.adjust(1000, 8); chunkSize != 1000 || workers != 8 {
+		t.Errorf("got (%d, %d), want (1000, 8)", chunkSize, workers)
+	}
+}
+
+func TestNewMemoryMonitor(t *testing.T) {
+	defer debug.SetMemoryLimit(debug.SetMemoryLimit(-1))
+
+	if m := newMemoryMonitor(0); m != nil {
+		t.Errorf("without limits, got %v, want nil", m)
+	}
+	if m := newMemoryMonitor(5 << 20); m == nil || m.limit != 5<<20 {
+		t.Errorf("got %v, want limit from quota", m)
+	}
+
+	// GOMEMLIMIT takes precedence if it is lower than the quota.
+	debug.SetMemoryLimit(3 << 20)
+	if m := newMemoryMonitor(5 << 20); m == nil || m.limit != 3<<20 {
+		t.Errorf("got %v, want limit from GOMEMLIMIT", m)
+	}
+	if m := newMemoryMonitor(0); m == nil || m.limit != 3<<20 {
+		t.Errorf("got %v, want limit from GOMEMLIMIT", m)
+	}
+}
+
+func TestResidentMemory(t *testing.T) {
+	rss, err := residentMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rss <= 0 {
+		t.Errorf("got %d, want positive", rss)
+	}
+}
@@ -0,0 +1,264 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+// Metadata describes a QRank release in a machine-readable way, so that
+// data catalogues and machine learning tools can discover and validate
+// the dataset. The format follows the Croissant vocabulary, which
+// is based on schema.org/Dataset and therefore also understood by
+// DCAT-aware catalogues.
+// https://docs.mlcommons.org/croissant/docs/croissant-spec.html
+type Metadata struct {
+	Context          map[string]string `json:"@context"`
+	Type             string            `json:"@type"`
+	ConformsTo       string            `json:"conformsTo"`
+	Name             string            `json:"name"`
+	Description      string            `json:"description"`
+	License          string            `json:"license"`
+	URL              string            `json:"url"`
+	Version          string            `json:"version"`
+	DatePublished    string            `json:"datePublished"`
+	TemporalCoverage string            `json:"temporalCoverage"`
+	IsBasedOn        []MetadataSource  `json:"isBasedOn"`
+	Distribution     []MetadataFile    `json:"distribution"`
+	RecordSet        []MetadataRecords `json:"recordSet"`
+}
+
+// MetadataSource describes an input to the QRank pipeline.
+type MetadataSource struct {
+	Type        string `json:"@type"`
+	Name        string `json:"name"`
+	URL         string `json:"url"`
+	DateCreated string `json:"dateCreated,omitempty"`
+}
+
+// MetadataFile describes one file of a QRank release.
+type MetadataFile struct {
+	Type           string `json:"@type"`
+	ID             string `json:"@id"`
+	Name           string `json:"name"`
+	ContentURL     string `json:"contentUrl"`
+	ContentSize    string `json:"contentSize"`
+	EncodingFormat string `json:"encodingFormat"`
+	SHA256         string `json:"sha256"`
+}
+
+// MetadataRecords describes the records in a QRank file.
+type MetadataRecords struct {
+	Type       string          `json:"@type"`
+	ID         string          `json:"@id"`
+	Name       string          `json:"name"`
+	NumRecords int64           `json:"numRecords"`
+	Fields     []MetadataField `json:"field"`
+}
+
+// MetadataField describes a column of a QRank file.
+type MetadataField struct {
+	Type        string `json:"@type"`
+	ID          string `json:"@id"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	DataType    string `json:"dataType"`
+	Source      struct {
+		FileObject struct {
+			ID string `json:"@id"`
+		} `json:"fileObject"`
+		Extract struct {
+			Column string `json:"column"`
+		} `json:"extract"`
+	} `json:"source"`
+}
+
+// BuildMetadata writes a dataset descriptor for a QRank release.
+// The artifacts get hashed unless their hash is already in hashes,
+// which is keyed by local file path; freshly computed hashes are
+// added to the map. The first artifact must be the QRank file.
+// The pageviews are the keys of the weekly pageview files that
+// have been aggregated into the ranking.
+func buildMetadata(date time.Time, pageviews []string, qrankPath string, artifacts []artifact, hashes map[string]string, outDir string) (string, error) {
+	metadataPath := filepath.Join(
+		outDir,
+		fmt.Sprintf("qrank-metadata-%04d%02d%02d.json", date.Year(), date.Month(), date.Day()))
+
+	if err := hashArtifacts(artifacts, hashes); err != nil {
+		return "", err
+	}
+
+	numRows, err := countQRankRows(qrankPath)
+	if err != nil {
+		return "", err
+	}
+
+	m := Metadata{
+		Context: map[string]string{
+			"@vocab":     "https://schema.org/",
+			"cr":         "http://mlcommons.org/croissant/",
+			"sc":         "https://schema.org/",
+			"dct":        "http://purl.org/dc/terms/",
+			"field":      "cr:field",
+			"source":     "cr:source",
+			"extract":    "cr:extract",
+			"fileObject": "cr:fileObject",
+			"column":     "cr:column",
+			"recordSet":  "cr:recordSet",
+			"dataType":   "cr:dataType",
+			"numRecords": "cr:numRecords",
+			"sha256":     "cr:sha256",
+			"conformsTo": "dct:conformsTo",
+		},
+		Type:       "sc:Dataset",
+		ConformsTo: "http://mlcommons.org/croissant/1.0",
+		Name:       "Wikidata QRank",
+		Description: "QRank is a ranking signal for Wikidata entities, computed " +
+			"by aggregating page view statistics of Wikipedia and other " +
+			"Wikimedia projects.",
+		License:          "https://creativecommons.org/publicdomain/zero/1.0/",
+		URL:              "https://qrank.toolforge.org/",
+		Version:          date.Format(time.DateOnly),
+		DatePublished:    time.Now().UTC().Format(time.DateOnly),
+		TemporalCoverage: pageviewsCoverage(pageviews),
+		IsBasedOn: []MetadataSource{
+			{
+				Type:        "sc:Dataset",
+				Name:        "Wikimedia database dumps",
+				URL:         "https://dumps.wikimedia.org/backup-index.html",
+				DateCreated: date.Format(time.DateOnly),
+			},
+			{
+				Type: "sc:Dataset",
+				Name: "Wikimedia pageviews complete",
+				URL:  "https://dumps.wikimedia.org/other/pageview_complete/",
+			},
+		},
+	}
+
+	for _, a := range artifacts {
+		stat, err := os.Stat(a.src)
+		if err != nil {
+			return "", err
+		}
+		name := path.Base(a.dest)
+		m.Distribution = append(m.Distribution, MetadataFile{
+			Type:           "cr:FileObject",
+			ID:             name,
+			Name:           name,
+			ContentURL:     "https://qrank.toolforge.org/download/" + latestName(name),
+			ContentSize:    fmt.Sprintf("%d B", stat.Size()),
+			EncodingFormat: a.contentType,
+			SHA256:         hashes[a.src],
+		})
+	}
+
+	qrankFile := path.Base(artifacts[0].dest)
+	records := MetadataRecords{
+		Type:       "cr:RecordSet",
+		ID:         "qrank",
+		Name:       "qrank",
+		NumRecords: numRows,
+	}
+	for _, col := range []struct{ name, description, dataType string }{
+		{"Entity", "Wikidata entity ID, such as Q42", "sc:Text"},
+		{"QRank", "Number of page views in the aggregated weeks", "sc:Integer"},
+	} {
+		f := MetadataField{
+			Type:        "cr:Field",
+			ID:          "qrank/" + col.name,
+			Name:        col.name,
+			Description: col.description,
+			DataType:    col.dataType,
+		}
+		f.Source.FileObject.ID = qrankFile
+		f.Source.Extract.Column = col.name
+		records.Fields = append(records.Fields, f)
+	}
+	m.RecordSet = []MetadataRecords{records}
+
+	j, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	tmpFile, err := os.Create(metadataPath + ".tmp")
+	if err != nil {
+		return "", err
+	}
+	if _, err := tmpFile.Write(j); err != nil {
+		tmpFile.Close()
+		return "", err
+	}
+	if err := commitFile(tmpFile, metadataPath); err != nil {
+		return "", err
+	}
+
+	return metadataPath, nil
+}
+
+// PageviewsCoverage returns the time interval covered by weekly pageview
+// files, such as "2024-02-05/2024-04-28" for the keys of weeks 2024-W06
+// to 2024-W17. If there are no weekly files, the result is empty.
+func pageviewsCoverage(pageviews []string) string {
+	var first, last time.Time
+	for _, pv := range pageviews {
+		year, week, err := ParseISOWeek(pv)
+		if err != nil {
+			continue
+		}
+		start := ISOWeekStart(year, week)
+		if first.IsZero() || start.Before(first) {
+			first = start
+		}
+		if start.After(last) {
+			last = start
+		}
+	}
+	if first.IsZero() {
+		return ""
+	}
+	return first.Format(time.DateOnly) + "/" + last.AddDate(0, 0, 6).Format(time.DateOnly)
+}
+
+// CountQRankRows returns the number of data rows in a QRank file.
+func countQRankRows(qrankPath string) (int64, error) {
+	f, err := os.Open(qrankPath)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	r, err := gzip.NewReader(f)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := countLines(r)
+	if err != nil {
+		return 0, err
+	}
+	return n - 1, nil // Don’t count CSV header.
+}
+
+// PublishedNameRegexp matches the names of published files. It mirrors
+// the regular expression used by the webserver to find servable files.
+var publishedNameRegexp = regexp.MustCompile(`^([a-z0-9_\-]+)\-(2[0-9]{7})\.([a-z0-9\.]+)$`)
+
+// LatestName returns the name under which the webserver serves
+// the most recent version of a published file. For example,
+// "qrank-stats-20240301.json" gets served as "qrank-stats.json".
+func latestName(name string) string {
+	if m := publishedNameRegexp.FindStringSubmatch(name); m != nil {
+		return m[1] + "." + m[3]
+	}
+	return name
+}
@@ -0,0 +1,55 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBuildMetadata(t *testing.T) {
+	dir := t.TempDir()
+	qrank := filepath.Join(dir, "qrank.gz")
+	writeGzipFile(qrank, "Entity,QRank\nQ4,77\nQ2,42\nQ5,42\n")
+	artifacts := []artifact{{"public/qrank-20240301.csv.gz", qrank, "text/csv"}}
+	hashes := make(map[string]string)
+	date := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	pageviews := []string{"pageviews/pageviews-2024-W06.zst", "pageviews/pageviews-2024-W08.zst"}
+	path, err := buildMetadata(date, pageviews, qrank, artifacts, hashes, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m Metadata
+	if err := json.Unmarshal(data, &m); err != nil {
+		t.Fatal(err)
+	}
+
+	if m.TemporalCoverage != "2024-02-05/2024-02-25" {
+		t.Errorf(`got temporalCoverage="%s", want "2024-02-05/2024-02-25"`, m.TemporalCoverage)
+	}
+
+	if len(m.RecordSet) != 1 || m.RecordSet[0].NumRecords != 3 {
+		t.Errorf("want 1 record set with 3 records, got %v", m.RecordSet)
+	}
+
+	if len(m.Distribution) != 1 {
+		t.Fatalf("want 1 distribution, got %v", m.Distribution)
+	}
+	dist := m.Distribution[0]
+	if dist.SHA256 != hashes[qrank] || dist.SHA256 == "" {
+		t.Errorf("got sha256=%q, want %q", dist.SHA256, hashes[qrank])
+	}
+	wantURL := "https://qrank.toolforge.org/download/qrank.csv.gz"
+	if dist.ContentURL != wantURL {
+		t.Errorf("got contentUrl=%q, want %q", dist.ContentURL, wantURL)
+	}
+}
@@ -0,0 +1,126 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+// MetricsRegistry holds the metrics about builds. Since the builder
+// is a batch job that is not running most of the time, Prometheus
+// cannot scrape it; instead, the metrics get pushed to a Pushgateway,
+// or written to a file for the textfile collector of node_exporter,
+// after every build. To alert on failing builds, compare
+// qrank_builder_last_success_timestamp_seconds with the current time.
+var metricsRegistry = prometheus.NewRegistry()
+
+var (
+	stageDuration = promauto.With(metricsRegistry).NewGaugeVec(prometheus.GaugeOpts{
+		Name: "qrank_builder_stage_duration_seconds",
+		Help: "How long each pipeline stage took in the last build, by stage.",
+	}, []string{"stage"})
+
+	stageReadBytes = promauto.With(metricsRegistry).NewCounterVec(prometheus.CounterOpts{
+		Name: "qrank_builder_read_bytes_total",
+		Help: "Bytes of input files read, by pipeline stage.",
+	}, []string{"stage"})
+
+	stageRows = promauto.With(metricsRegistry).NewCounterVec(prometheus.CounterOpts{
+		Name: "qrank_builder_rows_total",
+		Help: "Rows written to output files, by pipeline stage.",
+	}, []string{"stage"})
+
+	buildRuns = promauto.With(metricsRegistry).NewCounterVec(prometheus.CounterOpts{
+		Name: "qrank_builder_runs_total",
+		Help: "Number of builds, by result (success or failure).",
+	}, []string{"result"})
+
+	lastRunDuration = promauto.With(metricsRegistry).NewGauge(prometheus.GaugeOpts{
+		Name: "qrank_builder_last_run_duration_seconds",
+		Help: "How long the last build took.",
+	})
+
+	lastRunSuccess = promauto.With(metricsRegistry).NewGauge(prometheus.GaugeOpts{
+		Name: "qrank_builder_last_run_success",
+		Help: "Whether the last build succeeded (1) or failed (0).",
+	})
+
+	lastRunTimestamp = promauto.With(metricsRegistry).NewGauge(prometheus.GaugeOpts{
+		Name: "qrank_builder_last_run_timestamp_seconds",
+		Help: "Time when the last build finished.",
+	})
+
+	lastSuccessTimestamp = promauto.With(metricsRegistry).NewGauge(prometheus.GaugeOpts{
+		Name: "qrank_builder_last_success_timestamp_seconds",
+		Help: "Time when the last successful build finished.",
+	})
+
+	memoryPeak = promauto.With(metricsRegistry).NewGauge(prometheus.GaugeOpts{
+		Name: "qrank_builder_memory_peak_bytes",
+		Help: "Highest resident memory of the builder process, if monitored.",
+	})
+)
+
+// RecordRun updates the metrics about a finished build.
+func recordRun(started, finished time.Time, err error) {
+	lastRunDuration.Set(finished.Sub(started).Seconds())
+	lastRunTimestamp.Set(float64(finished.Unix()))
+	if err != nil {
+		buildRuns.WithLabelValues("failure").Inc()
+		lastRunSuccess.Set(0)
+		return
+	}
+	buildRuns.WithLabelValues("success").Inc()
+	lastRunSuccess.Set(1)
+	lastSuccessTimestamp.Set(float64(finished.Unix()))
+}
+
+// ExportMetrics pushes the metrics to a Prometheus Pushgateway,
+// and writes them to a file for the textfile collector of
+// node_exporter. Either target may be empty.
+func exportMetrics(pushgateway string, textfile string) error {
+	if pushgateway != "" {
+		pusher := push.New(pushgateway, "qrank_builder").Gatherer(metricsRegistry)
+		if err := pusher.Push(); err != nil {
+			return err
+		}
+	}
+	if textfile != "" {
+		if err := prometheus.WriteToTextfile(textfile, metricsRegistry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LineCounter is an io.Writer that counts the lines written through it.
+type lineCounter struct {
+	w     io.Writer
+	lines int64
+}
+
+func (c *lineCounter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.lines += int64(bytes.Count(p[:n], []byte{'\n'}))
+	return n, err
+}
+
+// FileSizes returns the total size of some files. Missing files
+// count as zero bytes.
+func fileSizes(paths []string) int64 {
+	var total int64
+	for _, path := range paths {
+		if stat, err := os.Stat(path); err == nil {
+			total += stat.Size()
+		}
+	}
+	return total
+}
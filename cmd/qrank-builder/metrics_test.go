@@ -0,0 +1,134 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// MetricValue returns the current value of a gauge or counter
+// in metricsRegistry, or -1 if there is no such metric.
+func metricValue(t *testing.T, name string, labelValues ...string) float64 {
+	families, err := metricsRegistry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range families {
+		if f.GetName() != name {
+			continue
+		}
+	metrics:
+		for _, m := range f.GetMetric() {
+			if len(m.GetLabel()) != len(labelValues) {
+				continue
+			}
+			for i, label := range m.GetLabel() {
+				if label.GetValue() != labelValues[i] {
+					continue metrics
+				}
+			}
+			if m.GetGauge() != nil {
+				return m.GetGauge().GetValue()
+			}
+			return m.GetCounter().GetValue()
+		}
+	}
+	return -1
+}
+
+func TestRecordRun(t *testing.T) {
+	started := time.Date(2024, 3, 1, 4, 0, 0, 0, time.UTC)
+	finished := started.Add(90 * time.Minute)
+	recordRun(started, finished, nil)
+	if got := metricValue(t, "qrank_builder_last_run_success"); got != 1 {
+		t.Errorf("got lastRunSuccess=%v, want 1", got)
+	}
+	if got := metricValue(t, "qrank_builder_last_run_duration_seconds"); got != 5400 {
+		t.Errorf("got lastRunDuration=%v, want 5400", got)
+	}
+
+	failures := max(0, metricValue(t, "qrank_builder_runs_total", "failure"))
+	recordRun(finished, finished.Add(time.Minute), errors.New("test"))
+	if got := metricValue(t, "qrank_builder_last_run_success"); got != 0 {
+		t.Errorf("got lastRunSuccess=%v, want 0", got)
+	}
+	if got := metricValue(t, "qrank_builder_last_success_timestamp_seconds"); got != float64(finished.Unix()) {
+		t.Errorf("failed run should not change lastSuccessTimestamp, got %v", got)
+	}
+	if got := metricValue(t, "qrank_builder_runs_total", "failure"); got != failures+1 {
+		t.Errorf("got %v failures, want %v", got, failures+1)
+	}
+}
+
+func TestExportMetrics(t *testing.T) {
+	var pushed string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		pushed = req.Method + " " + req.URL.Path + " " + string(body)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	textfile := filepath.Join(t.TempDir(), "qrank_builder.prom")
+	stageRows.WithLabelValues("test").Add(7)
+	if err := exportMetrics(server.URL, textfile); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(pushed, "PUT /metrics/job/qrank_builder ") {
+		t.Errorf("unexpected push: %q", pushed)
+	}
+
+	data, err := os.ReadFile(textfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `qrank_builder_rows_total{stage="test"} 7`
+	if !strings.Contains(string(data), want) {
+		t.Errorf("textfile should contain %q, got %q", want, data)
+	}
+}
+
+func TestProgressObservesStageDuration(t *testing.T) {
+	p := &buildProgress{}
+	p.start()
+	p.setStage("test_stage", 0)
+	p.finish(nil)
+	if got := metricValue(t, "qrank_builder_stage_duration_seconds", "test_stage"); got < 0 {
+		t.Error("stage duration should be observed")
+	}
+}
+
+func TestLineCounter(t *testing.T) {
+	var buf bytes.Buffer
+	c := &lineCounter{w: &buf}
+	io.WriteString(c, "a\nb\n")
+	io.WriteString(c, "c")
+	io.WriteString(c, "\n")
+	if c.lines != 3 {
+		t.Errorf("got %d lines, want 3", c.lines)
+	}
+	if buf.String() != "a\nb\nc\n" {
+		t.Errorf("got %q", buf.String())
+	}
+}
+
+func TestFileSizes(t *testing.T) {
+	dir := t.TempDir()
+	a := filepath.Join(dir, "a")
+	if err := os.WriteFile(a, []byte("12345"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got := fileSizes([]string{a, filepath.Join(dir, "missing")}); got != 5 {
+		t.Errorf("got %d, want 5", got)
+	}
+}
@@ -0,0 +1,280 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// BuildSummary describes a finished build, for notifying maintainers.
+type buildSummary struct {
+	State    string         `json:"state"` // "succeeded", "failed" or "canceled"
+	Host     string         `json:"host"`
+	Started  time.Time      `json:"started"`
+	Finished time.Time      `json:"finished"`
+	Error    string         `json:"error,omitempty"`
+	Stages   []stageSummary `json:"stages,omitempty"`
+}
+
+// StageSummary describes what a pipeline stage did during a build.
+type stageSummary struct {
+	Stage     string  `json:"stage"`
+	Seconds   float64 `json:"seconds"`
+	ReadBytes int64   `json:"readBytes,omitempty"`
+	Rows      int64   `json:"rows,omitempty"`
+}
+
+// StageCounters returns the current values of a per-stage counter
+// in metricsRegistry, such as "qrank_builder_rows_total".
+func stageCounters(name string) map[string]float64 {
+	result := make(map[string]float64)
+	families, err := metricsRegistry.Gather()
+	if err != nil {
+		return result
+	}
+	for _, f := range families {
+		if f.GetName() != name {
+			continue
+		}
+		for _, m := range f.GetMetric() {
+			for _, label := range m.GetLabel() {
+				if label.GetName() == "stage" {
+					result[label.GetValue()] = m.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+	return result
+}
+
+// SummarizeBuild describes a build that has just finished. The
+// counters of bytes read and rows written are cumulative over the
+// lifetime of the process, so the caller passes their values from
+// before the build.
+func summarizeBuild(started, finished time.Time, err error, readBefore, rowsBefore map[string]float64) buildSummary {
+	host, _ := os.Hostname()
+	s := buildSummary{Host: host, Started: started.UTC(), Finished: finished.UTC()}
+	switch {
+	case err == nil:
+		s.State = "succeeded"
+	case errors.Is(err, context.Canceled):
+		s.State = "canceled"
+	default:
+		s.State = "failed"
+		s.Error = err.Error()
+	}
+
+	read, rows := stageCounters("qrank_builder_read_bytes_total"), stageCounters("qrank_builder_rows_total")
+	for _, t := range progress.stageTimings() {
+		s.Stages = append(s.Stages, stageSummary{
+			Stage:     t.Stage,
+			Seconds:   t.Duration.Seconds(),
+			ReadBytes: int64(read[t.Stage] - readBefore[t.Stage]),
+			Rows:      int64(rows[t.Stage] - rowsBefore[t.Stage]),
+		})
+	}
+	return s
+}
+
+// Text formats a build summary for humans, such as in e-mail.
+// The first line can stand on its own, as in an IRC message.
+func (s buildSummary) text() string {
+	var b strings.Builder
+	duration := s.Finished.Sub(s.Started).Round(time.Second)
+	fmt.Fprintf(&b, "qrank-builder on %s: build %s after %s", s.Host, s.State, duration)
+	if s.Error != "" {
+		fmt.Fprintf(&b, ": %s", s.Error)
+	}
+	b.WriteString("\n")
+	for _, stage := range s.Stages {
+		fmt.Fprintf(&b, "%s: %s", stage.Stage, time.Duration(stage.Seconds*float64(time.Second)).Round(time.Second))
+		if stage.ReadBytes > 0 {
+			fmt.Fprintf(&b, ", read %s", formatBytes(stage.ReadBytes))
+		}
+		if stage.Rows > 0 {
+			fmt.Fprintf(&b, ", wrote %d rows", stage.Rows)
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// Notifier tells maintainers when a build has finished or failed,
+// so they do not have to poll the logs.
+type notifier struct {
+	webhook string   // URL for POSTing a JSON summary, or empty
+	email   []string // e-mail recipients, or empty
+	smtp    string   // address of mail server, such as "localhost:25"
+	from    string   // e-mail sender
+	irc     string   // IRC channel URL, such as "ircs://irc.libera.chat/#qrank"
+	client  *http.Client
+}
+
+func (n *notifier) enabled() bool {
+	return n.webhook != "" || len(n.email) > 0 || n.irc != ""
+}
+
+// Notify sends a build summary to all configured destinations.
+// A failure to reach one destination does not keep the others
+// from getting notified.
+func (n *notifier) notify(ctx context.Context, s buildSummary) error {
+	var errs []error
+	if n.webhook != "" {
+		if err := n.postWebhook(ctx, s); err != nil {
+			errs = append(errs, fmt.Errorf("webhook: %w", err))
+		}
+	}
+	if len(n.email) > 0 {
+		if err := n.sendEmail(s); err != nil {
+			errs = append(errs, fmt.Errorf("e-mail: %w", err))
+		}
+	}
+	if n.irc != "" {
+		if err := sendIRC(ctx, n.irc, s.text()); err != nil {
+			errs = append(errs, fmt.Errorf("irc: %w", err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// PostWebhook sends a build summary to a webhook. Besides the
+// summary, the payload contains a "text" field, which is what
+// chat systems such as Slack, Mattermost or Zulip display.
+func (n *notifier) postWebhook(ctx context.Context, s buildSummary) error {
+	payload := struct {
+		Text    string       `json:"text"`
+		Summary buildSummary `json:"summary"`
+	}{Text: s.text(), Summary: s}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.webhook, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	return nil
+}
+
+// SendEmail sends a build summary by e-mail.
+func (n *notifier) sendEmail(s buildSummary) error {
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", n.from)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(n.email, ", "))
+	fmt.Fprintf(&msg, "Subject: qrank-builder: build %s\r\n", s.State)
+	fmt.Fprintf(&msg, "Date: %s\r\n", s.Finished.Format(time.RFC1123Z))
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(s.text(), "\n", "\r\n"))
+	return smtp.SendMail(n.smtp, nil, n.from, n.email, msg.Bytes())
+}
+
+// SendIRC connects to an IRC server, joins a channel, posts a message
+// and leaves again. The channel is given as a URL, such as
+// "ircs://qrank-builder@irc.libera.chat:6697/#wikidata-qrank", where
+// the optional user name is the nickname, and the scheme "ircs" stands
+// for IRC over TLS. Only the first line of text gets posted, so as not
+// to flood the channel.
+func sendIRC(ctx context.Context, channelURL string, text string) error {
+	u, err := url.Parse(channelURL)
+	if err != nil {
+		return err
+	}
+	channel := "#" + u.Fragment
+	if u.Fragment == "" {
+		channel = "#" + strings.TrimLeft(u.Path, "/#")
+	}
+	if channel == "#" {
+		return fmt.Errorf("no channel in %q", channelURL)
+	}
+	nick := u.User.Username()
+	if nick == "" {
+		nick = "qrank-builder"
+	}
+
+	addr := u.Host
+	var conn net.Conn
+	switch u.Scheme {
+	case "irc":
+		if u.Port() == "" {
+			addr = net.JoinHostPort(u.Hostname(), "6667")
+		}
+		conn, err = (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+	case "ircs":
+		if u.Port() == "" {
+			addr = net.JoinHostPort(u.Hostname(), "6697")
+		}
+		conn, err = (&tls.Dialer{}).DialContext(ctx, "tcp", addr)
+	default:
+		return fmt.Errorf("unsupported scheme %q, must be irc or ircs", u.Scheme)
+	}
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	deadline := time.Now().Add(time.Minute)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+
+	if password, ok := u.User.Password(); ok {
+		fmt.Fprintf(conn, "PASS %s\r\n", password)
+	}
+	fmt.Fprintf(conn, "NICK %s\r\nUSER %s 0 * :qrank-builder\r\n", nick, nick)
+
+	// Wait until the server has registered us, answering pings.
+	reader := bufio.NewReader(conn)
+	for registered := false; !registered; {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) >= 1 && fields[0] == "PING":
+			fmt.Fprintf(conn, "PONG %s\r\n", strings.TrimPrefix(line, "PING "))
+		case len(fields) >= 2 && fields[1] == "001":
+			registered = true
+		case len(fields) >= 2 && (fields[1] == "433" || fields[1] == "464" || fields[0] == "ERROR"):
+			return fmt.Errorf("server refused registration: %s", line)
+		}
+	}
+
+	message, _, _ := strings.Cut(text, "\n")
+	_, err = fmt.Fprintf(conn, "JOIN %s\r\nPRIVMSG %s :%s\r\nQUIT :done\r\n", channel, channel, message)
+	if err != nil {
+		return err
+	}
+
+	// Wait for the server to close the connection, so our message
+	// does not get lost when we close the connection too early.
+	io.Copy(io.Discard, reader)
+	return nil
+}
@@ -0,0 +1,244 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testBuildSummary() buildSummary {
+	started := time.Date(2024, 3, 1, 4, 0, 0, 0, time.UTC)
+	return buildSummary{
+		State:    "succeeded",
+		Host:     "tools-worker-1",
+		Started:  started,
+		Finished: started.Add(3*time.Hour + 12*time.Minute),
+		Stages: []stageSummary{
+			{Stage: "pageviews", Seconds: 600, ReadBytes: 3 << 30, Rows: 1234},
+			{Stage: "titles", Seconds: 42},
+		},
+	}
+}
+
+func TestSummarizeBuild(t *testing.T) {
+	defer func(p *buildProgress) { progress = p }(progress)
+	progress = &buildProgress{status: BuildStatus{State: "idle"}}
+	progress.start()
+	progress.setStage("titles", 1)
+	readBefore := stageCounters("qrank_builder_read_bytes_total")
+	rowsBefore := stageCounters("qrank_builder_rows_total")
+	stageReadBytes.WithLabelValues("titles").Add(100)
+	stageRows.WithLabelValues("titles").Add(7)
+
+	started := time.Now()
+	s := summarizeBuild(started, started.Add(time.Minute), nil, readBefore, rowsBefore)
+	if s.State != "succeeded" || s.Error != "" {
+		t.Errorf("got state %q, error %q; want succeeded", s.State, s.Error)
+	}
+	if len(s.Stages) != 1 || s.Stages[0].Stage != "titles" || s.Stages[0].ReadBytes != 100 || s.Stages[0].Rows != 7 {
+		t.Errorf("got stages %+v, want titles with 100 bytes read and 7 rows", s.Stages)
+	}
+
+	s = summarizeBuild(started, started, errors.New("disk full"), readBefore, rowsBefore)
+	if s.State != "failed" || s.Error != "disk full" {
+		t.Errorf("got state %q, error %q; want failed with disk full", s.State, s.Error)
+	}
+
+	s = summarizeBuild(started, started, fmt.Errorf("reading: %w", context.Canceled), readBefore, rowsBefore)
+	if s.State != "canceled" {
+		t.Errorf("got state %q, want canceled", s.State)
+	}
+}
+
+func TestBuildSummary_Text(t *testing.T) {
+	got := testBuildSummary().text()
+	want := "qrank-builder on tools-worker-1: build succeeded after 3h12m0s\n" +
+		"pageviews: 10m0s, read 3.0 GiB, wrote 1234 rows\n" +
+		"titles: 42s\n"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestNotifier_Webhook(t *testing.T) {
+	var got struct {
+		Text    string       `json:"text"`
+		Summary buildSummary `json:"summary"`
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			t.Errorf("got method %s, want POST", r.Method)
+		}
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer server.Close()
+
+	n := &notifier{webhook: server.URL, client: server.Client()}
+	s := testBuildSummary()
+	if err := n.notify(context.Background(), s); err != nil {
+		t.Fatal(err)
+	}
+	if got.Text != s.text() {
+		t.Errorf("got text %q, want %q", got.Text, s.text())
+	}
+	if got.Summary.State != "succeeded" || len(got.Summary.Stages) != 2 {
+		t.Errorf("got summary %+v", got.Summary)
+	}
+}
+
+func TestNotifier_WebhookFailure(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "gone", http.StatusGone)
+	}))
+	defer server.Close()
+
+	n := &notifier{webhook: server.URL, client: server.Client()}
+	err := n.notify(context.Background(), testBuildSummary())
+	if err == nil || !strings.Contains(err.Error(), "410") {
+		t.Errorf("got %v, want error with status 410", err)
+	}
+}
+
+// FakeSMTPServer accepts one e-mail and sends its data to a channel.
+func fakeSMTPServer(t *testing.T) (string, <-chan string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	mails := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		fmt.Fprintf(conn, "220 localhost ESMTP\r\n")
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			switch cmd := strings.ToUpper(strings.TrimSpace(line)); {
+			case strings.HasPrefix(cmd, "DATA"):
+				fmt.Fprintf(conn, "354 go ahead\r\n")
+				var data strings.Builder
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil || line == ".\r\n" {
+						break
+					}
+					data.WriteString(line)
+				}
+				mails <- data.String()
+				fmt.Fprintf(conn, "250 queued\r\n")
+			case strings.HasPrefix(cmd, "QUIT"):
+				fmt.Fprintf(conn, "221 bye\r\n")
+				return
+			default:
+				fmt.Fprintf(conn, "250 ok\r\n")
+			}
+		}
+	}()
+	return listener.Addr().String(), mails
+}
+
+func TestNotifier_Email(t *testing.T) {
+	addr, mails := fakeSMTPServer(t)
+	n := &notifier{
+		email: []string{"maintainer@example.org"},
+		smtp:  addr,
+		from:  "qrank-builder@example.org",
+	}
+	s := testBuildSummary()
+	s.State, s.Error = "failed", "disk full"
+	if err := n.notify(context.Background(), s); err != nil {
+		t.Fatal(err)
+	}
+	mail := <-mails
+	for _, want := range []string{
+		"To: maintainer@example.org\r\n",
+		"Subject: qrank-builder: build failed\r\n",
+		"build failed after 3h12m0s: disk full\r\n",
+	} {
+		if !strings.Contains(mail, want) {
+			t.Errorf("mail does not contain %q; got %q", want, mail)
+		}
+	}
+}
+
+// FakeIRCServer accepts one client and sends the lines it receives
+// after registration to a channel.
+func fakeIRCServer(t *testing.T) (string, <-chan []string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	result := make(chan []string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		var lines []string
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				break
+			}
+			line = strings.TrimRight(line, "\r\n")
+			switch {
+			case strings.HasPrefix(line, "USER "):
+				fmt.Fprintf(conn, "PING :irc.example.org\r\n")
+			case strings.HasPrefix(line, "PONG "):
+				fmt.Fprintf(conn, ":irc.example.org 001 bot :Welcome\r\n")
+			case strings.HasPrefix(line, "NICK "):
+			default:
+				lines = append(lines, line)
+			}
+			if strings.HasPrefix(line, "QUIT") {
+				break
+			}
+		}
+		result <- lines
+	}()
+	return listener.Addr().String(), result
+}
+
+func TestSendIRC(t *testing.T) {
+	addr, result := fakeIRCServer(t)
+	text := "build succeeded\nmore details"
+	if err := sendIRC(context.Background(), "irc://bot@"+addr+"/#qrank", text); err != nil {
+		t.Fatal(err)
+	}
+	got := strings.Join(<-result, "|")
+	want := "JOIN #qrank|PRIVMSG #qrank :build succeeded|QUIT :done"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestSendIRC_BadURL(t *testing.T) {
+	for _, u := range []string{"http://irc.example.org/#qrank", "irc://irc.example.org/"} {
+		if err := sendIRC(context.Background(), u, "hello"); err == nil {
+			t.Errorf("sendIRC(%q) should fail", u)
+		}
+	}
+}
@@ -12,7 +12,6 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
-	"runtime"
 	"slices"
 	"strconv"
 	"strings"
@@ -100,7 +99,7 @@ func ReadPageItems(ctx context.Context, path string, out chan<- PageItem) error
 	return nil
 }
 
-func buildPageItems(ctx context.Context, site *WikiSite, dumps string) (string, error) {
+func buildPageItems(ctx context.Context, site *WikiSite, cfg *buildConfig) (string, error) {
 	file, err := os.CreateTemp("", "pageitems-*.zst")
 	if err != nil {
 		return "", err
@@ -112,27 +111,24 @@ func buildPageItems(ctx context.Context, site *WikiSite, dumps string) (string,
 	// exceptions.  For example, the file dewiki-20240601-page_props.sql.gz
 	// contains entries in non-sorted order.  Therefore, we need to re-sort
 	// the page_items ourselves.
-	items := make(chan extsort.SortType, 10000)
-	config := extsort.DefaultConfig()
-	config.ChunkSize = 8 * 1024 * 1024
-	config.NumWorkers = runtime.NumCPU()
+	items := make(chan extsort.SortType, cfg.Sort.buffer(10000))
+	config := cfg.Sort.newConfig(8*1024*1024, 8) // 64 MiB, 8 Bytes/record avg
 	sorter, sortedChan, errChan := extsort.New(items, PageItemFromBytes, PageItemLess, config)
 
 	group, groupCtx := errgroup.WithContext(ctx)
 	group.Go(func() error {
 		defer close(items)
-		if err := readPageItemsFromPageProps(groupCtx, site, dumps, items); err != nil {
+		if err := readPageItemsFromPageProps(groupCtx, site, cfg.Dumps, items); err != nil {
 			return err
 		}
-		if err := readPageItemsFromPage(groupCtx, site, dumps, items); err != nil {
+		if err := readPageItemsFromPage(groupCtx, site, cfg.Dumps, items); err != nil {
 			return err
 		}
 		return nil
 	})
 	group.Go(func() error {
 		sorter.Sort(groupCtx)
-		zstdLevel := zstd.WithEncoderLevel(zstd.SpeedFastest)
-		compressor, err := zstd.NewWriter(file, zstdLevel)
+		compressor, err := newCacheWriter(file, cfg.cacheLevel(zstd.SpeedFastest), nil)
 		if err != nil {
 			return err
 		}
@@ -157,6 +153,11 @@ func buildPageItems(ctx context.Context, site *WikiSite, dumps string) (string,
 		return "", err
 	}
 	if err := <-errChan; err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(file.Name())
 		return "", err
 	}
 
@@ -49,7 +49,7 @@ func TestBuildPageItems(t *testing.T) {
 	rmwiki := &WikiSite{Key: "rmwiki", Domain: "rm.wikipedia.org", LastDumped: dumped}
 	dumps := filepath.Join("testdata", "dumps")
 
-	path, err := buildPageItems(ctx, rmwiki, dumps)
+	path, err := buildPageItems(ctx, rmwiki, newBuildConfig(dumps))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -67,7 +67,7 @@ func TestBuildPageItemsForWikidata(t *testing.T) {
 	site := &WikiSite{Key: "wikidatawiki", Domain: "www.wikidata.org", LastDumped: dumped}
 	dumps := filepath.Join("testdata", "dumps")
 
-	path, err := buildPageItems(ctx, site, dumps)
+	path, err := buildPageItems(ctx, site, newBuildConfig(dumps))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -12,7 +12,6 @@ import (
 	"io"
 	"os"
 	"path/filepath"
-	"runtime"
 	"slices"
 	"strconv"
 	"strings"
@@ -26,7 +25,7 @@ import (
 // BuildLinks builds the `links` file for a WikiSite and puts it in S3 storage.
 // This includes any links between items of the same wiki. Interwiki links
 // are handled elsewhere, see BuildInterwikiLinks().
-func buildLinks(site *WikiSite, ctx context.Context, dumps string, s3 S3) error {
+func buildLinks(site *WikiSite, ctx context.Context, cfg *buildConfig, s3 S3) error {
 	destPath := site.S3Path("links")
 	logger.Printf("building %s", destPath)
 
@@ -36,19 +35,17 @@ func buildLinks(site *WikiSite, ctx context.Context, dumps string, s3 S3) error
 	}
 	defer os.Remove(unsorted.Name())
 
-	linesChan := make(chan string, 10000)
-	config := extsort.DefaultConfig()
-	config.ChunkSize = 8 * 1024 * 1024 / 64 // 8 MiB, 64 Bytes/line avg
-	config.NumWorkers = runtime.NumCPU()
+	linesChan := make(chan string, cfg.Sort.buffer(10000))
+	config := cfg.Sort.newConfig(8*1024*1024/64, 64) // 8 MiB, 64 Bytes/line avg
 	sorter, outChan, errChan := extsort.Strings(linesChan, config)
 
 	group, groupCtx := errgroup.WithContext(ctx)
 	group.Go(func() error {
 		defer close(linesChan)
-		if err := ReadPageItemsOld(groupCtx, site, "A", s3, linesChan); err != nil {
+		if err := ReadPageItemsOld(groupCtx, site, "A", cfg.Bucket, s3, linesChan); err != nil {
 			return err
 		}
-		if err := readPageLinks(groupCtx, site, "B", dumps, linesChan); err != nil {
+		if err := readPageLinks(groupCtx, site, "B", cfg, linesChan); err != nil {
 			return err
 		}
 		return nil
@@ -79,29 +76,29 @@ func buildLinks(site *WikiSite, ctx context.Context, dumps string, s3 S3) error
 		return err
 	}
 
-	sorted, err := SortLines(ctx, unsorted.Name())
+	sorted, err := SortLines(ctx, unsorted.Name(), cfg.Sort)
 	if err != nil {
 		return err
 	}
 	defer os.Remove(sorted)
 
-	links, err := joinPagelinksByTitle(ctx, site, sorted, s3)
+	links, err := joinPagelinksByTitle(ctx, site, sorted, cfg, s3)
 	if err != nil {
 		return err
 	}
 	defer os.Remove(links)
 
-	if err := PutInStorage(ctx, links, s3, "qrank", destPath, "application/zstd"); err != nil {
+	if err := PutInStorage(ctx, links, s3, cfg.Bucket, destPath, "application/zstd"); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-func readPageLinks(ctx context.Context, site *WikiSite, property string, dumps string, out chan<- string) error {
+func readPageLinks(ctx context.Context, site *WikiSite, property string, cfg *buildConfig, out chan<- string) error {
 	ymd := site.LastDumped.Format("20060102")
 	pageLinksFileName := fmt.Sprintf("%s-%s-pagelinks.sql.gz", site.Key, ymd)
-	pageLinksPath := filepath.Join(dumps, site.Key, ymd, pageLinksFileName)
+	pageLinksPath := filepath.Join(cfg.Dumps, site.Key, ymd, pageLinksFileName)
 	pageLinksFile, err := os.Open(pageLinksPath)
 	if err != nil {
 		return err
@@ -125,7 +122,7 @@ func readPageLinks(ctx context.Context, site *WikiSite, property string, dumps s
 	titleCol := slices.Index(columns, "pl_title")
 
 	if namespaceCol < 0 || titleCol < 0 {
-		return joinLinkTargets(ctx, site, property, dumps, out)
+		return joinLinkTargets(ctx, site, property, cfg, out)
 	}
 
 	for {
@@ -207,7 +204,7 @@ func (j *pagelinksJoiner) Close() error {
 	return j.writer.Close()
 }
 
-func joinPagelinksByTitle(ctx context.Context, site *WikiSite, pagelinks string, s3 S3) (string, error) {
+func joinPagelinksByTitle(ctx context.Context, site *WikiSite, pagelinks string, cfg *buildConfig, s3 S3) (string, error) {
 	scanners := make([]LineScanner, 0, 3)
 	scannerNames := make([]string, 0, 3)
 	pagelinksFile, err := os.Open(pagelinks)
@@ -223,9 +220,9 @@ func joinPagelinksByTitle(ctx context.Context, site *WikiSite, pagelinks string,
 	scannerNames = append(scannerNames, "pagelinks")
 	for _, filename := range []string{"titles", "redirects"} {
 		s3Path := site.S3Path(filename)
-		reader, err := NewS3Reader(ctx, "qrank", s3Path, s3)
+		reader, err := NewS3Reader(ctx, cfg.Bucket, s3Path, s3)
 		if err != nil {
-			logger.Printf("cannot read %s, err=%v", s3Path, err)
+			logger.Printf("error: cannot read %s, err=%v", s3Path, err)
 			return "", err
 		}
 		decompressor, err := zstd.NewReader(reader)
@@ -242,18 +239,16 @@ func joinPagelinksByTitle(ctx context.Context, site *WikiSite, pagelinks string,
 	}
 	defer dest.Close()
 
-	zstdLevel := zstd.WithEncoderLevel(zstd.SpeedBestCompression)
-	compressor, err := zstd.NewWriter(dest, zstdLevel)
+	compressor, err := newCacheWriter(dest, cfg.cacheLevel(zstd.SpeedBestCompression), nil)
 	if err != nil {
 		return "", err
 	}
 	defer compressor.Close()
 	writer := NewLinkWriter(compressor)
 
-	ch := make(chan extsort.SortType, 50000)
+	ch := make(chan extsort.SortType, cfg.Sort.buffer(50000))
 	group, groupCtx := errgroup.WithContext(ctx)
-	config := extsort.DefaultConfig()
-	config.NumWorkers = runtime.NumCPU()
+	config := cfg.Sort.newConfig(0, 16)
 	sorter, outChan, errChan := extsort.New(ch, LinkFromBytes, LinkLess, config)
 	group.Go(func() error {
 		defer close(ch)
@@ -306,6 +301,10 @@ func joinPagelinksByTitle(ctx context.Context, site *WikiSite, pagelinks string,
 		os.Remove(dest.Name())
 		return "", err
 	}
+	if err := dest.Close(); err != nil {
+		os.Remove(dest.Name())
+		return "", err
+	}
 
 	return dest.Name(), nil
 }
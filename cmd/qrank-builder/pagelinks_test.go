@@ -22,8 +22,8 @@ func TestBuildLinksFromTitle(t *testing.T) {
 	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
 	ctx := context.Background()
 	client := &http.Client{Transport: &FakeWikiSite{}}
-	dumps := filepath.Join("testdata", "dumps")
-	sites, err := ReadWikiSites(client, dumps)
+	cfg := newBuildConfig(filepath.Join("testdata", "dumps"))
+	sites, err := ReadWikiSites(client, cfg)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -56,7 +56,7 @@ func TestBuildLinksFromTitle(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	if err := buildLinks(site, ctx, dumps, s3); err != nil {
+	if err := buildLinks(site, ctx, cfg, s3); err != nil {
 		t.Fatal(err)
 	}
 
@@ -87,8 +87,8 @@ func TestBuildLinksFromLinkTarget(t *testing.T) {
 	ctx := context.Background()
 	client := &http.Client{Transport: &FakeWikiSite{}}
 
-	dumps := filepath.Join("testdata", "dumps")
-	sites, err := ReadWikiSites(client, dumps)
+	cfg := newBuildConfig(filepath.Join("testdata", "dumps"))
+	sites, err := ReadWikiSites(client, cfg)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -120,7 +120,7 @@ func TestBuildLinksFromLinkTarget(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	if err := buildLinks(site, ctx, dumps, s3); err != nil {
+	if err := buildLinks(site, ctx, cfg, s3); err != nil {
 		t.Fatal(err)
 	}
 
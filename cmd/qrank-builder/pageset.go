@@ -0,0 +1,72 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"strconv"
+	"sync/atomic"
+)
+
+// PageSet is a compact set of pages, keyed by wiki and page ID, such as
+// the pages that are linked to a Wikidata item. MediaWiki assigns page
+// IDs sequentially, so we keep one bitmap per wiki; for English Wikipedia
+// with about 80 million page IDs, the bitmap takes 10 MiB. Unlike a Bloom
+// filter, the set is exact, so filtering with it never changes results.
+//
+// After construction, the set is safe for concurrent use by multiple
+// goroutines, as long as nobody adds to it.
+type pageSet struct {
+	wikis map[string]*entitySet
+	size  int64
+
+	// Skipped counts the pageview lines that were dropped because
+	// their page is not in the set, for logging.
+	skipped atomic.Int64
+}
+
+func newPageSet() *pageSet {
+	return &pageSet{wikis: make(map[string]*entitySet, 1000)}
+}
+
+func (s *pageSet) add(wiki string, page int64) {
+	set, ok := s.wikis[wiki]
+	if !ok {
+		set = &entitySet{}
+		s.wikis[wiki] = set
+	}
+	if set.add(page) {
+		s.size += 1
+	}
+}
+
+func (s *pageSet) contains(wiki string, page int64) bool {
+	set, ok := s.wikis[wiki]
+	return ok && set.has(page)
+}
+
+// ItemPages returns the set of pages that are linked to a Wikidata item,
+// taken from the page_signals files of all sites.
+func itemPages(sites *WikiSites, bucket string, s3 S3) (*pageSet, error) {
+	set := newPageSet()
+	scanner := NewPageSignalsScanner(sites, bucket, s3)
+	for scanner.Scan() {
+		// "en.wikipedia,1234,Q72,5585,..."
+		line := scanner.Bytes()
+		wiki, rest, _ := bytes.Cut(line, []byte{','})
+		page, rest, _ := bytes.Cut(rest, []byte{','})
+		if len(rest) == 0 || rest[0] != 'Q' {
+			continue
+		}
+		id, err := strconv.ParseInt(string(page), 10, 64)
+		if err != nil || id <= 0 {
+			continue
+		}
+		set.add(string(wiki), id)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return set, nil
+}
@@ -0,0 +1,96 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestPageSet(t *testing.T) {
+	s := newPageSet()
+	s.add("rm.wikipedia", 3824)
+	s.add("rm.wikipedia", 3824)
+	s.add("rm.wikipedia", 1)
+	s.add("en.wikipedia", 63989872)
+	if s.size != 3 {
+		t.Errorf("got size %d, want 3", s.size)
+	}
+	for _, tc := range []struct {
+		wiki string
+		page int64
+		want bool
+	}{
+		{"rm.wikipedia", 3824, true},
+		{"rm.wikipedia", 1, true},
+		{"rm.wikipedia", 2, false},
+		{"rm.wikipedia", 10117, false},
+		{"rm.wikipedia", -1, false},
+		{"en.wikipedia", 63989872, true},
+		{"en.wikipedia", 3824, false},
+		{"de.wikipedia", 3824, false},
+	} {
+		if got := s.contains(tc.wiki, tc.page); got != tc.want {
+			t.Errorf("contains(%q, %d): got %v, want %v", tc.wiki, tc.page, got, tc.want)
+		}
+	}
+}
+
+func TestItemPages(t *testing.T) {
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	s3 := NewFakeS3()
+	s3.WriteLines([]string{"1,Q5296,2500", "3824,Q662541,4973", "799,,3142"}, "page_signals/rmwiki-20111209-page_signals.zst")
+	s3.WriteLines([]string{"200,Q72,,550,85,186"}, "page_signals/wikidatawiki-20110403-page_signals.zst")
+	rmDumped, _ := time.Parse(time.DateOnly, "2011-12-09")
+	wdDumped, _ := time.Parse(time.DateOnly, "2011-04-03")
+	sites := &WikiSites{Sites: map[string]*WikiSite{
+		"rmwiki":       {Key: "rmwiki", Domain: "rm.wikipedia.org", LastDumped: rmDumped},
+		"wikidatawiki": {Key: "wikidatawiki", Domain: "www.wikidata.org", LastDumped: wdDumped},
+	}}
+
+	got, err := itemPages(sites, "qrank", s3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.size != 3 {
+		t.Errorf("got size %d, want 3", got.size)
+	}
+	if !got.contains("rm.wikipedia", 3824) || !got.contains("www.wikidata", 200) {
+		t.Error("pages with items should be in the set")
+	}
+	if got.contains("rm.wikipedia", 799) {
+		t.Error("page without item should not be in the set")
+	}
+}
+
+func TestPageviewsStream_Filter(t *testing.T) {
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	dumps := filepath.Join("testdata", "dumps")
+	filter := newPageSet()
+	filter.add("rm.wikipedia", 3824)
+	filter.add("en.wikipedia", 63989872)
+	stream, err := newPageviewsStream(context.Background(), newBuildConfig(dumps), []string{"pageviews/pageviews-2023-W12.zst"}, filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	var got []string
+	for stream.Scan() {
+		got = append(got, stream.Text())
+	}
+	if err := stream.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || !slices.IsSorted(got) {
+		t.Errorf("got %q, want lines for the two pages in the filter", got)
+	}
+	if filter.skipped.Load() == 0 {
+		t.Error("expected some pageview lines to be skipped")
+	}
+}
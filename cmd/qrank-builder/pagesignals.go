@@ -13,7 +13,6 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
-	"runtime"
 	"slices"
 	"sort"
 	"strconv"
@@ -26,7 +25,7 @@ import (
 )
 
 // BuildPageSignals builds the page_signals file for a WikiSite and puts it in S3 storage.
-func buildPageSignals(site *WikiSite, ctx context.Context, dumps string, s3 S3) error {
+func buildPageSignals(site *WikiSite, ctx context.Context, cfg *buildConfig, s3 S3) error {
 	destPath := site.S3Path("page_signals")
 	logger.Printf("building %s", destPath)
 
@@ -34,25 +33,22 @@ func buildPageSignals(site *WikiSite, ctx context.Context, dumps string, s3 S3)
 	if err != nil {
 		return err
 	}
-	zstdLevel := zstd.WithEncoderLevel(zstd.SpeedBestCompression)
-	writer, err := zstd.NewWriter(outFile, zstdLevel)
+	writer, err := newCacheWriter(outFile, cfg.cacheLevel(zstd.SpeedBestCompression), nil)
 	if err != nil {
 		return err
 	}
 
-	linesChan := make(chan string, 10000)
-	config := extsort.DefaultConfig()
-	config.ChunkSize = 8 * 1024 * 1024 / 64 // 8 MiB, 64 Bytes/line avg
-	config.NumWorkers = runtime.NumCPU()
+	linesChan := make(chan string, cfg.Sort.buffer(10000))
+	config := cfg.Sort.newConfig(8*1024*1024/64, 64) // 8 MiB, 64 Bytes/line avg
 	sorter, outChan, errChan := extsort.Strings(linesChan, config)
 
 	group, groupCtx := errgroup.WithContext(ctx)
 	group.Go(func() error {
 		defer close(linesChan)
-		if err := processPagePropsTable(groupCtx, dumps, site, linesChan); err != nil {
+		if err := processPagePropsTable(groupCtx, cfg.Dumps, site, linesChan); err != nil {
 			return err
 		}
-		if err := processPageTable(groupCtx, dumps, site, linesChan); err != nil {
+		if err := processPageTable(groupCtx, cfg.Dumps, site, linesChan); err != nil {
 			return err
 		}
 		return nil
@@ -72,24 +68,29 @@ func buildPageSignals(site *WikiSite, ctx context.Context, dumps string, s3 S3)
 				}
 				err := merger.Process(line)
 				if err != nil {
-					logger.Printf(`BuildSitePageSignals(): merger.Process("%s") failed, err=%v`, line, err)
+					logger.Printf(`error: BuildSitePageSignals(): merger.Process("%s") failed, err=%v`, line, err)
 					return err
 				}
 			}
 		}
 	})
 	if err := group.Wait(); err != nil {
-		logger.Printf(`BuildSitePageSignals(): group.Wait() failed, err=%v`, err)
+		logger.Printf(`error: BuildSitePageSignals(): group.Wait() failed, err=%v`, err)
+		outFile.Close()
+		os.Remove(outFile.Name())
 		return err
 	}
 	if err := <-errChan; err != nil {
+		outFile.Close()
+		os.Remove(outFile.Name())
 		return err
 	}
 	if err := outFile.Close(); err != nil {
+		os.Remove(outFile.Name())
 		return err
 	}
 
-	if err := PutInStorage(ctx, outFile.Name(), s3, "qrank", destPath, "application/zstd"); err != nil {
+	if err := PutInStorage(ctx, outFile.Name(), s3, cfg.Bucket, destPath, "application/zstd"); err != nil {
 		return err
 	}
 
@@ -236,6 +237,7 @@ type pageSignalsScanner struct {
 	domains      []string
 	curDomain    int
 	storage      S3
+	bucket       string
 	reader       io.ReadCloser
 	decompressor *zstd.Decoder
 	scanner      *bufio.Scanner
@@ -245,7 +247,7 @@ type pageSignalsScanner struct {
 // NewPageSignalsScanner returns an object similar to bufio.Scanner
 // that sequentially scans pageid-to-qid mapping files for all WikiSites.
 // Lines are returned in the exact same order and format as pageviews files.
-func NewPageSignalsScanner(sites *WikiSites, s3 S3) *pageSignalsScanner {
+func NewPageSignalsScanner(sites *WikiSites, bucket string, s3 S3) *pageSignalsScanner {
 	sorted := make([]*WikiSite, 0, len(sites.Sites))
 	for _, site := range sites.Sites {
 		sorted = append(sorted, site)
@@ -270,6 +272,7 @@ func NewPageSignalsScanner(sites *WikiSites, s3 S3) *pageSignalsScanner {
 		domains:      domains,
 		curDomain:    -1,
 		storage:      s3,
+		bucket:       bucket,
 		reader:       nil,
 		decompressor: nil,
 		scanner:      nil,
@@ -279,7 +282,7 @@ func NewPageSignalsScanner(sites *WikiSites, s3 S3) *pageSignalsScanner {
 func (s *pageSignalsScanner) Scan() bool {
 	s.curLine.Truncate(0)
 	if s.err != nil {
-		logger.Printf("PageSignalsScanner.Scan(): early exit due to err=%v", s.err)
+		logger.Printf("error: PageSignalsScanner.Scan(): early exit due to err=%v", s.err)
 		return false
 	}
 	for s.curDomain < len(s.domains) {
@@ -292,7 +295,7 @@ func (s *pageSignalsScanner) Scan() bool {
 			}
 			s.err = s.scanner.Err()
 			if s.err != nil {
-				logger.Printf("PageSignalsScanner.Scan(): failed, domain=%s, err=%v", s.domains[s.curDomain], s.err)
+				logger.Printf("error: PageSignalsScanner.Scan(): failed, domain=%s, err=%v", s.domains[s.curDomain], s.err)
 				break
 			}
 		}
@@ -303,22 +306,22 @@ func (s *pageSignalsScanner) Scan() bool {
 		}
 
 		path := s.paths[s.curDomain]
-		s.reader, s.err = NewS3Reader(context.Background(), "qrank", path, s.storage)
+		s.reader, s.err = NewS3Reader(context.Background(), s.bucket, path, s.storage)
 		if s.err != nil {
-			logger.Printf(`PageSignalsScanner.Scan(): cannot open s3://qrank/%s, err=%v`, path, s.err)
+			logger.Printf(`error: PageSignalsScanner.Scan(): cannot open s3://%s/%s, err=%v`, s.bucket, path, s.err)
 			break
 		}
 
 		if s.decompressor == nil {
 			s.decompressor, s.err = zstd.NewReader(nil)
 			if s.err != nil {
-				logger.Printf(`failed to create zstd decompressor, err=%v`, s.err)
+				logger.Printf(`error: failed to create zstd decompressor, err=%v`, s.err)
 				break
 			}
 		}
 		s.err = s.decompressor.Reset(s.reader)
 		if s.err != nil {
-			logger.Printf(`failed to reset zstd decompressor, err=%v`, s.err)
+			logger.Printf(`error: failed to reset zstd decompressor, err=%v`, s.err)
 			break
 		}
 		s.scanner = bufio.NewScanner(s.decompressor)
@@ -473,10 +476,10 @@ func (m *pageSignalMerger) write() error {
 // ReadPageItemsOld reads our page_signals file and emits lines of the form
 // `<PageID>,<property>,<WikidataItemID>` to an output channel.
 // TODO: Remove this method after refactoring clients to call ReadPageItems().
-func ReadPageItemsOld(ctx context.Context, site *WikiSite, property string, s3 S3, out chan<- string) error {
+func ReadPageItemsOld(ctx context.Context, site *WikiSite, property string, bucket string, s3 S3, out chan<- string) error {
 	ymd := site.LastDumped.Format("20060102")
 	path := fmt.Sprintf("page_signals/%s-%s-page_signals.zst", site.Key, ymd)
-	reader, err := NewS3Reader(ctx, "qrank", path, s3)
+	reader, err := NewS3Reader(ctx, bucket, path, s3)
 	if err != nil {
 		return err
 	}
@@ -24,13 +24,13 @@ func TestBuildPageSignals(t *testing.T) {
 	ctx := context.Background()
 	dumps := filepath.Join("testdata", "dumps")
 	s3 := NewFakeS3()
-	sites, err := ReadWikiSites(nil, dumps)
+	sites, err := ReadWikiSites(nil, newBuildConfig(dumps))
 	if err != nil {
 		t.Fatal(err)
 	}
 	for _, siteKey := range []string{"rmwiki", "wikidatawiki"} {
 		site := sites.Sites[siteKey]
-		if err := buildPageSignals(site, ctx, dumps, s3); err != nil {
+		if err := buildPageSignals(site, ctx, newBuildConfig(dumps), s3); err != nil {
 			t.Fatal(err)
 		}
 	}
@@ -86,7 +86,7 @@ func TestPageSignalsScanner(t *testing.T) {
 	}
 
 	got := make([]string, 0, 10)
-	scanner := NewPageSignalsScanner(sites, s3)
+	scanner := NewPageSignalsScanner(sites, "qrank", s3)
 	for scanner.Scan() {
 		got = append(got, scanner.Text())
 	}
@@ -7,13 +7,13 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"encoding/binary"
 	"fmt"
 	"io"
 	"net/url"
 	"os"
 	"path/filepath"
 	"regexp"
-	"runtime"
 	"slices"
 	"sort"
 	"strconv"
@@ -23,16 +23,19 @@ import (
 
 	"golang.org/x/sync/errgroup"
 
-	"github.com/andybalholm/brotli"
-	"github.com/dsnet/compress/bzip2"
 	"github.com/klauspost/compress/zstd"
 	"github.com/lanrat/extsort"
 	"github.com/minio/minio-go/v7"
 )
 
 // LastestPageviewsDump returns the date of the most recent pageviews dump.
-func LatestPageviewsDump(dumps string) (time.Time, error) {
-	dir := filepath.Join(dumps, "other", "pageview_complete")
+// If cfg.AsOf is set, the result is the most recent dump on or before
+// that date.
+func LatestPageviewsDump(cfg *buildConfig) (time.Time, error) {
+	if !cfg.AsOf.IsZero() {
+		return pageviewsDumpAsOf(cfg.Dumps, cfg.AsOf)
+	}
+	dir := filepath.Join(cfg.Dumps, "other", "pageview_complete")
 	re := regexp.MustCompile(`^pageviews-(\d{8})-user\.bz2$`)
 	path, err := LatestDump(dir, re)
 	if err != nil {
@@ -46,6 +49,19 @@ func LatestPageviewsDump(dumps string) (time.Time, error) {
 	return t, nil
 }
 
+// PageviewsDumpAsOf returns the date of the most recent pageviews dump
+// on or before a date. Since pageviews get dumped daily, we look back
+// for at most a month.
+func pageviewsDumpAsOf(dumps string, date time.Time) (time.Time, error) {
+	for i := 0; i < 31; i++ {
+		day := date.AddDate(0, 0, -i)
+		if _, err := os.Stat(PageviewsPath(dumps, day)); err == nil {
+			return day, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("no pageviews dump in the month up to %s", date.Format(time.DateOnly))
+}
+
 // PageviewsPath returns the path to the pageviews file for the given day.
 func PageviewsPath(dumps string, day time.Time) string {
 	y, m, d := day.Year(), day.Month(), day.Day()
@@ -58,8 +74,10 @@ func PageviewsPath(dumps string, day time.Time) string {
 		fmt.Sprintf("pageviews-%04d%02d%02d-user.bz2", y, m, d))
 }
 
-func processPageviews(testRun bool, dumpsPath string, date time.Time, outDir string, ctx context.Context) ([]string, error) {
-	latest, err := LatestPageviewsDump(dumpsPath)
+// ProcessPageviews builds monthly pageview files for the twelve months
+// before date.
+func processPageviews(testRun bool, cfg *buildConfig, date time.Time, outDir string, ctx context.Context) ([]string, error) {
+	latest, err := LatestPageviewsDump(cfg)
 	if err != nil {
 		return nil, err
 	}
@@ -68,7 +86,7 @@ func processPageviews(testRun bool, dumpsPath string, date time.Time, outDir str
 	paths := make([]string, 0, 12)
 	for i := 1; i <= 12; i++ {
 		m := date.AddDate(0, -i, 0)
-		path, err := buildMonthlyPageviews(testRun, dumpsPath, m.Year(), m.Month(), outDir, ctx)
+		path, err := buildMonthlyPageviews(testRun, cfg, m.Year(), m.Month(), outDir, ctx)
 		if err != nil {
 			return nil, err
 		}
@@ -80,10 +98,14 @@ func processPageviews(testRun bool, dumpsPath string, date time.Time, outDir str
 	return paths, nil
 }
 
-func buildMonthlyPageviews(testRun bool, dumpsPath string, year int, month time.Month, outDir string, ctx context.Context) (string, error) {
-	outPath := filepath.Join(
+func monthlyPageviewsPath(outDir string, year int, month time.Month) string {
+	return filepath.Join(
 		outDir,
-		fmt.Sprintf("pageviews-%04d%02d.br", year, month))
+		fmt.Sprintf("pageviews-%04d%02d.zst", year, month))
+}
+
+func buildMonthlyPageviews(testRun bool, cfg *buildConfig, year int, month time.Month, outDir string, ctx context.Context) (string, error) {
+	outPath := monthlyPageviewsPath(outDir, year, month)
 	_, err := os.Stat(outPath)
 	if err == nil {
 		return outPath, nil // use pre-existing file
@@ -106,21 +128,19 @@ func buildMonthlyPageviews(testRun bool, dumpsPath string, year int, month time.
 	}
 	defer tmpFile.Close()
 
-	writer := brotli.NewWriterLevel(tmpFile, 9)
+	writer, err := newCacheWriter(tmpFile, cfg.cacheLevel(zstd.SpeedBetterCompression), cfg.CacheDictionary)
 	if err != nil {
 		return "", err
 	}
 	defer writer.Close()
 
-	ch := make(chan string, 10000)
-	config := extsort.DefaultConfig()
-	config.ChunkSize = 8 * 1024 * 1024 / 64 // 8 MiB, 64 Bytes/line avg
-	config.NumWorkers = runtime.NumCPU()
+	ch := make(chan string, cfg.Sort.buffer(10000))
+	config := cfg.Sort.newConfig(8*1024*1024/64, 64) // 8 MiB, 64 Bytes/line avg
 	sorter, outChan, errChan := extsort.Strings(ch, config)
 
 	g, subCtx := errgroup.WithContext(ctx)
 	g.Go(func() error {
-		return readMonthlyPageviews(testRun, dumpsPath, year, month, ch, subCtx)
+		return readMonthlyPageviews(testRun, cfg, year, month, ch, subCtx)
 	})
 	g.Go(func() error {
 		sorter.Sort(subCtx)
@@ -140,13 +160,7 @@ func buildMonthlyPageviews(testRun bool, dumpsPath string, year int, month time.
 		return "", err
 	}
 
-	if err := tmpFile.Sync(); err != nil {
-	}
-
-	if err := tmpFile.Close(); err != nil {
-	}
-
-	if err := os.Rename(tmpPath, outPath); err != nil {
+	if err := commitFile(tmpFile, outPath); err != nil {
 		return "", err
 	}
 
@@ -216,7 +230,7 @@ func writeCount(w io.Writer, key string, sep rune, count int64) error {
 	return nil
 }
 
-func readMonthlyPageviews(testRun bool, dumpsPath string, year int, month time.Month, ch chan<- string, ctx context.Context) error {
+func readMonthlyPageviews(testRun bool, cfg *buildConfig, year int, month time.Month, ch chan<- string, ctx context.Context) error {
 	defer close(ch)
 
 	g, subCtx := errgroup.WithContext(ctx)
@@ -226,26 +240,20 @@ func readMonthlyPageviews(testRun bool, dumpsPath string, year int, month time.M
 		filename := fmt.Sprintf("pageviews-%04d%02d%02d-user.bz2",
 			year, month, day)
 		path := filepath.Join(
-			dumpsPath, "other", "pageview_complete",
+			cfg.Dumps, "other", "pageview_complete",
 			fmt.Sprintf("%04d", year),
 			fmt.Sprintf("%04d-%02d", year, month),
 			filename)
 		g.Go(func() error {
-			return readPageviewsFile(testRun, path, ch, subCtx)
+			return readPageviewsFile(testRun, path, cfg, ch, subCtx)
 		})
 	}
 
 	return g.Wait()
 }
 
-func readPageviewsFile(testRun bool, path string, ch chan<- string, ctx context.Context) error {
-	file, err := os.Open(path)
-	if err != nil {
-		return err
-	}
-	defer file.Close()
-
-	reader, err := bzip2.NewReader(file, &bzip2.ReaderConfig{})
+func readPageviewsFile(testRun bool, path string, cfg *buildConfig, ch chan<- string, ctx context.Context) error {
+	reader, err := openBzip2(path, cfg.Bzip2Command, cfg.Limits)
 	if err != nil {
 		return err
 	}
@@ -333,62 +341,142 @@ func emitPageviews(site, title string, count int64, ch chan<- string, ctx contex
 // BuildPageviews builds weekly pageview files and puts them in storage.
 // If a weekly file is already stored, it is not getting re-built.
 // The implementation checks for the latest available pageviews dump,
-// and goes back `numWeeks` weeks.
-func buildPageviews(ctx context.Context, dumps string, numWeeks int, s3 S3) ([]string, error) {
-	result := make([]string, 0, numWeeks)
-	stored, err := storedPageviews(ctx, s3)
+// and goes back `cfg.NumWeeks` weeks.
+func buildPageviews(ctx context.Context, cfg *buildConfig, manifest *resumeManifest, s3 S3) ([]string, error) {
+	result := make([]string, 0, cfg.NumWeeks)
+	stored, err := storedPageviews(ctx, cfg.Bucket, s3)
 	if err != nil {
 		return nil, err
 	}
 
-	latest, err := LatestPageviewsDump(dumps)
+	latest, err := LatestPageviewsDump(cfg)
 	if err != nil {
 		return nil, err
 	}
 
-	// Find the last Sunday for which a pageviews dump is available.
-	// Other than ISO 8601, the golang time library starts weeks with Sunday.
-	latestSunday := latest.AddDate(0, 0, int(time.Sunday-latest.Weekday()))
-
 	tempDir, err := os.MkdirTemp("", "qrank-pageviews")
 	if err != nil {
 		return nil, err
 	}
 	defer os.RemoveAll(tempDir)
 
-	for i := 0; i < numWeeks; i++ {
-		day := latestSunday.AddDate(0, 0, -7*i)
-		year, week := day.ISOWeek()
-		weekString := fmt.Sprintf("%04d-W%02d", year, week)
-		fileName := "pageviews-" + weekString + ".zst"
-		destPath := "pageviews/" + fileName
-		result = append(result, destPath)
-
-		if _, found := slices.BinarySearch(stored, weekString); !found {
+	// Builds a week of pageviews and puts it in storage.
+	buildWeek := func(weekString string) func(context.Context) error {
+		return func(ctx context.Context) error {
+			year, week, err := ParseISOWeek(weekString)
+			if err != nil {
+				return err
+			}
+			fileName := "pageviews-" + weekString + ".zst"
+			dest := "pageviews/" + fileName
+			cacheKey := weeklyPageviewsCacheKey(cfg, year, week)
+			if cfg.SharedCache {
+				if found, err := fetchCachedAggregate(ctx, cfg.Bucket, cacheKey, dest, s3); found || err != nil {
+					return err
+				}
+			}
 
 			tempFile := filepath.Join(tempDir, fileName)
-			if err := buildWeeklyPageviews(ctx, dumps, year, week, tempFile); err != nil {
-				return nil, err
+			weekCtx, span := startSpan(ctx, "pageviews week", "week", weekString)
+			err = buildWeeklyPageviews(weekCtx, cfg, year, week, tempFile)
+			span.finish(err)
+			if err != nil {
+				return err
 			}
 			defer os.Remove(tempFile)
+			if cfg.SharedCache {
+				if err := PutInStorage(ctx, tempFile, s3, cfg.Bucket, cacheKey, "application/zstd"); err != nil {
+					return err
+				}
+			}
+			return PutInStorage(ctx, tempFile, s3, cfg.Bucket, dest, "application/zstd")
+		}
+	}
+
+	weeks := pageviewsWeeks(latest, cfg.NumWeeks)
+	inputs := make(map[string]string, len(weeks))
+	var pending []string // weeks being built by other builders
+	for _, weekString := range weeks {
+		year, week, err := ParseISOWeek(weekString)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, "pageviews/pageviews-"+weekString+".zst")
 
-			if err := PutInStorage(ctx, tempFile, s3, "qrank", destPath, "application/zstd"); err != nil {
+		input := weeklyPageviewsIdentity(cfg, year, week)
+		inputs[weekString] = input
+		_, found := slices.BinarySearch(stored, weekString)
+		if !manifest.canSkip("pageviews", weekString, input, found) {
+			done, err := cfg.Queue.run(ctx, "pageviews", weekString, input, buildWeek(weekString))
+			if err != nil {
+				return nil, err
+			}
+			if !done {
+				pending = append(pending, weekString)
+				continue
+			}
+			if err := manifest.complete(ctx, "pageviews", weekString, input); err != nil {
 				return nil, err
 			}
 		}
 	}
 
+	for _, weekString := range pending {
+		input := inputs[weekString]
+		done, err := cfg.Queue.await(ctx, "pageviews", weekString, input, buildWeek(weekString))
+		if err != nil {
+			return nil, err
+		}
+		if done {
+			if err := manifest.complete(ctx, "pageviews", weekString, input); err != nil {
+				return nil, err
+			}
+		}
+	}
+	manifest.retain("pageviews", weeks)
+
 	sort.Strings(result)
 	return result, nil
 }
 
-// StoredPageviews returns what pageview files are available in storage.
-func storedPageviews(ctx context.Context, s3 S3) ([]string, error) {
+// LatestStoredPageviews returns the storage keys of the most recent
+// cfg.NumWeeks weekly pageviews files in storage, in ascending order.
+// This is used instead of buildPageviews when the pageviews stage
+// has not been selected to run.
+func latestStoredPageviews(ctx context.Context, cfg *buildConfig, s3 S3) ([]string, error) {
+	weeks, err := storedPageviews(ctx, cfg.Bucket, s3)
+	if err != nil {
+		return nil, err
+	}
+	if len(weeks) == 0 {
+		return nil, fmt.Errorf("no pageviews in storage; run stage pageviews first")
+	}
+	if !cfg.AsOf.IsZero() {
+		last := pageviewsWeeks(cfg.AsOf, 1)[0]
+		pos, found := slices.BinarySearch(weeks, last)
+		if found {
+			pos += 1
+		}
+		weeks = weeks[:pos]
+		if len(weeks) == 0 {
+			return nil, fmt.Errorf("no pageviews in storage up to %s", cfg.AsOf.Format(time.DateOnly))
+		}
+	}
+	weeks = weeks[max(0, len(weeks)-cfg.NumWeeks):]
+	result := make([]string, 0, len(weeks))
+	for _, week := range weeks {
+		result = append(result, "pageviews/pageviews-"+week+".zst")
+	}
+	return result, nil
+}
+
+// StoredPageviews returns what pageview files are available in a storage bucket.
+func storedPageviews(ctx context.Context, bucket string, s3 S3) ([]string, error) {
 	re := regexp.MustCompile(`^pageviews/pageviews-(\d{4}-W\d{2}).zst$`)
 	result := make([]string, 0, 60)
 	group, groupCtx := errgroup.WithContext(ctx)
 	group.Go(func() error {
-		ch := s3.ListObjects(groupCtx, "qrank", minio.ListObjectsOptions{
+		ch := s3.ListObjects(groupCtx, bucket, minio.ListObjectsOptions{
 			Prefix: "pageviews/",
 		})
 		for obj := range ch {
@@ -408,6 +496,55 @@ func storedPageviews(ctx context.Context, s3 S3) ([]string, error) {
 	return result, nil
 }
 
+// PageviewsWeeks returns the numWeeks most recent ISO weeks, such as
+// "2023-W12", for which pageviews dumps are available up to latest.
+func pageviewsWeeks(latest time.Time, numWeeks int) []string {
+	// Find the last Sunday for which a pageviews dump is available.
+	// Other than ISO 8601, the golang time library starts weeks with Sunday.
+	latestSunday := latest.AddDate(0, 0, int(time.Sunday-latest.Weekday()))
+
+	weeks := make([]string, 0, numWeeks)
+	for i := 0; i < numWeeks; i++ {
+		day := latestSunday.AddDate(0, 0, -7*i)
+		year, week := day.ISOWeek()
+		weeks = append(weeks, fmt.Sprintf("%04d-W%02d", year, week))
+	}
+	return weeks
+}
+
+// WeeklyPageviewsPaths returns the paths of the daily pageviews
+// dumps that make up an ISO week.
+func weeklyPageviewsPaths(dumps string, year int, week int) []string {
+	start := ISOWeekStart(year, week)
+	paths := make([]string, 0, 7)
+	for i := 0; i < 7; i++ {
+		paths = append(paths, PageviewsPath(dumps, start.AddDate(0, 0, i)))
+	}
+	return paths
+}
+
+// WeeklyPageviewsIdentity returns a fingerprint of the daily
+// pageviews dumps that make up an ISO week.
+func weeklyPageviewsIdentity(cfg *buildConfig, year int, week int) string {
+	id := dumpIdentity(weeklyPageviewsPaths(cfg.Dumps, year, week))
+	if dict := cacheDictionaryID(cfg.CacheDictionary); dict != 0 {
+		id += fmt.Sprintf("-dict%d", dict)
+	}
+	return id
+}
+
+// WeeklyPageviewsCacheKey returns the key of a week of pageviews in the
+// shared cache. Weeks that got compressed with a dictionary have their
+// own keys, because builders without the dictionary cannot read them.
+func weeklyPageviewsCacheKey(cfg *buildConfig, year int, week int) string {
+	ext := ".zst"
+	if dict := cacheDictionaryID(cfg.CacheDictionary); dict != 0 {
+		ext = fmt.Sprintf("-dict%d.zst", dict)
+	}
+	unit := fmt.Sprintf("%04d-W%02d", year, week)
+	return aggregateCacheKey("pageviews", unit, cfg.Dumps, weeklyPageviewsPaths(cfg.Dumps, year, week), ext)
+}
+
 // BuildWeeklyPageviews aggregates Wikimedia pageviews for a week.
 //
 // The output is written to zstd-compressed CSV file with columns `Wiki`,
@@ -415,31 +552,39 @@ func storedPageviews(ctx context.Context, s3 S3) ([]string, error) {
 // means the page https://en.wikipedia.org/?curid=3422 has been
 // viewed 7 times during the week. In the output, rows are sorted
 // by increasing UTF-8 string order.
-func buildWeeklyPageviews(ctx context.Context, dumps string, year int, week int, outpath string) error {
+func buildWeeklyPageviews(ctx context.Context, cfg *buildConfig, year int, week int, outpath string) error {
 	logger.Printf("building pageviews for week %04d-W%02d", year, week)
 	start := time.Now()
 
-	file, err := os.Create(outpath)
+	// If the build gets interrupted, the temporary file is left
+	// behind incomplete; only a finished file gets the final name.
+	tmpPath := outpath + ".tmp"
+	file, err := os.Create(tmpPath)
 	if err != nil {
 		return err
 	}
 	defer file.Close()
 
-	zstdLevel := zstd.WithEncoderLevel(zstd.SpeedBestCompression)
-	writer, err := zstd.NewWriter(file, zstdLevel)
+	writer, err := newCacheWriter(file, cfg.cacheLevel(zstd.SpeedBestCompression), cfg.CacheDictionary)
+	if err != nil {
+		return err
+	}
 
-	ch := make(chan string, 10000)
-	config := extsort.DefaultConfig()
-	config.ChunkSize = 16 * 1024 * 1024 / 32
-	config.NumWorkers = runtime.NumCPU()
-	sorter, outChan, errChan := extsort.Strings(ch, config)
+	ch := make(chan extsort.SortType, cfg.Sort.buffer(10000))
+	config := cfg.Sort.newConfig(16*1024*1024/32, 32) // 16 MiB, 32 Bytes/record avg
+	sorter, outChan, errChan := extsort.New(ch, pageviewCountFromBytes, pageviewCountLess, config)
 	g, subCtx := errgroup.WithContext(ctx)
 	g.Go(func() error {
-		return readWeeklyPageviews(subCtx, dumps, year, week, ch)
+		return readWeeklyPageviews(subCtx, cfg, year, week, ch)
 	})
+	counter := &lineCounter{w: writer}
 	g.Go(func() error {
-		sorter.Sort(subCtx)
-		return MergeCounts(subCtx, outChan, writer)
+		ctx, span := startSpan(subCtx, "sort and merge")
+		sorter.Sort(ctx)
+		err := mergePageviewCounts(ctx, outChan, counter)
+		span.setAttr("rows", counter.lines)
+		span.finish(err)
+		return err
 	})
 
 	if err := g.Wait(); err != nil {
@@ -454,70 +599,97 @@ func buildWeeklyPageviews(ctx context.Context, dumps string, year int, week int,
 		return err
 	}
 
-	if err := file.Close(); err != nil {
+	if err := commitFile(file, outpath); err != nil {
 		return err
 	}
 
+	stageRows.WithLabelValues("pageviews").Add(float64(counter.lines))
+	stageReadBytes.WithLabelValues("pageviews").Add(float64(fileSizes(weeklyPageviewsPaths(cfg.Dumps, year, week))))
 	logger.Printf("built pageviews for week %04d-W%02d in %.1fs",
 		year, week, time.Since(start).Seconds())
 	return nil
 }
 
 // readWeeklyPageviews reads the Wikimedia pageview file of one week,
-// sending output as `Wiki,PageID,Count` to a string channel before
+// sending output as pageviewCount records to a channel before
 // closing that channel.
-func readWeeklyPageviews(ctx context.Context, dumps string, year int, week int, out chan<- string) error {
+func readWeeklyPageviews(ctx context.Context, cfg *buildConfig, year int, week int, out chan<- extsort.SortType) error {
 	defer close(out)
 	group, groupCtx := errgroup.WithContext(ctx)
 	start := ISOWeekStart(year, week)
 	for i := 0; i < 7; i++ {
 		day := start.AddDate(0, 0, i)
-		path := PageviewsPath(dumps, day)
+		path := PageviewsPath(cfg.Dumps, day)
 		group.Go(func() error {
-			return readDailyPageviews(groupCtx, path, out)
+			ctx, span := startSpan(groupCtx, "read dump", "path", path, "bytes", fileSizes([]string{path}))
+			err := readDailyPageviews(ctx, cfg, path, nil, out)
+			span.finish(err)
+			return err
 		})
 	}
 	return group.Wait()
 }
 
 // readDailyPageviews reads the Wikimedia pageview file of one single day,
-// sending output as `Wiki,PageID,Count` to a string channel.
+// sending output as pageviewCount records to a channel.
+// If `filter` is not nil, pages that are not in the filter get dropped.
 // If `ctx` gets cancelled while reading the file, an error is returned.
-func readDailyPageviews(ctx context.Context, path string, out chan<- string) error {
-	file, err := os.Open(path)
+func readDailyPageviews(ctx context.Context, cfg *buildConfig, path string, filter *pageSet, out chan<- extsort.SortType) error {
+	release, err := cfg.Limits.acquireFile(ctx)
 	if err != nil {
 		return err
 	}
-	defer file.Close()
+	defer release()
 
-	reader, err := bzip2.NewReader(file, &bzip2.ReaderConfig{})
-	if err != err {
+	reader, err := openBzip2(path, cfg.Bzip2Command, cfg.Limits)
+	if err != nil {
 		return err
 	}
 	defer reader.Close()
 
+	if err := parseDailyPageviews(ctx, reader, filter, out); err != nil {
+		return err
+	}
+
+	if err := reader.Close(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// ParseDailyPageviews parses the uncompressed content of a Wikimedia
+// pageview file, sending output as pageviewCount records to a channel.
+// Since this runs on billions of lines for each build, we parse bytes
+// without allocating; see BenchmarkParseDailyPageviews.
+func parseDailyPageviews(ctx context.Context, reader io.Reader, filter *pageSet, out chan<- extsort.SortType) error {
 	scanner := bufio.NewScanner(reader)
 	var lastWiki string
 	var lastID, lastCount int64
+	var cols [5][]byte
 	for scanner.Scan() {
 		// "commons.wikimedia Category:Obergesteln 2527294 desktop 3 B1K1"
-		cols := strings.Split(scanner.Text(), " ")
-		if len(cols) < 5 {
+		if splitInto(scanner.Bytes(), ' ', cols[:]) < 5 {
 			continue
 		}
 
 		wiki, pageID, count := cols[0], cols[2], cols[4]
-		id, err := strconv.ParseInt(pageID, 10, 64)
+		id, err := parseInt(pageID)
 		if id <= 0 || err != nil {
 			continue
 		}
 
-		c, err := strconv.ParseInt(count, 10, 64)
+		c, err := parseInt(count)
 		if c <= 0 || err != nil {
 			continue
 		}
 
-		if wiki == lastWiki && id == lastID {
+		if filter != nil && !filter.contains(string(wiki), id) {
+			filter.skipped.Add(1)
+			continue
+		}
+
+		if string(wiki) == lastWiki && id == lastID {
 			lastCount += c
 			continue
 		}
@@ -525,46 +697,125 @@ func readDailyPageviews(ctx context.Context, path string, out chan<- string) err
 		if err := sendCount(lastWiki, lastID, lastCount, ctx, out); err != nil {
 			return err
 		}
-		lastWiki, lastID, lastCount = wiki, id, c
-	}
-
-	if err := sendCount(lastWiki, lastID, lastCount, ctx, out); err != nil {
-		return err
-	}
-
-	if err := reader.Close(); err != nil {
-		return err
+		if string(wiki) != lastWiki {
+			lastWiki = string(wiki)
+		}
+		lastID, lastCount = id, c
 	}
-
-	if err := file.Close(); err != nil {
+	if err := scanner.Err(); err != nil {
 		return err
 	}
 
-	return nil
+	return sendCount(lastWiki, lastID, lastCount, ctx, out)
 }
 
 // SendCount is an internal helper for ReadDailyPageviews.
-func sendCount(wiki string, pageID int64, count int64, ctx context.Context, out chan<- string) error {
+func sendCount(wiki string, pageID int64, count int64, ctx context.Context, out chan<- extsort.SortType) error {
 	if count <= 0 {
 		return nil
 	}
 
-	var buf strings.Builder
-	buf.WriteString(wiki)
-	buf.WriteByte(',')
-	buf.WriteString(strconv.FormatInt(pageID, 10))
-	buf.WriteByte(',')
-	buf.WriteString(strconv.FormatInt(count, 10))
-
 	select {
 	case <-ctx.Done():
 		return ctx.Err()
 
-	case out <- buf.String():
+	case out <- pageviewCount{wiki: wiki, page: pageID, count: count}:
 		return nil
 	}
 }
 
+// PageviewCount tells how often a page has been viewed. When building
+// weekly pageviews, we sort millions of these records. Compared to
+// sorting formatted text lines, the binary encoding keeps the temporary
+// files smaller, and merging the sorted counts needs no parsing.
+type pageviewCount struct {
+	wiki  string // such as "en.wikipedia"
+	page  int64
+	count int64
+}
+
+// ToBytes encodes a pageviewCount as the length of the wiki name,
+// the wiki name, the page ID and the count, all numbers as varints.
+func (c pageviewCount) ToBytes() []byte {
+	buf := make([]byte, 0, len(c.wiki)+3*binary.MaxVarintLen64)
+	buf = binary.AppendUvarint(buf, uint64(len(c.wiki)))
+	buf = append(buf, c.wiki...)
+	buf = binary.AppendUvarint(buf, uint64(c.page))
+	buf = binary.AppendUvarint(buf, uint64(c.count))
+	return buf
+}
+
+func pageviewCountFromBytes(b []byte) extsort.SortType {
+	wikiLen, n := binary.Uvarint(b)
+	b = b[n:]
+	wiki := string(b[:wikiLen])
+	b = b[wikiLen:]
+	page, n := binary.Uvarint(b)
+	count, _ := binary.Uvarint(b[n:])
+	return pageviewCount{wiki: wiki, page: int64(page), count: int64(count)}
+}
+
+// PageviewCountLess sorts records in the same order as their text
+// form "wiki,page,count" in UTF-8 string order, which is the order
+// of the weekly pageviews files. Wiki names never contain characters
+// that sort before the comma, so we can compare them as a whole;
+// page IDs get compared by their decimal digits, so "10117" comes
+// before "3824".
+func pageviewCountLess(a, b extsort.SortType) bool {
+	aa, bb := a.(pageviewCount), b.(pageviewCount)
+	if aa.wiki != bb.wiki {
+		return aa.wiki < bb.wiki
+	}
+	return compareDecimal(aa.page, bb.page) < 0
+}
+
+// CompareDecimal compares two integers by their decimal form
+// in string order.
+func compareDecimal(a, b int64) int {
+	var abuf, bbuf [20]byte
+	return bytes.Compare(strconv.AppendInt(abuf[:0], a, 10), strconv.AppendInt(bbuf[:0], b, 10))
+}
+
+// MergePageviewCounts merges sorted pageviewCount records for the same
+// page, and writes them as lines of the form "en.wikipedia,3422,7".
+func mergePageviewCounts(ctx context.Context, ch <-chan extsort.SortType, w io.Writer) error {
+	var last pageviewCount
+	var buf []byte
+	flush := func() error {
+		if last.count <= 0 {
+			return nil
+		}
+		buf = append(buf[:0], last.wiki...)
+		buf = append(buf, ',')
+		buf = strconv.AppendInt(buf, last.page, 10)
+		buf = append(buf, ',')
+		buf = strconv.AppendInt(buf, last.count, 10)
+		buf = append(buf, '\n')
+		_, err := w.Write(buf)
+		return err
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+
+		case rec, ok := <-ch:
+			if !ok { // channel closed, end of input
+				return flush()
+			}
+			c := rec.(pageviewCount)
+			if c.wiki == last.wiki && c.page == last.page {
+				last.count += c.count
+				continue
+			}
+			if err := flush(); err != nil {
+				return err
+			}
+			last = c
+		}
+	}
+}
+
 // MergeCounts merges sorted counts such as "Foo,3" and "Foo,2" to "Foo,5".
 // Input is consumed from a string channel, output is written to a Writer.
 func MergeCounts(ctx context.Context, ch <-chan string, w io.Writer) error {
@@ -20,11 +20,12 @@ import (
 	"time"
 
 	"github.com/klauspost/compress/zstd"
+	"github.com/lanrat/extsort"
 	"golang.org/x/sync/errgroup"
 )
 
 func TestLatestPageviewsDump(t *testing.T) {
-	day, err := LatestPageviewsDump(filepath.Join("testdata", "dumps"))
+	day, err := LatestPageviewsDump(newBuildConfig(filepath.Join("testdata", "dumps")))
 	if err != nil {
 		t.Error(err)
 	}
@@ -34,8 +35,32 @@ func TestLatestPageviewsDump(t *testing.T) {
 	}
 }
 
+func TestLatestPageviewsDump_AsOf(t *testing.T) {
+	cfg := newBuildConfig(filepath.Join("testdata", "dumps"))
+	for _, tc := range []struct{ asOf, want string }{
+		{"2023-03-23", "2023-03-23"},
+		{"2023-04-10", "2023-03-26"},
+		{"2023-03-01", ""},
+	} {
+		cfg.AsOf, _ = time.Parse(time.DateOnly, tc.asOf)
+		day, err := LatestPageviewsDump(cfg)
+		if tc.want == "" {
+			if err == nil {
+				t.Errorf("as of %s: expected error, got %s", tc.asOf, day.Format(time.DateOnly))
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := day.Format(time.DateOnly); got != tc.want {
+			t.Errorf("as of %s: got %s, want %s", tc.asOf, got, tc.want)
+		}
+	}
+}
+
 func TestLatestPageviewsDump_NoSuchDir(t *testing.T) {
-	_, err := LatestPageviewsDump("no_such_dir")
+	_, err := LatestPageviewsDump(newBuildConfig("no_such_dir"))
 	if !errors.Is(err, fs.ErrNotExist) {
 		t.Errorf("got %v, want fs.ErrNotExist", err)
 	}
@@ -151,13 +176,18 @@ func TestBuildPageviews(t *testing.T) {
 
 	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
 	ctx := context.Background()
-	dumps := filepath.Join("testdata", "dumps")
+	cfg := newBuildConfig(filepath.Join("testdata", "dumps"))
+	cfg.NumWeeks = 4
 	s3 := NewFakeS3()
 	s3.data["pageviews/pageviews-2011-W51.zst"] = []byte("very old")
 	s3.data["pageviews/pageviews-2023-W09.zst"] = []byte("foo")
 	s3.data["pageviews/pageviews-2023-W10.zst"] = []byte("bar")
 	s3.data["pageviews/pageviews-2023-W11.zst"] = []byte("baz")
-	got, err := buildPageviews(ctx, dumps /*numWeeks*/, 4, s3)
+	manifest, err := loadResumeManifest(ctx, "qrank", s3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := buildPageviews(ctx, cfg, manifest, s3)
 	if err != nil {
 		t.Error(err)
 	}
@@ -173,6 +203,66 @@ func TestBuildPageviews(t *testing.T) {
 	if _, found := s3.data["pageviews/pageviews-2023-W12.zst"]; !found {
 		t.Errorf("buildPageviews() should upload newly computed 2023-W12 file")
 	}
+	if _, found := manifest.Stages["pageviews"]["2023-W12"]; !found {
+		t.Errorf("buildPageviews() should record 2023-W12 in resume manifest")
+	}
+	cacheKey := aggregateCacheKey("pageviews", "2023-W12", cfg.Dumps, weeklyPageviewsPaths(cfg.Dumps, 2023, 12), ".zst")
+	if _, found := s3.data[cacheKey]; !found {
+		t.Errorf("buildPageviews() should put 2023-W12 into shared cache")
+	}
+}
+
+func TestLatestStoredPageviews(t *testing.T) {
+	ctx := context.Background()
+	cfg := newBuildConfig("")
+	cfg.NumWeeks = 2
+	s3 := NewFakeS3()
+	if _, err := latestStoredPageviews(ctx, cfg, s3); err == nil {
+		t.Error("expected error when no pageviews are stored")
+	}
+	s3.data["pageviews/pageviews-2023-W09.zst"] = []byte("foo")
+	s3.data["pageviews/pageviews-2023-W10.zst"] = []byte("bar")
+	s3.data["pageviews/pageviews-2023-W11.zst"] = []byte("baz")
+	got, err := latestStoredPageviews(ctx, cfg, s3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"pageviews/pageviews-2023-W10.zst",
+		"pageviews/pageviews-2023-W11.zst",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestLatestStoredPageviews_AsOf(t *testing.T) {
+	ctx := context.Background()
+	cfg := newBuildConfig("")
+	cfg.NumWeeks = 2
+	s3 := NewFakeS3()
+	s3.data["pageviews/pageviews-2023-W09.zst"] = []byte("foo")
+	s3.data["pageviews/pageviews-2023-W10.zst"] = []byte("bar")
+	s3.data["pageviews/pageviews-2023-W11.zst"] = []byte("baz")
+
+	// Sunday 2023-03-12 is the last day of 2023-W10.
+	cfg.AsOf = time.Date(2023, 3, 12, 0, 0, 0, 0, time.UTC)
+	got, err := latestStoredPageviews(ctx, cfg, s3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"pageviews/pageviews-2023-W09.zst",
+		"pageviews/pageviews-2023-W10.zst",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	cfg.AsOf = time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	if _, err := latestStoredPageviews(ctx, cfg, s3); err == nil {
+		t.Error("expected error when no pageviews are stored up to the date")
+	}
 }
 
 func TestStoredPageviews(t *testing.T) {
@@ -180,7 +270,7 @@ func TestStoredPageviews(t *testing.T) {
 	s3.data["pageviews/pageviews-2011-W51.zst"] = []byte("a")
 	s3.data["pageviews/pageviews-2019-W51.gz"] = []byte("junk")
 	s3.data["pageviews/pageviews-2024-W06.zst"] = []byte("b")
-	got, err := storedPageviews(context.Background(), s3)
+	got, err := storedPageviews(context.Background(), "qrank", s3)
 	if err != nil {
 		t.Error(err)
 	}
@@ -199,7 +289,7 @@ func TestBuildWeeklyPageviews(t *testing.T) {
 	ctx := context.Background()
 	dumps := filepath.Join("testdata", "dumps")
 	path := filepath.Join(t.TempDir(), "pageviews-2023-W12.zst")
-	if err := buildWeeklyPageviews(ctx, dumps, 2023, 12, path); err != nil {
+	if err := buildWeeklyPageviews(ctx, newBuildConfig(dumps), 2023, 12, path); err != nil {
 		t.Error(err)
 	}
 
@@ -244,8 +334,63 @@ func TestBuildWeeklyPageviews(t *testing.T) {
 	}
 }
 
+func TestBuildWeeklyPageviews_Dictionary(t *testing.T) {
+	if testing.Short() {
+		t.Skip()
+	}
+
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	ctx := context.Background()
+	plain := newBuildConfig(filepath.Join("testdata", "dumps"))
+	cfg := newBuildConfig(plain.Dumps)
+	cfg.CacheDictionary = testCacheDictionary(t)
+
+	read := func(cfg *buildConfig, dict []byte) (string, error) {
+		path := filepath.Join(t.TempDir(), "pageviews-2023-W12.zst")
+		if err := buildWeeklyPageviews(ctx, cfg, 2023, 12, path); err != nil {
+			t.Fatal(err)
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+		r, err := newCacheReader(path, file, dict)
+		if err != nil {
+			return "", err
+		}
+		defer r.Close()
+		data, err := io.ReadAll(r)
+		return string(data), err
+	}
+
+	want, err := read(plain, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := read(cfg, cfg.CacheDictionary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if _, err := read(cfg, nil); err == nil {
+		t.Error("reading without the dictionary should fail")
+	}
+
+	// Weeks compressed with a dictionary must not get mixed up
+	// with those compressed without one.
+	if weeklyPageviewsIdentity(cfg, 2023, 12) == weeklyPageviewsIdentity(plain, 2023, 12) {
+		t.Error("dictionary should change the identity of a week")
+	}
+	if weeklyPageviewsCacheKey(cfg, 2023, 12) == weeklyPageviewsCacheKey(plain, 2023, 12) {
+		t.Error("dictionary should change the shared cache key of a week")
+	}
+}
+
 func TestReadWeeklyPageviews(t *testing.T) {
-	ch := make(chan string, 10)
+	ch := make(chan extsort.SortType, 10)
 	numLines := 0
 	group, ctx := errgroup.WithContext(context.Background())
 	group.Go(func() error {
@@ -256,7 +401,7 @@ func TestReadWeeklyPageviews(t *testing.T) {
 	})
 	group.Go(func() error {
 		dumps := filepath.Join("testdata", "dumps")
-		return readWeeklyPageviews(ctx, dumps, 2023, 12, ch)
+		return readWeeklyPageviews(ctx, newBuildConfig(dumps), 2023, 12, ch)
 	})
 	if err := group.Wait(); err != nil {
 		t.Error(err)
@@ -269,17 +414,17 @@ func TestReadWeeklyPageviews(t *testing.T) {
 func TestReadWeeklyPageviews_Canceled(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	cancel()
-	ch := make(chan string, 2)
+	ch := make(chan extsort.SortType, 2)
 	dumps := filepath.Join("testdata", "dumps")
-	if err := readWeeklyPageviews(ctx, dumps, 2023, 12, ch); err != context.Canceled {
+	if err := readWeeklyPageviews(ctx, newBuildConfig(dumps), 2023, 12, ch); err != context.Canceled {
 		t.Errorf("want context.Canceled, got %v", err)
 	}
 }
 
 func TestReadWeeklyPageviews_MissingFiles(t *testing.T) {
 	ctx := context.Background()
-	ch := make(chan string, 2)
-	if err := readWeeklyPageviews(ctx, "bad-path", 2021, 12, ch); err == nil {
+	ch := make(chan extsort.SortType, 2)
+	if err := readWeeklyPageviews(ctx, newBuildConfig("bad-path"), 2021, 12, ch); err == nil {
 		t.Error("want error, got nil")
 	}
 }
@@ -287,18 +432,19 @@ func TestReadWeeklyPageviews_MissingFiles(t *testing.T) {
 func TestReadDailyPageviews(t *testing.T) {
 	date, _ := time.Parse(time.DateOnly, "2023-03-20")
 	path := PageviewsPath(filepath.Join("testdata", "dumps"), date)
-	ch := make(chan string, 1)
+	ch := make(chan extsort.SortType, 1)
 	go func() {
 		defer close(ch)
 		ctx := context.Background()
-		if err := readDailyPageviews(ctx, path, ch); err != nil {
+		if err := readDailyPageviews(ctx, newBuildConfig(""), path, nil, ch); err != nil {
 			t.Error(err)
 		}
 	}()
 
 	got := make([]string, 0)
-	for line := range ch {
-		got = append(got, line)
+	for rec := range ch {
+		c := rec.(pageviewCount)
+		got = append(got, fmt.Sprintf("%s,%d,%d", c.wiki, c.page, c.count))
 	}
 
 	want := []string{
@@ -324,20 +470,54 @@ func TestReadDailyPageviews_Canceled(t *testing.T) {
 
 	date, _ := time.Parse(time.DateOnly, "2023-03-20")
 	path := PageviewsPath(filepath.Join("testdata", "dumps"), date)
-	ch := make(chan string, 100)
-	if err := readDailyPageviews(ctx, path, ch); err != context.Canceled {
+	ch := make(chan extsort.SortType, 100)
+	if err := readDailyPageviews(ctx, newBuildConfig(""), path, nil, ch); err != context.Canceled {
 		t.Errorf("want context.Canceled, got %v", err)
 	}
 }
 
 func TestReadDailyPageviews_FileNotFound(t *testing.T) {
 	ctx := context.Background()
-	ch := make(chan string, 2)
-	if err := readDailyPageviews(ctx, "no-such-file.bz2", ch); err == nil {
+	ch := make(chan extsort.SortType, 2)
+	if err := readDailyPageviews(ctx, newBuildConfig(""), "no-such-file.bz2", nil, ch); err == nil {
 		t.Error("want error, got nil")
 	}
 }
 
+func BenchmarkParseDailyPageviews(b *testing.B) {
+	// Pages appear on consecutive lines for different access methods,
+	// and only some of them are linked to a Wikidata item.
+	var buf bytes.Buffer
+	filter := newPageSet()
+	for i := 1; i <= 10000; i++ {
+		for _, access := range []string{"desktop", "mobile-app", "mobile-web"} {
+			fmt.Fprintf(&buf, "en.wikipedia Page_%d %d %s %d A1B2\n", i, i, access, i%7+1)
+		}
+		if i%3 == 0 {
+			filter.add("en.wikipedia", int64(i))
+		}
+	}
+	data := buf.Bytes()
+	ctx := context.Background()
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		ch := make(chan extsort.SortType, 100)
+		done := make(chan struct{})
+		go func() {
+			for range ch {
+			}
+			close(done)
+		}()
+		if err := parseDailyPageviews(ctx, bytes.NewReader(data), filter, ch); err != nil {
+			b.Fatal(err)
+		}
+		close(ch)
+		<-done
+	}
+}
+
 func TestMergeCounts(t *testing.T) {
 	ch := make(chan string, 2)
 	var buf bytes.Buffer
@@ -372,3 +552,72 @@ func TestMergeCounts_Canceled(t *testing.T) {
 		t.Errorf("expected context.Canceled, got %v", err)
 	}
 }
+
+func TestPageviewCount(t *testing.T) {
+	for _, c := range []pageviewCount{
+		{"en.wikipedia", 3422, 7},
+		{"zh-min-nan.wikipedia", 1, 1 << 40},
+		{"", 0, 0},
+	} {
+		got := pageviewCountFromBytes(c.ToBytes())
+		if got != c {
+			t.Errorf("got %v, want %v", got, c)
+		}
+	}
+}
+
+func TestPageviewCountLess(t *testing.T) {
+	// The records must sort in the same order as their text form.
+	records := []pageviewCount{
+		{"rm.wikipedia", 3824, 1},
+		{"de.wikipedia.x", 1, 1},
+		{"rm.wikipedia", 10117, 1},
+		{"en.wikipedia", 34220, 2},
+		{"de.wikipedia", 585473, 4},
+		{"en.wikipedia", 3422, 9},
+		{"de-x.wikipedia", 7, 1},
+	}
+	lines := make([]string, 0, len(records))
+	for _, c := range records {
+		lines = append(lines, fmt.Sprintf("%s,%d,%d", c.wiki, c.page, c.count))
+	}
+	slices.Sort(lines)
+	slices.SortFunc(records, func(a, b pageviewCount) int {
+		if pageviewCountLess(a, b) {
+			return -1
+		} else if pageviewCountLess(b, a) {
+			return 1
+		}
+		return 0
+	})
+	got := make([]string, 0, len(records))
+	for _, c := range records {
+		got = append(got, fmt.Sprintf("%s,%d,%d", c.wiki, c.page, c.count))
+	}
+	if !slices.Equal(got, lines) {
+		t.Errorf("got %v, want %v", got, lines)
+	}
+}
+
+func TestMergePageviewCounts(t *testing.T) {
+	ch := make(chan extsort.SortType, 5)
+	ch <- pageviewCount{"en.wikipedia", 3422, 7}
+	ch <- pageviewCount{"en.wikipedia", 3422, 2}
+	ch <- pageviewCount{"en.wikipedia", 34220, 1}
+	ch <- pageviewCount{"rm.wikipedia", 3422, 5}
+	close(ch)
+	var buf bytes.Buffer
+	if err := mergePageviewCounts(context.Background(), ch, &buf); err != nil {
+		t.Fatal(err)
+	}
+	want := "en.wikipedia,3422,9\nen.wikipedia,34220,1\nrm.wikipedia,3422,5\n"
+	if got := buf.String(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := mergePageviewCounts(ctx, make(chan extsort.SortType), &buf); err != context.Canceled {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+}
@@ -0,0 +1,129 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+
+	"github.com/lanrat/extsort"
+	"golang.org/x/sync/errgroup"
+)
+
+// PageviewsKeys returns the storage keys of the weekly pageview files
+// that buildPageviews would build, in ascending order, without building
+// anything. In streaming mode, the keys only name the weeks to read.
+func pageviewsKeys(cfg *buildConfig) ([]string, error) {
+	latest, err := LatestPageviewsDump(cfg)
+	if err != nil {
+		return nil, err
+	}
+	weeks := pageviewsWeeks(latest, cfg.NumWeeks)
+	keys := make([]string, 0, len(weeks))
+	for _, week := range weeks {
+		keys = append(keys, "pageviews/pageviews-"+week+".zst")
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// PageviewsStream is a LineScanner over the pageview counts of several
+// weeks, read from the Wikimedia dumps and sorted on the fly. The lines
+// have the same format and order as those in weekly pageview files,
+// such as "en.wikipedia,1234,7", so the stream can take the place
+// of these files when joining pageviews with page signals.
+type pageviewsStream struct {
+	*bufio.Scanner
+	reader *io.PipeReader
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewPageviewsStream starts reading and sorting the pageview dumps
+// for the weeks of the passed pageview keys, as returned by
+// pageviewsKeys. If filter is not nil, pages that are not in the filter
+// get dropped before sorting. The caller must close the stream.
+func newPageviewsStream(ctx context.Context, cfg *buildConfig, pageviews []string, filter *pageSet) (*pageviewsStream, error) {
+	re := regexp.MustCompile(`^pageviews/pageviews-(\d{4}-W\d{2}).zst$`)
+	paths := make([]string, 0, len(pageviews)*7)
+	for _, pv := range pageviews {
+		match := re.FindStringSubmatch(pv)
+		if match == nil {
+			return nil, fmt.Errorf("unexpected pageviews file: %q", pv)
+		}
+		year, week, err := ParseISOWeek(match[1])
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, weeklyPageviewsPaths(cfg.Dumps, year, week)...)
+	}
+	stageReadBytes.WithLabelValues("item_signals").Add(float64(fileSizes(paths)))
+
+	ctx, cancel := context.WithCancel(ctx)
+	reader, writer := io.Pipe()
+	s := &pageviewsStream{
+		Scanner: bufio.NewScanner(reader),
+		reader:  reader,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+	}
+	go func() {
+		defer close(s.done)
+		buf := bufio.NewWriter(writer)
+		err := sortPageviews(ctx, cfg, paths, filter, buf)
+		if err == nil {
+			err = buf.Flush()
+		}
+		writer.CloseWithError(err)
+	}()
+	return s, nil
+}
+
+// Close stops reading the dumps, if this has not finished yet.
+func (s *pageviewsStream) Close() error {
+	s.reader.Close()
+	s.cancel()
+	<-s.done
+	return nil
+}
+
+// SortPageviews reads daily pageview dumps, and writes the merged
+// counts in the format of weekly pageview files, sorted by wiki
+// and page ID. If filter is not nil, pages that are not in the filter
+// get dropped.
+func sortPageviews(ctx context.Context, cfg *buildConfig, paths []string, filter *pageSet, w io.Writer) error {
+	ch := make(chan extsort.SortType, cfg.Sort.buffer(10000))
+	config := cfg.Sort.newConfig(16*1024*1024/32, 32) // 16 MiB, 32 Bytes/record avg
+	sorter, outChan, errChan := extsort.New(ch, pageviewCountFromBytes, pageviewCountLess, config)
+	g, subCtx := errgroup.WithContext(ctx)
+	g.Go(func() error {
+		defer close(ch)
+		readers, readCtx := errgroup.WithContext(subCtx)
+		readers.SetLimit(7)
+		for _, path := range paths {
+			readers.Go(func() error {
+				ctx, span := startSpan(readCtx, "read dump", "path", path, "bytes", fileSizes([]string{path}))
+				err := readDailyPageviews(ctx, cfg, path, filter, ch)
+				span.finish(err)
+				return err
+			})
+		}
+		return readers.Wait()
+	})
+	g.Go(func() error {
+		sorter.Sort(subCtx)
+		return mergePageviewCounts(subCtx, outChan, w)
+	})
+	if err := g.Wait(); err != nil {
+		return err
+	}
+	if filter != nil {
+		logger.Printf("debug: dropped %d pageview lines for pages without Wikidata items", filter.skipped.Load())
+	}
+	return <-errChan
+}
@@ -0,0 +1,216 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestPageviewsKeys(t *testing.T) {
+	cfg := newBuildConfig(filepath.Join("testdata", "dumps"))
+	cfg.NumWeeks = 2
+	got, err := pageviewsKeys(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"pageviews/pageviews-2023-W11.zst", "pageviews/pageviews-2023-W12.zst"}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestPageviewsStream(t *testing.T) {
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	ctx := context.Background()
+	cfg := newBuildConfig(filepath.Join("testdata", "dumps"))
+
+	// The stream should produce the same lines as a weekly pageviews file.
+	weekly := filepath.Join(t.TempDir(), "pageviews-2023-W12.zst")
+	if err := buildWeeklyPageviews(ctx, cfg, 2023, 12, weekly); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(weekly)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoder, err := zstd.NewReader(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer decoder.Close()
+	decoded, err := decoder.DecodeAll(data, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := strings.Split(strings.TrimSuffix(string(decoded), "\n"), "\n")
+
+	stream, err := newPageviewsStream(ctx, cfg, []string{"pageviews/pageviews-2023-W12.zst"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for stream.Scan() {
+		got = append(got, stream.Text())
+	}
+	if err := stream.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) == 0 || !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestPageviewsStream_CloseEarly(t *testing.T) {
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	dumps := filepath.Join("testdata", "dumps")
+	stream, err := newPageviewsStream(context.Background(), newBuildConfig(dumps), []string{"pageviews/pageviews-2023-W12.zst"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPageviewsStream_MissingDump(t *testing.T) {
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	cfg := newBuildConfig(filepath.Join("testdata", "dumps"))
+	stream, err := newPageviewsStream(context.Background(), cfg, []string{"pageviews/pageviews-1999-W01.zst"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	for stream.Scan() {
+	}
+	if stream.Err() == nil {
+		t.Error("expected error for missing dumps")
+	}
+
+	if _, err := newPageviewsStream(context.Background(), cfg, []string{"junk"}, nil); err == nil {
+		t.Error("expected error for bad pageviews key")
+	}
+}
+
+func TestBuild_StreamPageviews(t *testing.T) {
+	if testing.Short() {
+		t.Skip()
+	}
+
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	cfg := newBuildConfig(filepath.Join("testdata", "dumps"))
+	cfg.NumWeeks = 1
+	client := &http.Client{Transport: &FakeWikiSite{}}
+	key := "public/item_signals-20240501.csv.zst"
+
+	s3 := NewFakeS3()
+	if err := Build(context.Background(), client, cfg, s3); err != nil {
+		t.Fatal(err)
+	}
+	want, err := s3.ReadLines(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg.StreamPageviews = true
+	s3 = NewFakeS3()
+	if err := Build(context.Background(), client, cfg, s3); err != nil {
+		t.Fatal(err)
+	}
+	got, err := s3.ReadLines(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	for key := range s3.data {
+		if strings.HasPrefix(key, "pageviews/") {
+			t.Errorf("streaming build should not store %s", key)
+		}
+	}
+}
+
+func TestBuild_StreamPageviewsSeeded(t *testing.T) {
+	if testing.Short() {
+		t.Skip()
+	}
+
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	cfg := newBuildConfig(filepath.Join("testdata", "dumps"))
+	cfg.NumWeeks = 1
+	client := &http.Client{Transport: &FakeWikiSite{}}
+	key := "public/item_signals-20240501.csv.zst"
+	weeks, err := pageviewsKeys(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	week := weeks[0]
+
+	s3 := NewFakeS3()
+	if err := Build(context.Background(), client, cfg, s3); err != nil {
+		t.Fatal(err)
+	}
+	want, err := s3.ReadLines(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	weekData, found := s3.data[week]
+	if !found {
+		t.Fatalf("build should have stored %s", week)
+	}
+
+	// A streaming build should read the week that an earlier
+	// build has left in storage, instead of the dumps.
+	cfg.StreamPageviews = true
+	s3 = NewFakeS3()
+	s3.data[week] = weekData
+	if err := Build(context.Background(), client, cfg, s3); err != nil {
+		t.Fatal(err)
+	}
+	got, err := s3.ReadLines(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// To tell that the week came from storage, we store it with
+	// ten times the pageviews, which should then show in the output.
+	lines, err := s3.ReadLines(week)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, line := range lines {
+		lines[i] = line + "0"
+	}
+	s3 = NewFakeS3()
+	if err := s3.WriteLines(lines, week); err != nil {
+		t.Fatal(err)
+	}
+	if err := Build(context.Background(), client, cfg, s3); err != nil {
+		t.Fatal(err)
+	}
+	got, err = s3.ReadLines(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if slices.Equal(got, want) {
+		t.Error("streaming build should have read the week from storage")
+	}
+}
@@ -0,0 +1,301 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// PlannedTask is a unit of work that a build would do, as reported
+// by a dry run.
+type plannedTask struct {
+	Stage string
+
+	// Storage keys of the files that the task would upload.
+	Outputs []string
+
+	// Dump files that the task would read, and their total size.
+	Inputs     []string
+	InputBytes int64
+
+	// Estimated size of the uploaded files, or -1 if unknown.
+	// The estimate is the size of the previous version in storage.
+	OutputBytes int64
+}
+
+// SiteStageTables tells which tables of the database dumps get read
+// by the per-wiki stages of the pipeline.
+var siteStageTables = map[string][]string{
+	"page_signals":    {"page_props", "page"},
+	"interwiki_links": {"iwlinks"},
+	"titles":          {"page", "redirect"},
+	"page_items":      {"page_props", "page"},
+}
+
+// SiteStageInputs returns the paths of the dump files that
+// a per-wiki stage of the pipeline reads for a site.
+func siteStageInputs(dumps string, site *WikiSite, stage string) []string {
+	ymd := site.LastDumped.Format("20060102")
+	tables := siteStageTables[stage]
+	paths := make([]string, 0, len(tables))
+	for _, table := range tables {
+		name := fmt.Sprintf("%s-%s-%s.sql.gz", site.Key, ymd, table)
+		paths = append(paths, filepath.Join(dumps, site.Key, ymd, name))
+	}
+	return paths
+}
+
+// PlanBuild works out what Build would do, without doing it. It goes
+// through the same discovery of dumps and the same checks for files
+// in storage, but only reads file listings.
+func planBuild(ctx context.Context, client *http.Client, cfg *buildConfig, s3 S3) ([]plannedTask, error) {
+	selected := func(stage string) bool {
+		return cfg.Stages == nil || cfg.Stages[stage]
+	}
+
+	manifest, err := loadResumeManifest(ctx, cfg.Bucket, s3)
+	if err != nil {
+		return nil, err
+	}
+
+	plan := make([]plannedTask, 0, 100)
+	var pageviews []string
+	if selected("pageviews") {
+		pageviews, plan, err = planPageviews(ctx, cfg, manifest, s3, plan)
+	} else {
+		pageviews, err = latestStoredPageviews(ctx, cfg, s3)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	sites, err := ReadWikiSites(client, cfg)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(sites.Sites))
+	for key := range sites.Sites {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, stage := range buildStages {
+		if _, ok := siteStageTables[stage]; !ok || !selected(stage) {
+			continue
+		}
+		stored, err := ListStoredFiles(ctx, cfg.Bucket, stage, s3)
+		if err != nil {
+			return nil, err
+		}
+		sizes, err := storedSizes(ctx, cfg.Bucket, stage+"/", s3)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			site := sites.Sites[key]
+			ymd := site.LastDumped.Format("20060102")
+			input := siteDumpIdentity(cfg.Dumps, site)
+			isStored := slices.Contains(stored[key], ymd)
+			if manifest.canSkip(stage, key, input, isStored) {
+				continue
+			}
+			task := plannedTask{Stage: stage, Outputs: []string{site.S3Path(stage)}, OutputBytes: -1}
+			if versions := stored[key]; len(versions) > 0 {
+				prev := fmt.Sprintf("%s/%s-%s-%s.zst", stage, key, versions[len(versions)-1], stage)
+				task.OutputBytes = sizes[prev]
+			}
+			if stage == "titles" {
+				task.Outputs = append(task.Outputs, fmt.Sprintf("redirects/%s-%s-redirects.zst", key, ymd))
+			}
+			for _, path := range siteStageInputs(cfg.Dumps, site, stage) {
+				task.addInput(path)
+			}
+			plan = append(plan, task)
+		}
+	}
+
+	if selected("item_signals") {
+		stored, err := StoredItemSignalsVersion(ctx, cfg, s3)
+		if err != nil {
+			return nil, err
+		}
+		newest := ItemSignalsVersion(pageviews, sites)
+		if newest.After(stored) {
+			sizes, err := storedSizes(ctx, cfg.Bucket, cfg.PublicPrefix+"item_signals-", s3)
+			if err != nil {
+				return nil, err
+			}
+			task := plannedTask{Stage: "item_signals", OutputBytes: -1}
+			dest := cfg.PublicPrefix + fmt.Sprintf("item_signals-%s.csv.zst", newest.Format("20060102"))
+			task.Outputs = []string{dest}
+			if prev := lastKey(sizes); prev != "" {
+				task.OutputBytes = sizes[prev]
+			}
+			plan = append(plan, task)
+		}
+	}
+
+	return plan, nil
+}
+
+// PlanPageviews appends the weekly pageviews files that would get built
+// to plan. The returned pageviews are the storage keys of all weekly
+// files that later stages would read.
+func planPageviews(ctx context.Context, cfg *buildConfig, manifest *resumeManifest, s3 S3, plan []plannedTask) ([]string, []plannedTask, error) {
+	stored, err := storedPageviews(ctx, cfg.Bucket, s3)
+	if err != nil {
+		return nil, nil, err
+	}
+	latest, err := LatestPageviewsDump(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	sizes, err := storedSizes(ctx, cfg.Bucket, "pageviews/", s3)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Weekly pageviews files are all about the same size,
+	// so we estimate by the average of what is in storage.
+	estimate := int64(-1)
+	if len(sizes) > 0 {
+		var total int64
+		for _, size := range sizes {
+			total += size
+		}
+		estimate = total / int64(len(sizes))
+	}
+
+	weeks := pageviewsWeeks(latest, cfg.NumWeeks)
+	pageviews := make([]string, 0, len(weeks))
+	for _, weekString := range weeks {
+		year, week, err := ParseISOWeek(weekString)
+		if err != nil {
+			return nil, nil, err
+		}
+		destPath := "pageviews/pageviews-" + weekString + ".zst"
+		pageviews = append(pageviews, destPath)
+
+		input := weeklyPageviewsIdentity(cfg, year, week)
+		_, found := slices.BinarySearch(stored, weekString)
+		if manifest.canSkip("pageviews", weekString, input, found) {
+			continue
+		}
+		task := plannedTask{Stage: "pageviews", Outputs: []string{destPath}, OutputBytes: estimate}
+		for _, path := range weeklyPageviewsPaths(cfg.Dumps, year, week) {
+			task.addInput(path)
+		}
+		plan = append(plan, task)
+	}
+	sort.Strings(pageviews)
+	return pageviews, plan, nil
+}
+
+// AddInput records that a task would read a dump file.
+// Missing files count as zero bytes.
+func (t *plannedTask) addInput(path string) {
+	t.Inputs = append(t.Inputs, path)
+	if stat, err := os.Stat(path); err == nil {
+		t.InputBytes += stat.Size()
+	}
+}
+
+// StoredSizes returns the sizes of all files in a storage bucket
+// whose keys start with prefix.
+func storedSizes(ctx context.Context, bucket string, prefix string, s3 S3) (map[string]int64, error) {
+	sizes := make(map[string]int64, 100)
+	opts := minio.ListObjectsOptions{Prefix: prefix}
+	for obj := range s3.ListObjects(ctx, bucket, opts) {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		sizes[obj.Key] = obj.Size
+	}
+	return sizes, nil
+}
+
+// LastKey returns the alphabetically last key of a map, or the empty
+// string if the map is empty. For files named by date, this is the
+// most recent one.
+func lastKey(m map[string]int64) string {
+	last := ""
+	for key := range m {
+		if key > last {
+			last = key
+		}
+	}
+	return last
+}
+
+// WritePlan prints a build plan in human-readable form.
+func writePlan(w io.Writer, plan []plannedTask) error {
+	var b strings.Builder
+	var totalIn, totalOut int64
+	unknownOut := 0
+	for i, task := range plan {
+		if i == 0 || plan[i-1].Stage != task.Stage {
+			n := 0
+			for _, t := range plan[i:] {
+				if t.Stage == task.Stage {
+					n += 1
+				}
+			}
+			fmt.Fprintf(&b, "%s: %d to build\n", task.Stage, n)
+		}
+		fmt.Fprintf(&b, "  build %s", strings.Join(task.Outputs, " and "))
+		if len(task.Inputs) > 0 {
+			fmt.Fprintf(&b, ", reading %d dump files (%s)", len(task.Inputs), formatBytes(task.InputBytes))
+		}
+		if task.OutputBytes >= 0 {
+			fmt.Fprintf(&b, ", uploading about %s\n", formatBytes(task.OutputBytes))
+			totalOut += task.OutputBytes
+		} else {
+			b.WriteString(", upload size unknown\n")
+			unknownOut += 1
+		}
+		for _, input := range task.Inputs {
+			fmt.Fprintf(&b, "    read %s\n", input)
+		}
+		totalIn += task.InputBytes
+	}
+
+	if len(plan) == 0 {
+		b.WriteString("nothing to build, everything is up to date\n")
+	} else {
+		fmt.Fprintf(&b, "total: %d to build, reading %s of dumps, uploading about %s", len(plan), formatBytes(totalIn), formatBytes(totalOut))
+		if unknownOut > 0 {
+			fmt.Fprintf(&b, " plus %d files of unknown size", unknownOut)
+		}
+		b.WriteString("\n")
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// FormatBytes formats a byte count for humans, such as "1.5 GiB".
+func formatBytes(n int64) string {
+	if n < 1024 {
+		return fmt.Sprintf("%d B", n)
+	}
+	value := float64(n)
+	units := []string{"KiB", "MiB", "GiB", "TiB"}
+	unit := ""
+	for _, unit = range units {
+		value /= 1024
+		if value < 1024 {
+			break
+		}
+	}
+	return fmt.Sprintf("%.1f %s", value, unit)
+}
@@ -0,0 +1,146 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestPlanBuild(t *testing.T) {
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	ctx := context.Background()
+	cfg := newBuildConfig(filepath.Join("testdata", "dumps"))
+	cfg.NumWeeks = 1
+	s3 := NewFakeS3()
+	s3.data["page_signals/rmwiki-20240301-page_signals.zst"] = []byte("rm")
+	s3.data["titles/rmwiki-20230101-titles.zst"] = []byte("old titles")
+	cfg.Stages = map[string]bool{"page_signals": true, "titles": true}
+	plan, err := planBuild(ctx, nil, cfg, s3)
+	if err == nil {
+		t.Error("planning without pageviews stage should fail when no pageviews are stored")
+	}
+
+	s3.data["pageviews/pageviews-2023-W12.zst"] = []byte("pageviews")
+	plan, err = planBuild(ctx, nil, cfg, s3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, task := range plan {
+		got = append(got, task.Outputs[0])
+	}
+	want := []string{
+		"page_signals/itwikibooks-20240301-page_signals.zst",
+		"page_signals/loginwiki-20240501-page_signals.zst",
+		"page_signals/rmwikibooks-20240301-page_signals.zst",
+		"page_signals/wikidatawiki-20240401-page_signals.zst",
+		"titles/itwikibooks-20240301-titles.zst",
+		"titles/loginwiki-20240501-titles.zst",
+		"titles/rmwiki-20240301-titles.zst",
+		"titles/rmwikibooks-20240301-titles.zst",
+		"titles/wikidatawiki-20240401-titles.zst",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// The size of titles for rmwiki should be estimated
+	// from the previous version in storage.
+	rm := plan[6]
+	if rm.OutputBytes != 10 {
+		t.Errorf("got OutputBytes=%d, want 10", rm.OutputBytes)
+	}
+	wantInputs := []string{
+		filepath.Join(cfg.Dumps, "rmwiki", "20240301", "rmwiki-20240301-page.sql.gz"),
+		filepath.Join(cfg.Dumps, "rmwiki", "20240301", "rmwiki-20240301-redirect.sql.gz"),
+	}
+	if !slices.Equal(rm.Inputs, wantInputs) {
+		t.Errorf("got inputs %v, want %v", rm.Inputs, wantInputs)
+	}
+	if rm.InputBytes <= 0 {
+		t.Errorf("got InputBytes=%d, want positive", rm.InputBytes)
+	}
+}
+
+func TestPlanBuild_Pageviews(t *testing.T) {
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	ctx := context.Background()
+	cfg := newBuildConfig(filepath.Join("testdata", "dumps"))
+	cfg.NumWeeks = 2
+	cfg.Stages = map[string]bool{"pageviews": true}
+	s3 := NewFakeS3()
+	s3.data["pageviews/pageviews-2023-W11.zst"] = []byte("1234")
+	plan, err := planBuild(ctx, nil, cfg, s3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan) != 1 {
+		t.Fatalf("got %d tasks, want 1", len(plan))
+	}
+	task := plan[0]
+	if got := task.Outputs[0]; got != "pageviews/pageviews-2023-W12.zst" {
+		t.Errorf("got output %q", got)
+	}
+	if len(task.Inputs) != 7 {
+		t.Errorf("got %d inputs, want 7 daily dumps", len(task.Inputs))
+	}
+	if task.OutputBytes != 4 {
+		t.Errorf("got OutputBytes=%d, want 4", task.OutputBytes)
+	}
+}
+
+func TestWritePlan(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writePlan(&buf, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := buf.String(); !strings.Contains(got, "up to date") {
+		t.Errorf("empty plan: got %q", got)
+	}
+
+	plan := []plannedTask{
+		{Stage: "titles", Outputs: []string{"titles/a.zst"}, Inputs: []string{"a.sql.gz"}, InputBytes: 2048, OutputBytes: 512},
+		{Stage: "titles", Outputs: []string{"titles/b.zst"}, OutputBytes: -1},
+	}
+	buf.Reset()
+	if err := writePlan(&buf, plan); err != nil {
+		t.Fatal(err)
+	}
+	got := buf.String()
+	for _, want := range []string{
+		"titles: 2 to build\n",
+		"  build titles/a.zst, reading 1 dump files (2.0 KiB), uploading about 512 B\n",
+		"    read a.sql.gz\n",
+		"  build titles/b.zst, upload size unknown\n",
+		"total: 2 to build, reading 2.0 KiB of dumps, uploading about 512 B plus 1 files of unknown size\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("missing %q in %q", want, got)
+		}
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	for _, tc := range []struct {
+		n    int64
+		want string
+	}{
+		{0, "0 B"},
+		{1023, "1023 B"},
+		{1536, "1.5 KiB"},
+		{3 << 30, "3.0 GiB"},
+		{5 << 40, "5.0 TiB"},
+	} {
+		if got := formatBytes(tc.n); got != tc.want {
+			t.Errorf("formatBytes(%d) = %q, want %q", tc.n, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,34 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"net/http"
+	"net/http/pprof"
+)
+
+// NewPprofHandler returns an HTTP handler for capturing CPU and heap
+// profiles of a running build with "go tool pprof". We register the
+// handlers on our own mux instead of http.DefaultServeMux, so the
+// profiles never get exposed on the admin API by accident.
+func newPprofHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return mux
+}
+
+// ServePprof serves profiles on addr in the background. A failure
+// to serve profiles gets logged, but does not stop the build.
+func servePprof(addr string) {
+	go func() {
+		logger.Printf("serving profiles on %s/debug/pprof/", addr)
+		if err := http.ListenAndServe(addr, newPprofHandler()); err != nil {
+			logger.Printf("warning: cannot serve profiles: %v", err)
+		}
+	}()
+}
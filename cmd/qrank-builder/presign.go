@@ -0,0 +1,67 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Presigner is the subset of minio.Client used for presigning URLs.
+type Presigner interface {
+	PresignedGetObject(ctx context.Context, bucketName, objectName string, expiry time.Duration, reqParams url.Values) (*url.URL, error)
+}
+
+// PresignMain implements the "presign" subcommand, which prints
+// time-limited download URLs for release artifacts. This allows
+// sharing pre-release builds from a private bucket.
+//
+// Usage: qrank-builder presign [-expires 24h] public/qrank-20240301.csv.gz ...
+func presignMain(args []string) error {
+	fs := flag.NewFlagSet("presign", flag.ContinueOnError)
+	storagekey := fs.String("storageKey", "", "path to key with storage access credentials")
+	bucket := fs.String("bucket", "qrank", "name of the bucket in object storage")
+	prefix := fs.String("publicPrefix", "public/", "prefix for the storage keys of published files")
+	expires := fs.Duration("expires", 24*time.Hour, "how long the URLs stay valid; at most 7 days")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return fmt.Errorf("usage: qrank-builder presign [flags] key...")
+	}
+
+	client, err := NewStorageClient(*storagekey)
+	if err != nil {
+		return err
+	}
+	return presign(context.Background(), client, *bucket, *prefix, fs.Args(), *expires, os.Stdout)
+}
+
+// Presign writes a presigned download URL for each key, one per line.
+// Keys without a slash are taken relative to prefix, so
+// "qrank-20240301.csv.gz" works as a shorthand.
+func presign(ctx context.Context, p Presigner, bucket string, prefix string, keys []string, expires time.Duration, w io.Writer) error {
+	if expires <= 0 || expires > 7*24*time.Hour {
+		return fmt.Errorf("expiry must be between 0 and 7 days, got %v", expires)
+	}
+	for _, key := range keys {
+		if !strings.Contains(key, "/") {
+			key = prefix + key
+		}
+		u, err := p.PresignedGetObject(ctx, bucket, key, expires, nil)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintln(w, u.String()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/url"
+	"testing"
+	"time"
+)
+
+type fakePresigner struct{}
+
+func (p fakePresigner) PresignedGetObject(ctx context.Context, bucketName, objectName string, expiry time.Duration, reqParams url.Values) (*url.URL, error) {
+	return url.Parse(fmt.Sprintf("https://s3.example.org/%s/%s?X-Amz-Expires=%d", bucketName, objectName, int(expiry.Seconds())))
+}
+
+func TestPresign(t *testing.T) {
+	var buf bytes.Buffer
+	keys := []string{"public/qrank-20240301.csv.gz", "qrank-stats-20240301.json"}
+	if err := presign(context.Background(), fakePresigner{}, "staging", "public/", keys, time.Hour, &buf); err != nil {
+		t.Fatal(err)
+	}
+	got := buf.String()
+	want := "https://s3.example.org/staging/public/qrank-20240301.csv.gz?X-Amz-Expires=3600\n" +
+		"https://s3.example.org/staging/public/qrank-stats-20240301.json?X-Amz-Expires=3600\n"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	if err := presign(context.Background(), fakePresigner{}, "staging", "public/", keys, 8*24*time.Hour, &buf); err == nil {
+		t.Error("expected error for expiry beyond 7 days")
+	}
+}
@@ -0,0 +1,137 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"time"
+)
+
+// BuildStatus describes the state of the current or most recent build.
+type BuildStatus struct {
+	// One of "idle", "running", "succeeded", "failed" or "canceled".
+	State string `json:"state"`
+
+	// Pipeline stage that is currently running, such as "titles".
+	Stage string `json:"stage,omitempty"`
+
+	// For stages that process one task per wiki site, the number
+	// of finished tasks and the total number of tasks in the stage.
+	Done  int `json:"done,omitempty"`
+	Total int `json:"total,omitempty"`
+
+	Started  *time.Time `json:"started,omitempty"`
+	Finished *time.Time `json:"finished,omitempty"`
+	Error    string     `json:"error,omitempty"`
+}
+
+// BuildProgress keeps track of the status of the pipeline, so it can
+// be monitored while running. It is safe to use from multiple goroutines.
+type buildProgress struct {
+	mutex        sync.Mutex
+	status       BuildStatus
+	stageStarted time.Time
+
+	// Time of the last change, for telling whether a build is stuck.
+	updated time.Time
+
+	// How long the finished stages of the current build have taken.
+	timings []stageTiming
+}
+
+// StageTiming tells how long a pipeline stage has taken.
+type stageTiming struct {
+	Stage    string
+	Duration time.Duration
+}
+
+// Progress tracks the status of the build that is running
+// in this process.
+var progress = &buildProgress{status: BuildStatus{State: "idle"}}
+
+// Start records that a new build has started.
+func (p *buildProgress) start() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	now := time.Now().UTC()
+	p.status = BuildStatus{State: "running", Started: &now}
+	p.updated = now
+	p.timings = nil
+}
+
+// SetStage records that the pipeline has entered a new stage.
+// If the stage consists of individual tasks, total is their count;
+// otherwise, total is zero.
+func (p *buildProgress) setStage(stage string, total int) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.observeStage()
+	p.status.Stage = stage
+	p.stageStarted = time.Now()
+	p.updated = p.stageStarted
+	p.status.Done = 0
+	p.status.Total = total
+}
+
+// Advance records that a task of the current stage has finished.
+func (p *buildProgress) advance() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.status.Done += 1
+	p.updated = time.Now()
+}
+
+// Finish records the outcome of a build.
+func (p *buildProgress) finish(err error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	now := time.Now().UTC()
+	p.observeStage()
+	p.status.Finished = &now
+	p.updated = now
+	switch {
+	case err == nil:
+		p.status.State = "succeeded"
+		p.status.Stage = ""
+		p.status.Done, p.status.Total = 0, 0
+	case errors.Is(err, context.Canceled):
+		p.status.State = "canceled"
+	default:
+		p.status.State = "failed"
+		p.status.Error = err.Error()
+	}
+}
+
+// ObserveStage records how long the current stage has taken.
+// The caller must hold the mutex.
+func (p *buildProgress) observeStage() {
+	if p.status.Stage != "" {
+		d := time.Since(p.stageStarted)
+		stageDuration.WithLabelValues(p.status.Stage).Set(d.Seconds())
+		p.timings = append(p.timings, stageTiming{Stage: p.status.Stage, Duration: d})
+	}
+}
+
+// StageTimings returns how long the stages of the current or last
+// build have taken. For a stage that is still running, the result
+// tells how long it has been running so far.
+func (p *buildProgress) stageTimings() []stageTiming {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	timings := slices.Clone(p.timings)
+	if p.status.State == "running" && p.status.Stage != "" {
+		timings = append(timings, stageTiming{Stage: p.status.Stage, Duration: time.Since(p.stageStarted)})
+	}
+	return timings
+}
+
+// Status returns a snapshot of the current status.
+func (p *buildProgress) Status() BuildStatus {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.status
+}
@@ -0,0 +1,196 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"runtime/debug"
+	"slices"
+	"sort"
+	"time"
+)
+
+// Provenance records how a release was built, so that it can be
+// reproduced, and so that discrepancies in the data can be traced
+// back to their inputs. It gets published next to the release files,
+// as provenance-YYYYMMDD.json.
+type provenance struct {
+	Release    string            `json:"release"`
+	Created    time.Time         `json:"created"`
+	Host       string            `json:"host"`
+	Builder    builderInfo       `json:"builder"`
+	Flags      map[string]string `json:"flags"`
+	Parameters map[string]any    `json:"parameters"`
+	Inputs     []provenanceInput `json:"inputs"`
+	Stages     []stageSummary    `json:"stages"`
+}
+
+// BuilderInfo identifies the binary that built a release.
+type builderInfo struct {
+	Module    string `json:"module"`
+	Version   string `json:"version,omitempty"`
+	Commit    string `json:"commit,omitempty"`
+	Time      string `json:"commitTime,omitempty"`
+	Modified  bool   `json:"modified,omitempty"`
+	GoVersion string `json:"goVersion"`
+}
+
+// ProvenanceInput lists the dump files that went into a release,
+// grouped by the dump they belong to.
+type provenanceInput struct {
+	Source string   `json:"source"` // "pageviews", "entities" or a site key like "rmwiki"
+	Date   string   `json:"date"`   // such as "2024-W09" or "2024-03-01"
+	Paths  []string `json:"paths"`
+}
+
+// ProvenanceKey returns the storage key of the provenance manifest
+// for a release whose published files have keys that start with prefix.
+func provenanceKey(prefix string, release time.Time) string {
+	return fmt.Sprintf("%sprovenance-%s.json", prefix, release.Format("20060102"))
+}
+
+// CurrentBuilderInfo tells which binary is running, from the version
+// control information that the Go toolchain embeds into binaries.
+func currentBuilderInfo() builderInfo {
+	info := builderInfo{Module: "github.com/brawer/wikidata-qrank/v2"}
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+	info.Module = bi.Main.Path
+	info.GoVersion = bi.GoVersion
+	if bi.Main.Version != "(devel)" {
+		info.Version = bi.Main.Version
+	}
+	for _, s := range bi.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			info.Commit = s.Value
+		case "vcs.time":
+			info.Time = s.Value
+		case "vcs.modified":
+			info.Modified = s.Value == "true"
+		}
+	}
+	return info
+}
+
+// FlagValues returns the values of all command-line flags. Passwords
+// in URLs, such as in the -notifyIRC flag, get redacted because the
+// manifest is public.
+func flagValues(flags *flag.FlagSet) map[string]string {
+	values := make(map[string]string, 50)
+	flags.VisitAll(func(f *flag.Flag) {
+		value := f.Value.String()
+		if u, err := url.Parse(value); err == nil && u.User != nil {
+			value = u.Redacted()
+		}
+		values[f.Name] = value
+	})
+	return values
+}
+
+// BuildProvenance describes how a release has been built from
+// the given weekly pageviews files and site dumps.
+func buildProvenance(release time.Time, cfg *buildConfig, pageviews []string, sites *WikiSites) (*provenance, error) {
+	host, _ := os.Hostname()
+	p := &provenance{
+		Release: release.Format(time.DateOnly),
+		Created: time.Now().UTC(),
+		Host:    host,
+		Builder: currentBuilderInfo(),
+		Flags:   flagValues(flag.CommandLine),
+		Parameters: map[string]any{
+			"pageviewsWeeks": cfg.NumWeeks,
+		},
+	}
+
+	re := regexp.MustCompile(`^pageviews/pageviews-(\d{4}-W\d{2}).zst$`)
+	for _, pv := range pageviews {
+		match := re.FindStringSubmatch(pv)
+		if match == nil {
+			return nil, fmt.Errorf("unexpected pageviews file: %q", pv)
+		}
+		year, week, err := ParseISOWeek(match[1])
+		if err != nil {
+			return nil, err
+		}
+		p.Inputs = append(p.Inputs, provenanceInput{
+			Source: "pageviews",
+			Date:   match[1],
+			Paths:  weeklyPageviewsPaths(cfg.Dumps, year, week),
+		})
+	}
+
+	keys := make([]string, 0, len(sites.Sites))
+	for key := range sites.Sites {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		site := sites.Sites[key]
+		var paths []string
+		for _, stage := range buildStages {
+			for _, path := range siteStageInputs(cfg.Dumps, site, stage) {
+				if !slices.Contains(paths, path) {
+					paths = append(paths, path)
+				}
+			}
+		}
+		p.Inputs = append(p.Inputs, provenanceInput{
+			Source: key,
+			Date:   site.LastDumped.Format(time.DateOnly),
+			Paths:  paths,
+		})
+	}
+
+	// The provenance manifest gets published before the release stage
+	// runs, but the entities dump that the release stage is going to read
+	// is already known, since it is pinned to the release date.
+	if cfg.needsEntitiesDump() {
+		date, path, err := entitiesDumpAsOf(cfg.Dumps, release)
+		if err != nil {
+			return nil, err
+		}
+		p.Inputs = append(p.Inputs, provenanceInput{
+			Source: "entities",
+			Date:   date.Format(time.DateOnly),
+			Paths:  []string{path},
+		})
+	}
+
+	for _, t := range progress.stageTimings() {
+		p.Stages = append(p.Stages, stageSummary{Stage: t.Stage, Seconds: t.Duration.Seconds()})
+	}
+	return p, nil
+}
+
+// PublishProvenance puts a provenance manifest into storage,
+// with the same userMetadata as the other files of the release.
+func publishProvenance(ctx context.Context, p *provenance, cfg *buildConfig, release time.Time, userMetadata map[string]string, s3 S3) error {
+	file, err := os.CreateTemp("", "*-provenance.json")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	encoder := json.NewEncoder(file)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(p); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	a := artifact{provenanceKey(cfg.PublicPrefix, release), file.Name(), "application/json"}
+	return PublishInStorage(ctx, a, userMetadata, s3, cfg.Bucket)
+}
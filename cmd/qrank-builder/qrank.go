@@ -13,7 +13,6 @@ import (
 	"io"
 	"os"
 	"path/filepath"
-	"runtime"
 	"strconv"
 	"strings"
 	"time"
@@ -52,7 +51,7 @@ func QRankLess(a, b extsort.SortType) bool {
 	}
 }
 
-func buildQRank(date time.Time, qviews string, outDir string, ctx context.Context) (string, error) {
+func buildQRank(date time.Time, qviews string, outDir string, sorting sortSettings, ctx context.Context) (string, error) {
 	qrankPath := filepath.Join(
 		outDir,
 		fmt.Sprintf("qrank-%04d%02d%02d.gz", date.Year(), date.Month(), date.Day()))
@@ -87,10 +86,9 @@ func buildQRank(date time.Time, qviews string, outDir string, ctx context.Contex
 	}
 	defer qviewsFile.Close()
 
-	ch := make(chan extsort.SortType, 50000)
+	ch := make(chan extsort.SortType, sorting.buffer(50000))
 	g, subCtx := errgroup.WithContext(context.Background())
-	config := extsort.DefaultConfig()
-	config.NumWorkers = runtime.NumCPU()
+	config := sorting.newConfig(0, 8)
 	sorter, outChan, errChan := extsort.New(ch, QRankFromBytes, QRankLess, config)
 	g.Go(func() error {
 		return readQViews(brotli.NewReader(qviewsFile), ch, subCtx)
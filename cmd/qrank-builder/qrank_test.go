@@ -14,7 +14,7 @@ func TestBuildQRank(t *testing.T) {
 	qviews := filepath.Join(t.TempDir(), "TestQRank-qviews.br")
 	writeBrotli(qviews, "Q1 1\nQ2 42\nQ3 1\nQ4 77\nQ5 42\n")
 
-	path, err := buildQRank(time.Now(), qviews, t.TempDir(), context.Background())
+	path, err := buildQRank(time.Now(), qviews, t.TempDir(), sortSettings{}, context.Background())
 	if err != nil {
 		t.Error(err)
 		return
@@ -8,11 +8,11 @@ import (
 	"bytes"
 	"context"
 	"encoding/binary"
+	"encoding/json"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
-	"runtime"
 	"strconv"
 	"strings"
 	"time"
@@ -45,16 +45,26 @@ func QViewCountLess(a, b extsort.SortType) bool {
 	return a.(QViewCount).entity < b.(QViewCount).entity
 }
 
-func buildQViews(testRun bool, date time.Time, sitelinks string, pageviews []string, outDir string, ctx context.Context) (string, error) {
+// BuildQViews aggregates pageviews by Wikidata entity. In addition to
+// the qviews file, it writes a JSON file that tells how many views
+// each site has contributed to the ranking, keyed by site such as
+// "en.wikipedia".
+func buildQViews(testRun bool, date time.Time, sitelinks string, pageviews []string, outDir string, sorting sortSettings, ctx context.Context) (string, string, error) {
 	qviewsPath := filepath.Join(
 		outDir,
 		fmt.Sprintf("qviews-%04d%02d%02d.br", date.Year(), date.Month(), date.Day()))
+	siteviewsPath := filepath.Join(
+		outDir,
+		fmt.Sprintf("siteviews-%04d%02d%02d.json", date.Year(), date.Month(), date.Day()))
 	_, err := os.Stat(qviewsPath)
 	if err == nil {
-		return qviewsPath, nil // use pre-existing file
+		_, err = os.Stat(siteviewsPath)
+	}
+	if err == nil {
+		return qviewsPath, siteviewsPath, nil // use pre-existing files
 	}
 	if !os.IsNotExist(err) {
-		return "", err
+		return "", "", err
 	}
 
 	if logger != nil {
@@ -64,7 +74,7 @@ func buildQViews(testRun bool, date time.Time, sitelinks string, pageviews []str
 	tmpQViewsPath := qviewsPath + ".tmp"
 	tmpQViewsFile, err := os.Create(tmpQViewsPath)
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
 	defer tmpQViewsFile.Close()
 
@@ -73,7 +83,7 @@ func buildQViews(testRun bool, date time.Time, sitelinks string, pageviews []str
 
 	sitelinksFile, err := os.Open(sitelinks)
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
 	defer sitelinksFile.Close()
 
@@ -84,34 +94,39 @@ func buildQViews(testRun bool, date time.Time, sitelinks string, pageviews []str
 	for _, pv := range pageviews {
 		pvFile, err := os.Open(pv)
 		if err != nil {
-			return "", err
+			return "", "", err
 		}
 		defer pvFile.Close()
-		qfiles = append(qfiles, brotli.NewReader(pvFile))
+		pvReader, err := newCacheReader(pv, pvFile, nil)
+		if err != nil {
+			return "", "", err
+		}
+		defer pvReader.Close()
+		qfiles = append(qfiles, pvReader)
 		qfilenames = append(qfilenames, pv)
 	}
 
-	ch := make(chan extsort.SortType, 10000)
+	ch := make(chan extsort.SortType, sorting.buffer(10000))
 	g, subCtx := errgroup.WithContext(context.Background())
-	config := extsort.DefaultConfig()
-	config.NumWorkers = runtime.NumCPU()
+	config := sorting.newConfig(0, 8)
 	sorter, outChan, errChan := extsort.New(ch, QViewCountFromBytes, QViewCountLess, config)
+	siteViews := make(map[string]int64, 1000)
 	g.Go(func() error {
-		return readQViewInputs(testRun, qfiles, qfilenames, ch, subCtx)
+		return readQViewInputs(testRun, qfiles, qfilenames, ch, siteViews, subCtx)
 	})
 	g.Go(func() error {
 		sorter.Sort(ctx) // not subCtx, as per extsort docs
 		return nil
 	})
 	if err := g.Wait(); err != nil {
-		return "", err
+		return "", "", err
 	}
 	var entity, count int64
 	for data := range outChan {
 		c := data.(QViewCount)
 		if c.entity != entity {
 			if err := writeQViewCount(qviewsWriter, entity, count); err != nil {
-				return "", err
+				return "", "", err
 			}
 			entity = c.entity
 			count = 0
@@ -119,11 +134,11 @@ func buildQViews(testRun bool, date time.Time, sitelinks string, pageviews []str
 		count += c.count
 	}
 	if err := writeQViewCount(qviewsWriter, entity, count); err != nil {
-		return "", err
+		return "", "", err
 	}
 
 	if err := <-errChan; err != nil {
-		return "", err
+		return "", "", err
 	}
 
 	if err := qviewsWriter.Close(); err != nil {
@@ -136,14 +151,26 @@ func buildQViews(testRun bool, date time.Time, sitelinks string, pageviews []str
 	}
 
 	if err := os.Rename(tmpQViewsPath, qviewsPath); err != nil {
-		return "", err
+		return "", "", err
+	}
+
+	j, err := json.Marshal(siteViews)
+	if err != nil {
+		return "", "", err
+	}
+	tmpSiteviewsPath := siteviewsPath + ".tmp"
+	if err := os.WriteFile(tmpSiteviewsPath, j, 0644); err != nil {
+		return "", "", err
+	}
+	if err := os.Rename(tmpSiteviewsPath, siteviewsPath); err != nil {
+		return "", "", err
 	}
 
 	if logger != nil {
 		logger.Printf("built %s in %.1fs", qviewsPath, time.Since(start).Seconds())
 	}
 
-	return qviewsPath, nil
+	return qviewsPath, siteviewsPath, nil
 }
 
 func writeQViewCount(w io.Writer, entity int64, count int64) error {
@@ -160,7 +187,10 @@ func writeQViewCount(w io.Writer, entity int64, count int64) error {
 	return err
 }
 
-func readQViewInputs(testRun bool, inputs []io.Reader, inputNames []string, ch chan<- extsort.SortType, ctx context.Context) error {
+// ReadQViewInputs merges sitelinks and pageviews, sending the view count
+// of each linked page to a channel. The views also get added up by site
+// into siteViews.
+func readQViewInputs(testRun bool, inputs []io.Reader, inputNames []string, ch chan<- extsort.SortType, siteViews map[string]int64, ctx context.Context) error {
 	defer close(ch)
 	scanners := make([]LineScanner, 0, len(inputs))
 	for _, input := range inputs {
@@ -185,6 +215,9 @@ func readQViewInputs(testRun bool, inputs []io.Reader, inputNames []string, ch c
 		if key != lastKey {
 			if entity > 0 && numViews > 0 {
 				ch <- QViewCount{entity, numViews}
+				if slash := strings.IndexByte(lastKey, '/'); slash > 0 {
+					siteViews[lastKey[:slash]] += numViews
+				}
 			}
 			lastKey = key
 			numViews = 0
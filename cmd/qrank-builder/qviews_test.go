@@ -5,6 +5,7 @@ package main
 
 import (
 	"context"
+	"os"
 	"path/filepath"
 	"testing"
 	"time"
@@ -19,19 +20,19 @@ func TestBuildQViews(t *testing.T) {
 			"az.wikipedia/sürix Q72\n")
 
 	pv1 := filepath.Join(t.TempDir(), "TestQViews-pageviews-1.br")
-	pv2 := filepath.Join(t.TempDir(), "TestQViews-pageviews-2.br")
+	pv2 := filepath.Join(t.TempDir(), "TestQViews-pageviews-2.zst")
 	writeBrotli(pv1,
 		"am.wikipedia/ዙሪክ 7\n"+
 			"az.wikipedia/simona_de_bovuar 2\n")
-	writeBrotli(pv2,
+	writeZstd(pv2,
 		"am.wikipedia/ዙሪክ 1\n"+
 			"az.wikipedia/simona_de_bovuar 58\n"+
 			"az.wikipedia/sürix 5\n"+
 			"ca.wikipedia/winterthur 11\n")
 
-	path, err := buildQViews(false, time.Now(),
+	path, siteviews, err := buildQViews(false, time.Now(),
 		sitelinks, []string{pv1, pv2},
-		t.TempDir(), context.Background())
+		t.TempDir(), sortSettings{}, context.Background())
 	if err != nil {
 		t.Error(err)
 		return
@@ -42,4 +43,14 @@ func TestBuildQViews(t *testing.T) {
 	if expected != got {
 		t.Errorf("expected %q, got %q", expected, got)
 	}
+
+	expected = `{"am.wikipedia":8,"az.wikipedia":65}`
+	buf, err := os.ReadFile(siteviews)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = string(buf)
+	if expected != got {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
 }
@@ -0,0 +1,177 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/lanrat/extsort"
+	"golang.org/x/sync/errgroup"
+)
+
+// The rank index is a binary file that lets the webserver look up
+// rankings without parsing the QRank file. Because all records have
+// a fixed width, the webserver can memory-map the file and find
+// entities by binary search, which needs neither startup time nor
+// much resident memory.
+//
+// The file starts with the four magic bytes "QRIX", followed by the
+// number of ranked entities n as big-endian uint32. Then come n ranking
+// records of 12 bytes, in ranking order: the entity ID (such as 42 for
+// Q42) as big-endian uint32, and its QRank score as big-endian uint64.
+// Finally, there are n entity records of 8 bytes, sorted by entity ID:
+// the entity ID as big-endian uint32, and the position of the entity
+// in the ranking (zero for the highest-ranked entity) as big-endian
+// uint32. The webserver's reader must match this format.
+var rankIndexMagic = []byte("QRIX")
+
+const (
+	rankIndexHeaderSize  = 8
+	rankIndexRankingSize = 12
+	rankIndexEntitySize  = 8
+)
+
+// BuildRankIndex builds the binary rank index for a QRank file.
+func buildRankIndex(date time.Time, qrankPath string, outDir string, sorting sortSettings, ctx context.Context) (string, error) {
+	indexPath := filepath.Join(
+		outDir,
+		fmt.Sprintf("qrank-index-%s.bin", date.Format("20060102")))
+	_, err := os.Stat(indexPath)
+	if err == nil {
+		return indexPath, nil // use pre-existing file
+	}
+	if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	if logger != nil {
+		logger.Printf("building %s", indexPath)
+	}
+	start := time.Now()
+
+	qrankFile, err := os.Open(qrankPath)
+	if err != nil {
+		return "", err
+	}
+	defer qrankFile.Close()
+
+	qrankReader, err := gzip.NewReader(qrankFile)
+	if err != nil {
+		return "", err
+	}
+
+	tmpPath := indexPath + ".tmp"
+	tmpFile, err := os.Create(tmpPath)
+	if err != nil {
+		return "", err
+	}
+	defer tmpFile.Close()
+
+	// We only know the number of entities at the end,
+	// so the header gets written last.
+	if _, err := tmpFile.Seek(rankIndexHeaderSize, 0); err != nil {
+		return "", err
+	}
+	w := bufio.NewWriter(tmpFile)
+
+	config := sorting.newConfig(0, 8)
+	qrankChan := make(chan extsort.SortType, 10000)
+	sortChan := make(chan extsort.SortType, sorting.buffer(10000))
+	sorter, sorted, sortErr := extsort.New(sortChan, QRankFromBytes, QRankEntityLess, config)
+	var count uint32
+	g, subCtx := errgroup.WithContext(ctx)
+	g.Go(func() error {
+		return readQRankCSV(qrankReader, qrankChan, subCtx)
+	})
+	g.Go(func() error {
+		sorter.Sort(ctx) // not subCtx, as per extsort docs
+		return nil
+	})
+	g.Go(func() error {
+		// The sort needs to see all input before producing output,
+		// so the ranking records are all written by the time we
+		// receive the first sorted entity record.
+		n, err := writeRankIndexRankings(qrankChan, sortChan, w)
+		close(sortChan)
+		if err != nil {
+			return err
+		}
+		count = n
+		return writeRankIndexEntities(sorted, w)
+	})
+	if err := g.Wait(); err != nil {
+		return "", err
+	}
+	if err := <-sortErr; err != nil {
+		return "", err
+	}
+
+	if err := w.Flush(); err != nil {
+		return "", err
+	}
+	var header [rankIndexHeaderSize]byte
+	copy(header[:], rankIndexMagic)
+	binary.BigEndian.PutUint32(header[4:], count)
+	if _, err := tmpFile.WriteAt(header[:], 0); err != nil {
+		return "", err
+	}
+	if err := tmpFile.Sync(); err != nil {
+		return "", err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmpPath, indexPath); err != nil {
+		return "", err
+	}
+
+	if logger != nil {
+		logger.Printf("built %s in %.1fs", indexPath, time.Since(start).Seconds())
+	}
+	return indexPath, nil
+}
+
+// WriteRankIndexRankings writes the ranking records of a rank index,
+// and forwards the position of each entity to be sorted by entity ID.
+// The forwarded QRank records carry the position in their Rank field.
+func writeRankIndexRankings(in <-chan extsort.SortType, out chan<- extsort.SortType, w *bufio.Writer) (uint32, error) {
+	var buf [rankIndexRankingSize]byte
+	var pos uint32
+	for rec := range in {
+		qr := rec.(QRank)
+		if qr.Entity > math.MaxUint32 || qr.Rank < 0 {
+			return 0, fmt.Errorf("cannot encode %v in rank index", qr)
+		}
+		binary.BigEndian.PutUint32(buf[0:4], uint32(qr.Entity))
+		binary.BigEndian.PutUint64(buf[4:12], uint64(qr.Rank))
+		if _, err := w.Write(buf[:]); err != nil {
+			return 0, err
+		}
+		out <- QRank{Entity: qr.Entity, Rank: int64(pos)}
+		pos += 1
+	}
+	return pos, nil
+}
+
+// WriteRankIndexEntities writes the entity records of a rank index.
+func writeRankIndexEntities(in <-chan extsort.SortType, w *bufio.Writer) error {
+	var buf [rankIndexEntitySize]byte
+	for rec := range in {
+		qr := rec.(QRank)
+		binary.BigEndian.PutUint32(buf[0:4], uint32(qr.Entity))
+		binary.BigEndian.PutUint32(buf[4:8], uint32(qr.Rank))
+		if _, err := w.Write(buf[:]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBuildRankIndex(t *testing.T) {
+	qrank := filepath.Join(t.TempDir(), "qrank.gz")
+	writeGzipFile(qrank, "Entity,QRank\nQ4,77\nQ2,42\nQ300,42\n")
+	date := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	path, err := buildRankIndex(date, qrank, t.TempDir(), sortSettings{}, context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := filepath.Base(path), "qrank-index-20240301.bin"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := hex.DecodeString("" +
+		"51524958" + "00000003" + // "QRIX", 3 entities
+		"00000004" + "000000000000004d" + // Q4, score 77
+		"00000002" + "000000000000002a" + // Q2, score 42
+		"0000012c" + "000000000000002a" + // Q300, score 42
+		"00000002" + "00000001" + // Q2 at position 1
+		"00000004" + "00000000" + // Q4 at position 0
+		"0000012c" + "00000002") // Q300 at position 2
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("got %x, want %x", got, want)
+	}
+}
+
+func TestBuildRankIndex_Empty(t *testing.T) {
+	qrank := filepath.Join(t.TempDir(), "qrank.gz")
+	writeGzipFile(qrank, "Entity,QRank\n")
+	path, err := buildRankIndex(time.Now(), qrank, t.TempDir(), sortSettings{}, context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte("QRIX\x00\x00\x00\x00"); !bytes.Equal(got, want) {
+		t.Errorf("got %x, want %x", got, want)
+	}
+}
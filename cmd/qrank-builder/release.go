@@ -0,0 +1,439 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"github.com/minio/minio-go/v7"
+)
+
+// BuildRelease derives the published QRank files from the item signals
+// of a release, and puts them into storage next to the item signals.
+// The QRank of an item is its number of pageviews; items without any
+// pageviews are not ranked. If the QRank file of the release is already
+// in storage, nothing gets built.
+func buildRelease(ctx context.Context, cfg *buildConfig, release time.Time, pageviews []string, s3 S3) error {
+	ymd := release.Format("20060102")
+	qrankDest := cfg.PublicPrefix + fmt.Sprintf("qrank-%s.csv.gz", ymd)
+	stored, err := storedSizes(ctx, cfg.Bucket, qrankDest, s3)
+	if err != nil {
+		return err
+	}
+	if _, found := stored[qrankDest]; found {
+		logger.Printf("release %s is already in storage", release.Format(time.DateOnly))
+		return nil
+	}
+
+	outDir, err := os.MkdirTemp("", "release-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(outDir)
+
+	// The item signals and the provenance manifest have already been
+	// published, but their checksums are part of the release.
+	published, err := downloadPublished(ctx, cfg, release, outDir, s3)
+	if err != nil {
+		return err
+	}
+
+	qviews, err := buildItemViews(published[0].src, release, outDir)
+	if err != nil {
+		return err
+	}
+
+	qrank, err := buildQRank(release, qviews, outDir, cfg.Sort, ctx)
+	if err != nil {
+		return err
+	}
+
+	bloom, err := buildBloomFilter(release, qrank, outDir)
+	if err != nil {
+		return err
+	}
+
+	index, err := buildRankIndex(release, qrank, outDir, cfg.Sort, ctx)
+	if err != nil {
+		return err
+	}
+
+	artifacts := []artifact{
+		{qrankDest, qrank, "text/csv"},
+		{cfg.PublicPrefix + fmt.Sprintf("qrank-bloom-%s.bin", ymd), bloom, "application/octet-stream"},
+		{cfg.PublicPrefix + fmt.Sprintf("qrank-index-%s.bin", ymd), index, "application/octet-stream"},
+	}
+
+	for _, top := range topSubsets {
+		topPath, err := buildTopQRank(release, qrank, top.name, top.size, outDir)
+		if err != nil {
+			return err
+		}
+		topDest := cfg.PublicPrefix + fmt.Sprintf("qrank-%s-%s.csv.gz", top.name, ymd)
+		artifacts = append(artifacts, artifact{topDest, topPath, "text/csv"})
+	}
+
+	var extractors []entityExtractor
+	if cfg.ClassStats {
+		extractors = append(extractors, classExtractor())
+	}
+	if cfg.LabelLanguage != "" {
+		extractors = append(extractors, labelExtractor(cfg.LabelLanguage))
+	}
+	if cfg.SplitTypes {
+		extractors = append(extractors, typeExtractor())
+	}
+	extracted, err := scanEntities(ctx, cfg, release, extractors, outDir)
+	if err != nil {
+		return err
+	}
+
+	if labels, ok := extracted["labels-"+cfg.LabelLanguage]; ok {
+		labeled, err := buildLabeledQRank(release, qrank, labels, cfg.LabelLanguage, outDir, cfg.Sort, ctx)
+		if err != nil {
+			return err
+		}
+		labeledDest := cfg.PublicPrefix + fmt.Sprintf("qrank-labels-%s-%s.csv.gz", cfg.LabelLanguage, ymd)
+		artifacts = append(artifacts, artifact{labeledDest, labeled, "text/csv"})
+	}
+
+	delta, err := buildDelta(ctx, cfg, release, qrank, outDir, s3)
+	if err != nil {
+		return err
+	}
+	// If there was no previous release to compare against, delta is empty.
+	if delta != "" {
+		deltaDest := cfg.PublicPrefix + fmt.Sprintf("qrank-delta-%s.csv.gz", ymd)
+		artifacts = append(artifacts, artifact{deltaDest, delta, "text/csv"})
+	}
+
+	history, err := buildHistory(ctx, cfg, release, qrank, outDir, s3)
+	if err != nil {
+		return err
+	}
+	historyDest := cfg.PublicPrefix + fmt.Sprintf("qrank-history-%s.csv.gz", ymd)
+	artifacts = append(artifacts, artifact{historyDest, history, "text/csv"})
+
+	if types, ok := extracted["types"]; ok {
+		typed, err := buildTypedQRank(release, qrank, types, outDir, cfg.Sort, ctx)
+		if err != nil {
+			return err
+		}
+		for _, typ := range entityTypes {
+			path, ok := typed[typ]
+			if !ok {
+				continue
+			}
+			// An empty ranking would fail validation, and hold back
+			// the entire release.
+			empty, err := isEmptyRanking(path)
+			if err != nil {
+				return err
+			}
+			if empty {
+				logger.Printf("no ranked entities of type %s, not publishing %s", typ, path)
+				continue
+			}
+			typedDest := cfg.PublicPrefix + fmt.Sprintf("qrank-%s-%s.csv.gz", typ, ymd)
+			artifacts = append(artifacts, artifact{typedDest, path, "text/csv"})
+		}
+	}
+
+	siteViews, err := downloadSiteViews(ctx, cfg, release, outDir, s3)
+	if err != nil {
+		return err
+	}
+
+	churn, err := computeChurn(ctx, cfg, release, qrank, churnSizes, s3)
+	if err != nil {
+		return err
+	}
+
+	stats, err := buildStats(release, qrank, extracted["types"], siteViews, extracted["classes"], churn, 50, 50, 1000, outDir, cfg.Sort, ctx)
+	if err != nil {
+		return err
+	}
+	statsDest := cfg.PublicPrefix + fmt.Sprintf("qrank-stats-%s.json", ymd)
+	artifacts = append(artifacts, artifact{statsDest, stats, "application/json"})
+
+	sitelinks, err := buildSitelinks(ctx, cfg, release, outDir, s3)
+	if err != nil {
+		return err
+	}
+	sitelinksDest := cfg.PublicPrefix + fmt.Sprintf("qrank-sitelinks-%s.txt.br", ymd)
+	artifacts = append(artifacts, artifact{sitelinksDest, sitelinks, "application/x-brotli"})
+
+	if cfg.Zstd {
+		for _, a := range artifacts {
+			if strings.HasSuffix(a.dest, ".csv.gz") {
+				zst, err := recompressZstd(a.src)
+				if err != nil {
+					return err
+				}
+				dest := strings.TrimSuffix(a.dest, ".gz") + ".zst"
+				artifacts = append(artifacts, artifact{dest, zst, "application/zstd"})
+			}
+		}
+	}
+
+	// The hashes map caches SHA-256 sums by local file path,
+	// to avoid hashing files twice.
+	hashes := make(map[string]string, len(artifacts)+len(published)+3)
+	metadata, err := buildMetadata(release, pageviews, qrank, slices.Concat(artifacts, published), hashes, outDir)
+	if err != nil {
+		return err
+	}
+	metadataDest := cfg.PublicPrefix + fmt.Sprintf("qrank-metadata-%s.json", ymd)
+	artifacts = append(artifacts, artifact{metadataDest, metadata, "application/ld+json"})
+
+	// Along with the release, we publish a file with the SHA-256 sums
+	// of all its files; if we have a signing key, that file also gets
+	// signed.
+	sums := filepath.Join(outDir, fmt.Sprintf("qrank-sha256sums-%s.txt", ymd))
+	if err := writeChecksums(sums, slices.Concat(published, artifacts), hashes); err != nil {
+		return err
+	}
+	sumsDest := cfg.PublicPrefix + fmt.Sprintf("qrank-sha256sums-%s.txt", ymd)
+	artifacts = append(artifacts, artifact{sumsDest, sums, "text/plain"})
+	if cfg.SigningKey != nil {
+		sig, err := signFile(sums, cfg.SigningKey)
+		if err != nil {
+			return err
+		}
+		artifacts = append(artifacts, artifact{sumsDest + ".sig", sig, "application/octet-stream"})
+	}
+
+	meta := releaseMetadata(release, pageviews)
+	if err := publishRelease(ctx, cfg, release, artifacts, meta, s3); err != nil {
+		return err
+	}
+
+	// When backfilling an older release, the "latest" keys must keep
+	// pointing to the newest one.
+	newest, err := PublishedQRankVersion(ctx, cfg, time.Date(9999, 12, 31, 0, 0, 0, 0, time.UTC), s3)
+	if err != nil {
+		return err
+	}
+	latest := !newest.After(release)
+	if latest {
+		err := publishLatest(ctx, slices.Concat(published, artifacts), cfg.Bucket, cfg.PublicPrefix, meta, s3)
+		if err != nil {
+			return err
+		}
+	} else {
+		logger.Printf("not updating latest keys, release %s is newer", newest.Format(time.DateOnly))
+	}
+
+	// Mirroring is best-effort; if the mirror is down, the release
+	// is still available from the primary storage.
+	if cfg.Mirror != nil {
+		files := slices.Concat(published, artifacts[1:], artifacts[:1])
+		if err := mirrorRelease(ctx, cfg, files, latest, meta); err != nil {
+			logger.Printf("warning: mirroring to %s failed: %v", cfg.MirrorBucket, err)
+		}
+	}
+	return nil
+}
+
+// MirrorRelease puts the files of a release into the mirror storage,
+// in the given order. If latest is true, the files also get copied
+// to their "latest" keys on the mirror.
+func mirrorRelease(ctx context.Context, cfg *buildConfig, files []artifact, latest bool, userMetadata map[string]string) error {
+	for _, a := range files {
+		if err := PublishInStorage(ctx, a, userMetadata, cfg.Mirror, cfg.MirrorBucket); err != nil {
+			return err
+		}
+		logger.Printf("mirrored %s to %s", a.dest, cfg.MirrorBucket)
+	}
+	if !latest {
+		return nil
+	}
+	return publishLatest(ctx, files, cfg.MirrorBucket, cfg.PublicPrefix, userMetadata, cfg.Mirror)
+}
+
+// DownloadPublished fetches the files of a release that get published
+// before the release stage, so they can be checksummed along with the
+// other files. The item signals come first in the result. Since older
+// releases have no provenance manifest, it is only included if it
+// is in storage.
+func downloadPublished(ctx context.Context, cfg *buildConfig, release time.Time, outDir string, s3 S3) ([]artifact, error) {
+	ymd := release.Format("20060102")
+	published := []artifact{
+		{cfg.PublicPrefix + fmt.Sprintf("item_signals-%s.csv.zst", ymd), "", "application/zstd"},
+	}
+	provenance := provenanceKey(cfg.PublicPrefix, release)
+	stored, err := storedSizes(ctx, cfg.Bucket, provenance, s3)
+	if err != nil {
+		return nil, err
+	}
+	if _, found := stored[provenance]; found {
+		published = append(published, artifact{provenance, "", "application/json"})
+	}
+
+	for i := range published {
+		a := &published[i]
+		a.src = filepath.Join(outDir, path.Base(a.dest))
+		if err := s3.FGetObject(ctx, cfg.Bucket, a.dest, a.src, minio.GetObjectOptions{}); err != nil {
+			return nil, err
+		}
+	}
+	return published, nil
+}
+
+// DownloadSiteViews fetches the per-site views of a release from
+// storage. Since item signals built by older versions of qrank-builder
+// have no site views, the result is empty if they are not in storage.
+func downloadSiteViews(ctx context.Context, cfg *buildConfig, release time.Time, outDir string, s3 S3) (string, error) {
+	key := siteViewsKey(release)
+	stored, err := storedSizes(ctx, cfg.Bucket, key, s3)
+	if err != nil {
+		return "", err
+	}
+	if _, found := stored[key]; !found {
+		return "", nil
+	}
+	local := filepath.Join(outDir, path.Base(key))
+	if err := s3.FGetObject(ctx, cfg.Bucket, key, local, minio.GetObjectOptions{}); err != nil {
+		return "", err
+	}
+	return local, nil
+}
+
+// ScanEntities runs extractors over the most recent Wikidata entities
+// dump on or before the release date, and returns the paths to their output files, keyed by extractor name.
+// Since the dump is huge, it only gets read if there are extractors.
+func scanEntities(ctx context.Context, cfg *buildConfig, release time.Time, extractors []entityExtractor, outDir string) (map[string]string, error) {
+	extracted := make(map[string]string, len(extractors))
+	if len(extractors) == 0 {
+		return extracted, nil
+	}
+
+	date, path, err := entitiesDumpAsOf(cfg.Dumps, release)
+	if err != nil {
+		return nil, err
+	}
+	_, paths, err := processEntities(false, path, date, extractors, outDir, cfg.Sort, ctx)
+	if err != nil {
+		return nil, err
+	}
+	for i, ex := range extractors {
+		extracted[ex.name] = paths[i]
+	}
+	return extracted, nil
+}
+
+// PublishRelease checks the files of a release and puts them into
+// storage. The QRank file, which comes first in artifacts, gets
+// uploaded last; once it is in storage, the release is complete.
+func publishRelease(ctx context.Context, cfg *buildConfig, release time.Time, artifacts []artifact, userMetadata map[string]string, s3 S3) error {
+	// A corrupt QRank file must never get published.
+	if err := validateRelease(cfg.PublicPrefix, release, artifacts); err != nil {
+		return err
+	}
+	for _, a := range artifacts {
+		if err := validateArtifact(a); err != nil {
+			return err
+		}
+	}
+
+	order := make([]artifact, 0, len(artifacts))
+	order = append(order, artifacts[1:]...)
+	order = append(order, artifacts[0])
+	for _, a := range order {
+		if err := PublishInStorage(ctx, a, userMetadata, s3, cfg.Bucket); err != nil {
+			return err
+		}
+		logger.Printf("published %s", a.dest)
+	}
+	return nil
+}
+
+// IsEmptyRanking tells whether a gzip-compressed ranking file has
+// no rows besides its CSV header.
+func isEmptyRanking(path string) (bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	reader, err := gzip.NewReader(file)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", path, err)
+	}
+	scanner := bufio.NewScanner(reader)
+	scanner.Scan() // Skip CSV header.
+	if scanner.Scan() {
+		return false, nil
+	}
+	return true, scanner.Err()
+}
+
+// BuildItemViews extracts the pageviews of every item from an item
+// signals file, in the format of lines like "Q72 123" that buildQRank
+// reads. Items without pageviews get left out.
+func buildItemViews(signals string, release time.Time, outDir string) (string, error) {
+	reader, err := os.Open(signals)
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+
+	decompressor, err := zstd.NewReader(reader)
+	if err != nil {
+		return "", err
+	}
+	defer decompressor.Close()
+
+	path := filepath.Join(outDir, fmt.Sprintf("qviews-%s.br", release.Format("20060102")))
+	file, err := os.Create(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	writer := brotli.NewWriterLevel(file, 6)
+
+	scanner := bufio.NewScanner(decompressor)
+	scanner.Scan() // Skip CSV header.
+	for scanner.Scan() {
+		cols := strings.SplitN(scanner.Text(), ",", 3)
+		if len(cols) < 2 || len(cols[0]) < 2 {
+			return "", fmt.Errorf("%s: bad line %q", signals, scanner.Text())
+		}
+		item, err := strconv.ParseInt(cols[0][1:], 10, 64)
+		if err != nil {
+			return "", fmt.Errorf("%s: bad item in line %q", signals, scanner.Text())
+		}
+		views, err := strconv.ParseInt(cols[1], 10, 64)
+		if err != nil {
+			return "", fmt.Errorf("%s: bad pageviews in line %q", signals, scanner.Text())
+		}
+		if err := writeQViewCount(writer, item, views); err != nil {
+			return "", err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+
+	if err := writer.Close(); err != nil {
+		return "", err
+	}
+	if err := file.Close(); err != nil {
+		return "", err
+	}
+	return path, nil
+}
@@ -0,0 +1,279 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBuildRelease(t *testing.T) {
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	ctx := context.Background()
+	cfg := newBuildConfig("")
+	s3 := NewFakeS3()
+	header := "item,pageviews_52w,wikitext_bytes,claims,identifiers,sitelinks"
+	s3.WriteLines([]string{header, "Q1,7,0,0,0,0", "Q2,0,0,0,0,0", "Q3,5,0,0,0,0"}, "public/item_signals-20240301.csv.zst")
+	s3.WriteLines([]string{header, "Q1,8,0,0,0,0", "Q2,3,0,0,0,0", "Q3,5,0,0,0,0"}, "public/item_signals-20240401.csv.zst")
+
+	march := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	if err := buildRelease(ctx, cfg, march, nil, s3); err != nil {
+		t.Fatal(err)
+	}
+	got, err := s3.ReadLines("public/qrank-20240301.csv.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"Entity,QRank", "Q1,7", "Q3,5"}; !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if _, found := s3.data["public/qrank-delta-20240301.csv.gz"]; found {
+		t.Error("first release should have no delta")
+	}
+	sums, err := s3.ReadLines("public/qrank-sha256sums-20240301.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sumFiles []string
+	for _, line := range sums {
+		sumFiles = append(sumFiles, line[strings.IndexByte(line, ' ')+2:])
+	}
+	wantSumFiles := []string{
+		"item_signals-20240301.csv.zst",
+		"qrank-20240301.csv.gz",
+		"qrank-bloom-20240301.bin",
+		"qrank-index-20240301.bin",
+		"qrank-top-100k-20240301.csv.gz",
+		"qrank-top-1m-20240301.csv.gz",
+		"qrank-history-20240301.csv.gz",
+		"qrank-stats-20240301.json",
+		"qrank-sitelinks-20240301.txt.br",
+		"qrank-metadata-20240301.json",
+	}
+	if !slices.Equal(sumFiles, wantSumFiles) {
+		t.Errorf("got checksums for %v, want %v", sumFiles, wantSumFiles)
+	}
+
+	april := time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC)
+	if err := buildRelease(ctx, cfg, april, nil, s3); err != nil {
+		t.Fatal(err)
+	}
+	got, err = s3.ReadLines("public/qrank-delta-20240401.csv.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"Entity,OldQRank,NewQRank", "Q1,7,8", "Q2,,3"}; !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	got, err = s3.ReadLines("public/qrank-history-20240401.csv.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"Entity,2024-03-01,2024-04-01", "Q1,7,8", "Q2,,3", "Q3,5,5"}; !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	var stats Stats
+	if err := json.Unmarshal(s3.data["public/qrank-stats-20240401.json"], &stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats.Churn == nil || stats.Churn.Previous != "2024-03-01" {
+		t.Errorf("got churn %+v, want comparison to 2024-03-01", stats.Churn)
+	}
+}
+
+func TestBuildRelease_Backfill(t *testing.T) {
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	ctx := context.Background()
+	cfg := newBuildConfig("")
+	s3 := NewFakeS3()
+	header := "item,pageviews_52w,wikitext_bytes,claims,identifiers,sitelinks"
+	s3.WriteLines([]string{header, "Q1,7,0,0,0,0"}, "public/item_signals-20240301.csv.zst")
+	s3.WriteLines([]string{header, "Q1,8,0,0,0,0"}, "public/item_signals-20240401.csv.zst")
+
+	april := time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC)
+	march := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	for _, release := range []time.Time{april, march} {
+		if err := buildRelease(ctx, cfg, release, nil, s3); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, key := range []string{"qrank-%s.csv.gz", "item_signals-%s.csv.zst"} {
+		latest := "public/" + fmt.Sprintf(key, "latest")
+		april := "public/" + fmt.Sprintf(key, "20240401")
+		if !bytes.Equal(s3.data[latest], s3.data[april]) {
+			t.Errorf("%s should be a copy of %s", latest, april)
+		}
+	}
+}
+
+func TestBuildRelease_Mirror(t *testing.T) {
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	cfg := newBuildConfig("")
+	mirror := NewFakeS3()
+	cfg.Mirror = mirror
+	s3 := NewFakeS3()
+	header := "item,pageviews_52w,wikitext_bytes,claims,identifiers,sitelinks"
+	s3.WriteLines([]string{header, "Q1,7,0,0,0,0"}, "public/item_signals-20240301.csv.zst")
+
+	march := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	if err := buildRelease(context.Background(), cfg, march, nil, s3); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{
+		"public/item_signals-20240301.csv.zst",
+		"public/qrank-20240301.csv.gz",
+		"public/qrank-latest.csv.gz",
+		"public/qrank-sha256sums-20240301.txt",
+	} {
+		if !bytes.Equal(mirror.data[key], s3.data[key]) {
+			t.Errorf("%s not mirrored", key)
+		}
+	}
+}
+
+func TestBuildRelease_MirrorFailure(t *testing.T) {
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	cfg := newBuildConfig("")
+	cfg.Mirror = &corruptingS3{FakeS3: NewFakeS3(), numCorrupt: 1000}
+	s3 := NewFakeS3()
+	header := "item,pageviews_52w,wikitext_bytes,claims,identifiers,sitelinks"
+	s3.WriteLines([]string{header, "Q1,7,0,0,0,0"}, "public/item_signals-20240301.csv.zst")
+
+	march := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	if err := buildRelease(context.Background(), cfg, march, nil, s3); err != nil {
+		t.Fatal(err)
+	}
+	if _, found := s3.data["public/qrank-20240301.csv.gz"]; !found {
+		t.Error("release should be published despite mirror failure")
+	}
+}
+
+func TestBuildRelease_Signed(t *testing.T) {
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	cfg := newBuildConfig("")
+	cfg.SigningKey = ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+	s3 := NewFakeS3()
+	header := "item,pageviews_52w,wikitext_bytes,claims,identifiers,sitelinks"
+	s3.WriteLines([]string{header, "Q1,7,0,0,0,0"}, "public/item_signals-20240301.csv.zst")
+	s3.data["public/provenance-20240301.json"] = []byte(`{"Release":"2024-03-01"}`)
+
+	march := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	if err := buildRelease(context.Background(), cfg, march, nil, s3); err != nil {
+		t.Fatal(err)
+	}
+	sums := s3.data["public/qrank-sha256sums-20240301.txt"]
+	if !bytes.Contains(sums, []byte("  provenance-20240301.json\n")) {
+		t.Errorf("checksums should cover the provenance manifest, got %q", sums)
+	}
+	sig := s3.data["public/qrank-sha256sums-20240301.txt.sig"]
+	if !ed25519.Verify(cfg.SigningKey.Public().(ed25519.PublicKey), sums, sig) {
+		t.Error("bad signature of checksums")
+	}
+}
+
+func TestBuildRelease_AlreadyStored(t *testing.T) {
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	s3 := NewFakeS3()
+	s3.data["public/qrank-20240301.csv.gz"] = []byte("stored")
+	march := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	if err := buildRelease(context.Background(), newBuildConfig(""), march, nil, s3); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(s3.data["public/qrank-20240301.csv.gz"]); got != "stored" {
+		t.Errorf("stored release should not have been rebuilt, got %q", got)
+	}
+}
+
+func TestBuildRelease_EntitiesDump(t *testing.T) {
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	cfg := newBuildConfig(addEntitiesDump(t, t.TempDir()))
+	cfg.LabelLanguage = "en"
+	cfg.SplitTypes = true
+	cfg.ClassStats = true
+	s3 := NewFakeS3()
+	header := "item,pageviews_52w,wikitext_bytes,claims,identifiers,sitelinks"
+	s3.WriteLines([]string{header, "Q7,3,0,0,0,0", "Q58921,5,0,0,0,0", "Q58942,9,0,0,0,0"}, "public/item_signals-20240301.csv.zst")
+	s3.data["item_signals/siteviews-20240301.json"] = []byte(`{"en.wikipedia":12,"ko.wikipedia":5}`)
+
+	march := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	if err := buildRelease(context.Background(), cfg, march, nil, s3); err != nil {
+		t.Fatal(err)
+	}
+	got, err := s3.ReadLines("public/qrank-labels-en-20240301.csv.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"Entity,Label,QRank",
+		"Q58942,Paldang Station,9",
+		"Q58921,Temminck's Stint,5",
+		"Q7,,3",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	got, err = s3.ReadLines("public/qrank-taxon-20240301.csv.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"Entity,QRank", "Q58921,5"}; !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	for _, typ := range []string{"human", "place", "work"} {
+		key := fmt.Sprintf("public/qrank-%s-20240301.csv.gz", typ)
+		if _, found := s3.data[key]; found {
+			t.Errorf("%s: empty ranking should not be published", key)
+		}
+	}
+
+	var stats Stats
+	if err := json.Unmarshal(s3.data["public/qrank-stats-20240301.json"], &stats); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := stats.Types["taxon"], (TypeStats{Ranked: 1}); got != want {
+		t.Errorf("got %+v for taxa, want %+v", got, want)
+	}
+	wantSites := []SiteStats{{"en.wikipedia", 12}, {"ko.wikipedia", 5}}
+	if !slices.Equal(stats.Sites, wantSites) {
+		t.Errorf("got sites %v, want %v", stats.Sites, wantSites)
+	}
+	wantTop := map[string][]Sample{"taxon": {{"Q58921", float64(2), float64(5)}}}
+	if !reflect.DeepEqual(stats.TopEntities, wantTop) {
+		t.Errorf("got top entities %v, want %v", stats.TopEntities, wantTop)
+	}
+}
+
+// AddEntitiesDump puts a small Wikidata entities dump into a dumps
+// directory, and returns the path to the directory.
+func addEntitiesDump(t *testing.T, dumps string) string {
+	dir := filepath.Join(dumps, "wikidatawiki", "entities", "20240226")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile("testdata/twenty_entities.json.bz2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "wikidata-20240226-all.json.bz2"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	latest := filepath.Join(dumps, "wikidatawiki", "entities", "latest-all.json.bz2")
+	if err := os.Symlink(filepath.Join("20240226", "wikidata-20240226-all.json.bz2"), latest); err != nil {
+		t.Fatal(err)
+	}
+	return dumps
+}
@@ -0,0 +1,198 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// ResumeManifestKey is the storage key of the manifest that records
+// which parts of a build have already been completed.
+const resumeManifestKey = "internal/qrank-builder/progress.json"
+
+// ResumeManifest records the completed units of work of each stage,
+// such as the weeks of the "pageviews" stage or the wikis of the
+// "titles" stage, together with the identity of the input dumps from
+// which each unit was built. A restarted build skips every unit whose
+// inputs are still the same, and redoes those whose dumps have changed
+// since. The manifest gets written to storage after every completed
+// unit, so a crash loses at most the work in progress.
+type resumeManifest struct {
+	s3       S3
+	bucket   string
+	mutex    sync.Mutex
+	readOnly bool                         // if true, the manifest only gets updated in memory
+	Stages   map[string]map[string]string `json:"stages"`
+}
+
+// LoadResumeManifest reads the manifest from a storage bucket. If there
+// is no manifest yet, the result is an empty manifest.
+func loadResumeManifest(ctx context.Context, bucket string, s3 S3) (*resumeManifest, error) {
+	m := &resumeManifest{s3: s3, bucket: bucket, Stages: make(map[string]map[string]string)}
+
+	// Not all storage implementations report missing objects in the same
+	// way, so we list instead of trying to read a possibly missing file.
+	found := false
+	opts := minio.ListObjectsOptions{Prefix: resumeManifestKey}
+	for obj := range s3.ListObjects(ctx, bucket, opts) {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		if obj.Key == resumeManifestKey {
+			found = true
+		}
+	}
+	if !found {
+		return m, nil
+	}
+
+	r, err := NewS3Reader(ctx, bucket, resumeManifestKey, s3)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("%s: %w", resumeManifestKey, err)
+	}
+	if m.Stages == nil {
+		m.Stages = make(map[string]map[string]string)
+	}
+	return m, nil
+}
+
+// Done tells whether a unit of work has already been completed
+// from the same input.
+func (m *resumeManifest) done(stage, unit, input string) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	got, ok := m.Stages[stage][unit]
+	return ok && got == input
+}
+
+// Complete records that a unit of work has been completed,
+// and writes the updated manifest to storage.
+func (m *resumeManifest) complete(ctx context.Context, stage, unit, input string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	units, ok := m.Stages[stage]
+	if !ok {
+		units = make(map[string]string)
+		m.Stages[stage] = units
+	}
+	units[unit] = input
+	return m.save(ctx)
+}
+
+// Save writes the manifest to storage. The caller must hold the mutex.
+func (m *resumeManifest) save(ctx context.Context) error {
+	if m.readOnly {
+		return nil
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	temp, err := os.CreateTemp("", "progress-*.json")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+	if _, err := temp.Write(data); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+
+	opts := minio.PutObjectOptions{ContentType: "application/json"}
+	_, err = m.s3.FPutObject(ctx, m.bucket, resumeManifestKey, temp.Name(), opts)
+	return err
+}
+
+// DumpIdentity returns a fingerprint of a set of dump files, built
+// from their names, sizes and modification times. If Wikimedia
+// re-publishes a dump, for example after fixing a broken one,
+// its fingerprint changes. Missing files are part of the fingerprint,
+// so a unit built from incomplete dumps gets redone once the
+// missing files appear.
+func dumpIdentity(paths []string) string {
+	h := sha256.New()
+	for _, path := range paths {
+		if stat, err := os.Stat(path); err == nil {
+			fmt.Fprintf(h, "%s\t%d\t%d\n", path, stat.Size(), stat.ModTime().Unix())
+		} else {
+			fmt.Fprintf(h, "%s\tmissing\n", path)
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// CanSkip tells whether a unit of work needs no rebuilding, given
+// whether its output is stored. Units without output always need to
+// be built. If the manifest knows the unit, it gets skipped if its
+// input is still the same; otherwise, the dump has been re-published
+// since, and the unit gets rebuilt. Units that the manifest does not
+// know, such as those left behind by builds from before the manifest
+// existed, get adopted into the manifest, which remembers them with
+// the next save.
+func (m *resumeManifest) canSkip(stage, unit, input string, stored bool) bool {
+	if !stored {
+		return false
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if got, ok := m.Stages[stage][unit]; ok {
+		return got == input
+	}
+	units, ok := m.Stages[stage]
+	if !ok {
+		units = make(map[string]string)
+		m.Stages[stage] = units
+	}
+	units[unit] = input
+	return true
+}
+
+// Retain forgets all units of a stage that are not in the given list,
+// so the manifest does not keep growing over time.
+func (m *resumeManifest) retain(stage string, units []string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for unit := range m.Stages[stage] {
+		if !slices.Contains(units, unit) {
+			delete(m.Stages[stage], unit)
+		}
+	}
+}
+
+// SiteDumpIdentity returns a fingerprint of the database dump
+// of a wiki site, covering all the files in its dump directory.
+func siteDumpIdentity(dumps string, site *WikiSite) string {
+	dir := filepath.Join(dumps, site.Key, site.LastDumped.Format("20060102"))
+	entries, _ := os.ReadDir(dir)
+	paths := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if !e.IsDir() {
+			paths = append(paths, filepath.Join(dir, e.Name()))
+		}
+	}
+	return dumpIdentity(paths)
+}
@@ -0,0 +1,111 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestResumeManifest(t *testing.T) {
+	ctx := context.Background()
+	s3 := NewFakeS3()
+	m, err := loadResumeManifest(ctx, "qrank", s3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.canSkip("titles", "rmwiki", "abc", false) {
+		t.Error("unit without stored output should not be skipped")
+	}
+	if err := m.complete(ctx, "titles", "rmwiki", "abc"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A restarted build should see what got completed before.
+	m, err = loadResumeManifest(ctx, "qrank", s3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		unit, input string
+		stored      bool
+		want        bool
+	}{
+		{"rmwiki", "abc", true, true},
+		{"rmwiki", "abc", false, false},
+		{"rmwiki", "def", true, false},
+		{"gswiki", "ghi", false, false},
+	} {
+		got := m.canSkip("titles", tc.unit, tc.input, tc.stored)
+		if got != tc.want {
+			t.Errorf("canSkip(%q, %q, %v) = %v, want %v", tc.unit, tc.input, tc.stored, got, tc.want)
+		}
+	}
+}
+
+func TestResumeManifest_AdoptStored(t *testing.T) {
+	ctx := context.Background()
+	m, err := loadResumeManifest(ctx, "qrank", NewFakeS3())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !m.canSkip("pageviews", "2023-W10", "abc", true) {
+		t.Error("unknown unit with stored output should be skipped")
+	}
+	if got := m.Stages["pageviews"]["2023-W10"]; got != "abc" {
+		t.Errorf("stored unit should be adopted, got %q", got)
+	}
+}
+
+func TestResumeManifest_Retain(t *testing.T) {
+	ctx := context.Background()
+	s3 := NewFakeS3()
+	m, err := loadResumeManifest(ctx, "qrank", s3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, week := range []string{"2023-W09", "2023-W10", "2023-W11"} {
+		if err := m.complete(ctx, "pageviews", week, "x"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m.retain("pageviews", []string{"2023-W10", "2023-W11", "2023-W12"})
+	if _, ok := m.Stages["pageviews"]["2023-W09"]; ok {
+		t.Error("retain() should drop 2023-W09")
+	}
+	if len(m.Stages["pageviews"]) != 2 {
+		t.Errorf("got %v, want two weeks", m.Stages["pageviews"])
+	}
+}
+
+func TestDumpIdentity(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "foo.sql.gz")
+	missing := dumpIdentity([]string{path})
+	if err := os.WriteFile(path, []byte("foo"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	first := dumpIdentity([]string{path})
+	if first == missing {
+		t.Error("dumpIdentity() should change when a missing file appears")
+	}
+	if again := dumpIdentity([]string{path}); again != first {
+		t.Errorf("dumpIdentity() not stable: %q vs %q", first, again)
+	}
+
+	// Simulate Wikimedia re-publishing a dump.
+	if err := os.WriteFile(path, []byte("fixed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if dumpIdentity([]string{path}) == first {
+		t.Error("dumpIdentity() should change when a dump gets re-published")
+	}
+}
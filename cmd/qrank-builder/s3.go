@@ -10,6 +10,7 @@ import (
 	"os"
 	"regexp"
 	"sort"
+	"strings"
 
 	"github.com/minio/minio-go/v7"
 	//"github.com/minio/minio-go/v7/pkg/credentials"
@@ -20,13 +21,25 @@ import (
 // We define our own interface for easier testing, so we only have to fake
 // those parts of the (rather big) S3 interface that we actually use.
 // A fake implementation for tests is in FakeS3, implemented in s3_test.go.
+// For running outside of a cloud, LocalStorage implements the interface
+// on top of a plain directory.
 type S3 interface {
+	BucketExists(ctx context.Context, bucketName string) (bool, error)
 	ListObjects(ctx context.Context, bucketName string, opts minio.ListObjectsOptions) <-chan minio.ObjectInfo
+	StatObject(ctx context.Context, bucketName, objectName string, opts minio.StatObjectOptions) (minio.ObjectInfo, error)
+	CopyObject(ctx context.Context, dst minio.CopyDestOptions, src minio.CopySrcOptions) (minio.UploadInfo, error)
+	ComposeObject(ctx context.Context, dst minio.CopyDestOptions, srcs ...minio.CopySrcOptions) (minio.UploadInfo, error)
 	RemoveObject(ctx context.Context, bucketName string, objectName string, opts minio.RemoveObjectOptions) error
 	FGetObject(ctx context.Context, bucketName, objectName, filePath string, opts minio.GetObjectOptions) error
 	FPutObject(ctx context.Context, bucketName, objectName, filePath string, opts minio.PutObjectOptions) (minio.UploadInfo, error)
 }
 
+// MaxCopyObjectSize is the size limit of S3 for copying an object
+// on the server side in a single request. Larger objects need to get
+// copied in parts with ComposeObject, which does not preserve headers
+// such as Content-Type. This is a variable so that tests can lower it.
+var maxCopyObjectSize int64 = 5 << 30
+
 type tempFileReader struct {
 	file *os.File
 }
@@ -92,6 +105,14 @@ func NewS3Reader(ctx context.Context, bucket string, path string, s3 S3) (io.Rea
 		return nil, err
 	}
 	tempPath := temp.Name()
+
+	// Intermediate files that we have written ourselves carry
+	// a checksum, so a truncated upload gets noticed right here
+	// instead of silently producing a corrupt release.
+	if err := verifyCacheFile(tempPath); err != nil {
+		os.Remove(tempPath)
+		return nil, fmt.Errorf("%s/%s: %w", bucket, path, err)
+	}
 	temp, err = os.Open(tempPath)
 	if err != nil {
 		os.Remove(tempPath)
@@ -103,17 +124,80 @@ func NewS3Reader(ctx context.Context, bucket string, path string, s3 S3) (io.Rea
 
 // PutInStorage stores a file in S3 storage.
 func PutInStorage(ctx context.Context, file string, s3 S3, bucket string, dest string, contentType string) error {
-	options := minio.PutObjectOptions{ContentType: contentType}
-	_, err := s3.FPutObject(ctx, bucket, dest, file, options)
+	ctx, span := startSpan(ctx, "upload", "key", dest, "bytes", fileSizes([]string{file}))
+	options := minio.PutObjectOptions{ContentType: contentType, PartSize: uploadPartSize}
+	err := putVerified(ctx, file, s3, bucket, dest, options)
+	span.finish(err)
 	return err
 }
 
-// ListStoredFiles returns what files are available in S3 storage.
-func ListStoredFiles(ctx context.Context, filename string, s3 S3) (map[string][]string, error) {
+// PublishInStorage stores a published file in S3 storage. Unlike
+// PutInStorage, which is for our internal files, this sets the headers
+// that clients and CDNs need for handling the file, and it attaches
+// userMetadata to the stored object.
+//
+// To make sure that consumers never see a half-written file, we first
+// upload to a temporary key, and then copy the object to its final key
+// on the server side. The copy keeps the headers and metadata. Files
+// above maxCopyObjectSize cannot be copied in one request, so they get
+// uploaded straight to their final key; S3 makes such large multipart
+// uploads visible only once they are complete.
+func PublishInStorage(ctx context.Context, a artifact, userMetadata map[string]string, s3 S3, bucket string) (err error) {
+	size := fileSizes([]string{a.src})
+	ctx, span := startSpan(ctx, "upload", "key", a.dest, "bytes", size)
+	defer func() { span.finish(err) }()
+
+	if size > maxCopyObjectSize {
+		return putVerified(ctx, a.src, s3, bucket, a.dest, putOptions(a, userMetadata))
+	}
+
+	tmpDest := uploadTempPrefix + a.dest
+	if err := putVerified(ctx, a.src, s3, bucket, tmpDest, putOptions(a, userMetadata)); err != nil {
+		return err
+	}
+	dst := minio.CopyDestOptions{Bucket: bucket, Object: a.dest}
+	src := minio.CopySrcOptions{Bucket: bucket, Object: tmpDest}
+	if _, err := s3.CopyObject(ctx, dst, src); err != nil {
+		return err
+	}
+	if _, err := verifySize(ctx, bucket, a.dest, a.src, s3); err != nil {
+		return err
+	}
+	return s3.RemoveObject(ctx, bucket, tmpDest, minio.RemoveObjectOptions{})
+}
+
+// PutVerified uploads a file to S3 storage and checks that the stored
+// object matches the local file. Large files get uploaded in multiple
+// parts; since opts.PartSize is set to uploadPartSize, we can predict
+// the ETag of the stored object. If the object does not match our local
+// file, we delete it and try again, up to three times in total.
+func putVerified(ctx context.Context, file string, s3 S3, bucket string, dest string, opts minio.PutObjectOptions) error {
+	for attempt := 1; ; attempt++ {
+		_, err := s3.FPutObject(ctx, bucket, dest, file, opts)
+		if err == nil {
+			err = verifyUpload(ctx, bucket, dest, file, s3)
+		}
+		if err == nil {
+			return nil
+		}
+		if attempt >= 3 {
+			return err
+		}
+		logger.Printf("warning: upload of %s/%s failed, retrying: %v", bucket, dest, err)
+		if _, statErr := s3.StatObject(ctx, bucket, dest, minio.StatObjectOptions{}); statErr == nil {
+			if err := s3.RemoveObject(ctx, bucket, dest, minio.RemoveObjectOptions{}); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// ListStoredFiles returns what files are available in a bucket of S3 storage.
+func ListStoredFiles(ctx context.Context, bucket string, filename string, s3 S3) (map[string][]string, error) {
 	re := regexp.MustCompile(fmt.Sprintf(`^%s/([a-z0-9_\-]+)-(\d{8})-%s.zst$`, filename, filename))
 	result := make(map[string][]string, 1000)
 	opts := minio.ListObjectsOptions{Prefix: filename + "/"}
-	for obj := range s3.ListObjects(ctx, "qrank", opts) {
+	for obj := range s3.ListObjects(ctx, bucket, opts) {
 		if obj.Err != nil {
 			return nil, obj.Err
 		}
@@ -130,3 +214,39 @@ func ListStoredFiles(ctx context.Context, filename string, s3 S3) (map[string][]
 	}
 	return result, nil
 }
+
+// PreconditionFailed returns the error that S3 sends back for
+// conditional requests whose condition does not hold.
+func preconditionFailed(objectName string) error {
+	return minio.ErrorResponse{
+		Code:       "PreconditionFailed",
+		Message:    "At least one of the pre-conditions you specified did not hold",
+		Key:        objectName,
+		StatusCode: 412,
+	}
+}
+
+// IsPreconditionFailed tells whether a conditional request failed
+// because its condition did not hold.
+func isPreconditionFailed(err error) bool {
+	return minio.ToErrorResponse(err).Code == "PreconditionFailed"
+}
+
+// PutPreconditionsHold evaluates the If-Match and If-None-Match
+// conditions of a put request, given the ETag of the object that
+// currently exists in storage, or "" if there is none. We need this
+// for implementing conditional puts in LocalStorage and FakeS3.
+func putPreconditionsHold(opts minio.PutObjectOptions, etag string) bool {
+	header := opts.Header()
+	if m := header.Get("If-Match"); m != "" {
+		if etag == "" || (m != "*" && strings.Trim(m, `"`) != etag) {
+			return false
+		}
+	}
+	if m := header.Get("If-None-Match"); m != "" {
+		if etag != "" && (m == "*" || strings.Trim(m, `"`) == etag) {
+			return false
+		}
+	}
+	return true
+}
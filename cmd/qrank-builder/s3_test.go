@@ -5,93 +5,117 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/md5"
+	"encoding/hex"
 	"fmt"
 	"io"
+	"log"
 	"os"
+	"path/filepath"
 	"reflect"
 	"slices"
 	"strings"
 	"sync"
 	"testing"
 
+	"github.com/andybalholm/brotli"
 	"github.com/klauspost/compress/zstd"
 	"github.com/minio/minio-go/v7"
 )
 
+// FakeS3 is an in-memory implementation of the S3 interface, with a single
+// bucket called "qrank", for unit tests.
 type FakeS3 struct {
 	data  map[string][]byte
+	opts  map[string]minio.PutObjectOptions
 	mutex sync.RWMutex
 }
 
 func NewFakeS3() *FakeS3 {
 	fake := &FakeS3{
 		data: make(map[string][]byte, 10),
+		opts: make(map[string]minio.PutObjectOptions, 10),
 	}
 	return fake
 }
 
-func (s3 *FakeS3) ReadLines(path string) ([]string, error) {
+func (s3 *FakeS3) BucketExists(ctx context.Context, bucketName string) (bool, error) {
+	return bucketName == "qrank", nil
+}
+
+func (s3 *FakeS3) StatObject(ctx context.Context, bucketName, objectName string, opts minio.StatObjectOptions) (minio.ObjectInfo, error) {
 	s3.mutex.RLock()
 	defer s3.mutex.RUnlock()
 
-	data, ok := s3.data[path]
-	if !ok {
-		return nil, fmt.Errorf("file not found: %s", path)
+	if bucketName != "qrank" {
+		return minio.ObjectInfo{}, fmt.Errorf(`unexpected bucket "%s"`, bucketName)
 	}
-
-	var buf bytes.Buffer
-	if strings.HasSuffix(path, ".zst") {
-		decoder, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(0))
-		if err != nil {
-			return nil, err
-		}
-		defer decoder.Close()
-		data, err = decoder.DecodeAll(data, nil)
-		if err != nil {
-			return nil, err
-		}
+	data, ok := s3.data[objectName]
+	if !ok {
+		return minio.ObjectInfo{}, fmt.Errorf("object not found: %s", objectName)
 	}
-	if _, err := buf.Write(data); err != nil {
-		return nil, err
+	sum := md5.Sum(data)
+	info := minio.ObjectInfo{
+		Key:  objectName,
+		Size: int64(len(data)),
+		ETag: hex.EncodeToString(sum[:]),
 	}
-
-	s := strings.TrimSuffix(string(data), "\n")
-	return strings.Split(s, "\n"), nil
+	return info, nil
 }
 
-func (s3 *FakeS3) WriteLines(lines []string, path string) error {
+func (s3 *FakeS3) CopyObject(ctx context.Context, dst minio.CopyDestOptions, src minio.CopySrcOptions) (minio.UploadInfo, error) {
 	s3.mutex.Lock()
 	defer s3.mutex.Unlock()
 
-	var buf bytes.Buffer
-	var writer io.WriteCloser
-	var err error
-	if strings.HasSuffix(path, ".zst") {
-		zstdLevel := zstd.WithEncoderLevel(zstd.SpeedFastest)
-		writer, err = zstd.NewWriter(&buf, zstdLevel)
-		if err != nil {
-			return err
+	if src.Bucket != "qrank" || dst.Bucket != "qrank" {
+		return minio.UploadInfo{}, fmt.Errorf("unexpected bucket")
+	}
+	data, ok := s3.data[src.Object]
+	if !ok {
+		return minio.UploadInfo{}, fmt.Errorf("object not found: %s", src.Object)
+	}
+	if int64(len(data)) > maxCopyObjectSize {
+		return minio.UploadInfo{}, fmt.Errorf("object too large for copying: %s", src.Object)
+	}
+	s3.data[dst.Object] = data
+	if dst.ReplaceMetadata {
+		s3.opts[dst.Object] = minio.PutObjectOptions{
+			ContentType:     dst.ContentType,
+			ContentEncoding: dst.ContentEncoding,
+			CacheControl:    dst.CacheControl,
+			UserMetadata:    dst.UserMetadata,
 		}
 	} else {
-		writer = NopWriteCloser(&buf)
+		s3.opts[dst.Object] = s3.opts[src.Object]
 	}
+	return minio.UploadInfo{Bucket: dst.Bucket, Key: dst.Object, Size: int64(len(data))}, nil
+}
 
-	for _, line := range lines {
-		if _, err := writer.Write([]byte(line)); err != nil {
-			return err
+// ComposeObject concatenates the source objects. Like S3, it does not
+// keep the headers of the source.
+func (s3 *FakeS3) ComposeObject(ctx context.Context, dst minio.CopyDestOptions, srcs ...minio.CopySrcOptions) (minio.UploadInfo, error) {
+	s3.mutex.Lock()
+	defer s3.mutex.Unlock()
+
+	if dst.Bucket != "qrank" {
+		return minio.UploadInfo{}, fmt.Errorf("unexpected bucket")
+	}
+	var data []byte
+	for _, src := range srcs {
+		if src.Bucket != "qrank" {
+			return minio.UploadInfo{}, fmt.Errorf("unexpected bucket")
 		}
-		if _, err := writer.Write([]byte("\n")); err != nil {
-			return err
+		part, ok := s3.data[src.Object]
+		if !ok {
+			return minio.UploadInfo{}, fmt.Errorf("object not found: %s", src.Object)
 		}
+		data = append(data, part...)
 	}
-
-	if err := writer.Close(); err != nil {
-		return err
-	}
-
-	s3.data[path] = buf.Bytes()
-	return nil
+	s3.data[dst.Object] = data
+	s3.opts[dst.Object] = minio.PutObjectOptions{UserMetadata: dst.UserMetadata}
+	return minio.UploadInfo{Bucket: dst.Bucket, Key: dst.Object, Size: int64(len(data))}, nil
 }
 
 func (s3 *FakeS3) ListObjects(ctx context.Context, bucketName string, opts minio.ListObjectsOptions) <-chan minio.ObjectInfo {
@@ -103,9 +127,9 @@ func (s3 *FakeS3) ListObjects(ctx context.Context, bucketName string, opts minio
 		defer close(ch)
 		prefix := opts.Prefix
 		if bucketName == "qrank" {
-			for key, _ := range s3.data {
+			for key, value := range s3.data {
 				if strings.HasPrefix(key, prefix) {
-					ch <- minio.ObjectInfo{Key: key}
+					ch <- minio.ObjectInfo{Key: key, Size: int64(len(value))}
 				}
 			}
 		}
@@ -166,15 +190,123 @@ func (s3 *FakeS3) FPutObject(ctx context.Context, bucketName, objectName, filePa
 		return info, fmt.Errorf("unexpected bucket %v", bucketName)
 	}
 
+	var etag string
+	if data, ok := s3.data[objectName]; ok {
+		sum := md5.Sum(data)
+		etag = hex.EncodeToString(sum[:])
+	}
+	if !putPreconditionsHold(opts, etag) {
+		return info, preconditionFailed(objectName)
+	}
+
 	file, err := os.ReadFile(filePath)
 	if err != nil {
 		return info, err
 	}
 
 	s3.data[objectName] = file
+	s3.opts[objectName] = opts
 	return info, nil
 }
 
+func (s3 *FakeS3) ReadLines(path string) ([]string, error) {
+	s3.mutex.RLock()
+	defer s3.mutex.RUnlock()
+
+	data, ok := s3.data[path]
+	if !ok {
+		return nil, fmt.Errorf("file not found: %s", path)
+	}
+
+	var buf bytes.Buffer
+	if strings.HasSuffix(path, ".zst") {
+		decoder, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(0))
+		if err != nil {
+			return nil, err
+		}
+		defer decoder.Close()
+		data, err = decoder.DecodeAll(data, nil)
+		if err != nil {
+			return nil, err
+		}
+	} else if strings.HasSuffix(path, ".gz") {
+		decoder, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		data, err = io.ReadAll(decoder)
+		if err != nil {
+			return nil, err
+		}
+	} else if strings.HasSuffix(path, ".br") {
+		var err error
+		data, err = io.ReadAll(brotli.NewReader(bytes.NewReader(data)))
+		if err != nil {
+			return nil, err
+		}
+	}
+	if _, err := buf.Write(data); err != nil {
+		return nil, err
+	}
+
+	s := strings.TrimSuffix(string(data), "\n")
+	return strings.Split(s, "\n"), nil
+}
+
+func (s3 *FakeS3) WriteLines(lines []string, path string) error {
+	s3.mutex.Lock()
+	defer s3.mutex.Unlock()
+
+	var buf bytes.Buffer
+	var writer io.WriteCloser
+	var err error
+	if strings.HasSuffix(path, ".zst") {
+		zstdLevel := zstd.WithEncoderLevel(zstd.SpeedFastest)
+		writer, err = zstd.NewWriter(&buf, zstdLevel)
+		if err != nil {
+			return err
+		}
+	} else {
+		writer = NopWriteCloser(&buf)
+	}
+
+	for _, line := range lines {
+		if _, err := writer.Write([]byte(line)); err != nil {
+			return err
+		}
+		if _, err := writer.Write([]byte("\n")); err != nil {
+			return err
+		}
+	}
+
+	if err := writer.Close(); err != nil {
+		return err
+	}
+
+	s3.data[path] = buf.Bytes()
+	return nil
+}
+
+// CorruptingS3 wraps a FakeS3 and truncates the first uploads,
+// for testing how we recover from broken transfers.
+type corruptingS3 struct {
+	*FakeS3
+	numCorrupt int
+	numPuts    int
+}
+
+func (s3 *corruptingS3) FPutObject(ctx context.Context, bucketName, objectName, filePath string, opts minio.PutObjectOptions) (minio.UploadInfo, error) {
+	info, err := s3.FakeS3.FPutObject(ctx, bucketName, objectName, filePath, opts)
+	s3.numPuts += 1
+	if err == nil && s3.numPuts <= s3.numCorrupt {
+		s3.mutex.Lock()
+		data := s3.data[objectName]
+		s3.data[objectName] = data[:len(data)/2]
+		s3.mutex.Unlock()
+	}
+	return info, err
+}
+
 type testingWriteCloser struct {
 	writer io.Writer
 	closed bool
@@ -231,6 +363,99 @@ func TestReadWriteLinest(t *testing.T) {
 	}
 }
 
+func TestPutInStorage_Retry(t *testing.T) {
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "hello.txt")
+	if err := os.WriteFile(path, []byte("Hello, world"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s3 := &corruptingS3{FakeS3: NewFakeS3(), numCorrupt: 2}
+	if err := PutInStorage(ctx, path, s3, "qrank", "hello.txt", "text/plain"); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(s3.data["hello.txt"]); got != "Hello, world" {
+		t.Errorf("got %q, want %q", got, "Hello, world")
+	}
+	if s3.numPuts != 3 {
+		t.Errorf("got %d uploads, want 3", s3.numPuts)
+	}
+
+	s3 = &corruptingS3{FakeS3: NewFakeS3(), numCorrupt: 3}
+	if err := PutInStorage(ctx, path, s3, "qrank", "hello.txt", "text/plain"); err == nil {
+		t.Error("expected error after three failed uploads")
+	}
+}
+
+func TestPublishInStorage(t *testing.T) {
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	path := filepath.Join(t.TempDir(), "qrank.gz")
+	writeGzipFile(path, "Entity,QRank\nQ42,7\n")
+	a := artifact{"public/qrank-20240301.csv.gz", path, "text/csv"}
+	meta := map[string]string{"Release": "2024-03-01"}
+
+	s3 := NewFakeS3()
+	if err := PublishInStorage(context.Background(), a, meta, s3, "qrank"); err != nil {
+		t.Fatal(err)
+	}
+	opts := s3.opts[a.dest]
+	if opts.ContentType != "text/csv" || opts.ContentEncoding != "gzip" || opts.CacheControl != immutableCacheControl {
+		t.Errorf("got %+v", opts)
+	}
+	if opts.UserMetadata["Release"] != "2024-03-01" {
+		t.Errorf("got metadata %v", opts.UserMetadata)
+	}
+	for key := range s3.data {
+		if strings.HasPrefix(key, uploadTempPrefix) {
+			t.Errorf("temporary upload %s should have been removed", key)
+		}
+	}
+}
+
+// The published key must only appear once the file has been completely
+// uploaded; a broken transfer must not be visible to consumers.
+func TestPublishInStorage_BrokenUpload(t *testing.T) {
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	path := filepath.Join(t.TempDir(), "qrank.gz")
+	writeGzipFile(path, "Entity,QRank\nQ42,7\n")
+	a := artifact{"public/qrank-20240301.csv.gz", path, "text/csv"}
+
+	s3 := &corruptingS3{FakeS3: NewFakeS3(), numCorrupt: 3}
+	if err := PublishInStorage(context.Background(), a, nil, s3, "qrank"); err == nil {
+		t.Fatal("expected error after three failed uploads")
+	}
+	if _, found := s3.data[a.dest]; found {
+		t.Errorf("%s should not be visible after a broken upload", a.dest)
+	}
+}
+
+// Files that are too large for a server-side copy get uploaded
+// straight to their final key, with the same headers.
+func TestPublishInStorage_Large(t *testing.T) {
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	defer func(size int64) { maxCopyObjectSize = size }(maxCopyObjectSize)
+	maxCopyObjectSize = 10
+	path := filepath.Join(t.TempDir(), "qrank.gz")
+	writeGzipFile(path, "Entity,QRank\nQ42,7\n")
+	a := artifact{"public/qrank-20240301.csv.gz", path, "text/csv"}
+
+	s3 := NewFakeS3()
+	if err := PublishInStorage(context.Background(), a, nil, s3, "qrank"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := s3.ReadLines(a.dest); err != nil || !slices.Equal(got, []string{"Entity,QRank", "Q42,7"}) {
+		t.Errorf("got %v, %v", got, err)
+	}
+	opts := s3.opts[a.dest]
+	if opts.ContentType != "text/csv" || opts.ContentEncoding != "gzip" || opts.CacheControl != immutableCacheControl {
+		t.Errorf("got %+v", opts)
+	}
+	if len(s3.data) != 1 {
+		t.Errorf("got %d objects in storage, want 1", len(s3.data))
+	}
+}
+
 func TestListStoredFiles(t *testing.T) {
 	s3 := NewFakeS3()
 	for _, path := range []string{
@@ -241,7 +466,7 @@ func TestListStoredFiles(t *testing.T) {
 	} {
 		s3.data[path] = []byte("content")
 	}
-	got, err := ListStoredFiles(context.Background(), "page_signals", s3)
+	got, err := ListStoredFiles(context.Background(), "qrank", "page_signals", s3)
 	if err != nil {
 		t.Error(err)
 	}
@@ -253,3 +478,30 @@ func TestListStoredFiles(t *testing.T) {
 		t.Errorf("got %v, want %v", got, want)
 	}
 }
+
+func TestNewS3Reader_Truncated(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := newCacheWriter(&buf, zstd.SpeedFastest, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(w, "en.wikipedia,3422,7\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	s3 := NewFakeS3()
+	s3.data["pageviews/pageviews-2024-W09.zst"] = buf.Bytes()
+	s3.data["pageviews/pageviews-2024-W10.zst"] = buf.Bytes()[:buf.Len()-3]
+	r, err := NewS3Reader(ctx, "qrank", "pageviews/pageviews-2024-W09.zst", s3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+	if _, err := NewS3Reader(ctx, "qrank", "pageviews/pageviews-2024-W10.zst", s3); err == nil {
+		t.Error("expected error for truncated file")
+	}
+}
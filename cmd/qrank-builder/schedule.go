@@ -0,0 +1,291 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CronSchedule tells when to check for new dumps. It is parsed from
+// a cron expression with five fields (minute, hour, day of month,
+// month, day of week), such as "17 */4 * * *", or from one of the
+// shorthands "@hourly", "@daily", "@weekly" and "@monthly". Times
+// are in UTC, like the Wikimedia dumps.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64 // bit sets
+
+	// As in classic cron, if both day fields are restricted,
+	// a day matches if it matches either of them.
+	domStar, dowStar bool
+}
+
+var cronShorthands = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+func parseCronSchedule(expr string) (*cronSchedule, error) {
+	s := strings.TrimSpace(expr)
+	if full, ok := cronShorthands[s]; ok {
+		s = full
+	}
+	fields := strings.Fields(s)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("bad schedule %q: expected 5 fields", expr)
+	}
+
+	// Like Vixie cron, we treat "*/2" as unrestricted for this rule.
+	c := &cronSchedule{
+		domStar: strings.HasPrefix(fields[2], "*"),
+		dowStar: strings.HasPrefix(fields[4], "*"),
+	}
+	for i, f := range []struct {
+		bits     *uint64
+		min, max int
+	}{
+		{&c.minute, 0, 59},
+		{&c.hour, 0, 23},
+		{&c.dom, 1, 31},
+		{&c.month, 1, 12},
+		{&c.dow, 0, 7},
+	} {
+		bits, err := parseCronField(fields[i], f.min, f.max)
+		if err != nil {
+			return nil, fmt.Errorf("bad schedule %q: %w", expr, err)
+		}
+		*f.bits = bits
+	}
+
+	// Both 0 and 7 stand for Sunday.
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+	return c, nil
+}
+
+// ParseCronField parses a comma-separated list of values, ranges
+// such as "1-5", and steps such as "*/15" or "0-30/10".
+func parseCronField(s string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(s, ",") {
+		rng, stepStr, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			n, err := strconv.Atoi(stepStr)
+			if err != nil || n < 1 {
+				return 0, fmt.Errorf("bad step %q", part)
+			}
+			step = n
+		}
+
+		lo, hi := min, max
+		if rng != "*" {
+			loStr, hiStr, isRange := strings.Cut(rng, "-")
+			var err error
+			if lo, err = strconv.Atoi(loStr); err != nil {
+				return 0, fmt.Errorf("bad value %q", part)
+			}
+			hi = lo
+			if isRange {
+				if hi, err = strconv.Atoi(hiStr); err != nil {
+					return 0, fmt.Errorf("bad range %q", part)
+				}
+			} else if hasStep {
+				hi = max // "5/15" means "5-max/15"
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("%q out of range %d-%d", part, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << v
+		}
+	}
+	return bits, nil
+}
+
+// Next returns the first scheduled time after t, or the zero time
+// if the schedule never fires, as for "0 0 31 2 *".
+func (c *cronSchedule) Next(t time.Time) time.Time {
+	t = t.UTC().Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		y, m, d := t.Date()
+		switch {
+		case c.month&(1<<uint(m)) == 0:
+			t = time.Date(y, m+1, 1, 0, 0, 0, 0, time.UTC)
+		case !c.dayMatches(t):
+			t = time.Date(y, m, d+1, 0, 0, 0, 0, time.UTC)
+		case c.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(y, m, d, t.Hour()+1, 0, 0, 0, time.UTC)
+		case c.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func (c *cronSchedule) dayMatches(t time.Time) bool {
+	domMatch := c.dom&(1<<uint(t.Day())) != 0
+	dowMatch := c.dow&(1<<uint(t.Weekday())) != 0
+	if c.domStar || c.dowStar {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
+
+// DumpsVersion identifies the input data that is available for
+// building. When any of the dates change, there is something new
+// to build.
+type dumpsVersion struct {
+	Pageviews time.Time `json:"pageviews"`
+	Sites     time.Time `json:"sites"`
+}
+
+// ReadDumpsVersion looks up the most recent pageviews and the most
+// recent database dump of any Wikimedia site.
+func readDumpsVersion(dumps string) (dumpsVersion, error) {
+	var v dumpsVersion
+	cfg := newBuildConfig(dumps)
+	pageviews, err := LatestPageviewsDump(cfg)
+	if err != nil {
+		return v, err
+	}
+	v.Pageviews = pageviews
+
+	// Without an HTTP client, ReadWikiSites does not fetch interwiki
+	// maps, which we do not need for finding dump dates.
+	sites, err := ReadWikiSites(nil, cfg)
+	if err != nil {
+		return v, err
+	}
+	for _, site := range sites.Sites {
+		if site.LastDumped.After(v.Sites) {
+			v.Sites = site.LastDumped
+		}
+	}
+	return v, nil
+}
+
+// Scheduler keeps the builder running as a long-lived job, which
+// checks for new dumps at the times of a cron schedule and builds
+// whenever some have appeared. The version of the last successfully
+// built dumps is stored in a small state file, so a restarted job
+// does not build the same dumps again.
+type scheduler struct {
+	schedule  *cronSchedule
+	statePath string
+	version   func() (dumpsVersion, error)
+	build     func(ctx context.Context) error
+	now       func() time.Time
+}
+
+func newScheduler(schedule *cronSchedule, statePath string, dumps string, build func(ctx context.Context) error) *scheduler {
+	return &scheduler{
+		schedule:  schedule,
+		statePath: statePath,
+		version:   func() (dumpsVersion, error) { return readDumpsVersion(dumps) },
+		build:     build,
+		now:       time.Now,
+	}
+}
+
+// Run checks for new dumps according to the schedule until the
+// context gets canceled. Failed checks and builds get logged, and
+// retried at the next scheduled time.
+func (s *scheduler) Run(ctx context.Context) error {
+	for {
+		next := s.schedule.Next(s.now())
+		if next.IsZero() {
+			return fmt.Errorf("schedule never fires")
+		}
+		if logger != nil {
+			logger.Printf("next check for new dumps at %s", next.Format(time.RFC3339))
+		}
+
+		timer := time.NewTimer(next.Sub(s.now()))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+
+		if _, err := s.check(ctx); err != nil && logger != nil {
+			logger.Printf("error: scheduled build failed: %v", err)
+		}
+	}
+}
+
+// Check builds if there are new dumps, returning whether it did.
+func (s *scheduler) check(ctx context.Context) (bool, error) {
+	v, err := s.version()
+	if err != nil {
+		return false, err
+	}
+
+	built, err := s.readState()
+	if err != nil {
+		return false, err
+	}
+	if v == built {
+		if logger != nil {
+			logger.Printf("no new dumps since last build")
+		}
+		return false, nil
+	}
+
+	if logger != nil {
+		logger.Printf("found new dumps, pageviews=%s sites=%s; starting build",
+			v.Pageviews.Format(time.DateOnly), v.Sites.Format(time.DateOnly))
+	}
+	progress.start()
+	err = s.build(ctx)
+	progress.finish(err)
+	if err != nil {
+		return true, err
+	}
+	return true, s.writeState(v)
+}
+
+func (s *scheduler) readState() (dumpsVersion, error) {
+	var v dumpsVersion
+	data, err := os.ReadFile(s.statePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return v, nil
+	} else if err != nil {
+		return v, err
+	}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return v, fmt.Errorf("%s: %w", s.statePath, err)
+	}
+	return v, nil
+}
+
+func (s *scheduler) writeState(v dumpsVersion) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	tmpPath := s.statePath + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, s.statePath)
+}
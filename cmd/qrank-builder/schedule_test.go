@@ -0,0 +1,172 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseCronSchedule_Errors(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"a * * * *",
+		"@sometimes",
+	} {
+		if _, err := parseCronSchedule(expr); err == nil {
+			t.Errorf("parseCronSchedule(%q): expected error, got nil", expr)
+		}
+	}
+}
+
+func TestCronSchedule_Next(t *testing.T) {
+	for _, tc := range []struct {
+		expr, now, want string
+	}{
+		{"@hourly", "2024-03-01T10:15:30Z", "2024-03-01T11:00:00Z"},
+		{"@daily", "2024-03-01T10:15:00Z", "2024-03-02T00:00:00Z"},
+		{"@weekly", "2024-03-01T10:15:00Z", "2024-03-03T00:00:00Z"},
+		{"@monthly", "2024-12-15T10:15:00Z", "2025-01-01T00:00:00Z"},
+		{"*/15 * * * *", "2024-03-01T10:15:00Z", "2024-03-01T10:30:00Z"},
+		{"17 */4 * * *", "2024-03-01T10:15:00Z", "2024-03-01T12:17:00Z"},
+		{"0 9-17/4 * * *", "2024-03-01T13:00:00Z", "2024-03-01T17:00:00Z"},
+		{"30 6 * * 1-5", "2024-03-01T07:00:00Z", "2024-03-04T06:30:00Z"},
+		{"0 0 * * 7", "2024-03-01T07:00:00Z", "2024-03-03T00:00:00Z"},
+		{"0 0 29 2 *", "2024-03-01T00:00:00Z", "2028-02-29T00:00:00Z"},
+		{"0 0 1,15 * *", "2024-03-02T00:00:00Z", "2024-03-15T00:00:00Z"},
+
+		// If both day fields are restricted, either one may match.
+		{"0 0 13 * 5", "2024-03-02T00:00:00Z", "2024-03-08T00:00:00Z"},
+		{"0 0 13 * 5", "2024-03-09T00:00:00Z", "2024-03-13T00:00:00Z"},
+
+		// February 31 never happens.
+		{"0 0 31 2 *", "2024-03-01T00:00:00Z", "0001-01-01T00:00:00Z"},
+
+		// Times in other zones get converted to UTC.
+		{"0 12 * * *", "2024-03-01T13:00:00+02:00", "2024-03-01T12:00:00Z"},
+	} {
+		c, err := parseCronSchedule(tc.expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		now, err := time.Parse(time.RFC3339, tc.now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := c.Next(now).Format(time.RFC3339); got != tc.want {
+			t.Errorf("%q.Next(%s): got %s, want %s", tc.expr, tc.now, got, tc.want)
+		}
+	}
+}
+
+func TestScheduler_Check(t *testing.T) {
+	version := dumpsVersion{
+		Pageviews: time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC),
+		Sites:     time.Date(2024, 2, 20, 0, 0, 0, 0, time.UTC),
+	}
+	builds := 0
+	buildErr := errors.New("disk full")
+	var failBuild bool
+	s := &scheduler{
+		statePath: filepath.Join(t.TempDir(), "schedule.json"),
+		version:   func() (dumpsVersion, error) { return version, nil },
+		build: func(ctx context.Context) error {
+			builds++
+			if failBuild {
+				return buildErr
+			}
+			return nil
+		},
+		now: time.Now,
+	}
+	ctx := context.Background()
+
+	// A failed build should get retried at the next check.
+	failBuild = true
+	if built, err := s.check(ctx); !built || err != buildErr {
+		t.Errorf("got %v, %v; want true, %v", built, err, buildErr)
+	}
+	failBuild = false
+	for i, want := range []bool{true, false, false} {
+		built, err := s.check(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if built != want {
+			t.Errorf("check #%d: got %v, want %v", i, built, want)
+		}
+	}
+
+	version.Pageviews = version.Pageviews.AddDate(0, 0, 1)
+	if built, err := s.check(ctx); !built || err != nil {
+		t.Errorf("got %v, %v; want true, nil after new dumps appeared", built, err)
+	}
+	if builds != 3 {
+		t.Errorf("got %d builds, want 3", builds)
+	}
+
+	// A scheduler with the same state file should remember the build.
+	restarted := *s
+	if built, err := restarted.check(ctx); built || err != nil {
+		t.Errorf("after restart: got %v, %v; want false, nil", built, err)
+	}
+}
+
+func TestScheduler_Run(t *testing.T) {
+	schedule, err := parseCronSchedule("* * * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Pretend that a minute boundary is just 10 milliseconds away.
+	now := time.Date(2024, 3, 1, 10, 14, 59, 990_000_000, time.UTC)
+	s := &scheduler{
+		schedule:  schedule,
+		statePath: filepath.Join(t.TempDir(), "schedule.json"),
+		version: func() (dumpsVersion, error) {
+			cancel()
+			return dumpsVersion{}, errors.New("no dumps")
+		},
+		now: func() time.Time { return now },
+	}
+
+	done := make(chan error)
+	go func() { done <- s.Run(ctx) }()
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Errorf("got %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("scheduler did not check for dumps")
+	}
+}
+
+func TestReadDumpsVersion(t *testing.T) {
+	got, err := readDumpsVersion(filepath.Join("testdata", "dumps"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := dumpsVersion{
+		Pageviews: time.Date(2023, 3, 26, 0, 0, 0, 0, time.UTC),
+		Sites:     time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC),
+	}
+	if got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
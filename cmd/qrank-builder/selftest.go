@@ -0,0 +1,289 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"embed"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/minio/minio-go/v7"
+)
+
+// SelftestData holds small dumps, with a handful of pages each,
+// and the output that building from them must produce.
+//
+//go:embed testdata/dumps testdata/interwikimap.php.txt testdata/selftest
+var selftestData embed.FS
+
+func selftestMain(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("selftest", flag.ContinueOnError)
+	verbose := fs.Bool("verbose", false, "if true, write the logs of the pipeline to stderr")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		return fmt.Errorf("usage: qrank-builder selftest [-verbose]")
+	}
+
+	logger = log.New(io.Discard, "", 0)
+	if *verbose {
+		logger = log.New(os.Stderr, "", log.Ltime|log.Lshortfile)
+	}
+	return selftest(ctx, os.Stdout)
+}
+
+// Selftest runs the entire pipeline on the small dumps that are built
+// into the binary, with storage in a temporary directory, and checks
+// the result against the expected output. This takes a few seconds,
+// so a new binary can be checked before deploying it for a build that
+// runs many hours.
+func selftest(ctx context.Context, w io.Writer) error {
+	start := time.Now()
+	dir, err := os.MkdirTemp("", "qrank-selftest-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	dumps := filepath.Join(dir, "dumps")
+	if err := extractSelftestDumps(dumps); err != nil {
+		return err
+	}
+
+	// The self test must not depend on any settings for production,
+	// so it builds with the defaults.
+	cfg := newBuildConfig(dumps)
+	cfg.NumWeeks = 1
+	if err := os.MkdirAll(filepath.Join(dir, "storage", cfg.Bucket), 0755); err != nil {
+		return err
+	}
+	s3 := NewLocalStorage(filepath.Join(dir, "storage"))
+	client := &http.Client{Transport: selftestTransport{}}
+	if err := Build(ctx, client, cfg, s3); err != nil {
+		return fmt.Errorf("selftest: build failed: %w", err)
+	}
+
+	var golden []string
+	for _, pattern := range []string{"testdata/selftest/*.csv", "testdata/selftest/*.json"} {
+		g, err := fs.Glob(selftestData, pattern)
+		if err != nil {
+			return err
+		}
+		golden = append(golden, g...)
+	}
+	for _, g := range golden {
+		key, err := selftestOutputKey(ctx, cfg.Bucket, cfg.PublicPrefix+path.Base(g), s3)
+		if err != nil {
+			return err
+		}
+		if err := checkSelftestOutput(ctx, cfg.Bucket, key, g, dumps, s3); err != nil {
+			return fmt.Errorf("selftest: %w", err)
+		}
+	}
+
+	numStored := 0
+	for obj := range s3.ListObjects(ctx, cfg.Bucket, minio.ListObjectsOptions{Recursive: true}) {
+		if obj.Err != nil {
+			return obj.Err
+		}
+		numStored += 1
+	}
+	_, err = fmt.Fprintf(w, "selftest passed in %.1fs: stored %d files, checked %d against golden files\n", time.Since(start).Seconds(), numStored, len(golden))
+	return err
+}
+
+// SelftestOutputKey returns the storage key of a published file,
+// which may or may not be compressed. For a golden file named
+// qrank-20240501.csv, the build publishes qrank-20240501.csv.gz,
+// but item_signals-20240501.csv gets published with zstd. If the
+// build has not published the file at all, the result is the key
+// of the uncompressed file, so the caller can report it as missing.
+func selftestOutputKey(ctx context.Context, bucket string, key string, s3 S3) (string, error) {
+	stored, err := storedSizes(ctx, bucket, key, s3)
+	if err != nil {
+		return "", err
+	}
+	for _, ext := range []string{".zst", ".gz"} {
+		if _, found := stored[key+ext]; found {
+			return key + ext, nil
+		}
+	}
+	return key, nil
+}
+
+// CheckSelftestOutput compares a file in a storage bucket with an
+// embedded golden file, line by line. Files whose key ends in .zst
+// or .gz get decompressed first. For the provenance manifest, we
+// only compare what stays the same from one run to the next;
+// see normalizeSelftestProvenance.
+func checkSelftestOutput(ctx context.Context, bucket string, key string, golden string, dumps string, s3 S3) error {
+	want, err := selftestData.ReadFile(golden)
+	if err != nil {
+		return err
+	}
+	wantLines := strings.Split(strings.TrimSuffix(string(want), "\n"), "\n")
+
+	stored, err := storedSizes(ctx, bucket, key, s3)
+	if err != nil {
+		return err
+	}
+	if _, found := stored[key]; !found {
+		return fmt.Errorf("build did not produce %s", key)
+	}
+	r, err := NewS3Reader(ctx, bucket, key, s3)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	var content io.Reader = r
+	switch path.Ext(key) {
+	case ".zst":
+		decompressor, err := zstd.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer decompressor.Close()
+		content = decompressor
+	case ".gz":
+		decompressor, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer decompressor.Close()
+		content = decompressor
+	}
+	got, err := io.ReadAll(content)
+	if err != nil {
+		return err
+	}
+	if strings.HasPrefix(path.Base(key), "provenance-") {
+		if got, err = normalizeSelftestProvenance(got, dumps); err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+	}
+
+	gotLines := strings.Split(strings.TrimSuffix(string(got), "\n"), "\n")
+	for i, line := range gotLines {
+		if i >= len(wantLines) {
+			return fmt.Errorf("%s: unexpected line %d: %q", key, i+1, line)
+		}
+		if line != wantLines[i] {
+			return fmt.Errorf("%s:%d: got %q, want %q", key, i+1, line, wantLines[i])
+		}
+	}
+	if len(gotLines) < len(wantLines) {
+		return fmt.Errorf("%s: got %d lines, want %d", key, len(gotLines), len(wantLines))
+	}
+	return nil
+}
+
+// NormalizeSelftestProvenance reduces a provenance manifest to the
+// parts that do not change from one run to the next. The creation time,
+// host, binary, command-line flags and stage timings get dropped, and
+// the paths of the inputs are made relative to the dumps directory.
+func normalizeSelftestProvenance(data []byte, dumps string) ([]byte, error) {
+	var p provenance
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, err
+	}
+	for i := range p.Inputs {
+		for j, path := range p.Inputs[i].Paths {
+			if rel, err := filepath.Rel(dumps, path); err == nil {
+				p.Inputs[i].Paths[j] = filepath.ToSlash(rel)
+			}
+		}
+	}
+	stable := struct {
+		Release    string            `json:"release"`
+		Parameters map[string]any    `json:"parameters"`
+		Inputs     []provenanceInput `json:"inputs"`
+	}{p.Release, p.Parameters, p.Inputs}
+	return json.MarshalIndent(stable, "", "  ")
+}
+
+// ExtractSelftestDumps writes the embedded dumps into a directory.
+// Since Go does not embed symbolic links, we re-create the "latest"
+// links from a list in testdata/selftest/latest-links.txt.
+func extractSelftestDumps(dir string) error {
+	root := "testdata/dumps"
+	err := fs.WalkDir(selftestData, root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dir, filepath.FromSlash(strings.TrimPrefix(p, root)))
+		if d.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+		data, err := selftestData.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(target, data, 0644)
+	})
+	if err != nil {
+		return err
+	}
+
+	links, err := selftestLinks()
+	if err != nil {
+		return err
+	}
+	for name, target := range links {
+		linkPath := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(linkPath), 0755); err != nil {
+			return err
+		}
+		if err := os.Symlink(filepath.FromSlash(target), linkPath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SelftestLinks returns the symbolic links in the embedded dumps,
+// keyed by their path relative to the dumps directory.
+func selftestLinks() (map[string]string, error) {
+	data, err := selftestData.ReadFile("testdata/selftest/latest-links.txt")
+	if err != nil {
+		return nil, err
+	}
+	links := make(map[string]string, 20)
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		name, target, ok := strings.Cut(line, " -> ")
+		if !ok {
+			return nil, fmt.Errorf("latest-links.txt: bad line %q", line)
+		}
+		links[name] = target
+	}
+	return links, nil
+}
+
+// SelftestTransport serves the embedded interwiki map, so the self test
+// does not need network access.
+type selftestTransport struct{}
+
+func (selftestTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.String() == "https://noc.wikimedia.org/conf/interwiki.php.txt" {
+		body, err := selftestData.Open("testdata/interwikimap.php.txt")
+		if err != nil {
+			return nil, err
+		}
+		return &http.Response{StatusCode: 200, Body: body, Header: make(http.Header)}, nil
+	}
+	return nil, fmt.Errorf("selftest: unexpected request: %s", req.URL.String())
+}
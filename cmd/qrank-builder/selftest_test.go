@@ -0,0 +1,110 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSelftest(t *testing.T) {
+	if testing.Short() {
+		t.Skip()
+	}
+
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	var buf bytes.Buffer
+	if err := selftest(context.Background(), &buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(buf.String(), "selftest passed") {
+		t.Errorf("got %q", buf.String())
+	}
+}
+
+// The list of links must be kept in sync with testdata/dumps.
+func TestSelftestLinks(t *testing.T) {
+	got, err := selftestLinks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := filepath.Join("testdata", "dumps")
+	want := make(map[string]string)
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.Type()&fs.ModeSymlink == 0 {
+			return err
+		}
+		target, err := os.Readlink(path)
+		if err != nil {
+			return err
+		}
+		name, _ := filepath.Rel(root, path)
+		want[filepath.ToSlash(name)] = filepath.ToSlash(target)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("testdata/selftest/latest-links.txt is out of date; got %v, want %v", got, want)
+	}
+}
+
+func TestCheckSelftestOutput(t *testing.T) {
+	ctx := context.Background()
+	s3 := NewFakeS3()
+	golden := "testdata/selftest/item_signals-20240501.csv"
+	key := "public/item_signals-20240501.csv.zst"
+
+	if err := checkSelftestOutput(ctx, "qrank", key, golden, "", s3); err == nil || !strings.Contains(err.Error(), "did not produce") {
+		t.Errorf("got %v, want error about missing output", err)
+	}
+
+	lines := []string{"item,pageviews_52w,wikitext_bytes,claims,identifiers,sitelinks", "Q72,1,3142,550,85,186"}
+	if err := s3.WriteLines(lines, key); err != nil {
+		t.Fatal(err)
+	}
+	want := `public/item_signals-20240501.csv.zst:2: got "Q72,1,3142,550,85,186", want "Q72,0,3142,550,85,186"`
+	if err := checkSelftestOutput(ctx, "qrank", key, golden, "", s3); err == nil || err.Error() != want {
+		t.Errorf("got %v, want %q", err, want)
+	}
+}
+
+func TestNormalizeSelftestProvenance(t *testing.T) {
+	dumps := filepath.Join("tmp", "dumps")
+	data := `{"release":"2024-05-01","created":"2024-05-03T04:05:06Z","host":"worker-7",` +
+		`"flags":{"workers":"8"},"parameters":{"pageviewsWeeks":1},` +
+		`"inputs":[{"source":"rmwiki","date":"2024-03-01","paths":["` +
+		filepath.ToSlash(filepath.Join(dumps, "rmwiki", "20240301", "rmwiki-20240301-page.sql.gz")) + `"]}],` +
+		`"stages":[{"stage":"titles","seconds":1.5}]}`
+	got, err := normalizeSelftestProvenance([]byte(data), dumps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{
+  "release": "2024-05-01",
+  "parameters": {
+    "pageviewsWeeks": 1
+  },
+  "inputs": [
+    {
+      "source": "rmwiki",
+      "date": "2024-03-01",
+      "paths": [
+        "rmwiki/20240301/rmwiki-20240301-page.sql.gz"
+      ]
+    }
+  ]
+}`
+	if string(got) != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,130 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"github.com/lanrat/extsort"
+	"golang.org/x/sync/errgroup"
+)
+
+// BuildSitelinks builds a file for looking up Wikidata items by page
+// title, from the titles files in storage. For every site, we take
+// the most recent titles file that is not newer than the release.
+// The output has lines such as "en.wikipedia/berlin Q64", sorted
+// and compressed with brotli. The webserver uses this file to look up
+// rankings by page title.
+func buildSitelinks(ctx context.Context, cfg *buildConfig, release time.Time, outDir string, s3 S3) (string, error) {
+	ymd := release.Format("20060102")
+	stored, err := ListStoredFiles(ctx, cfg.Bucket, "titles", s3)
+	if err != nil {
+		return "", err
+	}
+	keys := make([]string, 0, len(stored))
+	for site, versions := range stored {
+		var version string
+		for _, v := range versions {
+			if v <= ymd {
+				version = v
+			}
+		}
+		if version != "" {
+			keys = append(keys, fmt.Sprintf("titles/%s-%s-titles.zst", site, version))
+		}
+	}
+	slices.Sort(keys)
+
+	path := filepath.Join(outDir, fmt.Sprintf("sitelinks-%s.br", ymd))
+	file, err := os.Create(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	writer := brotli.NewWriterLevel(file, 6)
+	defer writer.Close()
+
+	ch := make(chan string, cfg.Sort.buffer(10000))
+	config := cfg.Sort.newConfig(8*1024*1024/32, 32) // 8 MiB, 32 Bytes/line avg
+	sorter, outChan, errChan := extsort.Strings(ch, config)
+	g, subCtx := errgroup.WithContext(ctx)
+	g.Go(func() error {
+		defer close(ch)
+		for _, key := range keys {
+			if err := readSitelinks(subCtx, cfg.Bucket, key, ch, s3); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	g.Go(func() error {
+		sorter.Sort(subCtx)
+		return writeSitelinks(outChan, writer, subCtx)
+	})
+	if err := g.Wait(); err != nil {
+		return "", err
+	}
+	if err := <-errChan; err != nil {
+		return "", err
+	}
+
+	if err := writer.Close(); err != nil {
+		return "", err
+	}
+	if err := file.Close(); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// ReadSitelinks reads a titles file from storage, such as
+// "titles/rmwiki-20240301-titles.zst", and sends its lines to out
+// in the format of the sitelinks file.
+func readSitelinks(ctx context.Context, bucket string, key string, out chan<- string, s3 S3) error {
+	site := strings.TrimPrefix(key, "titles/")
+	site = site[:strings.IndexByte(site, '-')]
+	wikiPos := strings.Index(site, "wiki")
+	if wikiPos < 0 {
+		return fmt.Errorf("%s: cannot tell language and project of site", key)
+	}
+	lang, project := site[:wikiPos], site[wikiPos:]
+	if project == "wiki" {
+		project = "wikipedia"
+	}
+
+	reader, err := NewS3Reader(ctx, bucket, key, s3)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	decompressor, err := zstd.NewReader(reader)
+	if err != nil {
+		return err
+	}
+	defer decompressor.Close()
+
+	scanner := bufio.NewScanner(decompressor)
+	for scanner.Scan() {
+		title, item, ok := strings.Cut(scanner.Text(), "\t")
+		if !ok {
+			return fmt.Errorf("%s: bad line %q", key, scanner.Text())
+		}
+		select {
+		case out <- formatLine(lang, project, title, item):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,75 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"runtime"
+
+	"github.com/lanrat/extsort"
+)
+
+// SortSettings tune the external sorts of the pipeline. The zero value
+// keeps the built-in defaults of each sort.
+type sortSettings struct {
+	// ChunkMiB is the approximate memory for each chunk of records
+	// that gets sorted in memory before spilling to disk.
+	ChunkMiB int
+
+	// Workers is the number of goroutines for sorting chunks.
+	// If zero, we use one per CPU.
+	Workers int
+
+	// MergeWorkers is the number of goroutines for merging chunks.
+	MergeWorkers int
+
+	// Buffer is the size of the channels that pass records
+	// to and from sorters.
+	Buffer int
+
+	// TempDir is where sorters spill chunks to disk. If empty,
+	// we use the default directory for temporary files.
+	TempDir string
+
+	// Memory, if not nil, monitors the memory of the process;
+	// when it gets short, new sorts use smaller chunks and fewer
+	// workers.
+	Memory *memoryMonitor
+}
+
+// NewConfig returns the configuration for an external sort.
+// When memory is getting short, chunks and workers get scaled down.
+// The chunk size is the number of records per chunk, or zero for the
+// default of the extsort library; recordBytes is the average size
+// of a record, for converting -sortChunkMiB to a number of records.
+func (s sortSettings) newConfig(chunkSize int, recordBytes int) *extsort.Config {
+	config := extsort.DefaultConfig()
+	if chunkSize > 0 {
+		config.ChunkSize = chunkSize
+	}
+	if s.ChunkMiB > 0 {
+		config.ChunkSize = max(s.ChunkMiB*1024*1024/max(recordBytes, 1), 2)
+	}
+	config.NumWorkers = runtime.GOMAXPROCS(0)
+	if s.Workers > 0 {
+		config.NumWorkers = s.Workers
+	}
+	if s.MergeWorkers > 0 {
+		config.NumMergeWorkers = s.MergeWorkers
+	}
+	if s.Buffer > 0 {
+		config.SortedChanBuffSize = s.Buffer
+	}
+	config.TempFilesDir = s.TempDir
+	config.ChunkSize, config.NumWorkers = s.Memory.adjust(config.ChunkSize, config.NumWorkers)
+	return config
+}
+
+// Buffer returns the size for a channel that passes records
+// to a sorter, given the default size for that sorter.
+func (s sortSettings) buffer(defaultSize int) int {
+	if s.Buffer > 0 {
+		return s.Buffer
+	}
+	return defaultSize
+}
@@ -0,0 +1,73 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestSortSettings(t *testing.T) {
+	sorting := sortSettings{}
+	c := sorting.newConfig(8*1024*1024/64, 64)
+	if c.ChunkSize != 131072 || c.NumWorkers != runtime.GOMAXPROCS(0) || c.TempFilesDir != "" {
+		t.Errorf("got %+v, want defaults", c)
+	}
+	if c := sorting.newConfig(0, 8); c.ChunkSize != 1000000 {
+		t.Errorf("got ChunkSize=%d, want extsort default", c.ChunkSize)
+	}
+	if got := sorting.buffer(50000); got != 50000 {
+		t.Errorf("got buffer(50000)=%d, want 50000", got)
+	}
+
+	sorting = sortSettings{ChunkMiB: 64, Workers: 3, MergeWorkers: 5, Buffer: 77, TempDir: "/mnt/ssd"}
+	c = sorting.newConfig(8*1024*1024/64, 64)
+	if c.ChunkSize != 1048576 {
+		t.Errorf("got ChunkSize=%d, want 1048576", c.ChunkSize)
+	}
+	if c.NumWorkers != 3 || c.NumMergeWorkers != 5 || c.SortedChanBuffSize != 77 || c.TempFilesDir != "/mnt/ssd" {
+		t.Errorf("got %+v", c)
+	}
+	if got := sorting.buffer(50000); got != 77 {
+		t.Errorf("got buffer(50000)=%d, want 77", got)
+	}
+}
+
+func TestSortLines_TempDir(t *testing.T) {
+	unsorted := filepath.Join(t.TempDir(), "unsorted.txt")
+	if err := os.WriteFile(unsorted, []byte("C\nB\nA\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	sorting := sortSettings{ChunkMiB: 1, Workers: 1, Buffer: 1, TempDir: t.TempDir()}
+	path, err := SortLines(context.Background(), unsorted, sorting)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	decoder, err := zstd.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer decoder.Close()
+	got, err := io.ReadAll(decoder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "A\nB\nC\n" {
+		t.Errorf("got %q, want %q", got, "A\nB\nC\n")
+	}
+}
@@ -7,25 +7,92 @@ import (
 	"bufio"
 	"bytes"
 	"compress/gzip"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"math"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/lanrat/extsort"
 )
 
 type Sample []interface{} // [ID, Rank, Value]
 
+// StatsSchema is the version of the Stats format. It gets incremented
+// whenever the format changes in a way that clients need to know about.
+const statsSchema = 2
+
 type Stats struct {
 	Median  int
 	Samples []Sample
+
+	Schema      int
+	NumRanked   int64
+	NumUnranked int64 `json:",omitempty"`
+
+	// Percentiles maps a percentile, such as "99", to the score
+	// at or below which this percentage of ranked entities lies.
+	Percentiles map[string]int64
+
+	// Histogram[i] is the number of entities whose score is
+	// in the interval [10^i, 10^(i+1)).
+	Histogram []int64
+
+	// Gini is the Gini coefficient of the score distribution,
+	// between 0 (all entities have the same score) and 1.
+	Gini float64
+
+	// Types gives entity counts for coarse entity types,
+	// such as "human". Entities of other types are counted
+	// as "other".
+	Types map[string]TypeStats `json:",omitempty"`
+
+	// Sites tells how many views the top sites, such as "en.wikipedia",
+	// have contributed to the ranking, sorted by decreasing views.
+	// The views of all other sites are summed up as "other".
+	Sites []SiteStats `json:",omitempty"`
+
+	// TopEntities lists the top entities for a handful of prominent
+	// classes, such as "city", as a human-readable sanity check.
+	TopEntities map[string][]Sample `json:",omitempty"`
+
+	// Churn compares the ranking to the previous release.
+	Churn *Churn `json:",omitempty"`
 }
 
-func buildStats(date time.Time, qrankPath string, topN int, numSamples int, outDir string) (string, error) {
+// SiteStats gives the number of views that a site has contributed.
+type SiteStats struct {
+	Site  string
+	Views int64
+}
+
+// TypeStats gives entity counts for a coarse entity type.
+type TypeStats struct {
+	Ranked   int64
+	Unranked int64
+}
+
+var statsPercentiles = []struct {
+	name  string
+	value float64
+}{
+	{"50", 50}, {"90", 90}, {"99", 99}, {"99.9", 99.9},
+}
+
+// BuildStats computes statistics about a QRank file. If typesPath
+// is not empty, the statistics also contain per-type counts.
+// Likewise, if siteviewsPath is not empty, the statistics contain
+// the views contributed by the top numSites sites; and if classesPath
+// is not empty, they contain the top entities of each class.
+// The churn metrics are optional, too.
+func buildStats(date time.Time, qrankPath string, typesPath string, siteviewsPath string, classesPath string, churn *Churn, numSites int, topN int, numSamples int, outDir string, sorting sortSettings, ctx context.Context) (string, error) {
 	// To compute our stats, we do two passes over the QRank file.
 	// First, a pass to count the number of lines in the file;
 	// second, a pass that actually computes the stats.
@@ -55,9 +122,26 @@ func buildStats(date time.Time, qrankPath string, topN int, numSamples int, outD
 		return "", err
 	}
 
+	// Ranks at which we pick the percentile values. Since the QRank
+	// file is sorted by decreasing score, the p-th percentile is found
+	// near the top for large p.
+	percentileRanks := make(map[int64][]string, len(statsPercentiles))
+	for _, p := range statsPercentiles {
+		r := numRanks - int64(math.Ceil(p.value*float64(numRanks)/100.0)) + 1
+		if r < 1 {
+			r = 1
+		}
+		percentileRanks[r] = append(percentileRanks[r], p.name)
+	}
+
 	samplingDistanceSq := 4.0 * 4.0
 	var stats Stats
+	stats.Schema = statsSchema
+	stats.Churn = churn
+	stats.NumRanked = numRanks
+	stats.Percentiles = make(map[string]int64, len(statsPercentiles))
 	stats.Samples = make([]Sample, 0, numSamples)
+	var giniSum, valueSum float64
 	var id string
 	var rank, value int64
 	var lastX, lastY, scaleY float64
@@ -77,6 +161,23 @@ func buildStats(date time.Time, qrankPath string, topN int, numSamples int, outD
 			return "", err
 		}
 
+		for _, name := range percentileRanks[rank] {
+			stats.Percentiles[name] = value
+		}
+
+		if value > 0 {
+			bucket := int(math.Floor(math.Log10(float64(value))))
+			for len(stats.Histogram) <= bucket {
+				stats.Histogram = append(stats.Histogram, 0)
+			}
+			stats.Histogram[bucket] += 1
+		}
+
+		// When sorting by increasing value, this entity would be at
+		// position numRanks-rank+1; see https://en.wikipedia.org/wiki/Gini_coefficient
+		giniSum += float64(numRanks-2*rank+1) * float64(value)
+		valueSum += float64(value)
+
 		if rank == 1 { // first item in file, this is the maximum value
 			scaleY = float64(numSamples) / math.Log10(float64(value))
 		}
@@ -108,6 +209,37 @@ func buildStats(date time.Time, qrankPath string, topN int, numSamples int, outD
 		return "", err
 	}
 
+	if valueSum > 0 {
+		stats.Gini = giniSum / (float64(numRanks) * valueSum)
+	}
+
+	if typesPath != "" {
+		types, err := countTypes(qrankPath, typesPath, sorting, ctx)
+		if err != nil {
+			return "", err
+		}
+		stats.Types = types
+		for _, t := range types {
+			stats.NumUnranked += t.Unranked
+		}
+	}
+
+	if siteviewsPath != "" {
+		sites, err := readSiteStats(siteviewsPath, numSites)
+		if err != nil {
+			return "", err
+		}
+		stats.Sites = sites
+	}
+
+	if classesPath != "" {
+		top, err := topEntitiesByClass(qrankPath, classesPath, 10, sorting, ctx)
+		if err != nil {
+			return "", err
+		}
+		stats.TopEntities = top
+	}
+
 	statsPath := filepath.Join(
 		outDir,
 		fmt.Sprintf("qrank-stats-%04d%02d%02d.json", date.Year(), date.Month(), date.Day()))
@@ -138,6 +270,105 @@ func buildStats(date time.Time, qrankPath string, topN int, numSamples int, outD
 	return statsPath, nil
 }
 
+// ReadSiteStats reads the per-site views that were written by buildQViews,
+// returning the top n sites plus the sum of all others as "other".
+func readSiteStats(siteviewsPath string, n int) ([]SiteStats, error) {
+	buf, err := os.ReadFile(siteviewsPath)
+	if err != nil {
+		return nil, err
+	}
+	var siteViews map[string]int64
+	if err := json.Unmarshal(buf, &siteViews); err != nil {
+		return nil, err
+	}
+
+	sites := make([]SiteStats, 0, len(siteViews))
+	for site, views := range siteViews {
+		sites = append(sites, SiteStats{Site: site, Views: views})
+	}
+	sort.Slice(sites, func(i, j int) bool {
+		if sites[i].Views != sites[j].Views {
+			return sites[i].Views > sites[j].Views
+		}
+		return sites[i].Site < sites[j].Site
+	})
+
+	if len(sites) > n {
+		var other int64
+		for _, s := range sites[n:] {
+			other += s.Views
+		}
+		sites = append(sites[:n], SiteStats{Site: "other", Views: other})
+	}
+	return sites, nil
+}
+
+// TopEntitiesByClass finds the top n entities of each class.
+// The classes file is sorted by entity ID, with lines such as "Q72 city",
+// as written by classExtractor.
+func topEntitiesByClass(qrankPath string, classesPath string, n int, sorting sortSettings, ctx context.Context) (map[string][]Sample, error) {
+	top := make(map[string][]Sample, len(statsClasses))
+	err := joinQRank(qrankPath, classesPath, sorting, ctx, func(ch <-chan extsort.SortType) error {
+		// The joined stream contains every ranked entity in QRank order,
+		// so we can tell the rank of an entity by counting.
+		var rank int64
+		for data := range ch {
+			rank += 1
+			lq := data.(LabeledQRank)
+			if lq.Label == "" || len(top[lq.Label]) >= n {
+				continue
+			}
+			id := "Q" + strconv.FormatInt(lq.Entity, 10)
+			top[lq.Label] = append(top[lq.Label], Sample{id, rank, lq.Rank})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return top, nil
+}
+
+// CountTypes counts ranked and unranked entities by coarse entity type.
+// The types file needs to list all entities, as written by typeExtractor.
+func countTypes(qrankPath string, typesPath string, sorting sortSettings, ctx context.Context) (map[string]TypeStats, error) {
+	total := make(map[string]int64, len(entityTypes)+1)
+	typesFile, err := os.Open(typesPath)
+	if err != nil {
+		return nil, err
+	}
+	defer typesFile.Close()
+	scanner := bufio.NewScanner(brotli.NewReader(typesFile))
+	for scanner.Scan() {
+		line := scanner.Text()
+		space := strings.IndexByte(line, ' ')
+		if space < 0 {
+			return nil, fmt.Errorf("%s: bad line %q", typesPath, line)
+		}
+		total[line[space+1:]] += 1
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	ranked := make(map[string]int64, len(total))
+	err = joinQRank(qrankPath, typesPath, sorting, ctx, func(ch <-chan extsort.SortType) error {
+		for data := range ch {
+			ranked[data.(LabeledQRank).Label] += 1
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]TypeStats, len(total))
+	for typ, n := range total {
+		result[typ] = TypeStats{Ranked: ranked[typ], Unranked: n - ranked[typ]}
+	}
+	return result, nil
+}
+
 // CountLines counts the number of lines in its input.
 func countLines(r io.Reader) (int64, error) {
 	var count int64
@@ -4,10 +4,12 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"io"
 	"os"
 	"path/filepath"
+	"reflect"
 	"testing"
 	"time"
 )
@@ -26,7 +28,7 @@ Q7,1
 Q8,1
 Q9,1
 `)
-	statsPath, err := buildStats(time.Now(), qrank, 2, 8, t.TempDir())
+	statsPath, err := buildStats(time.Now(), qrank, "", "", "", nil, 50, 2, 8, t.TempDir(), sortSettings{}, context.Background())
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -48,8 +50,75 @@ Q9,1
 	}
 
 	got := string(buf)
-	want := `{"Median":2,"Samples":[["Q1",1,4721864130],["Q2",2,107330319],["Q5",5,51123],["Q9",9,1]]}`
+	want := `{"Median":2,"Samples":[["Q1",1,4721864130],["Q2",2,107330319],["Q5",5,51123],["Q9",9,1]],` +
+		`"Schema":2,"NumRanked":9,` +
+		`"Percentiles":{"50":51123,"90":4721864130,"99":4721864130,"99.9":4721864130},` +
+		`"Histogram":[3,0,1,0,1,0,1,1,1,1],` +
+		`"Gini":0.8770520435484677}`
 	if got != want {
 		t.Errorf("got %s, want %s", got, want)
 	}
 }
+
+func TestCountTypes(t *testing.T) {
+	dir := t.TempDir()
+	qrank := filepath.Join(dir, "qrank.gz")
+	writeGzipFile(qrank, "Entity,QRank\nQ4,77\nQ2,42\nQ5,42\nQ1,1\n")
+	types := filepath.Join(dir, "types.br")
+	writeBrotli(types, "Q1 place\nQ2 other\nQ3 human\nQ4 human\nQ5 human\nQ6 other\n")
+
+	got, err := countTypes(qrank, types, sortSettings{}, context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]TypeStats{
+		"human": {Ranked: 2, Unranked: 1},
+		"other": {Ranked: 1, Unranked: 1},
+		"place": {Ranked: 1, Unranked: 0},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestReadSiteStats(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "siteviews.json")
+	data := `{"de.wikipedia":7,"en.wikipedia":9,"fr.wikipedia":7,"rm.wikipedia":2,"ch.wikipedia":1}`
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := readSiteStats(path, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []SiteStats{
+		{"en.wikipedia", 9},
+		{"de.wikipedia", 7},
+		{"fr.wikipedia", 7},
+		{"other", 3},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestTopEntitiesByClass(t *testing.T) {
+	dir := t.TempDir()
+	qrank := filepath.Join(dir, "qrank.gz")
+	writeGzipFile(qrank, "Entity,QRank\nQ4,77\nQ2,42\nQ5,42\nQ1,1\nQ6,1\n")
+	classes := filepath.Join(dir, "classes.br")
+	writeBrotli(classes, "Q1 city\nQ3 human\nQ4 human\nQ5 human\nQ6 human\n")
+
+	got, err := topEntitiesByClass(qrank, classes, 2, sortSettings{}, context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]Sample{
+		"city":  {{"Q1", int64(4), int64(1)}},
+		"human": {{"Q4", int64(1), int64(77)}, {"Q5", int64(3), int64(42)}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
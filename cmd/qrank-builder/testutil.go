@@ -9,6 +9,7 @@ import (
 	"os"
 
 	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
 )
 
 func readBrotliFile(path string) string {
@@ -81,3 +82,22 @@ func writeGzipFile(path string, content string) {
 		panic(err)
 	}
 }
+
+func writeZstd(path string, content string) {
+	f, err := os.Create(path)
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+	s, err := zstd.NewWriter(f, zstd.WithEncoderLevel(zstd.SpeedFastest))
+	if err != nil {
+		panic(err)
+	}
+	s.Write([]byte(content))
+	if err := s.Close(); err != nil {
+		panic(err)
+	}
+	if err := f.Close(); err != nil {
+		panic(err)
+	}
+}
@@ -12,7 +12,6 @@ import (
 	"io"
 	"os"
 	"path/filepath"
-	"runtime"
 	"slices"
 	"strconv"
 	"strings"
@@ -29,7 +28,7 @@ import (
 //
 // Category:Foo Q123
 // Zürich Q72
-func buildTitles(site *WikiSite, ctx context.Context, dumps string, s3 S3) error {
+func buildTitles(site *WikiSite, ctx context.Context, cfg *buildConfig, s3 S3) error {
 	ymd := site.LastDumped.Format("20060102")
 	destPath := fmt.Sprintf("titles/%s-%s-titles.zst", site.Key, ymd)
 	destRedirectsPath := fmt.Sprintf("redirects/%s-%s-redirects.zst", site.Key, ymd)
@@ -42,19 +41,17 @@ func buildTitles(site *WikiSite, ctx context.Context, dumps string, s3 S3) error
 	defer unsorted.Close()
 	defer os.Remove(unsorted.Name())
 
-	linesChan := make(chan string, 10000)
-	config := extsort.DefaultConfig()
-	config.ChunkSize = 8 * 1024 * 1024 / 64 // 8 MiB, 64 Bytes/line avg
-	config.NumWorkers = runtime.NumCPU()
+	linesChan := make(chan string, cfg.Sort.buffer(10000))
+	config := cfg.Sort.newConfig(8*1024*1024/64, 64) // 8 MiB, 64 Bytes/line avg
 	sorter, outChan, errChan := extsort.Strings(linesChan, config)
 
 	group, groupCtx := errgroup.WithContext(ctx)
 	group.Go(func() error {
 		defer close(linesChan)
-		if err := ReadPageItemsOld(groupCtx, site, "A", s3, linesChan); err != nil {
+		if err := ReadPageItemsOld(groupCtx, site, "A", cfg.Bucket, s3, linesChan); err != nil {
 			return err
 		}
-		if err := readTitles(groupCtx, site, "B", dumps, linesChan); err != nil {
+		if err := readTitles(groupCtx, site, "B", cfg.Dumps, linesChan); err != nil {
 			return err
 		}
 		return nil
@@ -85,29 +82,29 @@ func buildTitles(site *WikiSite, ctx context.Context, dumps string, s3 S3) error
 		return err
 	}
 
-	titleItemsPath, err := SortLines(ctx, unsorted.Name())
+	titleItemsPath, err := SortLines(ctx, unsorted.Name(), cfg.Sort)
 	if err != nil {
 		return err
 	}
 	defer os.Remove(titleItemsPath)
 
-	redirectTitlesPath, err := buildRedirectTitles(ctx, site, dumps)
+	redirectTitlesPath, err := buildRedirectTitles(ctx, site, cfg)
 	if err != nil {
 		return err
 	}
 	defer os.Remove(redirectTitlesPath)
 
-	redirectsPath, err := buildRedirects(ctx, site, titleItemsPath, redirectTitlesPath)
+	redirectsPath, err := buildRedirects(ctx, site, titleItemsPath, redirectTitlesPath, cfg.Sort)
 	if err != nil {
 		return err
 	}
 	defer os.Remove(redirectsPath)
 
-	if err := PutInStorage(ctx, titleItemsPath, s3, "qrank", destPath, "application/zstd"); err != nil {
+	if err := PutInStorage(ctx, titleItemsPath, s3, cfg.Bucket, destPath, "application/zstd"); err != nil {
 		return err
 	}
 
-	if err := PutInStorage(ctx, redirectsPath, s3, "qrank", destRedirectsPath, "application/zstd"); err != nil {
+	if err := PutInStorage(ctx, redirectsPath, s3, cfg.Bucket, destRedirectsPath, "application/zstd"); err != nil {
 		return err
 	}
 
@@ -170,7 +167,7 @@ func readTitles(ctx context.Context, site *WikiSite, property string, dumps stri
 	}
 }
 
-func buildRedirectTitles(ctx context.Context, site *WikiSite, dumps string) (string, error) {
+func buildRedirectTitles(ctx context.Context, site *WikiSite, cfg *buildConfig) (string, error) {
 	file, err := os.CreateTemp("", "redirect-titles-*")
 	if err != nil {
 		return "", err
@@ -178,19 +175,17 @@ func buildRedirectTitles(ctx context.Context, site *WikiSite, dumps string) (str
 	defer file.Close()
 	defer os.Remove(file.Name())
 
-	linesChan := make(chan string, 10000)
-	config := extsort.DefaultConfig()
-	config.ChunkSize = 8 * 1024 * 1024 / 64 // 8 MiB, 64 Bytes/line avg
-	config.NumWorkers = runtime.NumCPU()
+	linesChan := make(chan string, cfg.Sort.buffer(10000))
+	config := cfg.Sort.newConfig(8*1024*1024/64, 64) // 8 MiB, 64 Bytes/line avg
 	sorter, outChan, errChan := extsort.Strings(linesChan, config)
 
 	group, groupCtx := errgroup.WithContext(ctx)
 	group.Go(func() error {
 		defer close(linesChan)
-		if err := readRedirects(groupCtx, site, "A", dumps, linesChan); err != nil {
+		if err := readRedirects(groupCtx, site, "A", cfg.Dumps, linesChan); err != nil {
 			return err
 		}
-		if err := readTitles(groupCtx, site, "B", dumps, linesChan); err != nil {
+		if err := readTitles(groupCtx, site, "B", cfg.Dumps, linesChan); err != nil {
 			return err
 		}
 		return nil
@@ -221,7 +216,7 @@ func buildRedirectTitles(ctx context.Context, site *WikiSite, dumps string) (str
 		return "", err
 	}
 
-	path, err := SortLines(ctx, file.Name())
+	path, err := SortLines(ctx, file.Name(), cfg.Sort)
 	if err != nil {
 		return "", err
 	}
@@ -398,7 +393,7 @@ func (j *redirectTitleJoiner) Close() error {
 // For example, a titleItem "Zürich Q72" gets merged with a redirectTitle "Zürich Zurigo"
 // into the two output lines "Zurigo Q72" and "Zürich Q72". The lines in the output file
 // are in strong sort order; its file path (in a temporary directoy) is returned as a result.
-func buildRedirects(ctx context.Context, site *WikiSite, titleItemsPath string, redirectTitlesPath string) (string, error) {
+func buildRedirects(ctx context.Context, site *WikiSite, titleItemsPath string, redirectTitlesPath string, sorting sortSettings) (string, error) {
 	scanners := make([]LineScanner, 0, 2)
 	scannerNames := make([]string, 0, 2)
 	for _, path := range []string{titleItemsPath, redirectTitlesPath} {
@@ -474,7 +469,7 @@ func buildRedirects(ctx context.Context, site *WikiSite, titleItemsPath string,
 		return "", err
 	}
 
-	sortedRedirects, err := SortLines(ctx, redirectItemsPath)
+	sortedRedirects, err := SortLines(ctx, redirectItemsPath, sorting)
 	if err != nil {
 		return "", err
 	}
@@ -21,18 +21,18 @@ func TestBuildTitles(t *testing.T) {
 	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
 	ctx := context.Background()
 	client := &http.Client{Transport: &FakeWikiSite{}}
-	dumps := filepath.Join("testdata", "dumps")
-	sites, err := ReadWikiSites(client, dumps)
+	cfg := newBuildConfig(filepath.Join("testdata", "dumps"))
+	sites, err := ReadWikiSites(client, cfg)
 	if err != nil {
 		t.Fatal(err)
 	}
 
 	site := sites.Sites["rmwiki"]
 	s3 := NewFakeS3()
-	if err := buildPageSignals(site, ctx, dumps, s3); err != nil {
+	if err := buildPageSignals(site, ctx, cfg, s3); err != nil {
 		t.Fatal(err)
 	}
-	if err := buildTitles(site, ctx, dumps, s3); err != nil {
+	if err := buildTitles(site, ctx, cfg, s3); err != nil {
 		t.Fatal(err)
 	}
 
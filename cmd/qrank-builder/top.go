@@ -0,0 +1,91 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// TopSubsets lists the subsets of the QRank file that get published
+// for clients who only need the head of the distribution.
+var topSubsets = []struct {
+	name string
+	size int64
+}{
+	{"top-100k", 100000},
+	{"top-1m", 1000000},
+}
+
+// BuildTopQRank writes a QRank file with only the n highest-ranking
+// entities. Since the QRank file is sorted by decreasing rank, this
+// is simply a copy of its first n lines (plus the CSV header).
+func buildTopQRank(date time.Time, qrankPath string, name string, n int64, outDir string) (string, error) {
+	topPath := filepath.Join(
+		outDir,
+		fmt.Sprintf("qrank-%s-%04d%02d%02d.gz", name, date.Year(), date.Month(), date.Day()))
+	_, err := os.Stat(topPath)
+	if err == nil {
+		return topPath, nil // use pre-existing file
+	}
+	if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	qrankFile, err := os.Open(qrankPath)
+	if err != nil {
+		return "", err
+	}
+	defer qrankFile.Close()
+
+	qrankReader, err := gzip.NewReader(qrankFile)
+	if err != nil {
+		return "", err
+	}
+
+	tmpTopPath := topPath + ".tmp"
+	topFile, err := os.Create(tmpTopPath)
+	if err != nil {
+		return "", err
+	}
+	defer topFile.Close()
+
+	writer, err := gzip.NewWriterLevel(topFile, 9)
+	if err != nil {
+		return "", err
+	}
+	defer writer.Close()
+
+	scanner := bufio.NewScanner(qrankReader)
+	for i := int64(0); i <= n && scanner.Scan(); i++ {
+		if _, err := writer.Write(scanner.Bytes()); err != nil {
+			return "", err
+		}
+		if _, err := writer.Write([]byte{'\n'}); err != nil {
+			return "", err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+
+	if err := writer.Close(); err != nil {
+		return "", err
+	}
+	if err := topFile.Sync(); err != nil {
+		return "", err
+	}
+	if err := topFile.Close(); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmpTopPath, topPath); err != nil {
+		return "", err
+	}
+
+	return topPath, nil
+}
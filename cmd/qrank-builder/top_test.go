@@ -0,0 +1,39 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBuildTopQRank(t *testing.T) {
+	dir := t.TempDir()
+	qrank := filepath.Join(dir, "qrank.gz")
+	writeGzipFile(qrank, "Entity,QRank\nQ4,77\nQ2,42\nQ5,42\nQ1,1\n")
+
+	date := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		n    int64
+		want string
+	}{
+		{2, "Entity,QRank\nQ4,77\nQ2,42\n"},
+		{100, "Entity,QRank\nQ4,77\nQ2,42\nQ5,42\nQ1,1\n"},
+	} {
+		name := fmt.Sprintf("top-%d", tc.n)
+		path, err := buildTopQRank(date, qrank, name, tc.n, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wantPath := filepath.Join(dir, "qrank-"+name+"-20240301.gz")
+		if path != wantPath {
+			t.Errorf("got %q, want %q", path, wantPath)
+		}
+		if got := readGzipFile(path); got != tc.want {
+			t.Errorf("n=%d: got %q, want %q", tc.n, got, tc.want)
+		}
+	}
+}
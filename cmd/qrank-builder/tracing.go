@@ -0,0 +1,228 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Traces collects the spans of this process for exporting them
+// to an OpenTelemetry collector. If nil, tracing is disabled, and
+// all tracing functions do nothing.
+var traces *tracer
+
+// MaxSpanBatch is the number of finished spans after which
+// the tracer sends them off without waiting for the next flush.
+const maxSpanBatch = 512
+
+// Tracer exports spans to an OpenTelemetry collector, using the
+// JSON encoding of OTLP over HTTP. We only need a tiny part of
+// OpenTelemetry, so we do not pull in its SDK.
+type tracer struct {
+	endpoint string
+	client   *http.Client
+	now      func() time.Time
+
+	mutex sync.Mutex
+	spans []*span
+}
+
+// NewTracer returns a tracer that sends spans to an OTLP/HTTP
+// endpoint, such as "http://localhost:4318/v1/traces".
+func newTracer(endpoint string) *tracer {
+	return &tracer{endpoint: endpoint, client: &http.Client{Timeout: 30 * time.Second}, now: time.Now}
+}
+
+// OtlpEndpoint returns the URL for exporting traces. Unless given
+// explicitly, it is taken from the environment variables that are
+// standardized by OpenTelemetry.
+func otlpEndpoint(flagValue string) string {
+	if flagValue != "" {
+		return flagValue
+	}
+	if url := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"); url != "" {
+		return url
+	}
+	if url := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); url != "" {
+		return strings.TrimSuffix(url, "/") + "/v1/traces"
+	}
+	return ""
+}
+
+// Span is a timed operation, such as reading a dump file or
+// uploading an output file to storage.
+type span struct {
+	tracer   *tracer
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	name     string
+	start    time.Time
+	end      time.Time
+	attrs    map[string]any
+	err      error
+}
+
+type spanContextKey struct{}
+
+// StartSpan starts a new span as a child of the span in ctx, or as
+// the root of a new trace if ctx has no span. Attributes get passed
+// as pairs of keys and values, such as "site", "rmwiki". The returned
+// context carries the new span. Callers must call finish on the span,
+// which may be nil if tracing is disabled.
+func startSpan(ctx context.Context, name string, attrs ...any) (context.Context, *span) {
+	if traces == nil {
+		return ctx, nil
+	}
+	s := &span{tracer: traces, name: name, start: traces.now(), attrs: make(map[string]any, len(attrs)/2)}
+	if parent, ok := ctx.Value(spanContextKey{}).(*span); ok && parent != nil {
+		s.traceID = parent.traceID
+		s.parentID = parent.spanID
+	} else {
+		rand.Read(s.traceID[:])
+	}
+	rand.Read(s.spanID[:])
+	for i := 0; i+1 < len(attrs); i += 2 {
+		s.attrs[fmt.Sprint(attrs[i])] = attrs[i+1]
+	}
+	return context.WithValue(ctx, spanContextKey{}, s), s
+}
+
+// SetAttr adds an attribute to a span, such as the number of bytes
+// written, which is only known at the end.
+func (s *span) setAttr(key string, value any) {
+	if s != nil {
+		s.tracer.mutex.Lock()
+		s.attrs[key] = value
+		s.tracer.mutex.Unlock()
+	}
+}
+
+// Finish ends a span. If err is not nil, the span gets marked as failed.
+func (s *span) finish(err error) {
+	if s == nil {
+		return
+	}
+	t := s.tracer
+	t.mutex.Lock()
+	s.end = t.now()
+	s.err = err
+	t.spans = append(t.spans, s)
+	full := len(t.spans) >= maxSpanBatch
+	t.mutex.Unlock()
+
+	if full {
+		go func() {
+			if err := t.flush(context.Background()); err != nil && logger != nil {
+				logger.Printf("warning: could not export traces: %v", err)
+			}
+		}()
+	}
+}
+
+// Flush sends all finished spans to the collector.
+func (t *tracer) flush(ctx context.Context) error {
+	t.mutex.Lock()
+	spans := t.spans
+	t.spans = nil
+	body, err := json.Marshal(otlpRequest(spans))
+	t.mutex.Unlock()
+	if len(spans) == 0 || err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", t.endpoint, resp.Status)
+	}
+	return nil
+}
+
+// OtlpRequest builds the body of an OTLP/HTTP export request.
+// In OTLP's JSON encoding, trace and span IDs are hex strings,
+// and 64-bit integers are decimal strings.
+// https://opentelemetry.io/docs/specs/otlp/#json-protobuf-encoding
+func otlpRequest(spans []*span) map[string]any {
+	encoded := make([]map[string]any, 0, len(spans))
+	for _, s := range spans {
+		e := map[string]any{
+			"traceId":           hex.EncodeToString(s.traceID[:]),
+			"spanId":            hex.EncodeToString(s.spanID[:]),
+			"name":              s.name,
+			"kind":              1, // SPAN_KIND_INTERNAL
+			"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+			"attributes":        otlpAttributes(s.attrs),
+		}
+		if s.parentID != [8]byte{} {
+			e["parentSpanId"] = hex.EncodeToString(s.parentID[:])
+		}
+		if s.err != nil {
+			e["status"] = map[string]any{"code": 2, "message": s.err.Error()} // STATUS_CODE_ERROR
+		}
+		encoded = append(encoded, e)
+	}
+
+	resource := map[string]any{
+		"attributes": otlpAttributes(map[string]any{"service.name": "qrank-builder"}),
+	}
+	scope := map[string]any{"name": "github.com/brawer/wikidata-qrank/cmd/qrank-builder"}
+	return map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource":   resource,
+			"scopeSpans": []any{map[string]any{"scope": scope, "spans": encoded}},
+		}},
+	}
+}
+
+// OtlpAttributes encodes attributes for OTLP.
+func otlpAttributes(attrs map[string]any) []any {
+	keys := make([]string, 0, len(attrs))
+	for key := range attrs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	result := make([]any, 0, len(attrs))
+	for _, key := range keys {
+		value := attrs[key]
+		var v map[string]any
+		switch value := value.(type) {
+		case int:
+			v = map[string]any{"intValue": strconv.Itoa(value)}
+		case int64:
+			v = map[string]any{"intValue": strconv.FormatInt(value, 10)}
+		case bool:
+			v = map[string]any{"boolValue": value}
+		case float64:
+			v = map[string]any{"doubleValue": value}
+		default:
+			v = map[string]any{"stringValue": fmt.Sprint(value)}
+		}
+		result = append(result, map[string]any{"key": key, "value": v})
+	}
+	return result
+}
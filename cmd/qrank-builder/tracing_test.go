@@ -0,0 +1,117 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTracing(t *testing.T) {
+	var got struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Spans []struct {
+					TraceID      string `json:"traceId"`
+					SpanID       string `json:"spanId"`
+					ParentSpanID string `json:"parentSpanId"`
+					Name         string
+					Start        string `json:"startTimeUnixNano"`
+					Attributes   []struct {
+						Key   string
+						Value map[string]any
+					}
+					Status *struct {
+						Code    int
+						Message string
+					}
+				}
+			}
+		}
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost || req.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("unexpected request: %s %v", req.Method, req.Header)
+		}
+		body, _ := io.ReadAll(req.Body)
+		if err := json.Unmarshal(body, &got); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer server.Close()
+
+	defer func() { traces = nil }()
+	traces = newTracer(server.URL)
+	traces.now = func() time.Time { return time.Unix(1709265600, 0) }
+	ctx, root := startSpan(context.Background(), "build")
+	_, child := startSpan(ctx, "site", "site", "rmwiki", "bytes", int64(42))
+	child.finish(errors.New("boom"))
+	root.finish(nil)
+	if err := traces.flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	spans := got.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 2 {
+		t.Fatalf("got %d spans, want 2", len(spans))
+	}
+	c, r := spans[0], spans[1]
+	if c.Name != "site" || r.Name != "build" {
+		t.Errorf("got names %q, %q", c.Name, r.Name)
+	}
+	if c.TraceID != r.TraceID || len(r.TraceID) != 32 {
+		t.Errorf("spans should share trace ID, got %q and %q", c.TraceID, r.TraceID)
+	}
+	if c.ParentSpanID != r.SpanID || r.ParentSpanID != "" {
+		t.Errorf("bad parent span IDs: child %q, root %q, root span %q", c.ParentSpanID, r.ParentSpanID, r.SpanID)
+	}
+	if c.Start != "1709265600000000000" {
+		t.Errorf("got start %q", c.Start)
+	}
+	if len(c.Attributes) != 2 || c.Attributes[0].Key != "bytes" || c.Attributes[0].Value["intValue"] != "42" ||
+		c.Attributes[1].Value["stringValue"] != "rmwiki" {
+		t.Errorf("got attributes %+v", c.Attributes)
+	}
+	if c.Status == nil || c.Status.Code != 2 || c.Status.Message != "boom" {
+		t.Errorf("failed span should have error status, got %+v", c.Status)
+	}
+	if r.Status != nil {
+		t.Errorf("successful span should have no status, got %+v", r.Status)
+	}
+}
+
+func TestTracing_Disabled(t *testing.T) {
+	ctx := context.Background()
+	got, span := startSpan(ctx, "build")
+	if span != nil || got != ctx {
+		t.Error("startSpan() should do nothing when tracing is disabled")
+	}
+	span.setAttr("rows", 7)
+	span.finish(nil)
+}
+
+func TestOtlpEndpoint(t *testing.T) {
+	t.Setenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "")
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "")
+	if got := otlpEndpoint(""); got != "" {
+		t.Errorf("got %q, want empty", got)
+	}
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "http://collector:4318/")
+	if got := otlpEndpoint(""); got != "http://collector:4318/v1/traces" {
+		t.Errorf("got %q", got)
+	}
+	t.Setenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "http://traces:4318/v1/traces")
+	if got := otlpEndpoint(""); got != "http://traces:4318/v1/traces" {
+		t.Errorf("got %q", got)
+	}
+	if got := otlpEndpoint("http://flag/v1/traces"); got != "http://flag/v1/traces" {
+		t.Errorf("got %q", got)
+	}
+}
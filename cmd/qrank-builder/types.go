@@ -0,0 +1,241 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/lanrat/extsort"
+)
+
+// EntityTypes lists the coarse entity types for which we publish
+// separate ranking files, in the order of publication.
+var entityTypes = []string{"human", "place", "taxon", "work"}
+
+// EntityClasses maps Wikidata classes to coarse entity types.
+// Entities get their type from the first "instance of" (P31) statement
+// whose value is in this table. The table is intentionally small;
+// it covers the classes of most entities in the respective type,
+// but we do not attempt to follow the subclass hierarchy.
+var entityClasses = map[int64]string{
+	5: "human", // human
+
+	16521: "taxon", // taxon
+
+	515:     "place", // city
+	532:     "place", // village
+	3957:    "place", // town
+	4022:    "place", // river
+	5119:    "place", // capital
+	6256:    "place", // country
+	8502:    "place", // mountain
+	15284:   "place", // municipality
+	23397:   "place", // lake
+	123705:  "place", // neighborhood
+	486972:  "place", // human settlement
+	618123:  "place", // geographical feature
+	1549591: "place", // big city
+
+	7889:      "work", // video game
+	11424:     "work", // film
+	134556:    "work", // single
+	482994:    "work", // album
+	3305213:   "work", // painting
+	5398426:   "work", // television series
+	7725634:   "work", // literary work
+	47461344:  "work", // written work
+	105543609: "work", // musical work
+}
+
+// StatsClasses are the classes for which buildStats() reports
+// the top entities, as a human-readable sanity check of each release.
+// The table maps Wikidata classes to the name used in the stats.
+var statsClasses = map[int64]string{
+	5:     "human",
+	515:   "city",
+	11424: "film",
+	16521: "taxon",
+}
+
+// ClassExtractor returns an entityExtractor for the classes in
+// statsClasses. Entities that are not an instance of any of these
+// classes get skipped.
+func classExtractor() entityExtractor {
+	return entityExtractor{
+		name: "classes",
+		extract: func(data []byte) (string, bool) {
+			return extractClass(data, statsClasses)
+		},
+	}
+}
+
+// TypeExtractor returns an entityExtractor for coarse entity types,
+// such as "human" or "place". Entities of other types are extracted
+// as "other", so the output lists every entity; this lets buildStats()
+// count unranked entities.
+func typeExtractor() entityExtractor {
+	return entityExtractor{
+		name: "types",
+		extract: func(data []byte) (string, bool) {
+			if typ, ok := extractType(data); ok {
+				return typ, true
+			}
+			return "other", true
+		},
+	}
+}
+
+// ExtractType finds the coarse type of a Wikidata entity, such as "human",
+// by looking at its "instance of" (P31) statements.
+func extractType(data []byte) (string, bool) {
+	return extractClass(data, entityClasses)
+}
+
+// ExtractClass looks at the "instance of" (P31) statements of a Wikidata
+// entity and returns the value for the first class that is in a table.
+func extractClass(data []byte, classes map[int64]string) (string, bool) {
+	pattern := []byte(`"property":"P31","datavalue":{"value":{`)
+	for {
+		pos := bytes.Index(data, pattern)
+		if pos < 0 {
+			return "", false
+		}
+		data = data[pos+len(pattern):]
+
+		value := data
+		if end := bytes.IndexByte(value, '}'); end >= 0 {
+			value = value[:end]
+		}
+		idPos := bytes.Index(value, []byte(`"numeric-id":`))
+		if idPos < 0 {
+			continue
+		}
+		value = value[idPos+13:]
+		idLen := bytes.IndexAny(value, ",}")
+		if idLen < 0 {
+			idLen = len(value)
+		}
+		class, err := strconv.ParseInt(string(value[:idLen]), 10, 64)
+		if err != nil {
+			continue
+		}
+		if name, ok := classes[class]; ok {
+			return name, true
+		}
+	}
+}
+
+// BuildTypedQRank splits a QRank file by coarse entity type. The result
+// maps types, such as "human", to the path of a ranking file that
+// contains only entities of that type. Entities of other types are
+// dropped. The files have the same format as the full QRank file.
+func buildTypedQRank(date time.Time, qrankPath string, typesPath string, outDir string, sorting sortSettings, ctx context.Context) (map[string]string, error) {
+	ymd := fmt.Sprintf("%04d%02d%02d", date.Year(), date.Month(), date.Day())
+	paths := make(map[string]string, len(entityTypes))
+	missing := false
+	for _, typ := range entityTypes {
+		p := filepath.Join(outDir, fmt.Sprintf("qrank-%s-%s.gz", typ, ymd))
+		paths[typ] = p
+		if _, err := os.Stat(p); err != nil {
+			if !os.IsNotExist(err) {
+				return nil, err
+			}
+			missing = true
+		}
+	}
+	if !missing {
+		return paths, nil // use pre-existing files
+	}
+
+	if logger != nil {
+		logger.Printf("building typed QRank files for %s", ymd)
+	}
+	start := time.Now()
+
+	files := make(map[string]*os.File, len(entityTypes))
+	writers := make(map[string]*gzip.Writer, len(entityTypes))
+	for _, typ := range entityTypes {
+		f, err := os.Create(paths[typ] + ".tmp")
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		files[typ] = f
+
+		w, err := gzip.NewWriterLevel(f, 9)
+		if err != nil {
+			return nil, err
+		}
+		defer w.Close()
+		writers[typ] = w
+
+		if _, err := w.Write([]byte("Entity,QRank\n")); err != nil {
+			return nil, err
+		}
+	}
+
+	err := joinQRank(qrankPath, typesPath, sorting, ctx, func(ch <-chan extsort.SortType) error {
+		return writeTypedQRank(ch, writers)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, typ := range entityTypes {
+		if err := writers[typ].Close(); err != nil {
+			return nil, err
+		}
+		if err := files[typ].Sync(); err != nil {
+			return nil, err
+		}
+		if err := files[typ].Close(); err != nil {
+			return nil, err
+		}
+		if err := os.Rename(paths[typ]+".tmp", paths[typ]); err != nil {
+			return nil, err
+		}
+	}
+
+	if logger != nil {
+		logger.Printf("built typed QRank files for %s in %.1fs",
+			ymd, time.Since(start).Seconds())
+	}
+
+	return paths, nil
+}
+
+// WriteTypedQRank writes QRank records, whose Label holds the entity type,
+// to the writer for their type. Records without known type get dropped.
+func writeTypedQRank(ch <-chan extsort.SortType, writers map[string]*gzip.Writer) error {
+	for data := range ch {
+		lq := data.(LabeledQRank)
+		w, ok := writers[lq.Label]
+		if !ok {
+			continue
+		}
+		if err := writeTypedQRankLine(w, lq); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeTypedQRankLine(w io.Writer, lq LabeledQRank) error {
+	var buf bytes.Buffer
+	buf.WriteByte('Q')
+	buf.WriteString(strconv.FormatInt(lq.Entity, 10))
+	buf.WriteByte(',')
+	buf.WriteString(strconv.FormatInt(lq.Rank, 10))
+	buf.WriteByte('\n')
+	_, err := w.Write(buf.Bytes())
+	return err
+}
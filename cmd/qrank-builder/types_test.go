@@ -0,0 +1,64 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestExtractType(t *testing.T) {
+	for _, tc := range []struct{ data, want string }{
+		{`{"type":"item","id":"Q1"}`, ""},
+		{`{"claims":{"P31":[{"mainsnak":{"snaktype":"value","property":"P31","datavalue":{"value":{"entity-type":"item","numeric-id":5,"id":"Q5"},"type":"wikibase-entityid"}}}]}}`, "human"},
+		{`{"claims":{"P31":[` +
+			`{"mainsnak":{"snaktype":"value","property":"P31","datavalue":{"value":{"entity-type":"item","numeric-id":4167836,"id":"Q4167836"}}}},` +
+			`{"mainsnak":{"snaktype":"value","property":"P31","datavalue":{"value":{"entity-type":"item","numeric-id":515,"id":"Q515"}}}}]}}`, "place"},
+		{`{"claims":{"P31":[{"mainsnak":{"snaktype":"value","property":"P31","datavalue":{"value":{"entity-type":"item","numeric-id":55,"id":"Q55"}}}}]}}`, ""},
+	} {
+		got, ok := extractType([]byte(tc.data))
+		if got != tc.want || ok != (tc.want != "") {
+			t.Errorf("got (%q, %v) for %s, want %q", got, ok, tc.data, tc.want)
+		}
+	}
+}
+
+func TestClassExtractor(t *testing.T) {
+	ex := classExtractor()
+	data := `{"claims":{"P31":[{"mainsnak":{"snaktype":"value","property":"P31","datavalue":{"value":{"entity-type":"item","numeric-id":515,"id":"Q515"}}}}]}}`
+	if got, ok := ex.extract([]byte(data)); got != "city" || !ok {
+		t.Errorf("got (%q, %v), want (\"city\", true)", got, ok)
+	}
+}
+
+func TestBuildTypedQRank(t *testing.T) {
+	dir := t.TempDir()
+	qrank := filepath.Join(dir, "qrank.gz")
+	writeGzipFile(qrank, "Entity,QRank\nQ4,77\nQ2,42\nQ5,42\nQ1,1\n")
+	types := filepath.Join(dir, "types.br")
+	writeBrotli(types, "Q1 place\nQ3 human\nQ4 human\nQ5 human\n")
+
+	date := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	paths, err := buildTypedQRank(date, qrank, types, dir, sortSettings{}, context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct{ typ, want string }{
+		{"human", "Entity,QRank\nQ4,77\nQ5,42\n"},
+		{"place", "Entity,QRank\nQ1,1\n"},
+		{"taxon", "Entity,QRank\n"},
+		{"work", "Entity,QRank\n"},
+	} {
+		wantPath := filepath.Join(dir, "qrank-"+tc.typ+"-20240301.gz")
+		if paths[tc.typ] != wantPath {
+			t.Errorf("got %q, want %q", paths[tc.typ], wantPath)
+		}
+		if got := readGzipFile(paths[tc.typ]); got != tc.want {
+			t.Errorf("%s: got %q, want %q", tc.typ, got, tc.want)
+		}
+	}
+}
@@ -12,10 +12,10 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
-	"runtime"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 	"unicode"
 	"unicode/utf16"
@@ -23,6 +23,7 @@ import (
 
 	"golang.org/x/sync/errgroup"
 	"golang.org/x/text/cases"
+	"golang.org/x/text/transform"
 	"golang.org/x/text/unicode/norm"
 
 	"github.com/klauspost/compress/zstd"
@@ -229,25 +230,87 @@ func formatLine(lang, site, title, value string) string {
 		lang = "yue"
 	}
 
-	var buf strings.Builder
-	buf.Grow(len(lang) + len(site) + len(title) + len(value) + 6)
-	buf.WriteString(lang)
-	buf.WriteByte('.')
-	buf.WriteString(site)
-	buf.WriteByte('/')
+	buf := lineBufferPool.Get().(*lineBuffer)
+	defer lineBufferPool.Put(buf)
+
+	// Case-fold the title into a re-used buffer, to avoid allocating
+	// for every line. The caser never fails on valid UTF-8, but if it
+	// does, we fall back to the allocating variant.
+	buf.title = append(buf.title[:0], title...)
+	folded, _, err := transform.Append(caser, buf.folded[:0], buf.title)
+	if err != nil {
+		folded = append(buf.folded[:0], caser.String(title)...)
+	}
+	buf.folded = folded
+
+	line := buf.line[:0]
+	line = append(line, lang...)
+	line = append(line, '.')
+	line = append(line, site...)
+	line = append(line, '/')
 	var it norm.Iter
-	it.InitString(norm.NFC, caser.String(title))
+	it.Init(norm.NFC, folded)
 	for !it.Done() {
 		c := it.Next()
 		if c[0] > 0x20 {
-			buf.Write(c)
+			line = append(line, c...)
 		} else {
-			buf.WriteByte('_')
+			line = append(line, '_')
+		}
+	}
+	line = append(line, ' ')
+	line = append(line, value...)
+	buf.line = line
+	return string(line)
+}
+
+// LineBuffer holds scratch space for formatLine, which gets called
+// for billions of lines.
+type lineBuffer struct {
+	title, folded, line []byte
+}
+
+var lineBufferPool = sync.Pool{
+	New: func() any { return &lineBuffer{} },
+}
+
+// SplitInto splits a line at each separator byte, exactly like
+// bytes.Split, but stores the parts into cols instead of allocating
+// a new slice. It returns the number of parts in the line, which can
+// be larger than len(cols); only the first len(cols) parts get stored.
+func splitInto(line []byte, sep byte, cols [][]byte) int {
+	n := 0
+	for {
+		i := bytes.IndexByte(line, sep)
+		if i < 0 {
+			if n < len(cols) {
+				cols[n] = line
+			}
+			return n + 1
+		}
+		if n < len(cols) {
+			cols[n] = line[:i]
+		}
+		n++
+		line = line[i+1:]
+	}
+}
+
+// ParseInt parses a decimal number like strconv.ParseInt(s, 10, 64),
+// but without converting the bytes to a string first. The common case
+// of plain digits is handled without allocating.
+func parseInt(b []byte) (int64, error) {
+	if len(b) == 0 || len(b) > 18 {
+		return strconv.ParseInt(string(b), 10, 64)
+	}
+	var n int64
+	for _, c := range b {
+		if c < '0' || c > '9' {
+			return strconv.ParseInt(string(b), 10, 64)
 		}
+		n = n*10 + int64(c-'0')
 	}
-	buf.WriteByte(' ')
-	buf.WriteString(value)
-	return buf.String()
+	return n, nil
 }
 
 // getu4 decodes \uXXXX from the beginning of s, returning the hex value,
@@ -434,7 +497,7 @@ func ISOWeekStart(year, week int) time.Time {
 	return t.AddDate(0, 0, (week-w)*7)
 }
 
-func SortLines(ctx context.Context, path string) (string, error) {
+func SortLines(ctx context.Context, path string, sorting sortSettings) (string, error) {
 	outFile, err := os.CreateTemp("", "*-sorted.zst")
 	if err != nil {
 		return "", err
@@ -444,10 +507,8 @@ func SortLines(ctx context.Context, path string) (string, error) {
 	if err != nil {
 		return "", err
 	}
-	linesChan := make(chan string, 10000)
-	config := extsort.DefaultConfig()
-	config.ChunkSize = 8 * 1024 * 1024 / 64 // 8 MiB, 64 Bytes/line avg
-	config.NumWorkers = runtime.NumCPU()
+	linesChan := make(chan string, sorting.buffer(10000))
+	config := sorting.newConfig(8*1024*1024/64, 64) // 8 MiB, 64 Bytes/line avg
 	sorter, sortedChan, errChan := extsort.Strings(linesChan, config)
 	group, groupCtx := errgroup.WithContext(ctx)
 	group.Go(func() error {
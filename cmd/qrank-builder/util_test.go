@@ -13,6 +13,7 @@ import (
 	"path/filepath"
 	"regexp"
 	"slices"
+	"strconv"
 	"strings"
 	"testing"
 
@@ -159,6 +160,43 @@ func TestFormatLine(t *testing.T) {
 	}
 }
 
+func BenchmarkFormatLine(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		formatLine("de", "wikipedia", "Straße nach Zürich", "Q34442")
+	}
+}
+
+func TestSplitInto(t *testing.T) {
+	for _, tc := range []string{"", " ", "a", "a  b", "a b c d e f g h"} {
+		var cols [5][]byte
+		want := strings.Split(tc, " ")
+		n := splitInto([]byte(tc), ' ', cols[:])
+		if n != len(want) {
+			t.Errorf("splitInto(%q) = %d, want %d", tc, n, len(want))
+			continue
+		}
+		for i := 0; i < min(n, len(cols)); i++ {
+			if string(cols[i]) != want[i] {
+				t.Errorf("splitInto(%q): cols[%d] = %q, want %q", tc, i, cols[i], want[i])
+			}
+		}
+	}
+}
+
+func TestParseInt(t *testing.T) {
+	for _, tc := range []string{
+		"0", "7", "123456789012345678", "9223372036854775807",
+		"9223372036854775808", "-12", "+3", "", "1x", "١٢",
+	} {
+		want, wantErr := strconv.ParseInt(tc, 10, 64)
+		got, err := parseInt([]byte(tc))
+		if got != want || (err == nil) != (wantErr == nil) {
+			t.Errorf("parseInt(%q) = %d, %v; want %d, %v", tc, got, err, want, wantErr)
+		}
+	}
+}
+
 func TestUnquote(t *testing.T) {
 	tests := []struct{ in, expected string }{
 		{in: `"Foo:Bar"`, expected: "Foo:Bar"},
@@ -230,7 +268,7 @@ func TestSortLines(t *testing.T) {
 	os.WriteFile(unsorted.Name(), []byte("C\nB\nA\n"), 0666)
 
 	ctx := context.Background()
-	gotPath, err := SortLines(ctx, unsorted.Name())
+	gotPath, err := SortLines(ctx, unsorted.Name(), sortSettings{})
 	if err != nil {
 		t.Fatal(err)
 	}
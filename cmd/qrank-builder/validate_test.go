@@ -0,0 +1,156 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidateArtifact(t *testing.T) {
+	dir := t.TempDir()
+	good := filepath.Join(dir, "good.gz")
+	writeGzipFile(good, "Entity,QRank\nQ42,7\n")
+	empty := filepath.Join(dir, "empty.gz")
+	writeGzipFile(empty, "Entity,QRank\n")
+	truncated := filepath.Join(dir, "truncated.gz")
+	data, err := os.ReadFile(good)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(truncated, data[:len(data)-5], 0644); err != nil {
+		t.Fatal(err)
+	}
+	goodJSON := filepath.Join(dir, "good.json")
+	if err := os.WriteFile(goodJSON, []byte(`{"Median":1}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	badJSON := filepath.Join(dir, "bad.json")
+	if err := os.WriteFile(badJSON, []byte(`{"Median":`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		dest, src string
+		ok        bool
+	}{
+		{"public/qrank-20240301.csv.gz", good, true},
+		{"public/qrank-20240301.csv.gz", empty, false},
+		{"public/qrank-20240301.csv.gz", truncated, false},
+		{"public/qrank-stats-20240301.json", goodJSON, true},
+		{"public/qrank-stats-20240301.json", badJSON, false},
+		{"public/qrank-bloom-20240301.bin", badJSON, true},
+	} {
+		err := validateArtifact(artifact{tc.dest, tc.src, ""})
+		if (err == nil) != tc.ok {
+			t.Errorf("%s from %s: got error %v, want ok=%v", tc.dest, tc.src, err, tc.ok)
+		}
+	}
+}
+
+func TestValidateQRank(t *testing.T) {
+	for _, tc := range []struct {
+		content   string
+		numRanked int64
+		want      string
+	}{
+		{"Entity,QRank\nQ42,7\nQ1,7\nQ64,3\n", -1, ""},
+		{"Entity,QRank\nQ42,7\nQ1,7\nQ64,3\n", 3, ""},
+		{"Entity,QRank\nQ42,7\nQ1,7\nQ64,3\n", 4, "test.csv: 3 rows, but the statistics give 4 ranked entities"},
+		{"", -1, "test.csv: empty file"},
+		{"Entity,QRank\n", -1, "test.csv: no data rows"},
+		{"Item,Score\nQ42,7\n", -1, `test.csv:1: expected header "Entity,QRank", got "Item,Score"`},
+		{"Entity,QRank\nQ42,7\nQ1,8\n", -1, "test.csv:3: score 8 of Q1 is higher than 7 in the previous line"},
+		{"Entity,QRank\nQ42,7\nQ1,5\nQ42,5\n", -1, "test.csv:4: duplicate entity Q42"},
+		{"Entity,QRank\nL42,7\n", -1, `test.csv:2: malformed entity "L42"`},
+		{"Entity,QRank\nQ042,7\n", -1, `test.csv:2: malformed entity "Q042"`},
+		{"Entity,QRank\nQ-4,7\n", -1, `test.csv:2: malformed entity "Q-4"`},
+		{"Entity,QRank\nQ,7\n", -1, `test.csv:2: malformed entity "Q"`},
+		{"Entity,QRank\nQ42\n", -1, `test.csv:2: expected two columns, got "Q42"`},
+		{"Entity,QRank\nQ42,-7\n", -1, `test.csv:2: malformed score "-7" for Q42`},
+		{"Entity,QRank\nQ42,7,1\n", -1, `test.csv:2: malformed score "7,1" for Q42`},
+	} {
+		_, err := validateQRank("test.csv", strings.NewReader(tc.content), tc.numRanked)
+		got := ""
+		if err != nil {
+			got = err.Error()
+		}
+		if got != tc.want {
+			t.Errorf("content %q: got error %q, want %q", tc.content, got, tc.want)
+		}
+	}
+}
+
+func TestValidateItemSignals(t *testing.T) {
+	const header = "item,pageviews_52w,wikitext_bytes,claims,identifiers,sitelinks\n"
+	for _, tc := range []struct {
+		content string
+		want    string
+	}{
+		{header + "Q1,7,0,3,0,1\nQ42,0,0,0,0,0\n", ""},
+		{"", "test.csv: empty file"},
+		{header, "test.csv: no data rows"},
+		{"item,pageviews\nQ1,7\n", `test.csv:1: expected header "item,pageviews_52w,wikitext_bytes,claims,identifiers,sitelinks", got "item,pageviews"`},
+		{header + "Q42,0,0,0,0,0\nQ1,7,0,3,0,1\n", "test.csv:3: Q1 is not after Q42 in the previous line"},
+		{header + "Q42,0,0,0,0,0\nQ42,0,0,0,0,0\n", "test.csv:3: Q42 is not after Q42 in the previous line"},
+		{header + "Q042,0,0,0,0,0\n", `test.csv:2: malformed entity "Q042"`},
+		{header + "Q42,0,0,0,0\n", "test.csv:2: expected 6 columns, got 5"},
+		{header + "Q42,0,-1,0,0,0\n", `test.csv:2: malformed count "-1" for Q42`},
+	} {
+		_, err := validateItemSignals("test.csv", strings.NewReader(tc.content))
+		got := ""
+		if err != nil {
+			got = err.Error()
+		}
+		if got != tc.want {
+			t.Errorf("content %q: got error %q, want %q", tc.content, got, tc.want)
+		}
+	}
+}
+
+func TestValidateRelease(t *testing.T) {
+	dir := t.TempDir()
+	qrank := filepath.Join(dir, "qrank.csv.gz")
+	writeGzipFile(qrank, "Entity,QRank\nQ42,7\nQ1,3\n")
+	stats := filepath.Join(dir, "stats.json")
+	if err := os.WriteFile(stats, []byte(`{"NumRanked":3}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	date := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	artifacts := []artifact{
+		{"public/qrank-20240301.csv.gz", qrank, "text/csv"},
+		{"public/qrank-stats-20240301.json", stats, "application/json"},
+	}
+	err := validateRelease("public/", date, artifacts)
+	if err == nil || !strings.HasSuffix(err.Error(), "2 rows, but the statistics give 3 ranked entities") {
+		t.Errorf("got %v, want error about row count", err)
+	}
+
+	if err := os.WriteFile(stats, []byte(`{"NumRanked":2}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := validateRelease("public/", date, artifacts); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestEntitySet(t *testing.T) {
+	var s entitySet
+	for _, id := range []int64{1, 64, 63, 100000, 2} {
+		if !s.add(id) {
+			t.Errorf("add(%d) returned false for new entity", id)
+		}
+	}
+	for _, id := range []int64{1, 64, 63, 100000, 2} {
+		if s.add(id) {
+			t.Errorf("add(%d) returned true for existing entity", id)
+		}
+	}
+	if !s.add(65) {
+		t.Error("add(65) returned false for new entity")
+	}
+}
@@ -0,0 +1,286 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// MaxVerifyExamples is how many differing rows get reported
+// when verifying a release.
+const maxVerifyExamples = 10
+
+// VerifyResult tells how a rebuilt release compares to the published one.
+type verifyResult struct {
+	Release     string
+	Identical   bool // byte for byte
+	Rows        int64
+	RebuiltRows int64
+	Changed     int64 // rows for the same item, but with different signals
+	Missing     int64 // rows in the published release, but not in the rebuilt one
+	Added       int64 // rows in the rebuilt release, but not in the published one
+	Examples    []string
+}
+
+// Deterministic reports whether the rebuilt release has the same rows
+// as the published one. The files may still differ in their bytes,
+// for example if a newer version of the compression library has
+// compressed them differently.
+func (r *verifyResult) deterministic() bool {
+	return r.Changed == 0 && r.Missing == 0 && r.Added == 0 && r.Rows == r.RebuiltRows
+}
+
+// LoadProvenance reads the provenance manifest of a release from storage.
+func loadProvenance(ctx context.Context, cfg *buildConfig, release time.Time, s3 S3) (*provenance, error) {
+	key := provenanceKey(cfg.PublicPrefix, release)
+	stored, err := storedSizes(ctx, cfg.Bucket, key, s3)
+	if err != nil {
+		return nil, err
+	}
+	if _, found := stored[key]; !found {
+		return nil, fmt.Errorf("release %s has no provenance manifest at %s", release.Format(time.DateOnly), key)
+	}
+
+	r, err := NewS3Reader(ctx, cfg.Bucket, key, s3)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var p provenance
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("%s: %w", key, err)
+	}
+	return &p, nil
+}
+
+// PinnedInputs works out how to read the same inputs as recorded
+// in a provenance manifest: the date as of which to take pageviews,
+// the number of weeks, and the dump dates for each site.
+func pinnedInputs(p *provenance) (time.Time, int, map[string]time.Time, error) {
+	var lastWeek string
+	numWeeks := 0
+	sites := make(map[string]time.Time, len(p.Inputs))
+	for _, input := range p.Inputs {
+		if input.Source == "pageviews" {
+			numWeeks += 1
+			if input.Date > lastWeek {
+				lastWeek = input.Date
+			}
+			continue
+		}
+		dumped, err := time.Parse(time.DateOnly, input.Date)
+		if err != nil {
+			return time.Time{}, 0, nil, fmt.Errorf("bad date for %s in provenance manifest: %w", input.Source, err)
+		}
+		sites[input.Source] = dumped
+	}
+	if numWeeks == 0 {
+		return time.Time{}, 0, nil, fmt.Errorf("provenance manifest lists no pageviews")
+	}
+	year, week, err := ParseISOWeek(lastWeek)
+	if err != nil {
+		return time.Time{}, 0, nil, err
+	}
+	lastSunday := ISOWeekStart(year, week).AddDate(0, 0, 6)
+	return lastSunday, numWeeks, sites, nil
+}
+
+// VerifyRelease rebuilds a published release from the inputs that are
+// recorded in its provenance manifest, and compares the result with
+// the published file. The rebuild starts from scratch, in a temporary
+// storage directory, so it re-runs all stages of the pipeline and
+// leaves the production storage untouched. The dumps that went into
+// the release must still be available.
+func verifyRelease(ctx context.Context, client *http.Client, cfg *buildConfig, release time.Time, s3 S3) (*verifyResult, error) {
+	p, err := loadProvenance(ctx, cfg, release, s3)
+	if err != nil {
+		return nil, err
+	}
+	asOf, numWeeks, sites, err := pinnedInputs(p)
+	if err != nil {
+		return nil, err
+	}
+
+	scratchDir, err := os.MkdirTemp("", "qrank-verify-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(scratchDir)
+	if err := os.MkdirAll(filepath.Join(scratchDir, cfg.Bucket), 0755); err != nil {
+		return nil, err
+	}
+	scratch := NewLocalStorage(scratchDir)
+
+	rebuildCfg := *cfg
+	rebuildCfg.NumWeeks, rebuildCfg.Stages = numWeeks, nil
+	rebuildCfg.AsOf, rebuildCfg.PinnedSites = asOf, sites
+	logger.Printf("verify: rebuilding release %s from %d weeks of pageviews up to %s and %d site dumps", p.Release, numWeeks, asOf.Format(time.DateOnly), len(sites))
+	if err := Build(ctx, client, &rebuildCfg, scratch); err != nil {
+		return nil, fmt.Errorf("rebuilding release %s: %w", p.Release, err)
+	}
+
+	key := fmt.Sprintf("%sitem_signals-%s.csv.zst", cfg.PublicPrefix, release.Format("20060102"))
+	rebuilt, err := storedSizes(ctx, cfg.Bucket, key, scratch)
+	if err != nil {
+		return nil, err
+	}
+	if _, found := rebuilt[key]; !found {
+		return nil, fmt.Errorf("rebuild did not produce %s", key)
+	}
+
+	published, err := readStoredFile(ctx, cfg.Bucket, key, s3)
+	if err != nil {
+		return nil, err
+	}
+	rebuiltData, err := readStoredFile(ctx, cfg.Bucket, key, scratch)
+	if err != nil {
+		return nil, err
+	}
+	result, err := compareSignals(bytes.NewReader(published), bytes.NewReader(rebuiltData))
+	if err != nil {
+		return nil, err
+	}
+	result.Release = p.Release
+	result.Identical = sha256.Sum256(published) == sha256.Sum256(rebuiltData)
+	return result, nil
+}
+
+// ReadStoredFile reads an entire file from storage.
+func readStoredFile(ctx context.Context, bucket string, key string, s3 S3) ([]byte, error) {
+	r, err := NewS3Reader(ctx, bucket, key, s3)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// CompareSignals compares two zstd-compressed item signals files,
+// row by row. Both files are sorted by item ID, so we can merge them.
+func compareSignals(published, rebuilt io.Reader) (*verifyResult, error) {
+	pubDecompressor, err := zstd.NewReader(published)
+	if err != nil {
+		return nil, err
+	}
+	defer pubDecompressor.Close()
+	rebuiltDecompressor, err := zstd.NewReader(rebuilt)
+	if err != nil {
+		return nil, err
+	}
+	defer rebuiltDecompressor.Close()
+
+	pub := bufio.NewScanner(pubDecompressor)
+	reb := bufio.NewScanner(rebuiltDecompressor)
+	result := &verifyResult{}
+	example := func(format string, args ...any) {
+		if len(result.Examples) < maxVerifyExamples {
+			result.Examples = append(result.Examples, fmt.Sprintf(format, args...))
+		}
+	}
+
+	// Compare the header lines.
+	pubMore, rebMore := pub.Scan(), reb.Scan()
+	if pubMore && rebMore && pub.Text() != reb.Text() {
+		result.Changed += 1
+		example("header: published %q, rebuilt %q", pub.Text(), reb.Text())
+	}
+	if pubMore {
+		pubMore = pub.Scan()
+	}
+	if rebMore {
+		rebMore = reb.Scan()
+	}
+
+	for pubMore || rebMore {
+		var pubItem, rebItem int64 = -1, -1
+		if pubMore {
+			if pubItem, err = signalsItem(pub.Text()); err != nil {
+				return nil, err
+			}
+		}
+		if rebMore {
+			if rebItem, err = signalsItem(reb.Text()); err != nil {
+				return nil, err
+			}
+		}
+		switch {
+		case pubMore && (!rebMore || pubItem < rebItem):
+			result.Rows += 1
+			result.Missing += 1
+			example("missing: %s", pub.Text())
+			pubMore = pub.Scan()
+
+		case rebMore && (!pubMore || rebItem < pubItem):
+			result.RebuiltRows += 1
+			result.Added += 1
+			example("added: %s", reb.Text())
+			rebMore = reb.Scan()
+
+		default:
+			result.Rows += 1
+			result.RebuiltRows += 1
+			if pub.Text() != reb.Text() {
+				result.Changed += 1
+				example("changed: published %s, rebuilt %s", pub.Text(), reb.Text())
+			}
+			pubMore, rebMore = pub.Scan(), reb.Scan()
+		}
+	}
+	if err := pub.Err(); err != nil {
+		return nil, err
+	}
+	if err := reb.Err(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// SignalsItem returns the numeric item ID of a row in an item signals
+// file, such as 72 for "Q72,5585,3142,550,85,186".
+func signalsItem(line string) (int64, error) {
+	item, _, _ := strings.Cut(line, ",")
+	id, err := strconv.ParseInt(strings.TrimPrefix(item, "Q"), 10, 64)
+	if err != nil || !strings.HasPrefix(item, "Q") {
+		return 0, fmt.Errorf("bad item in signals row %q", line)
+	}
+	return id, nil
+}
+
+// WriteVerifyResult prints the result of verifying a release
+// in human-readable form.
+func writeVerifyResult(w io.Writer, r *verifyResult) error {
+	var b strings.Builder
+	switch {
+	case r.Identical:
+		fmt.Fprintf(&b, "release %s: reproducible, rebuilt file is identical byte for byte\n", r.Release)
+	case r.deterministic():
+		fmt.Fprintf(&b, "release %s: reproducible, all %d rows are identical, but the compressed files differ\n", r.Release, r.Rows)
+	default:
+		fmt.Fprintf(&b, "release %s: NOT reproducible\n", r.Release)
+		fmt.Fprintf(&b, "rows: %d published, %d rebuilt; %d changed, %d missing, %d added\n", r.Rows, r.RebuiltRows, r.Changed, r.Missing, r.Added)
+		for _, e := range r.Examples {
+			fmt.Fprintf(&b, "  %s\n", e)
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
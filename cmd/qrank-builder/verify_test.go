@@ -0,0 +1,138 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerifyRelease(t *testing.T) {
+	if testing.Short() {
+		t.Skip()
+	}
+
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	ctx := context.Background()
+	cfg := newBuildConfig(filepath.Join("testdata", "dumps"))
+	cfg.NumWeeks = 1
+	client := &http.Client{Transport: &FakeWikiSite{}}
+	s3 := NewFakeS3()
+	if err := Build(ctx, client, cfg, s3); err != nil {
+		t.Fatal(err)
+	}
+
+	release := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	result, err := verifyRelease(ctx, client, cfg, release, s3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.deterministic() || result.Rows != 9 {
+		var buf strings.Builder
+		writeVerifyResult(&buf, result)
+		t.Errorf("release should be reproducible, got %s", buf.String())
+	}
+	if !cfg.AsOf.IsZero() || cfg.PinnedSites != nil {
+		t.Error("verifying should not change the build settings")
+	}
+
+	// Tamper with the published release.
+	key := "public/item_signals-20240501.csv.zst"
+	lines, err := s3.ReadLines(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines[1] = "Q72,1,3142,550,85,186"
+	lines = append(lines, "Q999999999,1,2,3,4,5")
+	if err := s3.WriteLines(lines, key); err != nil {
+		t.Fatal(err)
+	}
+	result, err = verifyRelease(ctx, client, cfg, release, s3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.deterministic() || result.Changed != 1 || result.Missing != 1 {
+		t.Errorf("got %+v, want 1 changed and 1 missing row", result)
+	}
+}
+
+func TestVerifyRelease_NoProvenance(t *testing.T) {
+	logger = log.New(&bytes.Buffer{}, "", log.Lshortfile)
+	release := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	_, err := verifyRelease(context.Background(), nil, newBuildConfig("testdata/dumps"), release, NewFakeS3())
+	if err == nil || !strings.Contains(err.Error(), "no provenance manifest") {
+		t.Errorf("got %v, want error about missing provenance manifest", err)
+	}
+}
+
+func TestPinnedInputs(t *testing.T) {
+	p := &provenance{Inputs: []provenanceInput{
+		{Source: "pageviews", Date: "2024-W09"},
+		{Source: "pageviews", Date: "2024-W10"},
+		{Source: "rmwiki", Date: "2024-03-01"},
+	}}
+	asOf, numWeeks, sites, err := pinnedInputs(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := asOf.Format(time.DateOnly); got != "2024-03-10" {
+		t.Errorf("got asOf=%s, want 2024-03-10", got)
+	}
+	if numWeeks != 2 {
+		t.Errorf("got numWeeks=%d, want 2", numWeeks)
+	}
+	if len(sites) != 1 || sites["rmwiki"].Format(time.DateOnly) != "2024-03-01" {
+		t.Errorf("got sites=%v, want rmwiki 2024-03-01", sites)
+	}
+
+	if _, _, _, err := pinnedInputs(&provenance{}); err == nil {
+		t.Error("expected error for manifest without pageviews")
+	}
+}
+
+func TestCompareSignals(t *testing.T) {
+	s3 := NewFakeS3()
+	header := "item,pageviews_52w,wikitext_bytes,claims,identifiers,sitelinks"
+	if err := s3.WriteLines([]string{header, "Q1,1,1,1,1,1", "Q3,3,3,3,3,3", "Q20,4,4,4,4,4"}, "published.zst"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s3.WriteLines([]string{header, "Q1,1,1,1,1,1", "Q5,5,5,5,5,5", "Q20,4,4,4,4,7"}, "rebuilt.zst"); err != nil {
+		t.Fatal(err)
+	}
+	result, err := compareSignals(
+		bytes.NewReader(s3.data["published.zst"]),
+		bytes.NewReader(s3.data["rebuilt.zst"]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Rows != 3 || result.RebuiltRows != 3 || result.Changed != 1 || result.Missing != 1 || result.Added != 1 {
+		t.Errorf("got %+v", result)
+	}
+	want := []string{
+		"missing: Q3,3,3,3,3,3",
+		"added: Q5,5,5,5,5,5",
+		"changed: published Q20,4,4,4,4,4, rebuilt Q20,4,4,4,4,7",
+	}
+	if strings.Join(result.Examples, "|") != strings.Join(want, "|") {
+		t.Errorf("got examples %q, want %q", result.Examples, want)
+	}
+}
+
+func TestWriteVerifyResult(t *testing.T) {
+	var buf strings.Builder
+	r := &verifyResult{Release: "2024-05-01", Rows: 9, RebuiltRows: 9}
+	if err := writeVerifyResult(&buf, r); err != nil {
+		t.Fatal(err)
+	}
+	want := "release 2024-05-01: reproducible, all 9 rows are identical, but the compressed files differ\n"
+	if buf.String() != want {
+		t.Errorf("got %q, want %q", buf.String(), want)
+	}
+}
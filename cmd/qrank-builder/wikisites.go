@@ -43,7 +43,49 @@ type WikiSites struct {
 	Domains map[string]*WikiSite
 }
 
-func ReadWikiSites(client *http.Client, dumps string) (*WikiSites, error) {
+// SiteDumpFiles are the dump files that must be present for a site
+// to get processed.
+var siteDumpFiles = []string{"page.sql.gz", "pagelinks.sql.gz", "page_props.sql.gz"}
+
+// SiteDumpAsOf returns the date of the most recent complete dump
+// of a site on or before a date. If there is no such dump, the result
+// is the zero time.Time without error.
+func siteDumpAsOf(dumps string, key string, date time.Time) (time.Time, error) {
+	entries, err := os.ReadDir(filepath.Join(dumps, key))
+	if err != nil {
+		return time.Time{}, err
+	}
+	versions := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if e.IsDir() && len(e.Name()) == 8 {
+			versions = append(versions, e.Name())
+		}
+	}
+	slices.Sort(versions)
+	slices.Reverse(versions)
+
+	for _, version := range versions {
+		dumped, err := time.Parse("20060102", version)
+		if err != nil || dumped.After(date) {
+			continue
+		}
+		complete := true
+		for _, f := range siteDumpFiles {
+			path := filepath.Join(dumps, key, version, fmt.Sprintf("%s-%s-%s", key, version, f))
+			if _, err := os.Stat(path); err != nil {
+				complete = false
+				break
+			}
+		}
+		if complete {
+			return dumped, nil
+		}
+	}
+	return time.Time{}, nil
+}
+
+func ReadWikiSites(client *http.Client, cfg *buildConfig) (*WikiSites, error) {
+	dumps := cfg.Dumps
 	dirContent, err := os.ReadDir(dumps)
 	if err != nil {
 		return nil, err
@@ -99,15 +141,34 @@ func ReadWikiSites(client *http.Client, dumps string) (*WikiSites, error) {
 			continue
 		}
 
-		for _, f := range []string{"page.sql.gz", "pagelinks.sql.gz", "page_props.sql.gz"} {
-			latestFile := fmt.Sprintf("%s-latest-%s", site.Key, f)
-			latestPath := filepath.Join(dumps, site.Key, "latest", latestFile)
-			if latest, err := filepath.EvalSymlinks(latestPath); err == nil {
-				dir, _ := filepath.Split(latest)
-				_, version := filepath.Split(filepath.Dir(dir))
-				if dumped, err := time.Parse("20060102", version); err == nil {
-					if site.LastDumped.IsZero() || dumped.Before(site.LastDumped) {
-						site.LastDumped = dumped
+		if cfg.PinnedSites != nil {
+			pinned, ok := cfg.PinnedSites[site.Key]
+			if !ok {
+				continue
+			}
+			site.LastDumped, err = siteDumpAsOf(dumps, site.Key, pinned)
+			if err != nil {
+				return nil, err
+			}
+			if !site.LastDumped.Equal(pinned) {
+				return nil, fmt.Errorf("dump of %s from %s is no longer available", site.Key, pinned.Format(time.DateOnly))
+			}
+		} else if !cfg.AsOf.IsZero() {
+			site.LastDumped, err = siteDumpAsOf(dumps, site.Key, cfg.AsOf)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			for _, f := range siteDumpFiles {
+				latestFile := fmt.Sprintf("%s-latest-%s", site.Key, f)
+				latestPath := filepath.Join(dumps, site.Key, "latest", latestFile)
+				if latest, err := filepath.EvalSymlinks(latestPath); err == nil {
+					dir, _ := filepath.Split(latest)
+					_, version := filepath.Split(filepath.Dir(dir))
+					if dumped, err := time.Parse("20060102", version); err == nil {
+						if site.LastDumped.IsZero() || dumped.Before(site.LastDumped) {
+							site.LastDumped = dumped
+						}
 					}
 				}
 			}
@@ -33,7 +33,7 @@ func TestWikiSiteS3Path(t *testing.T) {
 
 func TestReadWikiSites(t *testing.T) {
 	client := &http.Client{Transport: &FakeWikiSite{}}
-	sites, err := ReadWikiSites(client, filepath.Join("testdata", "dumps"))
+	sites, err := ReadWikiSites(client, newBuildConfig(filepath.Join("testdata", "dumps")))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -105,8 +105,27 @@ func TestReadWikiSites(t *testing.T) {
 	}
 }
 
+func TestReadWikiSites_AsOf(t *testing.T) {
+	cfg := newBuildConfig(filepath.Join("testdata", "dumps"))
+	cfg.AsOf = time.Date(2024, 4, 15, 0, 0, 0, 0, time.UTC)
+	sites, err := ReadWikiSites(nil, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The loginwiki dump of 2024-05-01 is too recent.
+	if _, found := sites.Sites["loginwiki"]; found {
+		t.Error("loginwiki should not be included")
+	}
+	for key, want := range map[string]string{"rmwiki": "2024-03-01", "wikidatawiki": "2024-04-01"} {
+		if got := sites.Sites[key].LastDumped.Format(time.DateOnly); got != want {
+			t.Errorf("got %s, want %s, for sites[%q].LastDumped", got, want, key)
+		}
+	}
+}
+
 func TestReadWikiSites_BadPath(t *testing.T) {
-	_, err := ReadWikiSites(nil, filepath.Join("testdata", "no-such-dir"))
+	_, err := ReadWikiSites(nil, newBuildConfig(filepath.Join("testdata", "no-such-dir")))
 	if !os.IsNotExist(err) {
 		t.Errorf("want os.NotExists, got %v", err)
 	}
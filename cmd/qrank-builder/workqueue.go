@@ -0,0 +1,119 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// WorkQueuePrefix is the start of the storage keys of the leases
+// on units of work, such as "internal/qrank-builder/queue/titles/rmwiki.json".
+const workQueuePrefix = "internal/qrank-builder/queue/"
+
+// WorkQueue lets several builders, such as multiple Toolforge jobs,
+// share the work of a build. The units of work, such as a week of
+// pageviews or the titles of one wiki, get claimed with a lease in
+// object storage, one per unit. When a builder has completed a unit,
+// it marks the lease as done, together with the identity of the input
+// dumps. Workers build whatever units nobody else has claimed, and exit
+// when no unclaimed work is left. The coordinator does the same, but
+// then waits for the units that are still being built elsewhere, taking
+// over any unit whose lease expires. Finally, the coordinator runs the
+// stages that need the output of all units, such as item_signals.
+type workQueue struct {
+	s3     S3
+	bucket string
+	holder string
+	ttl    time.Duration
+	poll   time.Duration
+	worker bool
+}
+
+// WorkerStages returns the stages that workers run, which are those
+// of the selected stages that get split into units of work. The later
+// stages need the output of all units, so they are left to the builder
+// that coordinates the workers.
+func workerStages(stages map[string]bool) map[string]bool {
+	result := make(map[string]bool, len(buildStages))
+	for _, stage := range buildStages {
+		if stage != "item_signals" && stage != "release" && (stages == nil || stages[stage]) {
+			result[stage] = true
+		}
+	}
+	return result
+}
+
+// IsWorker tells whether we are only helping another builder.
+func (q *workQueue) isWorker() bool {
+	return q != nil && q.worker
+}
+
+// Run builds a unit of work, unless another builder has claimed it.
+// The result tells whether the unit is done, either because we have
+// just built it, or because another builder has already built it from
+// the same input. Without a work queue, the unit always gets built.
+func (q *workQueue) run(ctx context.Context, stage, unit, input string, build func(context.Context) error) (bool, error) {
+	if q == nil {
+		return true, build(ctx)
+	}
+
+	lease := &buildLease{
+		s3:     q.s3,
+		bucket: q.bucket,
+		key:    workQueuePrefix + stage + "/" + unit + ".json",
+		input:  input,
+		holder: q.holder,
+		ttl:    q.ttl,
+		now:    time.Now,
+	}
+	if err := lease.acquire(ctx); err != nil {
+		if errors.Is(err, errUnitDone) {
+			return true, nil
+		}
+		if errors.Is(err, errLeaseHeld) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	leaseCtx, stop := lease.keepAlive(ctx)
+	err := build(leaseCtx)
+	if cause := context.Cause(leaseCtx); errors.Is(cause, errLeaseLost) {
+		err = cause
+	}
+	stop()
+
+	// Give up the lease on failure, so another builder can retry.
+	ctx = context.WithoutCancel(ctx)
+	if err != nil {
+		if !errors.Is(err, errLeaseLost) {
+			lease.release(ctx)
+		}
+		return false, err
+	}
+	if err := lease.finish(ctx); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Await waits until another builder has completed a unit of work.
+// If the other builder gives up or crashes, so its lease expires,
+// we build the unit ourselves. Workers do not wait for each other;
+// for them, Await returns right away.
+func (q *workQueue) await(ctx context.Context, stage, unit, input string, build func(context.Context) error) (bool, error) {
+	for {
+		done, err := q.run(ctx, stage, unit, input, build)
+		if err != nil || done || q.isWorker() {
+			return done, err
+		}
+		select {
+		case <-time.After(q.poll):
+		case <-ctx.Done():
+			return false, ctx.Err()
+		}
+	}
+}
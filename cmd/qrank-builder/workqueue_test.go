@@ -0,0 +1,130 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestWorkQueue(t *testing.T) {
+	ctx := context.Background()
+	s3 := NewFakeS3()
+	alice := &workQueue{s3: s3, bucket: "qrank", holder: "alice", ttl: time.Minute, poll: time.Millisecond}
+	bob := &workQueue{s3: s3, bucket: "qrank", holder: "bob", ttl: time.Minute, poll: time.Millisecond, worker: true}
+
+	built := 0
+	build := func(ctx context.Context) error {
+		built += 1
+		return nil
+	}
+
+	// Once Bob has built a unit, Alice does not build it again.
+	if done, err := bob.run(ctx, "titles", "rmwiki", "input-1", build); !done || err != nil {
+		t.Fatalf("got %v, %v; want true, nil", done, err)
+	}
+	if done, err := alice.run(ctx, "titles", "rmwiki", "input-1", build); !done || err != nil {
+		t.Fatalf("got %v, %v; want true, nil", done, err)
+	}
+	if built != 1 {
+		t.Errorf("got %d builds, want 1", built)
+	}
+
+	// If the input has changed since, the unit needs to be rebuilt.
+	if done, err := alice.run(ctx, "titles", "rmwiki", "input-2", build); !done || err != nil {
+		t.Fatalf("got %v, %v; want true, nil", done, err)
+	}
+	if built != 2 {
+		t.Errorf("got %d builds, want 2", built)
+	}
+
+	// A failed unit can be retried by another builder.
+	failure := errors.New("test failure")
+	fail := func(ctx context.Context) error { return failure }
+	if done, err := bob.run(ctx, "titles", "dewiki", "input-1", fail); done || err != failure {
+		t.Errorf("got %v, %v; want false, %v", done, err, failure)
+	}
+	if done, err := alice.run(ctx, "titles", "dewiki", "input-1", build); !done || err != nil {
+		t.Fatalf("got %v, %v; want true, nil", done, err)
+	}
+}
+
+func TestWorkQueue_Await(t *testing.T) {
+	ctx := context.Background()
+	s3 := NewFakeS3()
+	alice := &workQueue{s3: s3, bucket: "qrank", holder: "alice", ttl: time.Minute, poll: time.Millisecond}
+	bob := &workQueue{s3: s3, bucket: "qrank", holder: "bob", ttl: time.Minute, poll: time.Millisecond, worker: true}
+
+	// While Alice works on a unit, Bob skips it, and does not wait.
+	started, finish := make(chan struct{}), make(chan struct{})
+	slow := func(ctx context.Context) error {
+		close(started)
+		<-finish
+		return nil
+	}
+	aliceDone := make(chan error)
+	go func() {
+		_, err := alice.run(ctx, "pageviews", "2024-W09", "input", slow)
+		aliceDone <- err
+	}()
+	<-started
+
+	unexpected := func(ctx context.Context) error {
+		t.Error("unit should not have been built")
+		return nil
+	}
+	if done, err := bob.run(ctx, "pageviews", "2024-W09", "input", unexpected); done || err != nil {
+		t.Errorf("got %v, %v; want false, nil", done, err)
+	}
+	if done, err := bob.await(ctx, "pageviews", "2024-W09", "input", unexpected); done || err != nil {
+		t.Errorf("got %v, %v; want false, nil", done, err)
+	}
+
+	// A coordinator waits until the unit is done.
+	carol := &workQueue{s3: s3, bucket: "qrank", holder: "carol", ttl: time.Minute, poll: time.Millisecond}
+	carolDone := make(chan bool)
+	go func() {
+		done, err := carol.await(ctx, "pageviews", "2024-W09", "input", unexpected)
+		if err != nil {
+			t.Error(err)
+		}
+		carolDone <- done
+	}()
+	close(finish)
+	if err := <-aliceDone; err != nil {
+		t.Fatal(err)
+	}
+	if done := <-carolDone; !done {
+		t.Error("await should have returned true")
+	}
+}
+
+func TestWorkQueue_Nil(t *testing.T) {
+	var q *workQueue
+	built := false
+	done, err := q.run(context.Background(), "titles", "rmwiki", "", func(ctx context.Context) error {
+		built = true
+		return nil
+	})
+	if !done || err != nil || !built {
+		t.Errorf("got %v, %v, built=%v", done, err, built)
+	}
+	if q.isWorker() {
+		t.Error("nil queue should not be a worker")
+	}
+}
+
+func TestWorkerStages(t *testing.T) {
+	want := map[string]bool{"pageviews": true, "page_signals": true, "interwiki_links": true, "titles": true, "page_items": true}
+	if got := workerStages(nil); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	got := workerStages(map[string]bool{"titles": true, "item_signals": true})
+	if want := map[string]bool{"titles": true}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,260 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// RecompressZstd converts a gzip-compressed file to zstandard compression,
+// returning the path to the converted file. The output gets written
+// next to the input, with the ".gz" extension replaced by ".zst".
+// Zstandard decompresses several times faster than gzip, which matters
+// for clients that read our ~100M-row ranking file.
+func recompressZstd(gzPath string) (string, error) {
+	zstPath := strings.TrimSuffix(gzPath, ".gz") + ".zst"
+	_, err := os.Stat(zstPath)
+	if err == nil {
+		return zstPath, nil // use pre-existing file
+	}
+	if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	in, err := os.Open(gzPath)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+
+	reader, err := gzip.NewReader(in)
+	if err != nil {
+		return "", err
+	}
+
+	tmpPath := zstPath + ".tmp"
+	out, err := os.Create(tmpPath)
+	if err != nil {
+		return "", err
+	}
+	defer out.Close()
+
+	zstdLevel := zstd.WithEncoderLevel(zstd.SpeedBestCompression)
+	writer, err := zstd.NewWriter(out, zstdLevel)
+	if err != nil {
+		return "", err
+	}
+	defer writer.Close()
+
+	if _, err := io.Copy(writer, reader); err != nil {
+		return "", err
+	}
+	if err := writer.Close(); err != nil {
+		return "", err
+	}
+	if err := out.Sync(); err != nil {
+		return "", err
+	}
+	if err := out.Close(); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmpPath, zstPath); err != nil {
+		return "", err
+	}
+
+	return zstPath, nil
+}
+
+// CacheHeaderMagic is the magic number of the skippable zstd frame
+// at the start of intermediate cache files. Zstandard decoders skip
+// such frames, so the header is invisible to readers of the file.
+const cacheHeaderMagic = 0x184D2A5E
+
+// CacheFooterMagic is the magic number of the skippable zstd frame
+// at the end of intermediate cache files. Its payload is the CRC-32
+// and the length of everything in the file before the footer.
+const cacheFooterMagic = 0x184D2A5F
+
+// CacheFooterSize is the size of the footer frame, in bytes.
+const cacheFooterSize = 8 + 4 + 8
+
+// NewCacheWriter returns a zstd encoder for intermediate cache files,
+// such as weekly pageviews. Compared to brotli at level 9, which we
+// used before, zstd writes several times faster at a similar ratio.
+// Before the compressed data, we write a header that records the
+// compression level, so one can tell later how a file was written.
+// When the writer gets closed, it appends a footer with a checksum,
+// so a truncated or corrupted file can be recognized when it gets
+// reused; see verifyCacheFile. If dict is not empty, the data gets
+// compressed with that dictionary, whose ID also goes into the header.
+func newCacheWriter(w io.Writer, level zstd.EncoderLevel, dict []byte) (*cacheWriter, error) {
+	out := &checksumWriter{w: w, crc: crc32.NewIEEE()}
+	opts := []zstd.EOption{zstd.WithEncoderLevel(level)}
+	if len(dict) > 0 {
+		opts = append(opts, zstd.WithEncoderDict(dict))
+	}
+	encoder, err := zstd.NewWriter(out, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	header := "zstd-level=" + level.String()
+	if id := cacheDictionaryID(dict); id != 0 {
+		header += fmt.Sprintf(" dict=%d", id)
+	}
+	header += " checksum=crc32"
+	buf := make([]byte, 8, 8+len(header))
+	binary.LittleEndian.PutUint32(buf[0:4], cacheHeaderMagic)
+	binary.LittleEndian.PutUint32(buf[4:8], uint32(len(header)))
+	buf = append(buf, header...)
+	if _, err := out.Write(buf); err != nil {
+		return nil, err
+	}
+
+	return &cacheWriter{Encoder: encoder, out: out}, nil
+}
+
+// CacheWriter is a zstd encoder that appends a checksum footer
+// when it gets closed.
+type cacheWriter struct {
+	*zstd.Encoder
+	out    *checksumWriter
+	closed bool
+}
+
+// Close flushes the compressed data and writes the footer.
+// Closing an already closed writer does nothing.
+func (w *cacheWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	if err := w.Encoder.Close(); err != nil {
+		return err
+	}
+
+	var footer [cacheFooterSize]byte
+	binary.LittleEndian.PutUint32(footer[0:4], cacheFooterMagic)
+	binary.LittleEndian.PutUint32(footer[4:8], cacheFooterSize-8)
+	binary.LittleEndian.PutUint32(footer[8:12], w.out.crc.Sum32())
+	binary.LittleEndian.PutUint64(footer[12:20], uint64(w.out.n))
+	_, err := w.out.w.Write(footer[:])
+	return err
+}
+
+// ChecksumWriter computes the CRC-32 and length of the data
+// written through it.
+type checksumWriter struct {
+	w   io.Writer
+	crc hash.Hash32
+	n   int64
+}
+
+func (c *checksumWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.crc.Write(p[:n])
+	c.n += int64(n)
+	return n, err
+}
+
+// VerifyCacheFile checks the checksum footer of an intermediate cache
+// file. Files whose header does not announce a checksum, such as those
+// written by earlier versions, or files that are not cache files at all,
+// pass without checks. A cache file that got truncated has lost its
+// footer, but its header still tells that there should be one.
+func verifyCacheFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	var head [8]byte
+	if _, err := io.ReadFull(f, head[:]); err != nil {
+		return nil // too short for a header
+	}
+	if binary.LittleEndian.Uint32(head[0:4]) != cacheHeaderMagic {
+		return nil
+	}
+	header := make([]byte, min(binary.LittleEndian.Uint32(head[4:8]), 1024))
+	if _, err := io.ReadFull(f, header); err != nil {
+		return fmt.Errorf("%s: truncated cache file", path)
+	}
+	if !slices.Contains(strings.Fields(string(header)), "checksum=crc32") {
+		return nil
+	}
+
+	length := stat.Size() - cacheFooterSize
+	if length < int64(8+len(header)) {
+		return fmt.Errorf("%s: truncated cache file", path)
+	}
+	var footer [cacheFooterSize]byte
+	if _, err := f.ReadAt(footer[:], length); err != nil {
+		return err
+	}
+	if binary.LittleEndian.Uint32(footer[0:4]) != cacheFooterMagic ||
+		binary.LittleEndian.Uint32(footer[4:8]) != cacheFooterSize-8 ||
+		binary.LittleEndian.Uint64(footer[12:20]) != uint64(length) {
+		return fmt.Errorf("%s: truncated cache file", path)
+	}
+
+	crc := crc32.NewIEEE()
+	if _, err := io.Copy(crc, io.NewSectionReader(f, 0, length)); err != nil {
+		return err
+	}
+	if crc.Sum32() != binary.LittleEndian.Uint32(footer[8:12]) {
+		return fmt.Errorf("%s: cache file has wrong checksum", path)
+	}
+	return nil
+}
+
+// NewCacheReader returns a reader that decompresses an intermediate
+// cache file. Files whose path ends in ".zst" are zstd-compressed;
+// all others are brotli-compressed, as written by earlier versions
+// of qrank-builder. If dict is not empty, files that were written with
+// that dictionary can be read, too.
+func newCacheReader(path string, r io.Reader, dict []byte) (io.ReadCloser, error) {
+	if !strings.HasSuffix(path, ".zst") {
+		return io.NopCloser(brotli.NewReader(r)), nil
+	}
+	var opts []zstd.DOption
+	if len(dict) > 0 {
+		opts = append(opts, zstd.WithDecoderDicts(dict))
+	}
+	decoder, err := zstd.NewReader(r, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return decoder.IOReadCloser(), nil
+}
+
+// CacheDictionaryID returns the ID of a zstd dictionary for cache files,
+// or zero if there is no dictionary or it cannot be parsed. Files that
+// get written with a dictionary can only be read with the same one, so
+// the ID goes into the identity of cached aggregates.
+func cacheDictionaryID(dict []byte) uint32 {
+	if len(dict) == 0 {
+		return 0
+	}
+	d, err := zstd.InspectDictionary(dict)
+	if err != nil {
+		return 0
+	}
+	return d.ID()
+}
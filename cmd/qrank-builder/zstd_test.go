@@ -5,7 +5,11 @@ package main
 
 import (
 	"bytes"
+	"fmt"
 	"io"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"testing/iotest"
 
@@ -47,3 +51,246 @@ func TestZstdDecoder(t *testing.T) {
 		t.Errorf("got %q, want %q", got, want)
 	}
 }
+
+func TestRecompressZstd(t *testing.T) {
+	gz := filepath.Join(t.TempDir(), "qrank-20240301.gz")
+	writeGzipFile(gz, "Entity,QRank\nQ4,77\n")
+	path, err := recompressZstd(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if filepath.Base(path) != "qrank-20240301.zst" {
+		t.Errorf("got %s, want qrank-20240301.zst", path)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	decoder, err := zstd.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer decoder.Close()
+
+	data, err := io.ReadAll(decoder)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, want := string(data), "Entity,QRank\nQ4,77\n"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestCacheReaderWriter(t *testing.T) {
+	content := strings.Repeat("en.wikipedia/zürich 17\nde.wikipedia/zürich 23\n", 100)
+
+	roundTrip := func(path string, data []byte, dict []byte) string {
+		r, err := newCacheReader(path, bytes.NewReader(data), dict)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		got, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(got)
+	}
+
+	for _, dict := range [][]byte{nil, testCacheDictionary(t)} {
+		var buf bytes.Buffer
+		w, err := newCacheWriter(&buf, zstd.SpeedBetterCompression, dict)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(w, content); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if got := roundTrip("pageviews-202403.zst", buf.Bytes(), dict); got != content {
+			t.Errorf("dict=%v: got %q, want %q", dict != nil, got, content)
+		}
+	}
+
+	// Files from earlier versions are compressed with brotli.
+	path := filepath.Join(t.TempDir(), "pageviews-202303.br")
+	writeBrotli(path, content)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := roundTrip(path, data, nil); got != content {
+		t.Errorf("got %q, want %q", got, content)
+	}
+}
+
+func TestCacheWriter_Header(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := newCacheWriter(&buf, zstd.SpeedFastest, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(w, "en.wikipedia,3422,7\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var h zstd.Header
+	if err := h.Decode(buf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if !h.Skippable || h.SkippableID != 0xE {
+		t.Fatalf("expected skippable frame with ID 0xE, got %+v", h)
+	}
+	header := buf.Bytes()[h.HeaderSize : h.HeaderSize+int(h.SkippableSize)]
+	if got, want := string(header), "zstd-level=fastest checksum=crc32"; got != want {
+		t.Errorf("got header %q, want %q", got, want)
+	}
+
+	// Plain zstd decoders should skip the header.
+	r, err := zstd.NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "en.wikipedia,3422,7\n" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestVerifyCacheFile(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := newCacheWriter(&buf, zstd.SpeedFastest, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(w, strings.Repeat("en.wikipedia,3422,7\n", 100)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	good := buf.Bytes()
+
+	corrupt := bytes.Clone(good)
+	corrupt[len(corrupt)/2] ^= 0xff
+
+	var plain bytes.Buffer
+	zw, err := zstd.NewWriter(&plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw.Write([]byte("foo"))
+	zw.Close()
+
+	// Header of files written before we had checksums.
+	old := []byte("\x5e\x2a\x4d\x18\x0f\x00\x00\x00zstd-level=best")
+	old = append(old, plain.Bytes()...)
+
+	for _, tc := range []struct {
+		name string
+		data []byte
+		ok   bool
+	}{
+		{"good", good, true},
+		{"truncated", good[:len(good)-5], false},
+		{"truncated-footer", good[:len(good)-cacheFooterSize], false},
+		{"truncated-header", good[:12], false},
+		{"corrupt", corrupt, false},
+		{"plain", plain.Bytes(), true},
+		{"old", old, true},
+		{"empty", nil, true},
+	} {
+		path := filepath.Join(t.TempDir(), tc.name+".zst")
+		if err := os.WriteFile(path, tc.data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := verifyCacheFile(path); (err == nil) != tc.ok {
+			t.Errorf("%s: got %v, want ok=%v", tc.name, err, tc.ok)
+		}
+	}
+
+	// The footer must not disturb zstd decoders.
+	r, err := zstd.NewReader(bytes.NewReader(good))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2000 {
+		t.Errorf("got %d bytes, want 2000", len(got))
+	}
+}
+
+func TestBuildConfig_CacheLevel(t *testing.T) {
+	cfg := newBuildConfig("")
+	if got := cfg.cacheLevel(zstd.SpeedFastest); got != zstd.SpeedFastest {
+		t.Errorf("got %v, want %v", got, zstd.SpeedFastest)
+	}
+	cfg.CacheLevel = zstd.SpeedBestCompression
+	if got := cfg.cacheLevel(zstd.SpeedFastest); got != zstd.SpeedBestCompression {
+		t.Errorf("got %v, want %v", got, zstd.SpeedBestCompression)
+	}
+}
+
+func TestCacheDictionaryID(t *testing.T) {
+	if got := cacheDictionaryID(nil); got != 0 {
+		t.Errorf("got %d, want 0", got)
+	}
+	if got := cacheDictionaryID([]byte("junk")); got != 0 {
+		t.Errorf("got %d, want 0", got)
+	}
+	dict := testCacheDictionary(t)
+	if got := cacheDictionaryID(dict); got != 1 {
+		t.Errorf("got %d, want 1", got)
+	}
+
+	var buf bytes.Buffer
+	w, err := newCacheWriter(&buf, zstd.SpeedFastest, dict)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := buf.String(); !strings.Contains(got, "zstd-level=fastest dict=1 checksum=crc32") {
+		t.Errorf("header should record dictionary, got %q", got)
+	}
+}
+
+func testCacheDictionary(t *testing.T) []byte {
+	var samples [][]byte
+	for i := 0; i < 100; i++ {
+		samples = append(samples, []byte(fmt.Sprintf("en.wikipedia/page_%d %d\nde.wikipedia/seite_%d %d\n", i, i*7, i, i*3)))
+	}
+	dict, err := zstd.BuildDict(zstd.BuildDictOptions{
+		ID:       1,
+		Contents: samples,
+		History:  []byte("en.wikipedia/ de.wikipedia/ fr.wikipedia/ "),
+		Offsets:  [3]int{1, 4, 8},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dict
+}
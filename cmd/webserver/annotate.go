@@ -0,0 +1,155 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Maximal size of a CSV file sent to /annotate. This is enough for
+// a few hundred thousand rows with a handful of columns.
+const maxAnnotateBytes = 64 * 1024 * 1024
+
+// Column headers that we recognize as holding Wikidata IDs when
+// the client does not pass a column parameter. Compared without
+// regard to case, and with an optional "?" prefix as in the output
+// of SPARQL queries.
+var annotateColumnNames = []string{"qid", "entity", "item", "wikidata", "wikidata_id"}
+
+// HandleAnnotate appends QRank scores to a CSV file. Clients POST a CSV
+// file with a header line; the response is the same file with two more
+// columns, "qrank" and "rank". The Wikidata IDs are taken from the column
+// given by the column parameter, such as /annotate?column=item, or else
+// from the first column with a well-known name such as "qid". Values may
+// be plain IDs like "Q42" or entity URIs like "http://www.wikidata.org/
+// entity/Q42", as returned by the Wikidata Query Service. Entities that
+// are not ranked get empty cells. Rows are processed one by one, so the
+// size of the input is not limited by memory.
+func (ws *Webserver) HandleAnnotate(w http.ResponseWriter, req *http.Request) {
+	h := w.Header()
+	switch req.Method {
+	case http.MethodPost:
+	case http.MethodOptions:
+		ws.handlePreflight(w, req, "POST, OPTIONS")
+		return
+	default:
+		h.Set("Allow", "POST, OPTIONS")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	ws.setAllowOrigin(h, req)
+
+	ranks := ws.storage.Ranks()
+	if ranks == nil {
+		http.Error(w, "ranking not loaded yet", http.StatusServiceUnavailable)
+		return
+	}
+
+	// Without full duplex, HTTP/1.x servers cannot read the request
+	// body after they have started to send the response. Not all
+	// ResponseWriters support this, but then we are not streaming
+	// anyway, so we ignore any error.
+	_ = http.NewResponseController(w).EnableFullDuplex()
+
+	body := http.MaxBytesReader(w, req.Body, maxAnnotateBytes)
+	r := csv.NewReader(body)
+	r.FieldsPerRecord = -1
+	r.ReuseRecord = true
+
+	header, err := r.Read()
+	if err != nil {
+		if err == io.EOF {
+			err = errors.New("missing CSV header")
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	col, ok := annotateColumn(header, req.URL.Query().Get("column"))
+	if !ok {
+		http.Error(w, "no column with Wikidata IDs", http.StatusBadRequest)
+		return
+	}
+
+	h.Set("Content-Type", "text/csv; charset=utf-8")
+	out := csv.NewWriter(w)
+	if err := out.Write(append(header, "qrank", "rank")); err != nil {
+		return
+	}
+
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// We have already sent the status code, so all we can
+			// do is to abort. The truncated response tells the client
+			// that something went wrong.
+			log.Printf("annotate: %v", err)
+			out.Flush()
+			return
+		}
+
+		var qrank, rank string
+		if col < len(record) {
+			if entity, ok := parseEntityID(entityFromCell(record[col])); ok {
+				if info, found := ranks.Lookup(entity); found {
+					qrank = strconv.FormatInt(info.QRank, 10)
+					rank = strconv.FormatInt(info.Rank, 10)
+				}
+			}
+		}
+		if err := out.Write(append(record, qrank, rank)); err != nil {
+			return
+		}
+	}
+	out.Flush()
+	if err := out.Error(); err != nil {
+		log.Printf("annotate: %v", err)
+	}
+}
+
+// AnnotateColumn finds the index of the column with Wikidata IDs.
+func annotateColumn(header []string, name string) (int, bool) {
+	// Files saved by spreadsheet programs often start with
+	// a byte-order mark.
+	if len(header) > 0 {
+		header[0] = strings.TrimPrefix(header[0], "\ufeff")
+	}
+
+	if name != "" {
+		for i, h := range header {
+			if strings.TrimSpace(h) == name {
+				return i, true
+			}
+		}
+		return 0, false
+	}
+
+	for _, n := range annotateColumnNames {
+		for i, h := range header {
+			h = strings.TrimSpace(h)
+			if strings.EqualFold(h, n) || strings.EqualFold(h, "?"+n) {
+				return i, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// EntityFromCell extracts the Wikidata ID from a CSV cell, which may
+// contain a plain ID such as "Q42" or an entity URI.
+func entityFromCell(s string) string {
+	s = strings.TrimSpace(s)
+	if i := strings.LastIndexByte(s, '/'); i >= 0 {
+		s = s[i+1:]
+	}
+	return s
+}
@@ -0,0 +1,115 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func makeAnnotateTestWebserver(t *testing.T) *Webserver {
+	ws := makeTestWebserver()
+	ri, err := readRankIndex(strings.NewReader("Entity,QRank\nQ64,900\nQ42,5\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws.storage.ranks = ri
+	return ws
+}
+
+func TestWebserver_Annotate(t *testing.T) {
+	ws := makeAnnotateTestWebserver(t)
+	for _, tc := range []struct {
+		path, body string
+		status     int
+		want       string
+	}{
+		{"/annotate", "name,QID\nDouglas Adams,Q42\nBerlin,Q64\nAtlantis,Q7\n", http.StatusOK,
+			"name,QID,qrank,rank\nDouglas Adams,Q42,5,2\nBerlin,Q64,900,1\nAtlantis,Q7,,\n"},
+		{"/annotate", "\ufeffitem,label\nhttp://www.wikidata.org/entity/Q64,\"Berlin, Germany\"\n", http.StatusOK,
+			"item,label,qrank,rank\nhttp://www.wikidata.org/entity/Q64,\"Berlin, Germany\",900,1\n"},
+		{"/annotate?column=b", "a,b\nQ64,Q42\nshort\n", http.StatusOK,
+			"a,b,qrank,rank\nQ64,Q42,5,2\nshort,,\n"},
+		{"/annotate", "?item\nQ42\n", http.StatusOK, "?item,qrank,rank\nQ42,5,2\n"},
+		{"/annotate", "a,b\nQ42,Q64\n", http.StatusBadRequest, "no column with Wikidata IDs\n"},
+		{"/annotate?column=c", "a,b\nQ42,Q64\n", http.StatusBadRequest, "no column with Wikidata IDs\n"},
+		{"/annotate", "", http.StatusBadRequest, "missing CSV header\n"},
+	} {
+		req := httptest.NewRequest("POST", tc.path, strings.NewReader(tc.body))
+		w := httptest.NewRecorder()
+		ws.HandleAnnotate(w, req)
+		res := w.Result()
+		body, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != tc.status {
+			t.Errorf("%s %q: got status %d, want %d", tc.path, tc.body, res.StatusCode, tc.status)
+		}
+		if string(body) != tc.want {
+			t.Errorf("%s %q: got %q, want %q", tc.path, tc.body, body, tc.want)
+		}
+	}
+}
+
+func TestWebserver_AnnotateMethodNotAllowed(t *testing.T) {
+	ws := makeAnnotateTestWebserver(t)
+	w := httptest.NewRecorder()
+	ws.HandleAnnotate(w, httptest.NewRequest("GET", "/annotate", nil))
+	if got, want := w.Result().StatusCode, http.StatusMethodNotAllowed; got != want {
+		t.Errorf("got status %d, want %d", got, want)
+	}
+}
+
+// Check that large files get streamed, which needs the server
+// to read the request while it is sending the response.
+func TestWebserver_AnnotateStreaming(t *testing.T) {
+	ws := makeAnnotateTestWebserver(t)
+	server := httptest.NewServer(http.HandlerFunc(ws.HandleAnnotate))
+	defer server.Close()
+
+	const numRows = 300000
+	pr, pw := io.Pipe()
+	go func() {
+		w := bufio.NewWriter(pw)
+		fmt.Fprintln(w, "qid")
+		for i := 0; i < numRows; i++ {
+			fmt.Fprintf(w, "Q%d\n", 42+i%30)
+		}
+		w.Flush()
+		pw.Close()
+	}()
+
+	res, err := http.Post(server.URL, "text/csv", pr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d, want %d", res.StatusCode, http.StatusOK)
+	}
+
+	scanner := bufio.NewScanner(res.Body)
+	lines, ranked := 0, 0
+	for scanner.Scan() {
+		lines++
+		if scanner.Text() == "Q42,5,2" {
+			ranked++
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if lines != numRows+1 {
+		t.Errorf("got %d lines, want %d", lines, numRows+1)
+	}
+	if ranked != numRows/30 {
+		t.Errorf("got %d ranked rows, want %d", ranked, numRows/30)
+	}
+}
@@ -0,0 +1,144 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Badge colors, as used by shields.io.
+const (
+	badgeBrightGreen = "#4c1"
+	badgeGreen       = "#97ca00"
+	badgeYellow      = "#dfb317"
+	badgeGrey        = "#9f9f9f"
+	badgeLabelColor  = "#555"
+)
+
+// HandleBadge serves an SVG image in the style of shields.io,
+// such as /badge/Q42.svg, showing the current rank of an entity.
+// The image can be embedded in wiki pages and dashboards.
+func (ws *Webserver) HandleBadge(w http.ResponseWriter, req *http.Request) {
+	h := w.Header()
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+	case http.MethodOptions:
+		ws.handlePreflight(w, req, "GET, HEAD, OPTIONS")
+		return
+	default:
+		h.Set("Allow", "GET, HEAD, OPTIONS")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	ws.setAllowOrigin(h, req)
+
+	qid, ok := strings.CutSuffix(strings.TrimPrefix(req.URL.Path, "/badge/"), ".svg")
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+	entity, ok := parseEntityID(qid)
+	if !ok {
+		http.Error(w, "bad Wikidata ID", http.StatusBadRequest)
+		return
+	}
+
+	ranks := ws.storage.Ranks()
+	if ranks == nil {
+		http.Error(w, "ranking not loaded yet", http.StatusServiceUnavailable)
+		return
+	}
+
+	// Unranked entities still get a badge, so that embedding pages
+	// do not show a broken image.
+	value, color := "unranked", badgeGrey
+	if info, found := ranks.Lookup(entity); found {
+		top := 100.0 * float64(info.Rank) / float64(ranks.Len())
+		value = fmt.Sprintf("#%s · top %s%%", formatThousands(info.Rank), formatPercent(top))
+		switch {
+		case top <= 1:
+			color = badgeBrightGreen
+		case top <= 10:
+			color = badgeGreen
+		case top <= 50:
+			color = badgeYellow
+		}
+	}
+
+	// Rankings change once a month, so browsers and wikis
+	// may cache badges for a while.
+	h.Set("Content-Type", "image/svg+xml")
+	h.Set("Cache-Control", "public, max-age=3600")
+	if _, err := w.Write([]byte(renderBadge("qrank", value, color))); err != nil {
+		log.Println(err)
+	}
+}
+
+// RenderBadge renders an SVG badge in the flat style of shields.io.
+func renderBadge(label, value, color string) string {
+	lw, vw := badgeTextWidth(label)+10, badgeTextWidth(value)+10
+	label, value = html.EscapeString(label), html.EscapeString(value)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="20" role="img" aria-label="%s: %s">`, lw+vw, label, value)
+	fmt.Fprintf(&b, `<title>%s: %s</title>`, label, value)
+	b.WriteString(`<linearGradient id="s" x2="0" y2="100%"><stop offset="0" stop-color="#bbb" stop-opacity=".1"/><stop offset="1" stop-opacity=".1"/></linearGradient>`)
+	fmt.Fprintf(&b, `<clipPath id="r"><rect width="%d" height="20" rx="3" fill="#fff"/></clipPath>`, lw+vw)
+	fmt.Fprintf(&b, `<g clip-path="url(#r)"><rect width="%d" height="20" fill="%s"/><rect x="%d" width="%d" height="20" fill="%s"/><rect width="%d" height="20" fill="url(#s)"/></g>`,
+		lw, badgeLabelColor, lw, vw, color, lw+vw)
+	b.WriteString(`<g fill="#fff" text-anchor="middle" font-family="Verdana,Geneva,DejaVu Sans,sans-serif" font-size="11">`)
+	fmt.Fprintf(&b, `<text x="%d" y="15" fill="#010101" fill-opacity=".3">%s</text><text x="%d" y="14">%s</text>`, lw/2, label, lw/2, label)
+	fmt.Fprintf(&b, `<text x="%d" y="15" fill="#010101" fill-opacity=".3">%s</text><text x="%d" y="14">%s</text>`, lw+vw/2, value, lw+vw/2, value)
+	b.WriteString(`</g></svg>`)
+	return b.String()
+}
+
+// BadgeTextWidth estimates the width in pixels of a string
+// in 11px Verdana. We do not need to be exact, since the text
+// is centered in its box.
+func badgeTextWidth(s string) int {
+	width := 0
+	for _, c := range s {
+		switch {
+		case strings.ContainsRune(".,:;·| ", c):
+			width += 4
+		case c == '#' || c == '%' || c == 'm' || c == 'w':
+			width += 10
+		default:
+			width += 7
+		}
+	}
+	return width
+}
+
+// FormatThousands formats an integer with commas as thousands
+// separators, such as "1,234,567".
+func formatThousands(n int64) string {
+	s := strconv.FormatInt(n, 10)
+	var b strings.Builder
+	for i, c := range s {
+		if i > 0 && (len(s)-i)%3 == 0 {
+			b.WriteByte(',')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// FormatPercent formats a percentage with two significant digits
+// below 1%, such as "0.0012", and as a whole number above.
+func formatPercent(p float64) string {
+	if p < 1 {
+		// Round to two significant digits, but avoid the
+		// exponent notation of strconv's 'g' format.
+		rounded, _ := strconv.ParseFloat(strconv.FormatFloat(p, 'g', 2, 64), 64)
+		return strconv.FormatFloat(rounded, 'f', -1, 64)
+	}
+	return strconv.FormatFloat(p, 'f', 0, 64)
+}
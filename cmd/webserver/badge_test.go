@@ -0,0 +1,113 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWebserver_Badge(t *testing.T) {
+	ws := makeTestWebserver()
+	ri, err := readRankIndex(strings.NewReader(
+		"Entity,QRank\nQ64,900\nQ1,800\nQ72,70\nQ42,5\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws.storage.ranks = ri
+
+	for _, tc := range []struct {
+		path   string
+		status int
+		text   string
+		color  string
+	}{
+		{"/badge/Q64.svg", http.StatusOK, "qrank: #1 · top 25%", badgeYellow},
+		{"/badge/Q42.svg", http.StatusOK, "qrank: #4 · top 100%", badgeGrey},
+		{"/badge/Q7.svg", http.StatusOK, "qrank: unranked", badgeGrey},
+		{"/badge/foo.svg", http.StatusBadRequest, "", ""},
+		{"/badge/Q42.png", http.StatusNotFound, "", ""},
+	} {
+		w := httptest.NewRecorder()
+		ws.HandleBadge(w, httptest.NewRequest("GET", tc.path, nil))
+		res := w.Result()
+		body, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != tc.status {
+			t.Errorf("%s: got status %d, want %d", tc.path, res.StatusCode, tc.status)
+			continue
+		}
+		if tc.status != http.StatusOK {
+			continue
+		}
+		if got := res.Header.Get("Content-Type"); got != "image/svg+xml" {
+			t.Errorf("%s: got Content-Type %q", tc.path, got)
+		}
+		var svg struct {
+			Title string `xml:"title"`
+		}
+		if err := xml.Unmarshal(body, &svg); err != nil {
+			t.Errorf("%s: malformed SVG: %v", tc.path, err)
+		}
+		if svg.Title != tc.text {
+			t.Errorf("%s: got title %q, want %q", tc.path, svg.Title, tc.text)
+		}
+		if !strings.Contains(string(body), `fill="`+tc.color+`"`) {
+			t.Errorf("%s: want color %s, got %s", tc.path, tc.color, body)
+		}
+	}
+}
+
+func TestRenderBadge_Escapes(t *testing.T) {
+	svg := renderBadge("a<b", `"&"`, badgeGrey)
+	var parsed struct {
+		Title string `xml:"title"`
+	}
+	if err := xml.Unmarshal([]byte(svg), &parsed); err != nil {
+		t.Fatal(err)
+	}
+	if want := `a<b: "&"`; parsed.Title != want {
+		t.Errorf("got %q, want %q", parsed.Title, want)
+	}
+}
+
+func TestFormatThousands(t *testing.T) {
+	for _, tc := range []struct {
+		n    int64
+		want string
+	}{
+		{0, "0"},
+		{999, "999"},
+		{1000, "1,000"},
+		{123456, "123,456"},
+		{1234567, "1,234,567"},
+	} {
+		if got := formatThousands(tc.n); got != tc.want {
+			t.Errorf("formatThousands(%d): got %q, want %q", tc.n, got, tc.want)
+		}
+	}
+}
+
+func TestFormatPercent(t *testing.T) {
+	for _, tc := range []struct {
+		p    float64
+		want string
+	}{
+		{0.00001, "0.00001"},
+		{0.0123, "0.012"},
+		{0.5, "0.5"},
+		{12.3, "12"},
+		{100, "100"},
+	} {
+		if got := formatPercent(tc.p); got != tc.want {
+			t.Errorf("formatPercent(%v): got %q, want %q", tc.p, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// An entity’s rank change is significant if it moves by at least
+// this factor, such as from rank 1000 to 2000 or to 500, and if it
+// is within this many top positions before or after the change.
+// Without the second condition, each release would report millions
+// of changes in the long tail, where ranks are shuffled by a handful
+// of page views.
+const (
+	rankChangeFactor  = 2.0
+	rankChangeMaxRank = 100000
+)
+
+// Interval for sending comments on idle event streams, so that
+// proxies do not close the connection.
+const rankChangeKeepAlive = 30 * time.Second
+
+// RankChange tells how an entity’s rank changed when a new release
+// was loaded. Rank zero means that the entity was not ranked.
+type RankChange struct {
+	Entity  string `json:"entity"`
+	Release string `json:"release"`
+	OldRank int64  `json:"oldRank"`
+	NewRank int64  `json:"newRank"`
+	QRank   int64  `json:"qrank"`
+}
+
+// RankChangeBatch contains the significant rank changes of a release.
+type rankChangeBatch struct {
+	release string
+	changes []RankChange
+}
+
+// DiffRanks finds the entities whose rank changed significantly
+// between two rankings. The result is sorted by entity ID. Positions
+// are zero-based, and -1 stands for an entity that is not ranked.
+func diffRanks(old, cur *RankIndex, release string) []RankChange {
+	var changes []RankChange
+	inTop := func(pos int) bool { return pos >= 0 && pos < rankChangeMaxRank }
+	significant := func(oldPos, newPos int) bool {
+		if !inTop(oldPos) && !inTop(newPos) {
+			return false
+		}
+		if oldPos < 0 || newPos < 0 {
+			return true
+		}
+		lo, hi := float64(min(oldPos, newPos)+1), float64(max(oldPos, newPos)+1)
+		return hi >= lo*rankChangeFactor
+	}
+	add := func(entity uint32, oldPos, newPos int) {
+		c := RankChange{Entity: fmt.Sprintf("Q%d", entity), Release: release}
+		if oldPos >= 0 {
+			c.OldRank = int64(oldPos) + 1
+		}
+		if newPos >= 0 {
+			c.NewRank = int64(newPos) + 1
+			_, c.QRank = cur.ranking(newPos)
+		}
+		changes = append(changes, c)
+	}
+
+	// Both indexes list their entities in order of entity ID,
+	// so we can walk them side by side.
+	i, j := 0, 0
+	for i < old.n || j < cur.n {
+		var oldEntity, curEntity uint32
+		var oldPos, curPos uint32
+		if i < old.n {
+			oldEntity, oldPos = old.entityRecord(i)
+		}
+		if j < cur.n {
+			curEntity, curPos = cur.entityRecord(j)
+		}
+		switch {
+		case j >= cur.n || (i < old.n && oldEntity < curEntity):
+			if significant(int(oldPos), -1) {
+				add(oldEntity, int(oldPos), -1)
+			}
+			i++
+		case i >= old.n || curEntity < oldEntity:
+			if significant(-1, int(curPos)) {
+				add(curEntity, -1, int(curPos))
+			}
+			j++
+		default:
+			if significant(int(oldPos), int(curPos)) {
+				add(curEntity, int(oldPos), int(curPos))
+			}
+			i++
+			j++
+		}
+	}
+	return changes
+}
+
+// RankChangeBroker distributes rank changes to the clients that are
+// listening on /changes. To let clients catch up after a dropped
+// connection, the broker keeps the changes of the most recent release.
+type rankChangeBroker struct {
+	mutex       sync.Mutex
+	last        *rankChangeBatch
+	subscribers map[chan *rankChangeBatch]struct{}
+}
+
+func newRankChangeBroker() *rankChangeBroker {
+	return &rankChangeBroker{subscribers: make(map[chan *rankChangeBatch]struct{})}
+}
+
+// Publish sends a batch of changes to all current subscribers.
+func (b *rankChangeBroker) Publish(batch *rankChangeBatch) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.last = batch
+	for ch := range b.subscribers {
+		// Releases come rarely, so a subscriber that has not yet
+		// consumed the previous batch is stuck; we rather skip it
+		// than blocking the reload of storage.
+		select {
+		case ch <- batch:
+		default:
+		}
+	}
+}
+
+// Subscribe registers a new listener. The caller must call Unsubscribe
+// when done. Besides the channel, Subscribe returns the most recently
+// published batch, or nil if there has not been any release yet.
+func (b *rankChangeBroker) Subscribe() (chan *rankChangeBatch, *rankChangeBatch) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	ch := make(chan *rankChangeBatch, 1)
+	b.subscribers[ch] = struct{}{}
+	return ch, b.last
+}
+
+// Unsubscribe removes a listener that was registered by Subscribe.
+func (b *rankChangeBroker) Unsubscribe(ch chan *rankChangeBatch) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	delete(b.subscribers, ch)
+}
+
+// HandleRankChanges streams significant rank changes as server-sent
+// events. Whenever the webserver loads a new release, each entity whose
+// rank changed significantly gets sent as one event, whose ID is the
+// release date. Clients that reconnect with a Last-Event-ID header
+// for an older release receive the changes of the latest release.
+func (ws *Webserver) HandleRankChanges(w http.ResponseWriter, req *http.Request) {
+	h := w.Header()
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodOptions:
+		ws.handlePreflight(w, req, "GET, OPTIONS")
+		return
+	default:
+		h.Set("Allow", "GET, OPTIONS")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	ws.setAllowOrigin(h, req)
+
+	broker := ws.storage.changes
+	if broker == nil {
+		http.Error(w, "rank changes not enabled on this server", http.StatusNotFound)
+		return
+	}
+
+	ch, last := broker.Subscribe()
+	defer broker.Unsubscribe(ch)
+
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	h.Set("X-Accel-Buffering", "no") // tell nginx to pass events through
+	w.WriteHeader(http.StatusOK)
+	rc := http.NewResponseController(w)
+
+	lastEventID := req.Header.Get("Last-Event-ID")
+	if last != nil && lastEventID != "" && lastEventID < last.release {
+		if err := writeRankChanges(w, last); err != nil {
+			return
+		}
+	}
+	if _, err := fmt.Fprint(w, ": connected\n\n"); err != nil {
+		return
+	}
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	ticker := time.NewTicker(rankChangeKeepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case batch := <-ch:
+			if err := writeRankChanges(w, batch); err != nil {
+				return
+			}
+		case <-ticker.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func writeRankChanges(w http.ResponseWriter, batch *rankChangeBatch) error {
+	for _, c := range batch.changes {
+		data, err := json.Marshal(c)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "id: %s\nevent: rank-change\ndata: %s\n\n", batch.release, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,181 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func makeTestRanks(t *testing.T, entities ...uint32) *RankIndex {
+	var buf strings.Builder
+	buf.WriteString("Entity,QRank\n")
+	for i, e := range entities {
+		fmt.Fprintf(&buf, "Q%d,%d\n", e, len(entities)-i)
+	}
+	ri, err := readRankIndex(strings.NewReader(buf.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ri
+}
+
+func TestDiffRanks(t *testing.T) {
+	old := makeTestRanks(t, 1, 2, 3, 4, 5, 6, 7, 8)
+	cur := makeTestRanks(t, 1, 3, 2, 9, 5, 6, 8, 4)
+	got := diffRanks(old, cur, "20240301")
+	want := []RankChange{
+		{Entity: "Q4", Release: "20240301", OldRank: 4, NewRank: 8, QRank: 1},
+		{Entity: "Q7", Release: "20240301", OldRank: 7},
+		{Entity: "Q9", Release: "20240301", NewRank: 4, QRank: 5},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestDiffRanks_LongTail(t *testing.T) {
+	// Entities that are outside the top positions in both releases
+	// should not be reported, however much their rank changes.
+	entities := make([]uint32, rankChangeMaxRank*3)
+	for i := range entities {
+		entities[i] = uint32(i + 1)
+	}
+	old := makeTestRanks(t, entities...)
+	n := len(entities)
+	entities[rankChangeMaxRank], entities[n-1] = entities[n-1], entities[rankChangeMaxRank]
+	cur := makeTestRanks(t, entities[:n-1]...)
+	if got := diffRanks(old, cur, "20240301"); len(got) != 0 {
+		t.Errorf("got %v, want no changes", got)
+	}
+}
+
+func TestRankChangeBroker(t *testing.T) {
+	b := newRankChangeBroker()
+	ch, last := b.Subscribe()
+	if last != nil {
+		t.Errorf("got %v, want nil", last)
+	}
+	batch := &rankChangeBatch{release: "20240301"}
+	b.Publish(batch)
+	if got := <-ch; got != batch {
+		t.Errorf("got %v, want %v", got, batch)
+	}
+
+	// A stuck subscriber must not block publishing.
+	b.Publish(&rankChangeBatch{release: "20240401"})
+	b.Publish(&rankChangeBatch{release: "20240501"})
+	b.Unsubscribe(ch)
+	if _, last := b.Subscribe(); last.release != "20240501" {
+		t.Errorf("got last release %q, want 20240501", last.release)
+	}
+}
+
+func TestWebserver_RankChanges(t *testing.T) {
+	ws := makeTestWebserver()
+	ws.storage.changes = newRankChangeBroker()
+	ws.storage.changes.Publish(&rankChangeBatch{
+		release: "20240301",
+		changes: []RankChange{{Entity: "Q7", Release: "20240301", OldRank: 7}},
+	})
+	server := httptest.NewServer(http.HandlerFunc(ws.HandleRankChanges))
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+	req.Header.Set("Last-Event-ID", "20240201")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if got, want := resp.Header.Get("Content-Type"), "text/event-stream"; got != want {
+		t.Errorf("got Content-Type %q, want %q", got, want)
+	}
+
+	events := make(chan string)
+	go readServerSentEvents(resp.Body, func(id, data string) {
+		events <- id + " " + data
+	})
+
+	// Since the client has missed the latest release, it should
+	// receive the changes of that release upon connecting.
+	if got, want := <-events, `20240301 {"entity":"Q7","release":"20240301","oldRank":7,"newRank":0,"qrank":0}`; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	ws.storage.changes.Publish(&rankChangeBatch{
+		release: "20240401",
+		changes: []RankChange{{Entity: "Q42", Release: "20240401", OldRank: 80, NewRank: 3, QRank: 12345}},
+	})
+	var got RankChange
+	event := <-events
+	id, data, _ := strings.Cut(event, " ")
+	if err := json.Unmarshal([]byte(data), &got); err != nil {
+		t.Fatal(err)
+	}
+	want := RankChange{Entity: "Q42", Release: "20240401", OldRank: 80, NewRank: 3, QRank: 12345}
+	if id != "20240401" || got != want {
+		t.Errorf("got %q, want id 20240401 with %v", event, want)
+	}
+}
+
+func TestWebserver_RankChangesUpToDate(t *testing.T) {
+	ws := makeTestWebserver()
+	ws.storage.changes = newRankChangeBroker()
+	ws.storage.changes.Publish(&rankChangeBatch{
+		release: "20240301",
+		changes: []RankChange{{Entity: "Q7", Release: "20240301", OldRank: 7}},
+	})
+	server := httptest.NewServer(http.HandlerFunc(ws.HandleRankChanges))
+	defer server.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+	req.Header.Set("Last-Event-ID", "20240301")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	// The first thing on the stream should be the comment that
+	// confirms the connection, not a replay of old changes.
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != ": connected\n" {
+		t.Errorf("got %q, want %q", line, ": connected\n")
+	}
+}
+
+func TestWebserver_RankChangesNotEnabled(t *testing.T) {
+	ws := makeTestWebserver()
+	rec := httptest.NewRecorder()
+	ws.HandleRankChanges(rec, httptest.NewRequest(http.MethodGet, "/changes", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("got status %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
+
+func TestWebserver_RankChangesMethodNotAllowed(t *testing.T) {
+	ws := makeTestWebserver()
+	rec := httptest.NewRecorder()
+	ws.HandleRankChanges(rec, httptest.NewRequest(http.MethodPost, "/changes", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("got status %d, want %d", rec.Code, http.StatusMethodNotAllowed)
+	}
+	if got, want := rec.Header().Get("Allow"), "GET, OPTIONS"; got != want {
+		t.Errorf("got Allow %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,52 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// ParseCORSOrigins parses a comma-separated list of origins, such as
+// "https://www.wikidata.org,https://example.org", which may call our
+// API from browsers. The special origin "*" allows any origin.
+func parseCORSOrigins(s string) []string {
+	origins := make([]string, 0, 4)
+	for _, o := range strings.Split(s, ",") {
+		if o = strings.TrimSpace(o); o != "" {
+			origins = append(origins, o)
+		}
+	}
+	return origins
+}
+
+// SetAllowOrigin sets the Access-Control-Allow-Origin response header
+// if the origin of a request is allowed to read the response.
+func (ws *Webserver) setAllowOrigin(h http.Header, req *http.Request) {
+	if slices.Contains(ws.corsOrigins, "*") {
+		h.Set("Access-Control-Allow-Origin", "*")
+		return
+	}
+
+	// The response depends on the requesting origin, so caches
+	// must not serve it to other origins.
+	h.Add("Vary", "Origin")
+	origin := req.Header.Get("Origin")
+	if origin != "" && slices.Contains(ws.corsOrigins, origin) {
+		h.Set("Access-Control-Allow-Origin", origin)
+	}
+}
+
+// HandlePreflight answers a CORS pre-flight request for an endpoint
+// that supports the given methods.
+func (ws *Webserver) handlePreflight(w http.ResponseWriter, req *http.Request, methods string) {
+	h := w.Header()
+	h.Set("Allow", methods)
+	h.Set("Access-Control-Allow-Methods", methods)
+	h.Set("Access-Control-Allow-Headers", "Content-Type")
+	h.Set("Access-Control-Max-Age", "86400") // 1 day
+	ws.setAllowOrigin(h, req)
+	w.WriteHeader(http.StatusNoContent)
+}
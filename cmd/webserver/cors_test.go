@@ -0,0 +1,68 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+func TestParseCORSOrigins(t *testing.T) {
+	got := parseCORSOrigins(" https://www.wikidata.org, ,https://example.org")
+	want := []string{"https://www.wikidata.org", "https://example.org"}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got := parseCORSOrigins(""); len(got) != 0 {
+		t.Errorf("got %v, want empty", got)
+	}
+}
+
+func TestSetAllowOrigin(t *testing.T) {
+	ws := &Webserver{corsOrigins: []string{"https://www.wikidata.org"}}
+	for _, tc := range []struct{ origin, want string }{
+		{"https://www.wikidata.org", "https://www.wikidata.org"},
+		{"https://evil.example", ""},
+		{"", ""},
+	} {
+		req := httptest.NewRequest("GET", "/rank/Q42", nil)
+		if tc.origin != "" {
+			req.Header.Set("Origin", tc.origin)
+		}
+		h := make(http.Header)
+		ws.setAllowOrigin(h, req)
+		if got := h.Get("Access-Control-Allow-Origin"); got != tc.want {
+			t.Errorf("origin %q: got %q, want %q", tc.origin, got, tc.want)
+		}
+		if got := h.Get("Vary"); got != "Origin" {
+			t.Errorf(`origin %q: got "Vary: %s", want "Vary: Origin"`, tc.origin, got)
+		}
+	}
+}
+
+func TestWebserver_BulkRanksPreflight(t *testing.T) {
+	ws := &Webserver{corsOrigins: []string{"https://www.wikidata.org"}}
+	req := httptest.NewRequest("OPTIONS", "/ranks", nil)
+	req.Header.Set("Origin", "https://www.wikidata.org")
+	req.Header.Set("Access-Control-Request-Method", "POST")
+	req.Header.Set("Access-Control-Request-Headers", "Content-Type")
+	w := httptest.NewRecorder()
+	ws.HandleBulkRanks(w, req)
+	res := w.Result()
+	if res.StatusCode != http.StatusNoContent {
+		t.Errorf("got status %d, want %d", res.StatusCode, http.StatusNoContent)
+	}
+	for key, want := range map[string]string{
+		"Access-Control-Allow-Origin":  "https://www.wikidata.org",
+		"Access-Control-Allow-Methods": "POST, OPTIONS",
+		"Access-Control-Allow-Headers": "Content-Type",
+		"Access-Control-Max-Age":       "86400",
+	} {
+		if got := res.Header.Get(key); got != want {
+			t.Errorf(`expected "%s: %s", got "%s"`, key, want, got)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// DashboardStats is the subset of qrank-stats.json shown on the
+// dashboard. The full format is defined by qrank-builder.
+type dashboardStats struct {
+	NumRanked   int64
+	NumUnranked int64
+	Median      int64
+	Gini        float64
+	Percentiles map[string]int64
+	Histogram   []int64
+	Sites       []struct {
+		Site  string
+		Views int64
+	}
+}
+
+// DashboardMetadata is the subset of qrank-metadata.json shown on the
+// dashboard. The full format is defined by qrank-builder.
+type dashboardMetadata struct {
+	Version          string `json:"version"`
+	DatePublished    string `json:"datePublished"`
+	TemporalCoverage string `json:"temporalCoverage"`
+	IsBasedOn        []struct {
+		Name        string `json:"name"`
+		URL         string `json:"url"`
+		DateCreated string `json:"dateCreated"`
+	} `json:"isBasedOn"`
+}
+
+// DashboardBar is one bar in a bar chart on the dashboard.
+type dashboardBar struct {
+	Label string
+	Value int64
+	Width float64 // percentage of the widest bar
+}
+
+type dashboardPage struct {
+	Release      string
+	LastModified time.Time
+	Age          string
+	Metadata     *dashboardMetadata
+	Stats        *dashboardStats
+	Percentiles  []dashboardBar
+	Histogram    []dashboardBar
+	Sites        []dashboardBar
+	Top          []RankInfo
+}
+
+// Number of top-ranked entities shown on the dashboard.
+const dashboardTopEntities = 20
+
+// HandleStatus serves an HTML page that shows the freshness of the
+// served dataset, and some statistics about it.
+func (ws *Webserver) HandleStatus(w http.ResponseWriter, req *http.Request) {
+	page := dashboardPage{}
+
+	if f, ok := ws.storage.file("qrank.csv.gz"); ok {
+		page.Release = f.Release
+		page.LastModified = f.LastModified
+		page.Age = formatAge(time.Since(f.LastModified))
+	}
+
+	var metadata dashboardMetadata
+	if err := ws.storage.ReadJSON("qrank-metadata.json", &metadata); err == nil {
+		page.Metadata = &metadata
+	}
+
+	var stats dashboardStats
+	if err := ws.storage.ReadJSON("qrank-stats.json", &stats); err == nil {
+		page.Stats = &stats
+		page.Percentiles = percentileBars(stats.Percentiles)
+		page.Histogram = histogramBars(stats.Histogram)
+		page.Sites = siteBars(&stats)
+	}
+
+	if ranks := ws.storage.Ranks(); ranks != nil {
+		page.Top = ranks.Top(dashboardTopEntities)
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := dashboardTemplate.Execute(w, page); err != nil {
+		log.Println(err)
+	}
+}
+
+func formatAge(d time.Duration) string {
+	days := int(d.Hours() / 24)
+	switch {
+	case days >= 2:
+		return fmt.Sprintf("%d days ago", days)
+	case d >= time.Hour:
+		return fmt.Sprintf("%d hours ago", int(d.Hours()))
+	default:
+		return "less than an hour ago"
+	}
+}
+
+func percentileBars(percentiles map[string]int64) []dashboardBar {
+	bars := make([]dashboardBar, 0, len(percentiles))
+	for _, p := range []string{"50", "90", "99", "99.9"} {
+		if v, ok := percentiles[p]; ok {
+			bars = append(bars, dashboardBar{Label: p + "%", Value: v})
+		}
+	}
+	return scaleBars(bars)
+}
+
+func histogramBars(histogram []int64) []dashboardBar {
+	bars := make([]dashboardBar, 0, len(histogram))
+	lo := int64(1)
+	for _, n := range histogram {
+		label := fmt.Sprintf("%d–%d", lo, lo*10-1)
+		bars = append(bars, dashboardBar{Label: label, Value: n})
+		lo *= 10
+	}
+	return scaleBars(bars)
+}
+
+func siteBars(stats *dashboardStats) []dashboardBar {
+	bars := make([]dashboardBar, 0, len(stats.Sites))
+	for _, s := range stats.Sites {
+		bars = append(bars, dashboardBar{Label: s.Site, Value: s.Views})
+	}
+	return scaleBars(bars)
+}
+
+// ScaleBars sets the width of bars relative to the largest value.
+func scaleBars(bars []dashboardBar) []dashboardBar {
+	if len(bars) == 0 {
+		return bars
+	}
+	largest := slices.MaxFunc(bars, func(a, b dashboardBar) int {
+		return cmp.Compare(a.Value, b.Value)
+	}).Value
+	if largest <= 0 {
+		return bars
+	}
+	for i := range bars {
+		bars[i].Width = 100.0 * float64(bars[i].Value) / float64(largest)
+	}
+	return bars
+}
+
+var dashboardTemplate = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8"/>
+<title>Wikidata QRank Status</title>
+<link href='https://tools-static.wmflabs.org/fontcdn/css?family=Roboto+Slab:400,700' rel='stylesheet' type='text/css'/>
+<style>
+* { font-family: 'Roboto Slab', serif; }
+h1 { color: #0066ff; margin-left: 1em; margin-top: 1em; }
+section { margin-left: 5em; margin-bottom: 2em; }
+table.chart { border-collapse: collapse; width: 40em; }
+table.chart td { padding: 0.1em 0.5em; }
+table.chart td.label { width: 10em; text-align: right; white-space: nowrap; }
+table.chart td.value { width: 8em; text-align: right; }
+div.bar { background: #0066ff; height: 1em; }
+</style>
+</head>
+<body>
+<h1>Wikidata QRank Status</h1>
+
+<section>
+<h2>Dataset</h2>
+{{if .Release}}
+<p>Serving the release of <b>{{.Release}}</b>, stored {{.LastModified.Format "2006-01-02 15:04 UTC"}} ({{.Age}}).</p>
+{{else}}
+<p>No dataset loaded yet.</p>
+{{end}}
+{{with .Metadata}}
+<p>Page views: {{.TemporalCoverage}}. Published {{.DatePublished}}.</p>
+<ul>
+{{range .IsBasedOn}}<li><a href="{{.URL}}">{{.Name}}</a>{{if .DateCreated}}: {{.DateCreated}}{{end}}</li>
+{{end}}</ul>
+{{end}}
+</section>
+
+{{with .Stats}}
+<section>
+<h2>Statistics</h2>
+<p>{{.NumRanked}} ranked entities{{if .NumUnranked}}, {{.NumUnranked}} unranked{{end}}.
+Median score {{.Median}}, Gini coefficient {{printf "%.3f" .Gini}}.</p>
+</section>
+{{end}}
+
+{{define "chart"}}<table class="chart">
+{{range .}}<tr><td class="label">{{.Label}}</td><td class="value">{{.Value}}</td><td><div class="bar" style="width: {{printf "%.1f" .Width}}%"></div></td></tr>
+{{end}}</table>{{end}}
+
+{{if .Percentiles}}<section><h2>Score percentiles</h2>{{template "chart" .Percentiles}}</section>{{end}}
+{{if .Histogram}}<section><h2>Entities by score</h2>{{template "chart" .Histogram}}</section>{{end}}
+{{if .Sites}}<section><h2>Views by site</h2>{{template "chart" .Sites}}</section>{{end}}
+
+{{if .Top}}
+<section>
+<h2>Top entities</h2>
+<table class="chart">
+{{range .Top}}<tr><td class="label">{{.Rank}}</td><td><a href="https://www.wikidata.org/wiki/{{.Entity}}">{{.Entity}}</a></td><td class="value">{{.QRank}}</td></tr>
+{{end}}</table>
+</section>
+{{end}}
+
+</body>
+</html>
+`))
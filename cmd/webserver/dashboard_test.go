@@ -0,0 +1,107 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWebserver_Status(t *testing.T) {
+	dir := t.TempDir()
+	storage := &Storage{
+		client:  &fakeStorageClient{},
+		workdir: dir,
+		files:   make(map[string]*localFile, 10),
+	}
+	for name, content := range map[string]string{
+		"qrank-stats.json": `{"NumRanked":3,"Median":7,"Gini":0.5,` +
+			`"Percentiles":{"50":7,"90":700},"Histogram":[1,0,2],` +
+			`"Sites":[{"Site":"en.wikipedia","Views":900},{"Site":"other","Views":450}]}`,
+		"qrank-metadata.json": `{"version":"2024-03-01","temporalCoverage":"2023-03/2024-02",` +
+			`"isBasedOn":[{"name":"Wikidata entities dump","url":"https://dumps.wikimedia.org/","dateCreated":"2024-03-01"}]}`,
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		storage.files[name] = &localFile{Path: path, ContentType: "application/json"}
+	}
+	lastmod := time.Now().Add(-72 * time.Hour)
+	storage.files["qrank.csv.gz"] = &localFile{Release: "20240301", LastModified: lastmod}
+	ri, err := readRankIndex(strings.NewReader("Entity,QRank\nQ64,900\nQ1,800\nQ42,5\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage.ranks = ri
+
+	ws := &Webserver{storage: storage}
+	w := httptest.NewRecorder()
+	ws.HandleStatus(w, httptest.NewRequest("GET", "/status", nil))
+	res := w.Result()
+	if got := res.Header.Get("Content-Type"); got != "text/html; charset=utf-8" {
+		t.Errorf(`got "Content-Type: %s"`, got)
+	}
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	page := string(body)
+	for _, want := range []string{
+		"<b>20240301</b>",
+		"(3 days ago)",
+		"Page views: 2023-03/2024-02.",
+		`Wikidata entities dump</a>: 2024-03-01`,
+		"3 ranked entities",
+		"Gini coefficient 0.500",
+		`<td class="label">en.wikipedia</td><td class="value">900</td><td><div class="bar" style="width: 100.0%">`,
+		`<td class="label">other</td><td class="value">450</td><td><div class="bar" style="width: 50.0%">`,
+		`<td class="label">100–999</td><td class="value">2</td>`,
+		`<td class="label">1</td><td><a href="https://www.wikidata.org/wiki/Q64">Q64</a></td>`,
+		`<td class="label">3</td><td><a href="https://www.wikidata.org/wiki/Q42">Q42</a></td>`,
+	} {
+		if !strings.Contains(page, want) {
+			t.Errorf("page should contain %q, got %s", want, page)
+		}
+	}
+}
+
+func TestWebserver_StatusEmpty(t *testing.T) {
+	storage := &Storage{
+		client:  &fakeStorageClient{},
+		workdir: t.TempDir(),
+		files:   make(map[string]*localFile, 10),
+	}
+	ws := &Webserver{storage: storage}
+	w := httptest.NewRecorder()
+	ws.HandleStatus(w, httptest.NewRequest("GET", "/status", nil))
+	body, err := io.ReadAll(w.Result().Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(body), "No dataset loaded yet.") {
+		t.Errorf("got %s", body)
+	}
+}
+
+func TestFormatAge(t *testing.T) {
+	for _, tc := range []struct {
+		d    time.Duration
+		want string
+	}{
+		{10 * time.Minute, "less than an hour ago"},
+		{5 * time.Hour, "5 hours ago"},
+		{30 * time.Hour, "30 hours ago"},
+		{50 * time.Hour, "2 days ago"},
+	} {
+		if got := formatAge(tc.d); got != tc.want {
+			t.Errorf("formatAge(%v): got %q, want %q", tc.d, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// DefaultEventStream is the Wikimedia EventStreams endpoint for
+// edits on all Wikimedia projects, in Server-Sent Events format.
+// https://wikitech.wikimedia.org/wiki/Event_Platform/EventStreams
+const defaultEventStream = "https://stream.wikimedia.org/v2/stream/recentchange"
+
+// RecentChange is the subset of a recentchange event that we need.
+// https://schema.wikimedia.org/repositories/primary/jsonschema/mediawiki/recentchange/latest.yaml
+type recentChange struct {
+	Type      string `json:"type"`
+	Namespace int    `json:"namespace"`
+	Title     string `json:"title"`
+	Wiki      string `json:"wiki"`
+	Bot       bool   `json:"bot"`
+}
+
+// EventStreamClient follows an EventStreams endpoint and feeds
+// the edited entities into a hotOverlay.
+type eventStreamClient struct {
+	url     string
+	client  *http.Client
+	storage *Storage
+	hot     *hotOverlay
+
+	// ID of the last received event, for resuming after reconnects.
+	lastEventID string
+}
+
+func newEventStreamClient(url string, storage *Storage, hot *hotOverlay) *eventStreamClient {
+	return &eventStreamClient{
+		url:     url,
+		client:  &http.Client{},
+		storage: storage,
+		hot:     hot,
+	}
+}
+
+// Run follows the event stream until the context gets canceled.
+// When the connection breaks, we reconnect with exponential backoff,
+// resuming after the last received event.
+func (c *eventStreamClient) Run(ctx context.Context) error {
+	backoff := time.Second
+	for {
+		start := time.Now()
+		err := c.follow(ctx)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		log.Printf("EventStreams: %v", err)
+		if time.Since(start) > time.Minute {
+			backoff = time.Second
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, 5*time.Minute)
+	}
+}
+
+// Follow connects to the event stream and processes events
+// until the connection breaks.
+func (c *eventStreamClient) follow(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set("User-Agent", "QRankWebserver/0.1 (https://qrank.toolforge.org)")
+	if c.lastEventID != "" {
+		req.Header.Set("Last-Event-ID", c.lastEventID)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: HTTP status %d", c.url, resp.StatusCode)
+	}
+
+	return readServerSentEvents(resp.Body, func(id, data string) {
+		if id != "" {
+			c.lastEventID = id
+		}
+		var rc recentChange
+		if err := json.Unmarshal([]byte(data), &rc); err != nil {
+			return // not a recentchange event, eg. a comment
+		}
+		if entity, ok := c.resolve(&rc); ok {
+			c.hot.Add(entity)
+		}
+	})
+}
+
+// Resolve finds the Wikidata entity for an edit, if any. Edits to
+// Wikidata items count for the item itself; edits to articles on
+// other wikis count for the entity of the article's sitelink.
+func (c *eventStreamClient) resolve(rc *recentChange) (uint32, bool) {
+	if rc.Bot || rc.Namespace != 0 || (rc.Type != "edit" && rc.Type != "new") {
+		return 0, false
+	}
+	if rc.Wiki == "wikidatawiki" {
+		return parseEntityID(rc.Title)
+	}
+
+	sitelinks := c.storage.Sitelinks()
+	if sitelinks == nil {
+		return 0, false
+	}
+	key, ok := sitelinkKey(rc.Wiki, rc.Title)
+	if !ok {
+		return 0, false
+	}
+	entity, found, err := sitelinks.Lookup(key)
+	if err != nil || !found {
+		return 0, false
+	}
+	return entity, true
+}
+
+// ReadServerSentEvents parses a stream in Server-Sent Events format,
+// calling handle for each event until the stream ends.
+// https://html.spec.whatwg.org/multipage/server-sent-events.html
+func readServerSentEvents(r io.Reader, handle func(id, data string)) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	var id string
+	var data strings.Builder
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			if data.Len() > 0 {
+				handle(id, strings.TrimSuffix(data.String(), "\n"))
+			}
+			data.Reset()
+			continue
+		}
+		field, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+		switch field {
+		case "id":
+			id = value
+		case "data":
+			data.WriteString(value)
+			data.WriteByte('\n')
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return io.ErrUnexpectedEOF
+}
@@ -0,0 +1,79 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadServerSentEvents(t *testing.T) {
+	stream := ":ok\n\n" +
+		"event: message\nid: [{\"offset\":1}]\ndata: {\"a\":1}\n\n" +
+		"data: line1\ndata:line2\n\n" +
+		"id: 3\n\n"
+	var got []string
+	err := readServerSentEvents(strings.NewReader(stream), func(id, data string) {
+		got = append(got, id+"|"+data)
+	})
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("got error %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+	want := []string{`[{"offset":1}]|{"a":1}`, `[{"offset":1}]|line1` + "\n" + "line2"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestEventStreamClient(t *testing.T) {
+	events := []string{
+		`{"type":"edit","namespace":0,"title":"Q42","wiki":"wikidatawiki"}`,
+		`{"type":"edit","namespace":0,"title":"Berlin","wiki":"dewiki"}`,
+		`{"type":"new","namespace":0,"title":"Douglas Adams","wiki":"enwiki"}`,
+		`{"type":"edit","namespace":0,"title":"Q42","wiki":"wikidatawiki","bot":true}`,
+		`{"type":"edit","namespace":1,"title":"Berlin","wiki":"enwiki"}`,
+		`{"type":"log","namespace":0,"title":"Berlin","wiki":"enwiki"}`,
+		`{"type":"edit","namespace":0,"title":"Atlantis","wiki":"enwiki"}`,
+	}
+	var lastEventID string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		lastEventID = req.Header.Get("Last-Event-ID")
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i, e := range events {
+			fmt.Fprintf(w, "event: message\nid: %d\ndata: %s\n\n", i, e)
+		}
+	}))
+	defer server.Close()
+
+	storage := &Storage{sitelinks: openTestSitelinks(t)}
+	hot := newHotOverlay(time.Hour, 100)
+	c := newEventStreamClient(server.URL, storage, hot)
+	if err := c.follow(context.Background()); err != io.ErrUnexpectedEOF {
+		t.Fatalf("got error %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+
+	entities, activities := hot.Top(10)
+	if want := []uint32{42, 64}; !reflect.DeepEqual(entities, want) {
+		t.Errorf("got %v, want %v", entities, want)
+	}
+	if len(activities) == 2 && (activities[0] < 1.99 || activities[1] < 0.99) {
+		t.Errorf("got activities %v, want about [2 1]", activities)
+	}
+
+	// When reconnecting, the client should resume after the last event.
+	if c.lastEventID != "6" {
+		t.Errorf("got lastEventID %q, want %q", c.lastEventID, "6")
+	}
+	c.follow(context.Background())
+	if lastEventID != "6" {
+		t.Errorf("server got Last-Event-ID %q, want %q", lastEventID, "6")
+	}
+}
@@ -0,0 +1,127 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+
+	"github.com/brawer/wikidata-qrank/v2/proto/qrankpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// GrpcStreamPage is the number of entities that StreamTop fetches
+// from the rank index at a time.
+const grpcStreamPage = 1000
+
+// GrpcServer serves the same lookups as /rank/{qid} and /ranks over
+// gRPC. The service is defined in proto/qrank.proto.
+type grpcServer struct {
+	qrankpb.UnimplementedQRankServer
+	storage *Storage
+}
+
+// NewGRPCServer returns a gRPC server for QRank lookups, with the
+// rankings taken from storage.
+func newGRPCServer(storage *Storage) *grpc.Server {
+	s := grpc.NewServer()
+	qrankpb.RegisterQRankServer(s, &grpcServer{storage: storage})
+	return s
+}
+
+// Lookup returns the ranking of a single entity.
+func (g *grpcServer) Lookup(ctx context.Context, req *qrankpb.LookupRequest) (*qrankpb.RankInfo, error) {
+	entity, ok := parseEntityID(req.GetEntity())
+	if !ok {
+		return nil, status.Errorf(codes.InvalidArgument, "bad Wikidata ID: %q", req.GetEntity())
+	}
+	ranks, err := g.ranks()
+	if err != nil {
+		return nil, err
+	}
+	info, found := ranks.Lookup(entity)
+	if !found {
+		return nil, status.Errorf(codes.NotFound, "%s is not ranked", req.GetEntity())
+	}
+	return rankInfoProto(info), nil
+}
+
+// BulkLookup returns the ranking of many entities at once.
+func (g *grpcServer) BulkLookup(ctx context.Context, req *qrankpb.BulkLookupRequest) (*qrankpb.BulkLookupResponse, error) {
+	qids := req.GetEntities()
+	if len(qids) > maxBulkEntities {
+		return nil, status.Errorf(codes.InvalidArgument, "too many entities, limit is %d", maxBulkEntities)
+	}
+	entities := make([]uint32, 0, len(qids))
+	for _, qid := range qids {
+		entity, ok := parseEntityID(qid)
+		if !ok {
+			return nil, status.Errorf(codes.InvalidArgument, "bad Wikidata ID: %q", qid)
+		}
+		entities = append(entities, entity)
+	}
+	ranks, err := g.ranks()
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &qrankpb.BulkLookupResponse{
+		Ranks: make([]*qrankpb.RankInfo, 0, len(entities)),
+	}
+	for i, entity := range entities {
+		if info, found := ranks.Lookup(entity); found {
+			resp.Ranks = append(resp.Ranks, rankInfoProto(info))
+		} else {
+			resp.NotFound = append(resp.NotFound, qids[i])
+		}
+	}
+	return resp, nil
+}
+
+// StreamTop streams entities in ranking order, starting with the
+// highest-ranked one.
+func (g *grpcServer) StreamTop(req *qrankpb.StreamTopRequest, stream qrankpb.QRank_StreamTopServer) error {
+	if req.GetLimit() < 0 {
+		return status.Errorf(codes.InvalidArgument, "negative limit: %d", req.GetLimit())
+	}
+	ranks, err := g.ranks()
+	if err != nil {
+		return err
+	}
+	end := ranks.Len()
+	if limit := req.GetLimit(); limit > 0 && limit < int64(end) {
+		end = int(limit)
+	}
+	for offset := 0; offset < end; offset += grpcStreamPage {
+		if err := stream.Context().Err(); err != nil {
+			return status.FromContextError(err).Err()
+		}
+		for _, info := range ranks.Range(offset, min(grpcStreamPage, end-offset)) {
+			if err := stream.Send(rankInfoProto(info)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Ranks returns the current rank index, or an error with status
+// UNAVAILABLE if no ranking has been loaded yet.
+func (g *grpcServer) ranks() (*RankIndex, error) {
+	ranks := g.storage.Ranks()
+	if ranks == nil {
+		return nil, status.Error(codes.Unavailable, "ranking not loaded yet")
+	}
+	return ranks, nil
+}
+
+func rankInfoProto(info RankInfo) *qrankpb.RankInfo {
+	return &qrankpb.RankInfo{
+		Entity:     info.Entity,
+		Qrank:      info.QRank,
+		Rank:       info.Rank,
+		Percentile: info.Percentile,
+	}
+}
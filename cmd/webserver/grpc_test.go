@@ -0,0 +1,120 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/brawer/wikidata-qrank/v2/proto/qrankpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func makeGRPCTestClient(t *testing.T, storage *Storage) qrankpb.QRankClient {
+	lis := bufconn.Listen(1024 * 1024)
+	server := newGRPCServer(storage)
+	go server.Serve(lis)
+	t.Cleanup(server.Stop)
+
+	dial := func(ctx context.Context, _ string) (net.Conn, error) {
+		return lis.DialContext(ctx)
+	}
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(dial),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return qrankpb.NewQRankClient(conn)
+}
+
+func TestGRPC(t *testing.T) {
+	ws := makeTestWebserver()
+	ri, err := readRankIndex(strings.NewReader("Entity,QRank\nQ64,900\nQ42,5\nQ1,2\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws.storage.ranks = ri
+	client := makeGRPCTestClient(t, ws.storage)
+	ctx := context.Background()
+
+	info, err := client.Lookup(ctx, &qrankpb.LookupRequest{Entity: "Q42"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Entity != "Q42" || info.Qrank != 5 || info.Rank != 2 || info.Percentile != 66.667 {
+		t.Errorf("got %v", info)
+	}
+
+	for _, tc := range []struct {
+		entity string
+		want   codes.Code
+	}{
+		{"Q7", codes.NotFound},
+		{"foo", codes.InvalidArgument},
+	} {
+		_, err := client.Lookup(ctx, &qrankpb.LookupRequest{Entity: tc.entity})
+		if got := status.Code(err); got != tc.want {
+			t.Errorf("Lookup(%q): got %v, want %v", tc.entity, got, tc.want)
+		}
+	}
+
+	bulk, err := client.BulkLookup(ctx, &qrankpb.BulkLookupRequest{Entities: []string{"Q1", "Q7", "Q64"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, r := range bulk.Ranks {
+		got = append(got, r.Entity)
+	}
+	if !slices.Equal(got, []string{"Q1", "Q64"}) || !slices.Equal(bulk.NotFound, []string{"Q7"}) {
+		t.Errorf("got %v", bulk)
+	}
+
+	for _, tc := range []struct {
+		limit int64
+		want  []string
+	}{
+		{0, []string{"Q64", "Q42", "Q1"}},
+		{2, []string{"Q64", "Q42"}},
+		{7, []string{"Q64", "Q42", "Q1"}},
+	} {
+		stream, err := client.StreamTop(ctx, &qrankpb.StreamTopRequest{Limit: tc.limit})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for {
+			info, err := stream.Recv()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, info.Entity)
+		}
+		if !slices.Equal(got, tc.want) {
+			t.Errorf("StreamTop(%d): got %v, want %v", tc.limit, got, tc.want)
+		}
+	}
+}
+
+func TestGRPC_NotLoaded(t *testing.T) {
+	ws := makeTestWebserver()
+	client := makeGRPCTestClient(t, ws.storage)
+	_, err := client.Lookup(context.Background(), &qrankpb.LookupRequest{Entity: "Q42"})
+	if got := status.Code(err); got != codes.Unavailable {
+		t.Errorf("got %v, want %v", got, codes.Unavailable)
+	}
+}
@@ -0,0 +1,137 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// HistoryIndex gives the QRank scores of entities in past releases.
+// The index is a text file on local disk, as published by qrank-builder,
+// with a header such as "Entity,2024-02-01,2024-03-01" and lines such
+// as "Q42,117,123", sorted numerically by entity ID. An empty column
+// means the entity was not ranked in that release.
+type HistoryIndex struct {
+	*sortedFile
+	dates []string
+}
+
+// HistoryPoint is the score of an entity in one release.
+type HistoryPoint struct {
+	Date  string `json:"date"`
+	QRank int64  `json:"qrank"`
+}
+
+// History is the response of the /history endpoint.
+type History struct {
+	Entity  string         `json:"entity"`
+	History []HistoryPoint `json:"history"`
+}
+
+// OpenHistoryIndex opens a decompressed history file for lookups.
+func OpenHistoryIndex(path string) (*HistoryIndex, error) {
+	sf, err := openSortedFile(path)
+	if err != nil {
+		return nil, err
+	}
+	header, err := sf.lineAt(0)
+	if err != nil {
+		sf.Close()
+		return nil, err
+	}
+	cols := strings.Split(string(header), ",")
+	if header == nil || cols[0] != "Entity" {
+		sf.Close()
+		return nil, fmt.Errorf("%s: bad header %q", path, header)
+	}
+	return &HistoryIndex{sortedFile: sf, dates: cols[1:]}, nil
+}
+
+// Lookup returns the scores of an entity in past releases, leaving out
+// the releases where the entity was not ranked. It is safe to call
+// Lookup from multiple goroutines at the same time.
+func (hi *HistoryIndex) Lookup(entity uint32) ([]HistoryPoint, bool, error) {
+	line, err := hi.search(func(line []byte) bool {
+		// The header does not start with a Wikidata ID, so it
+		// sorts before all entities.
+		e, ok := parseHistoryEntity(line)
+		return ok && e >= entity
+	})
+	if err != nil || line == nil {
+		return nil, false, err
+	}
+	if e, _ := parseHistoryEntity(line); e != entity {
+		return nil, false, nil
+	}
+
+	cols := strings.Split(string(line), ",")
+	if len(cols) != len(hi.dates)+1 {
+		return nil, false, fmt.Errorf("expected %d columns, got %q", len(hi.dates)+1, line)
+	}
+	points := make([]HistoryPoint, 0, len(hi.dates))
+	for i, s := range cols[1:] {
+		if s == "" {
+			continue
+		}
+		score, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return nil, false, err
+		}
+		points = append(points, HistoryPoint{Date: hi.dates[i], QRank: score})
+	}
+	return points, true, nil
+}
+
+func parseHistoryEntity(line []byte) (uint32, bool) {
+	qid, _, _ := bytes.Cut(line, []byte{','})
+	return parseEntityID(string(qid))
+}
+
+// HandleHistory serves the QRank scores of an entity across releases,
+// such as /history/Q42.
+func (ws *Webserver) HandleHistory(w http.ResponseWriter, req *http.Request) {
+	h := w.Header()
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+	case http.MethodOptions:
+		ws.handlePreflight(w, req, "GET, HEAD, OPTIONS")
+		return
+	default:
+		h.Set("Allow", "GET, HEAD, OPTIONS")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	ws.setAllowOrigin(h, req)
+
+	qid := strings.TrimPrefix(req.URL.Path, "/history/")
+	entity, ok := parseEntityID(qid)
+	if !ok {
+		http.Error(w, "bad Wikidata ID", http.StatusBadRequest)
+		return
+	}
+
+	history := ws.storage.History()
+	if history == nil {
+		http.Error(w, "history not loaded yet", http.StatusServiceUnavailable)
+		return
+	}
+
+	points, found, err := history.Lookup(entity)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.NotFound(w, req)
+		return
+	}
+
+	h.Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(History{Entity: fmt.Sprintf("Q%d", entity), History: points})
+}
@@ -0,0 +1,110 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func openTestHistory(t *testing.T) *HistoryIndex {
+	src := filepath.Join(t.TempDir(), "history.csv.gz")
+	f, err := os.Create(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := gzip.NewWriter(f)
+	content := "Entity,2024-01-01,2024-02-01,2024-03-01\n" +
+		"Q1,1,2,3\nQ42,,117,123\nQ64,900,,\nQ1000,7,8,9\n"
+	if _, err := w.Write([]byte(content)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	dest := strings.TrimSuffix(src, ".gz")
+	if err := decompressFile(src, dest); err != nil {
+		t.Fatal(err)
+	}
+	hi, err := OpenHistoryIndex(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { hi.Close() })
+	return hi
+}
+
+func TestHistoryIndex_Lookup(t *testing.T) {
+	hi := openTestHistory(t)
+	for _, tc := range []struct {
+		entity uint32
+		want   []HistoryPoint
+	}{
+		{1, []HistoryPoint{{"2024-01-01", 1}, {"2024-02-01", 2}, {"2024-03-01", 3}}},
+		{42, []HistoryPoint{{"2024-02-01", 117}, {"2024-03-01", 123}}},
+		{64, []HistoryPoint{{"2024-01-01", 900}}},
+		{1000, []HistoryPoint{{"2024-01-01", 7}, {"2024-02-01", 8}, {"2024-03-01", 9}}},
+		{2, nil},
+		{100, nil},
+		{5000, nil},
+	} {
+		got, found, err := hi.Lookup(tc.entity)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found != (tc.want != nil) || !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("Lookup(%d): got %v, %v; want %v", tc.entity, got, found, tc.want)
+		}
+	}
+}
+
+func TestWebserver_History(t *testing.T) {
+	ws := makeTestWebserver()
+	ws.storage.history = openTestHistory(t)
+
+	for _, tc := range []struct {
+		path   string
+		status int
+		body   string
+	}{
+		{"/history/Q42", http.StatusOK,
+			`{"entity":"Q42","history":[{"date":"2024-02-01","qrank":117},{"date":"2024-03-01","qrank":123}]}` + "\n"},
+		{"/history/Q7", http.StatusNotFound, "404 page not found\n"},
+		{"/history/foo", http.StatusBadRequest, "bad Wikidata ID\n"},
+	} {
+		w := httptest.NewRecorder()
+		ws.HandleHistory(w, httptest.NewRequest("GET", tc.path, nil))
+		res := w.Result()
+		body, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != tc.status {
+			t.Errorf("%s: got status %d, want %d", tc.path, res.StatusCode, tc.status)
+		}
+		if string(body) != tc.body {
+			t.Errorf("%s: got %q, want %q", tc.path, body, tc.body)
+		}
+	}
+}
+
+func TestWebserver_HistoryNotLoaded(t *testing.T) {
+	ws := makeTestWebserver()
+	w := httptest.NewRecorder()
+	ws.HandleHistory(w, httptest.NewRequest("GET", "/history/Q42", nil))
+	if got, want := w.Result().StatusCode, http.StatusServiceUnavailable; got != want {
+		t.Errorf("got status %d, want %d", got, want)
+	}
+}
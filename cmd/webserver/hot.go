@@ -0,0 +1,195 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// HotOverlay keeps track of very recent activity on Wikidata entities,
+// as seen on Wikimedia EventStreams. Every event adds one to the activity
+// of an entity, and activity decays exponentially over time. This is
+// a small overlay on top of the monthly batch ranking, meant to answer
+// what is getting attention right now.
+type hotOverlay struct {
+	halfLife   time.Duration
+	maxEntries int
+	now        func() time.Time
+
+	mutex   sync.Mutex
+	entries map[uint32]*hotEntry
+}
+
+type hotEntry struct {
+	activity float64 // as of updated
+	updated  time.Time
+}
+
+// HotEntity is an entry in the response of the /hot endpoint.
+type HotEntity struct {
+	Entity   string  `json:"entity"`
+	Activity float64 `json:"activity"`
+
+	// Batch ranking, or zero if the entity is not ranked.
+	QRank int64 `json:"qrank"`
+	Rank  int64 `json:"rank"`
+}
+
+// Number of entities kept in the overlay, unless configured otherwise.
+// Beyond this, the least active entities get forgotten.
+const defaultHotEntries = 100000
+
+const (
+	defaultHotLimit = 50
+	maxHotLimit     = 1000
+)
+
+func newHotOverlay(halfLife time.Duration, maxEntries int) *hotOverlay {
+	return &hotOverlay{
+		halfLife:   halfLife,
+		maxEntries: maxEntries,
+		now:        time.Now,
+		entries:    make(map[uint32]*hotEntry, 1000),
+	}
+}
+
+// Decayed returns the activity of an entry at a point in time.
+func (h *hotOverlay) decayed(e *hotEntry, now time.Time) float64 {
+	elapsed := now.Sub(e.updated).Seconds()
+	return e.activity * math.Exp2(-elapsed/h.halfLife.Seconds())
+}
+
+// Add records one event for an entity.
+func (h *hotOverlay) Add(entity uint32) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	now := h.now()
+	e, ok := h.entries[entity]
+	if !ok {
+		if len(h.entries) >= h.maxEntries {
+			h.prune(now)
+		}
+		e = &hotEntry{updated: now}
+		h.entries[entity] = e
+	}
+	e.activity = h.decayed(e, now) + 1
+	e.updated = now
+}
+
+// Prune forgets the less active half of all entries.
+// Caller must hold the mutex.
+func (h *hotOverlay) prune(now time.Time) {
+	activities := make([]float64, 0, len(h.entries))
+	for _, e := range h.entries {
+		activities = append(activities, h.decayed(e, now))
+	}
+	slices.Sort(activities)
+	median := activities[(len(activities)-1)/2]
+	for entity, e := range h.entries {
+		if h.decayed(e, now) <= median {
+			delete(h.entries, entity)
+		}
+	}
+}
+
+// Top returns up to n entities with the highest current activity,
+// together with their activity.
+func (h *hotOverlay) Top(n int) ([]uint32, []float64) {
+	h.mutex.Lock()
+	now := h.now()
+	type item struct {
+		entity   uint32
+		activity float64
+	}
+	items := make([]item, 0, len(h.entries))
+	for entity, e := range h.entries {
+		items = append(items, item{entity, h.decayed(e, now)})
+	}
+	h.mutex.Unlock()
+
+	slices.SortFunc(items, func(a, b item) int {
+		if c := cmp.Compare(b.activity, a.activity); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.entity, b.entity)
+	})
+	items = items[:min(n, len(items))]
+	entities := make([]uint32, len(items))
+	activities := make([]float64, len(items))
+	for i, it := range items {
+		entities[i], activities[i] = it.entity, it.activity
+	}
+	return entities, activities
+}
+
+// Len returns the number of entities in the overlay.
+func (h *hotOverlay) Len() int {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return len(h.entries)
+}
+
+// HandleHot serves the entities with the most recent activity,
+// such as /hot?limit=20, along with their batch ranking.
+func (ws *Webserver) HandleHot(w http.ResponseWriter, req *http.Request) {
+	h := w.Header()
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+	case http.MethodOptions:
+		ws.handlePreflight(w, req, "GET, HEAD, OPTIONS")
+		return
+	default:
+		h.Set("Allow", "GET, HEAD, OPTIONS")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	ws.setAllowOrigin(h, req)
+
+	if ws.hot == nil {
+		http.Error(w, "not enabled on this server", http.StatusNotFound)
+		return
+	}
+
+	limit := defaultHotLimit
+	if s := req.URL.Query().Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxHotLimit {
+			msg := fmt.Sprintf("limit must be between 1 and %d", maxHotLimit)
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	ranks := ws.storage.Ranks()
+	entities, activities := ws.hot.Top(limit)
+	result := make([]HotEntity, 0, len(entities))
+	for i, entity := range entities {
+		he := HotEntity{
+			Entity:   fmt.Sprintf("Q%d", entity),
+			Activity: math.Round(activities[i]*100) / 100,
+		}
+		if ranks != nil {
+			if info, found := ranks.Lookup(entity); found {
+				he.QRank, he.Rank = info.QRank, info.Rank
+			}
+		}
+		result = append(result, he)
+	}
+
+	h.Set("Content-Type", "application/json")
+	h.Set("Cache-Control", "public, max-age=60")
+	json.NewEncoder(w).Encode(struct {
+		Entities []HotEntity `json:"entities"`
+	}{result})
+}
@@ -0,0 +1,109 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHotOverlay(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	h := newHotOverlay(time.Hour, 100)
+	h.now = func() time.Time { return now }
+
+	for i := 0; i < 4; i++ {
+		h.Add(42)
+	}
+	h.Add(64)
+	now = now.Add(time.Hour)
+	h.Add(64)
+
+	entities, activities := h.Top(10)
+	if want := []uint32{42, 64}; !reflect.DeepEqual(entities, want) {
+		t.Errorf("got entities %v, want %v", entities, want)
+	}
+	if want := []float64{2.0, 1.5}; !reflect.DeepEqual(activities, want) {
+		t.Errorf("got activities %v, want %v", activities, want)
+	}
+
+	if entities, _ := h.Top(1); !reflect.DeepEqual(entities, []uint32{42}) {
+		t.Errorf("Top(1): got %v", entities)
+	}
+}
+
+func TestHotOverlay_Prune(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	h := newHotOverlay(time.Hour, 4)
+	h.now = func() time.Time { return now }
+	for entity := uint32(1); entity <= 4; entity++ {
+		for i := uint32(0); i < entity; i++ {
+			h.Add(entity)
+		}
+	}
+	h.Add(5)
+	if got := h.Len(); got != 3 {
+		t.Errorf("got %d entries, want 3", got)
+	}
+	entities, _ := h.Top(10)
+	if want := []uint32{4, 3, 5}; !reflect.DeepEqual(entities, want) {
+		t.Errorf("got %v, want %v", entities, want)
+	}
+}
+
+func TestWebserver_Hot(t *testing.T) {
+	ws := makeTestWebserver()
+	ri, err := readRankIndex(strings.NewReader("Entity,QRank\nQ64,900\nQ42,5\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws.storage.ranks = ri
+	ws.hot = newHotOverlay(time.Hour, 100)
+	now := time.Now()
+	ws.hot.now = func() time.Time { return now }
+	ws.hot.Add(42)
+	ws.hot.Add(42)
+	ws.hot.Add(7)
+
+	for _, tc := range []struct {
+		path   string
+		status int
+		body   string
+	}{
+		{"/hot", http.StatusOK, `{"entities":[` +
+			`{"entity":"Q42","activity":2,"qrank":5,"rank":2},` +
+			`{"entity":"Q7","activity":1,"qrank":0,"rank":0}]}` + "\n"},
+		{"/hot?limit=1", http.StatusOK,
+			`{"entities":[{"entity":"Q42","activity":2,"qrank":5,"rank":2}]}` + "\n"},
+		{"/hot?limit=0", http.StatusBadRequest, "limit must be between 1 and 1000\n"},
+	} {
+		w := httptest.NewRecorder()
+		ws.HandleHot(w, httptest.NewRequest("GET", tc.path, nil))
+		res := w.Result()
+		body, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != tc.status {
+			t.Errorf("%s: got status %d, want %d", tc.path, res.StatusCode, tc.status)
+		}
+		if string(body) != tc.body {
+			t.Errorf("%s: got %q, want %q", tc.path, body, tc.body)
+		}
+	}
+}
+
+func TestWebserver_HotDisabled(t *testing.T) {
+	ws := makeTestWebserver()
+	w := httptest.NewRecorder()
+	ws.HandleHot(w, httptest.NewRequest("GET", "/hot", nil))
+	if got, want := w.Result().StatusCode, http.StatusNotFound; got != want {
+		t.Errorf("got status %d, want %d", got, want)
+	}
+}
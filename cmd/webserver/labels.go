@@ -0,0 +1,279 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// DefaultWikidataAPI is the endpoint for fetching entity labels.
+// https://www.wikidata.org/w/api.php?action=help&modules=wbgetentities
+const defaultWikidataAPI = "https://www.wikidata.org/w/api.php"
+
+// The Wikidata API returns at most 50 entities per call.
+const wikidataAPIBatchSize = 50
+
+// MaxLabeledEntities is the maximal number of entities whose labels
+// can be requested in a single call to our API. This keeps bulk
+// lookups from sending hundreds of calls to the Wikidata API.
+const maxLabeledEntities = 1000
+
+// Language codes as used by Wikidata, such as "en" or "zh-hans".
+var labelLanguageRegexp = regexp.MustCompile(`^[a-z]{2,3}(-[a-z0-9]{1,8})*$`)
+
+// EntityLabels holds the human-readable label and description
+// of an entity in one language.
+type entityLabels struct {
+	Label       string `json:"label,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+// LabelCache fetches entity labels from the Wikidata API and keeps
+// them on local disk, one small JSON file per entity and language,
+// for a limited time. Concurrent requests for the same entities
+// get coalesced into a single call to the API.
+type labelCache struct {
+	apiURL string
+	client *http.Client
+	dir    string
+	ttl    time.Duration
+	now    func() time.Time
+	group  singleflight.Group
+}
+
+func newLabelCache(apiURL, dir string, ttl time.Duration) *labelCache {
+	return &labelCache{
+		apiURL: apiURL,
+		client: &http.Client{Timeout: 10 * time.Second},
+		dir:    dir,
+		ttl:    ttl,
+		now:    time.Now,
+	}
+}
+
+// Lookup returns the labels of entities in a language. Entities
+// without a label or description in that language are absent from
+// the result. It is safe to call Lookup from multiple goroutines
+// at the same time.
+func (c *labelCache) Lookup(lang string, entities []uint32) (map[uint32]entityLabels, error) {
+	result := make(map[uint32]entityLabels, len(entities))
+	missing := make([]uint32, 0, len(entities))
+	for _, e := range entities {
+		if labels, ok := c.readCached(lang, e); ok {
+			labelLookups.WithLabelValues("hit").Inc()
+			if labels != (entityLabels{}) {
+				result[e] = labels
+			}
+		} else {
+			labelLookups.WithLabelValues("miss").Inc()
+			missing = append(missing, e)
+		}
+	}
+
+	// Sorting makes identical requests produce identical batches,
+	// which lets singleflight coalesce them.
+	slices.Sort(missing)
+	missing = slices.Compact(missing)
+	for batch := range slices.Chunk(missing, wikidataAPIBatchSize) {
+		key := lang + ":" + formatEntityList(batch)
+		v, err, _ := c.group.Do(key, func() (any, error) {
+			return c.fetch(lang, batch)
+		})
+		if err != nil {
+			return nil, err
+		}
+		for e, labels := range v.(map[uint32]entityLabels) {
+			result[e] = labels
+		}
+	}
+	return result, nil
+}
+
+// Fetch calls the Wikidata API and stores the results on disk,
+// including entities that have no label, so we do not ask again
+// before the cache entry expires.
+func (c *labelCache) fetch(lang string, entities []uint32) (map[uint32]entityLabels, error) {
+	params := url.Values{}
+	params.Set("action", "wbgetentities")
+	params.Set("format", "json")
+	params.Set("props", "labels|descriptions")
+	params.Set("languages", lang)
+	params.Set("languagefallback", "1")
+	params.Set("ids", formatEntityList(entities))
+
+	req, err := http.NewRequest(http.MethodGet, c.apiURL+"?"+params.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "QRankWebserver/0.1 (https://qrank.toolforge.org)")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: status %d", c.apiURL, resp.StatusCode)
+	}
+
+	type text struct {
+		Value string `json:"value"`
+	}
+	var reply struct {
+		Entities map[string]struct {
+			Labels       map[string]text `json:"labels"`
+			Descriptions map[string]text `json:"descriptions"`
+		} `json:"entities"`
+		Error *struct {
+			Code string `json:"code"`
+			Info string `json:"info"`
+		} `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		return nil, err
+	}
+	if reply.Error != nil {
+		return nil, fmt.Errorf("%s: %s: %s", c.apiURL, reply.Error.Code, reply.Error.Info)
+	}
+
+	result := make(map[uint32]entityLabels, len(entities))
+	for _, e := range entities {
+		ent := reply.Entities[fmt.Sprintf("Q%d", e)]
+		labels := entityLabels{
+			Label:       ent.Labels[lang].Value,
+			Description: ent.Descriptions[lang].Value,
+		}
+		if err := c.writeCached(lang, e, labels); err != nil {
+			log.Printf("could not cache labels of Q%d: %v", e, err)
+		}
+		if labels != (entityLabels{}) {
+			result[e] = labels
+		}
+	}
+	return result, nil
+}
+
+// Path returns the location of a cache entry. To keep directories
+// small, entries are spread over 256 subdirectories per language.
+func (c *labelCache) path(lang string, entity uint32) string {
+	return filepath.Join(c.dir, lang, fmt.Sprintf("%02x", entity&0xff), fmt.Sprintf("Q%d.json", entity))
+}
+
+func (c *labelCache) readCached(lang string, entity uint32) (entityLabels, bool) {
+	var labels entityLabels
+	path := c.path(lang, entity)
+	stat, err := os.Stat(path)
+	if err != nil || c.now().Sub(stat.ModTime()) >= c.ttl {
+		return labels, false
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return labels, false
+	}
+	if err := json.Unmarshal(data, &labels); err != nil {
+		return labels, false
+	}
+	return labels, true
+}
+
+func (c *labelCache) writeCached(lang string, entity uint32, labels entityLabels) error {
+	path := c.path(lang, entity)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	data, err := json.Marshal(labels)
+	if err != nil {
+		return err
+	}
+
+	// Concurrent writers for the same entry must not see each
+	// other’s partial files, so each one gets a distinct temp file.
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Chtimes(tmp.Name(), c.now(), c.now()); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// FormatEntityList formats entities for the Wikidata API, such as "Q1|Q42".
+func formatEntityList(entities []uint32) string {
+	var buf strings.Builder
+	for i, e := range entities {
+		if i > 0 {
+			buf.WriteByte('|')
+		}
+		fmt.Fprintf(&buf, "Q%d", e)
+	}
+	return buf.String()
+}
+
+// LabelLanguage returns the language of labels requested with the
+// lang parameter, or "" if the client did not ask for labels.
+// If the parameter cannot be served, LabelLanguage sends an error
+// response and returns false.
+func (ws *Webserver) labelLanguage(w http.ResponseWriter, req *http.Request) (string, bool) {
+	lang := req.URL.Query().Get("lang")
+	if lang == "" {
+		return "", true
+	}
+	if ws.labels == nil {
+		http.Error(w, "labels not enabled on this server", http.StatusNotImplemented)
+		return "", false
+	}
+	if !labelLanguageRegexp.MatchString(lang) {
+		http.Error(w, "bad lang", http.StatusBadRequest)
+		return "", false
+	}
+	return lang, true
+}
+
+// AddLabels fills in the labels and descriptions of ranked entities.
+// If the Wikidata API cannot be reached, the rankings are still
+// useful, so we log the problem and leave the labels empty.
+func (ws *Webserver) addLabels(lang string, infos []RankInfo) {
+	if lang == "" || len(infos) == 0 {
+		return
+	}
+	entities := make([]uint32, 0, len(infos))
+	for _, info := range infos {
+		if e, ok := parseEntityID(info.Entity); ok {
+			entities = append(entities, e)
+		}
+	}
+	labels, err := ws.labels.Lookup(lang, entities)
+	if err != nil {
+		log.Printf("could not fetch labels: %v", err)
+		return
+	}
+	for i := range infos {
+		if e, ok := parseEntityID(infos[i].Entity); ok {
+			infos[i].Label = labels[e].Label
+			infos[i].Description = labels[e].Description
+		}
+	}
+}
@@ -0,0 +1,204 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// FakeWikidataAPI serves labels for Q1 and Q42 in English.
+type fakeWikidataAPI struct {
+	calls   atomic.Int32
+	block   chan struct{} // if non-nil, requests wait until closed
+	failing bool
+}
+
+func (f *fakeWikidataAPI) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	f.calls.Add(1)
+	if f.block != nil {
+		<-f.block
+	}
+	if f.failing {
+		fmt.Fprint(w, `{"error":{"code":"maxlag","info":"Waiting for a database server"}}`)
+		return
+	}
+	q := req.URL.Query()
+	if q.Get("action") != "wbgetentities" || q.Get("languages") != "en" {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	var parts []string
+	for _, id := range strings.Split(q.Get("ids"), "|") {
+		switch id {
+		case "Q1":
+			parts = append(parts, `"Q1":{"labels":{"en":{"language":"en","value":"Universe"}},"descriptions":{}}`)
+		case "Q42":
+			parts = append(parts, `"Q42":{"labels":{"en":{"language":"en","value":"Douglas Adams"}},"descriptions":{"en":{"language":"en","value":"English author"}}}`)
+		default:
+			parts = append(parts, fmt.Sprintf(`"%s":{"id":"%s","missing":""}`, id, id))
+		}
+	}
+	fmt.Fprintf(w, `{"entities":{%s},"success":1}`, strings.Join(parts, ","))
+}
+
+func newTestLabelCache(t *testing.T, api *fakeWikidataAPI) *labelCache {
+	server := httptest.NewServer(api)
+	t.Cleanup(server.Close)
+	return newLabelCache(server.URL, t.TempDir(), time.Hour)
+}
+
+func TestLabelCache_Lookup(t *testing.T) {
+	api := &fakeWikidataAPI{}
+	c := newTestLabelCache(t, api)
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	c.now = func() time.Time { return now }
+
+	want := map[uint32]entityLabels{
+		1:  {Label: "Universe"},
+		42: {Label: "Douglas Adams", Description: "English author"},
+	}
+	for i := 0; i < 2; i++ {
+		got, err := c.Lookup("en", []uint32{42, 1, 7})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	}
+	if got := api.calls.Load(); got != 1 {
+		t.Errorf("got %d API calls, want 1 because of caching", got)
+	}
+
+	now = now.Add(2 * time.Hour)
+	if _, err := c.Lookup("en", []uint32{7}); err != nil {
+		t.Fatal(err)
+	}
+	if got := api.calls.Load(); got != 2 {
+		t.Errorf("got %d API calls, want 2 after cache expiry", got)
+	}
+}
+
+func TestLabelCache_Batches(t *testing.T) {
+	api := &fakeWikidataAPI{}
+	c := newTestLabelCache(t, api)
+	entities := make([]uint32, wikidataAPIBatchSize+1)
+	for i := range entities {
+		entities[i] = uint32(i + 1)
+	}
+	got, err := c.Lookup("en", entities)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[1].Label != "Universe" || got[42].Label != "Douglas Adams" {
+		t.Errorf("got %v", got)
+	}
+	if got := api.calls.Load(); got != 2 {
+		t.Errorf("got %d API calls, want 2", got)
+	}
+}
+
+func TestLabelCache_Coalescing(t *testing.T) {
+	api := &fakeWikidataAPI{block: make(chan struct{})}
+	c := newTestLabelCache(t, api)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			got, err := c.Lookup("en", []uint32{42})
+			if err != nil {
+				t.Error(err)
+			} else if got[42].Label != "Douglas Adams" {
+				t.Errorf("got %v", got)
+			}
+		}()
+	}
+
+	// Give the goroutines time to pile up behind the first request.
+	for api.calls.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(api.block)
+	wg.Wait()
+	if got := api.calls.Load(); got != 1 {
+		t.Errorf("got %d API calls, want 1", got)
+	}
+}
+
+func TestLabelCache_Error(t *testing.T) {
+	c := newTestLabelCache(t, &fakeWikidataAPI{failing: true})
+	_, err := c.Lookup("en", []uint32{42})
+	if err == nil || !strings.Contains(err.Error(), "maxlag") {
+		t.Errorf("got %v, want maxlag error", err)
+	}
+}
+
+func TestWebserver_Labels(t *testing.T) {
+	ws := makeTestWebserver()
+	ranks, err := readRankIndex(strings.NewReader("Entity,QRank\nQ42,100\nQ1,50\nQ7,10\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws.storage.ranks = ranks
+	ws.labels = newTestLabelCache(t, &fakeWikidataAPI{})
+
+	for _, tc := range []struct {
+		method, path, body string
+		status             int
+		want               string
+	}{
+		{"GET", "/rank/Q42?lang=en", "", 200,
+			`{"entity":"Q42","qrank":100,"rank":1,"percentile":100,"label":"Douglas Adams","description":"English author"}`},
+		{"GET", "/rank/Q7?lang=en", "", 200, `{"entity":"Q7","qrank":10,"rank":3,"percentile":33.333}`},
+		{"GET", "/rank/Q42?lang=EN!", "", 400, "bad lang"},
+		{"GET", "/top?limit=2&lang=en", "", 200,
+			`{"offset":0,"limit":2,"total":3,"entities":[{"entity":"Q42","qrank":100,"rank":1,"percentile":100,"label":"Douglas Adams","description":"English author"},{"entity":"Q1","qrank":50,"rank":2,"percentile":66.667,"label":"Universe"}]}`},
+		{"POST", "/ranks?lang=en", "Q1\nQ5\n", 200,
+			`{"ranks":[{"entity":"Q1","qrank":50,"rank":2,"percentile":66.667,"label":"Universe"}],"notFound":["Q5"]}`},
+	} {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(tc.method, tc.path, strings.NewReader(tc.body))
+		switch {
+		case strings.HasPrefix(tc.path, "/rank/"):
+			ws.HandleRank(rec, req)
+		case strings.HasPrefix(tc.path, "/top"):
+			ws.HandleTop(rec, req)
+		default:
+			ws.HandleBulkRanks(rec, req)
+		}
+		body, _ := io.ReadAll(rec.Body)
+		if rec.Code != tc.status {
+			t.Errorf("%s %s: got status %d, want %d", tc.method, tc.path, rec.Code, tc.status)
+		}
+		if got := strings.TrimSpace(string(body)); got != tc.want {
+			t.Errorf("%s %s: got %s, want %s", tc.method, tc.path, got, tc.want)
+		}
+	}
+}
+
+func TestWebserver_LabelsNotEnabled(t *testing.T) {
+	ws := makeTestWebserver()
+	ranks, err := readRankIndex(strings.NewReader("Entity,QRank\nQ42,100\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws.storage.ranks = ranks
+	rec := httptest.NewRecorder()
+	ws.HandleRank(rec, httptest.NewRequest("GET", "/rank/Q42?lang=en", nil))
+	if rec.Code != http.StatusNotImplemented {
+		t.Errorf("got status %d, want %d", rec.Code, http.StatusNotImplemented)
+	}
+}
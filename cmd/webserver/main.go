@@ -8,18 +8,35 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
-	//"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 func main() {
 	port := flag.Int("port", 0, "port for serving HTTP requests")
+	grpcPort := flag.Int("grpcPort", 0, "if set, port for serving QRank lookups over gRPC")
 	workdir := flag.String("workdir", "webserver-workdir", "path to working directory on local disk")
+	bucket := flag.String("bucket", "qrank", "name of the bucket in object storage")
+	publicPrefix := flag.String("publicPrefix", "public/", "prefix for the storage keys of published files")
+	corsOrigins := flag.String("corsOrigins", "*", "comma-separated list of origins that may call the API from browsers, or * for any origin")
+	rateLimit := flag.Float64("rateLimit", 10, "maximal sustained number of API requests per second and client; 0 for no limit")
+	rateLimitBurst := flag.Int("rateLimitBurst", 100, "maximal number of API requests that a client may send in a burst")
+	rateLimitAllow := flag.String("rateLimitAllow", defaultRateLimitAllowlist, "comma-separated list of networks that are exempt from rate limiting")
+	trustedProxies := flag.String("trustedProxies", "", "comma-separated list of networks of front proxies whose X-Forwarded-For header tells the client address for rate limiting")
+	reloadInterval := flag.Duration("reloadInterval", 30*time.Second, "how often to check storage for newly published files")
+	eventStream := flag.String("eventStream", "", "if set, follow this Wikimedia EventStreams endpoint, such as "+defaultEventStream+", to serve recent activity at /hot")
+	hotHalfLife := flag.Duration("hotHalfLife", time.Hour, "half-life of recent activity served at /hot")
+	wikidataAPI := flag.String("wikidataAPI", "", "if set, such as "+defaultWikidataAPI+", fetch labels and descriptions from this Wikidata API endpoint when clients ask for them with the lang parameter")
+	labelTTL := flag.Duration("labelTTL", 7*24*time.Hour, "how long to keep fetched labels and descriptions in the local disk cache")
 	flag.Parse()
 
 	if *port == 0 {
@@ -29,7 +46,7 @@ func main() {
 		}
 	}
 
-	storage, err := NewStorage(*workdir)
+	storage, err := NewStorage(*workdir, *bucket, *publicPrefix)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -38,13 +55,72 @@ func main() {
 		log.Fatal(err)
 	}
 
+	// Besides polling storage periodically, we reload immediately
+	// upon SIGHUP, so the release pipeline can notify us when it has
+	// published a new dataset.
 	ctx, cancel := context.WithCancel(context.Background())
-	go storage.Watch(ctx)
-	server := &Webserver{storage: storage}
-	http.HandleFunc("/", server.HandleMain)
-	http.HandleFunc("/robots.txt", server.HandleRobotsTxt)
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	trigger := make(chan struct{}, 1)
+	go func() {
+		for range sighup {
+			log.Println("Received SIGHUP, reloading")
+			select {
+			case trigger <- struct{}{}:
+			default: // a reload is already pending
+			}
+		}
+	}()
+	go storage.Watch(ctx, *reloadInterval, trigger)
+	server := &Webserver{storage: storage, corsOrigins: parseCORSOrigins(*corsOrigins)}
+	if *eventStream != "" {
+		server.hot = newHotOverlay(*hotHalfLife, defaultHotEntries)
+		go newEventStreamClient(*eventStream, storage, server.hot).Run(ctx)
+	}
+
+	if *wikidataAPI != "" {
+		server.labels = newLabelCache(*wikidataAPI, filepath.Join(*workdir, "labels"), *labelTTL)
+	}
+
+	limit := func(h http.HandlerFunc) http.HandlerFunc { return h }
+	if *rateLimit > 0 {
+		allowlist, err := parseAllowlist(*rateLimitAllow)
+		if err != nil {
+			log.Fatal(err)
+		}
+		proxies, err := parseAllowlist(*trustedProxies)
+		if err != nil {
+			log.Fatal(err)
+		}
+		limiter := newRateLimiter(*rateLimit, *rateLimitBurst, allowlist, proxies)
+		limit = limiter.limit
+	}
+
+	http.Handle("/", instrumentHandler("main", server.HandleMain))
+	http.Handle("/robots.txt", instrumentHandler("robots", server.HandleRobotsTxt))
+	http.Handle("/status", instrumentHandler("status", server.HandleStatus))
 	http.Handle("/metrics", promhttp.Handler())
-	http.HandleFunc("/download/", server.HandleDownload)
+	http.Handle("/download/", instrumentHandler("download", limit(server.HandleDownload)))
+	http.Handle("/rank", instrumentHandler("rank_by_sitelink", limit(server.HandleRankBySitelink)))
+	http.Handle("/rank/", instrumentHandler("rank", limit(server.HandleRank)))
+	http.Handle("/badge/", instrumentHandler("badge", limit(server.HandleBadge)))
+	http.Handle("/annotate", instrumentHandler("annotate", limit(server.HandleAnnotate)))
+	http.Handle("/hot", instrumentHandler("hot", limit(server.HandleHot)))
+	http.Handle("/top", instrumentHandler("top", limit(server.HandleTop)))
+	http.Handle("/history/", instrumentHandler("history", limit(server.HandleHistory)))
+	http.Handle("/tilerank/", instrumentHandler("tilerank", limit(server.HandleTileRank)))
+	http.Handle("/changes", instrumentHandler("changes", limit(server.HandleRankChanges)))
+	http.Handle("/ranks", instrumentHandler("ranks", limit(server.HandleBulkRanks)))
+	http.Handle("/openapi.json", instrumentHandler("openapi", server.HandleOpenAPI))
+	if *grpcPort != 0 {
+		lis, err := net.Listen("tcp", ":"+strconv.Itoa(*grpcPort))
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Listening for gRPC requests on port %d", *grpcPort)
+		go newGRPCServer(storage).Serve(lis)
+	}
+
 	log.Printf("Listening for HTTP requests on port %d", *port)
 	http.ListenAndServe(":"+strconv.Itoa(*port), nil)
 	cancel()
@@ -52,6 +128,15 @@ func main() {
 
 type Webserver struct {
 	storage *Storage
+
+	// Origins that may call our API from browsers; "*" allows any.
+	corsOrigins []string
+
+	// Recent activity from Wikimedia EventStreams, or nil if disabled.
+	hot *hotOverlay
+
+	// Labels and descriptions from the Wikidata API, or nil if disabled.
+	labels *labelCache
 }
 
 func (ws *Webserver) HandleMain(w http.ResponseWriter, r *http.Request) {
@@ -98,6 +183,11 @@ width="88" height="31" alt="Public Domain" style="float:left"/></p>
 </body></html>`)
 }
 
+// DownloadExposedHeaders are the response headers of /download that
+// browsers may expose to scripts. Resumable downloaders need them
+// to check whether a partial download is still current.
+const downloadExposedHeaders = "Accept-Ranges, Content-Length, Content-Range, ETag, Last-Modified"
+
 func (ws *Webserver) HandleDownload(w http.ResponseWriter, req *http.Request) {
 	if !strings.HasPrefix(req.URL.Path, "/download/") {
 		http.NotFound(w, req)
@@ -121,15 +211,21 @@ func (ws *Webserver) HandleDownload(w http.ResponseWriter, req *http.Request) {
 		// As per https://tools.ietf.org/html/rfc7232, ETag must have quotes.
 		h.Set("ETag", fmt.Sprintf(`"%s"`, c.ETag))
 		h.Set("Content-Type", c.ContentType)
-		h.Set("Access-Control-Allow-Origin", "*")
+		ws.setAllowOrigin(h, req)
+		h.Set("Access-Control-Expose-Headers", downloadExposedHeaders)
+
+		// ServeContent handles conditional requests (If-Match,
+		// If-None-Match, If-Modified-Since, If-Unmodified-Since)
+		// and byte ranges, including If-Range, so that mirrors
+		// and resumable downloaders work correctly.
 		http.ServeContent(w, req, "", c.LastModified, c)
 
 	case http.MethodOptions: // CORS pre-flight
 		h.Set("Allow", "GET, HEAD, OPTIONS")
 		h.Set("Access-Control-Allow-Methods", "GET, HEAD, OPTIONS")
 		h.Set("Access-Control-Allow-Headers", "ETag, If-Match, If-None-Match, If-Modified-Since, If-Range, Range")
-		h.Set("Access-Control-Allow-Origin", "*")
-		h.Set("Access-Control-Expose-Headers", "ETag")
+		ws.setAllowOrigin(h, req)
+		h.Set("Access-Control-Expose-Headers", downloadExposedHeaders)
 		h.Set("Access-Control-Max-Age", "86400") // 1 day
 		w.WriteHeader(http.StatusNoContent)
 
@@ -0,0 +1,78 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metrics for monitoring, exported at /metrics. To alert on stale
+// data, compare qrank_dataset_last_modified_timestamp_seconds with
+// the current time.
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "qrank_http_requests_total",
+		Help: "Number of HTTP requests, by handler, method and status code.",
+	}, []string{"handler", "code", "method"})
+
+	httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "qrank_http_request_duration_seconds",
+		Help:    "Latency of HTTP requests, by handler and method.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"handler", "method"})
+
+	datasetInfo = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "qrank_dataset_info",
+		Help: "Release of the QRank dataset being served; always 1.",
+	}, []string{"release"})
+
+	datasetLastModified = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "qrank_dataset_last_modified_timestamp_seconds",
+		Help: "Time when the QRank dataset being served was stored.",
+	})
+
+	rankIndexEntities = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "qrank_rank_index_entities",
+		Help: "Number of entities in the ranking index.",
+	})
+
+	rankIndexBytes = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "qrank_rank_index_bytes",
+		Help: "Size of the ranking index, which may be memory-mapped from disk.",
+	})
+
+	cacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "qrank_cache_lookups_total",
+		Help: "Lookups of storage objects in the local disk cache, by result (hit or miss).",
+	}, []string{"result"})
+
+	labelLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "qrank_label_lookups_total",
+		Help: "Lookups of entity labels in the local disk cache, by result (hit or miss).",
+	}, []string{"result"})
+
+	reloadFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "qrank_reload_failures_total",
+		Help: "Number of failed attempts to reload content from storage.",
+	})
+
+	lastReload = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "qrank_last_reload_timestamp_seconds",
+		Help: "Time of the last successful reload from storage.",
+	})
+)
+
+// InstrumentHandler wraps an HTTP handler so that its requests
+// get counted and timed, labeled with the given handler name.
+func instrumentHandler(name string, h http.HandlerFunc) http.Handler {
+	labels := prometheus.Labels{"handler": name}
+	return promhttp.InstrumentHandlerDuration(
+		httpRequestDuration.MustCurryWith(labels),
+		promhttp.InstrumentHandlerCounter(
+			httpRequests.MustCurryWith(labels), h))
+}
@@ -0,0 +1,43 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+func scrapeMetrics(t *testing.T) string {
+	w := httptest.NewRecorder()
+	promhttp.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	body, err := io.ReadAll(w.Result().Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+func TestInstrumentHandler(t *testing.T) {
+	h := instrumentHandler("test", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+	for i := 0; i < 2; i++ {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/test", nil))
+	}
+
+	metrics := scrapeMetrics(t)
+	for _, want := range []string{
+		`qrank_http_requests_total{code="418",handler="test",method="get"} 2`,
+		`qrank_http_request_duration_seconds_count{handler="test",method="get"} 2`,
+	} {
+		if !strings.Contains(metrics, want) {
+			t.Errorf("metrics should contain %q, got %s", want, metrics)
+		}
+	}
+}
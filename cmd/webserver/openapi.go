@@ -0,0 +1,33 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// OpenAPISpec describes our web API in OpenAPI 3 format.
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+// HandleOpenAPI serves the OpenAPI document for our web API.
+func (ws *Webserver) HandleOpenAPI(w http.ResponseWriter, req *http.Request) {
+	h := w.Header()
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+	case http.MethodOptions:
+		ws.handlePreflight(w, req, "GET, HEAD, OPTIONS")
+		return
+	default:
+		h.Set("Allow", "GET, HEAD, OPTIONS")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	ws.setAllowOrigin(h, req)
+	h.Set("Content-Type", "application/json")
+	w.Write(openAPISpec)
+}
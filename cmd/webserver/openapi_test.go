@@ -0,0 +1,43 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWebserver_OpenAPI(t *testing.T) {
+	w := httptest.NewRecorder()
+	testWebserver.HandleOpenAPI(w, httptest.NewRequest("GET", "/openapi.json", nil))
+	res := w.Result()
+	if got := res.Header.Get("Content-Type"); got != "application/json" {
+		t.Errorf(`got "Content-Type: %s", want "application/json"`, got)
+	}
+	if got := res.Header.Get("Access-Control-Allow-Origin"); got != "*" {
+		t.Errorf(`got "Access-Control-Allow-Origin: %s", want "*"`, got)
+	}
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var spec struct {
+		OpenAPI string                     `json:"openapi"`
+		Paths   map[string]json.RawMessage `json:"paths"`
+	}
+	if err := json.Unmarshal(body, &spec); err != nil {
+		t.Fatal(err)
+	}
+	if spec.OpenAPI != "3.0.3" {
+		t.Errorf("got openapi=%q, want 3.0.3", spec.OpenAPI)
+	}
+	for _, path := range []string{"/download/{file}", "/rank/{qid}", "/rank", "/ranks", "/history/{qid}", "/top", "/annotate", "/badge/{qid}.svg", "/hot", "/changes", "/tilerank/{z}/{x}/{y}"} {
+		if _, ok := spec.Paths[path]; !ok {
+			t.Errorf("OpenAPI spec should describe %s", path)
+		}
+	}
+}
@@ -0,0 +1,445 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"runtime"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// RankIndex allows looking up the QRank of individual entities.
+// To keep memory consumption low for tens of millions of entities,
+// the index is a byte array in the binary format that qrank-builder
+// publishes as qrank-index.bin; see there for a description. When
+// loaded with OpenRankIndex, the array is memory-mapped from disk,
+// so the index takes no time to load and hardly any resident memory.
+type RankIndex struct {
+	data []byte
+
+	// Number of ranked entities.
+	n int
+}
+
+var rankIndexMagic = []byte("QRIX")
+
+const (
+	rankIndexHeaderSize  = 8
+	rankIndexRankingSize = 12
+	rankIndexEntitySize  = 8
+)
+
+// RankInfo is the result of looking up an entity in a RankIndex.
+type RankInfo struct {
+	Entity     string  `json:"entity"`
+	QRank      int64   `json:"qrank"`
+	Rank       int64   `json:"rank"`
+	Percentile float64 `json:"percentile"`
+
+	// Only filled in when requested with the lang parameter.
+	Label       string `json:"label,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+// OpenRankIndex memory-maps a rank index file, such as qrank-index.bin.
+// The mapping gets released when the index becomes unreachable.
+// Because the finalizer may run as soon as the last reference to the
+// index is gone, methods that read from the mapping keep the index
+// alive with runtime.KeepAlive until they are done reading.
+func OpenRankIndex(path string) (*RankIndex, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close() // the mapping stays valid after closing
+
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if stat.Size() < rankIndexHeaderSize || stat.Size() > math.MaxInt {
+		return nil, fmt.Errorf("%s: bad size %d", path, stat.Size())
+	}
+
+	data, err := syscall.Mmap(int(f.Fd()), 0, int(stat.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, err
+	}
+	ri, err := newRankIndex(data)
+	if err != nil {
+		syscall.Munmap(data)
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	runtime.SetFinalizer(ri, func(ri *RankIndex) {
+		syscall.Munmap(ri.data)
+	})
+	return ri, nil
+}
+
+// NewRankIndex checks the header and size of a rank index.
+func newRankIndex(data []byte) (*RankIndex, error) {
+	if len(data) < rankIndexHeaderSize || !bytes.Equal(data[0:4], rankIndexMagic) {
+		return nil, fmt.Errorf("not a rank index")
+	}
+	n := int(binary.BigEndian.Uint32(data[4:8]))
+	size := rankIndexHeaderSize + n*(rankIndexRankingSize+rankIndexEntitySize)
+	if len(data) != size {
+		return nil, fmt.Errorf("expected %d bytes for %d entities, got %d", size, n, len(data))
+	}
+	return &RankIndex{data: data, n: n}, nil
+}
+
+// ReadRankIndex builds a RankIndex from a QRank file, such as
+// qrank.csv.gz. Lines must be sorted by decreasing QRank,
+// as they are in the published files. Unlike OpenRankIndex, this
+// parses the entire file and keeps the index in memory; we only
+// do this for releases without a published qrank-index.bin.
+func ReadRankIndex(path string) (*RankIndex, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return readRankIndex(r)
+}
+
+func readRankIndex(r io.Reader) (*RankIndex, error) {
+	scanner := bufio.NewScanner(r)
+	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("missing header")
+	}
+	if header := scanner.Text(); header != "Entity,QRank" {
+		return nil, fmt.Errorf(`expected header "Entity,QRank", got %q`, header)
+	}
+
+	data := make([]byte, rankIndexHeaderSize, 1024)
+	copy(data, rankIndexMagic)
+	var rec [rankIndexRankingSize]byte
+	for scanner.Scan() {
+		line := scanner.Text()
+		entity, score, ok := parseRankLine(line)
+		if !ok || score < 0 {
+			return nil, fmt.Errorf("bad line: %q", line)
+		}
+		binary.BigEndian.PutUint32(rec[0:4], entity)
+		binary.BigEndian.PutUint64(rec[4:12], uint64(score))
+		data = append(data, rec[:]...)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	n := (len(data) - rankIndexHeaderSize) / rankIndexRankingSize
+	binary.BigEndian.PutUint32(data[4:8], uint32(n))
+
+	// Sort entity IDs so we can do binary search, keeping track
+	// of the position of each entity in the ranking.
+	ri := &RankIndex{data: data, n: n}
+	order := make([]uint32, n)
+	for i := range order {
+		order[i] = uint32(i)
+	}
+	slices.SortFunc(order, func(a, b uint32) int {
+		ea, _ := ri.ranking(int(a))
+		eb, _ := ri.ranking(int(b))
+		return cmp.Compare(ea, eb)
+	})
+	data = slices.Grow(data, n*rankIndexEntitySize)
+	var erec [rankIndexEntitySize]byte
+	for _, pos := range order {
+		entity, _ := ri.ranking(int(pos))
+		binary.BigEndian.PutUint32(erec[0:4], entity)
+		binary.BigEndian.PutUint32(erec[4:8], pos)
+		data = append(data, erec[:]...)
+	}
+	return newRankIndex(data)
+}
+
+func parseRankLine(line string) (uint32, int64, bool) {
+	qid, s, ok := strings.Cut(line, ",")
+	if !ok {
+		return 0, 0, false
+	}
+	entity, ok := parseEntityID(qid)
+	if !ok {
+		return 0, 0, false
+	}
+	score, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	return entity, score, true
+}
+
+// ParseEntityID parses a Wikidata ID such as "Q42".
+func parseEntityID(qid string) (uint32, bool) {
+	if len(qid) < 2 || qid[0] != 'Q' || qid[1] == '0' {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(qid[1:], 10, 32)
+	if err != nil {
+		return 0, false
+	}
+	return uint32(n), true
+}
+
+// Len returns the number of ranked entities in the index.
+func (ri *RankIndex) Len() int {
+	return ri.n
+}
+
+// SizeBytes returns the size of the index. For memory-mapped indexes,
+// only the pages that actually get accessed are held in memory.
+func (ri *RankIndex) SizeBytes() int64 {
+	return int64(len(ri.data))
+}
+
+// Ranking returns the entity and score at a position in the ranking.
+func (ri *RankIndex) ranking(pos int) (uint32, int64) {
+	off := rankIndexHeaderSize + pos*rankIndexRankingSize
+	rec := ri.data[off : off+rankIndexRankingSize]
+	entity, score := binary.BigEndian.Uint32(rec[0:4]), int64(binary.BigEndian.Uint64(rec[4:12]))
+	runtime.KeepAlive(ri)
+	return entity, score
+}
+
+// EntityRecord returns the i-th entity record, in order of entity ID.
+func (ri *RankIndex) entityRecord(i int) (uint32, uint32) {
+	off := rankIndexHeaderSize + ri.n*rankIndexRankingSize + i*rankIndexEntitySize
+	rec := ri.data[off : off+rankIndexEntitySize]
+	entity, pos := binary.BigEndian.Uint32(rec[0:4]), binary.BigEndian.Uint32(rec[4:8])
+	runtime.KeepAlive(ri)
+	return entity, pos
+}
+
+// Top returns the n highest-ranked entities.
+func (ri *RankIndex) Top(n int) []RankInfo {
+	return ri.Range(0, n)
+}
+
+// Range returns up to limit entities in ranking order, starting
+// at position offset. Zero is the position of the highest-ranked
+// entity.
+func (ri *RankIndex) Range(offset, limit int) []RankInfo {
+	start := min(offset, ri.n)
+	end := min(start+limit, ri.n)
+	result := make([]RankInfo, 0, end-start)
+	for pos := start; pos < end; pos++ {
+		entity, _ := ri.ranking(pos)
+		result = append(result, ri.info(entity, pos))
+	}
+	return result
+}
+
+// Lookup finds the ranking of an entity.
+func (ri *RankIndex) Lookup(entity uint32) (RankInfo, bool) {
+	i := sort.Search(ri.n, func(i int) bool {
+		e, _ := ri.entityRecord(i)
+		return e >= entity
+	})
+	if i >= ri.n {
+		return RankInfo{}, false
+	}
+	e, pos := ri.entityRecord(i)
+	if e != entity {
+		return RankInfo{}, false
+	}
+	return ri.info(entity, int(pos)), true
+}
+
+func (ri *RankIndex) info(entity uint32, pos int) RankInfo {
+	_, score := ri.ranking(pos)
+	n := float64(ri.n)
+	percentile := 100.0 * (n - float64(pos)) / n
+	return RankInfo{
+		Entity:     fmt.Sprintf("Q%d", entity),
+		QRank:      score,
+		Rank:       int64(pos) + 1,
+		Percentile: math.Round(percentile*1000) / 1000,
+	}
+}
+
+// HandleRank serves the ranking of a single Wikidata entity.
+// For example, a request for /rank/Q42 returns a JSON object with
+// the QRank score of Q42, its position in the ranking, and the
+// percentage of ranked entities that are not ranked higher.
+func (ws *Webserver) HandleRank(w http.ResponseWriter, req *http.Request) {
+	h := w.Header()
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+	case http.MethodOptions:
+		ws.handlePreflight(w, req, "GET, HEAD, OPTIONS")
+		return
+	default:
+		h.Set("Allow", "GET, HEAD, OPTIONS")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	ws.setAllowOrigin(h, req)
+
+	qid := strings.TrimPrefix(req.URL.Path, "/rank/")
+	entity, ok := parseEntityID(qid)
+	if !ok {
+		http.Error(w, "bad Wikidata ID", http.StatusBadRequest)
+		return
+	}
+
+	ranks := ws.storage.Ranks()
+	if ranks == nil {
+		http.Error(w, "ranking not loaded yet", http.StatusServiceUnavailable)
+		return
+	}
+
+	ws.writeRankInfo(w, req, ranks, entity)
+}
+
+// WriteRankInfo sends the ranking of an entity as a JSON response.
+func (ws *Webserver) writeRankInfo(w http.ResponseWriter, req *http.Request, ranks *RankIndex, entity uint32) {
+	lang, ok := ws.labelLanguage(w, req)
+	if !ok {
+		return
+	}
+	info, found := ranks.Lookup(entity)
+	if !found {
+		http.NotFound(w, req)
+		return
+	}
+	infos := []RankInfo{info}
+	ws.addLabels(lang, infos)
+	info = infos[0]
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
+
+// MaxBulkEntities is the maximal number of entities that can be
+// looked up with a single request to /ranks.
+const maxBulkEntities = 10000
+
+// BulkRanks is the response to a bulk lookup. Entities that are
+// not ranked are listed in NotFound, in the order of the request.
+type BulkRanks struct {
+	Ranks    []RankInfo `json:"ranks"`
+	NotFound []string   `json:"notFound"`
+}
+
+// HandleBulkRanks looks up the ranking of many entities at once.
+// Clients send a POST request whose body is either a JSON array
+// of Wikidata IDs (with Content-Type: application/json),
+// or a plain-text list with one ID per line.
+func (ws *Webserver) HandleBulkRanks(w http.ResponseWriter, req *http.Request) {
+	h := w.Header()
+	switch req.Method {
+	case http.MethodPost:
+	case http.MethodOptions:
+		ws.handlePreflight(w, req, "POST, OPTIONS")
+		return
+	default:
+		h.Set("Allow", "POST, OPTIONS")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	ws.setAllowOrigin(h, req)
+
+	// Wikidata IDs are short, so 1 MiB is plenty for maxBulkEntities.
+	body := http.MaxBytesReader(w, req.Body, 1024*1024)
+	qids, err := readBulkRequest(body, req.Header.Get("Content-Type"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(qids) > maxBulkEntities {
+		msg := fmt.Sprintf("too many entities, limit is %d", maxBulkEntities)
+		http.Error(w, msg, http.StatusRequestEntityTooLarge)
+		return
+	}
+	lang, ok := ws.labelLanguage(w, req)
+	if !ok {
+		return
+	}
+	if lang != "" && len(qids) > maxLabeledEntities {
+		msg := fmt.Sprintf("too many entities for lang, limit is %d", maxLabeledEntities)
+		http.Error(w, msg, http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	entities := make([]uint32, 0, len(qids))
+	for _, qid := range qids {
+		entity, ok := parseEntityID(qid)
+		if !ok {
+			http.Error(w, fmt.Sprintf("bad Wikidata ID: %q", qid), http.StatusBadRequest)
+			return
+		}
+		entities = append(entities, entity)
+	}
+
+	ranks := ws.storage.Ranks()
+	if ranks == nil {
+		http.Error(w, "ranking not loaded yet", http.StatusServiceUnavailable)
+		return
+	}
+
+	result := BulkRanks{
+		Ranks:    make([]RankInfo, 0, len(entities)),
+		NotFound: make([]string, 0),
+	}
+	for i, entity := range entities {
+		if info, found := ranks.Lookup(entity); found {
+			result.Ranks = append(result.Ranks, info)
+		} else {
+			result.NotFound = append(result.NotFound, qids[i])
+		}
+	}
+	ws.addLabels(lang, result.Ranks)
+
+	h.Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// ReadBulkRequest parses the body of a request to /ranks.
+func readBulkRequest(r io.Reader, contentType string) ([]string, error) {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	if strings.TrimSpace(mediaType) == "application/json" {
+		var qids []string
+		if err := json.NewDecoder(r).Decode(&qids); err != nil {
+			return nil, err
+		}
+		return qids, nil
+	}
+
+	qids := make([]string, 0, 100)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if qid := strings.TrimSpace(scanner.Text()); qid != "" {
+			qids = append(qids, qid)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return qids, nil
+}
@@ -0,0 +1,234 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadRankIndex(t *testing.T) {
+	ri, err := readRankIndex(strings.NewReader(
+		"Entity,QRank\nQ64,900\nQ1,800\nQ72,70\nQ42,5\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ri.Len() != 4 {
+		t.Errorf("got Len()=%d, want 4", ri.Len())
+	}
+	if got := ri.SizeBytes(); got < 4*16 {
+		t.Errorf("got SizeBytes()=%d, want at least %d", got, 4*16)
+	}
+
+	for _, tc := range []struct {
+		entity uint32
+		want   RankInfo
+	}{
+		{64, RankInfo{Entity: "Q64", QRank: 900, Rank: 1, Percentile: 100}},
+		{1, RankInfo{Entity: "Q1", QRank: 800, Rank: 2, Percentile: 75}},
+		{42, RankInfo{Entity: "Q42", QRank: 5, Rank: 4, Percentile: 25}},
+	} {
+		got, ok := ri.Lookup(tc.entity)
+		if !ok {
+			t.Errorf("Lookup(%d) failed", tc.entity)
+		} else if got != tc.want {
+			t.Errorf("Lookup(%d): got %v, want %v", tc.entity, got, tc.want)
+		}
+	}
+
+	top := ri.Top(2)
+	if len(top) != 2 || top[0].Entity != "Q64" || top[1].Entity != "Q1" {
+		t.Errorf("Top(2): got %v", top)
+	}
+	if got := len(ri.Top(10)); got != 4 {
+		t.Errorf("Top(10): got %d entities, want 4", got)
+	}
+
+	if got, ok := ri.Lookup(2); ok {
+		t.Errorf("Lookup(2): got %v, want not found", got)
+	}
+}
+
+func TestReadRankIndex_BadInput(t *testing.T) {
+	for _, s := range []string{
+		"",
+		"Foo,Bar\nQ1,2\n",
+		"Entity,QRank\nQ1\n",
+		"Entity,QRank\nP1,2\n",
+		"Entity,QRank\nQ1,x\n",
+	} {
+		if _, err := readRankIndex(strings.NewReader(s)); err == nil {
+			t.Errorf("expected error for %q", s)
+		}
+	}
+}
+
+func TestParseEntityID(t *testing.T) {
+	for _, tc := range []struct {
+		qid  string
+		want uint32
+		ok   bool
+	}{
+		{"Q42", 42, true},
+		{"Q1", 1, true},
+		{"Q", 0, false},
+		{"Q042", 0, false},
+		{"q42", 0, false},
+		{"L42", 0, false},
+		{"Q-1", 0, false},
+		{"Q99999999999", 0, false},
+	} {
+		got, ok := parseEntityID(tc.qid)
+		if got != tc.want || ok != tc.ok {
+			t.Errorf("parseEntityID(%q): got (%d, %v), want (%d, %v)",
+				tc.qid, got, ok, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestWebserver_Rank(t *testing.T) {
+	ws := makeTestWebserver()
+	ri, err := readRankIndex(strings.NewReader("Entity,QRank\nQ64,900\nQ42,5\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws.storage.ranks = ri
+
+	for _, tc := range []struct {
+		method, path string
+		status       int
+		body         string
+	}{
+		{"GET", "/rank/Q42", http.StatusOK,
+			`{"entity":"Q42","qrank":5,"rank":2,"percentile":50}` + "\n"},
+		{"GET", "/rank/Q7", http.StatusNotFound, "404 page not found\n"},
+		{"GET", "/rank/foo", http.StatusBadRequest, "bad Wikidata ID\n"},
+		{"POST", "/rank/Q42", http.StatusMethodNotAllowed, ""},
+	} {
+		req := httptest.NewRequest(tc.method, tc.path, nil)
+		w := httptest.NewRecorder()
+		ws.HandleRank(w, req)
+		res := w.Result()
+		body, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != tc.status {
+			t.Errorf("%s %s: got status %d, want %d", tc.method, tc.path, res.StatusCode, tc.status)
+		}
+		if string(body) != tc.body {
+			t.Errorf("%s %s: got %q, want %q", tc.method, tc.path, body, tc.body)
+		}
+	}
+}
+
+func TestWebserver_RankNotLoaded(t *testing.T) {
+	ws := makeTestWebserver()
+	req := httptest.NewRequest("GET", "/rank/Q42", nil)
+	w := httptest.NewRecorder()
+	ws.HandleRank(w, req)
+	if got := w.Result().StatusCode; got != http.StatusServiceUnavailable {
+		t.Errorf("got status %d, want %d", got, http.StatusServiceUnavailable)
+	}
+}
+
+func TestWebserver_BulkRanks(t *testing.T) {
+	ws := makeTestWebserver()
+	ri, err := readRankIndex(strings.NewReader("Entity,QRank\nQ64,900\nQ42,5\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws.storage.ranks = ri
+
+	tooMany := strings.Repeat("Q1\n", maxBulkEntities+1)
+	for _, tc := range []struct {
+		method, contentType, body string
+		status                    int
+		want                      string
+	}{
+		{"POST", "application/json", `["Q42", "Q7", "Q64"]`, http.StatusOK,
+			`{"ranks":[{"entity":"Q42","qrank":5,"rank":2,"percentile":50},` +
+				`{"entity":"Q64","qrank":900,"rank":1,"percentile":100}],"notFound":["Q7"]}` + "\n"},
+		{"POST", "text/plain; charset=utf-8", "Q64\n\nQ42\n", http.StatusOK,
+			`{"ranks":[{"entity":"Q64","qrank":900,"rank":1,"percentile":100},` +
+				`{"entity":"Q42","qrank":5,"rank":2,"percentile":50}],"notFound":[]}` + "\n"},
+		{"POST", "application/json", `["Q42", "foo"]`, http.StatusBadRequest,
+			`bad Wikidata ID: "foo"` + "\n"},
+		{"POST", "application/json", `{"Q42": 1}`, http.StatusBadRequest, ""},
+		{"POST", "text/plain", tooMany, http.StatusRequestEntityTooLarge,
+			"too many entities, limit is 10000\n"},
+		{"GET", "", "", http.StatusMethodNotAllowed, ""},
+	} {
+		req := httptest.NewRequest(tc.method, "/ranks", strings.NewReader(tc.body))
+		if tc.contentType != "" {
+			req.Header.Set("Content-Type", tc.contentType)
+		}
+		w := httptest.NewRecorder()
+		ws.HandleBulkRanks(w, req)
+		res := w.Result()
+		body, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != tc.status {
+			t.Errorf("%s %q: got status %d, want %d", tc.method, tc.body, res.StatusCode, tc.status)
+		}
+		if tc.want != "" && string(body) != tc.want {
+			t.Errorf("%s %q: got %q, want %q", tc.method, tc.body, body, tc.want)
+		}
+	}
+}
+
+func TestOpenRankIndex(t *testing.T) {
+	mem, err := readRankIndex(strings.NewReader(
+		"Entity,QRank\nQ64,900\nQ1,800\nQ72,70\nQ42,5\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "qrank-index.bin")
+	if err := os.WriteFile(path, mem.data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ri, err := OpenRankIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ri.Len() != 4 {
+		t.Errorf("got Len()=%d, want 4", ri.Len())
+	}
+	for _, entity := range []uint32{1, 2, 42, 64, 72, 100} {
+		got, gotOK := ri.Lookup(entity)
+		want, wantOK := mem.Lookup(entity)
+		if got != want || gotOK != wantOK {
+			t.Errorf("Lookup(%d): got %v, %v; want %v, %v", entity, got, gotOK, want, wantOK)
+		}
+	}
+	if got, want := ri.Range(1, 2), mem.Range(1, 2); !reflect.DeepEqual(got, want) {
+		t.Errorf("Range(1, 2): got %v, want %v", got, want)
+	}
+}
+
+func TestOpenRankIndex_BadInput(t *testing.T) {
+	for _, data := range []string{
+		"",
+		"QRBF\x00\x00\x00\x00",
+		"QRIX\x00\x00\x00\x01",
+		"QRIX\x00\x00\x00\x00extra",
+	} {
+		path := filepath.Join(t.TempDir(), "qrank-index.bin")
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := OpenRankIndex(path); err == nil {
+			t.Errorf("OpenRankIndex(%q): want error", data)
+		}
+	}
+}
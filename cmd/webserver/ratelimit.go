@@ -0,0 +1,188 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultRateLimitAllowlist are the networks whose clients are exempt
+// from rate limiting. By default, this is only loopback. On Toolforge,
+// every request arrives from the front proxy in a private range, so
+// exempting private ranges would exempt everyone whenever the proxy
+// is not listed in -trustedProxies.
+const defaultRateLimitAllowlist = "127.0.0.0/8,::1/128"
+
+// RateLimiter limits the request rate of each client with a token
+// bucket. Buckets start full and get refilled continuously; each request
+// takes one token. When a client's bucket is empty, it gets an HTTP 429
+// response until its bucket has been refilled.
+type rateLimiter struct {
+	rate      float64 // tokens per second
+	burst     float64 // bucket capacity
+	allowlist []netip.Prefix
+	proxies   []netip.Prefix
+	now       func() time.Time
+
+	mutex   sync.Mutex
+	clients map[netip.Addr]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Beyond this number of clients, we forget clients whose buckets have
+// been refilled completely, since they are not distinguishable from
+// clients we have never seen.
+const maxRateLimitClients = 10000
+
+// NewRateLimiter sets up a rate limiter. For requests that come from
+// one of the trusted proxies, such as the front proxy of Wikimedia
+// Toolforge, the client address is taken from the X-Forwarded-For
+// header. Other clients could forge that header to evade the limit,
+// so for them we use the address of the connection.
+func newRateLimiter(rate float64, burst int, allowlist []netip.Prefix, proxies []netip.Prefix) *rateLimiter {
+	return &rateLimiter{
+		rate:      rate,
+		burst:     float64(burst),
+		allowlist: allowlist,
+		proxies:   proxies,
+		now:       time.Now,
+		clients:   make(map[netip.Addr]*tokenBucket, 100),
+	}
+}
+
+// ParseAllowlist parses a comma-separated list of networks in CIDR
+// notation, such as "10.0.0.0/8,2620:0:860::/46".
+func parseAllowlist(s string) ([]netip.Prefix, error) {
+	result := make([]netip.Prefix, 0, 8)
+	for _, p := range strings.Split(s, ",") {
+		if p = strings.TrimSpace(p); p == "" {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(p)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, prefix.Masked())
+	}
+	return result, nil
+}
+
+// Allow takes a token from the bucket of a client. If the bucket
+// is empty, the result tells how long the client should wait.
+func (rl *rateLimiter) allow(client netip.Addr) (bool, time.Duration) {
+	if containsAddr(rl.allowlist, client) {
+		return true, 0
+	}
+
+	// An IPv6 client typically gets an entire /64 network, so it
+	// could pick a fresh address for every request. Therefore, all
+	// addresses in the same /64 share one bucket.
+	key := client
+	if client.Is6() {
+		key = netip.PrefixFrom(client, 64).Masked().Addr()
+	}
+
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	now := rl.now()
+	b, ok := rl.clients[key]
+	if !ok {
+		if len(rl.clients) >= maxRateLimitClients {
+			rl.prune(now)
+		}
+		b = &tokenBucket{tokens: rl.burst, last: now}
+		rl.clients[key] = b
+	}
+
+	elapsed := now.Sub(b.last).Seconds()
+	b.tokens = math.Min(rl.burst, b.tokens+elapsed*rl.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens -= 1
+		return true, 0
+	}
+
+	wait := (1 - b.tokens) / rl.rate
+	return false, time.Duration(wait * float64(time.Second))
+}
+
+// Prune forgets clients whose buckets would be full by now.
+// Caller must hold the mutex.
+func (rl *rateLimiter) prune(now time.Time) {
+	for addr, b := range rl.clients {
+		if b.tokens+now.Sub(b.last).Seconds()*rl.rate >= rl.burst {
+			delete(rl.clients, addr)
+		}
+	}
+}
+
+// ClientAddr returns the network address of the client that sent
+// a request, or false if it cannot be determined.
+func (rl *rateLimiter) clientAddr(req *http.Request) (netip.Addr, bool) {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	addr = addr.Unmap()
+
+	if containsAddr(rl.proxies, addr) {
+		// Proxies append to X-Forwarded-For, so the last entry
+		// has been added by our own front proxy. Earlier entries
+		// come from the client and could be forged.
+		if fwd := req.Header.Values("X-Forwarded-For"); len(fwd) > 0 {
+			hops := strings.Split(fwd[len(fwd)-1], ",")
+			last := strings.TrimSpace(hops[len(hops)-1])
+			if client, err := netip.ParseAddr(last); err == nil {
+				return client.Unmap(), true
+			}
+		}
+	}
+	return addr, true
+}
+
+// ContainsAddr tells whether any of a list of networks contains
+// an address.
+func containsAddr(networks []netip.Prefix, addr netip.Addr) bool {
+	for _, p := range networks {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Limit wraps an HTTP handler so that clients exceeding their
+// request rate get an HTTP 429 (Too Many Requests) response.
+func (rl *rateLimiter) limit(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		client, ok := rl.clientAddr(req)
+		if ok {
+			if allowed, wait := rl.allow(client); !allowed {
+				secs := max(int(math.Ceil(wait.Seconds())), 1)
+				w.Header().Set("Retry-After", strconv.Itoa(secs))
+				msg := fmt.Sprintf("too many requests, retry after %d seconds", secs)
+				http.Error(w, msg, http.StatusTooManyRequests)
+				return
+			}
+		}
+		h(w, req)
+	}
+}
@@ -0,0 +1,163 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter_Allow(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	rl := newRateLimiter(2, 3, nil, nil)
+	rl.now = func() time.Time { return now }
+	client := netip.MustParseAddr("192.0.2.1")
+
+	// The bucket starts full, so the first three requests are fine.
+	for i := 0; i < 3; i++ {
+		if ok, _ := rl.allow(client); !ok {
+			t.Fatalf("request %d should be allowed", i+1)
+		}
+	}
+	ok, wait := rl.allow(client)
+	if ok {
+		t.Fatal("fourth request should be rejected")
+	}
+	if wait != 500*time.Millisecond {
+		t.Errorf("got wait=%v, want 500ms", wait)
+	}
+
+	// Other clients are not affected.
+	if ok, _ := rl.allow(netip.MustParseAddr("192.0.2.2")); !ok {
+		t.Error("request from other client should be allowed")
+	}
+
+	// After half a second, one token has been refilled.
+	now = now.Add(500 * time.Millisecond)
+	if ok, _ := rl.allow(client); !ok {
+		t.Error("request should be allowed after refill")
+	}
+	if ok, _ := rl.allow(client); ok {
+		t.Error("request should be rejected after using refilled token")
+	}
+}
+
+func TestRateLimiter_IPv6(t *testing.T) {
+	rl := newRateLimiter(1, 1, nil, nil)
+	if ok, _ := rl.allow(netip.MustParseAddr("2001:db8:1:2::1")); !ok {
+		t.Fatal("first request should be allowed")
+	}
+	if ok, _ := rl.allow(netip.MustParseAddr("2001:db8:1:2::2")); ok {
+		t.Error("request from same /64 network should be rejected")
+	}
+	if ok, _ := rl.allow(netip.MustParseAddr("2001:db8:1:3::1")); !ok {
+		t.Error("request from other /64 network should be allowed")
+	}
+}
+
+func TestRateLimiter_Allowlist(t *testing.T) {
+	allowlist, err := parseAllowlist(defaultRateLimitAllowlist)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rl := newRateLimiter(1, 1, allowlist, nil)
+	for _, addr := range []string{"127.0.0.1", "::1"} {
+		client := netip.MustParseAddr(addr)
+		for i := 0; i < 5; i++ {
+			if ok, _ := rl.allow(client); !ok {
+				t.Errorf("%s should be exempt from rate limiting", addr)
+				break
+			}
+		}
+	}
+
+	// Without -trustedProxies, requests forwarded by the front proxy
+	// of Toolforge come from a private address, so private ranges
+	// must not be exempt by default.
+	for _, addr := range []string{"10.1.2.3", "172.16.5.6"} {
+		client := netip.MustParseAddr(addr)
+		rl.allow(client)
+		if ok, _ := rl.allow(client); ok {
+			t.Errorf("%s should be rate limited", addr)
+		}
+	}
+}
+
+func TestParseAllowlist(t *testing.T) {
+	got, err := parseAllowlist(" 10.1.2.3/8, ,2620:0:860::/46")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0].String() != "10.0.0.0/8" || got[1].String() != "2620:0:860::/46" {
+		t.Errorf("got %v", got)
+	}
+	if _, err := parseAllowlist("10.0.0.0"); err == nil {
+		t.Error("expected error for address without prefix length")
+	}
+}
+
+func TestRateLimiter_Prune(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	rl := newRateLimiter(1, 1, nil, nil)
+	rl.now = func() time.Time { return now }
+	idle := netip.MustParseAddr("192.0.2.1")
+	rl.allow(idle)
+	now = now.Add(time.Minute)
+	rl.prune(now)
+	if _, found := rl.clients[idle]; found {
+		t.Error("prune() should forget idle clients")
+	}
+}
+
+func TestRateLimiter_ClientAddr(t *testing.T) {
+	proxies := []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")}
+	for _, tc := range []struct {
+		remoteAddr string
+		forwarded  string
+		want       string
+	}{
+		{"192.0.2.1:1234", "", "192.0.2.1"},
+		{"192.0.2.1:1234", "203.0.113.9, 198.51.100.7", "198.51.100.7"},
+		{"192.0.2.1:1234", "garbage", "192.0.2.1"},
+		{"198.51.100.3:1234", "203.0.113.9", "198.51.100.3"}, // not a trusted proxy
+		{"[2001:db8::1]:80", "203.0.113.9", "2001:db8::1"},
+	} {
+		rl := newRateLimiter(1, 1, nil, proxies)
+		req := httptest.NewRequest("GET", "/rank/Q42", nil)
+		req.RemoteAddr = tc.remoteAddr
+		if tc.forwarded != "" {
+			req.Header.Set("X-Forwarded-For", tc.forwarded)
+		}
+		got, ok := rl.clientAddr(req)
+		if !ok || got.String() != tc.want {
+			t.Errorf("%+v: got %v, %v; want %s", tc, got, ok, tc.want)
+		}
+	}
+}
+
+func TestRateLimiter_Limit(t *testing.T) {
+	rl := newRateLimiter(0.1, 1, nil, nil)
+	h := rl.limit(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	for i, want := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		req := httptest.NewRequest("GET", "/rank/Q42", nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		w := httptest.NewRecorder()
+		h(w, req)
+		res := w.Result()
+		if res.StatusCode != want {
+			t.Errorf("request %d: got status %d, want %d", i+1, res.StatusCode, want)
+		}
+		if want == http.StatusTooManyRequests {
+			if got := res.Header.Get("Retry-After"); got != "10" {
+				t.Errorf(`got "Retry-After: %s", want "10"`, got)
+			}
+		}
+	}
+}
@@ -0,0 +1,172 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+// SitelinkIndex maps Wikimedia page titles to Wikidata entities.
+// The index is a sorted text file on local disk, with lines such as
+// "en.wikipedia/berlin Q64", as published by qrank-builder. Since there
+// are about 100 million sitelinks, we do not load the file into memory
+// but look up titles by binary search on disk.
+type SitelinkIndex struct {
+	*sortedFile
+}
+
+// OpenSitelinkIndex opens a decompressed sitelinks file for lookups.
+func OpenSitelinkIndex(path string) (*SitelinkIndex, error) {
+	sf, err := openSortedFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return &SitelinkIndex{sf}, nil
+}
+
+// Lookup finds the entity for a sitelink key, such as "en.wikipedia/berlin".
+// It is safe to call Lookup from multiple goroutines at the same time.
+func (si *SitelinkIndex) Lookup(key string) (uint32, bool, error) {
+	prefix := key + " "
+	line, err := si.search(func(line []byte) bool {
+		return string(line) >= prefix
+	})
+	if err != nil || line == nil {
+		return 0, false, err
+	}
+	qid, found := strings.CutPrefix(string(line), prefix)
+	if !found {
+		return 0, false, nil
+	}
+	entity, ok := parseEntityID(qid)
+	return entity, ok, nil
+}
+
+// Caser is stateless and safe to use concurrently by multiple goroutines.
+var caser = cases.Fold()
+
+// SitelinkKey converts a Wikidata site ID, such as "enwiki", and a page
+// title into the key used in the sitelinks file, such as "en.wikipedia/berlin".
+// This must match the normalization in formatLine() of qrank-builder.
+func sitelinkKey(site, title string) (string, bool) {
+	wikiPos := strings.Index(site, "wiki")
+	if wikiPos < 0 || title == "" {
+		return "", false
+	}
+	lang, project := site[:wikiPos], site[wikiPos:]
+	if project == "wiki" {
+		project = "wikipedia"
+	}
+
+	switch lang {
+	case "":
+		lang = "und"
+		switch project {
+		case "wikidatawiki":
+			project = "wikidata"
+		case "wikimaniawiki":
+			project = "wikimania"
+		}
+	case "als":
+		lang = "gsw"
+	case "bat_smg", "bat-smg":
+		lang = "sgs"
+	case "be_x_old":
+		lang = "be-tarask"
+	case "cbk_zam", "cbk-zam":
+		lang = "cbk-x-zam"
+	case "commons":
+		lang, project = "und", "commons"
+	case "fiu_vro", "fiu-vro":
+		lang = "vro"
+	case "map_bms", "map-bms":
+		lang = "jv-x-bms"
+	case "media":
+		lang, project = "und", "mediawiki"
+	case "meta":
+		lang, project = "und", "metawiki"
+	case "nds_nl", "nds-nl":
+		lang = "nds-NL"
+	case "roa_rup", "roa-rup":
+		lang = "rup"
+	case "roa_tara", "roa-tara":
+		lang = "nap-x-tara"
+	case "simple":
+		lang = "en-x-simple"
+	case "sources":
+		lang, project = "und", "wikisource"
+	case "species":
+		lang, project = "und", "wikispecies"
+	case "zh_classical", "zh-classical":
+		lang = "lzh"
+	case "zh_min_nan", "zh-min-nan":
+		lang = "nan"
+	case "zh_yue", "zh-yue":
+		lang = "yue"
+	}
+
+	var buf strings.Builder
+	buf.WriteString(lang)
+	buf.WriteByte('.')
+	buf.WriteString(project)
+	buf.WriteByte('/')
+	var it norm.Iter
+	it.InitString(norm.NFC, caser.String(title))
+	for !it.Done() {
+		c := it.Next()
+		if c[0] > 0x20 {
+			buf.Write(c)
+		} else {
+			buf.WriteByte('_')
+		}
+	}
+	return buf.String(), true
+}
+
+// HandleRankBySitelink serves the ranking of the Wikidata entity
+// for a page title, such as /rank?site=enwiki&title=Berlin.
+func (ws *Webserver) HandleRankBySitelink(w http.ResponseWriter, req *http.Request) {
+	h := w.Header()
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+	case http.MethodOptions:
+		ws.handlePreflight(w, req, "GET, HEAD, OPTIONS")
+		return
+	default:
+		h.Set("Allow", "GET, HEAD, OPTIONS")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	ws.setAllowOrigin(h, req)
+
+	query := req.URL.Query()
+	key, ok := sitelinkKey(query.Get("site"), query.Get("title"))
+	if !ok {
+		http.Error(w, "bad site or title", http.StatusBadRequest)
+		return
+	}
+
+	sitelinks := ws.storage.Sitelinks()
+	ranks := ws.storage.Ranks()
+	if sitelinks == nil || ranks == nil {
+		http.Error(w, "ranking not loaded yet", http.StatusServiceUnavailable)
+		return
+	}
+
+	entity, found, err := sitelinks.Lookup(key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.NotFound(w, req)
+		return
+	}
+
+	ws.writeRankInfo(w, req, ranks, entity)
+}
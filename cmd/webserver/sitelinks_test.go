@@ -0,0 +1,150 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+)
+
+func TestSitelinkKey(t *testing.T) {
+	for _, tc := range []struct{ site, title, want string }{
+		{"enwiki", "Berlin", "en.wikipedia/berlin"},
+		{"enwiki", "Douglas Adams", "en.wikipedia/douglas_adams"},
+		{"dewikivoyage", "Zürich", "de.wikivoyage/zürich"},
+		{"simplewikinews", "Impala", "en-x-simple.wikinews/impala"},
+		{"be_x_oldwiki", "Імпала", "be-tarask.wikipedia/імпала"},
+		{"commonswiki", "Aepyceros melampus", "und.commons/aepyceros_melampus"},
+		{"specieswiki", "Aepyceros melampus", "und.wikispecies/aepyceros_melampus"},
+		{"wikidatawiki", "Project chat", "und.wikidata/project_chat"},
+		{"zh_min_nanwiki", "Impala", "nan.wikipedia/impala"},
+	} {
+		got, ok := sitelinkKey(tc.site, tc.title)
+		if !ok || got != tc.want {
+			t.Errorf("sitelinkKey(%q, %q): got %q, %v; want %q", tc.site, tc.title, got, ok, tc.want)
+		}
+	}
+
+	for _, tc := range []struct{ site, title string }{
+		{"en", "Berlin"},
+		{"enwiki", ""},
+		{"", "Berlin"},
+	} {
+		if got, ok := sitelinkKey(tc.site, tc.title); ok {
+			t.Errorf("sitelinkKey(%q, %q): got %q, want failure", tc.site, tc.title, got)
+		}
+	}
+}
+
+func writeTestSitelinks(t *testing.T, lines ...string) string {
+	path := filepath.Join(t.TempDir(), "sitelinks.txt.br")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := brotli.NewWriter(f)
+	for _, line := range lines {
+		if _, err := w.Write([]byte(line + "\n")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func openTestSitelinks(t *testing.T) *SitelinkIndex {
+	src := writeTestSitelinks(t,
+		"de.wikipedia/berlin Q64",
+		"en.wikipedia/berlin Q64",
+		"en.wikipedia/berlin_wall Q5086",
+		"en.wikipedia/douglas_adams Q42",
+		"und.wikispecies/aepyceros_melampus Q132576",
+	)
+	dest := strings.TrimSuffix(src, ".br")
+	if err := decompressFile(src, dest); err != nil {
+		t.Fatal(err)
+	}
+	si, err := OpenSitelinkIndex(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { si.Close() })
+	return si
+}
+
+func TestSitelinkIndex_Lookup(t *testing.T) {
+	si := openTestSitelinks(t)
+	for _, tc := range []struct {
+		key   string
+		want  uint32
+		found bool
+	}{
+		{"de.wikipedia/berlin", 64, true},
+		{"en.wikipedia/berlin", 64, true},
+		{"en.wikipedia/berlin_wall", 5086, true},
+		{"en.wikipedia/douglas_adams", 42, true},
+		{"und.wikispecies/aepyceros_melampus", 132576, true},
+		{"en.wikipedia/ber", 0, false},
+		{"aa.wikipedia/berlin", 0, false},
+		{"zz.wikipedia/berlin", 0, false},
+	} {
+		got, found, err := si.Lookup(tc.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tc.want || found != tc.found {
+			t.Errorf("Lookup(%q): got %d, %v; want %d, %v", tc.key, got, found, tc.want, tc.found)
+		}
+	}
+}
+
+func TestWebserver_RankBySitelink(t *testing.T) {
+	ws := makeTestWebserver()
+	ri, err := readRankIndex(strings.NewReader("Entity,QRank\nQ64,900\nQ42,5\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws.storage.ranks = ri
+	ws.storage.sitelinks = openTestSitelinks(t)
+
+	for _, tc := range []struct {
+		path   string
+		status int
+		body   string
+	}{
+		{"/rank?site=enwiki&title=Douglas%20Adams", http.StatusOK,
+			`{"entity":"Q42","qrank":5,"rank":2,"percentile":50}` + "\n"},
+		{"/rank?site=dewiki&title=Berlin", http.StatusOK,
+			`{"entity":"Q64","qrank":900,"rank":1,"percentile":100}` + "\n"},
+		{"/rank?site=enwiki&title=Berlin_Wall", http.StatusNotFound, "404 page not found\n"},
+		{"/rank?site=enwiki&title=Atlantis", http.StatusNotFound, "404 page not found\n"},
+		{"/rank?title=Berlin", http.StatusBadRequest, "bad site or title\n"},
+	} {
+		w := httptest.NewRecorder()
+		ws.HandleRankBySitelink(w, httptest.NewRequest("GET", tc.path, nil))
+		res := w.Result()
+		body, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != tc.status {
+			t.Errorf("%s: got status %d, want %d", tc.path, res.StatusCode, tc.status)
+		}
+		if string(body) != tc.body {
+			t.Errorf("%s: got %q, want %q", tc.path, body, tc.body)
+		}
+	}
+}
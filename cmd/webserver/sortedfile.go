@@ -0,0 +1,151 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/andybalholm/brotli"
+)
+
+// SortedFile is a sorted text file on local disk, in which we look up
+// lines by binary search. This lets us serve datasets that would be
+// too large to keep in memory.
+type sortedFile struct {
+	f    *os.File
+	size int64
+}
+
+// Lines longer than this get truncated during lookups. Our sorted
+// files have short lines, so this is plenty.
+const maxLineLen = 4096
+
+// DecompressFile decompresses a brotli or gzip-compressed file,
+// depending on the filename extension of src. The output is written
+// atomically, so an interrupted run never leaves a truncated file behind.
+func decompressFile(src, dest string) error {
+	if _, err := os.Stat(dest); err == nil {
+		return nil // use pre-existing file
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	var r io.Reader
+	switch filepath.Ext(src) {
+	case ".br":
+		r = brotli.NewReader(in)
+	case ".gz":
+		gz, err := gzip.NewReader(in)
+		if err != nil {
+			return err
+		}
+		r = gz
+	default:
+		return fmt.Errorf("unsupported compression: %s", src)
+	}
+
+	tmpPath := dest + ".tmp"
+	out, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	w := bufio.NewWriter(out)
+	if _, err := io.Copy(w, r); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, dest)
+}
+
+func openSortedFile(path string) (*sortedFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &sortedFile{f: f, size: stat.Size()}, nil
+}
+
+// Search returns the first line for which pred returns true, or nil
+// if there is no such line. Like sort.Search, it assumes that pred
+// is false for some (possibly empty) prefix of the file, and true
+// for the remainder. It is safe to call Search from multiple
+// goroutines at the same time.
+func (sf *sortedFile) search(pred func(line []byte) bool) ([]byte, error) {
+	var searchErr error
+	pos := sort.Search(int(sf.size), func(i int) bool {
+		line, err := sf.lineAt(int64(i))
+		if err != nil {
+			searchErr = err
+			return true
+		}
+		return line == nil || pred(line)
+	})
+	if searchErr != nil {
+		return nil, searchErr
+	}
+	return sf.lineAt(int64(pos))
+}
+
+// LineAt returns the first line that starts at or after pos,
+// or nil if there is no such line.
+func (sf *sortedFile) lineAt(pos int64) ([]byte, error) {
+	// Unless we are at the very beginning, skip to the start of
+	// the next line. If the byte before pos is a newline, pos
+	// is already the start of a line.
+	start := pos
+	if pos > 0 {
+		buf := make([]byte, maxLineLen)
+		n, err := sf.f.ReadAt(buf, pos-1)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		nl := bytes.IndexByte(buf[:n], '\n')
+		if nl < 0 {
+			return nil, nil
+		}
+		start = pos + int64(nl)
+	}
+	if start >= sf.size {
+		return nil, nil
+	}
+
+	buf := make([]byte, maxLineLen)
+	n, err := sf.f.ReadAt(buf, start)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	line := buf[:n]
+	if nl := bytes.IndexByte(line, '\n'); nl >= 0 {
+		line = line[:nl]
+	}
+	return line, nil
+}
+
+// Close releases the resources held by a sortedFile.
+func (sf *sortedFile) Close() error {
+	return sf.f.Close()
+}
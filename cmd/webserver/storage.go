@@ -6,11 +6,14 @@ package main
 import (
 	"context"
 	"encoding/base32"
+	"encoding/json"
 	"fmt"
 	"log"
+	"maps"
 	"os"
 	"path/filepath"
 	"regexp"
+	"strings"
 	"sync"
 	"time"
 
@@ -21,8 +24,47 @@ import (
 type Storage struct {
 	client  storageClient
 	workdir string
-	mutex   sync.RWMutex
-	files   map[string]*localFile
+
+	// Bucket and key prefix of the published files in object storage,
+	// such as "qrank" and "public/".
+	bucket string
+	prefix string
+
+	// Serializes calls to Reload(), which may get triggered both
+	// by the periodic timer and by external notifications.
+	reloadMutex sync.Mutex
+
+	mutex sync.RWMutex
+	files map[string]*localFile
+
+	// Index for looking up the ranking of individual entities,
+	// built from the file at ranksPath. Nil until the first load.
+	ranks     *RankIndex
+	ranksPath string
+
+	// Index for looking up entities by page title, built from
+	// the file at sitelinksPath. Nil until the first load.
+	sitelinks     *SitelinkIndex
+	sitelinksPath string
+
+	// Index for looking up the scores of entities in past releases,
+	// built from the file at historyPath. Nil until the first load.
+	history     *HistoryIndex
+	historyPath string
+
+	// Index for looking up the popularity of map tiles, built from
+	// the GeoTIFF file at tileRankPath. Nil until the first load.
+	tileRank     *TileRankIndex
+	tileRankPath string
+
+	// Receives the significant rank changes whenever a new
+	// ranking gets loaded. Nil if not enabled.
+	changes *rankChangeBroker
+
+	// Entities of each class in ranking order, such as "human",
+	// built from the files at classPaths.
+	classes    map[string][]uint32
+	classPaths map[string]string
 }
 
 // LocalFile represents a file in the local working directory,
@@ -32,6 +74,9 @@ type localFile struct {
 	ContentType  string
 	ETag         string
 	LastModified time.Time
+
+	// Release date of the file in storage, such as "20240301".
+	Release string
 }
 
 // StorageClient is the subset of minio.Client used in this program.
@@ -42,7 +87,7 @@ type storageClient interface {
 }
 
 // NewStorage sets up a client for accessing S3-compatible object storage.
-func NewStorage(workdir string) (*Storage, error) {
+func NewStorage(workdir, bucket, prefix string) (*Storage, error) {
 	if err := os.MkdirAll(workdir, 0755); err != nil {
 		return nil, err
 	}
@@ -64,23 +109,33 @@ func NewStorage(workdir string) (*Storage, error) {
 	return &Storage{
 		client:  client,
 		workdir: workdir,
+		bucket:  bucket,
+		prefix:  prefix,
 		files:   make(map[string]*localFile, 10),
+		changes: newRankChangeBroker(),
 	}, nil
 }
 
-var objRegexp = regexp.MustCompile(`public/([a-z_\-]+)\-(2[0-9]{7})\.([a-z0-9\.]+)`)
+// ObjRegexp matches the names of published files, after stripping
+// the storage prefix.
+var objRegexp = regexp.MustCompile(`^([a-z0-9_\-]+)\-(2[0-9]{7})\.([a-z0-9\.]+)$`)
 
 // Reload caches public content from remote object storage to local disk.
 // Any old content (which is not live anymore) is deleted from local disk.
+// New content is swapped in atomically; until then, requests keep
+// getting served from the previous content.
 func (s *Storage) Reload(ctx context.Context) error {
+	s.reloadMutex.Lock()
+	defer s.reloadMutex.Unlock()
+
 	// Find the most recent version of each file in storage.
-	objects := s.client.ListObjects(ctx, "qrank", minio.ListObjectsOptions{
-		Prefix:    "public/",
+	objects := s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{
+		Prefix:    s.prefix,
 		Recursive: false,
 	})
 	inStorage := make(map[string]minio.ObjectInfo, 5)
 	for obj := range objects {
-		if m := objRegexp.FindStringSubmatch(obj.Key); m != nil {
+		if m := objRegexp.FindStringSubmatch(strings.TrimPrefix(obj.Key, s.prefix)); m != nil {
 			filename := fmt.Sprintf("%s.%s", m[1], m[3])
 			info := inStorage[filename]
 			if obj.LastModified.After(info.LastModified) {
@@ -98,9 +153,12 @@ func (s *Storage) Reload(ctx context.Context) error {
 		if err != nil {
 			return err
 		}
-		if _, err := os.Stat(path); err != nil {
+		if _, err := os.Stat(path); err == nil {
+			cacheLookups.WithLabelValues("hit").Inc()
+		} else {
+			cacheLookups.WithLabelValues("miss").Inc()
 			tmpPath := path + ".tmp"
-			if err := s.client.FGetObject(ctx, "qrank", obj.Key, tmpPath, minio.GetObjectOptions{}); err != nil {
+			if err := s.client.FGetObject(ctx, s.bucket, obj.Key, tmpPath, minio.GetObjectOptions{}); err != nil {
 				return err
 			}
 			if err := os.Chtimes(tmpPath, time.Now(), obj.LastModified); err != nil {
@@ -115,10 +173,13 @@ func (s *Storage) Reload(ctx context.Context) error {
 			LastModified: obj.LastModified.UTC(),
 			ContentType:  "application/octet-stream",
 			ETag:         obj.ETag,
+			Release:      objRegexp.FindStringSubmatch(strings.TrimPrefix(obj.Key, s.prefix))[2],
 			Path:         path,
 		}
 
 		switch filepath.Ext(filename) {
+		case ".br":
+			loc.ContentType = "application/x-brotli"
 		case ".gz":
 			loc.ContentType = "application/gzip"
 		case ".json":
@@ -139,10 +200,175 @@ func (s *Storage) Reload(ctx context.Context) error {
 		live[f.Path] = true
 	}
 
+	// If there is a new QRank file, build a new lookup index.
+	// We do this before swapping in the new files, so that
+	// rankings and downloads stay consistent. If the builder has
+	// published a binary index for the same release, we memory-map
+	// it; otherwise, we parse the QRank file into memory.
+	var ranks *RankIndex
+	s.mutex.RLock()
+	ranksPath := s.ranksPath
+	s.mutex.RUnlock()
+	if f, ok := files["qrank.csv.gz"]; ok {
+		load, path := ReadRankIndex, f.Path
+		if idx, ok := files["qrank-index.bin"]; ok && idx.Release == f.Release {
+			load, path = OpenRankIndex, idx.Path
+		}
+		if path != ranksPath {
+			ri, err := load(path)
+			if err != nil {
+				return err
+			}
+			ranks = ri
+			log.Printf("Loaded ranking of %d entities from %s", ri.Len(), path)
+			ranksPath = path
+		}
+	}
+
+	// Likewise for the sitelinks, which we decompress to local disk
+	// for lookups. The decompressed file must survive the cleanup
+	// of the working directory below.
+	var sitelinks *SitelinkIndex
+	s.mutex.RLock()
+	sitelinksPath := s.sitelinksPath
+	s.mutex.RUnlock()
+	if f, ok := files["qrank-sitelinks.txt.br"]; ok {
+		path := strings.TrimSuffix(f.Path, ".br")
+		live[path] = true
+		if path != sitelinksPath {
+			if err := decompressFile(f.Path, path); err != nil {
+				return err
+			}
+			si, err := OpenSitelinkIndex(path)
+			if err != nil {
+				return err
+			}
+			sitelinks = si
+			sitelinksPath = path
+			log.Printf("Loaded sitelinks from %s", path)
+		}
+	}
+
+	// Same for the history of scores across releases.
+	var history *HistoryIndex
+	s.mutex.RLock()
+	historyPath := s.historyPath
+	s.mutex.RUnlock()
+	if f, ok := files["qrank-history.csv.gz"]; ok {
+		path := strings.TrimSuffix(f.Path, ".gz")
+		live[path] = true
+		if path != historyPath {
+			if err := decompressFile(f.Path, path); err != nil {
+				return err
+			}
+			hi, err := OpenHistoryIndex(path)
+			if err != nil {
+				return err
+			}
+			history = hi
+			historyPath = path
+			log.Printf("Loaded history of %d releases from %s", len(hi.dates), path)
+		}
+	}
+
+	// Map tiles are looked up directly in the GeoTIFF file, which
+	// is already laid out for random access.
+	var tileRank *TileRankIndex
+	s.mutex.RLock()
+	tileRankPath := s.tileRankPath
+	s.mutex.RUnlock()
+	if f, ok := files["osmviews.tiff"]; ok && f.Path != tileRankPath {
+		ti, err := OpenTileRankIndex(f.Path)
+		if err != nil {
+			return err
+		}
+		tileRank = ti
+		tileRankPath = f.Path
+		log.Printf("Loaded tile ranks from %s", f.Path)
+	}
+
+	// Likewise for the per-class rankings, which are only present
+	// if qrank-builder was run with -splitTypes.
+	s.mutex.RLock()
+	classes := maps.Clone(s.classes)
+	classPaths := maps.Clone(s.classPaths)
+	s.mutex.RUnlock()
+	if classes == nil {
+		classes = make(map[string][]uint32, len(rankClasses))
+		classPaths = make(map[string]string, len(rankClasses))
+	}
+	classesChanged := false
+	for _, class := range rankClasses {
+		f, ok := files[fmt.Sprintf("qrank-%s.csv.gz", class)]
+		if !ok {
+			if _, loaded := classes[class]; loaded {
+				delete(classes, class)
+				delete(classPaths, class)
+				classesChanged = true
+			}
+			continue
+		}
+		if f.Path == classPaths[class] {
+			continue
+		}
+		entities, err := readRankedEntities(f.Path)
+		if err != nil {
+			return err
+		}
+		classes[class] = entities
+		classPaths[class] = f.Path
+		classesChanged = true
+		log.Printf("Loaded ranking of %d entities of class %s from %s", len(entities), class, f.Path)
+	}
+
+	// We do not close replaced indexes because in-flight requests
+	// may still be using them. Once they are unreachable, the garbage
+	// collector closes their files.
 	s.mutex.Lock()
+	oldRanks := s.ranks
 	s.files = files
+	if ranks != nil {
+		s.ranks = ranks
+		s.ranksPath = ranksPath
+	}
+	if sitelinks != nil {
+		s.sitelinks = sitelinks
+		s.sitelinksPath = sitelinksPath
+	}
+	if history != nil {
+		s.history = history
+		s.historyPath = historyPath
+	}
+	if tileRank != nil {
+		s.tileRank = tileRank
+		s.tileRankPath = tileRankPath
+	}
+	if classesChanged {
+		s.classes = classes
+		s.classPaths = classPaths
+	}
 	s.mutex.Unlock()
 
+	if f, ok := files["qrank.csv.gz"]; ok {
+		datasetInfo.Reset()
+		datasetInfo.WithLabelValues(f.Release).Set(1)
+		datasetLastModified.Set(float64(f.LastModified.Unix()))
+	}
+	if ranks != nil {
+		rankIndexEntities.Set(float64(ranks.Len()))
+		rankIndexBytes.Set(float64(ranks.SizeBytes()))
+	}
+
+	// Tell listeners on /changes about entities whose rank has
+	// changed significantly. There is nothing to compare against
+	// when the webserver loads its very first ranking.
+	if ranks != nil && oldRanks != nil && s.changes != nil {
+		release := files["qrank.csv.gz"].Release
+		changes := diffRanks(oldRanks, ranks, release)
+		s.changes.Publish(&rankChangeBatch{release: release, changes: changes})
+		log.Printf("Published %d rank changes for release %s", len(changes), release)
+	}
+
 	// Clean up workdir so it only contains live files. If we have a new
 	// version for a file that is still getting served to an in-flight
 	// request, it’s not a problem: In Linux, it is perfectly fine to
@@ -155,6 +381,11 @@ func (s *Storage) Reload(ctx context.Context) error {
 		return err
 	}
 	for _, f := range ff {
+		// Subdirectories, such as the cache of entity labels,
+		// are managed elsewhere.
+		if f.IsDir() {
+			continue
+		}
 		fp, err := filepath.Abs(filepath.Join(s.workdir, f.Name()))
 		if err != nil {
 			return err
@@ -169,27 +400,96 @@ func (s *Storage) Reload(ctx context.Context) error {
 		}
 	}
 
+	lastReload.SetToCurrentTime()
 	return nil
 }
 
-func (s *Storage) Watch(ctx context.Context) error {
-	ticker := time.NewTicker(30 * time.Second)
+// Watch reloads content from remote storage periodically, and whenever
+// a value gets received on the trigger channel. If reloading fails,
+// we keep serving the previous content.
+func (s *Storage) Watch(ctx context.Context, interval time.Duration, trigger <-chan struct{}) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
 	for {
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
 		case <-ticker.C:
-			if err := s.Reload(ctx); err != nil {
-				if err == ctx.Err() {
-					return err
-				} else {
-					log.Println(err)
-				}
+		case <-trigger:
+		}
+		if err := s.Reload(ctx); err != nil {
+			if err == ctx.Err() {
+				return err
+			} else {
+				reloadFailures.Inc()
+				log.Println(err)
 			}
 		}
 	}
 }
 
+// Sitelinks returns the index for looking up entities by page title,
+// or nil if no sitelinks have been loaded yet.
+func (s *Storage) Sitelinks() *SitelinkIndex {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.sitelinks
+}
+
+// History returns the index for looking up scores in past releases,
+// or nil if no history has been loaded yet.
+func (s *Storage) History() *HistoryIndex {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.history
+}
+
+// TileRank returns the index for looking up the popularity of map tiles,
+// or nil if no tile ranks have been loaded yet.
+func (s *Storage) TileRank() *TileRankIndex {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.tileRank
+}
+
+// Class returns the entities of a class, such as "human",
+// in ranking order.
+func (s *Storage) Class(class string) ([]uint32, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	entities, ok := s.classes[class]
+	return entities, ok
+}
+
+// Ranks returns the index for looking up entity rankings,
+// or nil if no ranking has been loaded yet.
+func (s *Storage) Ranks() *RankIndex {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.ranks
+}
+
+// File returns information about a servable file, such as "qrank.csv.gz".
+func (s *Storage) file(filename string) (localFile, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	f, ok := s.files[filename]
+	if !ok {
+		return localFile{}, false
+	}
+	return *f, true
+}
+
+// ReadJSON decodes a file in JSON format, such as "qrank-stats.json".
+func (s *Storage) ReadJSON(filename string, v any) error {
+	c, err := s.Retrieve(filename)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	return json.NewDecoder(c).Decode(v)
+}
+
 type Content struct {
 	f            *os.File
 	ContentType  string
@@ -18,6 +18,8 @@ func TestStorage_Reload(t *testing.T) {
 	storage := &Storage{
 		client:  &fakeStorageClient{},
 		workdir: t.TempDir(),
+		bucket:  "qrank",
+		prefix:  "public/",
 		files:   make(map[string]*localFile, 10),
 	}
 
@@ -67,6 +69,8 @@ func TestStorage_Retrieve(t *testing.T) {
 	storage := &Storage{
 		client:  &fakeStorageClient{},
 		workdir: t.TempDir(),
+		bucket:  "qrank",
+		prefix:  "public/",
 		files:   make(map[string]*localFile, 10),
 	}
 
@@ -147,9 +151,10 @@ func (s *fakeStorageClient) FGetObject(ctx context.Context, bucketName, objectNa
 
 func TestStorage_objRegexp(t *testing.T) {
 	for _, s := range []string{
-		"public/qrank-20220631.csv.gz",
-		"public/qrank-stats-20220631.json",
-		"public/osmviews-20220631.tiff",
+		"qrank-20220631.csv.gz",
+		"qrank-stats-20220631.json",
+		"osmviews-20220631.tiff",
+		"qrank-top-100k-20220631.csv.gz",
 	} {
 		if !objRegexp.MatchString(s) {
 			t.Errorf("should match but does not: %v", s)
@@ -158,10 +163,46 @@ func TestStorage_objRegexp(t *testing.T) {
 
 	for _, s := range []string{
 		"internal/osmviews-builder/foobar.tiff",
-		"public/qrank.csv.gz",
+		"osmviews-builder/osmviews-20220631.tiff",
+		"qrank.csv.gz",
 	} {
 		if objRegexp.MatchString(s) {
 			t.Errorf("should not match but does: %v", s)
 		}
 	}
 }
+
+func TestStorage_Watch(t *testing.T) {
+	storage := &Storage{
+		client:  &fakeStorageClient{},
+		workdir: t.TempDir(),
+		bucket:  "qrank",
+		prefix:  "public/",
+		files:   make(map[string]*localFile, 10),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	trigger := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- storage.Watch(ctx, time.Hour, trigger)
+	}()
+
+	trigger <- struct{}{}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if c, err := storage.Retrieve("hello.txt"); err == nil {
+			c.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Storage.Watch() should reload when triggered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Errorf("got %v, want %v", err, context.Canceled)
+	}
+}
@@ -0,0 +1,306 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+// TiledTIFF reads individual pixels of a tiled TIFF file, such as
+// a Cloud-Optimized GeoTIFF, without loading the entire image.
+// We only support what we need for single-band rasters: classic
+// TIFF and BigTIFF in either byte order, tiled layout, no compression
+// or Deflate, and floating-point or unsigned integer samples.
+type tiledTIFF struct {
+	r     io.ReaderAt
+	order binary.ByteOrder
+	big   bool // BigTIFF
+	ifds  []tiffIFD
+}
+
+// TiffIFD describes one image in a TIFF file. In a Cloud-Optimized
+// GeoTIFF, the first image is the full-resolution raster, and the
+// following ones are overviews at lower resolution.
+type tiffIFD struct {
+	width, height         uint64
+	tileWidth, tileHeight uint64
+	bitsPerSample         uint16
+	sampleFormat          uint16
+	compression           uint16
+	predictor             uint16
+
+	// Location of the TileOffsets and TileByteCounts arrays,
+	// whose entries get read on demand. Files with many tiles
+	// have large arrays, so we do not load them upfront.
+	offsets, byteCounts tiffArray
+}
+
+type tiffArray struct {
+	pos   int64
+	count uint64
+	typ   uint16
+}
+
+const (
+	tiffTypeShort = 3
+	tiffTypeLong  = 4
+	tiffTypeLong8 = 16
+
+	tiffTagImageWidth     = 256
+	tiffTagImageLength    = 257
+	tiffTagBitsPerSample  = 258
+	tiffTagCompression    = 259
+	tiffTagPredictor      = 317
+	tiffTagTileWidth      = 322
+	tiffTagTileLength     = 323
+	tiffTagTileOffsets    = 324
+	tiffTagTileByteCounts = 325
+	tiffTagSampleFormat   = 339
+
+	tiffSampleFormatUint  = 1
+	tiffSampleFormatFloat = 3
+)
+
+// Limit on the number of images in a file, to guard against loops.
+const maxTIFFImages = 64
+
+func openTiledTIFF(r io.ReaderAt) (*tiledTIFF, error) {
+	var header [16]byte
+	if _, err := r.ReadAt(header[:8], 0); err != nil {
+		return nil, err
+	}
+	t := &tiledTIFF{r: r}
+	switch string(header[0:2]) {
+	case "II":
+		t.order = binary.LittleEndian
+	case "MM":
+		t.order = binary.BigEndian
+	default:
+		return nil, fmt.Errorf("not a TIFF file")
+	}
+
+	var next uint64
+	switch t.order.Uint16(header[2:4]) {
+	case 42:
+		next = uint64(t.order.Uint32(header[4:8]))
+	case 43:
+		t.big = true
+		if _, err := r.ReadAt(header[:16], 0); err != nil {
+			return nil, err
+		}
+		next = t.order.Uint64(header[8:16])
+	default:
+		return nil, fmt.Errorf("not a TIFF file")
+	}
+
+	for next != 0 {
+		if len(t.ifds) >= maxTIFFImages {
+			return nil, fmt.Errorf("too many images in TIFF file")
+		}
+		ifd, n, err := t.readIFD(int64(next))
+		if err != nil {
+			return nil, err
+		}
+		t.ifds = append(t.ifds, ifd)
+		next = n
+	}
+	return t, nil
+}
+
+// ReadIFD parses the image file directory at pos, returning
+// the position of the next directory.
+func (t *tiledTIFF) readIFD(pos int64) (tiffIFD, uint64, error) {
+	ifd := tiffIFD{bitsPerSample: 1, sampleFormat: tiffSampleFormatUint, compression: 1, predictor: 1}
+	countSize, entrySize, offsetSize := 2, 12, 4
+	if t.big {
+		countSize, entrySize, offsetSize = 8, 20, 8
+	}
+
+	buf := make([]byte, countSize)
+	if _, err := t.r.ReadAt(buf, pos); err != nil {
+		return ifd, 0, err
+	}
+	var numEntries uint64
+	if t.big {
+		numEntries = t.order.Uint64(buf)
+	} else {
+		numEntries = uint64(t.order.Uint16(buf))
+	}
+	if numEntries > 1000 {
+		return ifd, 0, fmt.Errorf("too many TIFF tags")
+	}
+
+	buf = make([]byte, int(numEntries)*entrySize+offsetSize)
+	if _, err := t.r.ReadAt(buf, pos+int64(countSize)); err != nil {
+		return ifd, 0, err
+	}
+	for i := 0; i < int(numEntries); i++ {
+		e := buf[i*entrySize : (i+1)*entrySize]
+		tag, typ := t.order.Uint16(e[0:2]), t.order.Uint16(e[2:4])
+		var count uint64
+		var value []byte
+		if t.big {
+			count, value = t.order.Uint64(e[4:12]), e[12:20]
+		} else {
+			count, value = uint64(t.order.Uint32(e[4:8])), e[8:12]
+		}
+
+		switch tag {
+		case tiffTagTileOffsets, tiffTagTileByteCounts:
+			arr := tiffArray{count: count, typ: typ}
+			size := tiffTypeSize(typ) * count
+			if size <= uint64(len(value)) {
+				// Small arrays are stored inside the entry itself;
+				// the value then starts right after the count.
+				arr.pos = pos + int64(countSize) + int64(i*entrySize) + int64(entrySize-len(value))
+			} else {
+				arr.pos = int64(t.uint(value, offsetSize))
+			}
+			if tag == tiffTagTileOffsets {
+				ifd.offsets = arr
+			} else {
+				ifd.byteCounts = arr
+			}
+
+		case tiffTagImageWidth, tiffTagImageLength, tiffTagTileWidth, tiffTagTileLength,
+			tiffTagBitsPerSample, tiffTagCompression, tiffTagPredictor, tiffTagSampleFormat:
+			// For multi-sample images, BitsPerSample and SampleFormat
+			// have one value per sample. We only look at the first.
+			v := t.uint(value, int(tiffTypeSize(typ)))
+			switch tag {
+			case tiffTagImageWidth:
+				ifd.width = v
+			case tiffTagImageLength:
+				ifd.height = v
+			case tiffTagTileWidth:
+				ifd.tileWidth = v
+			case tiffTagTileLength:
+				ifd.tileHeight = v
+			case tiffTagBitsPerSample:
+				ifd.bitsPerSample = uint16(v)
+			case tiffTagCompression:
+				ifd.compression = uint16(v)
+			case tiffTagPredictor:
+				ifd.predictor = uint16(v)
+			case tiffTagSampleFormat:
+				ifd.sampleFormat = uint16(v)
+			}
+		}
+	}
+
+	next := t.uint(buf[int(numEntries)*entrySize:], offsetSize)
+	return ifd, next, nil
+}
+
+func tiffTypeSize(typ uint16) uint64 {
+	switch typ {
+	case tiffTypeShort:
+		return 2
+	case tiffTypeLong:
+		return 4
+	case tiffTypeLong8:
+		return 8
+	default:
+		return 1
+	}
+}
+
+// Uint decodes an unsigned integer of 1, 2, 4 or 8 bytes.
+func (t *tiledTIFF) uint(b []byte, size int) uint64 {
+	switch size {
+	case 2:
+		return uint64(t.order.Uint16(b))
+	case 4:
+		return uint64(t.order.Uint32(b))
+	case 8:
+		return t.order.Uint64(b)
+	default:
+		return uint64(b[0])
+	}
+}
+
+// ArrayElement reads the i-th element of a TIFF array.
+func (t *tiledTIFF) arrayElement(a tiffArray, i uint64) (uint64, error) {
+	if i >= a.count {
+		return 0, fmt.Errorf("TIFF array index %d out of range", i)
+	}
+	size := tiffTypeSize(a.typ)
+	buf := make([]byte, size)
+	if _, err := t.r.ReadAt(buf, a.pos+int64(i*size)); err != nil {
+		return 0, err
+	}
+	return t.uint(buf, int(size)), nil
+}
+
+// Pixel returns the value of a pixel in the n-th image of the file.
+func (t *tiledTIFF) Pixel(n int, x, y uint64) (float64, error) {
+	ifd := &t.ifds[n]
+	if x >= ifd.width || y >= ifd.height {
+		return 0, fmt.Errorf("pixel (%d, %d) out of range", x, y)
+	}
+	if ifd.tileWidth == 0 || ifd.tileHeight == 0 {
+		return 0, fmt.Errorf("TIFF image is not tiled")
+	}
+	if ifd.predictor != 1 {
+		return 0, fmt.Errorf("unsupported TIFF predictor %d", ifd.predictor)
+	}
+	bytesPerSample := uint64(ifd.bitsPerSample / 8)
+	switch {
+	case ifd.sampleFormat == tiffSampleFormatFloat && (bytesPerSample == 4 || bytesPerSample == 8):
+	case ifd.sampleFormat == tiffSampleFormatUint && bytesPerSample >= 1 && bytesPerSample <= 8:
+	default:
+		return 0, fmt.Errorf("unsupported TIFF sample format %d with %d bits", ifd.sampleFormat, ifd.bitsPerSample)
+	}
+
+	tilesAcross := (ifd.width + ifd.tileWidth - 1) / ifd.tileWidth
+	tile := (y/ifd.tileHeight)*tilesAcross + x/ifd.tileWidth
+	offset, err := t.arrayElement(ifd.offsets, tile)
+	if err != nil {
+		return 0, err
+	}
+	size, err := t.arrayElement(ifd.byteCounts, tile)
+	if err != nil {
+		return 0, err
+	}
+	if offset == 0 || size == 0 {
+		return 0, nil // sparse tile, as written by GDAL for empty areas
+	}
+
+	data := make([]byte, size)
+	if _, err := t.r.ReadAt(data, int64(offset)); err != nil {
+		return 0, err
+	}
+	switch ifd.compression {
+	case 1:
+	case 8, 32946: // Deflate
+		zr, err := zlib.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return 0, err
+		}
+		data, err = io.ReadAll(zr)
+		if err != nil {
+			return 0, err
+		}
+	default:
+		return 0, fmt.Errorf("unsupported TIFF compression %d", ifd.compression)
+	}
+
+	pos := ((y%ifd.tileHeight)*ifd.tileWidth + x%ifd.tileWidth) * bytesPerSample
+	if pos+bytesPerSample > uint64(len(data)) {
+		return 0, fmt.Errorf("TIFF tile %d is truncated", tile)
+	}
+	sample := data[pos : pos+bytesPerSample]
+	if ifd.sampleFormat == tiffSampleFormatFloat {
+		if bytesPerSample == 4 {
+			return float64(math.Float32frombits(t.order.Uint32(sample))), nil
+		}
+		return math.Float64frombits(t.order.Uint64(sample)), nil
+	}
+	return float64(t.uint(sample, int(bytesPerSample))), nil
+}
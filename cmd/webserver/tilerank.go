@@ -0,0 +1,143 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// TileRankIndex gives the popularity of map tiles, measured in views
+// per km², as published by osmviews-builder in a Cloud-Optimized GeoTIFF.
+// The file contains one image per zoom level; at zoom level z, the image
+// is 2^z pixels wide and high, with one pixel for each tile.
+type TileRankIndex struct {
+	file   *os.File
+	tiff   *tiledTIFF
+	levels map[int]int // zoom level → image number in tiff
+}
+
+// TileRank is the response of the /tilerank endpoint.
+type TileRank struct {
+	Zoom         int     `json:"z"`
+	X            uint64  `json:"x"`
+	Y            uint64  `json:"y"`
+	ViewsPerSqKm float64 `json:"viewsPerKm2"`
+}
+
+// OpenTileRankIndex opens a GeoTIFF file for looking up tile values.
+func OpenTileRankIndex(path string) (*TileRankIndex, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	t, err := openTiledTIFF(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	levels := make(map[int]int, len(t.ifds))
+	for i, ifd := range t.ifds {
+		for zoom := 0; zoom <= maxTileZoom; zoom++ {
+			if ifd.width == 1<<zoom && ifd.height == 1<<zoom {
+				levels[zoom] = i
+			}
+		}
+	}
+	if len(levels) == 0 {
+		f.Close()
+		return nil, fmt.Errorf("%s: no image for any zoom level", path)
+	}
+	return &TileRankIndex{file: f, tiff: t, levels: levels}, nil
+}
+
+// Highest zoom level whose tiles we can look up.
+const maxTileZoom = 24
+
+// Lookup returns the views per km² of a map tile. The boolean result
+// is false if the file has no image for the requested zoom level.
+// It is safe to call Lookup from multiple goroutines at the same time.
+func (ti *TileRankIndex) Lookup(zoom int, x, y uint64) (float64, bool, error) {
+	img, ok := ti.levels[zoom]
+	if !ok {
+		return 0, false, nil
+	}
+	value, err := ti.tiff.Pixel(img, x, y)
+	if err != nil {
+		return 0, false, err
+	}
+	return value, true, nil
+}
+
+// Close releases the resources held by the index.
+func (ti *TileRankIndex) Close() error {
+	return ti.file.Close()
+}
+
+// HandleTileRank serves the popularity of a map tile, such as
+// /tilerank/18/137341/91897.
+func (ws *Webserver) HandleTileRank(w http.ResponseWriter, req *http.Request) {
+	h := w.Header()
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+	case http.MethodOptions:
+		ws.handlePreflight(w, req, "GET, HEAD, OPTIONS")
+		return
+	default:
+		h.Set("Allow", "GET, HEAD, OPTIONS")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	ws.setAllowOrigin(h, req)
+
+	zoom, x, y, ok := parseTilePath(strings.TrimPrefix(req.URL.Path, "/tilerank/"))
+	if !ok {
+		http.Error(w, "bad tile; expected /tilerank/{z}/{x}/{y}", http.StatusBadRequest)
+		return
+	}
+
+	tileRank := ws.storage.TileRank()
+	if tileRank == nil {
+		http.Error(w, "tile ranks not loaded yet", http.StatusServiceUnavailable)
+		return
+	}
+
+	value, found, err := tileRank.Lookup(zoom, x, y)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, "zoom level not available", http.StatusNotFound)
+		return
+	}
+
+	h.Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(TileRank{Zoom: zoom, X: x, Y: y, ViewsPerSqKm: value})
+}
+
+// ParseTilePath parses a tile path such as "18/137341/91897".
+func parseTilePath(s string) (int, uint64, uint64, bool) {
+	parts := strings.Split(s, "/")
+	if len(parts) != 3 {
+		return 0, 0, 0, false
+	}
+	zoom, err := strconv.Atoi(parts[0])
+	if err != nil || zoom < 0 || zoom > maxTileZoom {
+		return 0, 0, 0, false
+	}
+	x, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil || x >= 1<<zoom {
+		return 0, 0, 0, false
+	}
+	y, err := strconv.ParseUint(parts[2], 10, 64)
+	if err != nil || y >= 1<<zoom {
+		return 0, 0, 0, false
+	}
+	return zoom, x, y, true
+}
@@ -0,0 +1,267 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// TestImage is an image for writing test TIFF files. The value
+// of the pixel at (x, y) is x + 10*y + 100*size.
+type testImage struct {
+	size, tileSize int
+	deflate        bool
+}
+
+func (img testImage) value(x, y int) float32 {
+	return float32(x + 10*y + 100*img.size)
+}
+
+// WriteTestTIFF produces a tiled TIFF file with float32 samples.
+func writeTestTIFF(order binary.ByteOrder, bigTIFF bool, images []testImage) []byte {
+	var buf bytes.Buffer
+	put := func(v uint64, size int) {
+		b := make([]byte, 8)
+		switch size {
+		case 2:
+			order.PutUint16(b, uint16(v))
+		case 4:
+			order.PutUint32(b, uint32(v))
+		case 8:
+			order.PutUint64(b, v)
+		}
+		buf.Write(b[:size])
+	}
+	patch := func(pos int, v uint64, size int) {
+		b := buf.Bytes()[pos : pos+size]
+		if size == 4 {
+			order.PutUint32(b, uint32(v))
+		} else {
+			order.PutUint64(b, v)
+		}
+	}
+
+	if order == binary.LittleEndian {
+		buf.WriteString("II")
+	} else {
+		buf.WriteString("MM")
+	}
+	offsetSize, offsetType := 4, uint64(tiffTypeLong)
+	if bigTIFF {
+		offsetSize, offsetType = 8, tiffTypeLong8
+		put(43, 2)
+		put(8, 2)
+		put(0, 2)
+	} else {
+		put(42, 2)
+	}
+	nextPos := buf.Len()
+	put(0, offsetSize)
+
+	for _, img := range images {
+		tilesAcross := (img.size + img.tileSize - 1) / img.tileSize
+		var offsets, counts []uint64
+		for ty := 0; ty < tilesAcross; ty++ {
+			for tx := 0; tx < tilesAcross; tx++ {
+				var tile bytes.Buffer
+				for y := ty * img.tileSize; y < (ty+1)*img.tileSize; y++ {
+					for x := tx * img.tileSize; x < (tx+1)*img.tileSize; x++ {
+						binary.Write(&tile, order, math.Float32bits(img.value(x, y)))
+					}
+				}
+				data := tile.Bytes()
+				if img.deflate {
+					var z bytes.Buffer
+					zw := zlib.NewWriter(&z)
+					zw.Write(data)
+					zw.Close()
+					data = z.Bytes()
+				}
+				offsets = append(offsets, uint64(buf.Len()))
+				counts = append(counts, uint64(len(data)))
+				buf.Write(data)
+			}
+		}
+
+		// Arrays that do not fit into a tag entry get written
+		// before the image file directory.
+		arrayPos := func(values []uint64) uint64 {
+			if len(values)*offsetSize <= offsetSize {
+				return values[0]
+			}
+			pos := uint64(buf.Len())
+			for _, v := range values {
+				put(v, offsetSize)
+			}
+			return pos
+		}
+		offsetsValue, countsValue := arrayPos(offsets), arrayPos(counts)
+
+		compression := uint64(1)
+		if img.deflate {
+			compression = 8
+		}
+		type entry struct{ tag, typ, count, value uint64 }
+		entries := []entry{
+			{tiffTagImageWidth, tiffTypeLong, 1, uint64(img.size)},
+			{tiffTagImageLength, tiffTypeLong, 1, uint64(img.size)},
+			{tiffTagBitsPerSample, tiffTypeShort, 1, 32},
+			{tiffTagCompression, tiffTypeShort, 1, compression},
+			{tiffTagTileWidth, tiffTypeShort, 1, uint64(img.tileSize)},
+			{tiffTagTileLength, tiffTypeShort, 1, uint64(img.tileSize)},
+			{tiffTagTileOffsets, offsetType, uint64(len(offsets)), offsetsValue},
+			{tiffTagTileByteCounts, offsetType, uint64(len(counts)), countsValue},
+			{tiffTagSampleFormat, tiffTypeShort, 1, tiffSampleFormatFloat},
+		}
+		sort.Slice(entries, func(i, j int) bool { return entries[i].tag < entries[j].tag })
+
+		if buf.Len()%2 != 0 {
+			buf.WriteByte(0)
+		}
+		patch(nextPos, uint64(buf.Len()), offsetSize)
+		if bigTIFF {
+			put(uint64(len(entries)), 8)
+		} else {
+			put(uint64(len(entries)), 2)
+		}
+		for _, e := range entries {
+			put(e.tag, 2)
+			put(e.typ, 2)
+			put(e.count, offsetSize)
+			// Values are left-aligned in the value field.
+			size := int(tiffTypeSize(uint16(e.typ)))
+			put(e.value, size)
+			buf.Write(make([]byte, offsetSize-size))
+		}
+		nextPos = buf.Len()
+		put(0, offsetSize)
+	}
+	return buf.Bytes()
+}
+
+var testTileRankImages = []testImage{
+	{size: 4, tileSize: 2, deflate: true},
+	{size: 2, tileSize: 2},
+	{size: 1, tileSize: 16},
+}
+
+func TestTiledTIFF_Pixel(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		order   binary.ByteOrder
+		bigTIFF bool
+	}{
+		{"LittleEndian", binary.LittleEndian, false},
+		{"BigEndian", binary.BigEndian, false},
+		{"BigTIFF", binary.LittleEndian, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			data := writeTestTIFF(tc.order, tc.bigTIFF, testTileRankImages)
+			tt, err := openTiledTIFF(bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(tt.ifds) != len(testTileRankImages) {
+				t.Fatalf("got %d images, want %d", len(tt.ifds), len(testTileRankImages))
+			}
+			for n, img := range testTileRankImages {
+				for y := 0; y < img.size; y++ {
+					for x := 0; x < img.size; x++ {
+						got, err := tt.Pixel(n, uint64(x), uint64(y))
+						if err != nil {
+							t.Fatal(err)
+						}
+						if want := float64(img.value(x, y)); got != want {
+							t.Errorf("image %d, pixel (%d, %d): got %v, want %v", n, x, y, got, want)
+						}
+					}
+				}
+			}
+			if _, err := tt.Pixel(0, 4, 0); err == nil {
+				t.Error("expected error for pixel out of range")
+			}
+		})
+	}
+}
+
+func TestTiledTIFF_NotTIFF(t *testing.T) {
+	if _, err := openTiledTIFF(strings.NewReader("GIF89a...")); err == nil {
+		t.Error("expected error, got nil")
+	}
+}
+
+func openTestTileRank(t *testing.T) *TileRankIndex {
+	path := filepath.Join(t.TempDir(), "osmviews.tiff")
+	data := writeTestTIFF(binary.LittleEndian, false, testTileRankImages)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	ti, err := OpenTileRankIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ti.Close() })
+	return ti
+}
+
+func TestWebserver_TileRank(t *testing.T) {
+	ws := makeTestWebserver()
+	ws.storage.tileRank = openTestTileRank(t)
+
+	for _, tc := range []struct {
+		path   string
+		status int
+		body   string
+	}{
+		{"/tilerank/0/0/0", 200, `{"z":0,"x":0,"y":0,"viewsPerKm2":100}`},
+		{"/tilerank/1/1/0", 200, `{"z":1,"x":1,"y":0,"viewsPerKm2":201}`},
+		{"/tilerank/2/3/2", 200, `{"z":2,"x":3,"y":2,"viewsPerKm2":423}`},
+		{"/tilerank/3/0/0", 404, "zoom level not available"},
+		{"/tilerank/2/4/0", 400, "bad tile"},
+		{"/tilerank/2/0/-1", 400, "bad tile"},
+		{"/tilerank/2/0", 400, "bad tile"},
+		{"/tilerank/x/0/0", 400, "bad tile"},
+		{"/tilerank/99/0/0", 400, "bad tile"},
+	} {
+		rec := httptest.NewRecorder()
+		ws.HandleTileRank(rec, httptest.NewRequest(http.MethodGet, tc.path, nil))
+		if rec.Code != tc.status {
+			t.Errorf("GET %s: got status %d, want %d", tc.path, rec.Code, tc.status)
+		}
+		if got := strings.TrimSpace(rec.Body.String()); !strings.HasPrefix(got, tc.body) {
+			t.Errorf("GET %s: got %q, want %q", tc.path, got, tc.body)
+		}
+	}
+}
+
+func TestWebserver_TileRankNotLoaded(t *testing.T) {
+	ws := makeTestWebserver()
+	rec := httptest.NewRecorder()
+	ws.HandleTileRank(rec, httptest.NewRequest(http.MethodGet, "/tilerank/0/0/0", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("got status %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+}
+
+func TestWebserver_TileRankMethodNotAllowed(t *testing.T) {
+	ws := makeTestWebserver()
+	rec := httptest.NewRecorder()
+	ws.HandleTileRank(rec, httptest.NewRequest(http.MethodPost, "/tilerank/0/0/0", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("got status %d, want %d", rec.Code, http.StatusMethodNotAllowed)
+	}
+	if got, want := rec.Header().Get("Allow"), "GET, HEAD, OPTIONS"; got != want {
+		t.Errorf("got Allow %q, want %q", got, want)
+	}
+}
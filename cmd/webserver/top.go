@@ -0,0 +1,152 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+// RankClasses are the coarse entity types for which qrank-builder
+// publishes separate ranking files, such as qrank-human.csv.gz,
+// when running with -splitTypes. This must match entityTypes in
+// qrank-builder.
+var rankClasses = []string{"human", "place", "taxon", "work"}
+
+const (
+	defaultTopLimit = 100
+	maxTopLimit     = 1000
+)
+
+// TopPage is the response of the /top endpoint.
+type TopPage struct {
+	Offset   int        `json:"offset"`
+	Limit    int        `json:"limit"`
+	Total    int        `json:"total"`
+	Class    string     `json:"class,omitempty"`
+	Entities []RankInfo `json:"entities"`
+}
+
+// ReadRankedEntities reads the entity IDs of a ranking file, such as
+// qrank-human.csv.gz, in ranking order. We do not keep the scores,
+// since they are the same as in the full ranking.
+func readRankedEntities(path string) ([]uint32, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	scanner := bufio.NewScanner(r)
+	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%s: missing header", path)
+	}
+	if header := scanner.Text(); header != "Entity,QRank" {
+		return nil, fmt.Errorf(`%s: expected header "Entity,QRank", got %q`, path, header)
+	}
+
+	entities := make([]uint32, 0, 1024)
+	for scanner.Scan() {
+		entity, _, ok := parseRankLine(scanner.Text())
+		if !ok {
+			return nil, fmt.Errorf("%s: bad line: %q", path, scanner.Text())
+		}
+		entities = append(entities, entity)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return entities, nil
+}
+
+// HandleTop serves a page of entities in ranking order, such as
+// /top?offset=10000&limit=1000 for the entities ranked 10,001 to 11,000.
+// With a class parameter, such as /top?class=human, only entities of that
+// class are listed; offset and total then refer to the entities of that
+// class, while the returned rank is still the position in the full ranking.
+func (ws *Webserver) HandleTop(w http.ResponseWriter, req *http.Request) {
+	h := w.Header()
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+	case http.MethodOptions:
+		ws.handlePreflight(w, req, "GET, HEAD, OPTIONS")
+		return
+	default:
+		h.Set("Allow", "GET, HEAD, OPTIONS")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	ws.setAllowOrigin(h, req)
+
+	query := req.URL.Query()
+	page := TopPage{Limit: defaultTopLimit, Class: query.Get("class")}
+	if s := query.Get("offset"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			http.Error(w, "bad offset", http.StatusBadRequest)
+			return
+		}
+		page.Offset = n
+	}
+	if s := query.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxTopLimit {
+			msg := fmt.Sprintf("limit must be between 1 and %d", maxTopLimit)
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+		page.Limit = n
+	}
+	lang, ok := ws.labelLanguage(w, req)
+	if !ok {
+		return
+	}
+
+	ranks := ws.storage.Ranks()
+	if ranks == nil {
+		http.Error(w, "ranking not loaded yet", http.StatusServiceUnavailable)
+		return
+	}
+
+	if page.Class == "" {
+		page.Total = ranks.Len()
+		page.Entities = ranks.Range(page.Offset, page.Limit)
+	} else {
+		entities, ok := ws.storage.Class(page.Class)
+		if !ok {
+			http.Error(w, "unknown class", http.StatusNotFound)
+			return
+		}
+		page.Total = len(entities)
+		start := min(page.Offset, len(entities))
+		end := min(start+page.Limit, len(entities))
+		page.Entities = make([]RankInfo, 0, end-start)
+		for _, entity := range entities[start:end] {
+			// During a reload, the class ranking may be from a
+			// different release than the full ranking.
+			if info, found := ranks.Lookup(entity); found {
+				page.Entities = append(page.Entities, info)
+			}
+		}
+	}
+
+	ws.addLabels(lang, page.Entities)
+
+	h.Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
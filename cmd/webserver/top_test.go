@@ -0,0 +1,110 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRankIndex_Range(t *testing.T) {
+	ri, err := readRankIndex(strings.NewReader(
+		"Entity,QRank\nQ64,900\nQ1,800\nQ72,70\nQ42,5\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		offset, limit int
+		want          []RankInfo
+	}{
+		{0, 1, []RankInfo{{Entity: "Q64", QRank: 900, Rank: 1, Percentile: 100}}},
+		{1, 2, []RankInfo{{Entity: "Q1", QRank: 800, Rank: 2, Percentile: 75}, {Entity: "Q72", QRank: 70, Rank: 3, Percentile: 50}}},
+		{3, 10, []RankInfo{{Entity: "Q42", QRank: 5, Rank: 4, Percentile: 25}}},
+		{4, 10, []RankInfo{}},
+		{99, 10, []RankInfo{}},
+	} {
+		got := ri.Range(tc.offset, tc.limit)
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("Range(%d, %d): got %v, want %v", tc.offset, tc.limit, got, tc.want)
+		}
+	}
+}
+
+func TestReadRankedEntities(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "qrank-human.csv.gz")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := gzip.NewWriter(f)
+	if _, err := w.Write([]byte("Entity,QRank\nQ72,70\nQ42,5\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := readRankedEntities(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []uint32{72, 42}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestWebserver_Top(t *testing.T) {
+	ws := makeTestWebserver()
+	ri, err := readRankIndex(strings.NewReader(
+		"Entity,QRank\nQ64,900\nQ1,800\nQ72,70\nQ42,5\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws.storage.ranks = ri
+	ws.storage.classes = map[string][]uint32{"human": {72, 42}}
+
+	for _, tc := range []struct {
+		path   string
+		status int
+		body   string
+	}{
+		{"/top?offset=1&limit=2", http.StatusOK,
+			`{"offset":1,"limit":2,"total":4,"entities":[` +
+				`{"entity":"Q1","qrank":800,"rank":2,"percentile":75},` +
+				`{"entity":"Q72","qrank":70,"rank":3,"percentile":50}]}` + "\n"},
+		{"/top?offset=10", http.StatusOK,
+			`{"offset":10,"limit":100,"total":4,"entities":[]}` + "\n"},
+		{"/top?class=human&offset=1", http.StatusOK,
+			`{"offset":1,"limit":100,"total":2,"class":"human","entities":[` +
+				`{"entity":"Q42","qrank":5,"rank":4,"percentile":25}]}` + "\n"},
+		{"/top?class=taxon", http.StatusNotFound, "unknown class\n"},
+		{"/top?offset=-1", http.StatusBadRequest, "bad offset\n"},
+		{"/top?limit=1001", http.StatusBadRequest, "limit must be between 1 and 1000\n"},
+		{"/top?limit=0", http.StatusBadRequest, "limit must be between 1 and 1000\n"},
+	} {
+		w := httptest.NewRecorder()
+		ws.HandleTop(w, httptest.NewRequest("GET", tc.path, nil))
+		res := w.Result()
+		body, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != tc.status {
+			t.Errorf("%s: got status %d, want %d", tc.path, res.StatusCode, tc.status)
+		}
+		if string(body) != tc.body {
+			t.Errorf("%s: got %q, want %q", tc.path, body, tc.body)
+		}
+	}
+}
@@ -89,6 +89,86 @@ func TestWebserver_DownloadETagMatch(t *testing.T) {
 	}
 }
 
+func TestWebserver_DownloadModifiedSince(t *testing.T) {
+	rh := make(http.Header)
+	rh.Set("If-Modified-Since", "Tue, 21 Nov 2023 19:20:21 GMT")
+	status, _, body, err := sendRequest("GET", "/download/c.txt", rh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusNotModified {
+		t.Errorf("want StatusCode %d, got %d", http.StatusNotModified, status)
+	}
+	if len(body) > 0 {
+		t.Errorf(`want empty body, got "%s"`, string(body))
+	}
+
+	rh.Set("If-Modified-Since", "Mon, 20 Nov 2023 08:00:00 GMT")
+	status, _, body, err = sendRequest("GET", "/download/c.txt", rh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusOK {
+		t.Errorf("want StatusCode %d, got %d", http.StatusOK, status)
+	}
+	if string(body) != "Content" {
+		t.Errorf(`want body="Content", got "%s"`, string(body))
+	}
+}
+
+func TestWebserver_DownloadRange(t *testing.T) {
+	rh := make(http.Header)
+	rh.Set("Range", "bytes=2-4")
+	status, header, body, err := sendRequest("GET", "/download/c.txt", rh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusPartialContent {
+		t.Errorf("want StatusCode %d, got %d", http.StatusPartialContent, status)
+	}
+	if string(body) != "nte" {
+		t.Errorf(`want body="nte", got "%s"`, string(body))
+	}
+	want := "bytes 2-4/7"
+	if got := header.Get("Content-Range"); got != want {
+		t.Errorf(`expected "Content-Range: %s", got "%s"`, want, got)
+	}
+	want = "bytes"
+	if got := header.Get("Accept-Ranges"); got != want {
+		t.Errorf(`expected "Accept-Ranges: %s", got "%s"`, want, got)
+	}
+}
+
+func TestWebserver_DownloadIfRange(t *testing.T) {
+	// If the ETag still matches, the client gets the requested range.
+	rh := make(http.Header)
+	rh.Set("Range", "bytes=3-")
+	rh.Set("If-Range", `"ETag-123"`)
+	status, _, body, err := sendRequest("GET", "/download/c.txt", rh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusPartialContent {
+		t.Errorf("want StatusCode %d, got %d", http.StatusPartialContent, status)
+	}
+	if string(body) != "tent" {
+		t.Errorf(`want body="tent", got "%s"`, string(body))
+	}
+
+	// If the content has changed, the client gets the full content.
+	rh.Set("If-Range", `"ETag-old"`)
+	status, _, body, err = sendRequest("GET", "/download/c.txt", rh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusOK {
+		t.Errorf("want StatusCode %d, got %d", http.StatusOK, status)
+	}
+	if string(body) != "Content" {
+		t.Errorf(`want body="Content", got "%s"`, string(body))
+	}
+}
+
 func TestWebserver_DownloadNotFound(t *testing.T) {
 	rh := make(http.Header)
 	status, _, _, err := sendRequest("GET", "/download/unkown", rh)
@@ -136,7 +216,7 @@ func TestWebserver_DownloadOptions(t *testing.T) {
 		t.Errorf(`expected "Access-Control-Allow-Headers: %s", got "%s"`, want, got)
 	}
 
-	want = "ETag"
+	want = "Accept-Ranges, Content-Length, Content-Range, ETag, Last-Modified"
 	if got := header.Get("Access-Control-Expose-Headers"); got != want {
 		t.Errorf(`expected "Access-Control-Expose-Headers: %s", got "%s"`, want, got)
 	}
@@ -205,5 +285,5 @@ func makeTestWebserver() *Webserver {
 		LastModified: lastmod,
 	}
 
-	return &Webserver{storage: storage}
+	return &Webserver{storage: storage, corsOrigins: []string{"*"}}
 }
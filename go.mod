@@ -16,6 +16,7 @@ toolchain go1.24.5
 // +heroku install ./cmd/qrank-builder ./cmd/webserver
 
 require (
+	github.com/BurntSushi/toml v1.5.0
 	github.com/andybalholm/brotli v1.2.0
 	github.com/dsnet/compress v0.0.1
 	github.com/fogleman/gg v1.3.0
@@ -25,6 +26,9 @@ require (
 	github.com/prometheus/client_golang v1.22.0
 	golang.org/x/sync v0.16.0
 	golang.org/x/text v0.27.0
+	google.golang.org/grpc v1.73.0
+	google.golang.org/protobuf v1.36.6
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -49,5 +53,5 @@ require (
 	golang.org/x/image v0.29.0 // indirect
 	golang.org/x/net v0.42.0 // indirect
 	golang.org/x/sys v0.34.0 // indirect
-	google.golang.org/protobuf v1.36.6 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20250324211829-b45e905df463 // indirect
 )
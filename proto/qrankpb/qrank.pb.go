@@ -0,0 +1,378 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+// Service definition for looking up QRank over gRPC. The messages
+// mirror the JSON responses of the webserver's /rank/{qid} and
+// /ranks endpoints, so clients can switch between the two.
+//
+// The generated Go code is in proto/qrankpb. After changing this
+// file, regenerate it with:
+//
+//   protoc --go_out=. --go_opt=module=github.com/brawer/wikidata-qrank/v2 \
+//     --go-grpc_out=. --go-grpc_opt=module=github.com/brawer/wikidata-qrank/v2 \
+//     proto/qrank.proto
+
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.6
+// 	protoc        (unknown)
+// source: proto/qrank.proto
+
+package qrankpb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type LookupRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Wikidata ID, such as "Q42".
+	Entity        string `protobuf:"bytes,1,opt,name=entity,proto3" json:"entity,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *LookupRequest) Reset() {
+	*x = LookupRequest{}
+	mi := &file_proto_qrank_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *LookupRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*LookupRequest) ProtoMessage() {}
+
+func (x *LookupRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_qrank_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use LookupRequest.ProtoReflect.Descriptor instead.
+func (*LookupRequest) Descriptor() ([]byte, []int) {
+	return file_proto_qrank_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *LookupRequest) GetEntity() string {
+	if x != nil {
+		return x.Entity
+	}
+	return ""
+}
+
+type BulkLookupRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Entities      []string               `protobuf:"bytes,1,rep,name=entities,proto3" json:"entities,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *BulkLookupRequest) Reset() {
+	*x = BulkLookupRequest{}
+	mi := &file_proto_qrank_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *BulkLookupRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*BulkLookupRequest) ProtoMessage() {}
+
+func (x *BulkLookupRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_qrank_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use BulkLookupRequest.ProtoReflect.Descriptor instead.
+func (*BulkLookupRequest) Descriptor() ([]byte, []int) {
+	return file_proto_qrank_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *BulkLookupRequest) GetEntities() []string {
+	if x != nil {
+		return x.Entities
+	}
+	return nil
+}
+
+type BulkLookupResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Ranks         []*RankInfo            `protobuf:"bytes,1,rep,name=ranks,proto3" json:"ranks,omitempty"`
+	NotFound      []string               `protobuf:"bytes,2,rep,name=not_found,json=notFound,proto3" json:"not_found,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *BulkLookupResponse) Reset() {
+	*x = BulkLookupResponse{}
+	mi := &file_proto_qrank_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *BulkLookupResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*BulkLookupResponse) ProtoMessage() {}
+
+func (x *BulkLookupResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_qrank_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use BulkLookupResponse.ProtoReflect.Descriptor instead.
+func (*BulkLookupResponse) Descriptor() ([]byte, []int) {
+	return file_proto_qrank_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *BulkLookupResponse) GetRanks() []*RankInfo {
+	if x != nil {
+		return x.Ranks
+	}
+	return nil
+}
+
+func (x *BulkLookupResponse) GetNotFound() []string {
+	if x != nil {
+		return x.NotFound
+	}
+	return nil
+}
+
+type StreamTopRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Maximal number of entities to return; zero means all.
+	Limit         int64 `protobuf:"varint,1,opt,name=limit,proto3" json:"limit,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *StreamTopRequest) Reset() {
+	*x = StreamTopRequest{}
+	mi := &file_proto_qrank_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *StreamTopRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*StreamTopRequest) ProtoMessage() {}
+
+func (x *StreamTopRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_qrank_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use StreamTopRequest.ProtoReflect.Descriptor instead.
+func (*StreamTopRequest) Descriptor() ([]byte, []int) {
+	return file_proto_qrank_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *StreamTopRequest) GetLimit() int64 {
+	if x != nil {
+		return x.Limit
+	}
+	return 0
+}
+
+type RankInfo struct {
+	state  protoimpl.MessageState `protogen:"open.v1"`
+	Entity string                 `protobuf:"bytes,1,opt,name=entity,proto3" json:"entity,omitempty"`
+	Qrank  int64                  `protobuf:"varint,2,opt,name=qrank,proto3" json:"qrank,omitempty"`
+	// Position in the ranking, starting at 1.
+	Rank int64 `protobuf:"varint,3,opt,name=rank,proto3" json:"rank,omitempty"`
+	// Percentage of ranked entities that are not ranked higher.
+	Percentile    float64 `protobuf:"fixed64,4,opt,name=percentile,proto3" json:"percentile,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *RankInfo) Reset() {
+	*x = RankInfo{}
+	mi := &file_proto_qrank_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *RankInfo) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*RankInfo) ProtoMessage() {}
+
+func (x *RankInfo) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_qrank_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use RankInfo.ProtoReflect.Descriptor instead.
+func (*RankInfo) Descriptor() ([]byte, []int) {
+	return file_proto_qrank_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *RankInfo) GetEntity() string {
+	if x != nil {
+		return x.Entity
+	}
+	return ""
+}
+
+func (x *RankInfo) GetQrank() int64 {
+	if x != nil {
+		return x.Qrank
+	}
+	return 0
+}
+
+func (x *RankInfo) GetRank() int64 {
+	if x != nil {
+		return x.Rank
+	}
+	return 0
+}
+
+func (x *RankInfo) GetPercentile() float64 {
+	if x != nil {
+		return x.Percentile
+	}
+	return 0
+}
+
+var File_proto_qrank_proto protoreflect.FileDescriptor
+
+const file_proto_qrank_proto_rawDesc = "" +
+	"\n" +
+	"\x11proto/qrank.proto\x12\bqrank.v1\"'\n" +
+	"\rLookupRequest\x12\x16\n" +
+	"\x06entity\x18\x01 \x01(\tR\x06entity\"/\n" +
+	"\x11BulkLookupRequest\x12\x1a\n" +
+	"\bentities\x18\x01 \x03(\tR\bentities\"[\n" +
+	"\x12BulkLookupResponse\x12(\n" +
+	"\x05ranks\x18\x01 \x03(\v2\x12.qrank.v1.RankInfoR\x05ranks\x12\x1b\n" +
+	"\tnot_found\x18\x02 \x03(\tR\bnotFound\"(\n" +
+	"\x10StreamTopRequest\x12\x14\n" +
+	"\x05limit\x18\x01 \x01(\x03R\x05limit\"l\n" +
+	"\bRankInfo\x12\x16\n" +
+	"\x06entity\x18\x01 \x01(\tR\x06entity\x12\x14\n" +
+	"\x05qrank\x18\x02 \x01(\x03R\x05qrank\x12\x12\n" +
+	"\x04rank\x18\x03 \x01(\x03R\x04rank\x12\x1e\n" +
+	"\n" +
+	"percentile\x18\x04 \x01(\x01R\n" +
+	"percentile2\xc6\x01\n" +
+	"\x05QRank\x125\n" +
+	"\x06Lookup\x12\x17.qrank.v1.LookupRequest\x1a\x12.qrank.v1.RankInfo\x12G\n" +
+	"\n" +
+	"BulkLookup\x12\x1b.qrank.v1.BulkLookupRequest\x1a\x1c.qrank.v1.BulkLookupResponse\x12=\n" +
+	"\tStreamTop\x12\x1a.qrank.v1.StreamTopRequest\x1a\x12.qrank.v1.RankInfo0\x01B3Z1github.com/brawer/wikidata-qrank/v2/proto/qrankpbb\x06proto3"
+
+var (
+	file_proto_qrank_proto_rawDescOnce sync.Once
+	file_proto_qrank_proto_rawDescData []byte
+)
+
+func file_proto_qrank_proto_rawDescGZIP() []byte {
+	file_proto_qrank_proto_rawDescOnce.Do(func() {
+		file_proto_qrank_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_proto_qrank_proto_rawDesc), len(file_proto_qrank_proto_rawDesc)))
+	})
+	return file_proto_qrank_proto_rawDescData
+}
+
+var file_proto_qrank_proto_msgTypes = make([]protoimpl.MessageInfo, 5)
+var file_proto_qrank_proto_goTypes = []any{
+	(*LookupRequest)(nil),      // 0: qrank.v1.LookupRequest
+	(*BulkLookupRequest)(nil),  // 1: qrank.v1.BulkLookupRequest
+	(*BulkLookupResponse)(nil), // 2: qrank.v1.BulkLookupResponse
+	(*StreamTopRequest)(nil),   // 3: qrank.v1.StreamTopRequest
+	(*RankInfo)(nil),           // 4: qrank.v1.RankInfo
+}
+var file_proto_qrank_proto_depIdxs = []int32{
+	4, // 0: qrank.v1.BulkLookupResponse.ranks:type_name -> qrank.v1.RankInfo
+	0, // 1: qrank.v1.QRank.Lookup:input_type -> qrank.v1.LookupRequest
+	1, // 2: qrank.v1.QRank.BulkLookup:input_type -> qrank.v1.BulkLookupRequest
+	3, // 3: qrank.v1.QRank.StreamTop:input_type -> qrank.v1.StreamTopRequest
+	4, // 4: qrank.v1.QRank.Lookup:output_type -> qrank.v1.RankInfo
+	2, // 5: qrank.v1.QRank.BulkLookup:output_type -> qrank.v1.BulkLookupResponse
+	4, // 6: qrank.v1.QRank.StreamTop:output_type -> qrank.v1.RankInfo
+	4, // [4:7] is the sub-list for method output_type
+	1, // [1:4] is the sub-list for method input_type
+	1, // [1:1] is the sub-list for extension type_name
+	1, // [1:1] is the sub-list for extension extendee
+	0, // [0:1] is the sub-list for field type_name
+}
+
+func init() { file_proto_qrank_proto_init() }
+func file_proto_qrank_proto_init() {
+	if File_proto_qrank_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_proto_qrank_proto_rawDesc), len(file_proto_qrank_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   5,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_proto_qrank_proto_goTypes,
+		DependencyIndexes: file_proto_qrank_proto_depIdxs,
+		MessageInfos:      file_proto_qrank_proto_msgTypes,
+	}.Build()
+	File_proto_qrank_proto = out.File
+	file_proto_qrank_proto_goTypes = nil
+	file_proto_qrank_proto_depIdxs = nil
+}
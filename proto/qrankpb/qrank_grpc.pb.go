@@ -0,0 +1,225 @@
+// SPDX-FileCopyrightText: 2024 Sascha Brawer <sascha@brawer.ch>
+// SPDX-License-Identifier: MIT
+
+// Service definition for looking up QRank over gRPC. The messages
+// mirror the JSON responses of the webserver's /rank/{qid} and
+// /ranks endpoints, so clients can switch between the two.
+//
+// The generated Go code is in proto/qrankpb. After changing this
+// file, regenerate it with:
+//
+//   protoc --go_out=. --go_opt=module=github.com/brawer/wikidata-qrank/v2 \
+//     --go-grpc_out=. --go-grpc_opt=module=github.com/brawer/wikidata-qrank/v2 \
+//     proto/qrank.proto
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             (unknown)
+// source: proto/qrank.proto
+
+package qrankpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	QRank_Lookup_FullMethodName     = "/qrank.v1.QRank/Lookup"
+	QRank_BulkLookup_FullMethodName = "/qrank.v1.QRank/BulkLookup"
+	QRank_StreamTop_FullMethodName  = "/qrank.v1.QRank/StreamTop"
+)
+
+// QRankClient is the client API for QRank service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type QRankClient interface {
+	// Lookup returns the ranking of a single entity. Entities that
+	// are not ranked produce a NOT_FOUND error.
+	Lookup(ctx context.Context, in *LookupRequest, opts ...grpc.CallOption) (*RankInfo, error)
+	// BulkLookup returns the ranking of up to 10,000 entities at once.
+	BulkLookup(ctx context.Context, in *BulkLookupRequest, opts ...grpc.CallOption) (*BulkLookupResponse, error)
+	// StreamTop streams entities in ranking order, starting with
+	// the highest-ranked one.
+	StreamTop(ctx context.Context, in *StreamTopRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[RankInfo], error)
+}
+
+type qRankClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewQRankClient(cc grpc.ClientConnInterface) QRankClient {
+	return &qRankClient{cc}
+}
+
+func (c *qRankClient) Lookup(ctx context.Context, in *LookupRequest, opts ...grpc.CallOption) (*RankInfo, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(RankInfo)
+	err := c.cc.Invoke(ctx, QRank_Lookup_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *qRankClient) BulkLookup(ctx context.Context, in *BulkLookupRequest, opts ...grpc.CallOption) (*BulkLookupResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(BulkLookupResponse)
+	err := c.cc.Invoke(ctx, QRank_BulkLookup_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *qRankClient) StreamTop(ctx context.Context, in *StreamTopRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[RankInfo], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &QRank_ServiceDesc.Streams[0], QRank_StreamTop_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[StreamTopRequest, RankInfo]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type QRank_StreamTopClient = grpc.ServerStreamingClient[RankInfo]
+
+// QRankServer is the server API for QRank service.
+// All implementations must embed UnimplementedQRankServer
+// for forward compatibility.
+type QRankServer interface {
+	// Lookup returns the ranking of a single entity. Entities that
+	// are not ranked produce a NOT_FOUND error.
+	Lookup(context.Context, *LookupRequest) (*RankInfo, error)
+	// BulkLookup returns the ranking of up to 10,000 entities at once.
+	BulkLookup(context.Context, *BulkLookupRequest) (*BulkLookupResponse, error)
+	// StreamTop streams entities in ranking order, starting with
+	// the highest-ranked one.
+	StreamTop(*StreamTopRequest, grpc.ServerStreamingServer[RankInfo]) error
+	mustEmbedUnimplementedQRankServer()
+}
+
+// UnimplementedQRankServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedQRankServer struct{}
+
+func (UnimplementedQRankServer) Lookup(context.Context, *LookupRequest) (*RankInfo, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Lookup not implemented")
+}
+func (UnimplementedQRankServer) BulkLookup(context.Context, *BulkLookupRequest) (*BulkLookupResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method BulkLookup not implemented")
+}
+func (UnimplementedQRankServer) StreamTop(*StreamTopRequest, grpc.ServerStreamingServer[RankInfo]) error {
+	return status.Errorf(codes.Unimplemented, "method StreamTop not implemented")
+}
+func (UnimplementedQRankServer) mustEmbedUnimplementedQRankServer() {}
+func (UnimplementedQRankServer) testEmbeddedByValue()               {}
+
+// UnsafeQRankServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to QRankServer will
+// result in compilation errors.
+type UnsafeQRankServer interface {
+	mustEmbedUnimplementedQRankServer()
+}
+
+func RegisterQRankServer(s grpc.ServiceRegistrar, srv QRankServer) {
+	// If the following call pancis, it indicates UnimplementedQRankServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&QRank_ServiceDesc, srv)
+}
+
+func _QRank_Lookup_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(LookupRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(QRankServer).Lookup(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: QRank_Lookup_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(QRankServer).Lookup(ctx, req.(*LookupRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _QRank_BulkLookup_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BulkLookupRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(QRankServer).BulkLookup(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: QRank_BulkLookup_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(QRankServer).BulkLookup(ctx, req.(*BulkLookupRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _QRank_StreamTop_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(StreamTopRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(QRankServer).StreamTop(m, &grpc.GenericServerStream[StreamTopRequest, RankInfo]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type QRank_StreamTopServer = grpc.ServerStreamingServer[RankInfo]
+
+// QRank_ServiceDesc is the grpc.ServiceDesc for QRank service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var QRank_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "qrank.v1.QRank",
+	HandlerType: (*QRankServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Lookup",
+			Handler:    _QRank_Lookup_Handler,
+		},
+		{
+			MethodName: "BulkLookup",
+			Handler:    _QRank_BulkLookup_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "StreamTop",
+			Handler:       _QRank_StreamTop_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "proto/qrank.proto",
+}